@@ -159,7 +159,7 @@ export default function Home() {
     }
 
     try {
-      const response = await fetch(`${API_BASE}/api/orders/${mockUser.user_id}`, {
+      const response = await fetch(`${API_BASE}/api/orders/users/${mockUser.user_id}`, {
         method: 'POST',
         headers: { 'Content-Type': 'application/json' },
         body: JSON.stringify({
@@ -0,0 +1,96 @@
+package main
+
+import (
+    "bufio"
+    "fmt"
+    "net/http"
+    "net/url"
+    "os"
+    "strings"
+
+    "github.com/spf13/cobra"
+)
+
+// Helper function to map a service name to its configured URL. Every
+// service exposes DELETE /admin/clear and confirms with its own name.
+func clearableServices() map[string]string {
+    return map[string]string{
+        "product-service":      productURL,
+        "inventory-service":    inventoryURL,
+        "cart-service":         cartURL,
+        "order-service":        orderURL,
+        "payment-service":      paymentURL,
+        "user-service":         userURL,
+        "search-service":       searchURL,
+        "notification-service": notificationURL,
+    }
+}
+
+// Order in which "all" clears services: dependents before the data
+// they reference
+var clearOrder = []string{
+    "order-service", "payment-service", "cart-service", "inventory-service",
+    "search-service", "product-service", "notification-service", "user-service",
+}
+
+func newClearCommand() *cobra.Command {
+    var scope string
+    var yes bool
+
+    cmd := &cobra.Command{
+        Use:   "clear SERVICE... | all",
+        Short: "Clear service data via DELETE /admin/clear",
+        Long: `Clear a service's data. --scope test only removes entities whose IDs
+carry the test- prefix; --scope all wipes everything. Each service must be
+confirmed by typing its name unless --yes is given.`,
+        Args: cobra.MinimumNArgs(1),
+        RunE: func(cmd *cobra.Command, args []string) error {
+            if scope != "test" && scope != "all" {
+                return fmt.Errorf("--scope must be 'test' or 'all'")
+            }
+            if adminToken == "" {
+                return fmt.Errorf("--admin-token or ADMIN_TOKEN is required")
+            }
+
+            services := clearableServices()
+            targets := args
+            if len(args) == 1 && args[0] == "all" {
+                targets = clearOrder
+            }
+            for _, name := range targets {
+                if _, exists := services[name]; !exists {
+                    return fmt.Errorf("unknown service %q", name)
+                }
+            }
+
+            stdin := bufio.NewReader(os.Stdin)
+            for _, name := range targets {
+                if !yes {
+                    fmt.Printf("Clear %s data in %s? Type the service name to confirm: ", scope, name)
+                    answer, _ := stdin.ReadString('\n')
+                    if strings.TrimSpace(answer) != name {
+                        fmt.Printf("Skipped %s\n", name)
+                        continue
+                    }
+                }
+
+                query := url.Values{}
+                query.Set("scope", scope)
+                query.Set("confirm", name)
+                var result map[string]interface{}
+                if err := call(http.MethodDelete, services[name]+"/admin/clear?"+query.Encode(), nil, &result); err != nil {
+                    return err
+                }
+                fmt.Printf("Cleared %s (%s)\n", name, scope)
+                if outputFormat == "json" {
+                    printJSON(result)
+                }
+            }
+            return nil
+        },
+    }
+
+    cmd.Flags().StringVar(&scope, "scope", "test", "test (test- prefixed data only) or all")
+    cmd.Flags().BoolVarP(&yes, "yes", "y", false, "skip the confirmation prompt")
+    return cmd
+}
@@ -0,0 +1,19 @@
+module ecomctl
+
+go 1.21
+
+require (
+	github.com/spf13/cobra v1.8.1
+	money v0.0.0-00010101000000-000000000000
+	webhooks v0.0.0-00010101000000-000000000000
+)
+
+require (
+	github.com/inconshreveable/mousetrap v1.1.0 // indirect
+	github.com/spf13/pflag v1.0.5 // indirect
+)
+
+replace (
+	money => ../../pkg/money
+	webhooks => ../../pkg/webhooks
+)
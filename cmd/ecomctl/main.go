@@ -0,0 +1,82 @@
+// Command ecomctl is an operator CLI for the e-commerce stack. It talks to
+// each service's API directly (not through the gateway), so admin
+// endpoints are reachable with the ADMIN_TOKEN.
+//
+//	ecomctl products list --category audio
+//	ecomctl stock set sku-12345678 40
+//	ecomctl orders list user-123
+//	ecomctl webhooks replay pay_abc123
+//	ecomctl clear cart-service order-service --scope test
+package main
+
+import (
+    "fmt"
+    "os"
+
+    "github.com/spf13/cobra"
+)
+
+// Service URLs and credentials, set from flags or ECOMCTL_* / ADMIN_TOKEN
+var (
+    productURL      string
+    inventoryURL    string
+    cartURL         string
+    orderURL        string
+    paymentURL      string
+    userURL         string
+    searchURL       string
+    notificationURL string
+    adminToken      string
+    outputFormat    string
+)
+
+// Helper function to read a flag default from the environment
+func envOr(name string, fallback string) string {
+    if value := os.Getenv(name); value != "" {
+        return value
+    }
+    return fallback
+}
+
+func newRootCommand() *cobra.Command {
+    root := &cobra.Command{
+        Use:           "ecomctl",
+        Short:         "Operate the e-commerce services from the command line",
+        SilenceUsage:  true,
+        SilenceErrors: true,
+        PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+            if outputFormat != "table" && outputFormat != "json" {
+                return fmt.Errorf("--output must be 'table' or 'json'")
+            }
+            return nil
+        },
+    }
+
+    flags := root.PersistentFlags()
+    flags.StringVar(&productURL, "product-url", envOr("ECOMCTL_PRODUCT_URL", "http://localhost:8001"), "product service URL")
+    flags.StringVar(&inventoryURL, "inventory-url", envOr("ECOMCTL_INVENTORY_URL", "http://localhost:8004"), "inventory service URL")
+    flags.StringVar(&cartURL, "cart-url", envOr("ECOMCTL_CART_URL", "http://localhost:8002"), "cart service URL")
+    flags.StringVar(&orderURL, "order-url", envOr("ECOMCTL_ORDER_URL", "http://localhost:8003"), "order service URL")
+    flags.StringVar(&paymentURL, "payment-url", envOr("ECOMCTL_PAYMENT_URL", "http://localhost:3002"), "payment service URL")
+    flags.StringVar(&userURL, "user-url", envOr("ECOMCTL_USER_URL", "http://localhost:3001"), "user service URL")
+    flags.StringVar(&searchURL, "search-url", envOr("ECOMCTL_SEARCH_URL", "http://localhost:8005"), "search service URL")
+    flags.StringVar(&notificationURL, "notification-url", envOr("ECOMCTL_NOTIFICATION_URL", "http://localhost:8006"), "notification service URL")
+    flags.StringVar(&adminToken, "admin-token", os.Getenv("ADMIN_TOKEN"), "admin bearer token (default $ADMIN_TOKEN)")
+    flags.StringVarP(&outputFormat, "output", "o", "table", "output format: table or json")
+
+    root.AddCommand(
+        newProductsCommand(),
+        newStockCommand(),
+        newOrdersCommand(),
+        newWebhooksCommand(),
+        newClearCommand(),
+    )
+    return root
+}
+
+func main() {
+    if err := newRootCommand().Execute(); err != nil {
+        fmt.Fprintln(os.Stderr, "Error:", err)
+        os.Exit(1)
+    }
+}
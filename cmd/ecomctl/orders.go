@@ -0,0 +1,146 @@
+package main
+
+import (
+    "fmt"
+    "net/http"
+    "net/url"
+    "strconv"
+
+    "github.com/spf13/cobra"
+)
+
+// Order mirrors the order service's order record
+type Order struct {
+    OrderID     string      `json:"order_id"`
+    OrderNumber string      `json:"order_number,omitempty"`
+    UserID      string      `json:"user_id"`
+    Items       []OrderItem `json:"items"`
+    TotalCents  int         `json:"total_cents"`
+    Currency    string      `json:"currency"`
+    Status      string      `json:"status"`
+    PaymentID   string      `json:"payment_id"`
+    CartID      string      `json:"cart_id,omitempty"`
+    CreatedAt   int64       `json:"created_at"`
+    UpdatedAt   int64       `json:"updated_at"`
+}
+
+// OrderItem is one line of an order
+type OrderItem struct {
+    ProductID  string `json:"product_id"`
+    Quantity   int    `json:"qty"`
+    PriceCents int    `json:"price_cents"`
+}
+
+// Statuses accepted by PUT /api/orders/{orderId}/status: the fulfillment
+// steps. The rest are set by checkout, cancellation, refunds and fraud
+// review. The order service only allows moves along its state machine
+// (paid -> shipped -> delivered) and answers others with 409.
+var orderStatuses = []string{"shipped", "delivered"}
+
+func newOrdersCommand() *cobra.Command {
+    cmd := &cobra.Command{
+        Use:     "orders",
+        Aliases: []string{"order"},
+        Short:   "Inspect orders and change their status",
+    }
+    cmd.AddCommand(newOrdersListCommand(), newOrdersGetCommand(), newOrdersSetStatusCommand(), newOrdersCancelCommand())
+    return cmd
+}
+
+// Helper function to render orders
+func printOrders(raw interface{}, orders []Order) error {
+    rows := make([][]string, 0, len(orders))
+    for _, order := range orders {
+        rows = append(rows, []string{order.OrderID, order.OrderNumber, order.UserID, order.Status,
+            strconv.Itoa(len(order.Items)), formatCents(order.TotalCents, order.Currency), order.PaymentID, formatTime(order.CreatedAt)})
+    }
+    return printTable(raw, []string{"ORDER", "NUMBER", "USER", "STATUS", "ITEMS", "TOTAL", "PAYMENT", "CREATED"}, rows)
+}
+
+// Helper function to fetch one order by ID or order number, through the
+// by-number lookup, which accepts either and also finds archived orders.
+func fetchOrder(orderID string) (Order, error) {
+    var order Order
+    if err := call(http.MethodGet, orderURL+"/api/orders/by-number/"+url.PathEscape(orderID), nil, &order); err != nil {
+        return order, err
+    }
+    return order, nil
+}
+
+func newOrdersListCommand() *cobra.Command {
+    return &cobra.Command{
+        Use:   "list USER_ID",
+        Short: "List a user's orders",
+        Args:  cobra.ExactArgs(1),
+        RunE: func(cmd *cobra.Command, args []string) error {
+            var result struct {
+                Orders []Order `json:"orders"`
+                Total  int     `json:"total"`
+            }
+            if err := call(http.MethodGet, orderURL+"/api/orders/users/"+url.PathEscape(args[0]), nil, &result); err != nil {
+                return err
+            }
+            return printOrders(result, result.Orders)
+        },
+    }
+}
+
+func newOrdersGetCommand() *cobra.Command {
+    return &cobra.Command{
+        Use:   "get ORDER_ID|ORDER_NUMBER",
+        Short: "Show one order",
+        Args:  cobra.ExactArgs(1),
+        RunE: func(cmd *cobra.Command, args []string) error {
+            order, err := fetchOrder(args[0])
+            if err != nil {
+                return err
+            }
+            return printJSON(order)
+        },
+    }
+}
+
+func newOrdersSetStatusCommand() *cobra.Command {
+    var reason string
+    cmd := &cobra.Command{
+        Use:   "set-status ORDER_ID|ORDER_NUMBER STATUS",
+        Short: "Move an order to a fulfillment status (shipped, delivered)",
+        Args:  cobra.ExactArgs(2),
+        RunE: func(cmd *cobra.Command, args []string) error {
+            valid := false
+            for _, status := range orderStatuses {
+                if args[1] == status {
+                    valid = true
+                    break
+                }
+            }
+            if !valid {
+                return fmt.Errorf("invalid status %q, must be one of %v", args[1], orderStatuses)
+            }
+
+            var order Order
+            request := map[string]string{"status": args[1], "reason": reason}
+            if err := call(http.MethodPut, orderURL+"/api/orders/"+url.PathEscape(args[0])+"/status", request, &order); err != nil {
+                return err
+            }
+            return printOrders(order, []Order{order})
+        },
+    }
+    cmd.Flags().StringVar(&reason, "reason", "", "why the status changed, recorded on the order")
+    return cmd
+}
+
+func newOrdersCancelCommand() *cobra.Command {
+    return &cobra.Command{
+        Use:   "cancel ORDER_ID|ORDER_NUMBER",
+        Short: "Cancel an order and release its stock",
+        Args:  cobra.ExactArgs(1),
+        RunE: func(cmd *cobra.Command, args []string) error {
+            var order Order
+            if err := call(http.MethodPost, orderURL+"/api/orders/"+url.PathEscape(args[0])+"/cancel", nil, &order); err != nil {
+                return err
+            }
+            return printOrders(order, []Order{order})
+        },
+    }
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+    "fmt"
+    "net/http"
+    "net/url"
+    "strconv"
+
+    "github.com/spf13/cobra"
+)
+
+// Product mirrors the product service's catalog entry
+type Product struct {
+    ProductID   string                 `json:"product_id"`
+    Title       string                 `json:"title"`
+    Description string                 `json:"description"`
+    Categories  []string               `json:"categories"`
+    PriceCents  int                    `json:"price_cents"`
+    Currency    string                 `json:"currency"`
+    Images      []string               `json:"images"`
+    Stock       int                    `json:"stock"`
+    Metadata    map[string]interface{} `json:"metadata,omitempty"`
+    CreatedAt   int64                  `json:"created_at"`
+    UpdatedAt   int64                  `json:"updated_at"`
+}
+
+func newProductsCommand() *cobra.Command {
+    cmd := &cobra.Command{
+        Use:     "products",
+        Aliases: []string{"product"},
+        Short:   "List, inspect, create and delete catalog products",
+    }
+    cmd.AddCommand(newProductsListCommand(), newProductsGetCommand(), newProductsCreateCommand(), newProductsDeleteCommand())
+    return cmd
+}
+
+func newProductsListCommand() *cobra.Command {
+    var category, sort string
+    var limit, offset int
+
+    cmd := &cobra.Command{
+        Use:   "list",
+        Short: "List products",
+        Args:  cobra.NoArgs,
+        RunE: func(cmd *cobra.Command, args []string) error {
+            query := url.Values{}
+            query.Set("limit", strconv.Itoa(limit))
+            query.Set("offset", strconv.Itoa(offset))
+            if category != "" {
+                query.Set("category", category)
+            }
+            if sort != "" {
+                query.Set("sort", sort)
+            }
+
+            var page struct {
+                Products []Product `json:"products"`
+                Total    int       `json:"total"`
+            }
+            if err := call(http.MethodGet, productURL+"/api/products?"+query.Encode(), nil, &page); err != nil {
+                return err
+            }
+
+            rows := make([][]string, 0, len(page.Products))
+            for _, product := range page.Products {
+                rows = append(rows, []string{product.ProductID, product.Title,
+                    formatCents(product.PriceCents, product.Currency), strconv.Itoa(product.Stock)})
+            }
+            if err := printTable(page, []string{"ID", "TITLE", "PRICE", "STOCK"}, rows); err != nil {
+                return err
+            }
+            if outputFormat == "table" {
+                fmt.Printf("\n%d of %d products\n", len(page.Products), page.Total)
+            }
+            return nil
+        },
+    }
+
+    cmd.Flags().StringVar(&category, "category", "", "only products in this category")
+    cmd.Flags().StringVar(&sort, "sort", "", "price_asc or price_desc")
+    cmd.Flags().IntVar(&limit, "limit", 20, "page size (max 100)")
+    cmd.Flags().IntVar(&offset, "offset", 0, "page offset")
+    return cmd
+}
+
+func newProductsGetCommand() *cobra.Command {
+    return &cobra.Command{
+        Use:   "get PRODUCT_ID",
+        Short: "Show one product",
+        Args:  cobra.ExactArgs(1),
+        RunE: func(cmd *cobra.Command, args []string) error {
+            var product Product
+            if err := call(http.MethodGet, productURL+"/api/products/"+url.PathEscape(args[0]), nil, &product); err != nil {
+                return err
+            }
+            return printJSON(product)
+        },
+    }
+}
+
+func newProductsCreateCommand() *cobra.Command {
+    var request struct {
+        Title       string   `json:"title"`
+        Description string   `json:"description"`
+        Categories  []string `json:"categories"`
+        PriceCents  int      `json:"price_cents"`
+        Currency    string   `json:"currency"`
+        Images      []string `json:"images"`
+        Stock       int      `json:"stock"`
+    }
+
+    cmd := &cobra.Command{
+        Use:   "create",
+        Short: "Create a product",
+        Args:  cobra.NoArgs,
+        RunE: func(cmd *cobra.Command, args []string) error {
+            if request.Title == "" || request.PriceCents <= 0 {
+                return fmt.Errorf("--title and a positive --price-cents are required")
+            }
+
+            var product Product
+            if err := call(http.MethodPost, productURL+"/api/products", request, &product); err != nil {
+                return err
+            }
+            return printJSON(product)
+        },
+    }
+
+    cmd.Flags().StringVar(&request.Title, "title", "", "product title (required)")
+    cmd.Flags().StringVar(&request.Description, "description", "", "product description")
+    cmd.Flags().StringSliceVar(&request.Categories, "category", nil, "category (repeatable)")
+    cmd.Flags().IntVar(&request.PriceCents, "price-cents", 0, "price in cents (required)")
+    cmd.Flags().StringVar(&request.Currency, "currency", "USD", "price currency")
+    cmd.Flags().StringSliceVar(&request.Images, "image", nil, "image URL (repeatable)")
+    cmd.Flags().IntVar(&request.Stock, "stock", 0, "catalog stock level (use 'stock set' for inventory)")
+    return cmd
+}
+
+func newProductsDeleteCommand() *cobra.Command {
+    return &cobra.Command{
+        Use:   "delete PRODUCT_ID",
+        Short: "Delete a product",
+        Args:  cobra.ExactArgs(1),
+        RunE: func(cmd *cobra.Command, args []string) error {
+            if err := call(http.MethodDelete, productURL+"/api/products/"+url.PathEscape(args[0]), nil, nil); err != nil {
+                return err
+            }
+            fmt.Printf("Deleted product %s\n", args[0])
+            return nil
+        },
+    }
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+    "fmt"
+    "net/http"
+    "net/url"
+    "strconv"
+
+    "github.com/spf13/cobra"
+)
+
+// InventoryItem mirrors the inventory service's stock record
+type InventoryItem struct {
+    ProductID   string `json:"product_id"`
+    Available   int    `json:"available"`
+    Reserved    int    `json:"reserved"`
+    TotalStock  int    `json:"total_stock"`
+    LastUpdated int64  `json:"last_updated"`
+
+    ReorderThreshold int   `json:"reorder_threshold,omitempty"`
+    LowStockSince    int64 `json:"low_stock_since,omitempty"`
+}
+
+func newStockCommand() *cobra.Command {
+    cmd := &cobra.Command{
+        Use:     "stock",
+        Aliases: []string{"inventory"},
+        Short:   "Inspect and adjust inventory levels",
+    }
+    cmd.AddCommand(
+        newStockListCommand(),
+        newStockGetCommand(),
+        newStockAdjustCommand("set", "Set a product's total stock"),
+        newStockAdjustCommand("add", "Add units to a product's stock"),
+        newStockThresholdCommand(),
+        newStockLowCommand(),
+        newStockMovementsCommand(),
+    )
+    return cmd
+}
+
+// Helper function to render stock records
+func printStock(raw interface{}, items []InventoryItem) error {
+    rows := make([][]string, 0, len(items))
+    for _, item := range items {
+        rows = append(rows, []string{item.ProductID, strconv.Itoa(item.Available),
+            strconv.Itoa(item.Reserved), strconv.Itoa(item.TotalStock), formatTime(item.LastUpdated)})
+    }
+    return printTable(raw, []string{"PRODUCT", "AVAILABLE", "RESERVED", "TOTAL", "UPDATED"}, rows)
+}
+
+func newStockListCommand() *cobra.Command {
+    var sortOrder, prefix, warehouse string
+    var below int
+
+    cmd := &cobra.Command{
+        Use:   "list",
+        Short: "List stock for every product",
+        Args:  cobra.NoArgs,
+        RunE: func(cmd *cobra.Command, args []string) error {
+            query := url.Values{}
+            query.Set("limit", "1000")
+            if sortOrder != "" {
+                query.Set("sort", sortOrder)
+            }
+            if prefix != "" {
+                query.Set("product_id_prefix", prefix)
+            }
+            if below > 0 {
+                query.Set("below_threshold", strconv.Itoa(below))
+            }
+            if warehouse != "" {
+                query.Set("warehouse", warehouse)
+            }
+
+            // Follow the cursor until every page is in
+            var result struct {
+                Inventory []InventoryItem `json:"inventory"`
+            }
+            for {
+                var page struct {
+                    Inventory  []InventoryItem `json:"inventory"`
+                    NextCursor string          `json:"next_cursor"`
+                }
+                if err := call(http.MethodGet, inventoryURL+"/api/inventory?"+query.Encode(), nil, &page); err != nil {
+                    return err
+                }
+                result.Inventory = append(result.Inventory, page.Inventory...)
+                if page.NextCursor == "" {
+                    break
+                }
+                query.Set("cursor", page.NextCursor)
+            }
+            return printStock(result, result.Inventory)
+        },
+    }
+
+    cmd.Flags().StringVar(&sortOrder, "sort", "", "product_id_asc (default), available_asc/desc, reserved_asc/desc or last_updated_asc/desc")
+    cmd.Flags().StringVar(&prefix, "prefix", "", "only products whose ID starts with this")
+    cmd.Flags().IntVar(&below, "below", 0, "only products with fewer than this many available")
+    cmd.Flags().StringVar(&warehouse, "warehouse", "", "only products stocked at this warehouse; --below then counts its stock")
+    return cmd
+}
+
+func newStockGetCommand() *cobra.Command {
+    return &cobra.Command{
+        Use:   "get PRODUCT_ID",
+        Short: "Show stock for one product",
+        Args:  cobra.ExactArgs(1),
+        RunE: func(cmd *cobra.Command, args []string) error {
+            var item InventoryItem
+            if err := call(http.MethodGet, inventoryURL+"/api/inventory/"+url.PathEscape(args[0]), nil, &item); err != nil {
+                return err
+            }
+            return printStock(item, []InventoryItem{item})
+        },
+    }
+}
+
+func newStockAdjustCommand(operation string, short string) *cobra.Command {
+    var warehouse string
+
+    cmd := &cobra.Command{
+        Use:   operation + " PRODUCT_ID QUANTITY",
+        Short: short,
+        Args:  cobra.ExactArgs(2),
+        RunE: func(cmd *cobra.Command, args []string) error {
+            quantity, err := strconv.Atoi(args[1])
+            if err != nil || quantity < 0 {
+                return fmt.Errorf("quantity must be a non-negative integer")
+            }
+
+            request := map[string]interface{}{
+                "product_id": args[0],
+                "quantity":   quantity,
+                "operation":  operation,
+            }
+            if warehouse != "" {
+                request["warehouse_id"] = warehouse
+            }
+            var item InventoryItem
+            if err := call(http.MethodPost, inventoryURL+"/api/inventory/stock", request, &item); err != nil {
+                return err
+            }
+            return printStock(item, []InventoryItem{item})
+        },
+    }
+
+    cmd.Flags().StringVar(&warehouse, "warehouse", "", "warehouse to change the stock at (default: the first in WAREHOUSES)")
+    return cmd
+}
+
+func newStockThresholdCommand() *cobra.Command {
+    return &cobra.Command{
+        Use:   "threshold PRODUCT_ID UNITS",
+        Short: "Set the stock level below which a product is reported low (0 removes it)",
+        Args:  cobra.ExactArgs(2),
+        RunE: func(cmd *cobra.Command, args []string) error {
+            threshold, err := strconv.Atoi(args[1])
+            if err != nil || threshold < 0 {
+                return fmt.Errorf("threshold must be a non-negative integer")
+            }
+            if adminToken == "" {
+                return fmt.Errorf("--admin-token or ADMIN_TOKEN is required")
+            }
+
+            var item InventoryItem
+            path := "/api/inventory/" + url.PathEscape(args[0]) + "/threshold"
+            if err := call(http.MethodPost, inventoryURL+path, map[string]int{"threshold": threshold}, &item); err != nil {
+                return err
+            }
+            return printStock(item, []InventoryItem{item})
+        },
+    }
+}
+
+func newStockLowCommand() *cobra.Command {
+    return &cobra.Command{
+        Use:   "low",
+        Short: "List products below their reorder threshold, furthest below first",
+        Args:  cobra.NoArgs,
+        RunE: func(cmd *cobra.Command, args []string) error {
+            var result struct {
+                Items []struct {
+                    InventoryItem
+                    Shortfall int `json:"shortfall"`
+                } `json:"items"`
+            }
+            if err := call(http.MethodGet, inventoryURL+"/api/inventory/low-stock", nil, &result); err != nil {
+                return err
+            }
+
+            rows := make([][]string, 0, len(result.Items))
+            for _, item := range result.Items {
+                rows = append(rows, []string{item.ProductID, strconv.Itoa(item.Available),
+                    strconv.Itoa(item.ReorderThreshold), strconv.Itoa(item.Shortfall), formatTime(item.LowStockSince)})
+            }
+            return printTable(result, []string{"PRODUCT", "AVAILABLE", "THRESHOLD", "SHORT", "LOW SINCE"}, rows)
+        },
+    }
+}
+
+// StockMovement mirrors the inventory service's stock movement record
+type StockMovement struct {
+    Seq             int64  `json:"seq"`
+    Type            string `json:"type"`
+    WarehouseID     string `json:"warehouse_id,omitempty"`
+    Quantity        int    `json:"quantity"`
+    AvailableDelta  int    `json:"available_delta"`
+    ReservedDelta   int    `json:"reserved_delta"`
+    TotalStockDelta int    `json:"total_stock_delta"`
+    Available       int    `json:"available"`
+    Reserved        int    `json:"reserved"`
+    TotalStock      int    `json:"total_stock"`
+    Actor           string `json:"actor,omitempty"`
+    ReservationID   string `json:"reservation_id,omitempty"`
+    ReferenceType   string `json:"reference_type,omitempty"`
+    Reference       string `json:"reference,omitempty"`
+    OrderID         string `json:"order_id,omitempty"`
+    ReleaseID       string `json:"release_id,omitempty"`
+    At              int64  `json:"at"`
+}
+
+func newStockMovementsCommand() *cobra.Command {
+    return &cobra.Command{
+        Use:   "movements PRODUCT_ID",
+        Short: "List every change to a product's stock, oldest first",
+        Args:  cobra.ExactArgs(1),
+        RunE: func(cmd *cobra.Command, args []string) error {
+            query := url.Values{}
+            query.Set("limit", "1000")
+
+            // Follow the cursor until every page is in
+            var result struct {
+                ProductID string          `json:"product_id"`
+                Movements []StockMovement `json:"movements"`
+            }
+            for {
+                var page struct {
+                    ProductID  string          `json:"product_id"`
+                    Movements  []StockMovement `json:"movements"`
+                    NextCursor string          `json:"next_cursor"`
+                }
+                path := "/api/inventory/" + url.PathEscape(args[0]) + "/movements?" + query.Encode()
+                if err := call(http.MethodGet, inventoryURL+path, nil, &page); err != nil {
+                    return err
+                }
+                result.ProductID = page.ProductID
+                result.Movements = append(result.Movements, page.Movements...)
+                if page.NextCursor == "" {
+                    break
+                }
+                query.Set("cursor", page.NextCursor)
+            }
+
+            rows := make([][]string, 0, len(result.Movements))
+            for _, movement := range result.Movements {
+                reference := movement.OrderID
+                if reference == "" && movement.Reference != "" {
+                    reference = movement.ReferenceType + " " + movement.Reference
+                }
+                rows = append(rows, []string{strconv.FormatInt(movement.Seq, 10), movement.Type, movement.WarehouseID,
+                    fmt.Sprintf("%+d", movement.AvailableDelta), fmt.Sprintf("%+d", movement.ReservedDelta), fmt.Sprintf("%+d", movement.TotalStockDelta),
+                    movement.Actor, reference, formatTime(movement.At)})
+            }
+            return printTable(result, []string{"SEQ", "TYPE", "WAREHOUSE", "AVAILABLE", "RESERVED", "TOTAL", "ACTOR", "REFERENCE", "AT"}, rows)
+        },
+    }
+}
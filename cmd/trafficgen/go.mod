@@ -0,0 +1,3 @@
+module trafficgen
+
+go 1.21
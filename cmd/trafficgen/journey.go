@@ -0,0 +1,192 @@
+package main
+
+import (
+    "bytes"
+    "context"
+    "encoding/json"
+    "fmt"
+    "io"
+    "math/rand"
+    "net/http"
+    "net/url"
+    "strings"
+    "time"
+)
+
+// Product is the subset of the catalog entry a shopper looks at
+type Product struct {
+    ProductID  string `json:"product_id"`
+    Title      string `json:"title"`
+    PriceCents int    `json:"price_cents"`
+}
+
+// Cart is the subset of the cart a shopper needs to check out
+type Cart struct {
+    CartID string `json:"cart_id"`
+}
+
+// Order is the subset of the order a shopper needs to cancel it
+type Order struct {
+    OrderID string `json:"order_id"`
+    Status  string `json:"status"`
+}
+
+// Shopper drives one journey through the gateway
+type Shopper struct {
+    cfg    *Config
+    client *http.Client
+    stats  *Stats
+    rng    *rand.Rand
+    userID string
+}
+
+// Helper function to send a request, timing it under the given step.
+// Decodes the JSON response into out (if non-nil) on 2xx.
+func (s *Shopper) call(ctx context.Context, step string, method string, path string, body interface{}, out interface{}) (int, error) {
+    var reader io.Reader
+    if body != nil {
+        data, err := json.Marshal(body)
+        if err != nil {
+            return 0, err
+        }
+        reader = bytes.NewReader(data)
+    }
+
+    req, err := http.NewRequestWithContext(ctx, method, s.cfg.Target+path, reader)
+    if err != nil {
+        return 0, err
+    }
+    if body != nil {
+        req.Header.Set("Content-Type", "application/json")
+    }
+    if s.cfg.APIKey != "" {
+        req.Header.Set("X-API-Key", s.cfg.APIKey)
+    }
+    req.Header.Set("User-Agent", "trafficgen")
+
+    start := time.Now()
+    resp, err := s.client.Do(req)
+    if err != nil {
+        if ctx.Err() == nil {
+            s.stats.record(step, time.Since(start), true)
+        }
+        return 0, err
+    }
+    defer resp.Body.Close()
+
+    if resp.StatusCode >= 300 {
+        io.Copy(io.Discard, resp.Body)
+        s.stats.record(step, time.Since(start), true)
+        return resp.StatusCode, fmt.Errorf("%s %s: status %d", method, path, resp.StatusCode)
+    }
+
+    if out != nil {
+        err = json.NewDecoder(resp.Body).Decode(out)
+    } else {
+        io.Copy(io.Discard, resp.Body)
+    }
+    s.stats.record(step, time.Since(start), err != nil)
+    return resp.StatusCode, err
+}
+
+// Helper function to pause like a person reading the page
+func (s *Shopper) think(ctx context.Context) bool {
+    if s.cfg.ThinkTime <= 0 {
+        return ctx.Err() == nil
+    }
+    delay := time.Duration(s.rng.Int63n(int64(s.cfg.ThinkTime)))
+    select {
+    case <-time.After(delay):
+        return true
+    case <-ctx.Done():
+        return false
+    }
+}
+
+// Run one shopper journey: browse → add to cart → checkout → cancel some.
+// Returns how the journey ended.
+func (s *Shopper) run(ctx context.Context) string {
+    // Browse a catalog page
+    sorts := []string{"price_asc", "price_desc"}
+    var page struct {
+        Products []Product `json:"products"`
+    }
+    path := fmt.Sprintf("/api/products?limit=20&sort=%s", sorts[s.rng.Intn(len(sorts))])
+    if _, err := s.call(ctx, "browse", "GET", path, nil, &page); err != nil || len(page.Products) == 0 {
+        return "no_catalog"
+    }
+
+    // Some shoppers search for something they saw
+    if s.rng.Float64() < s.cfg.SearchRatio {
+        words := strings.Fields(page.Products[s.rng.Intn(len(page.Products))].Title)
+        if len(words) > 0 {
+            query := url.QueryEscape(strings.ToLower(words[s.rng.Intn(len(words))]))
+            s.call(ctx, "search", "GET", "/api/search?limit=10&q="+query, nil, nil)
+        }
+    }
+
+    // Look at a few product pages
+    viewed := make([]Product, 0, 3)
+    for i := 0; i < 1+s.rng.Intn(3); i++ {
+        if !s.think(ctx) {
+            return "interrupted"
+        }
+        product := page.Products[s.rng.Intn(len(page.Products))]
+        if _, err := s.call(ctx, "view", "GET", "/api/storefront/products/"+url.PathEscape(product.ProductID), nil, nil); err == nil {
+            viewed = append(viewed, product)
+        }
+    }
+
+    if len(viewed) == 0 || s.rng.Float64() >= s.cfg.AddToCartRatio {
+        return "browsed"
+    }
+
+    // Add some of what was viewed to the cart
+    var cart Cart
+    for _, product := range viewed {
+        if !s.think(ctx) {
+            return "interrupted"
+        }
+        item := map[string]interface{}{"product_id": product.ProductID, "qty": 1 + s.rng.Intn(2)}
+        s.call(ctx, "add_to_cart", "POST", "/api/cart/"+s.userID+"/add", item, &cart)
+    }
+    if cart.CartID == "" {
+        return "cart_failed"
+    }
+
+    if s.rng.Float64() >= s.cfg.CheckoutRatio {
+        // Abandoned carts release their reservations so soak runs don't
+        // drain stock
+        if s.cfg.ClearAbandoned {
+            s.call(ctx, "clear_cart", "DELETE", "/api/cart/"+s.userID+"/clear", nil, nil)
+        }
+        return "abandoned"
+    }
+
+    // Check out
+    if !s.think(ctx) {
+        return "interrupted"
+    }
+    var order Order
+    checkout := map[string]string{"cart_id": cart.CartID, "payment_method": s.cfg.PaymentMethod}
+    status, err := s.call(ctx, "checkout", "POST", "/api/orders/users/"+s.userID, checkout, &order)
+    if err != nil {
+        if status == http.StatusPaymentRequired {
+            return "declined"
+        }
+        return "checkout_failed"
+    }
+    if status != http.StatusAccepted {
+        // Paid orders can only be refunded, which shoppers can't do
+        return "paid"
+    }
+
+    // Waiting on a 3-D Secure challenge nobody will complete; some
+    // shoppers give up and cancel instead
+    if order.Status == "pending_payment" && s.rng.Float64() < s.cfg.CancelRatio && s.think(ctx) {
+        if _, err := s.call(ctx, "cancel", "POST", "/api/orders/"+url.PathEscape(order.OrderID)+"/cancel", nil, nil); err == nil {
+            return "cancelled"
+        }
+    }
+    return "pending_payment"
+}
@@ -0,0 +1,164 @@
+// Command trafficgen drives realistic shopper journeys (browse → add to
+// cart → checkout → cancel some) against an environment through the API
+// gateway, for soak testing and demo data generation.
+//
+//	go run . -target http://localhost:8000 -rate 5 -duration 10m
+//
+// Shoppers use IDs under the test- prefix, so the data they create can be
+// removed with the services' ?scope=test clears.
+package main
+
+import (
+    "context"
+    "flag"
+    "fmt"
+    "log"
+    "math/rand"
+    "net/http"
+    "os"
+    "os/signal"
+    "strings"
+    "sync"
+    "syscall"
+    "time"
+)
+
+// Config holds the run settings
+type Config struct {
+    Target         string
+    APIKey         string
+    Rate           float64 // journeys started per second
+    Duration       time.Duration
+    Concurrency    int
+    Users          int
+    UserPrefix     string
+    ThinkTime      time.Duration
+    SearchRatio    float64
+    AddToCartRatio float64
+    CheckoutRatio  float64
+    CancelRatio    float64
+    ClearAbandoned bool
+    PaymentMethod  string
+    ReportEvery    time.Duration
+    Seed           int64
+}
+
+// Helper function to parse flags into a validated config
+func parseConfig() (*Config, error) {
+    cfg := &Config{}
+    flag.StringVar(&cfg.Target, "target", "http://localhost:8000", "gateway base URL")
+    flag.StringVar(&cfg.APIKey, "api-key", os.Getenv("TRAFFICGEN_API_KEY"), "gateway API key (X-API-Key), if required")
+    flag.Float64Var(&cfg.Rate, "rate", 2, "journeys started per second")
+    flag.DurationVar(&cfg.Duration, "duration", 0, "how long to run (0: until interrupted)")
+    flag.IntVar(&cfg.Concurrency, "concurrency", 50, "maximum journeys in flight; new journeys are skipped beyond it")
+    flag.IntVar(&cfg.Users, "users", 1000, "number of distinct shoppers to cycle through")
+    flag.StringVar(&cfg.UserPrefix, "user-prefix", "test-shopper-", "shopper ID prefix (keep test- for scoped cleanup)")
+    flag.DurationVar(&cfg.ThinkTime, "think-time", 2*time.Second, "maximum pause between a shopper's steps")
+    flag.Float64Var(&cfg.SearchRatio, "search-ratio", 0.4, "fraction of shoppers who search")
+    flag.Float64Var(&cfg.AddToCartRatio, "add-ratio", 0.5, "fraction of shoppers who add to cart")
+    flag.Float64Var(&cfg.CheckoutRatio, "checkout-ratio", 0.6, "fraction of carts that are checked out")
+    flag.Float64Var(&cfg.CancelRatio, "cancel-ratio", 0.1, "fraction of orders awaiting 3-D Secure that are cancelled")
+    flag.BoolVar(&cfg.ClearAbandoned, "clear-abandoned", true, "clear abandoned carts so their stock is released")
+    flag.StringVar(&cfg.PaymentMethod, "payment-method", "credit_card", "payment method used at checkout")
+    flag.DurationVar(&cfg.ReportEvery, "report-every", 10*time.Second, "progress report interval (0: only at the end)")
+    flag.Int64Var(&cfg.Seed, "seed", 0, "random seed for reproducible runs (0: time-based)")
+    flag.Parse()
+
+    cfg.Target = strings.TrimRight(cfg.Target, "/")
+    if cfg.Rate <= 0 {
+        return nil, fmt.Errorf("-rate must be positive")
+    }
+    if cfg.Concurrency <= 0 || cfg.Users <= 0 {
+        return nil, fmt.Errorf("-concurrency and -users must be positive")
+    }
+    for name, ratio := range map[string]float64{
+        "-search-ratio":   cfg.SearchRatio,
+        "-add-ratio":      cfg.AddToCartRatio,
+        "-checkout-ratio": cfg.CheckoutRatio,
+        "-cancel-ratio":   cfg.CancelRatio,
+    } {
+        if ratio < 0 || ratio > 1 {
+            return nil, fmt.Errorf("%s must be between 0 and 1", name)
+        }
+    }
+    if cfg.Seed == 0 {
+        cfg.Seed = time.Now().UnixNano()
+    }
+    return cfg, nil
+}
+
+func main() {
+    cfg, err := parseConfig()
+    if err != nil {
+        log.Fatal(err)
+    }
+
+    ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+    defer stop()
+    if cfg.Duration > 0 {
+        var cancel context.CancelFunc
+        ctx, cancel = context.WithTimeout(ctx, cfg.Duration)
+        defer cancel()
+    }
+
+    log.Printf("Driving %.1f journeys/s against %s (seed %d)", cfg.Rate, cfg.Target, cfg.Seed)
+
+    stats := newStats()
+    client := &http.Client{
+        Timeout: 30 * time.Second,
+        Transport: &http.Transport{
+            MaxIdleConns:        cfg.Concurrency,
+            MaxIdleConnsPerHost: cfg.Concurrency,
+            IdleConnTimeout:     90 * time.Second,
+        },
+    }
+
+    rng := rand.New(rand.NewSource(cfg.Seed))
+    slots := make(chan struct{}, cfg.Concurrency)
+    var wg sync.WaitGroup
+
+    ticker := time.NewTicker(time.Duration(float64(time.Second) / cfg.Rate))
+    defer ticker.Stop()
+
+    var report <-chan time.Time
+    if cfg.ReportEvery > 0 {
+        reportTicker := time.NewTicker(cfg.ReportEvery)
+        defer reportTicker.Stop()
+        report = reportTicker.C
+    }
+
+    for {
+        select {
+        case <-ctx.Done():
+            log.Printf("Stopping; waiting for in-flight journeys")
+            wg.Wait()
+            fmt.Print(stats.summary())
+            return
+        case <-report:
+            fmt.Print(stats.summary())
+        case <-ticker.C:
+            select {
+            case slots <- struct{}{}:
+            default:
+                // At the cap: skip rather than queue, so the offered rate
+                // never bursts once the target recovers
+                stats.skip()
+                continue
+            }
+
+            shopper := &Shopper{
+                cfg:    cfg,
+                client: client,
+                stats:  stats,
+                rng:    rand.New(rand.NewSource(rng.Int63())),
+                userID: fmt.Sprintf("%s%d", cfg.UserPrefix, rng.Intn(cfg.Users)),
+            }
+            wg.Add(1)
+            go func() {
+                defer wg.Done()
+                defer func() { <-slots }()
+                stats.finish(shopper.run(ctx))
+            }()
+        }
+    }
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+    "fmt"
+    "sort"
+    "strings"
+    "sync"
+    "time"
+)
+
+// Latency percentiles cover the most recent samples so soak runs stay
+// bounded in memory
+const MaxLatencySamples = 10000
+
+// stepStats aggregates the outcomes of one journey step
+type stepStats struct {
+    Requests  int
+    Failures  int
+    Latencies []time.Duration
+}
+
+// Stats collects per-step counters for the whole run
+type Stats struct {
+    mu        sync.Mutex
+    steps     map[string]*stepStats
+    journeys  int
+    skipped   int
+    outcomes  map[string]int // how journeys ended: browsed, abandoned, paid, cancelled, ...
+    startedAt time.Time
+}
+
+func newStats() *Stats {
+    return &Stats{
+        steps:     make(map[string]*stepStats),
+        outcomes:  make(map[string]int),
+        startedAt: time.Now(),
+    }
+}
+
+// Helper function to record one request
+func (s *Stats) record(step string, latency time.Duration, failed bool) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    st, exists := s.steps[step]
+    if !exists {
+        st = &stepStats{}
+        s.steps[step] = st
+    }
+    st.Requests++
+    if failed {
+        st.Failures++
+    }
+    if len(st.Latencies) < MaxLatencySamples {
+        st.Latencies = append(st.Latencies, latency)
+    } else {
+        st.Latencies[st.Requests%MaxLatencySamples] = latency
+    }
+}
+
+// Helper function to record how a journey ended
+func (s *Stats) finish(outcome string) {
+    s.mu.Lock()
+    s.journeys++
+    s.outcomes[outcome]++
+    s.mu.Unlock()
+}
+
+// Helper function to count a journey dropped because the concurrency cap was hit
+func (s *Stats) skip() {
+    s.mu.Lock()
+    s.skipped++
+    s.mu.Unlock()
+}
+
+// Helper function to pick a percentile from sorted latencies
+func percentile(sorted []time.Duration, p float64) time.Duration {
+    if len(sorted) == 0 {
+        return 0
+    }
+    index := int(float64(len(sorted)-1) * p)
+    return sorted[index]
+}
+
+// Helper function to render a summary table
+func (s *Stats) summary() string {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    elapsed := time.Since(s.startedAt).Round(time.Second)
+    var b strings.Builder
+    fmt.Fprintf(&b, "after %s: %d journeys, %d skipped (concurrency cap)\n", elapsed, s.journeys, s.skipped)
+
+    var outcomes []string
+    for outcome := range s.outcomes {
+        outcomes = append(outcomes, outcome)
+    }
+    sort.Strings(outcomes)
+    for _, outcome := range outcomes {
+        fmt.Fprintf(&b, "  %-16s %d\n", outcome, s.outcomes[outcome])
+    }
+
+    var steps []string
+    for step := range s.steps {
+        steps = append(steps, step)
+    }
+    sort.Strings(steps)
+    fmt.Fprintf(&b, "  %-16s %8s %8s %9s %9s %9s\n", "step", "requests", "failures", "p50", "p95", "p99")
+    for _, step := range steps {
+        st := s.steps[step]
+        sorted := append([]time.Duration{}, st.Latencies...)
+        sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+        fmt.Fprintf(&b, "  %-16s %8d %8d %9s %9s %9s\n", step, st.Requests, st.Failures,
+            percentile(sorted, 0.50).Round(time.Millisecond),
+            percentile(sorted, 0.95).Round(time.Millisecond),
+            percentile(sorted, 0.99).Round(time.Millisecond))
+    }
+    return b.String()
+}
@@ -0,0 +1,205 @@
+// Package events defines the domain events the e-commerce services
+// exchange: their types, payloads, JSON schemas and schema versions.
+//
+// An event is a flat JSON object. The envelope fields
+//
+//	{"event_id": "...", "type": "order.paid", "schema_version": 2,
+//	 "occurred_at": <unix seconds>, "trace_id": "...", "replayed": true}
+//
+// sit next to the payload's own fields, e.g. "order_id" and "order" for
+// order events. Events are delivered in batches as {"events": [...]}.
+//
+// Consumers decode a delivery with DecodeBatch, which upcasts events
+// written under older schema versions to the current one, and then read
+// each payload with Payload:
+//
+//	batch, err := events.DecodeBatch(body)
+//	for _, event := range batch {
+//	    if event.Type == events.TypeOrderPaid {
+//	        var paid events.OrderChanged
+//	        if err := event.Payload(&paid); err != nil { ... }
+//	    }
+//	}
+//
+// Event IDs are stable for a given change, so replays carry the same ID
+// and consumers can deduplicate on it.
+//
+// Producers build their events with New, which stamps the current schema
+// version of the type. Bump the schema version (adding an upcaster) for
+// any change an older consumer could misread.
+package events
+
+import (
+    "encoding/json"
+    "errors"
+    "fmt"
+)
+
+// Decoding errors
+var (
+    ErrMissingType    = errors.New("events: event has no type")
+    ErrUnknownType    = errors.New("events: unknown event type")
+    ErrFutureVersion  = errors.New("events: schema version is newer than this package")
+    ErrMissingEventID = errors.New("events: event has no event_id")
+)
+
+// Envelope is one event: the metadata every event carries, plus its
+// payload fields
+type Envelope struct {
+    EventID       string `json:"event_id"`
+    Type          string `json:"type"`
+    SchemaVersion int    `json:"schema_version"`
+    OccurredAt    int64  `json:"occurred_at"`       // Unix seconds
+    TraceID       string `json:"trace_id,omitempty"` // W3C trace ID of the request that caused the event
+    Replayed      bool   `json:"replayed,omitempty"` // re-sent by an admin replay
+
+    // Data holds the payload's fields as a JSON object
+    Data json.RawMessage `json:"-"`
+}
+
+// envelopeFields are the keys reserved for metadata; payloads must not
+// use them
+var envelopeFields = []string{"event_id", "type", "schema_version", "occurred_at", "trace_id", "replayed"}
+
+// New builds an event of the current schema version for eventType.
+// payload must marshal to a JSON object.
+func New(eventType string, eventID string, occurredAt int64, traceID string, payload interface{}) (Envelope, error) {
+    version, known := CurrentVersion(eventType)
+    if !known {
+        return Envelope{}, fmt.Errorf("%w: %s", ErrUnknownType, eventType)
+    }
+    data, err := json.Marshal(payload)
+    if err != nil {
+        return Envelope{}, err
+    }
+    if _, err := payloadFields(data); err != nil {
+        return Envelope{}, err
+    }
+    return Envelope{
+        EventID:       eventID,
+        Type:          eventType,
+        SchemaVersion: version,
+        OccurredAt:    occurredAt,
+        TraceID:       traceID,
+        Data:          data,
+    }, nil
+}
+
+// Payload decodes the event's payload fields into v
+func (e Envelope) Payload(v interface{}) error {
+    if len(e.Data) == 0 {
+        return json.Unmarshal([]byte("{}"), v)
+    }
+    return json.Unmarshal(e.Data, v)
+}
+
+// MarshalJSON writes the metadata and the payload fields as one object
+func (e Envelope) MarshalJSON() ([]byte, error) {
+    fields, err := payloadFields(e.Data)
+    if err != nil {
+        return nil, err
+    }
+
+    type metadata Envelope
+    meta, err := json.Marshal(metadata(e))
+    if err != nil {
+        return nil, err
+    }
+    if err := json.Unmarshal(meta, &fields); err != nil {
+        return nil, err
+    }
+    return json.Marshal(fields)
+}
+
+// Helper function to split a payload into its fields, checking that it is
+// an object and stays clear of the envelope's fields
+func payloadFields(data json.RawMessage) (map[string]json.RawMessage, error) {
+    fields := map[string]json.RawMessage{}
+    if len(data) == 0 {
+        return fields, nil
+    }
+    if err := json.Unmarshal(data, &fields); err != nil || fields == nil {
+        return nil, errors.New("events: payload is not a JSON object")
+    }
+    for _, key := range envelopeFields {
+        if _, clash := fields[key]; clash {
+            return nil, fmt.Errorf("events: payload uses reserved field %q", key)
+        }
+    }
+    return fields, nil
+}
+
+// UnmarshalJSON splits an event into its metadata and payload fields. It
+// does not upcast; use Decode for that.
+func (e *Envelope) UnmarshalJSON(data []byte) error {
+    type metadata Envelope
+    var meta metadata
+    if err := json.Unmarshal(data, &meta); err != nil {
+        return err
+    }
+
+    var fields map[string]json.RawMessage
+    if err := json.Unmarshal(data, &fields); err != nil {
+        return err
+    }
+    for _, key := range envelopeFields {
+        delete(fields, key)
+    }
+    payload, err := json.Marshal(fields)
+    if err != nil {
+        return err
+    }
+
+    *e = Envelope(meta)
+    e.Data = payload
+    return nil
+}
+
+// Decode parses one event and upcasts it to the current schema version of
+// its type. Events without a schema_version predate versioning and are
+// read as version 1.
+func Decode(data []byte) (Envelope, error) {
+    var event Envelope
+    if err := json.Unmarshal(data, &event); err != nil {
+        return Envelope{}, err
+    }
+    if event.Type == "" {
+        return Envelope{}, ErrMissingType
+    }
+    if event.EventID == "" {
+        return Envelope{}, ErrMissingEventID
+    }
+    if event.SchemaVersion == 0 {
+        event.SchemaVersion = 1
+    }
+    return Upcast(event)
+}
+
+// DecodeBatch parses a {"events": [...]} delivery, upcasting every event.
+// It stops at the first event that can't be decoded.
+func DecodeBatch(data []byte) ([]Envelope, error) {
+    var batch struct {
+        Events []json.RawMessage `json:"events"`
+    }
+    if err := json.Unmarshal(data, &batch); err != nil {
+        return nil, err
+    }
+
+    decoded := make([]Envelope, 0, len(batch.Events))
+    for i, raw := range batch.Events {
+        event, err := Decode(raw)
+        if err != nil {
+            return nil, fmt.Errorf("event %d: %w", i, err)
+        }
+        decoded = append(decoded, event)
+    }
+    return decoded, nil
+}
+
+// EncodeBatch writes events as a {"events": [...]} delivery
+func EncodeBatch(batch []Envelope) ([]byte, error) {
+    if batch == nil {
+        batch = []Envelope{}
+    }
+    return json.Marshal(map[string]interface{}{"events": batch})
+}
@@ -0,0 +1,158 @@
+package events
+
+import (
+    "embed"
+    "encoding/json"
+    "fmt"
+    "math"
+    "reflect"
+    "strings"
+)
+
+// Schemas are JSON Schema documents named <type>.v<version>.json; the
+// order lifecycle types share order.v<version>.json
+//
+//go:embed schemas/*.json
+var schemaFiles embed.FS
+
+// Helper function to name the schema file of a type and version
+func schemaFile(eventType string, version int) string {
+    if strings.HasPrefix(eventType, "order.") {
+        eventType = "order"
+    }
+    return fmt.Sprintf("schemas/%s.v%d.json", eventType, version)
+}
+
+// Schema returns the JSON Schema of an event type at a schema version
+func Schema(eventType string, version int) ([]byte, error) {
+    if _, known := CurrentVersion(eventType); !known {
+        return nil, fmt.Errorf("%w: %s", ErrUnknownType, eventType)
+    }
+    data, err := schemaFiles.ReadFile(schemaFile(eventType, version))
+    if err != nil {
+        return nil, fmt.Errorf("events: no schema for %s version %d", eventType, version)
+    }
+    return data, nil
+}
+
+// Validate checks an event against the schema of its type and version.
+// It understands the keywords the bundled schemas use: type, required,
+// properties, items, enum, const and minimum.
+func Validate(event Envelope) error {
+    data, err := Schema(event.Type, event.SchemaVersion)
+    if err != nil {
+        return err
+    }
+    var schema map[string]interface{}
+    if err := json.Unmarshal(data, &schema); err != nil {
+        return fmt.Errorf("events: schema for %s version %d: %w", event.Type, event.SchemaVersion, err)
+    }
+
+    encoded, err := json.Marshal(event)
+    if err != nil {
+        return err
+    }
+    var document interface{}
+    if err := json.Unmarshal(encoded, &document); err != nil {
+        return err
+    }
+    return validateValue(schema, document, "")
+}
+
+// Helper function to check one value against a (sub)schema
+func validateValue(schema map[string]interface{}, value interface{}, path string) error {
+    name := path
+    if name == "" {
+        name = "event"
+    }
+
+    if expected, exists := schema["const"]; exists && !reflect.DeepEqual(expected, value) {
+        return fmt.Errorf("events: %s must be %v", name, expected)
+    }
+    if allowed, exists := schema["enum"].([]interface{}); exists {
+        found := false
+        for _, candidate := range allowed {
+            if reflect.DeepEqual(candidate, value) {
+                found = true
+                break
+            }
+        }
+        if !found {
+            return fmt.Errorf("events: %s must be one of %v", name, allowed)
+        }
+    }
+
+    if kind, exists := schema["type"].(string); exists && !hasType(value, kind) {
+        return fmt.Errorf("events: %s must be of type %s", name, kind)
+    }
+    if minimum, exists := schema["minimum"].(float64); exists {
+        if number, isNumber := value.(float64); isNumber && number < minimum {
+            return fmt.Errorf("events: %s must be at least %v", name, minimum)
+        }
+    }
+
+    if object, isObject := value.(map[string]interface{}); isObject {
+        required, _ := schema["required"].([]interface{})
+        for _, field := range required {
+            if _, exists := object[field.(string)]; !exists {
+                return fmt.Errorf("events: %s is required", join(path, field.(string)))
+            }
+        }
+        properties, _ := schema["properties"].(map[string]interface{})
+        for field, subschema := range properties {
+            fieldValue, exists := object[field]
+            if !exists {
+                continue
+            }
+            if err := validateValue(subschema.(map[string]interface{}), fieldValue, join(path, field)); err != nil {
+                return err
+            }
+        }
+    }
+
+    if array, isArray := value.([]interface{}); isArray {
+        if items, exists := schema["items"].(map[string]interface{}); exists {
+            for i, item := range array {
+                if err := validateValue(items, item, fmt.Sprintf("%s[%d]", name, i)); err != nil {
+                    return err
+                }
+            }
+        }
+    }
+    return nil
+}
+
+// Helper function to check a decoded JSON value against a JSON Schema type
+func hasType(value interface{}, kind string) bool {
+    switch kind {
+    case "object":
+        _, ok := value.(map[string]interface{})
+        return ok
+    case "array":
+        _, ok := value.([]interface{})
+        return ok
+    case "string":
+        _, ok := value.(string)
+        return ok
+    case "boolean":
+        _, ok := value.(bool)
+        return ok
+    case "number":
+        _, ok := value.(float64)
+        return ok
+    case "integer":
+        number, ok := value.(float64)
+        return ok && number == math.Trunc(number)
+    case "null":
+        return value == nil
+    }
+    return false
+}
+
+// Helper function to build a field path for error messages
+func join(path string, field string) string {
+    if path == "" {
+        return field
+    }
+    return path + "." + field
+}
@@ -0,0 +1,265 @@
+package events
+
+// Event types
+const (
+    TypeOrderCreated   = "order.created"
+    TypeOrderPaid      = "order.paid"
+    TypeOrderShipped   = "order.shipped"
+    TypeOrderCancelled = "order.cancelled"
+    TypeOrderRefunded  = "order.refunded"
+
+    TypeStockChanged    = "inventory.stock_changed"
+    TypeBackordered     = "inventory.backordered"
+    TypeBackorderFilled = "inventory.backorder_filled"
+    TypeLowStock        = "inventory.low_stock"
+    TypeProductUpdated  = "product.updated"
+    TypeCartAbandoned   = "cart.abandoned"
+)
+
+// currentVersions is the schema version producers write for each type.
+// Order events are at version 2: version 1 events (sent before events
+// were versioned) had no schema_version or trace_id.
+var currentVersions = map[string]int{
+    TypeOrderCreated:    2,
+    TypeOrderPaid:       2,
+    TypeOrderShipped:    2,
+    TypeOrderCancelled:  2,
+    TypeOrderRefunded:   2,
+    TypeStockChanged:    1,
+    TypeBackordered:     1,
+    TypeBackorderFilled: 1,
+    TypeLowStock:        1,
+    TypeProductUpdated:  1,
+    TypeCartAbandoned:   1,
+}
+
+// CurrentVersion returns the schema version producers write for an event
+// type, and false for unknown types
+func CurrentVersion(eventType string) (int, bool) {
+    version, known := currentVersions[eventType]
+    return version, known
+}
+
+// Types returns every known event type
+func Types() []string {
+    return []string{
+        TypeOrderCreated, TypeOrderPaid, TypeOrderShipped, TypeOrderCancelled, TypeOrderRefunded,
+        TypeStockChanged, TypeBackordered, TypeBackorderFilled, TypeLowStock, TypeProductUpdated, TypeCartAbandoned,
+    }
+}
+
+// OrderItem is one line of an order
+type OrderItem struct {
+    ProductID     string `json:"product_id"`
+    Quantity      int    `json:"qty"`
+    PriceCents    int    `json:"price_cents"`
+    RefundedQty   int    `json:"refunded_qty,omitempty"`
+    TaxCents      int    `json:"tax_cents,omitempty"`      // the line's share of the order's tax
+    DiscountCents int    `json:"discount_cents,omitempty"` // the line's share of the coupon discount
+}
+
+// Order is an order as carried by order events
+type Order struct {
+    OrderID      string      `json:"order_id"`
+    OrderNumber  string      `json:"order_number,omitempty"`
+    UserID       string      `json:"user_id"`
+    Items        []OrderItem `json:"items"`
+    TotalCents   int         `json:"total_cents"`
+    Currency     string      `json:"currency"`
+    Status       string      `json:"status"`
+    PaymentID    string      `json:"payment_id"`
+    CartID       string      `json:"cart_id,omitempty"`
+    CreatedAt    int64       `json:"created_at"`
+    UpdatedAt    int64       `json:"updated_at"`
+    StatusActor  string      `json:"status_actor,omitempty"` // who made the last status change
+    StatusReason string      `json:"status_reason,omitempty"`
+
+    // Every status the order has had, oldest first
+    StatusHistory []StatusChange `json:"status_history,omitempty"`
+
+    // Refunds so far (a partial refund leaves the status as it was), and
+    // returns requested by the customer
+    RefundedCents int           `json:"refunded_cents,omitempty"`
+    Refunds       []OrderRefund `json:"refunds,omitempty"`
+    Returns       []OrderReturn `json:"returns,omitempty"`
+
+    // Parcels the items went out in; the status is partially_shipped
+    // until every unit not refunded has shipped
+    Shipments []OrderShipment `json:"shipments,omitempty"`
+
+    // Discount and tax. TotalCents is the grand total: the subtotal less
+    // the coupon discount, plus tax on what is left. Orders from before
+    // tax was charged have a subtotal equal to it and no tax.
+    SubtotalCents   int              `json:"subtotal_cents"`
+    CouponCode      string           `json:"coupon_code,omitempty"`
+    DiscountCents   int              `json:"discount_cents,omitempty"`
+    TaxCents        int              `json:"tax_cents"`
+    TaxRatePPM      int              `json:"tax_rate_ppm,omitempty"`
+    TaxRegion       string           `json:"tax_region,omitempty"`
+    GrandTotalCents int              `json:"grand_total_cents"`
+    ShippingAddress *ShippingAddress `json:"shipping_address,omitempty"`
+
+    // How urgently the order is handled, from its shipping method: standard
+    // or express; orders from before priorities have none
+    Priority string `json:"priority,omitempty"`
+
+    // The order's total and refunds in the shop's settlement currency, at
+    // the rate of the order's creation; unset for shops without one
+    SettlementCurrency      string `json:"settlement_currency,omitempty"`
+    FXRate                  string `json:"fx_rate,omitempty"`
+    SettlementTotalCents    int    `json:"settlement_total_cents,omitempty"`
+    SettlementRefundedCents int    `json:"settlement_refunded_cents,omitempty"`
+}
+
+// ShippingAddress is where an order is going
+type ShippingAddress struct {
+    Country    string `json:"country"`
+    Region     string `json:"region,omitempty"`
+    PostalCode string `json:"postal_code,omitempty"`
+}
+
+// StatusChange is one entry in an order's status history. From is empty
+// for the status the order was created with.
+type StatusChange struct {
+    From       string `json:"from,omitempty"`
+    To         string `json:"to"`
+    Actor      string `json:"actor,omitempty"`
+    Reason     string `json:"reason,omitempty"`
+    At         int64  `json:"at"`
+    Backfilled bool   `json:"backfilled,omitempty"`
+}
+
+// OrderRefund is one refund of an order, in full or by line item
+type OrderRefund struct {
+    RefundID        string       `json:"refund_id"`
+    PaymentRefundID string       `json:"payment_refund_id,omitempty"`
+    Items           []RefundItem `json:"items"`
+    AmountCents     int          `json:"amount_cents"`
+    SettlementCents int          `json:"settlement_cents,omitempty"`
+    Reason          string       `json:"reason,omitempty"`
+    Actor           string       `json:"actor"`
+    Restocked       bool         `json:"restocked"`
+    CreatedAt       int64        `json:"created_at"`
+}
+
+// RefundItem is one line of a refund or return
+type RefundItem struct {
+    ProductID string `json:"product_id"`
+    Quantity  int    `json:"qty"`
+}
+
+// OrderShipment is one parcel of an order's items
+type OrderShipment struct {
+    ShipmentID     string       `json:"shipment_id"`
+    Carrier        string       `json:"carrier"`
+    TrackingNumber string       `json:"tracking_number"`
+    TrackingURL    string       `json:"tracking_url,omitempty"`
+    Items          []RefundItem `json:"items"`
+    CreatedBy      string       `json:"created_by"`
+    CreatedAt      int64        `json:"created_at"`
+}
+
+// OrderReturn is a return (RMA) of some of an order's items. Status is
+// requested, approved, rejected or refunded.
+type OrderReturn struct {
+    ReturnID       string       `json:"return_id"`
+    Items          []RefundItem `json:"items"`
+    Reason         string       `json:"reason,omitempty"`
+    Status         string       `json:"status"`
+    RequestedBy    string       `json:"requested_by"`
+    DecidedBy      string       `json:"decided_by,omitempty"`
+    DecisionReason string       `json:"decision_reason,omitempty"`
+    RefundID       string       `json:"refund_id,omitempty"`
+    CreatedAt      int64        `json:"created_at"`
+    UpdatedAt      int64        `json:"updated_at"`
+}
+
+// OrderChanged is the payload of the order lifecycle events
+// (order.created, order.paid, order.shipped, order.cancelled and
+// order.refunded): the order as it stood after the change
+type OrderChanged struct {
+    OrderID string `json:"order_id"`
+    Order   Order  `json:"order"`
+}
+
+// OrderPaid is the payload of order.paid events
+type OrderPaid = OrderChanged
+
+// Stock change reasons
+const (
+    StockReserved  = "reserve"
+    StockReleased  = "release"
+    StockCommitted = "commit"
+    StockExpired   = "expire"
+    StockAdjusted  = "adjust"
+    StockRemoved   = "remove"
+)
+
+// StockChanged is the payload of inventory.stock_changed events: a
+// product's stock after one change, and what changed it
+type StockChanged struct {
+    ProductID      string `json:"product_id"`
+    Reason         string `json:"reason"`
+    AvailableDelta int    `json:"available_delta"`
+    Available      int    `json:"available"`
+    Reserved       int    `json:"reserved"`
+    TotalStock     int    `json:"total_stock"`
+    ReservationID  string `json:"reservation_id,omitempty"`
+}
+
+// Backorder is the payload of inventory.backordered and
+// inventory.backorder_filled events: a reservation the stock couldn't
+// cover, as it stood after it was made or filled. A filled backorder is
+// an ordinary reservation, held until expires_at.
+type Backorder struct {
+    ReservationID string `json:"reservation_id"`
+    ProductID     string `json:"product_id"`
+    Quantity      int    `json:"quantity"`
+    WarehouseID   string `json:"warehouse_id"`
+    ReferenceType string `json:"reference_type"`
+    Reference     string `json:"reference"`
+    CartID        string `json:"cart_id,omitempty"`
+    Status        string `json:"status"` // backordered, or reserved once filled
+    ExpectedAt    int64  `json:"expected_at"`
+    FilledAt      int64  `json:"filled_at,omitempty"`
+    ExpiresAt     int64  `json:"expires_at,omitempty"`
+}
+
+// LowStock is the payload of inventory.low_stock events: a product whose
+// available stock fell below its reorder threshold, as it stood then
+type LowStock struct {
+    ProductID        string `json:"product_id"`
+    Available        int    `json:"available"`
+    Reserved         int    `json:"reserved"`
+    TotalStock       int    `json:"total_stock"`
+    ReorderThreshold int    `json:"reorder_threshold"`
+}
+
+// ProductUpdated is the payload of product.updated events: the catalogue
+// fields consumers (search, carts) keep copies of
+type ProductUpdated struct {
+    ProductID  string   `json:"product_id"`
+    Title      string   `json:"title"`
+    Categories []string `json:"categories"`
+    PriceCents int      `json:"price_cents"`
+    Currency   string   `json:"currency"`
+    Deleted    bool     `json:"deleted,omitempty"`
+    UpdatedAt  int64    `json:"updated_at"`
+}
+
+// CartItem is one line of a cart
+type CartItem struct {
+    ProductID  string `json:"product_id"`
+    Quantity   int    `json:"qty"`
+    PriceCents int    `json:"price_cents"`
+    Currency   string `json:"currency,omitempty"`
+}
+
+// CartAbandoned is the payload of cart.abandoned events: a cart left with
+// items and no checkout
+type CartAbandoned struct {
+    CartID         string     `json:"cart_id"`
+    UserID         string     `json:"user_id"`
+    Items          []CartItem `json:"items"`
+    LastActivityAt int64      `json:"last_activity_at"`
+}
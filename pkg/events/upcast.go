@@ -0,0 +1,66 @@
+package events
+
+import (
+    "fmt"
+)
+
+// Upcaster rewrites an event of one schema version into the next. It
+// returns the event with its payload and SchemaVersion updated.
+type Upcaster func(event Envelope) (Envelope, error)
+
+type upcastKey struct {
+    eventType string
+    from      int
+}
+
+// upcasters holds the step from each (type, version) to the next
+var upcasters = map[upcastKey]Upcaster{}
+
+func init() {
+    for _, eventType := range []string{TypeOrderCreated, TypeOrderPaid, TypeOrderShipped, TypeOrderCancelled} {
+        RegisterUpcaster(eventType, 1, upcastOrderV1)
+    }
+}
+
+// RegisterUpcaster registers the step from version from of eventType to
+// version from+1. Register upcasters from an init function.
+func RegisterUpcaster(eventType string, from int, upcaster Upcaster) {
+    upcasters[upcastKey{eventType, from}] = upcaster
+}
+
+// Upcast steps an event through the registered upcasters until it reaches
+// the current schema version of its type
+func Upcast(event Envelope) (Envelope, error) {
+    current, known := CurrentVersion(event.Type)
+    if !known {
+        return event, fmt.Errorf("%w: %s", ErrUnknownType, event.Type)
+    }
+    if event.SchemaVersion > current {
+        return event, fmt.Errorf("%w: %s version %d", ErrFutureVersion, event.Type, event.SchemaVersion)
+    }
+
+    for event.SchemaVersion < current {
+        upcaster, exists := upcasters[upcastKey{event.Type, event.SchemaVersion}]
+        if !exists {
+            return event, fmt.Errorf("events: no upcaster for %s version %d", event.Type, event.SchemaVersion)
+        }
+        from := event.SchemaVersion
+        upcasted, err := upcaster(event)
+        if err != nil {
+            return event, fmt.Errorf("events: upcasting %s from version %d: %w", event.Type, from, err)
+        }
+        if upcasted.SchemaVersion != from+1 {
+            return event, fmt.Errorf("events: upcaster for %s version %d produced version %d", event.Type, from, upcasted.SchemaVersion)
+        }
+        event = upcasted
+    }
+    return event, nil
+}
+
+// Order events 1 -> 2: version 2 added schema_version and trace_id to the
+// envelope and left the payload as it was. A version 1 event has no trace
+// ID to recover, so only the version changes.
+func upcastOrderV1(event Envelope) (Envelope, error) {
+    event.SchemaVersion = 2
+    return event, nil
+}
@@ -0,0 +1,192 @@
+// Package accesslog writes one access log line per request and makes sure
+// every request has an ID.
+//
+// Wrap the whole handler chain, so requests that never reach a route are
+// logged too, and note the route from the router-level middleware:
+//
+//	handler := accesslog.Handler(serviceName, c.Handler(router))
+//	...
+//	accesslog.NoteRoute(r, route, mux.Vars(r)["userId"])
+package accesslog
+
+import (
+    "context"
+    "encoding/json"
+    "fmt"
+    "log"
+    "math/rand"
+    "net"
+    "net/http"
+    "os"
+    "strconv"
+    "strings"
+    "time"
+
+    "github.com/google/uuid"
+    "middleware"
+)
+
+// Access log settings. ACCESS_LOG_FORMAT is json (default), clf or off.
+// ACCESS_LOG_SAMPLE_RATE logs that fraction of ordinary requests; server
+// errors and requests slower than ACCESS_LOG_SLOW_MS are always logged, so
+// sampling never hides the requests worth looking at. Paths in
+// ACCESS_LOG_SKIP_PATHS (probes and scrapes by default) are never logged.
+const (
+    DefaultFormat    = "json"
+    DefaultSlow      = time.Second
+    DefaultSkipPaths = "/health,/readyz,/metrics,/slo"
+)
+
+// RequestIDHeader carries the request ID; one is generated when the caller
+// didn't send one
+const RequestIDHeader = "X-Request-ID"
+
+var (
+    accessLogFormat     = DefaultFormat
+    accessLogSampleRate = 1.0
+    accessLogSlow       = DefaultSlow
+    accessLogSkipPaths  = make(map[string]bool)
+    accessLogger        = log.New(os.Stdout, "", 0)
+)
+
+// requestInfo is filled in by the router-level middleware, which is the
+// only place the route template and path variables are known
+type requestInfo struct {
+    Route  string
+    UserID string
+}
+
+type requestInfoKey struct{}
+
+func init() {
+    if value := os.Getenv("ACCESS_LOG_FORMAT"); value != "" {
+        switch value {
+        case "json", "clf", "off":
+            accessLogFormat = value
+        default:
+            log.Printf("Ignoring invalid ACCESS_LOG_FORMAT=%q", value)
+        }
+    }
+    if value := os.Getenv("ACCESS_LOG_SAMPLE_RATE"); value != "" {
+        if rate, err := strconv.ParseFloat(value, 64); err == nil && rate >= 0 && rate <= 1 {
+            accessLogSampleRate = rate
+        } else {
+            log.Printf("Ignoring invalid ACCESS_LOG_SAMPLE_RATE=%q", value)
+        }
+    }
+    if value := os.Getenv("ACCESS_LOG_SLOW_MS"); value != "" {
+        if ms, err := strconv.Atoi(value); err == nil && ms > 0 {
+            accessLogSlow = time.Duration(ms) * time.Millisecond
+        } else {
+            log.Printf("Ignoring invalid ACCESS_LOG_SLOW_MS=%q", value)
+        }
+    }
+
+    skipPaths, set := os.LookupEnv("ACCESS_LOG_SKIP_PATHS")
+    if !set {
+        skipPaths = DefaultSkipPaths
+    }
+    for _, path := range strings.Split(skipPaths, ",") {
+        if path = strings.TrimSpace(path); path != "" {
+            accessLogSkipPaths[path] = true
+        }
+    }
+}
+
+// NoteRoute records the route template and user of a request for the
+// access log. Called from the router-level middleware.
+func NoteRoute(r *http.Request, route string, userID string) {
+    if info, ok := r.Context().Value(requestInfoKey{}).(*requestInfo); ok {
+        info.Route = route
+        info.UserID = userID
+    }
+}
+
+// Handler is the access log middleware of the named service: it wraps the
+// whole handler chain, so requests that never reach a route (404s, shed
+// requests, CORS preflights) are logged too. It also makes sure every
+// request has an ID, echoed in the response and passed on to anything the
+// request is forwarded to.
+func Handler(service string, next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        requestID := r.Header.Get(RequestIDHeader)
+        if requestID == "" || len(requestID) > 128 {
+            requestID = uuid.New().String()
+            r.Header.Set(RequestIDHeader, requestID)
+        }
+        w.Header().Set(RequestIDHeader, requestID)
+
+        if accessLogFormat == "off" || accessLogSkipPaths[r.URL.Path] {
+            next.ServeHTTP(w, r)
+            return
+        }
+
+        info := &requestInfo{}
+        recorder := &middleware.StatusRecorder{ResponseWriter: w}
+        start := time.Now()
+        next.ServeHTTP(recorder, r.WithContext(context.WithValue(r.Context(), requestInfoKey{}, info)))
+        elapsed := time.Since(start)
+
+        if recorder.Status == 0 {
+            recorder.Status = http.StatusOK
+        }
+        if recorder.Status < 500 && elapsed < accessLogSlow && rand.Float64() >= accessLogSampleRate {
+            return
+        }
+        writeAccessLog(service, r, info, recorder, elapsed, requestID, start)
+    })
+}
+
+// Helper function to write one access log line in the configured format
+func writeAccessLog(service string, r *http.Request, info *requestInfo, recorder *middleware.StatusRecorder, elapsed time.Duration, requestID string, start time.Time) {
+    host, _, err := net.SplitHostPort(r.RemoteAddr)
+    if err != nil {
+        host = r.RemoteAddr
+    }
+
+    if accessLogFormat == "clf" {
+        // Common Log Format, followed by the route template, latency and
+        // request ID
+        user, route := "-", "-"
+        if info.UserID != "" {
+            user = info.UserID
+        }
+        if info.Route != "" {
+            route = info.Route
+        }
+        accessLogger.Printf("%s - %s [%s] \"%s %s %s\" %d %d \"%s\" %dms %s",
+            host, user, start.Format("02/Jan/2006:15:04:05 -0700"), r.Method, r.URL.RequestURI(), r.Proto,
+            recorder.Status, recorder.Bytes, route, elapsed.Milliseconds(), requestID)
+        return
+    }
+
+    entry := map[string]interface{}{
+        "event":       "access",
+        "service":     service,
+        "time":        start.UTC().Format(time.RFC3339Nano),
+        "method":      r.Method,
+        "path":        r.URL.Path,
+        "route":       info.Route,
+        "status":      recorder.Status,
+        "bytes":       recorder.Bytes,
+        "duration_ms": float64(elapsed.Microseconds()) / 1000,
+        "user_id":     info.UserID,
+        "request_id":  requestID,
+        "remote_addr": host,
+        "user_agent":  r.UserAgent(),
+    }
+    data, err := json.Marshal(entry)
+    if err != nil {
+        log.Printf("Failed to encode access log entry: %v", err)
+        return
+    }
+    accessLogger.Print(string(data))
+}
+
+// Settings describes the access log settings for the startup log
+func Settings() string {
+    if accessLogFormat == "off" {
+        return "off"
+    }
+    return fmt.Sprintf("%s, sample rate %g, slow %s", accessLogFormat, accessLogSampleRate, accessLogSlow)
+}
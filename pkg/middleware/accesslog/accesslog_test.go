@@ -0,0 +1,30 @@
+package accesslog
+
+import (
+    "net/http"
+    "net/http/httptest"
+    "testing"
+)
+
+func TestHandlerSetsRequestID(t *testing.T) {
+    var forwarded string
+    handler := Handler("test-service", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        forwarded = r.Header.Get(RequestIDHeader)
+    }))
+
+    // A caller's ID is kept
+    req := httptest.NewRequest("GET", "/health", nil)
+    req.Header.Set(RequestIDHeader, "req-1")
+    rec := httptest.NewRecorder()
+    handler.ServeHTTP(rec, req)
+    if got := rec.Header().Get(RequestIDHeader); got != "req-1" || forwarded != "req-1" {
+        t.Errorf("request ID echoed as %q and forwarded as %q, want req-1", got, forwarded)
+    }
+
+    // A missing one is generated, and passed on to the handler
+    rec = httptest.NewRecorder()
+    handler.ServeHTTP(rec, httptest.NewRequest("GET", "/health", nil))
+    if got := rec.Header().Get(RequestIDHeader); got == "" || got != forwarded {
+        t.Errorf("generated request ID echoed as %q and forwarded as %q", got, forwarded)
+    }
+}
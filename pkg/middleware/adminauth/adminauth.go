@@ -0,0 +1,107 @@
+// Package adminauth guards a service's /admin routes with the ADMIN_TOKEN
+// bearer token, audits admin actions, and checks the confirmation that
+// destructive clears must carry.
+//
+// A service names itself once with Setup; audit events carry the name and
+// clears must confirm with it. Admin endpoints are disabled entirely
+// (403) unless ADMIN_TOKEN is configured.
+package adminauth
+
+import (
+    "crypto/subtle"
+    "encoding/json"
+    "log"
+    "net/http"
+    "os"
+    "strings"
+    "time"
+)
+
+// TestDataPrefix marks IDs created by tests and load generators; scoped
+// clears (?scope=test) only remove entities carrying it
+const TestDataPrefix = "test-"
+
+var (
+    adminToken  = os.Getenv("ADMIN_TOKEN")
+    serviceName string
+)
+
+// Setup names the service for audit events and clear confirmations
+func Setup(name string) {
+    serviceName = name
+}
+
+// ServiceName returns the name given to Setup
+func ServiceName() string {
+    return serviceName
+}
+
+// Token returns ADMIN_TOKEN, e.g. for calls to another service's admin
+// API; "" when it is unset
+func Token() string {
+    return adminToken
+}
+
+// IsAdminToken reports whether a bearer token is ADMIN_TOKEN. Always false
+// when ADMIN_TOKEN is unset.
+func IsAdminToken(token string) bool {
+    return adminToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) == 1
+}
+
+// Middleware requires the ADMIN_TOKEN bearer token
+func Middleware(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if adminToken == "" {
+            http.Error(w, "Admin endpoints disabled: ADMIN_TOKEN not configured", http.StatusForbidden)
+            return
+        }
+
+        if !IsAdminToken(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")) {
+            Audit(r, "auth_failed", nil)
+            http.Error(w, "Admin token required", http.StatusUnauthorized)
+            return
+        }
+
+        next.ServeHTTP(w, r)
+    })
+}
+
+// ConfirmClear parses ?scope= and checks ?confirm=<service> on a
+// destructive call. Writes the error response and returns false on failure.
+func ConfirmClear(w http.ResponseWriter, r *http.Request) (string, bool) {
+    scope := r.URL.Query().Get("scope")
+    if scope == "" {
+        scope = "all"
+    }
+    if scope != "all" && scope != "test" {
+        http.Error(w, "Scope must be 'all' or 'test'", http.StatusBadRequest)
+        return "", false
+    }
+
+    if r.URL.Query().Get("confirm") != serviceName {
+        http.Error(w, "Confirmation required: pass ?confirm="+serviceName, http.StatusBadRequest)
+        return "", false
+    }
+
+    return scope, true
+}
+
+// Audit records an audit event for an admin action
+func Audit(r *http.Request, action string, details map[string]interface{}) {
+    event := map[string]interface{}{
+        "event":       "admin_action",
+        "service":     serviceName,
+        "action":      action,
+        "method":      r.Method,
+        "path":        r.URL.Path,
+        "remote_addr": r.RemoteAddr,
+        "user_agent":  r.UserAgent(),
+        "timestamp":   time.Now().Unix(),
+    }
+    for key, value := range details {
+        event[key] = value
+    }
+
+    data, _ := json.Marshal(event)
+    log.Printf("AUDIT %s", data)
+}
@@ -0,0 +1,65 @@
+package adminauth
+
+import (
+    "net/http"
+    "net/http/httptest"
+    "testing"
+)
+
+func TestMiddleware(t *testing.T) {
+    defer func(previous string) { adminToken = previous }(adminToken)
+    handler := Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        w.WriteHeader(http.StatusNoContent)
+    }))
+
+    tests := []struct {
+        token         string
+        authorization string
+        want          int
+    }{
+        {"", "", http.StatusForbidden},
+        {"", "Bearer ", http.StatusForbidden}, // an unset token never matches an empty one
+        {"secret", "", http.StatusUnauthorized},
+        {"secret", "Bearer wrong", http.StatusUnauthorized},
+        {"secret", "Bearer secret", http.StatusNoContent},
+    }
+    for _, tt := range tests {
+        adminToken = tt.token
+        r := httptest.NewRequest("GET", "/admin/config", nil)
+        if tt.authorization != "" {
+            r.Header.Set("Authorization", tt.authorization)
+        }
+        w := httptest.NewRecorder()
+        handler.ServeHTTP(w, r)
+        if w.Code != tt.want {
+            t.Errorf("ADMIN_TOKEN=%q, Authorization %q: status %d, want %d", tt.token, tt.authorization, w.Code, tt.want)
+        }
+    }
+}
+
+func TestConfirmClear(t *testing.T) {
+    Setup("cart-service")
+
+    tests := []struct {
+        query     string
+        wantScope string
+        wantOK    bool
+    }{
+        {"confirm=cart-service", "all", true},
+        {"confirm=cart-service&scope=test", "test", true},
+        {"", "", false},
+        {"confirm=order-service", "", false},
+        {"confirm=cart-service&scope=some", "", false},
+    }
+    for _, tt := range tests {
+        r := httptest.NewRequest("DELETE", "/admin/clear?"+tt.query, nil)
+        w := httptest.NewRecorder()
+        scope, ok := ConfirmClear(w, r)
+        if scope != tt.wantScope || ok != tt.wantOK {
+            t.Errorf("?%s: scope %q, ok %v, want %q, %v", tt.query, scope, ok, tt.wantScope, tt.wantOK)
+        }
+        if !ok && w.Code != http.StatusBadRequest {
+            t.Errorf("?%s: status %d, want 400", tt.query, w.Code)
+        }
+    }
+}
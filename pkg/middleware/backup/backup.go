@@ -0,0 +1,240 @@
+// Package backup is the stream format behind each service's /admin/backup
+// and /admin/restore.
+//
+// A backup is newline-delimited JSON: a Header naming the service, then one
+// Record per entity. A service encodes its own entities into records and
+// applies them on restore; this package writes and reads the stream,
+// classifies each restored entity against the one it would replace, and
+// reports the outcome. The service name comes from adminauth.Setup.
+package backup
+
+import (
+    "bytes"
+    "encoding/json"
+    "fmt"
+    "io"
+    "net/http"
+    "time"
+
+    "middleware/adminauth"
+    "middleware/httpserver"
+)
+
+// Version is bumped whenever the backup record layout changes
+const Version = 1
+
+// Conflict policies for /admin/restore, applied when a backed-up entity
+// already exists with different contents. Identical entities are never
+// conflicts, so restoring the same backup twice is a no-op.
+const (
+    ConflictSkip      = "skip"      // keep the existing entity (default)
+    ConflictOverwrite = "overwrite" // replace it with the backed-up one
+    ConflictFail      = "fail"      // reject the whole restore, changing nothing
+)
+
+// Header is the first line of a backup stream
+type Header struct {
+    Type    string `json:"type"` // always "header"
+    Service string `json:"service"`
+    Version int    `json:"version"`
+    TakenAt int64  `json:"taken_at"`
+}
+
+// Record is one entity in a backup stream (one JSON object per line)
+type Record struct {
+    Type string          `json:"type"`
+    ID   string          `json:"id"`
+    Data json.RawMessage `json:"data"`
+}
+
+// Result counts what a restore did with each record
+type Result struct {
+    Created   int      `json:"created"`
+    Updated   int      `json:"updated"`
+    Unchanged int      `json:"unchanged"`
+    Skipped   int      `json:"skipped"`
+    Conflicts []string `json:"conflicts,omitempty"`
+}
+
+// Restore actions for a single record
+const (
+    ActionCreate    = "create"
+    ActionUpdate    = "update"
+    ActionUnchanged = "unchanged"
+    ActionSkip      = "skip"
+    ActionConflict  = "conflict"
+)
+
+// Classify decides what to do with a backed-up entity and counts it
+func (result *Result) Classify(policy string, id string, exists bool, existing interface{}, incoming interface{}) string {
+    action := ActionCreate
+    if exists {
+        existingJSON, _ := json.Marshal(existing)
+        incomingJSON, _ := json.Marshal(incoming)
+        switch {
+        case bytes.Equal(existingJSON, incomingJSON):
+            action = ActionUnchanged
+        case policy == ConflictOverwrite:
+            action = ActionUpdate
+        case policy == ConflictSkip:
+            action = ActionSkip
+        default:
+            action = ActionConflict
+        }
+    }
+
+    switch action {
+    case ActionCreate:
+        result.Created++
+    case ActionUpdate:
+        result.Updated++
+    case ActionUnchanged:
+        result.Unchanged++
+    case ActionSkip:
+        result.Skipped++
+    case ActionConflict:
+        result.Conflicts = append(result.Conflicts, id)
+    }
+    return action
+}
+
+// Applies reports whether a restore classified into result may be applied:
+// anything but a fail-policy restore with conflicts
+func (result *Result) Applies(policy string) bool {
+    return policy != ConflictFail || len(result.Conflicts) == 0
+}
+
+// ParseConflictPolicy parses ?on_conflict=. Writes the error response and
+// returns false on failure.
+func ParseConflictPolicy(w http.ResponseWriter, r *http.Request) (string, bool) {
+    policy := r.URL.Query().Get("on_conflict")
+    if policy == "" {
+        policy = ConflictSkip
+    }
+    if policy != ConflictSkip && policy != ConflictOverwrite && policy != ConflictFail {
+        http.Error(w, "on_conflict must be 'skip', 'overwrite' or 'fail'", http.StatusBadRequest)
+        return "", false
+    }
+    return policy, true
+}
+
+// Writer streams records as newline-delimited JSON, flushing as it goes so
+// large stores never sit in a response buffer
+type Writer struct {
+    w       http.ResponseWriter
+    encoder *json.Encoder
+    count   int
+}
+
+// NewWriter starts a backup stream and writes its header
+func NewWriter(w http.ResponseWriter) *Writer {
+    httpserver.LiftDeadlines(w)
+
+    service := adminauth.ServiceName()
+    takenAt := time.Now().Unix()
+    w.Header().Set("Content-Type", "application/x-ndjson")
+    w.Header().Set("Content-Disposition",
+        fmt.Sprintf("attachment; filename=\"%s-backup-%d.ndjson\"", service, takenAt))
+
+    writer := &Writer{w: w, encoder: json.NewEncoder(w)}
+    writer.encoder.Encode(Header{
+        Type:    "header",
+        Service: service,
+        Version: Version,
+        TakenAt: takenAt,
+    })
+    return writer
+}
+
+// Write writes one record
+func (writer *Writer) Write(recordType string, id string, data interface{}) error {
+    raw, err := json.Marshal(data)
+    if err != nil {
+        return err
+    }
+    if err := writer.encoder.Encode(Record{Type: recordType, ID: id, Data: raw}); err != nil {
+        return err
+    }
+
+    writer.count++
+    if writer.count%1000 == 0 {
+        if flusher, ok := writer.w.(http.Flusher); ok {
+            flusher.Flush()
+        }
+    }
+    return nil
+}
+
+// Count returns the number of records written so far
+func (writer *Writer) Count() int {
+    return writer.count
+}
+
+// Read reads a backup stream, checking it was taken from this service in a
+// layout we understand
+func Read(body io.Reader) ([]Record, error) {
+    decoder := json.NewDecoder(body)
+    service := adminauth.ServiceName()
+
+    var header Header
+    if err := decoder.Decode(&header); err != nil {
+        return nil, fmt.Errorf("invalid backup header: %v", err)
+    }
+    if header.Type != "header" {
+        return nil, fmt.Errorf("backup must start with a header record")
+    }
+    if header.Service != service {
+        return nil, fmt.Errorf("backup was taken from %q, not %s", header.Service, service)
+    }
+    if header.Version > Version {
+        return nil, fmt.Errorf("backup version %d is newer than supported version %d", header.Version, Version)
+    }
+
+    var records []Record
+    for {
+        var record Record
+        err := decoder.Decode(&record)
+        if err == io.EOF {
+            break
+        }
+        if err != nil {
+            return nil, fmt.Errorf("invalid backup record %d: %v", len(records)+1, err)
+        }
+        records = append(records, record)
+    }
+    return records, nil
+}
+
+// WriteResult finishes a restore: audits it and reports the outcome. A
+// fail-policy restore with conflicts is answered with 409 and the
+// conflicting IDs; nothing was applied.
+func WriteResult(w http.ResponseWriter, r *http.Request, policy string, result Result) {
+    failed := !result.Applies(policy)
+
+    adminauth.Audit(r, "restore", map[string]interface{}{
+        "on_conflict": policy,
+        "created":     result.Created,
+        "updated":     result.Updated,
+        "unchanged":   result.Unchanged,
+        "skipped":     result.Skipped,
+        "conflicts":   len(result.Conflicts),
+        "applied":     !failed,
+    })
+
+    response := map[string]interface{}{
+        "message":     "Restore complete",
+        "on_conflict": policy,
+        "created":     result.Created,
+        "updated":     result.Updated,
+        "unchanged":   result.Unchanged,
+        "skipped":     result.Skipped,
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    if failed {
+        response["message"] = "Restore aborted: conflicting entities exist"
+        response["conflicts"] = result.Conflicts
+        w.WriteHeader(http.StatusConflict)
+    }
+    json.NewEncoder(w).Encode(response)
+}
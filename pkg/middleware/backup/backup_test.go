@@ -0,0 +1,79 @@
+package backup
+
+import (
+    "net/http/httptest"
+    "strings"
+    "testing"
+
+    "middleware/adminauth"
+)
+
+func TestWriteThenRead(t *testing.T) {
+    adminauth.Setup("cart-service")
+
+    w := httptest.NewRecorder()
+    writer := NewWriter(w)
+    for _, id := range []string{"cart-1", "cart-2"} {
+        if err := writer.Write("cart", id, map[string]string{"cart_id": id}); err != nil {
+            t.Fatalf("Write: %v", err)
+        }
+    }
+    if writer.Count() != 2 {
+        t.Errorf("Count = %d, want 2", writer.Count())
+    }
+
+    records, err := Read(strings.NewReader(w.Body.String()))
+    if err != nil {
+        t.Fatalf("Read: %v", err)
+    }
+    if len(records) != 2 || records[1].Type != "cart" || records[1].ID != "cart-2" || string(records[1].Data) != `{"cart_id":"cart-2"}` {
+        t.Errorf("records = %+v", records)
+    }
+
+    // A backup from another service is refused
+    adminauth.Setup("order-service")
+    defer adminauth.Setup("cart-service")
+    if _, err := Read(strings.NewReader(w.Body.String())); err == nil {
+        t.Error("Read accepted a backup taken from another service")
+    }
+}
+
+func TestReadRejects(t *testing.T) {
+    adminauth.Setup("cart-service")
+    for _, stream := range []string{
+        ``,
+        `{"type":"cart","id":"cart-1"}`,
+        `{"type":"header","service":"cart-service","version":99}`,
+        "{\"type\":\"header\",\"service\":\"cart-service\",\"version\":1}\n{not json",
+    } {
+        if _, err := Read(strings.NewReader(stream)); err == nil {
+            t.Errorf("Read(%q) succeeded, want an error", stream)
+        }
+    }
+}
+
+func TestClassify(t *testing.T) {
+    existing := map[string]int{"qty": 1}
+    tests := []struct {
+        policy string
+        exists bool
+        qty    int
+        want   string
+    }{
+        {ConflictSkip, false, 1, ActionCreate},
+        {ConflictFail, true, 1, ActionUnchanged},
+        {ConflictSkip, true, 2, ActionSkip},
+        {ConflictOverwrite, true, 2, ActionUpdate},
+        {ConflictFail, true, 2, ActionConflict},
+    }
+    for _, tt := range tests {
+        var result Result
+        got := result.Classify(tt.policy, "id-1", tt.exists, existing, map[string]int{"qty": tt.qty})
+        if got != tt.want {
+            t.Errorf("Classify(%s, exists %v, qty %d) = %s, want %s", tt.policy, tt.exists, tt.qty, got, tt.want)
+        }
+        if applies := result.Applies(tt.policy); applies != (got != ActionConflict) {
+            t.Errorf("Applies(%s) after %s = %v", tt.policy, got, applies)
+        }
+    }
+}
@@ -0,0 +1,87 @@
+// Package corspolicy builds the services' CORS policy from the
+// environment, on top of github.com/rs/cors.
+package corspolicy
+
+import (
+    "log"
+    "os"
+    "strconv"
+    "strings"
+
+    "github.com/rs/cors"
+)
+
+// CORS policy. Browsers only send credentials cross-origin to an explicit
+// origin, so the policy names origins rather than allowing "*":
+//
+//   - CORS_ALLOWED_ORIGINS: comma-separated origins. Defaults to the local
+//     frontend when APP_ENV=development and to none (same-origin only)
+//     otherwise. "*" is accepted but turns credentials off.
+//   - CORS_ALLOWED_METHODS, CORS_ALLOWED_HEADERS: comma-separated overrides
+//     of the defaults below.
+//   - CORS_ALLOW_CREDENTIALS: true (default) or false.
+//   - CORS_MAX_AGE_SECONDS: how long browsers may cache a preflight.
+var (
+    developmentOrigins   = []string{"http://localhost:3000", "http://127.0.0.1:3000", "http://localhost"}
+    defaultCORSMethods   = []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"}
+    defaultCORSHeaders   = []string{"Authorization", "Content-Type", "Accept", "Accept-Language", "X-API-Key", "X-Request-ID", "X-Acting-As", "traceparent"}
+    defaultExposeHeaders = []string{"X-Request-ID", "X-Error-Code", "Content-Language", "API-Version", "Deprecation", "Sunset", "Link", "Retry-After"}
+)
+
+const DefaultCORSMaxAge = 600 // seconds
+
+// Helper function to read a comma-separated list setting
+func listFromEnv(name string, fallback []string) []string {
+    value, set := os.LookupEnv(name)
+    if !set {
+        return fallback
+    }
+    list := []string{}
+    for _, item := range strings.Split(value, ",") {
+        if item = strings.TrimSpace(item); item != "" {
+            list = append(list, item)
+        }
+    }
+    return list
+}
+
+// New builds the CORS policy from the environment. extra lists response
+// headers the service exposes beyond the shared ones.
+func New(extra ...string) *cors.Cors {
+    fallbackOrigins := []string{}
+    if os.Getenv("APP_ENV") == "development" {
+        fallbackOrigins = developmentOrigins
+    }
+
+    options := cors.Options{
+        AllowedOrigins:   listFromEnv("CORS_ALLOWED_ORIGINS", fallbackOrigins),
+        AllowedMethods:   listFromEnv("CORS_ALLOWED_METHODS", defaultCORSMethods),
+        AllowedHeaders:   listFromEnv("CORS_ALLOWED_HEADERS", defaultCORSHeaders),
+        ExposedHeaders:   append(append([]string{}, defaultExposeHeaders...), extra...),
+        AllowCredentials: os.Getenv("CORS_ALLOW_CREDENTIALS") != "false",
+        MaxAge:           DefaultCORSMaxAge,
+    }
+    if value := os.Getenv("CORS_MAX_AGE_SECONDS"); value != "" {
+        if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+            options.MaxAge = seconds
+        } else {
+            log.Printf("Ignoring invalid CORS_MAX_AGE_SECONDS=%q", value)
+        }
+    }
+
+    for _, origin := range options.AllowedOrigins {
+        if origin == "*" && options.AllowCredentials {
+            log.Printf("CORS_ALLOWED_ORIGINS allows any origin; disabling credentialed requests")
+            options.AllowCredentials = false
+        }
+    }
+
+    if len(options.AllowedOrigins) == 0 {
+        log.Printf("CORS: cross-origin requests disabled (set CORS_ALLOWED_ORIGINS)")
+        // rs/cors treats an empty origin list as "*" unless a func decides
+        options.AllowOriginFunc = func(origin string) bool { return false }
+    } else {
+        log.Printf("CORS: allowed origins %v, credentials %t", options.AllowedOrigins, options.AllowCredentials)
+    }
+    return cors.New(options)
+}
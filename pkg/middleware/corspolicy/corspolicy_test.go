@@ -0,0 +1,52 @@
+package corspolicy
+
+import (
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "testing"
+)
+
+// Helper function to send a request from origin through the policy
+func corsResponse(policy http.Handler, method string, origin string) *httptest.ResponseRecorder {
+    req := httptest.NewRequest(method, "/api/orders", nil)
+    req.Header.Set("Origin", origin)
+    if method == "OPTIONS" {
+        req.Header.Set("Access-Control-Request-Method", "POST")
+    }
+    rec := httptest.NewRecorder()
+    policy.ServeHTTP(rec, req)
+    return rec
+}
+
+func TestNew(t *testing.T) {
+    ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+    t.Setenv("CORS_ALLOWED_ORIGINS", "https://shop.example")
+    policy := New("Duplicate-Of").Handler(ok)
+
+    rec := corsResponse(policy, "OPTIONS", "https://shop.example")
+    if rec.Header().Get("Access-Control-Allow-Origin") != "https://shop.example" || rec.Header().Get("Access-Control-Allow-Credentials") != "true" {
+        t.Errorf("preflight from an allowed origin got %v", rec.Header())
+    }
+    rec = corsResponse(policy, "GET", "https://shop.example")
+    if exposed := rec.Header().Get("Access-Control-Expose-Headers"); !strings.Contains(exposed, "Duplicate-Of") || !strings.Contains(exposed, "X-Error-Code") {
+        t.Errorf("exposed headers %q, want the shared ones and Duplicate-Of", exposed)
+    }
+    if rec = corsResponse(policy, "GET", "https://evil.example"); rec.Header().Get("Access-Control-Allow-Origin") != "" {
+        t.Errorf("request from another origin allowed: %v", rec.Header())
+    }
+
+    // No origins configured means same-origin only, not any origin
+    t.Setenv("CORS_ALLOWED_ORIGINS", "")
+    if rec = corsResponse(New().Handler(ok), "GET", "https://shop.example"); rec.Header().Get("Access-Control-Allow-Origin") != "" {
+        t.Errorf("request allowed with no origins configured: %v", rec.Header())
+    }
+
+    // Any origin turns credentials off
+    t.Setenv("CORS_ALLOWED_ORIGINS", "*")
+    rec = corsResponse(New().Handler(ok), "GET", "https://shop.example")
+    if rec.Header().Get("Access-Control-Allow-Origin") != "*" || rec.Header().Get("Access-Control-Allow-Credentials") != "" {
+        t.Errorf("any origin with credentials: %v", rec.Header())
+    }
+}
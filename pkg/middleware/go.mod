@@ -0,0 +1,9 @@
+module middleware
+
+go 1.21
+
+require (
+    github.com/google/uuid v1.4.0
+    github.com/gorilla/mux v1.8.1
+    github.com/rs/cors v1.10.1
+)
@@ -0,0 +1,205 @@
+// Package hotconfig holds a service's reloadable settings.
+//
+// Settings come from the environment, overridden by CONFIG_FILE (KEY=VALUE
+// lines) when it is set. The file is re-read on SIGHUP or POST
+// /admin/config/reload, so settings change without a restart and without
+// dropping in-memory state. A service keeps its settings struct, how to
+// load and validate it and how to list it; this package does the rest.
+package hotconfig
+
+import (
+    "bufio"
+    "encoding/json"
+    "fmt"
+    "log"
+    "net/http"
+    "net/url"
+    "os"
+    "os/signal"
+    "sort"
+    "strings"
+    "sync"
+    "sync/atomic"
+    "syscall"
+)
+
+var configFile = os.Getenv("CONFIG_FILE")
+
+// Config is the live configuration of type T. load builds a T from the
+// current settings, reading them with Value; settings lists a T's values
+// by name, for display and for diffing reloads.
+type Config[T any] struct {
+    load     func() (*T, error)
+    settings func(*T) map[string]string
+
+    current  atomic.Pointer[T]
+    reloadMu sync.Mutex        // serializes reloads
+    overlay  map[string]string // CONFIG_FILE values, guarded by reloadMu
+
+    // Audit, when set, records reloads made through ReloadHandler
+    Audit func(r *http.Request, action string, details map[string]interface{})
+}
+
+// New creates a configuration; call Load before using it
+func New[T any](load func() (*T, error), settings func(*T) map[string]string) *Config[T] {
+    return &Config[T]{load: load, settings: settings}
+}
+
+// Get returns the live configuration
+func (c *Config[T]) Get() *T {
+    return c.current.Load()
+}
+
+// Set swaps in a configuration and returns the previous one, e.g. for tests
+func (c *Config[T]) Set(cfg *T) *T {
+    return c.current.Swap(cfg)
+}
+
+// Value reads a setting, preferring CONFIG_FILE over the environment. Only
+// valid while building a configuration, i.e. from load.
+func (c *Config[T]) Value(name string) string {
+    if value, exists := c.overlay[name]; exists {
+        return value
+    }
+    return os.Getenv(name)
+}
+
+// Helper function to parse CONFIG_FILE into settings
+func readConfigFile() (map[string]string, error) {
+    settings := make(map[string]string)
+    if configFile == "" {
+        return settings, nil
+    }
+
+    file, err := os.Open(configFile)
+    if err != nil {
+        return nil, err
+    }
+    defer file.Close()
+
+    scanner := bufio.NewScanner(file)
+    for lineNumber := 1; scanner.Scan(); lineNumber++ {
+        line := strings.TrimSpace(scanner.Text())
+        if line == "" || strings.HasPrefix(line, "#") {
+            continue
+        }
+        parts := strings.SplitN(line, "=", 2)
+        if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+            return nil, fmt.Errorf("%s:%d: expected KEY=VALUE", configFile, lineNumber)
+        }
+        settings[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+    }
+    return settings, scanner.Err()
+}
+
+// Helper function to build a configuration from the environment and
+// CONFIG_FILE. Called with reloadMu held.
+func (c *Config[T]) build() (*T, error) {
+    overlay, err := readConfigFile()
+    if err != nil {
+        return nil, err
+    }
+
+    c.overlay = overlay
+    defer func() { c.overlay = nil }()
+    return c.load()
+}
+
+// Load builds the configuration at startup
+func (c *Config[T]) Load() error {
+    c.reloadMu.Lock()
+    defer c.reloadMu.Unlock()
+
+    cfg, err := c.build()
+    if err != nil {
+        return err
+    }
+    c.current.Store(cfg)
+    return nil
+}
+
+// Reload re-reads and swaps in the configuration. On error the running
+// configuration is kept. Returns the settings that changed.
+func (c *Config[T]) Reload() (map[string][2]string, error) {
+    c.reloadMu.Lock()
+    defer c.reloadMu.Unlock()
+
+    cfg, err := c.build()
+    if err != nil {
+        log.Printf("Configuration reload failed, keeping current settings: %v", err)
+        return nil, err
+    }
+
+    before := c.settings(c.Get())
+    c.current.Store(cfg)
+
+    changed := make(map[string][2]string)
+    var names []string
+    for name, value := range c.settings(cfg) {
+        if before[name] != value {
+            changed[name] = [2]string{before[name], value}
+            names = append(names, name)
+        }
+    }
+    sort.Strings(names)
+    log.Printf("Configuration reloaded; changed: %v", names)
+    return changed, nil
+}
+
+// Watch reloads the configuration whenever the process receives SIGHUP
+func (c *Config[T]) Watch() {
+    signals := make(chan os.Signal, 1)
+    signal.Notify(signals, syscall.SIGHUP)
+    for range signals {
+        c.Reload()
+    }
+}
+
+// Handler is the admin endpoint showing the live settings
+func (c *Config[T]) Handler(w http.ResponseWriter, r *http.Request) {
+    result := map[string]interface{}{
+        "config_file": configFile,
+        "settings":    c.settings(c.Get()),
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(result)
+}
+
+// ReloadHandler is the admin endpoint that reloads the configuration
+func (c *Config[T]) ReloadHandler(w http.ResponseWriter, r *http.Request) {
+    changed, err := c.Reload()
+    if err != nil {
+        if c.Audit != nil {
+            c.Audit(r, "config_reload_failed", map[string]interface{}{"error": err.Error()})
+        }
+        http.Error(w, "Configuration reload failed: "+err.Error(), http.StatusBadRequest)
+        return
+    }
+
+    diff := make(map[string]interface{})
+    for name, values := range changed {
+        diff[name] = map[string]string{"from": values[0], "to": values[1]}
+    }
+    if c.Audit != nil {
+        c.Audit(r, "config_reload", map[string]interface{}{"changed": diff})
+    }
+
+    result := map[string]interface{}{
+        "message":  "Configuration reloaded",
+        "changed":  diff,
+        "settings": c.settings(c.Get()),
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(result)
+}
+
+// ValidateURL checks a dependency URL setting
+func ValidateURL(name string, value string) error {
+    parsed, err := url.Parse(value)
+    if err != nil || parsed.Scheme == "" || parsed.Host == "" {
+        return fmt.Errorf("%s=%q is not an absolute URL", name, value)
+    }
+    return nil
+}
@@ -0,0 +1,69 @@
+package hotconfig
+
+import (
+    "errors"
+    "os"
+    "path/filepath"
+    "testing"
+)
+
+type testConfig struct {
+    URL   string
+    Limit string
+}
+
+func TestReloadPrefersConfigFile(t *testing.T) {
+    configFile = filepath.Join(t.TempDir(), "service.conf")
+    defer func() { configFile = "" }()
+    t.Setenv("TEST_URL", "http://from-env:8000")
+    t.Setenv("TEST_LIMIT", "10")
+
+    var live *Config[testConfig]
+    live = New(func() (*testConfig, error) {
+        cfg := &testConfig{URL: live.Value("TEST_URL"), Limit: live.Value("TEST_LIMIT")}
+        if err := ValidateURL("TEST_URL", cfg.URL); err != nil {
+            return nil, err
+        }
+        return cfg, nil
+    }, func(cfg *testConfig) map[string]string {
+        return map[string]string{"TEST_URL": cfg.URL, "TEST_LIMIT": cfg.Limit}
+    })
+
+    if err := live.Load(); !errors.Is(err, os.ErrNotExist) {
+        t.Fatalf("Load with a missing CONFIG_FILE = %v, want not exist", err)
+    }
+    writeConfigFile(t, "# comment\n\nTEST_LIMIT = 20\n")
+    if err := live.Load(); err != nil {
+        t.Fatalf("Load: %v", err)
+    }
+    if got := *live.Get(); got != (testConfig{URL: "http://from-env:8000", Limit: "20"}) {
+        t.Errorf("config = %+v, want the file's TEST_LIMIT over the environment's", got)
+    }
+
+    writeConfigFile(t, "TEST_LIMIT=20\nTEST_URL=http://from-file:8000\n")
+    changed, err := live.Reload()
+    if err != nil {
+        t.Fatalf("Reload: %v", err)
+    }
+    if len(changed) != 1 || changed["TEST_URL"] != [2]string{"http://from-env:8000", "http://from-file:8000"} {
+        t.Errorf("changed = %v, want only TEST_URL", changed)
+    }
+
+    // A bad file or an invalid setting keeps the running configuration
+    for _, contents := range []string{"TEST_URL\n", "TEST_URL=not a url\n"} {
+        writeConfigFile(t, contents)
+        if _, err := live.Reload(); err == nil {
+            t.Errorf("Reload with %q succeeded, want an error", contents)
+        }
+        if live.Get().URL != "http://from-file:8000" {
+            t.Errorf("failed reload with %q replaced the configuration", contents)
+        }
+    }
+}
+
+func writeConfigFile(t *testing.T, contents string) {
+    t.Helper()
+    if err := os.WriteFile(configFile, []byte(contents), 0644); err != nil {
+        t.Fatal(err)
+    }
+}
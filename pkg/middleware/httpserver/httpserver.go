@@ -0,0 +1,74 @@
+// Package httpserver builds the services' HTTP servers, with timeouts and
+// a header size limit from the environment.
+package httpserver
+
+import (
+    "log"
+    "net/http"
+    "os"
+    "strconv"
+    "time"
+)
+
+// Server limits, overridable per deployment. The header timeout is what
+// stops slowloris clients; the others bound stuck and idle connections.
+const (
+    DefaultReadHeaderTimeout = 5 * time.Second
+    DefaultReadTimeout       = 15 * time.Second
+    DefaultWriteTimeout      = 30 * time.Second
+    DefaultIdleTimeout       = 120 * time.Second
+    DefaultMaxHeaderBytes    = 64 << 10
+)
+
+// EnvSeconds reads a duration in seconds from the environment, falling
+// back when it is unset or invalid
+func EnvSeconds(name string, fallback time.Duration) time.Duration {
+    if value := os.Getenv(name); value != "" {
+        if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+            return time.Duration(seconds) * time.Second
+        }
+        log.Printf("Ignoring invalid %s=%q", name, value)
+    }
+    return fallback
+}
+
+// New builds a service's HTTP server with timeouts and a header size limit
+// (HTTP_READ_HEADER_TIMEOUT_SECONDS, HTTP_READ_TIMEOUT_SECONDS,
+// HTTP_WRITE_TIMEOUT_SECONDS, HTTP_IDLE_TIMEOUT_SECONDS, HTTP_MAX_HEADER_BYTES)
+func New(port string, handler http.Handler) *http.Server {
+    maxHeaderBytes := DefaultMaxHeaderBytes
+    if value := os.Getenv("HTTP_MAX_HEADER_BYTES"); value != "" {
+        if parsed, err := strconv.Atoi(value); err == nil && parsed > 0 {
+            maxHeaderBytes = parsed
+        } else {
+            log.Printf("Ignoring invalid HTTP_MAX_HEADER_BYTES=%q", value)
+        }
+    }
+
+    server := &http.Server{
+        Addr:              ":" + port,
+        Handler:           handler,
+        ReadHeaderTimeout: EnvSeconds("HTTP_READ_HEADER_TIMEOUT_SECONDS", DefaultReadHeaderTimeout),
+        ReadTimeout:       EnvSeconds("HTTP_READ_TIMEOUT_SECONDS", DefaultReadTimeout),
+        WriteTimeout:      EnvSeconds("HTTP_WRITE_TIMEOUT_SECONDS", DefaultWriteTimeout),
+        IdleTimeout:       EnvSeconds("HTTP_IDLE_TIMEOUT_SECONDS", DefaultIdleTimeout),
+        MaxHeaderBytes:    maxHeaderBytes,
+    }
+
+    log.Printf("HTTP timeouts: read header %s, read %s, write %s, idle %s; max header %d bytes",
+        server.ReadHeaderTimeout, server.ReadTimeout, server.WriteTimeout, server.IdleTimeout, server.MaxHeaderBytes)
+    return server
+}
+
+// LiftDeadlines lifts the read and write deadlines for a long-running
+// request (streamed backups and restores, reindexes) that legitimately
+// outlasts the server timeouts
+func LiftDeadlines(w http.ResponseWriter) {
+    controller := http.NewResponseController(w)
+    if err := controller.SetReadDeadline(time.Time{}); err != nil {
+        log.Printf("Failed to lift read deadline: %v", err)
+    }
+    if err := controller.SetWriteDeadline(time.Time{}); err != nil {
+        log.Printf("Failed to lift write deadline: %v", err)
+    }
+}
@@ -0,0 +1,30 @@
+package httpserver
+
+import (
+    "net/http"
+    "testing"
+    "time"
+)
+
+func TestNewReadsLimitsFromEnvironment(t *testing.T) {
+    t.Setenv("HTTP_READ_HEADER_TIMEOUT_SECONDS", "2")
+    t.Setenv("HTTP_WRITE_TIMEOUT_SECONDS", "-1")
+    t.Setenv("HTTP_MAX_HEADER_BYTES", "1024")
+
+    server := New("8080", http.NotFoundHandler())
+    if server.Addr != ":8080" {
+        t.Errorf("Addr = %q, want :8080", server.Addr)
+    }
+    if server.ReadHeaderTimeout != 2*time.Second {
+        t.Errorf("ReadHeaderTimeout = %s, want 2s", server.ReadHeaderTimeout)
+    }
+    if server.WriteTimeout != DefaultWriteTimeout {
+        t.Errorf("invalid write timeout gave %s, want the default %s", server.WriteTimeout, DefaultWriteTimeout)
+    }
+    if server.ReadTimeout != DefaultReadTimeout || server.IdleTimeout != DefaultIdleTimeout {
+        t.Errorf("unset timeouts are %s and %s, want the defaults", server.ReadTimeout, server.IdleTimeout)
+    }
+    if server.MaxHeaderBytes != 1024 {
+        t.Errorf("MaxHeaderBytes = %d, want 1024", server.MaxHeaderBytes)
+    }
+}
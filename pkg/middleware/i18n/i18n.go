@@ -0,0 +1,534 @@
+// Package i18n localizes the customer-facing errors of the order, cart and
+// product services.
+//
+//	i18n.WriteError(w, r, http.StatusNotFound, "order.not_found")
+//
+// writes the message in the caller's Accept-Language, with the message code
+// in X-Error-Code.
+package i18n
+
+import (
+    "errors"
+    "fmt"
+    "net/http"
+    "sort"
+    "strconv"
+    "strings"
+)
+
+// Customer-facing error messages, by locale and message code. The order,
+// cart and product services share this catalog, so a code means the same
+// thing whichever service returns it. Storefronts can switch on the code
+// (X-Error-Code) and show the text as is.
+//
+// DefaultLocale is the fallback for unknown locales and for codes a locale
+// hasn't translated yet.
+const DefaultLocale = "en"
+
+// ErrorCodeHeader carries the message code of an error response
+const ErrorCodeHeader = "X-Error-Code"
+
+var messages = map[string]map[string]string{
+    "en": {
+        "request.invalid_json":    "Invalid JSON",
+        "currency.unsupported":    "Unsupported currency %q",
+        "currency.not_settleable": "Orders in %q can't be taken: there is no exchange rate to the settlement currency",
+
+        "auth.token_required": "Sign in to see or place orders",
+        "auth.token_invalid":   "Your sign-in is invalid or has expired, sign in again",
+        "auth.role_required":  "You don't have permission to do this",
+
+        "order.not_found":                  "Order not found",
+        "order.cart_and_payment_required":  "Cart ID and payment method required",
+        "order.invalid_status":             "Invalid status",
+        "order.invalid_transition":         "Cannot change order status from %q to %q",
+        "order.invalid_total":              "Order total could not be calculated",
+        "order.cannot_cancel_shipped":      "Cannot cancel shipped order",
+        "order.checkout_in_progress":       "Checkout is still in progress, try again shortly",
+        "order.checkout_busy":              "Too many checkouts in progress, try again shortly",
+        "order.inventory_unavailable":      "Stock for this order could not be committed; the payment has been refunded",
+        "order.payment_failed":             "Payment processing failed",
+        "order.payment_declined":           "The payment was declined; try another payment method",
+        "order.payment_method_required":    "Payment method required",
+        "order.retry_not_allowed":          "Only orders whose payment failed can retry it; this order is %q",
+        "order.refund_in_progress":         "A refund for this order is already in progress, try again shortly",
+        "order.refund_item_invalid":        "Each refund item needs a product on the order and a positive quantity",
+        "order.refund_exceeds_order":       "Cannot refund more of %q than the order has left to refund",
+        "order.refund_failed":              "The payment could not be refunded",
+        "order.return_not_allowed":         "Only shipped or delivered orders can be returned; this order is %q",
+        "order.return_item_invalid":        "Each return item needs a product on the order and a positive quantity",
+        "order.return_exceeds_order":       "Cannot return more of %q than the order has left to return",
+        "order.return_not_found":           "Return not found",
+        "order.invoice_not_available":      "An invoice is only available once the order is paid; it is %q",
+        "order.shipment_tracking_required":  "A shipment needs a carrier and a tracking number",
+        "order.shipment_not_allowed":        "Only paid orders can be shipped; this order is %q",
+        "order.shipment_item_invalid":       "Each shipment item needs a product on the order and a positive quantity",
+        "order.shipment_exceeds_order":      "Cannot ship more of %q than the order has left to ship",
+        "order.shipment_nothing_left":       "Every item on this order has already shipped",
+        "order.address_field_required":      "%s is required",
+        "order.address_field_too_long":      "%s must be at most %d characters",
+        "order.address_country_invalid":     "%s must be a two-letter ISO 3166-1 country code, not %q",
+        "order.address_change_not_allowed":  "The shipping address of a %s order can't be changed",
+        "order.address_change_tax":          "The new shipping address changes the order's tax; cancel the order and place it again",
+        "order.shipping_method_invalid":     "Shipping method %q is not offered; choose one of %s",
+        "order.metadata_key_invalid":        "Metadata key %q must be at most %d lower-case letters, digits, _, - or ., starting with a letter or digit",
+        "order.metadata_value_too_long":     "Metadata value of %q must be at most %d characters",
+        "order.metadata_too_many":           "An order can have at most %d metadata keys",
+        "order.rule_violated":               "This order can't be placed",
+        "order.rule_max_total":              "Orders can total at most %s",
+        "order.rule_max_quantity":           "At most %d of %s can be ordered at once",
+        "order.rule_product_restricted":     "%s can't be shipped to %s",
+        "order.tax_unavailable":             "Tax for this order could not be calculated, try again shortly",
+        "order.coupon_invalid":              "Coupon %q is not valid for this order",
+        "order.coupon_unavailable":          "Coupons could not be checked right now, try again shortly",
+        "order.exchange_rate_unavailable":   "Exchange rates could not be fetched right now, try again shortly",
+        "order.payment_timed_out":           "Order was not paid within %d minutes",
+        "order.payment_unavailable":         "Payments are unavailable right now, please try again shortly",
+        "order.notes_staff_only":            "Only support staff can add notes to orders",
+        "order.timeline_staff_only":         "Only support staff can see an order's timeline",
+        "order.note_body_invalid":           "A note needs a body of at most %d characters",
+        "order.note_visibility_invalid":     "Note visibility must be internal or customer",
+        "order.payment_method_conflict":     "Send either payment_method or payments, not both",
+        "order.payments_invalid":            "Each payment needs a payment method, and all but the last a positive amount_cents",
+        "order.payments_too_many":           "An order can be split over at most %d payment methods",
+        "order.payments_total_mismatch":     "Payments add up to %s but the order total is %s",
+        "order.split_payment_authentication": "Only the last payment method of a split payment can ask for authentication",
+        "order.price_changed":               "Prices on this order have changed since the cart was priced",
+        "order.prices_unavailable":          "Prices could not be checked right now, try again shortly",
+        "order.product_unavailable":         "Product %q is no longer available",
+        "order.product_currency_mismatch":   "Product %q is not sold in %s",
+        "order.fraud_declined":              "This order could not be placed, please contact support",
+        "order.held_for_review":             "This order is being reviewed and can't be changed until the review is done",
+        "order.paid_use_refund":             "Paid orders can't be cancelled; use POST /api/orders/{orderId}/refund to return the payment",
+        "order.fraud_rejected":              "The order was cancelled after review and its payment returned",
+        "order.duplicate":                   "An identical order was placed in the last %d seconds; send force=true to place it again",
+        "order.other_customer":             "You can only see and place your own orders",
+        "order.cart_snapshot_invalid":      "Cart snapshot is invalid",
+        "order.cart_snapshot_empty":        "Cart snapshot has no items",
+        "order.cart_snapshot_expired":      "Cart snapshot expired, check out again",
+        "order.cart_snapshot_mismatch":     "Cart snapshot does not match the request",
+        "order.cart_snapshot_subtotal":     "Cart snapshot subtotal does not match its items",
+        "order.cart_snapshot_already_used": "Cart snapshot was already used to place an order",
+
+        "cart.not_found":          "Cart not found",
+        "cart.empty":              "Cart is empty",
+        "cart.item_required":      "Product ID and positive quantity required",
+        "cart.quantity_required":  "Valid quantity required",
+        "cart.item_not_found":     "Item not found in cart",
+        "cart.reservation_failed": "Failed to reserve inventory",
+        "cart.invalid_total":      "Cart total could not be calculated",
+
+        "product.not_found":         "Product not found",
+        "product.title_required":    "Title is required",
+        "product.price_positive":    "Price must be positive",
+        "product.invalid_price":     "Price must be a positive %s amount",
+        "product.invalid_sort":      "Sort must be 'price_asc' or 'price_desc'",
+        "product.invalid_image_url": "Image %q is not an http(s) URL",
+        "product.image_unreadable":  "Failed to read image",
+        "product.image_too_large":   "Image must be at most %d bytes",
+        "product.image_type":        "Image must be JPEG, PNG or GIF",
+        "product.image_not_found":   "Image not found",
+    },
+    "es": {
+        "request.invalid_json":    "JSON no válido",
+        "currency.unsupported":    "Moneda no admitida %q",
+        "currency.not_settleable": "No se pueden aceptar pedidos en %q: no hay tipo de cambio a la moneda de liquidación",
+
+        "auth.token_required": "Inicia sesión para ver o realizar pedidos",
+        "auth.token_invalid":   "Tu sesión no es válida o ha caducado, vuelve a iniciar sesión",
+        "auth.role_required":  "No tienes permiso para hacer esto",
+
+        "order.not_found":                  "Pedido no encontrado",
+        "order.cart_and_payment_required":  "Se requieren el ID del carrito y el método de pago",
+        "order.invalid_status":             "Estado no válido",
+        "order.invalid_transition":         "No se puede cambiar el estado del pedido de %q a %q",
+        "order.invalid_total":              "No se pudo calcular el total del pedido",
+        "order.cannot_cancel_shipped":      "No se puede cancelar un pedido enviado",
+        "order.checkout_in_progress":       "El pago del pedido aún se está procesando, inténtalo de nuevo en unos momentos",
+        "order.checkout_busy":              "Hay demasiados pagos en curso, inténtalo de nuevo en unos momentos",
+        "order.inventory_unavailable":      "No se pudo confirmar el stock de este pedido; el pago ha sido reembolsado",
+        "order.payment_failed":             "Error al procesar el pago",
+        "order.payment_declined":           "El pago fue rechazado; prueba con otro método de pago",
+        "order.payment_method_required":    "Se requiere un método de pago",
+        "order.retry_not_allowed":          "Solo se puede reintentar el pago de pedidos cuyo pago falló; este pedido está %q",
+        "order.refund_in_progress":         "Ya se está procesando un reembolso de este pedido, inténtalo de nuevo en unos momentos",
+        "order.refund_item_invalid":        "Cada artículo a reembolsar debe indicar un producto del pedido y una cantidad positiva",
+        "order.refund_exceeds_order":       "No se puede reembolsar más de %q de lo que queda por reembolsar en el pedido",
+        "order.refund_failed":              "No se pudo reembolsar el pago",
+        "order.return_not_allowed":         "Solo se pueden devolver artículos de pedidos enviados o entregados; este pedido está en %q",
+        "order.return_item_invalid":        "Cada artículo a devolver debe indicar un producto del pedido y una cantidad positiva",
+        "order.return_exceeds_order":       "No se puede devolver más de %q de lo que queda por devolver en el pedido",
+        "order.return_not_found":           "Devolución no encontrada",
+        "order.invoice_not_available":      "La factura solo está disponible cuando el pedido está pagado; está %q",
+        "order.shipment_tracking_required":  "Un envío necesita un transportista y un número de seguimiento",
+        "order.shipment_not_allowed":        "Solo se pueden enviar pedidos pagados; este pedido está en %q",
+        "order.shipment_item_invalid":       "Cada artículo del envío necesita un producto del pedido y una cantidad positiva",
+        "order.shipment_exceeds_order":      "No se pueden enviar más unidades de %q de las que quedan por enviar",
+        "order.shipment_nothing_left":       "Todos los artículos de este pedido ya se han enviado",
+        "order.address_field_required":      "%s es obligatorio",
+        "order.address_field_too_long":      "%s no puede superar los %d caracteres",
+        "order.address_country_invalid":     "%s debe ser un código de país ISO 3166-1 de dos letras, no %q",
+        "order.address_change_not_allowed":  "No se puede cambiar la dirección de envío de un pedido en estado %s",
+        "order.address_change_tax":          "La nueva dirección de envío cambia los impuestos del pedido; cancélalo y vuelve a realizarlo",
+        "order.shipping_method_invalid":     "El método de envío %q no está disponible; elige uno de %s",
+        "order.metadata_key_invalid":        "La clave de metadatos %q debe tener como máximo %d letras minúsculas, dígitos, _, - o ., y empezar por una letra o un dígito",
+        "order.metadata_value_too_long":     "El valor de metadatos de %q debe tener como máximo %d caracteres",
+        "order.metadata_too_many":           "Un pedido puede tener como máximo %d claves de metadatos",
+        "order.rule_violated":               "Este pedido no se puede realizar",
+        "order.rule_max_total":              "Los pedidos pueden sumar como máximo %s",
+        "order.rule_max_quantity":           "Se pueden pedir como máximo %d unidades de %s a la vez",
+        "order.rule_product_restricted":     "%s no se puede enviar a %s",
+        "order.tax_unavailable":             "No se pudieron calcular los impuestos de este pedido, inténtalo de nuevo en unos momentos",
+        "order.coupon_invalid":              "El cupón %q no es válido para este pedido",
+        "order.coupon_unavailable":          "No se pudieron comprobar los cupones en este momento, inténtalo de nuevo en unos momentos",
+        "order.exchange_rate_unavailable":   "No se pudieron obtener los tipos de cambio en este momento, inténtalo de nuevo en unos momentos",
+        "order.payment_timed_out":           "El pedido no se pagó en %d minutos",
+        "order.payment_unavailable":         "Los pagos no están disponibles en este momento, inténtalo de nuevo en breve",
+        "order.notes_staff_only":            "Solo el personal de soporte puede añadir notas a los pedidos",
+        "order.timeline_staff_only":         "Solo el personal de soporte puede ver la cronología de un pedido",
+        "order.note_body_invalid":           "Una nota necesita un texto de como máximo %d caracteres",
+        "order.note_visibility_invalid":     "La visibilidad de la nota debe ser internal o customer",
+        "order.payment_method_conflict":     "Envía payment_method o payments, no ambos",
+        "order.payments_invalid":            "Cada pago necesita un método de pago y, salvo el último, un amount_cents positivo",
+        "order.payments_too_many":           "Un pedido se puede repartir como máximo entre %d métodos de pago",
+        "order.payments_total_mismatch":     "Los pagos suman %s pero el total del pedido es %s",
+        "order.split_payment_authentication": "Solo el último método de pago de un pago dividido puede pedir autenticación",
+        "order.price_changed":               "Los precios de este pedido han cambiado desde que se calculó el carrito",
+        "order.prices_unavailable":          "No se pudieron comprobar los precios en este momento, inténtalo de nuevo en unos momentos",
+        "order.product_unavailable":         "El producto %q ya no está disponible",
+        "order.product_currency_mismatch":   "El producto %q no se vende en %s",
+        "order.fraud_declined":              "No se ha podido realizar este pedido, ponte en contacto con soporte",
+        "order.held_for_review":             "Este pedido está en revisión y no se puede modificar hasta que termine",
+        "order.paid_use_refund":             "Los pedidos pagados no se pueden cancelar; usa POST /api/orders/{orderId}/refund para devolver el pago",
+        "order.fraud_rejected":              "El pedido se canceló tras su revisión y se devolvió el pago",
+        "order.duplicate":                   "Se ha realizado un pedido idéntico en los últimos %d segundos; envía force=true para realizarlo de nuevo",
+        "order.other_customer":             "Solo puedes ver y realizar tus propios pedidos",
+        "order.cart_snapshot_invalid":      "La instantánea del carrito no es válida",
+        "order.cart_snapshot_empty":        "La instantánea del carrito no tiene artículos",
+        "order.cart_snapshot_expired":      "La instantánea del carrito ha caducado, vuelve a finalizar la compra",
+        "order.cart_snapshot_mismatch":     "La instantánea del carrito no coincide con la solicitud",
+        "order.cart_snapshot_subtotal":     "El subtotal de la instantánea del carrito no coincide con sus artículos",
+        "order.cart_snapshot_already_used": "La instantánea del carrito ya se usó para realizar un pedido",
+
+        "cart.not_found":          "Carrito no encontrado",
+        "cart.empty":              "El carrito está vacío",
+        "cart.item_required":      "Se requieren el ID del producto y una cantidad positiva",
+        "cart.quantity_required":  "Se requiere una cantidad válida",
+        "cart.item_not_found":     "Artículo no encontrado en el carrito",
+        "cart.reservation_failed": "No se pudo reservar el inventario",
+        "cart.invalid_total":      "No se pudo calcular el total del carrito",
+
+        "product.not_found":         "Producto no encontrado",
+        "product.title_required":    "El título es obligatorio",
+        "product.price_positive":    "El precio debe ser positivo",
+        "product.invalid_price":     "El precio debe ser un importe positivo en %s",
+        "product.invalid_sort":      "El orden debe ser 'price_asc' o 'price_desc'",
+        "product.invalid_image_url": "La imagen %q no es una URL http(s)",
+        "product.image_unreadable":  "No se pudo leer la imagen",
+        "product.image_too_large":   "La imagen debe ocupar como máximo %d bytes",
+        "product.image_type":        "La imagen debe ser JPEG, PNG o GIF",
+        "product.image_not_found":   "Imagen no encontrada",
+    },
+    "fr": {
+        "request.invalid_json":    "JSON non valide",
+        "currency.unsupported":    "Devise non prise en charge %q",
+        "currency.not_settleable": "Les commandes en %q ne peuvent pas être acceptées : aucun taux de change vers la devise de règlement",
+
+        "auth.token_required": "Connectez-vous pour voir ou passer des commandes",
+        "auth.token_invalid":   "Votre session est invalide ou a expiré, reconnectez-vous",
+        "auth.role_required":  "Vous n'avez pas l'autorisation de faire cela",
+
+        "order.not_found":                  "Commande introuvable",
+        "order.cart_and_payment_required":  "L'identifiant du panier et le moyen de paiement sont obligatoires",
+        "order.invalid_status":             "Statut non valide",
+        "order.invalid_transition":         "Impossible de passer le statut de la commande de %q à %q",
+        "order.invalid_total":              "Le total de la commande n'a pas pu être calculé",
+        "order.cannot_cancel_shipped":      "Impossible d'annuler une commande expédiée",
+        "order.checkout_in_progress":       "La commande est encore en cours de traitement, réessayez dans un instant",
+        "order.checkout_busy":              "Trop de commandes en cours de traitement, réessayez dans un instant",
+        "order.inventory_unavailable":      "Le stock de cette commande n'a pas pu être confirmé ; le paiement a été remboursé",
+        "order.payment_failed":             "Échec du traitement du paiement",
+        "order.payment_declined":           "Le paiement a été refusé ; essayez un autre moyen de paiement",
+        "order.payment_method_required":    "Moyen de paiement requis",
+        "order.retry_not_allowed":          "Seules les commandes dont le paiement a échoué peuvent le retenter ; cette commande est %q",
+        "order.refund_in_progress":         "Un remboursement de cette commande est déjà en cours, réessayez dans un instant",
+        "order.refund_item_invalid":        "Chaque article à rembourser doit indiquer un produit de la commande et une quantité positive",
+        "order.refund_exceeds_order":       "Impossible de rembourser plus de %q qu'il n'en reste à rembourser sur la commande",
+        "order.refund_failed":              "Le paiement n'a pas pu être remboursé",
+        "order.return_not_allowed":         "Seules les commandes expédiées ou livrées peuvent être retournées ; cette commande est %q",
+        "order.return_item_invalid":        "Chaque article à retourner doit indiquer un produit de la commande et une quantité positive",
+        "order.return_exceeds_order":       "Impossible de retourner plus de %q qu'il n'en reste à retourner sur la commande",
+        "order.return_not_found":           "Retour introuvable",
+        "order.invoice_not_available":      "La facture n'est disponible qu'une fois la commande payée ; elle est %q",
+        "order.shipment_tracking_required":  "Une expédition nécessite un transporteur et un numéro de suivi",
+        "order.shipment_not_allowed":        "Seules les commandes payées peuvent être expédiées ; cette commande est %q",
+        "order.shipment_item_invalid":       "Chaque article expédié doit être un produit de la commande avec une quantité positive",
+        "order.shipment_exceeds_order":      "Impossible d'expédier plus de %q qu'il n'en reste à expédier",
+        "order.shipment_nothing_left":       "Tous les articles de cette commande ont déjà été expédiés",
+        "order.address_field_required":      "%s est obligatoire",
+        "order.address_field_too_long":      "%s ne doit pas dépasser %d caractères",
+        "order.address_country_invalid":     "%s doit être un code pays ISO 3166-1 à deux lettres, pas %q",
+        "order.address_change_not_allowed":  "L'adresse de livraison d'une commande à l'état %s ne peut pas être modifiée",
+        "order.address_change_tax":          "La nouvelle adresse de livraison modifie la taxe de la commande ; annulez-la et passez-la à nouveau",
+        "order.shipping_method_invalid":     "Le mode de livraison %q n'est pas proposé ; choisissez parmi %s",
+        "order.metadata_key_invalid":        "La clé de métadonnées %q doit comporter au plus %d lettres minuscules, chiffres, _, - ou ., et commencer par une lettre ou un chiffre",
+        "order.metadata_value_too_long":     "La valeur de métadonnées de %q doit comporter au plus %d caractères",
+        "order.metadata_too_many":           "Une commande peut avoir au plus %d clés de métadonnées",
+        "order.rule_violated":               "Cette commande ne peut pas être passée",
+        "order.rule_max_total":              "Une commande ne peut pas dépasser %s",
+        "order.rule_max_quantity":           "Vous pouvez commander au plus %d unités de %s à la fois",
+        "order.rule_product_restricted":     "%s ne peut pas être livré vers %s",
+        "order.tax_unavailable":             "Les taxes de cette commande n'ont pas pu être calculées, réessayez dans un instant",
+        "order.coupon_invalid":              "Le code promo %q n'est pas valable pour cette commande",
+        "order.coupon_unavailable":          "Les codes promo ne peuvent pas être vérifiés pour le moment, réessayez dans un instant",
+        "order.exchange_rate_unavailable":   "Les taux de change ne peuvent pas être récupérés pour le moment, réessayez dans un instant",
+        "order.payment_timed_out":           "La commande n'a pas été payée dans les %d minutes",
+        "order.payment_unavailable":         "Les paiements sont indisponibles pour le moment, réessayez dans un instant",
+        "order.notes_staff_only":            "Seul le support peut ajouter des notes aux commandes",
+        "order.timeline_staff_only":         "Seul le support peut consulter la chronologie d'une commande",
+        "order.note_body_invalid":           "Une note doit avoir un texte d'au plus %d caractères",
+        "order.note_visibility_invalid":     "La visibilité de la note doit être internal ou customer",
+        "order.payment_method_conflict":     "Envoyez payment_method ou payments, pas les deux",
+        "order.payments_invalid":            "Chaque paiement doit avoir un moyen de paiement et, sauf le dernier, un amount_cents positif",
+        "order.payments_too_many":           "Une commande peut être répartie sur %d moyens de paiement au plus",
+        "order.payments_total_mismatch":     "Les paiements totalisent %s mais le total de la commande est %s",
+        "order.split_payment_authentication": "Seul le dernier moyen d'un paiement fractionné peut demander une authentification",
+        "order.price_changed":               "Les prix de cette commande ont changé depuis le calcul du panier",
+        "order.prices_unavailable":          "Les prix ne peuvent pas être vérifiés pour le moment, réessayez dans un instant",
+        "order.product_unavailable":         "Le produit %q n'est plus disponible",
+        "order.product_currency_mismatch":   "Le produit %q n'est pas vendu en %s",
+        "order.fraud_declined":              "Cette commande n'a pas pu être passée, veuillez contacter le support",
+        "order.held_for_review":             "Cette commande est en cours de vérification et ne peut pas être modifiée avant la fin de celle-ci",
+        "order.paid_use_refund":             "Une commande payée ne peut pas être annulée ; utilisez POST /api/orders/{orderId}/refund pour rembourser le paiement",
+        "order.fraud_rejected":              "La commande a été annulée après vérification et son paiement remboursé",
+        "order.duplicate":                   "Une commande identique a été passée au cours des %d dernières secondes ; envoyez force=true pour la passer à nouveau",
+        "order.other_customer":             "Vous ne pouvez voir et passer que vos propres commandes",
+        "order.cart_snapshot_invalid":      "L'instantané du panier n'est pas valide",
+        "order.cart_snapshot_empty":        "L'instantané du panier ne contient aucun article",
+        "order.cart_snapshot_expired":      "L'instantané du panier a expiré, veuillez repasser la commande",
+        "order.cart_snapshot_mismatch":     "L'instantané du panier ne correspond pas à la requête",
+        "order.cart_snapshot_subtotal":     "Le sous-total de l'instantané du panier ne correspond pas à ses articles",
+        "order.cart_snapshot_already_used": "L'instantané du panier a déjà servi à passer une commande",
+
+        "cart.not_found":          "Panier introuvable",
+        "cart.empty":              "Le panier est vide",
+        "cart.item_required":      "L'identifiant du produit et une quantité positive sont obligatoires",
+        "cart.quantity_required":  "Une quantité valide est obligatoire",
+        "cart.item_not_found":     "Article introuvable dans le panier",
+        "cart.reservation_failed": "Impossible de réserver le stock",
+        "cart.invalid_total":      "Le total du panier n'a pas pu être calculé",
+
+        "product.not_found":         "Produit introuvable",
+        "product.title_required":    "Le titre est obligatoire",
+        "product.price_positive":    "Le prix doit être positif",
+        "product.invalid_price":     "Le prix doit être un montant positif en %s",
+        "product.invalid_sort":      "Le tri doit être 'price_asc' ou 'price_desc'",
+        "product.invalid_image_url": "L'image %q n'est pas une URL http(s)",
+        "product.image_unreadable":  "Impossible de lire l'image",
+        "product.image_too_large":   "L'image ne doit pas dépasser %d octets",
+        "product.image_type":        "L'image doit être au format JPEG, PNG ou GIF",
+        "product.image_not_found":   "Image introuvable",
+    },
+    "de": {
+        "request.invalid_json":    "Ungültiges JSON",
+        "currency.unsupported":    "Nicht unterstützte Währung %q",
+        "currency.not_settleable": "Bestellungen in %q können nicht angenommen werden: Es gibt keinen Wechselkurs zur Abrechnungswährung",
+
+        "auth.token_required": "Melden Sie sich an, um Bestellungen zu sehen oder aufzugeben",
+        "auth.token_invalid":   "Ihre Anmeldung ist ungültig oder abgelaufen, melden Sie sich erneut an",
+        "auth.role_required":  "Sie haben keine Berechtigung dafür",
+
+        "order.not_found":                  "Bestellung nicht gefunden",
+        "order.cart_and_payment_required":  "Warenkorb-ID und Zahlungsmethode erforderlich",
+        "order.invalid_status":             "Ungültiger Status",
+        "order.invalid_transition":         "Bestellstatus kann nicht von %q zu %q geändert werden",
+        "order.invalid_total":              "Bestellsumme konnte nicht berechnet werden",
+        "order.cannot_cancel_shipped":      "Versandte Bestellungen können nicht storniert werden",
+        "order.checkout_in_progress":       "Die Bestellung wird noch bearbeitet, bitte versuchen Sie es gleich erneut",
+        "order.checkout_busy":              "Zu viele Bestellungen in Bearbeitung, bitte versuchen Sie es gleich erneut",
+        "order.inventory_unavailable":      "Der Bestand für diese Bestellung konnte nicht bestätigt werden; die Zahlung wurde erstattet",
+        "order.payment_failed":             "Zahlung konnte nicht verarbeitet werden",
+        "order.payment_declined":           "Die Zahlung wurde abgelehnt; versuchen Sie eine andere Zahlungsmethode",
+        "order.payment_method_required":    "Zahlungsmethode erforderlich",
+        "order.retry_not_allowed":          "Nur Bestellungen mit fehlgeschlagener Zahlung können sie wiederholen; diese Bestellung ist %q",
+        "order.refund_in_progress":         "Für diese Bestellung wird bereits eine Erstattung bearbeitet, bitte gleich erneut versuchen",
+        "order.refund_item_invalid":        "Jede Erstattungsposition braucht ein Produkt der Bestellung und eine positive Menge",
+        "order.refund_exceeds_order":       "Von %q kann nicht mehr erstattet werden, als in der Bestellung noch offen ist",
+        "order.refund_failed":              "Die Zahlung konnte nicht erstattet werden",
+        "order.return_not_allowed":         "Nur versandte oder zugestellte Bestellungen können zurückgegeben werden; diese Bestellung ist %q",
+        "order.return_item_invalid":        "Jede Rücksendeposition braucht ein Produkt der Bestellung und eine positive Menge",
+        "order.return_exceeds_order":       "Von %q kann nicht mehr zurückgegeben werden, als in der Bestellung noch offen ist",
+        "order.return_not_found":           "Rücksendung nicht gefunden",
+        "order.invoice_not_available":      "Eine Rechnung gibt es erst, wenn die Bestellung bezahlt ist; sie ist %q",
+        "order.shipment_tracking_required":  "Eine Sendung braucht einen Versanddienstleister und eine Sendungsnummer",
+        "order.shipment_not_allowed":        "Nur bezahlte Bestellungen können versendet werden; diese Bestellung ist %q",
+        "order.shipment_item_invalid":       "Jeder Sendungsartikel braucht ein Produkt der Bestellung und eine positive Menge",
+        "order.shipment_exceeds_order":      "Von %q kann nicht mehr versendet werden, als noch zu versenden ist",
+        "order.shipment_nothing_left":       "Alle Artikel dieser Bestellung wurden bereits versendet",
+        "order.address_field_required":      "%s ist erforderlich",
+        "order.address_field_too_long":      "%s darf höchstens %d Zeichen lang sein",
+        "order.address_country_invalid":     "%s muss ein zweistelliger Ländercode nach ISO 3166-1 sein, nicht %q",
+        "order.address_change_not_allowed":  "Die Lieferadresse einer Bestellung im Status %s kann nicht geändert werden",
+        "order.address_change_tax":          "Die neue Lieferadresse ändert die Steuer der Bestellung; stornieren Sie sie und geben Sie sie erneut auf",
+        "order.shipping_method_invalid":     "Die Versandart %q wird nicht angeboten; wählen Sie eine von %s",
+        "order.metadata_key_invalid":        "Der Metadatenschlüssel %q darf höchstens %d Kleinbuchstaben, Ziffern, _, - oder . enthalten und muss mit einem Buchstaben oder einer Ziffer beginnen",
+        "order.metadata_value_too_long":     "Der Metadatenwert von %q darf höchstens %d Zeichen lang sein",
+        "order.metadata_too_many":           "Eine Bestellung kann höchstens %d Metadatenschlüssel haben",
+        "order.rule_violated":               "Diese Bestellung kann nicht aufgegeben werden",
+        "order.rule_max_total":              "Bestellungen dürfen höchstens %s betragen",
+        "order.rule_max_quantity":           "Höchstens %d Stück von %s können auf einmal bestellt werden",
+        "order.rule_product_restricted":     "%s kann nicht nach %s versandt werden",
+        "order.tax_unavailable":             "Die Steuer für diese Bestellung konnte nicht berechnet werden, bitte gleich erneut versuchen",
+        "order.coupon_invalid":              "Der Gutschein %q ist für diese Bestellung nicht gültig",
+        "order.coupon_unavailable":          "Gutscheine können gerade nicht geprüft werden, bitte gleich erneut versuchen",
+        "order.exchange_rate_unavailable":   "Wechselkurse können gerade nicht abgerufen werden, bitte gleich erneut versuchen",
+        "order.payment_timed_out":           "Die Bestellung wurde nicht innerhalb von %d Minuten bezahlt",
+        "order.payment_unavailable":         "Zahlungen sind gerade nicht verfügbar, bitte versuchen Sie es gleich noch einmal",
+        "order.notes_staff_only":            "Nur der Support kann Bestellungen Notizen hinzufügen",
+        "order.timeline_staff_only":         "Nur der Support kann den Verlauf einer Bestellung einsehen",
+        "order.note_body_invalid":           "Eine Notiz braucht einen Text mit höchstens %d Zeichen",
+        "order.note_visibility_invalid":     "Die Sichtbarkeit der Notiz muss internal oder customer sein",
+        "order.payment_method_conflict":     "Bitte entweder payment_method oder payments senden, nicht beides",
+        "order.payments_invalid":            "Jede Zahlung braucht eine Zahlungsart und, außer der letzten, einen positiven amount_cents-Betrag",
+        "order.payments_too_many":           "Eine Bestellung kann auf höchstens %d Zahlungsarten aufgeteilt werden",
+        "order.payments_total_mismatch":     "Die Zahlungen ergeben %s, die Bestellsumme ist aber %s",
+        "order.split_payment_authentication": "Nur die letzte Zahlungsart einer geteilten Zahlung kann eine Authentifizierung verlangen",
+        "order.price_changed":               "Die Preise dieser Bestellung haben sich seit der Berechnung des Warenkorbs geändert",
+        "order.prices_unavailable":          "Preise können gerade nicht geprüft werden, bitte gleich erneut versuchen",
+        "order.product_unavailable":         "Produkt %q ist nicht mehr verfügbar",
+        "order.product_currency_mismatch":   "Produkt %q wird nicht in %s verkauft",
+        "order.fraud_declined":              "Diese Bestellung konnte nicht aufgegeben werden, bitte wenden Sie sich an den Support",
+        "order.held_for_review":             "Diese Bestellung wird geprüft und kann bis zum Abschluss der Prüfung nicht geändert werden",
+        "order.paid_use_refund":             "Bezahlte Bestellungen können nicht storniert werden; verwenden Sie POST /api/orders/{orderId}/refund, um die Zahlung zu erstatten",
+        "order.fraud_rejected":              "Die Bestellung wurde nach der Prüfung storniert und die Zahlung erstattet",
+        "order.duplicate":                   "Eine identische Bestellung wurde in den letzten %d Sekunden aufgegeben; senden Sie force=true, um sie erneut aufzugeben",
+        "order.other_customer":             "Sie können nur Ihre eigenen Bestellungen sehen und aufgeben",
+        "order.cart_snapshot_invalid":      "Warenkorb-Snapshot ist ungültig",
+        "order.cart_snapshot_empty":        "Warenkorb-Snapshot enthält keine Artikel",
+        "order.cart_snapshot_expired":      "Warenkorb-Snapshot ist abgelaufen, bitte erneut zur Kasse gehen",
+        "order.cart_snapshot_mismatch":     "Warenkorb-Snapshot passt nicht zur Anfrage",
+        "order.cart_snapshot_subtotal":     "Zwischensumme des Warenkorb-Snapshots passt nicht zu den Artikeln",
+        "order.cart_snapshot_already_used": "Warenkorb-Snapshot wurde bereits für eine Bestellung verwendet",
+
+        "cart.not_found":          "Warenkorb nicht gefunden",
+        "cart.empty":              "Warenkorb ist leer",
+        "cart.item_required":      "Produkt-ID und positive Menge erforderlich",
+        "cart.quantity_required":  "Gültige Menge erforderlich",
+        "cart.item_not_found":     "Artikel nicht im Warenkorb gefunden",
+        "cart.reservation_failed": "Bestand konnte nicht reserviert werden",
+        "cart.invalid_total":      "Warenkorbsumme konnte nicht berechnet werden",
+
+        "product.not_found":         "Produkt nicht gefunden",
+        "product.title_required":    "Titel ist erforderlich",
+        "product.price_positive":    "Preis muss positiv sein",
+        "product.invalid_price":     "Preis muss ein positiver Betrag in %s sein",
+        "product.invalid_sort":      "Sortierung muss 'price_asc' oder 'price_desc' sein",
+        "product.invalid_image_url": "Bild %q ist keine http(s)-URL",
+        "product.image_unreadable":  "Bild konnte nicht gelesen werden",
+        "product.image_too_large":   "Bild darf höchstens %d Bytes groß sein",
+        "product.image_type":        "Bild muss JPEG, PNG oder GIF sein",
+        "product.image_not_found":   "Bild nicht gefunden",
+    },
+}
+
+// MessageError is an error returned by a helper whose failure is shown to
+// customers; handlers localize it by code rather than echoing Error()
+type MessageError struct {
+    Code string
+    Args []interface{}
+}
+
+func (e *MessageError) Error() string {
+    return Message(DefaultLocale, e.Code, e.Args...)
+}
+
+// NewError creates an error carrying a message code
+func NewError(code string, args ...interface{}) error {
+    return &MessageError{Code: code, Args: args}
+}
+
+// NegotiateLocale picks the best supported locale from an Accept-Language
+// header ("fr-CH, fr;q=0.9, en;q=0.8"). Regional tags fall back to their
+// language (es-MX -> es); anything unsupported falls back to DefaultLocale.
+func NegotiateLocale(acceptLanguage string) string {
+    type candidate struct {
+        locale  string
+        quality float64
+    }
+    var candidates []candidate
+
+    for _, part := range strings.Split(acceptLanguage, ",") {
+        tag, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+        tag = strings.ToLower(strings.TrimSpace(tag))
+        if tag == "" || tag == "*" {
+            continue
+        }
+
+        quality := 1.0
+        if value, found := strings.CutPrefix(strings.TrimSpace(params), "q="); found {
+            parsed, err := strconv.ParseFloat(value, 64)
+            if err != nil {
+                continue
+            }
+            quality = parsed
+        }
+        if quality <= 0 {
+            continue
+        }
+
+        language, _, _ := strings.Cut(tag, "-")
+        for _, locale := range []string{tag, language} {
+            if _, supported := messages[locale]; supported {
+                candidates = append(candidates, candidate{locale: locale, quality: quality})
+                break
+            }
+        }
+    }
+
+    // Stable, so equal weights keep the client's order
+    sort.SliceStable(candidates, func(i, j int) bool {
+        return candidates[i].quality > candidates[j].quality
+    })
+    if len(candidates) > 0 {
+        return candidates[0].locale
+    }
+    return DefaultLocale
+}
+
+// Message renders a message code in a locale, falling back to the default
+// locale and finally to the code itself
+func Message(locale string, code string, args ...interface{}) string {
+    format, exists := messages[locale][code]
+    if !exists {
+        format, exists = messages[DefaultLocale][code]
+    }
+    if !exists {
+        return code
+    }
+    if len(args) == 0 {
+        return format
+    }
+    return fmt.Sprintf(format, args...)
+}
+
+// WriteError writes a customer-facing error in the caller's language. The body stays plain text as with http.Error; the code goes in
+// X-Error-Code so clients never have to match on the text.
+func WriteError(w http.ResponseWriter, r *http.Request, status int, code string, args ...interface{}) {
+    locale := NegotiateLocale(r.Header.Get("Accept-Language"))
+
+    w.Header().Set(ErrorCodeHeader, code)
+    w.Header().Set("Content-Language", locale)
+    w.Header().Add("Vary", "Accept-Language")
+    http.Error(w, Message(locale, code, args...), status)
+}
+
+// WriteMessageError writes an error returned by a helper: message errors
+// are localized, anything else is reported under the fallback code
+func WriteMessageError(w http.ResponseWriter, r *http.Request, status int, err error, fallback string) {
+    var messageErr *MessageError
+    if errors.As(err, &messageErr) {
+        WriteError(w, r, status, messageErr.Code, messageErr.Args...)
+        return
+    }
+    WriteError(w, r, status, fallback)
+}
@@ -0,0 +1,82 @@
+package i18n
+
+import (
+    "errors"
+    "fmt"
+    "net/http/httptest"
+    "testing"
+)
+
+func TestNegotiateLocale(t *testing.T) {
+    tests := []struct {
+        header string
+        want   string
+    }{
+        {"", DefaultLocale},
+        {"fr-CH, fr;q=0.9, en;q=0.8", "fr"},
+        {"es-MX", "es"},
+        {"ja, de;q=0.5", "de"},
+        {"de;q=0.5, fr;q=0.5", "de"},
+        {"en;q=0.1, es;q=0", "en"},
+        {"*", DefaultLocale},
+        {"xx-YY", DefaultLocale},
+    }
+    for _, tt := range tests {
+        if got := NegotiateLocale(tt.header); got != tt.want {
+            t.Errorf("NegotiateLocale(%q) = %q, want %q", tt.header, got, tt.want)
+        }
+    }
+}
+
+// Every locale must use the same format verbs as English for each code it
+// translates, or a translated message renders its arguments wrongly
+func TestCatalogMatchesDefaultLocale(t *testing.T) {
+    for locale, catalog := range messages {
+        for code, format := range catalog {
+            english, exists := messages[DefaultLocale][code]
+            if !exists {
+                t.Errorf("%s: %s has no %s message", locale, code, DefaultLocale)
+                continue
+            }
+            if got, want := verbs(format), verbs(english); got != want {
+                t.Errorf("%s: %s uses %q, %s uses %q", locale, code, got, DefaultLocale, want)
+            }
+        }
+    }
+}
+
+// Helper function to list the format verbs of a message, in order
+func verbs(format string) string {
+    result := ""
+    for i := 0; i < len(format)-1; i++ {
+        if format[i] != '%' {
+            continue
+        }
+        i++
+        for i < len(format)-1 && (format[i] >= '0' && format[i] <= '9' || format[i] == '.' || format[i] == '-') {
+            i++
+        }
+        result += string(format[i])
+    }
+    return result
+}
+
+func TestWriteMessageError(t *testing.T) {
+    req := httptest.NewRequest("GET", "/", nil)
+    req.Header.Set("Accept-Language", "de")
+
+    rec := httptest.NewRecorder()
+    WriteMessageError(rec, req, 400, fmt.Errorf("checking: %w", NewError("order.not_found")), "order.invalid_status")
+    if code := rec.Header().Get(ErrorCodeHeader); code != "order.not_found" {
+        t.Errorf("wrapped message error written as %q, want order.not_found", code)
+    }
+    if language := rec.Header().Get("Content-Language"); language != "de" {
+        t.Errorf("Content-Language = %q, want de", language)
+    }
+
+    rec = httptest.NewRecorder()
+    WriteMessageError(rec, req, 400, errors.New("boom"), "order.invalid_status")
+    if code := rec.Header().Get(ErrorCodeHeader); code != "order.invalid_status" {
+        t.Errorf("plain error written as %q, want the fallback order.invalid_status", code)
+    }
+}
@@ -0,0 +1,92 @@
+// Package loadshed caps the requests a service serves at once, answering
+// the rest with 503 and Retry-After.
+package loadshed
+
+import (
+    "fmt"
+    "log"
+    "net/http"
+    "os"
+    "strconv"
+    "sync/atomic"
+
+    "middleware/slo"
+)
+
+// Load shedding settings. MAX_IN_FLIGHT_REQUESTS caps concurrent requests
+// (0 disables the cap); requests over it get 503 with Retry-After instead
+// of piling onto the in-memory stores and downstream services.
+const (
+    DefaultMaxInFlightRequests = 512
+    DefaultShedRetryAfter      = 1 // seconds
+)
+
+var (
+    maxInFlightRequests = DefaultMaxInFlightRequests
+    shedRetryAfter      = DefaultShedRetryAfter
+    inFlightRequests    atomic.Int64
+    shedRequests        atomic.Int64
+)
+
+func init() {
+    if value := os.Getenv("MAX_IN_FLIGHT_REQUESTS"); value != "" {
+        if parsed, err := strconv.Atoi(value); err == nil && parsed >= 0 {
+            maxInFlightRequests = parsed
+        } else {
+            log.Printf("Ignoring invalid MAX_IN_FLIGHT_REQUESTS=%q", value)
+        }
+    }
+    if value := os.Getenv("SHED_RETRY_AFTER_SECONDS"); value != "" {
+        if parsed, err := strconv.Atoi(value); err == nil && parsed > 0 {
+            shedRetryAfter = parsed
+        } else {
+            log.Printf("Ignoring invalid SHED_RETRY_AFTER_SECONDS=%q", value)
+        }
+    }
+}
+
+// Handler is the load shedding middleware: it rejects requests beyond the
+// in-flight cap. Health checks, readiness checks, metrics and SLOs are
+// never shed so probes and dashboards keep working while the service is
+// saturated, and neither are requests exempt reports (it may be nil), e.g.
+// long-lived streams with a cap of their own.
+func Handler(next http.Handler, exempt func(r *http.Request) bool) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if r.URL.Path == "/health" || r.URL.Path == "/readyz" || r.URL.Path == "/metrics" || r.URL.Path == "/slo" || (exempt != nil && exempt(r)) {
+            next.ServeHTTP(w, r)
+            return
+        }
+
+        inFlight := inFlightRequests.Add(1)
+        defer inFlightRequests.Add(-1)
+
+        if maxInFlightRequests > 0 && inFlight > int64(maxInFlightRequests) {
+            shedRequests.Add(1)
+            // Shed requests never reach a route, so they only count
+            // against objectives that cover every route
+            slo.Record(r.Method, "", http.StatusServiceUnavailable, 0)
+            w.Header().Set("Retry-After", strconv.Itoa(shedRetryAfter))
+            http.Error(w, "Service overloaded, retry later", http.StatusServiceUnavailable)
+            return
+        }
+
+        next.ServeHTTP(w, r)
+    })
+}
+
+// Metrics renders the load shedding metrics in the Prometheus text format
+func Metrics() string {
+    return fmt.Sprintf(`
+# HELP http_requests_in_flight Requests currently being served
+# TYPE http_requests_in_flight gauge
+http_requests_in_flight %d
+
+# HELP http_requests_in_flight_limit Maximum concurrent requests before shedding (0: unlimited)
+# TYPE http_requests_in_flight_limit gauge
+http_requests_in_flight_limit %d
+
+# HELP http_requests_shed_total Requests rejected with 503 because the service was at capacity
+# TYPE http_requests_shed_total counter
+http_requests_shed_total %d
+`, inFlightRequests.Load(), maxInFlightRequests, shedRequests.Load())
+}
@@ -0,0 +1,58 @@
+package loadshed
+
+import (
+    "net/http"
+    "net/http/httptest"
+    "sync"
+    "testing"
+)
+
+func TestHandlerShedsOverTheCap(t *testing.T) {
+    defer func(limit int) { maxInFlightRequests = limit }(maxInFlightRequests)
+    maxInFlightRequests = 1
+
+    // Hold one request in flight
+    entered, release := make(chan struct{}), make(chan struct{})
+    handler := Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if r.URL.Path == "/slow" {
+            close(entered)
+            <-release
+        }
+    }), func(r *http.Request) bool { return r.URL.Path == "/stream" })
+
+    var wg sync.WaitGroup
+    wg.Add(1)
+    go func() {
+        defer wg.Done()
+        handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/slow", nil))
+    }()
+    <-entered
+
+    tests := []struct {
+        path string
+        want int
+    }{
+        {"/api/orders", http.StatusServiceUnavailable},
+        {"/health", http.StatusOK},
+        {"/metrics", http.StatusOK},
+        {"/stream", http.StatusOK},
+    }
+    for _, tt := range tests {
+        rec := httptest.NewRecorder()
+        handler.ServeHTTP(rec, httptest.NewRequest("GET", tt.path, nil))
+        if rec.Code != tt.want {
+            t.Errorf("%s at the cap = %d, want %d", tt.path, rec.Code, tt.want)
+        }
+        if tt.want == http.StatusServiceUnavailable && rec.Header().Get("Retry-After") == "" {
+            t.Errorf("%s was shed without Retry-After", tt.path)
+        }
+    }
+
+    close(release)
+    wg.Wait()
+    rec := httptest.NewRecorder()
+    handler.ServeHTTP(rec, httptest.NewRequest("GET", "/api/orders", nil))
+    if rec.Code != http.StatusOK {
+        t.Errorf("/api/orders under the cap = %d, want 200", rec.Code)
+    }
+}
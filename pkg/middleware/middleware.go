@@ -0,0 +1,50 @@
+// Package middleware holds the HTTP middleware and metrics helpers the Go
+// services share, one package per concern (middleware/accesslog,
+// middleware/runtimemetrics, ...), and the response recorder they wrap
+// handlers with.
+//
+// The services import it through a replace directive in their go.mod:
+//
+//	require middleware v0.0.0-00010101000000-000000000000
+//
+//	replace middleware => ../../pkg/middleware
+//
+// so their images are built from the repository root.
+package middleware
+
+import "net/http"
+
+// StatusRecorder remembers the status code and body size a handler wrote
+type StatusRecorder struct {
+    http.ResponseWriter
+    Status int
+    Bytes  int
+}
+
+func (w *StatusRecorder) WriteHeader(status int) {
+    if w.Status == 0 {
+        w.Status = status
+    }
+    w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *StatusRecorder) Write(data []byte) (int, error) {
+    if w.Status == 0 {
+        w.Status = http.StatusOK
+    }
+    written, err := w.ResponseWriter.Write(data)
+    w.Bytes += written
+    return written, err
+}
+
+// Flush keeps streamed responses (backups, reindex progress) streaming
+func (w *StatusRecorder) Flush() {
+    if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+        flusher.Flush()
+    }
+}
+
+// Unwrap lets http.ResponseController reach the connection underneath
+func (w *StatusRecorder) Unwrap() http.ResponseWriter {
+    return w.ResponseWriter
+}
@@ -0,0 +1,224 @@
+// Package openmetrics records request latency by route and serves the
+// services' hand-written /metrics output as Prometheus text or, when the
+// scraper asks for it, as OpenMetrics with trace exemplars.
+//
+//	router.Use(openmetrics.Observe)
+//	...
+//	openmetrics.Write(w, r, metrics)
+package openmetrics
+
+import (
+    "fmt"
+    "net/http"
+    "sort"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/gorilla/mux"
+    "middleware"
+    "middleware/accesslog"
+    "middleware/slo"
+)
+
+// LatencyBuckets are the request latency histogram buckets, in seconds
+var LatencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 0.8, 1, 2.5, 5, 10}
+
+// ContentType is served to scrapers that ask for OpenMetrics; everyone
+// else keeps getting the Prometheus text format
+const ContentType = "application/openmetrics-text; version=1.0.0; charset=utf-8"
+
+// exemplar links a histogram bucket to one request that landed in it
+type exemplar struct {
+    TraceID   string
+    Value     float64
+    Timestamp time.Time
+}
+
+// latencyHistogram holds per-bucket (not cumulative) counts for one route;
+// the last slot is +Inf. Each bucket keeps the exemplar of its most recent
+// traced request.
+type latencyHistogram struct {
+    Counts    []uint64
+    Exemplars []*exemplar
+    Sum       float64
+    Count     uint64
+}
+
+var (
+    latencyMu         sync.Mutex
+    latencyHistograms = make(map[[2]string]*latencyHistogram) // {method, route} -> histogram
+)
+
+// TraceID returns the trace ID of a request's W3C traceparent header
+// ("00-<trace id>-<span id>-<flags>"), or "" when the request isn't
+// traced.
+func TraceID(r *http.Request) string {
+    parts := strings.Split(strings.TrimSpace(r.Header.Get("traceparent")), "-")
+    if len(parts) != 4 || len(parts[1]) != 32 || strings.Trim(parts[1], "0") == "" {
+        return ""
+    }
+    for _, c := range parts[1] {
+        if !strings.ContainsRune("0123456789abcdef", c) {
+            return ""
+        }
+    }
+    return parts[1]
+}
+
+// Observe is the latency middleware, installed on the router: it records
+// how long each routed request took, by route template so IDs in paths
+// don't explode the label set, and scores it against the SLOs. Probe,
+// metrics and SLO routes are left out.
+func Observe(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        route := ""
+        if current := mux.CurrentRoute(r); current != nil {
+            route, _ = current.GetPathTemplate()
+        }
+        accesslog.NoteRoute(r, route, mux.Vars(r)["userId"])
+        if route == "" || route == "/health" || route == "/readyz" || route == "/metrics" || route == "/slo" {
+            next.ServeHTTP(w, r)
+            return
+        }
+
+        start := time.Now()
+        recorder := &middleware.StatusRecorder{ResponseWriter: w}
+        next.ServeHTTP(recorder, r)
+        elapsed := time.Since(start)
+
+        if recorder.Status == 0 {
+            recorder.Status = http.StatusOK
+        }
+        recordLatency(r.Method, route, elapsed, TraceID(r))
+        slo.Record(r.Method, route, recorder.Status, elapsed)
+    })
+}
+
+// Helper function to add one observation to a route's histogram
+func recordLatency(method string, route string, elapsed time.Duration, traceID string) {
+    seconds := elapsed.Seconds()
+    bucket := sort.SearchFloat64s(LatencyBuckets, seconds)
+
+    latencyMu.Lock()
+    defer latencyMu.Unlock()
+
+    key := [2]string{method, route}
+    histogram, exists := latencyHistograms[key]
+    if !exists {
+        histogram = &latencyHistogram{
+            Counts:    make([]uint64, len(LatencyBuckets)+1),
+            Exemplars: make([]*exemplar, len(LatencyBuckets)+1),
+        }
+        latencyHistograms[key] = histogram
+    }
+    histogram.Counts[bucket]++
+    histogram.Sum += seconds
+    histogram.Count++
+    if traceID != "" {
+        histogram.Exemplars[bucket] = &exemplar{TraceID: traceID, Value: seconds, Timestamp: time.Now()}
+    }
+}
+
+// Helper function to render the latency histograms. Exemplars are only
+// valid in OpenMetrics, so the Prometheus text output leaves them out.
+func latencyMetrics(withExemplars bool) string {
+    latencyMu.Lock()
+    defer latencyMu.Unlock()
+
+    keys := make([][2]string, 0, len(latencyHistograms))
+    for key := range latencyHistograms {
+        keys = append(keys, key)
+    }
+    sort.Slice(keys, func(i, j int) bool {
+        if keys[i][1] != keys[j][1] {
+            return keys[i][1] < keys[j][1]
+        }
+        return keys[i][0] < keys[j][0]
+    })
+
+    var b strings.Builder
+    b.WriteString(`
+# HELP http_request_duration_seconds Time taken to serve requests, by route
+# TYPE http_request_duration_seconds histogram
+`)
+    for _, key := range keys {
+        histogram := latencyHistograms[key]
+        labels := fmt.Sprintf("method=%q,route=%q", key[0], key[1])
+
+        cumulative := uint64(0)
+        for i := range histogram.Counts {
+            cumulative += histogram.Counts[i]
+            le := "+Inf"
+            if i < len(LatencyBuckets) {
+                le = fmt.Sprintf("%g", LatencyBuckets[i])
+            }
+            fmt.Fprintf(&b, "http_request_duration_seconds_bucket{%s,le=\"%s\"} %d", labels, le, cumulative)
+            if sample := histogram.Exemplars[i]; withExemplars && sample != nil {
+                fmt.Fprintf(&b, " # {trace_id=\"%s\"} %g %.3f", sample.TraceID, sample.Value,
+                    float64(sample.Timestamp.UnixMilli())/1000)
+            }
+            b.WriteString("\n")
+        }
+        fmt.Fprintf(&b, "http_request_duration_seconds_sum{%s} %g\n", labels, histogram.Sum)
+        fmt.Fprintf(&b, "http_request_duration_seconds_count{%s} %d\n", labels, histogram.Count)
+    }
+    return b.String()
+}
+
+// Helper function to rewrite Prometheus text output as OpenMetrics: no
+// blank lines, counter families named without their _total suffix (which
+// every counter sample then carries), and "untyped" spelled "unknown"
+func toOpenMetrics(metrics string) string {
+    // Counter families by the name used in the text format
+    counters := make(map[string]bool)
+    for _, line := range strings.Split(metrics, "\n") {
+        if fields := strings.Fields(line); len(fields) == 4 && fields[1] == "TYPE" && fields[3] == "counter" {
+            counters[fields[2]] = true
+        }
+    }
+
+    var b strings.Builder
+    for _, line := range strings.Split(metrics, "\n") {
+        line = strings.TrimSpace(line)
+        if line == "" {
+            continue
+        }
+
+        if strings.HasPrefix(line, "#") {
+            fields := strings.SplitN(line, " ", 4)
+            if len(fields) >= 3 && (fields[1] == "HELP" || fields[1] == "TYPE") && counters[fields[2]] {
+                fields[2] = strings.TrimSuffix(fields[2], "_total")
+            }
+            if len(fields) == 4 && fields[1] == "TYPE" && fields[3] == "untyped" {
+                fields[3] = "unknown"
+            }
+            b.WriteString(strings.Join(fields, " ") + "\n")
+            continue
+        }
+
+        name := line
+        if end := strings.IndexAny(line, "{ "); end >= 0 {
+            name = line[:end]
+        }
+        if counters[name] && !strings.HasSuffix(name, "_total") {
+            line = name + "_total" + line[len(name):]
+        }
+        b.WriteString(line + "\n")
+    }
+    return b.String()
+}
+
+// Write writes a metrics response, followed by the latency histograms, in
+// the format the scraper asked for. Prometheus requests OpenMetrics by
+// default, which is what carries the trace exemplars through to Grafana.
+func Write(w http.ResponseWriter, r *http.Request, metrics string) {
+    if strings.Contains(r.Header.Get("Accept"), "application/openmetrics-text") {
+        w.Header().Set("Content-Type", ContentType)
+        w.Write([]byte(toOpenMetrics(metrics+latencyMetrics(true)) + "# EOF\n"))
+        return
+    }
+
+    w.Header().Set("Content-Type", "text/plain")
+    w.Write([]byte(metrics + latencyMetrics(false)))
+}
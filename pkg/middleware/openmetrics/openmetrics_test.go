@@ -0,0 +1,73 @@
+package openmetrics
+
+import (
+    "net/http/httptest"
+    "strings"
+    "testing"
+    "time"
+)
+
+func TestTraceID(t *testing.T) {
+    tests := []struct {
+        traceparent string
+        want        string
+    }{
+        {"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", "4bf92f3577b34da6a3ce929d0e0e4736"},
+        {" 00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00 ", "4bf92f3577b34da6a3ce929d0e0e4736"},
+        {"00-00000000000000000000000000000000-00f067aa0ba902b7-01", ""},
+        {"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01", ""},
+        {"00-4bf92f35-00f067aa0ba902b7-01", ""},
+        {"", ""},
+    }
+    for _, tt := range tests {
+        req := httptest.NewRequest("GET", "/", nil)
+        req.Header.Set("traceparent", tt.traceparent)
+        if got := TraceID(req); got != tt.want {
+            t.Errorf("TraceID(%q) = %q, want %q", tt.traceparent, got, tt.want)
+        }
+    }
+}
+
+func TestToOpenMetrics(t *testing.T) {
+    text := `
+# HELP orders_total Orders taken
+# TYPE orders_total counter
+orders_total{status="paid"} 3
+
+# HELP queue_depth Jobs waiting
+# TYPE queue_depth untyped
+queue_depth 2
+`
+    want := `# HELP orders Orders taken
+# TYPE orders counter
+orders_total{status="paid"} 3
+# HELP queue_depth Jobs waiting
+# TYPE queue_depth unknown
+queue_depth 2
+`
+    if got := toOpenMetrics(text); got != want {
+        t.Errorf("toOpenMetrics =\n%s\nwant\n%s", got, want)
+    }
+}
+
+func TestWriteCarriesExemplarsOnlyInOpenMetrics(t *testing.T) {
+    recordLatency("GET", "/api/test/{id}", 30*time.Millisecond, "4bf92f3577b34da6a3ce929d0e0e4736")
+
+    req := httptest.NewRequest("GET", "/metrics", nil)
+    req.Header.Set("Accept", "application/openmetrics-text; version=1.0.0")
+    rec := httptest.NewRecorder()
+    Write(rec, req, "")
+    body := rec.Body.String()
+    if rec.Header().Get("Content-Type") != ContentType || !strings.HasSuffix(body, "# EOF\n") {
+        t.Errorf("OpenMetrics response served as %q, ending %q", rec.Header().Get("Content-Type"), body[len(body)-10:])
+    }
+    if !strings.Contains(body, `http_request_duration_seconds_bucket{method="GET",route="/api/test/{id}",le="0.05"} 1 # {trace_id="4bf92f3577b34da6a3ce929d0e0e4736"} 0.03`) {
+        t.Errorf("OpenMetrics response has no exemplar on the 0.05 bucket:\n%s", body)
+    }
+
+    rec = httptest.NewRecorder()
+    Write(rec, httptest.NewRequest("GET", "/metrics", nil), "")
+    if body := rec.Body.String(); strings.Contains(body, "trace_id") || !strings.Contains(body, `le="0.05"} 1`) {
+        t.Errorf("Prometheus text response:\n%s", body)
+    }
+}
@@ -0,0 +1,57 @@
+// Package outbound builds the HTTP clients the services call out with.
+package outbound
+
+import (
+    "crypto/tls"
+    "crypto/x509"
+    "log"
+    "net/http"
+    "os"
+    "time"
+)
+
+// Transport is the outbound transport. Every call a service makes, to other
+// services, webhook receivers or external hosts, goes through clients
+// built by NewClient so they share this one transport, which:
+//
+//   - sends requests through HTTPS_PROXY / HTTP_PROXY, except for hosts
+//     listed in NO_PROXY (list the internal service names there when an
+//     egress proxy is configured)
+//   - trusts the CA certificates in OUTBOUND_CA_BUNDLE (a PEM file) on top
+//     of the system roots, for proxies and hosts with an internal CA
+var Transport = newTransport()
+
+// Client stands in for http.DefaultClient on calls without a timeout of
+// their own
+var Client = NewClient(0)
+
+// Helper function to build the shared outbound transport
+func newTransport() *http.Transport {
+    transport := http.DefaultTransport.(*http.Transport).Clone()
+    transport.Proxy = http.ProxyFromEnvironment
+
+    bundlePath := os.Getenv("OUTBOUND_CA_BUNDLE")
+    if bundlePath == "" {
+        return transport
+    }
+    bundle, err := os.ReadFile(bundlePath)
+    if err != nil {
+        log.Fatalf("Failed to read OUTBOUND_CA_BUNDLE %s: %v", bundlePath, err)
+    }
+    roots, err := x509.SystemCertPool()
+    if err != nil {
+        roots = x509.NewCertPool()
+    }
+    if !roots.AppendCertsFromPEM(bundle) {
+        log.Fatalf("OUTBOUND_CA_BUNDLE %s contains no PEM certificates", bundlePath)
+    }
+    transport.TLSClientConfig = &tls.Config{RootCAs: roots, MinVersion: tls.VersionTLS12}
+    log.Printf("Trusting extra CA certificates from %s for outbound calls", bundlePath)
+    return transport
+}
+
+// NewClient creates an HTTP client on the shared outbound transport. A
+// zero timeout means none.
+func NewClient(timeout time.Duration) *http.Client {
+    return &http.Client{Transport: Transport, Timeout: timeout}
+}
@@ -0,0 +1,36 @@
+package outbound
+
+import (
+    "encoding/pem"
+    "net/http"
+    "net/http/httptest"
+    "os"
+    "path/filepath"
+    "testing"
+    "time"
+)
+
+// A host whose certificate is signed by an internal CA is only trusted
+// once the CA is in OUTBOUND_CA_BUNDLE
+func TestTransportTrustsCABundle(t *testing.T) {
+    server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+    defer server.Close()
+
+    if _, err := NewClient(time.Second).Get(server.URL); err == nil {
+        t.Fatal("call to a host with an unknown CA succeeded without a bundle")
+    }
+
+    bundle := filepath.Join(t.TempDir(), "ca.pem")
+    cert := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+    if err := os.WriteFile(bundle, cert, 0o600); err != nil {
+        t.Fatal(err)
+    }
+    t.Setenv("OUTBOUND_CA_BUNDLE", bundle)
+
+    client := &http.Client{Transport: newTransport(), Timeout: time.Second}
+    resp, err := client.Get(server.URL)
+    if err != nil {
+        t.Fatalf("call with the CA in the bundle failed: %v", err)
+    }
+    resp.Body.Close()
+}
@@ -0,0 +1,280 @@
+// Package readiness probes a service's dependencies and serves /readyz.
+//
+// A service names its dependencies once at startup, starts the probes with
+// its own HTTP client, and serves the results:
+//
+//	readiness.Setup(serviceName, readinessDependencies, nil)
+//	go readiness.Run(newHTTPClient)
+//	router.HandleFunc("/readyz", readiness.Handler).Methods("GET")
+package readiness
+
+import (
+    "encoding/json"
+    "fmt"
+    "log"
+    "net/http"
+    "os"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+)
+
+// Readiness probe settings. A dependency is only marked down after
+// READINESS_FAILURE_THRESHOLD consecutive failed probes, so one slow
+// health check doesn't pull the instance out of rotation.
+const (
+    DefaultProbeInterval    = 10 * time.Second
+    DefaultProbeTimeout     = 2 * time.Second
+    DefaultFailureThreshold = 3
+)
+
+var (
+    probeInterval    = DefaultProbeInterval
+    probeTimeout     = DefaultProbeTimeout
+    failureThreshold = DefaultFailureThreshold
+)
+
+// Dependency is a downstream service probed via its /health endpoint.
+// Required dependencies gate /readyz; optional ones are only reported.
+type Dependency struct {
+    Name     string
+    URL      func() string // read on every probe so config reloads apply
+    Required bool
+}
+
+// Status is the latest probe result for one dependency
+type Status struct {
+    Name                string `json:"name"`
+    URL                 string `json:"url"`
+    Required            bool   `json:"required"`
+    Up                  bool   `json:"up"`
+    ConsecutiveFailures int    `json:"consecutive_failures"`
+    LatencyMs           int64  `json:"latency_ms"`
+    LastError           string `json:"last_error,omitempty"`
+    CheckedAt           int64  `json:"checked_at"`
+}
+
+// Probe results, guarded by readinessMu. probed stays false until the
+// first round finishes, so a fresh instance is not ready before it has
+// seen its dependencies.
+var (
+    readinessMu        sync.RWMutex
+    dependencyStatuses = make(map[string]*Status)
+    probed             bool
+)
+
+// The service's name and dependencies, and whether it is draining, as
+// given to Setup
+var (
+    service      string
+    dependencies = func() []Dependency { return nil }
+    draining     = func() bool { return false }
+)
+
+func init() {
+    if value := os.Getenv("READINESS_PROBE_INTERVAL_SECONDS"); value != "" {
+        if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+            probeInterval = time.Duration(seconds) * time.Second
+        } else {
+            log.Printf("Ignoring invalid READINESS_PROBE_INTERVAL_SECONDS=%q", value)
+        }
+    }
+    if value := os.Getenv("READINESS_PROBE_TIMEOUT_SECONDS"); value != "" {
+        if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+            probeTimeout = time.Duration(seconds) * time.Second
+        } else {
+            log.Printf("Ignoring invalid READINESS_PROBE_TIMEOUT_SECONDS=%q", value)
+        }
+    }
+    if value := os.Getenv("READINESS_FAILURE_THRESHOLD"); value != "" {
+        if parsed, err := strconv.Atoi(value); err == nil && parsed > 0 {
+            failureThreshold = parsed
+        } else {
+            log.Printf("Ignoring invalid READINESS_FAILURE_THRESHOLD=%q", value)
+        }
+    }
+}
+
+// Setup names the service and its dependencies, which are listed again on
+// every probe so config reloads apply. isDraining, when not nil, reports
+// whether the instance is shutting down and must leave rotation.
+func Setup(name string, listDependencies func() []Dependency, isDraining func() bool) {
+    readinessMu.Lock()
+    defer readinessMu.Unlock()
+
+    service = name
+    dependencies = listDependencies
+    if isDraining != nil {
+        draining = isDraining
+    }
+}
+
+// Helper function to probe one dependency's /health endpoint
+func probeDependency(client *http.Client, dep Dependency) (time.Duration, error) {
+    start := time.Now()
+    resp, err := client.Get(strings.TrimRight(dep.URL(), "/") + "/health")
+    if err != nil {
+        return time.Since(start), err
+    }
+    resp.Body.Close()
+
+    if resp.StatusCode >= 300 {
+        return time.Since(start), fmt.Errorf("health check returned status %d", resp.StatusCode)
+    }
+    return time.Since(start), nil
+}
+
+// Helper function to probe every dependency once and record the results
+func probeDependencies(client *http.Client) {
+    type result struct {
+        dep     Dependency
+        latency time.Duration
+        err     error
+    }
+
+    readinessMu.RLock()
+    deps := dependencies()
+    readinessMu.RUnlock()
+
+    results := make(chan result, len(deps))
+    for _, dep := range deps {
+        go func(dep Dependency) {
+            latency, err := probeDependency(client, dep)
+            results <- result{dep: dep, latency: latency, err: err}
+        }(dep)
+    }
+
+    readinessMu.Lock()
+    defer readinessMu.Unlock()
+
+    for range deps {
+        res := <-results
+        status, exists := dependencyStatuses[res.dep.Name]
+        if !exists {
+            // Assume up until the threshold is reached, except on the very
+            // first round where there is no history to lean on
+            status = &Status{Name: res.dep.Name, Up: true}
+            dependencyStatuses[res.dep.Name] = status
+        }
+
+        status.URL = res.dep.URL()
+        status.Required = res.dep.Required
+        status.LatencyMs = res.latency.Milliseconds()
+        status.CheckedAt = time.Now().Unix()
+
+        if res.err == nil {
+            if !status.Up {
+                log.Printf("Dependency %s is back up", res.dep.Name)
+            }
+            status.Up = true
+            status.ConsecutiveFailures = 0
+            status.LastError = ""
+            continue
+        }
+
+        status.ConsecutiveFailures++
+        status.LastError = res.err.Error()
+        if status.Up && (!probed || status.ConsecutiveFailures >= failureThreshold) {
+            log.Printf("Dependency %s is down after %d failed probes: %v",
+                res.dep.Name, status.ConsecutiveFailures, res.err)
+            status.Up = false
+        }
+    }
+    probed = true
+}
+
+// Run probes the dependencies at startup and then every probe interval,
+// with a client newClient builds for the probe timeout
+func Run(newClient func(timeout time.Duration) *http.Client) {
+    client := newClient(probeTimeout)
+
+    probeDependencies(client)
+    ticker := time.NewTicker(probeInterval)
+    defer ticker.Stop()
+    for range ticker.C {
+        probeDependencies(client)
+    }
+}
+
+// Helper function to decide readiness; returns the reason when not ready
+func readiness() (bool, string, []Status) {
+    readinessMu.RLock()
+    defer readinessMu.RUnlock()
+
+    var statuses []Status
+    var down []string
+    for _, dep := range dependencies() {
+        status, exists := dependencyStatuses[dep.Name]
+        if !exists {
+            continue
+        }
+        statuses = append(statuses, *status)
+        if dep.Required && !status.Up {
+            down = append(down, dep.Name)
+        }
+    }
+
+    if draining() {
+        return false, "shutting down", statuses
+    }
+    if !probed {
+        return false, "dependencies not probed yet", statuses
+    }
+    if len(down) > 0 {
+        return false, "required dependencies down: " + strings.Join(down, ", "), statuses
+    }
+    return true, "", statuses
+}
+
+// Handler is the readiness endpoint: 200 when every required dependency
+// is up, 503 otherwise. /health stays a pure liveness check.
+func Handler(w http.ResponseWriter, r *http.Request) {
+    ready, reason, statuses := readiness()
+
+    readinessMu.RLock()
+    name := service
+    readinessMu.RUnlock()
+
+    result := map[string]interface{}{
+        "status":       "ready",
+        "service":      name,
+        "timestamp":    time.Now().Unix(),
+        "dependencies": statuses,
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    if !ready {
+        result["status"] = "not_ready"
+        result["reason"] = reason
+        w.WriteHeader(http.StatusServiceUnavailable)
+    }
+    json.NewEncoder(w).Encode(result)
+}
+
+// Metrics renders the readiness metrics in the Prometheus text format
+func Metrics() string {
+    ready, _, statuses := readiness()
+
+    readyValue := 0
+    if ready {
+        readyValue = 1
+    }
+    metrics := fmt.Sprintf(`
+# HELP service_ready Whether the instance is ready for traffic (all required dependencies up)
+# TYPE service_ready gauge
+service_ready %d
+
+# HELP dependency_up Whether a dependency's health check is passing
+# TYPE dependency_up gauge
+`, readyValue)
+
+    for _, status := range statuses {
+        up := 0
+        if status.Up {
+            up = 1
+        }
+        metrics += fmt.Sprintf("dependency_up{dependency=%q,required=\"%t\"} %d\n", status.Name, status.Required, up)
+    }
+    return metrics
+}
@@ -0,0 +1,69 @@
+package readiness
+
+import (
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "testing"
+)
+
+func TestReadiness(t *testing.T) {
+    healthy := true
+    server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if !healthy {
+            w.WriteHeader(http.StatusInternalServerError)
+        }
+    }))
+    defer server.Close()
+    down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        w.WriteHeader(http.StatusServiceUnavailable)
+    }))
+    defer down.Close()
+
+    draining := false
+    Setup("test-service", func() []Dependency {
+        return []Dependency{
+            {Name: "payment", URL: func() string { return server.URL }, Required: true},
+            {Name: "notification", URL: func() string { return down.URL }},
+        }
+    }, func() bool { return draining })
+
+    if ready, reason, _ := readiness(); ready || reason != "dependencies not probed yet" {
+        t.Fatalf("before probing: ready %v (%q), want not probed yet", ready, reason)
+    }
+
+    // Optional dependencies being down don't matter
+    probeDependencies(server.Client())
+    if ready, reason, statuses := readiness(); !ready || len(statuses) != 2 || statuses[1].Up {
+        t.Fatalf("after the first round: ready %v (%q), statuses %+v", ready, reason, statuses)
+    }
+
+    // A required dependency is only marked down after failureThreshold
+    // failed probes in a row
+    healthy = false
+    for i := 1; i < failureThreshold; i++ {
+        probeDependencies(server.Client())
+        if ready, reason, _ := readiness(); !ready {
+            t.Fatalf("down after %d failed probes (%q), want %d", i, reason, failureThreshold)
+        }
+    }
+    probeDependencies(server.Client())
+    if ready, reason, _ := readiness(); ready || !strings.Contains(reason, "payment") {
+        t.Fatalf("after %d failed probes: ready %v (%q), want payment down", failureThreshold, ready, reason)
+    }
+
+    healthy = true
+    probeDependencies(server.Client())
+    rec := httptest.NewRecorder()
+    Handler(rec, httptest.NewRequest("GET", "/readyz", nil))
+    if rec.Code != http.StatusOK {
+        t.Fatalf("/readyz once payment is back = %d, want 200", rec.Code)
+    }
+
+    draining = true
+    rec = httptest.NewRecorder()
+    Handler(rec, httptest.NewRequest("GET", "/readyz", nil))
+    if rec.Code != http.StatusServiceUnavailable || !strings.Contains(rec.Body.String(), "shutting down") {
+        t.Errorf("/readyz while draining = %d %s, want 503 shutting down", rec.Code, rec.Body.String())
+    }
+}
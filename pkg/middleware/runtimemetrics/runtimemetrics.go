@@ -0,0 +1,90 @@
+// Package runtimemetrics renders Go runtime and process metrics for the
+// services' hand-written /metrics endpoints.
+package runtimemetrics
+
+import (
+    "fmt"
+    "os"
+    "runtime"
+    "strings"
+    "syscall"
+)
+
+// Text renders Go runtime and process metrics in the Prometheus text
+// format, using the standard go_* / process_* metric names
+func Text() string {
+    var mem runtime.MemStats
+    runtime.ReadMemStats(&mem)
+
+    // Most recent GC pause; PauseNs is a circular buffer indexed by NumGC
+    lastPause := uint64(0)
+    if mem.NumGC > 0 {
+        lastPause = mem.PauseNs[(mem.NumGC+255)%256]
+    }
+
+    var b strings.Builder
+    fmt.Fprintf(&b, `
+# HELP go_goroutines Number of goroutines that currently exist
+# TYPE go_goroutines gauge
+go_goroutines %d
+
+# HELP go_threads Number of OS threads created
+# TYPE go_threads gauge
+go_threads %d
+
+# HELP go_memstats_heap_alloc_bytes Heap bytes allocated and still in use
+# TYPE go_memstats_heap_alloc_bytes gauge
+go_memstats_heap_alloc_bytes %d
+
+# HELP go_memstats_heap_inuse_bytes Heap bytes in in-use spans
+# TYPE go_memstats_heap_inuse_bytes gauge
+go_memstats_heap_inuse_bytes %d
+
+# HELP go_memstats_heap_objects Number of allocated heap objects
+# TYPE go_memstats_heap_objects gauge
+go_memstats_heap_objects %d
+
+# HELP go_memstats_sys_bytes Bytes of memory obtained from the OS
+# TYPE go_memstats_sys_bytes gauge
+go_memstats_sys_bytes %d
+
+# HELP go_gc_cycles_total Number of completed GC cycles
+# TYPE go_gc_cycles_total counter
+go_gc_cycles_total %d
+
+# HELP go_gc_pause_seconds_total Cumulative GC stop-the-world pause time
+# TYPE go_gc_pause_seconds_total counter
+go_gc_pause_seconds_total %f
+
+# HELP go_gc_last_pause_seconds Duration of the most recent GC pause
+# TYPE go_gc_last_pause_seconds gauge
+go_gc_last_pause_seconds %f
+`, runtime.NumGoroutine(), threadCount(), mem.HeapAlloc, mem.HeapInuse, mem.HeapObjects,
+        mem.Sys, mem.NumGC, float64(mem.PauseTotalNs)/1e9, float64(lastPause)/1e9)
+
+    // File descriptor metrics are only available where /proc exists (Linux)
+    if entries, err := os.ReadDir("/proc/self/fd"); err == nil {
+        fmt.Fprintf(&b, `
+# HELP process_open_fds Number of open file descriptors
+# TYPE process_open_fds gauge
+process_open_fds %d
+`, len(entries))
+    }
+
+    var limit syscall.Rlimit
+    if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &limit); err == nil {
+        fmt.Fprintf(&b, `
+# HELP process_max_fds Maximum number of open file descriptors
+# TYPE process_max_fds gauge
+process_max_fds %d
+`, limit.Cur)
+    }
+
+    return b.String()
+}
+
+// Helper function to count OS threads
+func threadCount() int {
+    count, _ := runtime.ThreadCreateProfile(nil)
+    return count
+}
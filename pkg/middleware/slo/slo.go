@@ -0,0 +1,290 @@
+// Package slo scores requests against a service's objectives and reports
+// compliance, error budgets and burn rates.
+//
+// A service sets its objectives once at startup, records every finished
+// request from its router-level middleware and serves the reports:
+//
+//	slo.Setup(serviceName, []slo.Objective{...}, nil)
+//	slo.Record(r.Method, route, status, elapsed)
+//	router.HandleFunc("/slo", slo.Handler).Methods("GET")
+package slo
+
+import (
+    "encoding/json"
+    "fmt"
+    "log"
+    "net/http"
+    "os"
+    "regexp"
+    "strconv"
+    "sync"
+    "time"
+)
+
+// Service level objectives. Every routed request is scored good or bad
+// against each objective it matches; /slo reports compliance over the SLO
+// window (SLO_WINDOW_DAYS, default 30) and how fast the error budget is
+// burning, so alerts can use the numbers directly.
+const DefaultWindowDays = 30
+
+// Burn rate alert thresholds for a 30-day budget, from the multiwindow
+// alerting recipe: page when the budget would be gone in ~2 days (1h and
+// 5m windows), open a ticket when it would be gone in ~5 days (6h and 1h).
+const (
+    PageBurnRate   = 14.4
+    TicketBurnRate = 6.0
+)
+
+// burnRateWindows are the short windows burn rates are reported over
+var burnRateWindows = []struct {
+    Name     string
+    Duration time.Duration
+}{
+    {"5m", 5 * time.Minute},
+    {"1h", time.Hour},
+    {"6h", 6 * time.Hour},
+}
+
+// Objective is one SLO. A request is good when it didn't fail with a 5xx
+// and, if Latency is set, was served within it.
+type Objective struct {
+    Name        string
+    Description string
+    Method      string        // "" matches any method
+    Route       string        // unversioned route template; "" matches any route
+    Target      float64       // fraction of requests that must be good, e.g. 0.995
+    Latency     time.Duration // 0 only checks for errors
+}
+
+// sloCounts tallies good and total requests for one time slot
+type sloCounts struct {
+    Slot  int64
+    Good  uint64
+    Total uint64
+}
+
+// sloTracker keeps per-minute counts for the burn rate windows and
+// per-hour counts for the whole SLO window, both as rings
+type sloTracker struct {
+    Minutes []sloCounts
+    Hours   []sloCounts
+}
+
+// Report is an objective's current standing, as served on /slo
+type Report struct {
+    Name                 string             `json:"name"`
+    Description          string             `json:"description"`
+    Method               string             `json:"method,omitempty"`
+    Route                string             `json:"route,omitempty"`
+    Target               float64            `json:"target"`
+    LatencyThresholdMs   int64              `json:"latency_threshold_ms,omitempty"`
+    Good                 uint64             `json:"good"`
+    Total                uint64             `json:"total"`
+    Compliance           float64            `json:"compliance"`
+    Met                  bool               `json:"met"`
+    ErrorBudgetRemaining float64            `json:"error_budget_remaining"`
+    BurnRates            map[string]float64 `json:"burn_rates"`
+    Alert                string             `json:"alert,omitempty"`
+}
+
+var (
+    sloMu        sync.Mutex
+    sloWindow    = DefaultWindowDays * 24 * time.Hour
+    service      string
+    objectives   []Objective
+    routeAliases map[string]string
+    sloTrackers  []*sloTracker
+)
+
+// Versioned API routes count toward the same objectives as the legacy ones
+var versionedRoute = regexp.MustCompile(`^/api/v[0-9]+/`)
+
+func init() {
+    if value := os.Getenv("SLO_WINDOW_DAYS"); value != "" {
+        if days, err := strconv.Atoi(value); err == nil && days > 0 {
+            sloWindow = time.Duration(days) * 24 * time.Hour
+        } else {
+            log.Printf("Ignoring invalid SLO_WINDOW_DAYS=%q", value)
+        }
+    }
+}
+
+// Setup sets the objectives of the named service, before it serves
+// requests. aliases maps route templates to the ones whose objectives they
+// count toward (e.g. legacy routes to their replacements); it may be nil.
+func Setup(name string, list []Objective, aliases map[string]string) {
+    sloMu.Lock()
+    defer sloMu.Unlock()
+
+    service = name
+    objectives = list
+    routeAliases = aliases
+
+    longest := burnRateWindows[len(burnRateWindows)-1].Duration
+    sloTrackers = make([]*sloTracker, len(objectives))
+    for i := range sloTrackers {
+        sloTrackers[i] = &sloTracker{
+            Minutes: make([]sloCounts, int(longest/time.Minute)),
+            Hours:   make([]sloCounts, int(sloWindow/time.Hour)),
+        }
+    }
+}
+
+// Helper function to add a request to a ring of counts
+func addToRing(ring []sloCounts, slot int64, good bool) {
+    counts := &ring[slot%int64(len(ring))]
+    if counts.Slot != slot {
+        *counts = sloCounts{Slot: slot}
+    }
+    counts.Total++
+    if good {
+        counts.Good++
+    }
+}
+
+// Helper function to sum the slots of a ring newer than since
+func sumRing(ring []sloCounts, since int64) (good uint64, total uint64) {
+    for _, counts := range ring {
+        if counts.Slot > since {
+            good += counts.Good
+            total += counts.Total
+        }
+    }
+    return good, total
+}
+
+// Record scores a finished request against every objective it falls
+// under. Requests that never reached a route are recorded with route "".
+func Record(method string, route string, status int, elapsed time.Duration) {
+    route = versionedRoute.ReplaceAllString(route, "/api/")
+    now := time.Now()
+
+    sloMu.Lock()
+    defer sloMu.Unlock()
+
+    if alias, exists := routeAliases[route]; exists {
+        route = alias
+    }
+
+    for i, objective := range objectives {
+        if (objective.Method != "" && objective.Method != method) || (objective.Route != "" && objective.Route != route) {
+            continue
+        }
+        good := status < 500 && (objective.Latency == 0 || elapsed <= objective.Latency)
+        addToRing(sloTrackers[i].Minutes, now.Unix()/60, good)
+        addToRing(sloTrackers[i].Hours, now.Unix()/3600, good)
+    }
+}
+
+// Helper function to turn good/total counts into a burn rate: how many
+// times faster than sustainable the error budget is being spent
+func burnRate(good uint64, total uint64, target float64) float64 {
+    if total == 0 || target >= 1 {
+        return 0
+    }
+    return (float64(total-good) / float64(total)) / (1 - target)
+}
+
+// Reports returns every objective's current standing
+func Reports() []Report {
+    now := time.Now()
+
+    sloMu.Lock()
+    defer sloMu.Unlock()
+
+    reports := make([]Report, 0, len(objectives))
+    for i, objective := range objectives {
+        tracker := sloTrackers[i]
+        good, total := sumRing(tracker.Hours, now.Unix()/3600-int64(len(tracker.Hours)))
+
+        report := Report{
+            Name:                 objective.Name,
+            Description:          objective.Description,
+            Method:               objective.Method,
+            Route:                objective.Route,
+            Target:               objective.Target,
+            LatencyThresholdMs:   objective.Latency.Milliseconds(),
+            Good:                 good,
+            Total:                total,
+            Compliance:           1,
+            ErrorBudgetRemaining: 1,
+            BurnRates:            make(map[string]float64),
+        }
+        if total > 0 {
+            report.Compliance = float64(good) / float64(total)
+            report.ErrorBudgetRemaining = 1 - burnRate(good, total, objective.Target)
+        }
+        report.Met = report.Compliance >= objective.Target
+
+        for _, window := range burnRateWindows {
+            windowGood, windowTotal := sumRing(tracker.Minutes, now.Add(-window.Duration).Unix()/60)
+            report.BurnRates[window.Name] = burnRate(windowGood, windowTotal, objective.Target)
+        }
+        switch {
+        case report.BurnRates["1h"] > PageBurnRate && report.BurnRates["5m"] > PageBurnRate:
+            report.Alert = "page"
+        case report.BurnRates["6h"] > TicketBurnRate && report.BurnRates["1h"] > TicketBurnRate:
+            report.Alert = "ticket"
+        }
+
+        reports = append(reports, report)
+    }
+    return reports
+}
+
+// Handler is the SLO endpoint: compliance, error budget and burn rates per
+// objective
+func Handler(w http.ResponseWriter, r *http.Request) {
+    sloMu.Lock()
+    name := service
+    sloMu.Unlock()
+
+    result := map[string]interface{}{
+        "service":     name,
+        "window_days": int(sloWindow / (24 * time.Hour)),
+        "timestamp":   time.Now().Unix(),
+        "objectives":  Reports(),
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(result)
+}
+
+// Metrics renders the SLO metrics in the Prometheus text format
+func Metrics() string {
+    metrics := `
+# HELP slo_target Fraction of requests that must be good
+# TYPE slo_target gauge
+`
+    reports := Reports()
+    for _, report := range reports {
+        metrics += fmt.Sprintf("slo_target{objective=%q} %g\n", report.Name, report.Target)
+    }
+
+    metrics += `
+# HELP slo_compliance_ratio Fraction of good requests over the SLO window
+# TYPE slo_compliance_ratio gauge
+`
+    for _, report := range reports {
+        metrics += fmt.Sprintf("slo_compliance_ratio{objective=%q} %g\n", report.Name, report.Compliance)
+    }
+
+    metrics += `
+# HELP slo_error_budget_remaining_ratio Share of the error budget left in the SLO window
+# TYPE slo_error_budget_remaining_ratio gauge
+`
+    for _, report := range reports {
+        metrics += fmt.Sprintf("slo_error_budget_remaining_ratio{objective=%q} %g\n", report.Name, report.ErrorBudgetRemaining)
+    }
+
+    metrics += `
+# HELP slo_burn_rate Error budget burn rate over a short window (1 = exactly on budget)
+# TYPE slo_burn_rate gauge
+`
+    for _, report := range reports {
+        for _, window := range burnRateWindows {
+            metrics += fmt.Sprintf("slo_burn_rate{objective=%q,window=%q} %g\n", report.Name, window.Name, report.BurnRates[window.Name])
+        }
+    }
+    return metrics
+}
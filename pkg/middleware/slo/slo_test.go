@@ -0,0 +1,35 @@
+package slo
+
+import (
+    "testing"
+    "time"
+)
+
+func TestRecordAndReports(t *testing.T) {
+    Setup("test-service", []Objective{
+        {Name: "checkout_latency", Method: "POST", Route: "/api/orders/users/{userId}", Target: 0.5, Latency: 100 * time.Millisecond},
+        {Name: "availability", Target: 0.999},
+    }, map[string]string{"/api/orders/{userId}": "/api/orders/users/{userId}"})
+
+    Record("POST", "/api/v1/orders/users/{userId}", 201, 10*time.Millisecond) // versioned route
+    Record("POST", "/api/orders/{userId}", 201, 500*time.Millisecond)         // legacy alias, too slow
+    Record("GET", "/api/orders/users/{userId}", 500, 0)                       // other method
+    Record("GET", "", 503, 0)                                                 // shed before routing
+
+    reports := Reports()
+    want := []struct {
+        good, total uint64
+        met         bool
+    }{
+        {1, 2, true},
+        {2, 4, false},
+    }
+    for i, report := range reports {
+        if report.Good != want[i].good || report.Total != want[i].total || report.Met != want[i].met {
+            t.Errorf("%s: %d/%d good, met %v, want %d/%d, met %v", report.Name, report.Good, report.Total, report.Met, want[i].good, want[i].total, want[i].met)
+        }
+    }
+    if rate := reports[1].BurnRates["5m"]; rate < 499 || rate > 501 {
+        t.Errorf("availability burn rate over 5m = %g, want 500", rate)
+    }
+}
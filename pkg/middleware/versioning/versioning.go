@@ -0,0 +1,210 @@
+// Package versioning mounts a service's API under every published
+// version, /api/<version><resource>, and under the legacy unversioned
+// /api<resource>, and marks deprecated versions on their responses.
+//
+//	versioning.Mount(api, "/orders", map[string]func(*mux.Router){
+//	    "v1": orderRoutesV1,
+//	})
+package versioning
+
+import (
+    "fmt"
+    "log"
+    "net/http"
+    "os"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/gorilla/mux"
+)
+
+// DefaultVersion is served on the legacy unversioned /api/... paths,
+// which predate versioning and stay as aliases so existing clients keep
+// working
+const DefaultVersion = "v1"
+
+// apiVersion is one published version of the API
+type apiVersion struct {
+    Name       string
+    Deprecated bool
+    Sunset     time.Time // zero when no retirement date is scheduled
+}
+
+// Published API versions, oldest first, shared by every service. To ship a
+// breaking change, append a version here and register only the routes it
+// changes; everything else, in every service, falls through to the
+// previous version's handlers.
+var apiVersions = []*apiVersion{
+    {Name: "v1"},
+}
+
+// Requests served per version, split by legacy (unversioned) paths, so
+// operators can see when it's safe to retire one
+var (
+    apiVersionMu       sync.Mutex
+    apiVersionRequests = make(map[string]int64)
+)
+
+// API_DEPRECATIONS marks versions deprecated, optionally with a sunset
+// date after which they answer 410 Gone: "v1=2027-06-30,v2"
+func init() {
+    spec := os.Getenv("API_DEPRECATIONS")
+    if spec == "" {
+        return
+    }
+
+    for _, entry := range strings.Split(spec, ",") {
+        name, date, _ := strings.Cut(strings.TrimSpace(entry), "=")
+        version := findAPIVersion(name)
+        if version == nil {
+            log.Printf("Ignoring API_DEPRECATIONS entry for unknown version %q", name)
+            continue
+        }
+        if date != "" {
+            sunset, err := time.Parse("2006-01-02", date)
+            if err != nil {
+                log.Printf("Ignoring invalid sunset date %q for API %s", date, name)
+                continue
+            }
+            version.Sunset = sunset
+        }
+        version.Deprecated = true
+    }
+}
+
+// Helper function to look up a published version by name
+func findAPIVersion(name string) *apiVersion {
+    for _, version := range apiVersions {
+        if version.Name == name {
+            return version
+        }
+    }
+    return nil
+}
+
+// Names lists the published versions, oldest first
+func Names() []string {
+    names := make([]string, len(apiVersions))
+    for i, version := range apiVersions {
+        names[i] = version.Name
+    }
+    return names
+}
+
+// Helper function to find the version that supersedes a deprecated one
+func successorVersion(name string) string {
+    for i, version := range apiVersions {
+        if version.Name == name && i+1 < len(apiVersions) {
+            return apiVersions[i+1].Name
+        }
+    }
+    return ""
+}
+
+// Middleware that tags responses with the API version served and, for
+// deprecated versions, the Deprecation/Sunset/Link headers (RFC 8594).
+// Versions past their sunset date are refused.
+func apiVersionMiddleware(version *apiVersion, resource string, legacy bool) mux.MiddlewareFunc {
+    return func(next http.Handler) http.Handler {
+        return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+            apiVersionMu.Lock()
+            apiVersionRequests[fmt.Sprintf("%s|%t", version.Name, legacy)]++
+            apiVersionMu.Unlock()
+
+            w.Header().Set("API-Version", version.Name)
+            if version.Deprecated {
+                w.Header().Set("Deprecation", "true")
+                if !version.Sunset.IsZero() {
+                    w.Header().Set("Sunset", version.Sunset.UTC().Format(http.TimeFormat))
+                }
+                if successor := successorVersion(version.Name); successor != "" {
+                    w.Header().Set("Link", fmt.Sprintf("</api/%s%s>; rel=\"successor-version\"", successor, resource))
+                }
+
+                if !version.Sunset.IsZero() && time.Now().After(version.Sunset) {
+                    http.Error(w, fmt.Sprintf("API %s was retired on %s", version.Name,
+                        version.Sunset.Format("2006-01-02")), http.StatusGone)
+                    return
+                }
+            }
+
+            next.ServeHTTP(w, r)
+        })
+    }
+}
+
+// Helper function to register the routes of apiVersions[index] and every
+// version before it. Newer versions are registered first so their
+// overrides win; keep override paths as specific as the routes they
+// replace, since gorilla/mux matches in registration order.
+func registerVersionRoutes(router *mux.Router, index int, routes map[string]func(*mux.Router)) {
+    for i := index; i >= 0; i-- {
+        if register, exists := routes[apiVersions[i].Name]; exists {
+            register(router)
+        }
+    }
+}
+
+// Mount mounts a resource for every API version, under
+// /api/<version><resource>, and under the legacy /api<resource> as the
+// default version. routes maps a version name to the function that
+// registers that version's handlers; middleware, if any, wraps them all.
+func Mount(api *mux.Router, resource string, routes map[string]func(*mux.Router), middleware ...mux.MiddlewareFunc) {
+    for name := range routes {
+        if findAPIVersion(name) == nil {
+            log.Fatalf("Routes registered for unpublished API version %s", name)
+        }
+    }
+
+    defaultIndex := 0
+    for i, version := range apiVersions {
+        versioned := api.PathPrefix("/" + version.Name + resource).Subrouter()
+        versioned.Use(apiVersionMiddleware(version, resource, false))
+        versioned.Use(middleware...)
+        registerVersionRoutes(versioned, i, routes)
+
+        if version.Name == DefaultVersion {
+            defaultIndex = i
+        }
+    }
+
+    legacy := api.PathPrefix(resource).Subrouter()
+    legacy.Use(apiVersionMiddleware(apiVersions[defaultIndex], resource, true))
+    legacy.Use(middleware...)
+    registerVersionRoutes(legacy, defaultIndex, routes)
+}
+
+// Metrics renders the API version usage metrics in the Prometheus text
+// format
+func Metrics() string {
+    apiVersionMu.Lock()
+    defer apiVersionMu.Unlock()
+
+    metrics := `
+# HELP api_version_requests_total Requests served per API version (legacy = unversioned /api paths)
+# TYPE api_version_requests_total counter
+`
+    for _, version := range apiVersions {
+        for _, legacy := range []bool{false, true} {
+            if legacy && version.Name != DefaultVersion {
+                continue
+            }
+            count := apiVersionRequests[fmt.Sprintf("%s|%t", version.Name, legacy)]
+            metrics += fmt.Sprintf("api_version_requests_total{version=%q,legacy=\"%t\"} %d\n", version.Name, legacy, count)
+        }
+    }
+
+    metrics += `
+# HELP api_version_deprecated Whether an API version is deprecated
+# TYPE api_version_deprecated gauge
+`
+    for _, version := range apiVersions {
+        deprecated := 0
+        if version.Deprecated {
+            deprecated = 1
+        }
+        metrics += fmt.Sprintf("api_version_deprecated{version=%q} %d\n", version.Name, deprecated)
+    }
+    return metrics
+}
@@ -0,0 +1,66 @@
+package versioning
+
+import (
+    "net/http"
+    "net/http/httptest"
+    "testing"
+    "time"
+
+    "github.com/gorilla/mux"
+)
+
+func TestMount(t *testing.T) {
+    defer func(published []*apiVersion) { apiVersions = published }(apiVersions)
+    apiVersions = []*apiVersion{
+        {Name: "v1", Deprecated: true, Sunset: time.Now().AddDate(0, 1, 0)},
+        {Name: "v2"},
+        {Name: "v3", Deprecated: true, Sunset: time.Now().AddDate(0, 0, -1)},
+    }
+
+    // v2 only changes the item route; the list falls through to v1
+    handler := func(body string) http.HandlerFunc {
+        return func(w http.ResponseWriter, r *http.Request) { w.Write([]byte(body)) }
+    }
+    router := mux.NewRouter()
+    api := router.PathPrefix("/api").Subrouter()
+    Mount(api, "/things", map[string]func(*mux.Router){
+        "v1": func(r *mux.Router) {
+            r.HandleFunc("", handler("v1 list"))
+            r.HandleFunc("/{id}", handler("v1 item"))
+        },
+        "v2": func(r *mux.Router) {
+            r.HandleFunc("/{id}", handler("v2 item"))
+        },
+    })
+
+    tests := []struct {
+        path    string
+        status  int
+        body    string
+        version string
+        link    string
+    }{
+        {"/api/things/1", 200, "v1 item", "v1", "</api/v2/things>; rel=\"successor-version\""},
+        {"/api/v1/things", 200, "v1 list", "v1", "</api/v2/things>; rel=\"successor-version\""},
+        {"/api/v2/things", 200, "v1 list", "v2", ""},
+        {"/api/v2/things/1", 200, "v2 item", "v2", ""},
+        {"/api/v3/things/1", http.StatusGone, "", "v3", ""},
+    }
+    for _, tt := range tests {
+        rec := httptest.NewRecorder()
+        router.ServeHTTP(rec, httptest.NewRequest("GET", tt.path, nil))
+        if rec.Code != tt.status || (tt.body != "" && rec.Body.String() != tt.body) {
+            t.Errorf("%s = %d %q, want %d %q", tt.path, rec.Code, rec.Body.String(), tt.status, tt.body)
+        }
+        if got := rec.Header().Get("API-Version"); got != tt.version {
+            t.Errorf("%s served as %q, want %q", tt.path, got, tt.version)
+        }
+        if got := rec.Header().Get("Link"); got != tt.link {
+            t.Errorf("%s Link = %q, want %q", tt.path, got, tt.link)
+        }
+        deprecated := tt.version != "v2"
+        if got := rec.Header().Get("Deprecation") == "true"; got != deprecated {
+            t.Errorf("%s Deprecation header present = %v, want %v", tt.path, got, deprecated)
+        }
+    }
+}
@@ -0,0 +1,260 @@
+// Package money holds amounts of money for the e-commerce services: Money,
+// an integer amount in a currency's minor unit with checked arithmetic and
+// allocation, and the ISO 4217 currencies with their minor units.
+//
+// Amounts are integers in the currency's minor unit: cents for USD, yen
+// for JPY (no minor unit), fils for KWD (thousandths). The services' *_cents
+// fields predate multi-currency support and hold minor units despite the
+// name.
+//
+//	price := money.New(1999, "USD")
+//	line, err := price.Multiply(3)         // 59.97 USD
+//	shares, err := line.Allocate([]int{1, 1, 1})
+//
+// order-service, cart-service, product-service and ecomctl import it
+// through a replace directive in their go.mod.
+package money
+
+import (
+    "errors"
+    "fmt"
+    "math"
+    "math/bits"
+    "strconv"
+    "strings"
+)
+
+// DefaultCurrency is the currency of amounts that don't name one
+const DefaultCurrency = "USD"
+
+// ISO 4217 currencies by number of minor-unit digits. Codes not listed
+// (including precious metals and testing codes) are rejected. Built as a
+// package variable rather than in init so settings loaded at startup can
+// check currencies.
+var currencyMinorUnits = buildCurrencyMinorUnits()
+
+func buildCurrencyMinorUnits() map[string]int {
+    units := make(map[string]int)
+    byDigits := map[int]string{
+        0: "BIF CLP DJF GNF ISK JPY KMF KRW PYG RWF UGX UYI VND VUV XAF XOF XPF",
+        2: "AED AFN ALL AMD ANG AOA ARS AUD AWG AZN BAM BBD BDT BGN BMD BND BOB BOV BRL BSD BTN " +
+            "BWP BYN BZD CAD CDF CHE CHF CHW CNY COP COU CRC CUP CVE CZK DKK DOP DZD EGP ERN ETB " +
+            "EUR FJD FKP GBP GEL GHS GIP GMD GTQ GYD HKD HNL HTG HUF IDR ILS INR IRR JMD KES KGS " +
+            "KHR KPW KYD KZT LAK LBP LKR LRD LSL MAD MDL MGA MKD MMK MNT MOP MRU MUR MVR MWK MXN " +
+            "MXV MYR MZN NAD NGN NIO NOK NPR NZD PAB PEN PGK PHP PKR PLN QAR RON RSD RUB SAR SBD " +
+            "SCR SDG SEK SGD SHP SLE SOS SRD SSP STN SVC SYP SZL THB TJS TMT TOP TRY TTD TWD TZS " +
+            "UAH USD USN UYU UZS VED VES WST XCD XCG YER ZAR ZMW ZWG",
+        3: "BHD IQD JOD KWD LYD OMR TND",
+        4: "CLF UYW",
+    }
+    for digits, codes := range byDigits {
+        for _, code := range strings.Fields(codes) {
+            units[code] = digits
+        }
+    }
+    return units
+}
+
+// NormalizeCurrency validates a currency code, returning it upper-cased.
+// An empty code means DefaultCurrency.
+func NormalizeCurrency(code string) (string, error) {
+    code = strings.ToUpper(strings.TrimSpace(code))
+    if code == "" {
+        return DefaultCurrency, nil
+    }
+    if _, exists := currencyMinorUnits[code]; !exists {
+        return "", fmt.Errorf("unsupported currency %q", code)
+    }
+    return code, nil
+}
+
+// MinorUnits returns the number of minor-unit digits of a valid currency
+func MinorUnits(currency string) int {
+    if digits, exists := currencyMinorUnits[currency]; exists {
+        return digits
+    }
+    return 2
+}
+
+// FormatAmount formats a minor-unit amount as a decimal string in major
+// units: 123456 USD is "1234.56", 1500 JPY is "1500"
+func FormatAmount(amount int, currency string) string {
+    digits := MinorUnits(currency)
+    sign := ""
+    if amount < 0 {
+        sign = "-"
+        amount = -amount
+    }
+    text := strconv.Itoa(amount)
+    if digits == 0 {
+        return sign + text
+    }
+    if len(text) <= digits {
+        text = strings.Repeat("0", digits-len(text)+1) + text
+    }
+    return sign + text[:len(text)-digits] + "." + text[len(text)-digits:]
+}
+
+// ParseAmount parses a decimal string in major units into minor units,
+// rejecting more decimals than the currency has ("10.5" USD is 1050;
+// "10.5" JPY is an error)
+func ParseAmount(value string, currency string) (int, error) {
+    digits := MinorUnits(currency)
+    text := strings.TrimSpace(value)
+
+    negative := strings.HasPrefix(text, "-")
+    if negative {
+        text = text[1:]
+    } else {
+        text = strings.TrimPrefix(text, "+")
+    }
+
+    whole, fraction, hasPoint := strings.Cut(text, ".")
+    if whole == "" || (hasPoint && fraction == "") {
+        return 0, fmt.Errorf("invalid amount %q", value)
+    }
+    if len(fraction) > digits {
+        return 0, fmt.Errorf("%s amounts have at most %d decimal places", currency, digits)
+    }
+    for _, part := range []string{whole, fraction} {
+        if strings.Trim(part, "0123456789") != "" {
+            return 0, fmt.Errorf("invalid amount %q", value)
+        }
+    }
+
+    amount, err := strconv.Atoi(whole + fraction + strings.Repeat("0", digits-len(fraction)))
+    if err != nil {
+        return 0, fmt.Errorf("invalid amount %q", value)
+    }
+    if negative {
+        amount = -amount
+    }
+    return amount, nil
+}
+
+// Money is an amount in minor units with its currency. The services' wire
+// formats keep their *_cents and currency fields; types expose them as
+// Money so arithmetic is currency-checked and overflow-safe.
+type Money struct {
+    Amount   int    `json:"amount"`
+    Currency string `json:"currency"`
+}
+
+// Money arithmetic errors
+var (
+    ErrCurrencyMismatch = errors.New("currency mismatch")
+    ErrAmountOverflow   = errors.New("amount overflows")
+)
+
+// New builds a Money value; an empty currency means DefaultCurrency
+func New(amount int, currency string) Money {
+    if currency == "" {
+        currency = DefaultCurrency
+    }
+    return Money{Amount: amount, Currency: currency}
+}
+
+// String formats the amount in major units with its code, e.g. "19.99 USD"
+func (m Money) String() string {
+    return FormatAmount(m.Amount, m.Currency) + " " + m.Currency
+}
+
+// Add returns m + other; both must be in the same currency
+func (m Money) Add(other Money) (Money, error) {
+    if m.Currency != other.Currency {
+        return Money{}, fmt.Errorf("%w: %s + %s", ErrCurrencyMismatch, m.Currency, other.Currency)
+    }
+    if (other.Amount > 0 && m.Amount > math.MaxInt-other.Amount) ||
+        (other.Amount < 0 && m.Amount < math.MinInt-other.Amount) {
+        return Money{}, ErrAmountOverflow
+    }
+    return Money{Amount: m.Amount + other.Amount, Currency: m.Currency}, nil
+}
+
+// Sub returns m - other; both must be in the same currency
+func (m Money) Sub(other Money) (Money, error) {
+    if other.Amount == math.MinInt {
+        return Money{}, ErrAmountOverflow
+    }
+    return m.Add(Money{Amount: -other.Amount, Currency: other.Currency})
+}
+
+// Multiply returns m * quantity, e.g. a line total from a unit price
+func (m Money) Multiply(quantity int) (Money, error) {
+    if m.Amount != 0 && quantity != 0 {
+        product := m.Amount * quantity
+        if product/quantity != m.Amount || (m.Amount == math.MinInt && quantity == -1) ||
+            (m.Amount == -1 && quantity == math.MinInt) {
+            return Money{}, ErrAmountOverflow
+        }
+        return Money{Amount: product, Currency: m.Currency}, nil
+    }
+    return Money{Amount: 0, Currency: m.Currency}, nil
+}
+
+// Allocate splits m in proportion to weights (e.g. a discount across order
+// lines by line total) without losing or inventing minor units: each share
+// is rounded down, and the leftover units go one at a time to the shares
+// with the largest remainders (earlier shares win ties).
+func (m Money) Allocate(weights []int) ([]Money, error) {
+    total := 0
+    for _, weight := range weights {
+        if weight < 0 {
+            return nil, errors.New("allocation weights must not be negative")
+        }
+        if weight > math.MaxInt-total {
+            return nil, ErrAmountOverflow
+        }
+        total += weight
+    }
+    if total == 0 {
+        return nil, errors.New("allocation weights must not all be zero")
+    }
+
+    amount := m.Amount
+    negative := amount < 0
+    if negative {
+        if amount == math.MinInt {
+            return nil, ErrAmountOverflow
+        }
+        amount = -amount
+    }
+
+    shares := make([]Money, len(weights))
+    remainders := make([]int, len(weights))
+    allocated := 0
+    for i, weight := range weights {
+        // amount*weight can overflow int; weight <= total keeps the share in range
+        quotient, remainder := MulDiv(amount, weight, total)
+        shares[i] = Money{Amount: quotient, Currency: m.Currency}
+        remainders[i] = remainder
+        allocated += quotient
+    }
+
+    for leftover := amount - allocated; leftover > 0; leftover-- {
+        best := -1
+        for i := range shares {
+            if weights[i] > 0 && (best < 0 || remainders[i] > remainders[best]) {
+                best = i
+            }
+        }
+        shares[best].Amount++
+        remainders[best] = -1 // at most one extra unit per share
+    }
+
+    if negative {
+        for i := range shares {
+            shares[i].Amount = -shares[i].Amount
+        }
+    }
+    return shares, nil
+}
+
+// MulDiv computes a*b/c and its remainder for non-negative values with
+// b <= c, using a 128-bit intermediate product, e.g. a rate in parts per
+// million of an amount
+func MulDiv(a int, b int, c int) (int, int) {
+    hi, lo := bits.Mul64(uint64(a), uint64(b))
+    quotient, remainder := bits.Div64(hi, lo, uint64(c))
+    return int(quotient), int(remainder)
+}
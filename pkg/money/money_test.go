@@ -0,0 +1,162 @@
+package money
+
+import (
+    "errors"
+    "math"
+    "reflect"
+    "testing"
+)
+
+// Helper function to pull the amounts out of allocated shares
+func amounts(shares []Money) []int {
+    result := make([]int, len(shares))
+    for i, share := range shares {
+        result[i] = share.Amount
+    }
+    return result
+}
+
+func TestAllocate(t *testing.T) {
+    tests := []struct {
+        name    string
+        amount  int
+        weights []int
+        want    []int
+    }{
+        {"even split", 900, []int{1, 1, 1}, []int{300, 300, 300}},
+        {"leftover to earlier shares on ties", 100, []int{1, 1, 1}, []int{34, 33, 33}},
+        {"leftover to the largest remainder", 10, []int{3, 3, 4}, []int{3, 3, 4}},
+        {"largest remainder wins over order", 100, []int{1, 2}, []int{33, 67}},
+        {"one unit over many shares", 1, []int{1, 1, 1, 1}, []int{1, 0, 0, 0}},
+        {"zero weights get nothing", 101, []int{0, 1, 0, 1}, []int{0, 51, 0, 50}},
+        {"proportional by line total", 500, []int{1999, 550, 3000}, []int{180, 50, 270}},
+        {"negative amounts mirror positive ones", -100, []int{1, 1, 1}, []int{-34, -33, -33}},
+        {"zero amount", 0, []int{2, 5}, []int{0, 0}},
+        {"weights whose product overflows", math.MaxInt, []int{math.MaxInt / 2, math.MaxInt / 2}, []int{math.MaxInt/2 + 1, math.MaxInt / 2}},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            shares, err := New(tt.amount, "USD").Allocate(tt.weights)
+            if err != nil {
+                t.Fatalf("Allocate(%v) failed: %v", tt.weights, err)
+            }
+            if got := amounts(shares); !reflect.DeepEqual(got, tt.want) {
+                t.Errorf("Allocate(%v) of %d = %v, want %v", tt.weights, tt.amount, got, tt.want)
+            }
+
+            sum := 0
+            for _, share := range shares {
+                sum += share.Amount
+                if share.Currency != "USD" {
+                    t.Errorf("share in %q, want USD", share.Currency)
+                }
+            }
+            if sum != tt.amount {
+                t.Errorf("shares sum to %d, want %d", sum, tt.amount)
+            }
+        })
+    }
+}
+
+func TestAllocateRejects(t *testing.T) {
+    tests := []struct {
+        name    string
+        amount  int
+        weights []int
+    }{
+        {"no weights", 100, nil},
+        {"all zero", 100, []int{0, 0}},
+        {"negative weight", 100, []int{2, -1}},
+        {"weights overflow", 100, []int{math.MaxInt, 1}},
+        {"minimum int", math.MinInt, []int{1}},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            if shares, err := New(tt.amount, "USD").Allocate(tt.weights); err == nil {
+                t.Errorf("Allocate(%v) = %v, want an error", tt.weights, amounts(shares))
+            }
+        })
+    }
+}
+
+func TestMultiply(t *testing.T) {
+    tests := []struct {
+        name     string
+        amount   int
+        quantity int
+        want     int
+        err      error
+    }{
+        {"line total", 1999, 3, 5997, nil},
+        {"zero quantity", 1999, 0, 0, nil},
+        {"zero amount", 0, math.MaxInt, 0, nil},
+        {"negative quantity", 250, -2, -500, nil},
+        {"largest product", math.MaxInt, 1, math.MaxInt, nil},
+        {"overflow", math.MaxInt/2 + 1, 2, 0, ErrAmountOverflow},
+        {"negative overflow", math.MinInt, -1, 0, ErrAmountOverflow},
+        {"overflow the other way", -1, math.MinInt, 0, ErrAmountOverflow},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            got, err := New(tt.amount, "JPY").Multiply(tt.quantity)
+            if !errors.Is(err, tt.err) {
+                t.Fatalf("Multiply(%d) error = %v, want %v", tt.quantity, err, tt.err)
+            }
+            if err == nil && (got.Amount != tt.want || got.Currency != "JPY") {
+                t.Errorf("%d * %d = %v, want %d JPY", tt.amount, tt.quantity, got, tt.want)
+            }
+        })
+    }
+}
+
+func TestAddChecksCurrencyAndOverflow(t *testing.T) {
+    if _, err := New(100, "USD").Add(New(100, "EUR")); !errors.Is(err, ErrCurrencyMismatch) {
+        t.Errorf("USD + EUR error = %v, want %v", err, ErrCurrencyMismatch)
+    }
+    if _, err := New(math.MaxInt, "USD").Add(New(1, "USD")); !errors.Is(err, ErrAmountOverflow) {
+        t.Errorf("MaxInt + 1 error = %v, want %v", err, ErrAmountOverflow)
+    }
+    if _, err := New(0, "USD").Sub(New(math.MinInt, "USD")); !errors.Is(err, ErrAmountOverflow) {
+        t.Errorf("0 - MinInt error = %v, want %v", err, ErrAmountOverflow)
+    }
+}
+
+func TestFormatAndParseAmount(t *testing.T) {
+    tests := []struct {
+        text     string
+        currency string
+        amount   int
+    }{
+        {"1234.56", "USD", 123456},
+        {"0.05", "USD", 5},
+        {"-0.50", "EUR", -50},
+        {"1500", "JPY", 1500},
+        {"1.234", "KWD", 1234},
+    }
+    for _, tt := range tests {
+        if got := FormatAmount(tt.amount, tt.currency); got != tt.text {
+            t.Errorf("FormatAmount(%d, %s) = %q, want %q", tt.amount, tt.currency, got, tt.text)
+        }
+        if got, err := ParseAmount(tt.text, tt.currency); err != nil || got != tt.amount {
+            t.Errorf("ParseAmount(%q, %s) = %d, %v, want %d", tt.text, tt.currency, got, err, tt.amount)
+        }
+    }
+
+    for _, bad := range []struct{ text, currency string }{{"10.5", "JPY"}, {"1.001", "USD"}, {"1.", "USD"}, {"abc", "USD"}, {"", "USD"}} {
+        if _, err := ParseAmount(bad.text, bad.currency); err == nil {
+            t.Errorf("ParseAmount(%q, %s) succeeded, want an error", bad.text, bad.currency)
+        }
+    }
+}
+
+func TestNormalizeCurrency(t *testing.T) {
+    if code, err := NormalizeCurrency(" eur "); err != nil || code != "EUR" {
+        t.Errorf(`NormalizeCurrency(" eur ") = %q, %v, want "EUR"`, code, err)
+    }
+    if code, err := NormalizeCurrency(""); err != nil || code != DefaultCurrency {
+        t.Errorf(`NormalizeCurrency("") = %q, %v, want %q`, code, err, DefaultCurrency)
+    }
+    if _, err := NormalizeCurrency("XAU"); err == nil {
+        t.Error(`NormalizeCurrency("XAU") succeeded, want an error for precious metals`)
+    }
+}
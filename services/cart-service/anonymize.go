@@ -0,0 +1,112 @@
+package main
+
+import (
+    "crypto/hmac"
+    "crypto/sha256"
+    "encoding/hex"
+    "encoding/json"
+    "net/http"
+    "os"
+    "strings"
+
+    "middleware/adminauth"
+)
+
+// Staging anonymization. Personal data is replaced with keyed pseudonyms
+// (HMAC-SHA256 under ANONYMIZE_KEY), so one value always maps to the same
+// pseudonym, in every service that shares the key. An email used as a
+// user ID in orders therefore still matches the same user's cart. Opaque
+// identifiers (UUID user, cart and order IDs) carry no personal data and
+// are kept, so references between services stay intact. Values that are
+// already pseudonyms are left alone, which makes anonymizing twice a no-op.
+var anonymizeKey = os.Getenv("ANONYMIZE_KEY")
+
+// AnonymizedEmailDomain is reserved (RFC 2606), so anonymized addresses
+// can never reach a real mailbox
+const AnonymizedEmailDomain = "example.invalid"
+
+// AnonymizedPaymentPrefix marks pseudonymous payment references
+const AnonymizedPaymentPrefix = "pay_anon_"
+
+// Helper function to derive a pseudonym for a value
+func pseudonym(kind string, value string) string {
+    mac := hmac.New(sha256.New, []byte(anonymizeKey))
+    mac.Write([]byte(kind + ":" + value))
+    return hex.EncodeToString(mac.Sum(nil))[:16]
+}
+
+// Helper function to anonymize an email address. Anything that isn't an
+// address is returned unchanged. Test users keep their prefix so test
+// scoped clears still find them.
+func anonymizeEmail(value string) string {
+    if !strings.Contains(value, "@") || strings.HasSuffix(value, "@"+AnonymizedEmailDomain) {
+        return value
+    }
+    prefix := ""
+    if strings.HasPrefix(value, adminauth.TestDataPrefix) {
+        prefix = adminauth.TestDataPrefix
+    }
+    return prefix + "user-" + pseudonym("email", strings.ToLower(value)) + "@" + AnonymizedEmailDomain
+}
+
+// Helper function to anonymize a payment provider reference
+func anonymizePaymentRef(value string) string {
+    if value == "" || strings.HasPrefix(value, AnonymizedPaymentPrefix) {
+        return value
+    }
+    return AnonymizedPaymentPrefix + pseudonym("payment", value)
+}
+
+// Helper function to check that anonymization can run. Writes the error
+// response and returns false when it can't.
+func checkAnonymizeKey(w http.ResponseWriter) bool {
+    if anonymizeKey == "" {
+        http.Error(w, "ANONYMIZE_KEY is not set; use the same key in every service so pseudonyms match", http.StatusBadRequest)
+        return false
+    }
+    return true
+}
+
+// Helper function to anonymize one cart. Carts hold no names, addresses or
+// payment details; only a user ID that is an email needs replacing.
+func anonymizeCart(cart Cart) Cart {
+    cart.UserID = anonymizeEmail(cart.UserID)
+    return cart
+}
+
+// Admin endpoint to anonymize every cart in place, e.g. after restoring a
+// production backup into staging. Carts being updated at the same moment
+// may be written back under their old user, so run it on a quiet service.
+func anonymizeCartsHandler(w http.ResponseWriter, r *http.Request) {
+    if r.URL.Query().Get("confirm") != serviceName {
+        http.Error(w, "Confirmation required: pass ?confirm="+serviceName, http.StatusBadRequest)
+        return
+    }
+    if !checkAnonymizeKey(w) {
+        return
+    }
+
+    mu.Lock()
+    anonymized := 0
+    for cartID, cart := range carts {
+        updated := anonymizeCart(cart)
+        if updated.UserID == cart.UserID {
+            continue
+        }
+        delete(userCarts, cart.UserID)
+        userCarts[updated.UserID] = cartID
+        carts[cartID] = updated
+        anonymized++
+    }
+    mu.Unlock()
+
+    adminauth.Audit(r, "anonymize", map[string]interface{}{"carts": anonymized})
+
+    result := map[string]interface{}{
+        "message": "Carts anonymized",
+        "carts":   anonymized,
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(result)
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "log"
+    "net/http"
+    "sort"
+
+    "middleware/adminauth"
+    "middleware/backup"
+    "middleware/httpserver"
+)
+
+// Helper function to parse ?anonymize=true, which anonymizes records as
+// they are imported. Writes the error response and returns false on
+// failure.
+func parseAnonymizeFlag(w http.ResponseWriter, r *http.Request) (bool, bool) {
+    switch r.URL.Query().Get("anonymize") {
+    case "", "false":
+        return false, true
+    case "true":
+        return true, checkAnonymizeKey(w)
+    }
+    http.Error(w, "anonymize must be 'true' or 'false'", http.StatusBadRequest)
+    return false, false
+}
+
+// cartBackup is a cart together with the inventory reservations it holds
+type cartBackup struct {
+    Cart
+    ReservationIDs []string `json:"reservation_ids,omitempty"`
+}
+
+// Admin endpoint to stream every cart as a backup
+func backupCartsHandler(w http.ResponseWriter, r *http.Request) {
+    // Copy under the lock so the backup is a point-in-time view and slow
+    // clients never hold up writers
+    mu.RLock()
+    snapshot := make([]cartBackup, 0, len(carts))
+    for cartID, cart := range carts {
+        cart.Items = append([]CartItem{}, cart.Items...)
+        snapshot = append(snapshot, cartBackup{
+            Cart:           cart,
+            ReservationIDs: append([]string(nil), reservations[cartID]...),
+        })
+    }
+    mu.RUnlock()
+
+    writer := backup.NewWriter(w)
+    for _, cart := range snapshot {
+        if err := writer.Write("cart", cart.CartID, cart); err != nil {
+            log.Printf("Backup aborted after %d records: %v", writer.Count(), err)
+            return
+        }
+    }
+
+    adminauth.Audit(r, "backup", map[string]interface{}{"records": writer.Count()})
+}
+
+// Admin endpoint to import carts from a backup. A user has one cart, so a
+// backed-up cart conflicts with whatever cart its user has now.
+func restoreCartsHandler(w http.ResponseWriter, r *http.Request) {
+    policy, ok := backup.ParseConflictPolicy(w, r)
+    if !ok {
+        return
+    }
+    anonymize, ok := parseAnonymizeFlag(w, r)
+    if !ok {
+        return
+    }
+
+    httpserver.LiftDeadlines(w)
+    records, err := backup.Read(r.Body)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+
+    incoming := make([]cartBackup, 0, len(records))
+    userIDs := make([]string, 0, len(records))
+    for _, record := range records {
+        if record.Type != "cart" {
+            http.Error(w, fmt.Sprintf("Unknown record type %q", record.Type), http.StatusBadRequest)
+            return
+        }
+        var cart cartBackup
+        if err := json.Unmarshal(record.Data, &cart); err != nil || cart.CartID == "" || cart.UserID == "" {
+            http.Error(w, fmt.Sprintf("Invalid cart record %q", record.ID), http.StatusBadRequest)
+            return
+        }
+        if anonymize {
+            cart.Cart = anonymizeCart(cart.Cart)
+        }
+        incoming = append(incoming, cart)
+        userIDs = append(userIDs, cart.UserID)
+    }
+
+    // Hold every affected user's lock so in-flight cart updates can't
+    // overwrite restored carts. Handlers only ever hold one user lock, so
+    // taking them in sorted order can't deadlock.
+    sort.Strings(userIDs)
+    for i, userID := range userIDs {
+        if i > 0 && userID == userIDs[i-1] {
+            continue
+        }
+        defer lockUser(userID)()
+    }
+
+    mu.Lock()
+    var result backup.Result
+    actions := make([]string, len(incoming))
+    for i, cart := range incoming {
+        var existing cartBackup
+        cartID, exists := userCarts[cart.UserID]
+        if exists {
+            existing = cartBackup{Cart: carts[cartID], ReservationIDs: reservations[cartID]}
+        }
+        actions[i] = result.Classify(policy, cart.CartID, exists, existing, cart)
+    }
+
+    var released []string
+    if result.Applies(policy) {
+        for i, cart := range incoming {
+            if actions[i] != backup.ActionCreate && actions[i] != backup.ActionUpdate {
+                continue
+            }
+
+            // Reservations the restored cart no longer holds go back to stock
+            if previousID, exists := userCarts[cart.UserID]; exists {
+                kept := make(map[string]bool)
+                for _, reservationID := range cart.ReservationIDs {
+                    kept[reservationID] = true
+                }
+                for _, reservationID := range reservations[previousID] {
+                    if !kept[reservationID] {
+                        released = append(released, reservationID)
+                    }
+                }
+                delete(reservations, previousID)
+                delete(carts, previousID)
+            }
+
+            carts[cart.CartID] = cart.Cart
+            userCarts[cart.UserID] = cart.CartID
+            if len(cart.ReservationIDs) > 0 {
+                reservations[cart.CartID] = cart.ReservationIDs
+            } else {
+                delete(reservations, cart.CartID)
+            }
+        }
+    }
+    mu.Unlock()
+
+    if len(released) > 0 {
+        go releaseReservations(released)
+    }
+
+    backup.WriteResult(w, r, policy, result)
+}
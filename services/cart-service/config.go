@@ -0,0 +1,69 @@
+package main
+
+import (
+    "log"
+
+    "middleware/adminauth"
+    "middleware/hotconfig"
+)
+
+// Reloadable settings; see pkg/middleware/hotconfig. Everything else is
+// read once at startup.
+var liveConfig *hotconfig.Config[serviceConfig]
+
+func init() {
+    liveConfig = hotconfig.New(loadConfig, (*serviceConfig).settings)
+    liveConfig.Audit = adminauth.Audit
+    if err := liveConfig.Load(); err != nil {
+        log.Fatalf("Invalid configuration: %v", err)
+    }
+}
+
+// Helper function to get the live configuration
+func config() *serviceConfig {
+    return liveConfig.Get()
+}
+
+// Helper function to read a setting, preferring CONFIG_FILE over the
+// environment. Only valid while building a configuration.
+func configValue(name string) string {
+    return liveConfig.Value(name)
+}
+
+// serviceConfig holds the cart service's reloadable settings
+type serviceConfig struct {
+    InventoryServiceURL string
+    OrderServiceURL     string
+}
+
+// Helper function to load the reloadable settings. Called by liveConfig
+// while it builds a configuration, so configValue sees the current
+// CONFIG_FILE.
+func loadConfig() (*serviceConfig, error) {
+    cfg := &serviceConfig{
+        InventoryServiceURL: configValue("INVENTORY_SERVICE_URL"),
+        OrderServiceURL:     configValue("ORDER_SERVICE_URL"),
+    }
+    if cfg.InventoryServiceURL == "" {
+        cfg.InventoryServiceURL = "http://inventory-service:8004"
+    }
+    if cfg.OrderServiceURL == "" {
+        cfg.OrderServiceURL = "http://order-service:8003"
+    }
+
+    if err := hotconfig.ValidateURL("INVENTORY_SERVICE_URL", cfg.InventoryServiceURL); err != nil {
+        return nil, err
+    }
+    if err := hotconfig.ValidateURL("ORDER_SERVICE_URL", cfg.OrderServiceURL); err != nil {
+        return nil, err
+    }
+    return cfg, nil
+}
+
+// Helper function to list the settings for display and diffing
+func (cfg *serviceConfig) settings() map[string]string {
+    return map[string]string{
+        "INVENTORY_SERVICE_URL": cfg.InventoryServiceURL,
+        "ORDER_SERVICE_URL":     cfg.OrderServiceURL,
+    }
+}
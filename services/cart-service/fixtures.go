@@ -0,0 +1,81 @@
+package main
+
+import (
+    "encoding/json"
+    "net/http"
+
+    "middleware/adminauth"
+)
+
+// FixtureTimestamp is used for every fixture's update time so fixture
+// responses are byte-for-byte stable between runs (2024-01-01T00:00:00Z)
+const FixtureTimestamp = 1704067200
+
+// Fixture carts for end-to-end suites, owned by the fixture users in
+// user-service and priced like the fixture products. They hold no
+// inventory reservations, so loading them never changes fixture stock.
+var fixtureCarts = []Cart{
+    {
+        CartID: "test-cart-1",
+        UserID: "test-user-1",
+        Items: []CartItem{
+            {ProductID: "test-prod-1", Quantity: 2, PriceCents: 1999},
+            {ProductID: "test-prod-3", Quantity: 1, PriceCents: 999},
+        },
+    },
+    {
+        CartID: "test-cart-2",
+        UserID: "test-user-2",
+        Items: []CartItem{
+            {ProductID: "test-prod-4", Quantity: 1, PriceCents: 2999},
+        },
+    },
+}
+
+// Helper function to replace all test carts with the fixture set. Returns
+// how many test carts were removed first.
+func loadFixtures() int {
+    mu.Lock()
+    defer mu.Unlock()
+
+    removed := clearTestCarts()
+    for _, cart := range fixtureCarts {
+        cart.Items = append([]CartItem{}, cart.Items...)
+        cart.UpdatedAt = FixtureTimestamp
+        carts[cart.CartID] = cart
+        userCarts[cart.UserID] = cart.CartID
+    }
+    return removed
+}
+
+// Admin endpoint to (re)load the fixture carts. Any other test users'
+// carts are removed, so every run starts from the same carts.
+func loadFixturesHandler(w http.ResponseWriter, r *http.Request) {
+    removed := loadFixtures()
+    adminauth.Audit(r, "fixtures_load", map[string]interface{}{"removed": removed, "carts": len(fixtureCarts)})
+
+    result := map[string]interface{}{
+        "message": "Fixtures loaded",
+        "removed": removed,
+        "loaded":  map[string]int{"carts": len(fixtureCarts)},
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(result)
+}
+
+// Admin endpoint to remove fixtures and any other test users' carts
+func resetFixturesHandler(w http.ResponseWriter, r *http.Request) {
+    mu.Lock()
+    removed := clearTestCarts()
+    mu.Unlock()
+    adminauth.Audit(r, "fixtures_reset", map[string]interface{}{"removed": removed})
+
+    result := map[string]interface{}{
+        "message": "Fixtures reset",
+        "removed": removed,
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(result)
+}
@@ -0,0 +1,43 @@
+package main
+
+import "sync"
+
+// userLock serializes operations on a single user's cart. refs counts the
+// holders and waiters so idle locks can be dropped from the map.
+type userLock struct {
+    mu   sync.Mutex
+    refs int
+}
+
+// Per-user cart locks. The global mu only guards the maps themselves and is
+// never held across remote calls; a user's lock is held for the whole
+// read-modify-write of their cart, including the inventory round trip.
+var (
+    userLocks   = make(map[string]*userLock)
+    userLocksMu sync.Mutex
+)
+
+// Helper function to lock a user's cart; returns the unlock function
+func lockUser(userID string) func() {
+    userLocksMu.Lock()
+    lock, exists := userLocks[userID]
+    if !exists {
+        lock = &userLock{}
+        userLocks[userID] = lock
+    }
+    lock.refs++
+    userLocksMu.Unlock()
+
+    lock.mu.Lock()
+
+    return func() {
+        lock.mu.Unlock()
+
+        userLocksMu.Lock()
+        lock.refs--
+        if lock.refs == 0 {
+            delete(userLocks, userID)
+        }
+        userLocksMu.Unlock()
+    }
+}
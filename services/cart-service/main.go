@@ -6,14 +6,26 @@ import (
     "fmt"
     "log"
     "net/http"
-    "os"
     "strconv"
+    "strings"
     "sync"
     "time"
 
     "github.com/google/uuid"
     "github.com/gorilla/mux"
-    "github.com/rs/cors"
+    "middleware/accesslog"
+    "middleware/adminauth"
+    "middleware/corspolicy"
+    "middleware/httpserver"
+    "middleware/i18n"
+    "middleware/loadshed"
+    "middleware/openmetrics"
+    "middleware/outbound"
+    "middleware/readiness"
+    "middleware/runtimemetrics"
+    "middleware/slo"
+    "middleware/versioning"
+    "money"
 )
 
 // CartItem represents an item in the cart
@@ -21,6 +33,12 @@ type CartItem struct {
     ProductID  string `json:"product_id"`
     Quantity   int    `json:"qty"`
     PriceCents int    `json:"price_cents"`
+    Currency   string `json:"currency,omitempty"` // ISO 4217, defaults to USD
+}
+
+// LineTotal returns the item's unit price times quantity
+func (i CartItem) LineTotal() (money.Money, error) {
+    return money.New(i.PriceCents, i.Currency).Multiply(i.Quantity)
 }
 
 // Cart represents a user's shopping cart
@@ -60,20 +78,45 @@ var (
     mu          sync.RWMutex
 )
 
-// Environment variables
-var (
-    inventoryServiceURL = os.Getenv("INVENTORY_SERVICE_URL")
-)
+// FunnelEvent is reported to the order service's conversion funnel
+type FunnelEvent struct {
+    Event     string `json:"event"`
+    CartID    string `json:"cart_id"`
+    Timestamp int64  `json:"timestamp"`
+}
+
+// Helper function to report a funnel event (fire-and-forget)
+func trackFunnelEvent(event string, cartID string) {
+    jsonData, err := json.Marshal(FunnelEvent{
+        Event:     event,
+        CartID:    cartID,
+        Timestamp: time.Now().Unix(),
+    })
+    if err != nil {
+        return
+    }
 
-func init() {
-    if inventoryServiceURL == "" {
-        inventoryServiceURL = "http://inventory-service:8004"
+    req, err := http.NewRequest(http.MethodPost, config().OrderServiceURL+"/api/orders/analytics/funnel/events", bytes.NewBuffer(jsonData))
+    if err != nil {
+        return
     }
+    req.Header.Set("Content-Type", "application/json")
+    if token := serviceToken(time.Now()); token != "" {
+        req.Header.Set("Authorization", "Bearer "+token)
+    }
+
+    client := outbound.NewClient(2 * time.Second)
+    resp, err := client.Do(req)
+    if err != nil {
+        log.Printf("Failed to report funnel event %s: %v", event, err)
+        return
+    }
+    resp.Body.Close()
 }
 
 // Helper function to call inventory service
 func reserveInventory(productID string, quantity int, cartID string) (*ReservationResponse, error) {
-    if inventoryServiceURL == "" {
+    if config().InventoryServiceURL == "" {
         return &ReservationResponse{Success: true, ReservationID: "mock-" + uuid.New().String()[:8]}, nil
     }
 
@@ -88,8 +131,8 @@ func reserveInventory(productID string, quantity int, cartID string) (*Reservati
         return nil, err
     }
 
-    resp, err := http.Post(
-        inventoryServiceURL+"/api/inventory/reserve",
+    resp, err := outbound.Client.Post(
+        config().InventoryServiceURL+"/api/inventory/reserve",
         "application/json",
         bytes.NewBuffer(jsonData),
     )
@@ -107,30 +150,57 @@ func reserveInventory(productID string, quantity int, cartID string) (*Reservati
     return &reservationResp, nil
 }
 
-// Helper function to release inventory reservations
-func releaseReservations(cartID string) error {
+// Helper function to read a user's cart. Items are copied so the caller can
+// modify them without racing readers; callers must hold the user's lock.
+func getUserCart(userID string) (Cart, bool) {
     mu.RLock()
+    defer mu.RUnlock()
+
+    cartID, exists := userCarts[userID]
+    if !exists {
+        return Cart{}, false
+    }
+    cart, exists := carts[cartID]
+    if !exists {
+        return Cart{CartID: cartID, UserID: userID, Items: []CartItem{}, UpdatedAt: time.Now().Unix()}, false
+    }
+
+    cart.Items = append([]CartItem{}, cart.Items...)
+    return cart, true
+}
+
+// Helper function to write a cart. Callers must hold the user's lock.
+func saveCart(cart Cart) {
+    mu.Lock()
+    carts[cart.CartID] = cart
+    userCarts[cart.UserID] = cart.CartID
+    mu.Unlock()
+}
+
+// Helper function to detach a cart's reservation IDs so they can be released
+// outside the lock without losing reservations added afterwards
+func takeReservations(cartID string) []string {
+    mu.Lock()
+    defer mu.Unlock()
+
     reservationIDs := reservations[cartID]
-    mu.RUnlock()
+    delete(reservations, cartID)
+    return reservationIDs
+}
 
+// Helper function to release inventory reservations
+func releaseReservations(reservationIDs []string) {
     for _, reservationID := range reservationIDs {
         // Call inventory service to release reservation
-        url := fmt.Sprintf("%s/api/inventory/release/%s", inventoryServiceURL, reservationID)
+        url := fmt.Sprintf("%s/api/inventory/release/%s", config().InventoryServiceURL, reservationID)
         req, _ := http.NewRequest("DELETE", url, nil)
         
-        client := &http.Client{Timeout: 5 * time.Second}
+        client := outbound.NewClient(5 * time.Second)
         _, err := client.Do(req)
         if err != nil {
             log.Printf("Failed to release reservation %s: %v", reservationID, err)
         }
     }
-
-    // Clear reservations for this cart
-    mu.Lock()
-    delete(reservations, cartID)
-    mu.Unlock()
-
-    return nil
 }
 
 // Health check endpoint
@@ -155,27 +225,24 @@ func getCartHandler(w http.ResponseWriter, r *http.Request) {
     vars := mux.Vars(r)
     userID := vars["userId"]
 
-    mu.Lock()
-    defer mu.Unlock()
+    unlock := lockUser(userID)
+    defer unlock()
 
     // Check if user already has a cart
-    cartID, exists := userCarts[userID]
+    cart, exists := getUserCart(userID)
     if !exists {
         // Create new cart
-        cartID = uuid.New().String()
-        cart := Cart{
-            CartID:    cartID,
+        cart = Cart{
+            CartID:    uuid.New().String(),
             UserID:    userID,
             Items:     []CartItem{},
             Reserved:  false,
             UpdatedAt: time.Now().Unix(),
         }
-        carts[cartID] = cart
-        userCarts[userID] = cartID
+        saveCart(cart)
+        go trackFunnelEvent("cart_created", cart.CartID)
     }
 
-    cart := carts[cartID]
-    
     w.Header().Set("Content-Type", "application/json")
     json.NewEncoder(w).Encode(cart)
 }
@@ -187,40 +254,39 @@ func addItemHandler(w http.ResponseWriter, r *http.Request) {
 
     var req AddItemRequest
     if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-        http.Error(w, "Invalid JSON", http.StatusBadRequest)
+        i18n.WriteError(w, r, http.StatusBadRequest, "request.invalid_json")
         return
     }
 
     if req.ProductID == "" || req.Quantity <= 0 {
-        http.Error(w, "Product ID and positive quantity required", http.StatusBadRequest)
+        i18n.WriteError(w, r, http.StatusBadRequest, "cart.item_required")
         return
     }
 
-    mu.Lock()
-    defer mu.Unlock()
+    // Only this user's cart is locked while waiting on the inventory service
+    unlock := lockUser(userID)
+    defer unlock()
 
     // Get or create cart
-    cartID, exists := userCarts[userID]
+    cart, exists := getUserCart(userID)
     if !exists {
-        cartID = uuid.New().String()
-        userCarts[userID] = cartID
-    }
-
-    cart, exists := carts[cartID]
-    if !exists {
-        cart = Cart{
-            CartID:    cartID,
-            UserID:    userID,
-            Items:     []CartItem{},
-            Reserved:  false,
-            UpdatedAt: time.Now().Unix(),
+        if cart.CartID == "" {
+            cart = Cart{
+                CartID:    uuid.New().String(),
+                UserID:    userID,
+                Items:     []CartItem{},
+                Reserved:  false,
+                UpdatedAt: time.Now().Unix(),
+            }
         }
+        go trackFunnelEvent("cart_created", cart.CartID)
     }
+    cartID := cart.CartID
 
     // Reserve inventory first
     reservationResp, err := reserveInventory(req.ProductID, req.Quantity, cartID)
     if err != nil {
-        http.Error(w, "Failed to reserve inventory", http.StatusInternalServerError)
+        i18n.WriteError(w, r, http.StatusInternalServerError, "cart.reservation_failed")
         return
     }
 
@@ -249,13 +315,17 @@ func addItemHandler(w http.ResponseWriter, r *http.Request) {
 
     cart.Reserved = true
     cart.UpdatedAt = time.Now().Unix()
-    carts[cartID] = cart
+    saveCart(cart)
 
     // Track reservations
+    mu.Lock()
     if reservations[cartID] == nil {
         reservations[cartID] = []string{}
     }
     reservations[cartID] = append(reservations[cartID], reservationResp.ReservationID)
+    mu.Unlock()
+
+    go trackFunnelEvent("item_added", cartID)
 
     w.Header().Set("Content-Type", "application/json")
     json.NewEncoder(w).Encode(cart)
@@ -267,18 +337,12 @@ func removeItemHandler(w http.ResponseWriter, r *http.Request) {
     userID := vars["userId"]
     productID := vars["productId"]
 
-    mu.Lock()
-    defer mu.Unlock()
-
-    cartID, exists := userCarts[userID]
-    if !exists {
-        http.Error(w, "Cart not found", http.StatusNotFound)
-        return
-    }
+    unlock := lockUser(userID)
+    defer unlock()
 
-    cart, exists := carts[cartID]
+    cart, exists := getUserCart(userID)
     if !exists {
-        http.Error(w, "Cart not found", http.StatusNotFound)
+        i18n.WriteError(w, r, http.StatusNotFound, "cart.not_found")
         return
     }
 
@@ -291,7 +355,7 @@ func removeItemHandler(w http.ResponseWriter, r *http.Request) {
     }
 
     cart.UpdatedAt = time.Now().Unix()
-    carts[cartID] = cart
+    saveCart(cart)
 
     w.Header().Set("Content-Type", "application/json")
     json.NewEncoder(w).Encode(cart)
@@ -306,22 +370,16 @@ func updateItemHandler(w http.ResponseWriter, r *http.Request) {
     quantityStr := r.URL.Query().Get("quantity")
     quantity, err := strconv.Atoi(quantityStr)
     if err != nil || quantity < 0 {
-        http.Error(w, "Valid quantity required", http.StatusBadRequest)
+        i18n.WriteError(w, r, http.StatusBadRequest, "cart.quantity_required")
         return
     }
 
-    mu.Lock()
-    defer mu.Unlock()
+    unlock := lockUser(userID)
+    defer unlock()
 
-    cartID, exists := userCarts[userID]
-    if !exists {
-        http.Error(w, "Cart not found", http.StatusNotFound)
-        return
-    }
-
-    cart, exists := carts[cartID]
+    cart, exists := getUserCart(userID)
     if !exists {
-        http.Error(w, "Cart not found", http.StatusNotFound)
+        i18n.WriteError(w, r, http.StatusNotFound, "cart.not_found")
         return
     }
 
@@ -341,12 +399,12 @@ func updateItemHandler(w http.ResponseWriter, r *http.Request) {
     }
 
     if !found {
-        http.Error(w, "Item not found in cart", http.StatusNotFound)
+        i18n.WriteError(w, r, http.StatusNotFound, "cart.item_not_found")
         return
     }
 
     cart.UpdatedAt = time.Now().Unix()
-    carts[cartID] = cart
+    saveCart(cart)
 
     w.Header().Set("Content-Type", "application/json")
     json.NewEncoder(w).Encode(cart)
@@ -357,17 +415,19 @@ func clearCartHandler(w http.ResponseWriter, r *http.Request) {
     vars := mux.Vars(r)
     userID := vars["userId"]
 
-    mu.Lock()
-    defer mu.Unlock()
+    unlock := lockUser(userID)
+    defer unlock()
 
+    mu.RLock()
     cartID, exists := userCarts[userID]
+    mu.RUnlock()
     if !exists {
-        http.Error(w, "Cart not found", http.StatusNotFound)
+        i18n.WriteError(w, r, http.StatusNotFound, "cart.not_found")
         return
     }
 
     // Release all reservations
-    go releaseReservations(cartID)
+    go releaseReservations(takeReservations(cartID))
 
     // Clear cart
     cart := Cart{
@@ -378,28 +438,59 @@ func clearCartHandler(w http.ResponseWriter, r *http.Request) {
         UpdatedAt: time.Now().Unix(),
     }
     
-    carts[cartID] = cart
+    saveCart(cart)
 
     w.Header().Set("Content-Type", "application/json")
     json.NewEncoder(w).Encode(cart)
 }
 
+// Helper function to remove carts owned by test users, releasing their
+// reservations. Callers must hold mu.
+func clearTestCarts() int {
+    cleared := 0
+    for cartID, cart := range carts {
+        if !strings.HasPrefix(cart.UserID, adminauth.TestDataPrefix) {
+            continue
+        }
+        go releaseReservations(reservations[cartID])
+        delete(reservations, cartID)
+        delete(userCarts, cart.UserID)
+        delete(carts, cartID)
+        cleared++
+    }
+    return cleared
+}
+
 // Admin endpoint to clear all carts
 func clearAllCartsHandler(w http.ResponseWriter, r *http.Request) {
+    scope, ok := adminauth.ConfirmClear(w, r)
+    if !ok {
+        return
+    }
+
     mu.Lock()
-    defer mu.Unlock()
+    cleared := 0
+    if scope == "test" {
+        cleared = clearTestCarts()
+    } else {
+        // Release all reservations
+        for _, reservationIDs := range reservations {
+            go releaseReservations(reservationIDs)
+        }
 
-    // Release all reservations
-    for cartID := range reservations {
-        go releaseReservations(cartID)
+        cleared = len(carts)
+        carts = make(map[string]Cart)
+        userCarts = make(map[string]string)
+        reservations = make(map[string][]string)
     }
+    mu.Unlock()
 
-    carts = make(map[string]Cart)
-    userCarts = make(map[string]string)
-    reservations = make(map[string][]string)
+    adminauth.Audit(r, "clear", map[string]interface{}{"scope": scope, "cleared": cleared})
 
-    result := map[string]string{
-        "message": "All carts cleared",
+    result := map[string]interface{}{
+        "message": "Carts cleared",
+        "scope":   scope,
+        "cleared": cleared,
     }
 
     w.Header().Set("Content-Type", "application/json")
@@ -423,8 +514,13 @@ cart_service_carts_total %d
 cart_service_reservations_total %d
 `, cartCount, reservationCount)
 
-    w.Header().Set("Content-Type", "text/plain")
-    w.Write([]byte(metrics))
+    metrics += readiness.Metrics()
+    metrics += versioning.Metrics()
+    metrics += loadshed.Metrics()
+    metrics += slo.Metrics()
+    metrics += runtimemetrics.Text()
+
+    openmetrics.Write(w, r, metrics)
 }
 
 // Clean up expired reservations (runs every 30 minutes)
@@ -433,58 +529,91 @@ func cleanupExpiredReservations() {
     defer ticker.Stop()
 
     for range ticker.C {
-        mu.Lock()
         now := time.Now().Unix()
-        
-        for cartID, cart := range carts {
-            // Release reservations for carts older than 1 hour without activity
+
+        // Collect candidates first; user locks are always taken before mu
+        mu.RLock()
+        var idleUsers []string
+        for _, cart := range carts {
             if now-cart.UpdatedAt > 3600 {
-                go releaseReservations(cartID)
+                idleUsers = append(idleUsers, cart.UserID)
+            }
+        }
+        mu.RUnlock()
+
+        for _, userID := range idleUsers {
+            unlock := lockUser(userID)
+
+            // Release reservations for carts older than 1 hour without activity
+            cart, exists := getUserCart(userID)
+            if exists && now-cart.UpdatedAt > 3600 {
+                go releaseReservations(takeReservations(cart.CartID))
                 cart.Reserved = false
                 cart.UpdatedAt = now
-                carts[cartID] = cart
+                saveCart(cart)
             }
+
+            unlock()
         }
-        mu.Unlock()
     }
 }
 
+// Cart API v1 routes
+func cartRoutesV1(api *mux.Router) {
+    api.HandleFunc("/{userId}", getCartHandler).Methods("GET")
+    api.HandleFunc("/{userId}/add", addItemHandler).Methods("POST")
+    api.HandleFunc("/{userId}/remove/{productId}", removeItemHandler).Methods("DELETE")
+    api.HandleFunc("/{userId}/update/{productId}", updateItemHandler).Methods("PUT")
+    api.HandleFunc("/{userId}/clear", clearCartHandler).Methods("DELETE")
+    api.HandleFunc("/{userId}/checkout", checkoutCartHandler).Methods("POST")
+}
+
 func main() {
     // Start cleanup goroutine
     go cleanupExpiredReservations()
+    go liveConfig.Watch()
+    go readiness.Run(outbound.NewClient)
 
     router := mux.NewRouter()
+    router.Use(openmetrics.Observe)
 
-    // API routes
-    api := router.PathPrefix("/api/cart").Subrouter()
-    api.HandleFunc("/{userId}", getCartHandler).Methods("GET")
-    api.HandleFunc("/{userId}/add", addItemHandler).Methods("POST")
-    api.HandleFunc("/{userId}/remove/{productId}", removeItemHandler).Methods("DELETE")
-    api.HandleFunc("/{userId}/update/{productId}", updateItemHandler).Methods("PUT")
-    api.HandleFunc("/{userId}/clear", clearCartHandler).Methods("DELETE")
+    // API routes, served under /api/v1/cart and the legacy /api/cart
+    api := router.PathPrefix("/api").Subrouter()
+    api.Use(actingAsMiddleware)
+    versioning.Mount(api, "/cart", map[string]func(*mux.Router){
+        "v1": cartRoutesV1,
+    })
 
     // Admin routes
-    router.HandleFunc("/admin/clear", clearAllCartsHandler).Methods("DELETE")
+    admin := router.PathPrefix("/admin").Subrouter()
+    admin.Use(adminauth.Middleware)
+    admin.HandleFunc("/clear", clearAllCartsHandler).Methods("DELETE")
+    admin.HandleFunc("/backup", backupCartsHandler).Methods("GET")
+    admin.HandleFunc("/restore", restoreCartsHandler).Methods("POST")
+    admin.HandleFunc("/anonymize", anonymizeCartsHandler).Methods("POST")
+    admin.HandleFunc("/test/fixtures", loadFixturesHandler).Methods("POST")
+    admin.HandleFunc("/test/fixtures", resetFixturesHandler).Methods("DELETE")
+    admin.HandleFunc("/config", liveConfig.Handler).Methods("GET")
+    admin.HandleFunc("/config/reload", liveConfig.ReloadHandler).Methods("POST")
 
     // Utility routes
     router.HandleFunc("/health", healthHandler).Methods("GET")
+    router.HandleFunc("/readyz", readiness.Handler).Methods("GET")
     router.HandleFunc("/metrics", metricsHandler).Methods("GET")
+    router.HandleFunc("/slo", slo.Handler).Methods("GET")
 
-    // CORS configuration
-    c := cors.New(cors.Options{
-        AllowedOrigins:   []string{"*"},
-        AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
-        AllowedHeaders:   []string{"*"},
-        AllowCredentials: true,
-    })
+    // CORS policy from CORS_* settings
+    c := corspolicy.New()
 
-    handler := c.Handler(router)
+    handler := accesslog.Handler(serviceName, c.Handler(loadshed.Handler(router, nil)))
 
     port := "8002"
     log.Printf("Cart service starting on port %s", port)
-    log.Printf("Inventory service URL: %s", inventoryServiceURL)
+    log.Printf("Access log: %s", accesslog.Settings())
+    log.Printf("Inventory service URL: %s", config().InventoryServiceURL)
+    log.Printf("Order service URL: %s", config().OrderServiceURL)
     
-    if err := http.ListenAndServe(":"+port, handler); err != nil {
+    if err := httpserver.New(port, handler).ListenAndServe(); err != nil {
         log.Fatal("Server failed to start:", err)
     }
 }
\ No newline at end of file
@@ -0,0 +1,16 @@
+package main
+
+import "middleware/readiness"
+
+func init() {
+    readiness.Setup(serviceName, readinessDependencies, nil)
+}
+
+// Dependencies probed for readiness. Adding to a cart reserves stock, so
+// inventory is required; the order service only receives funnel events.
+func readinessDependencies() []readiness.Dependency {
+    return []readiness.Dependency{
+        {Name: "inventory", URL: func() string { return config().InventoryServiceURL }, Required: true},
+        {Name: "order", URL: func() string { return config().OrderServiceURL }, Required: false},
+    }
+}
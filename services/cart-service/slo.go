@@ -0,0 +1,31 @@
+package main
+
+import (
+    "time"
+
+    "middleware/slo"
+)
+
+func init() {
+    slo.Setup(serviceName, serviceObjectives(), nil)
+}
+
+// SLOs for the cart service. Adding an item waits on an inventory
+// reservation, so it gets more room than plain cart reads.
+func serviceObjectives() []slo.Objective {
+    return []slo.Objective{
+        {
+            Name:        "add_to_cart_latency",
+            Description: "99.5% of add-to-cart requests complete within 500ms",
+            Method:      "POST",
+            Route:       "/api/cart/{userId}/add",
+            Target:      0.995,
+            Latency:     500 * time.Millisecond,
+        },
+        {
+            Name:        "availability",
+            Description: "99.9% of requests succeed",
+            Target:      0.999,
+        },
+    }
+}
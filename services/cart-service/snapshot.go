@@ -0,0 +1,112 @@
+package main
+
+import (
+    "crypto/hmac"
+    "crypto/sha256"
+    "encoding/base64"
+    "encoding/hex"
+    "encoding/json"
+    "net/http"
+    "os"
+    "time"
+
+    "github.com/google/uuid"
+    "github.com/gorilla/mux"
+    "middleware/i18n"
+    "money"
+)
+
+// CartSnapshotTTL is how long order-service accepts a checkout snapshot
+const CartSnapshotTTL = 15 * time.Minute
+
+// Signs checkout snapshots; order-service verifies them with the same
+// secret. Unset means unsigned, for local development.
+var cartSnapshotSecret = os.Getenv("CART_SNAPSHOT_SECRET")
+
+// CartSnapshot freezes a cart's contents at checkout. order-service builds
+// the order from the snapshot instead of re-reading the cart, so items
+// added or removed while payment is in flight can't change what is
+// charged.
+type CartSnapshot struct {
+    SnapshotID    string     `json:"snapshot_id"`
+    CartID        string     `json:"cart_id"`
+    UserID        string     `json:"user_id"`
+    Items         []CartItem `json:"items"`
+    SubtotalCents int        `json:"subtotal_cents"`
+    Currency      string     `json:"currency"`
+    CreatedAt     int64      `json:"created_at"`
+    ExpiresAt     int64      `json:"expires_at"`
+}
+
+// Helper function to encode a snapshot as an opaque token,
+// "<base64url JSON>.<hex HMAC-SHA256 of the encoded JSON>". Signing the
+// encoded bytes means clients pass the token through untouched rather
+// than re-serializing JSON that must match byte for byte.
+func encodeCartSnapshot(snapshot CartSnapshot) (string, error) {
+    data, err := json.Marshal(snapshot)
+    if err != nil {
+        return "", err
+    }
+    payload := base64.RawURLEncoding.EncodeToString(data)
+
+    mac := hmac.New(sha256.New, []byte(cartSnapshotSecret))
+    mac.Write([]byte(payload))
+    return payload + "." + hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+// Checkout: snapshot the cart for order-service
+func checkoutCartHandler(w http.ResponseWriter, r *http.Request) {
+    userID := mux.Vars(r)["userId"]
+
+    unlock := lockUser(userID)
+    defer unlock()
+
+    cart, exists := getUserCart(userID)
+    if !exists {
+        i18n.WriteError(w, r, http.StatusNotFound, "cart.not_found")
+        return
+    }
+    if len(cart.Items) == 0 {
+        i18n.WriteError(w, r, http.StatusBadRequest, "cart.empty")
+        return
+    }
+
+    // Every line must be in one currency; the subtotal is what gets charged
+    currency := money.New(0, cart.Items[0].Currency).Currency
+    subtotal := money.New(0, currency)
+    for _, item := range cart.Items {
+        line, err := item.LineTotal()
+        if err == nil {
+            subtotal, err = subtotal.Add(line)
+        }
+        if err != nil {
+            i18n.WriteError(w, r, http.StatusBadRequest, "cart.invalid_total")
+            return
+        }
+    }
+
+    now := time.Now()
+    snapshot := CartSnapshot{
+        SnapshotID:    uuid.New().String(),
+        CartID:        cart.CartID,
+        UserID:        cart.UserID,
+        Items:         cart.Items,
+        SubtotalCents: subtotal.Amount,
+        Currency:      subtotal.Currency,
+        CreatedAt:     now.Unix(),
+        ExpiresAt:     now.Add(CartSnapshotTTL).Unix(),
+    }
+    token, err := encodeCartSnapshot(snapshot)
+    if err != nil {
+        http.Error(w, "Failed to encode cart snapshot", http.StatusInternalServerError)
+        return
+    }
+
+    result := map[string]interface{}{
+        "snapshot": snapshot,
+        "token":    token,
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(result)
+}
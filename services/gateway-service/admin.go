@@ -0,0 +1,11 @@
+package main
+
+import "middleware/adminauth"
+
+// serviceName identifies the gateway in SLO reports and audit events, and
+// is the value destructive admin calls must confirm with
+const serviceName = "gateway-service"
+
+func init() {
+    adminauth.Setup(serviceName)
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+    "fmt"
+    "log"
+    "net"
+    "strconv"
+    "strings"
+    "time"
+
+    "middleware/hotconfig"
+)
+
+// Reloadable settings; see pkg/middleware/hotconfig. Everything else is
+// read once at startup.
+var liveConfig *hotconfig.Config[serviceConfig]
+
+func init() {
+    liveConfig = hotconfig.New(loadConfig, (*serviceConfig).settings)
+    if err := liveConfig.Load(); err != nil {
+        log.Fatalf("Invalid configuration: %v", err)
+    }
+}
+
+// Helper function to get the live configuration
+func config() *serviceConfig {
+    return liveConfig.Get()
+}
+
+// Helper function to read a setting, preferring CONFIG_FILE over the
+// environment. Only valid while building a configuration.
+func configValue(name string) string {
+    return liveConfig.Value(name)
+}
+
+// serviceConfig holds the gateway's reloadable settings. The upstream
+// proxies are built from the URLs, so a reload re-routes traffic too.
+type serviceConfig struct {
+    ProductServiceURL      string
+    InventoryServiceURL    string
+    SearchServiceURL       string
+    ReviewServiceURL       string // optional; ratings are omitted when unset
+    CartServiceURL         string
+    OrderServiceURL        string
+    PaymentServiceURL      string
+    NotificationServiceURL string
+    UserServiceURL         string
+
+    // Per-dependency timeouts for composed storefront pages
+    CatalogTimeout      time.Duration
+    AvailabilityTimeout time.Duration
+    RatingsTimeout      time.Duration
+    RelatedTimeout      time.Duration
+
+    RequireAPIKey     bool
+    DefaultDailyQuota int
+    RouteLimits       []RouteLimit
+    DefaultRouteLimit int
+    TrustedProxies    []*net.IPNet // peers whose X-Forwarded-For is believed
+
+    Upstreams []upstream
+}
+
+// Helper function to load the reloadable settings. Called by liveConfig
+// while it builds a configuration, so configValue sees the current
+// CONFIG_FILE.
+func loadConfig() (*serviceConfig, error) {
+    cfg := &serviceConfig{
+        ProductServiceURL:      serviceURL("PRODUCT_SERVICE_URL", "http://product-service:8001"),
+        InventoryServiceURL:    serviceURL("INVENTORY_SERVICE_URL", "http://inventory-service:8004"),
+        SearchServiceURL:       serviceURL("SEARCH_SERVICE_URL", "http://search-service:8005"),
+        ReviewServiceURL:       configValue("REVIEW_SERVICE_URL"),
+        CartServiceURL:         serviceURL("CART_SERVICE_URL", "http://cart-service:8002"),
+        OrderServiceURL:        serviceURL("ORDER_SERVICE_URL", "http://order-service:8003"),
+        PaymentServiceURL:      serviceURL("PAYMENT_SERVICE_URL", "http://payment-service:3002"),
+        NotificationServiceURL: serviceURL("NOTIFICATION_SERVICE_URL", "http://notification-service:8006"),
+        UserServiceURL:         serviceURL("USER_SERVICE_URL", "http://user-service:3001"),
+
+        CatalogTimeout:      durationFromEnv("CATALOG_TIMEOUT_MS", 800*time.Millisecond),
+        AvailabilityTimeout: durationFromEnv("AVAILABILITY_TIMEOUT_MS", 300*time.Millisecond),
+        RatingsTimeout:      durationFromEnv("RATINGS_TIMEOUT_MS", 300*time.Millisecond),
+        RelatedTimeout:      durationFromEnv("RELATED_TIMEOUT_MS", 500*time.Millisecond),
+
+        RequireAPIKey:     configValue("REQUIRE_API_KEY") == "true",
+        DefaultDailyQuota: intFromEnv("DEFAULT_DAILY_QUOTA", 100000),
+        RouteLimits:       parseRouteLimits(configValue("ROUTE_RATE_LIMITS")),
+        DefaultRouteLimit: intFromEnv("DEFAULT_ROUTE_RATE_LIMIT", 120),
+    }
+
+    trusted, err := parseTrustedProxies(configValue("TRUSTED_PROXIES"))
+    if err != nil {
+        return nil, err
+    }
+    cfg.TrustedProxies = trusted
+
+    if cfg.ReviewServiceURL != "" {
+        if err := hotconfig.ValidateURL("REVIEW_SERVICE_URL", cfg.ReviewServiceURL); err != nil {
+            return nil, err
+        }
+    }
+
+    upstreams, err := buildUpstreams(cfg)
+    if err != nil {
+        return nil, err
+    }
+    cfg.Upstreams = upstreams
+    return cfg, nil
+}
+
+// Helper function to list the settings for display and diffing
+func (cfg *serviceConfig) settings() map[string]string {
+    var routeLimits []string
+    for _, limit := range cfg.RouteLimits {
+        routeLimits = append(routeLimits, fmt.Sprintf("%s=%d", limit.Prefix, limit.Limit))
+    }
+    var trustedProxies []string
+    for _, network := range cfg.TrustedProxies {
+        trustedProxies = append(trustedProxies, network.String())
+    }
+
+    return map[string]string{
+        "PRODUCT_SERVICE_URL":      cfg.ProductServiceURL,
+        "INVENTORY_SERVICE_URL":    cfg.InventoryServiceURL,
+        "SEARCH_SERVICE_URL":       cfg.SearchServiceURL,
+        "REVIEW_SERVICE_URL":       cfg.ReviewServiceURL,
+        "CART_SERVICE_URL":         cfg.CartServiceURL,
+        "ORDER_SERVICE_URL":        cfg.OrderServiceURL,
+        "PAYMENT_SERVICE_URL":      cfg.PaymentServiceURL,
+        "NOTIFICATION_SERVICE_URL": cfg.NotificationServiceURL,
+        "USER_SERVICE_URL":         cfg.UserServiceURL,
+        "CATALOG_TIMEOUT_MS":       strconv.FormatInt(cfg.CatalogTimeout.Milliseconds(), 10),
+        "AVAILABILITY_TIMEOUT_MS":  strconv.FormatInt(cfg.AvailabilityTimeout.Milliseconds(), 10),
+        "RATINGS_TIMEOUT_MS":       strconv.FormatInt(cfg.RatingsTimeout.Milliseconds(), 10),
+        "RELATED_TIMEOUT_MS":       strconv.FormatInt(cfg.RelatedTimeout.Milliseconds(), 10),
+        "REQUIRE_API_KEY":          strconv.FormatBool(cfg.RequireAPIKey),
+        "DEFAULT_DAILY_QUOTA":      strconv.Itoa(cfg.DefaultDailyQuota),
+        "ROUTE_RATE_LIMITS":        strings.Join(routeLimits, ","),
+        "DEFAULT_ROUTE_RATE_LIMIT": strconv.Itoa(cfg.DefaultRouteLimit),
+        "TRUSTED_PROXIES":          strings.Join(trustedProxies, ","),
+    }
+}
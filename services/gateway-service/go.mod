@@ -0,0 +1,13 @@
+module gateway-service
+
+go 1.21
+
+require (
+    github.com/google/uuid v1.4.0
+    github.com/gorilla/mux v1.8.1
+    middleware v0.0.0-00010101000000-000000000000
+)
+
+require github.com/rs/cors v1.10.1 // indirect
+
+replace middleware => ../../pkg/middleware
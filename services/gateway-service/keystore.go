@@ -0,0 +1,194 @@
+package main
+
+import (
+    "encoding/json"
+    "log"
+    "os"
+    "path/filepath"
+    "strconv"
+    "sync"
+    "sync/atomic"
+    "time"
+)
+
+// KeySnapshotVersion is bumped whenever the on-disk layout changes
+const KeySnapshotVersion = 1
+
+// storedAPIKey is an API key as written to disk; only the hash of the raw
+// key is kept, so the file can't be used to call the API
+type storedAPIKey struct {
+    APIKey
+    Hash string `json:"hash"`
+}
+
+// storedWindow is a daily quota window as written to disk
+type storedWindow struct {
+    Start int64 `json:"start"`
+    Count int   `json:"count"`
+}
+
+// keySnapshot is the on-disk representation of the API keys and the
+// quota they have used today. Per-route windows last a minute and are not
+// kept.
+type keySnapshot struct {
+    Version int                     `json:"version"`
+    TakenAt int64                   `json:"taken_at"`
+    Keys    []storedAPIKey          `json:"keys"`
+    Quotas  map[string]storedWindow `json:"quotas,omitempty"` // keyID -> today's window
+}
+
+// Snapshot settings (API_KEYS_PATH="" keeps keys in memory only)
+var (
+    keySnapshotPath     = os.Getenv("API_KEYS_PATH")
+    keySnapshotInterval = 30 * time.Second
+    keySnapshotDirty    atomic.Bool
+    keySnapshotMu       sync.Mutex // serializes writers to the snapshot file
+)
+
+func init() {
+    if _, set := os.LookupEnv("API_KEYS_PATH"); !set {
+        keySnapshotPath = "data/api-keys.json"
+    }
+    if value := os.Getenv("API_KEYS_SNAPSHOT_INTERVAL_SECONDS"); value != "" {
+        if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+            keySnapshotInterval = time.Duration(seconds) * time.Second
+        }
+    }
+}
+
+// Helper function to reload API keys and quota usage on startup
+func loadAPIKeys() error {
+    if keySnapshotPath == "" {
+        return nil
+    }
+
+    data, err := os.ReadFile(keySnapshotPath)
+    if os.IsNotExist(err) {
+        return nil
+    }
+    if err != nil {
+        return err
+    }
+
+    var snapshot keySnapshot
+    if err := json.Unmarshal(data, &snapshot); err != nil {
+        return err
+    }
+
+    keysMu.Lock()
+    for _, stored := range snapshot.Keys {
+        key := stored.APIKey
+        key.hash = stored.Hash
+        apiKeys[key.hash] = &key
+        apiKeyHashes[key.KeyID] = key.hash
+    }
+    keysMu.Unlock()
+
+    // Windows that have already reset are dropped by the next request
+    limiterMu.Lock()
+    for keyID, window := range snapshot.Quotas {
+        quotaWindows[keyID] = &rateWindow{start: time.Unix(window.Start, 0), count: window.Count}
+    }
+    limiterMu.Unlock()
+
+    log.Printf("Restored %d API keys from snapshot taken at %s",
+        len(snapshot.Keys), time.Unix(snapshot.TakenAt, 0).UTC().Format(time.RFC3339))
+    return nil
+}
+
+// Helper function to write the API keys and quota usage to disk. The
+// snapshot is written to a temp file, fsynced, then renamed over the old
+// one so a crash mid-write never leaves a truncated file behind.
+func saveAPIKeys() error {
+    if keySnapshotPath == "" {
+        return nil
+    }
+
+    keySnapshotMu.Lock()
+    defer keySnapshotMu.Unlock()
+
+    // Clear the dirty flag before copying so requests that land during
+    // the copy are picked up by the next snapshot
+    keySnapshotDirty.Store(false)
+
+    snapshot := keySnapshot{
+        Version: KeySnapshotVersion,
+        TakenAt: time.Now().Unix(),
+        Quotas:  make(map[string]storedWindow),
+    }
+
+    keysMu.RLock()
+    for hash, key := range apiKeys {
+        snapshot.Keys = append(snapshot.Keys, storedAPIKey{APIKey: *key, Hash: hash})
+    }
+    keysMu.RUnlock()
+
+    limiterMu.Lock()
+    for keyID, window := range quotaWindows {
+        snapshot.Quotas[keyID] = storedWindow{Start: window.start.Unix(), Count: window.count}
+    }
+    limiterMu.Unlock()
+
+    data, err := json.Marshal(snapshot)
+    if err != nil {
+        return err
+    }
+
+    dir := filepath.Dir(keySnapshotPath)
+    if err := os.MkdirAll(dir, 0755); err != nil {
+        return err
+    }
+
+    tmp, err := os.CreateTemp(dir, ".api-keys-*")
+    if err != nil {
+        return err
+    }
+    defer os.Remove(tmp.Name())
+
+    if _, err := tmp.Write(data); err != nil {
+        tmp.Close()
+        return err
+    }
+    if err := tmp.Sync(); err != nil {
+        tmp.Close()
+        return err
+    }
+    if err := tmp.Close(); err != nil {
+        return err
+    }
+    if err := os.Rename(tmp.Name(), keySnapshotPath); err != nil {
+        return err
+    }
+
+    // Persist the rename itself
+    if d, err := os.Open(dir); err == nil {
+        d.Sync()
+        d.Close()
+    }
+    return nil
+}
+
+// Helper function to write the snapshot after a key is issued, changed or
+// revoked. A failure is logged and left to the periodic loop to retry.
+func persistAPIKeys() {
+    if err := saveAPIKeys(); err != nil {
+        keySnapshotDirty.Store(true)
+        log.Printf("Failed to write API key snapshot: %v", err)
+    }
+}
+
+// Background task to write the snapshot when quota usage has changed
+func apiKeySnapshotLoop() {
+    if keySnapshotPath == "" {
+        return
+    }
+
+    ticker := time.NewTicker(keySnapshotInterval)
+    defer ticker.Stop()
+
+    for range ticker.C {
+        if keySnapshotDirty.Load() {
+            persistAPIKeys()
+        }
+    }
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+    "path/filepath"
+    "testing"
+    "time"
+)
+
+func TestAPIKeysSurviveRestart(t *testing.T) {
+    keySnapshotPath = filepath.Join(t.TempDir(), "api-keys.json")
+    today := time.Now().Truncate(QuotaWindow)
+
+    key := &APIKey{KeyID: "key-1", Name: "partner", Prefix: "gw_0123456", DailyQuota: 50, CreatedAt: today.Unix(), hash: hashAPIKey("gw_secret")}
+    apiKeys[key.hash] = key
+    apiKeyHashes[key.KeyID] = key.hash
+    quotaWindows[key.KeyID] = &rateWindow{start: today, count: 7}
+
+    if err := saveAPIKeys(); err != nil {
+        t.Fatalf("saveAPIKeys: %v", err)
+    }
+
+    // A fresh process starts with empty maps
+    apiKeys = make(map[string]*APIKey)
+    apiKeyHashes = make(map[string]string)
+    quotaWindows = make(map[string]*rateWindow)
+    if err := loadAPIKeys(); err != nil {
+        t.Fatalf("loadAPIKeys: %v", err)
+    }
+
+    restored, exists := apiKeys[hashAPIKey("gw_secret")]
+    if !exists {
+        t.Fatal("key not found by the hash of its raw value after reload")
+    }
+    if *restored != *key {
+        t.Errorf("restored key = %+v, want %+v", *restored, *key)
+    }
+    if apiKeyHashes["key-1"] != key.hash {
+        t.Errorf("key ID index not rebuilt")
+    }
+    window := quotaWindows["key-1"]
+    if window == nil || !window.start.Equal(today) || window.count != 7 {
+        t.Errorf("quota window = %+v, want 7 requests used today", window)
+    }
+}
@@ -0,0 +1,435 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "log"
+    "net/http"
+    "strconv"
+    "sync"
+    "time"
+
+    "github.com/gorilla/mux"
+    "middleware/accesslog"
+    "middleware/adminauth"
+    "middleware/corspolicy"
+    "middleware/httpserver"
+    "middleware/loadshed"
+    "middleware/openmetrics"
+    "middleware/outbound"
+    "middleware/readiness"
+    "middleware/runtimemetrics"
+    "middleware/slo"
+    "middleware/versioning"
+)
+
+// Dependency names used in responses and metrics
+const (
+    DependencyCatalog      = "catalog"
+    DependencyAvailability = "availability"
+    DependencyRatings      = "ratings"
+    DependencyRelated      = "related"
+)
+
+// RelatedProductsLimit caps how many related products are hydrated per page
+const RelatedProductsLimit = 4
+
+var (
+    errNotFound      = errors.New("not found")
+    errNotConfigured = errors.New("not configured")
+)
+
+// dependencyResult holds the outcome of a single downstream call
+type dependencyResult struct {
+    Data     interface{}
+    Err      error
+    Duration time.Duration
+}
+
+// StorefrontProductResponse is the composed product page payload
+type StorefrontProductResponse struct {
+    Product         map[string]interface{}   `json:"product"`
+    Availability    map[string]interface{}   `json:"availability"`
+    RatingSummary   map[string]interface{}   `json:"rating_summary"`
+    RelatedProducts []map[string]interface{} `json:"related_products"`
+    Partial         bool                     `json:"partial"`
+    Degraded        map[string]string        `json:"degraded,omitempty"`
+    TimingsMs       map[string]int64         `json:"timings_ms"`
+}
+
+// Aggregation stats for metrics
+var (
+    storefrontRequests int
+    partialResponses   int
+    dependencyFailures = make(map[string]int)
+    statsMu            sync.Mutex
+)
+
+var httpClient = outbound.NewClient(0)
+
+// Helper function to read a millisecond duration from the configuration
+func durationFromEnv(name string, fallback time.Duration) time.Duration {
+    value := configValue(name)
+    if value == "" {
+        return fallback
+    }
+
+    ms, err := strconv.Atoi(value)
+    if err != nil || ms <= 0 {
+        log.Printf("Invalid %s=%q, using default %s", name, value, fallback)
+        return fallback
+    }
+
+    return time.Duration(ms) * time.Millisecond
+}
+
+// Helper function to GET a JSON document within the given timeout
+func fetchJSON(ctx context.Context, timeout time.Duration, url string, out interface{}) error {
+    ctx, cancel := context.WithTimeout(ctx, timeout)
+    defer cancel()
+
+    req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+    if err != nil {
+        return err
+    }
+
+    resp, err := httpClient.Do(req)
+    if err != nil {
+        return err
+    }
+    defer resp.Body.Close()
+
+    if resp.StatusCode == http.StatusNotFound {
+        return errNotFound
+    }
+    if resp.StatusCode != http.StatusOK {
+        return fmt.Errorf("unexpected status %d from %s", resp.StatusCode, url)
+    }
+
+    return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// Helper function to time a dependency call
+func callDependency(fn func() (interface{}, error)) dependencyResult {
+    start := time.Now()
+    data, err := fn()
+    return dependencyResult{Data: data, Err: err, Duration: time.Since(start)}
+}
+
+func fetchCatalog(ctx context.Context, productID string) (interface{}, error) {
+    var product map[string]interface{}
+    err := fetchJSON(ctx, config().CatalogTimeout, fmt.Sprintf("%s/api/products/%s", config().ProductServiceURL, productID), &product)
+    return product, err
+}
+
+func fetchAvailability(ctx context.Context, productID string) (interface{}, error) {
+    var item map[string]interface{}
+    err := fetchJSON(ctx, config().AvailabilityTimeout, fmt.Sprintf("%s/api/inventory/%s", config().InventoryServiceURL, productID), &item)
+    return item, err
+}
+
+func fetchRatingSummary(ctx context.Context, productID string) (interface{}, error) {
+    if config().ReviewServiceURL == "" {
+        return nil, errNotConfigured
+    }
+
+    var summary map[string]interface{}
+    err := fetchJSON(ctx, config().RatingsTimeout, fmt.Sprintf("%s/api/reviews/products/%s/summary", config().ReviewServiceURL, productID), &summary)
+    return summary, err
+}
+
+// Related products come from search-service recommendations and are
+// hydrated from the catalog concurrently, all within the related budget
+func fetchRelatedProducts(ctx context.Context, productID string) (interface{}, error) {
+    ctx, cancel := context.WithTimeout(ctx, config().RelatedTimeout)
+    defer cancel()
+
+    var recommendations struct {
+        ProductIDs []string `json:"product_ids"`
+    }
+    url := fmt.Sprintf("%s/api/search/recommendations/%s?limit=%d", config().SearchServiceURL, productID, RelatedProductsLimit)
+    if err := fetchJSON(ctx, config().RelatedTimeout, url, &recommendations); err != nil {
+        if errors.Is(err, errNotFound) {
+            return []map[string]interface{}{}, nil
+        }
+        return nil, err
+    }
+
+    related := make([]map[string]interface{}, len(recommendations.ProductIDs))
+    var wg sync.WaitGroup
+    for i, relatedID := range recommendations.ProductIDs {
+        wg.Add(1)
+        go func(i int, relatedID string) {
+            defer wg.Done()
+            var product map[string]interface{}
+            if err := fetchJSON(ctx, config().RelatedTimeout, fmt.Sprintf("%s/api/products/%s", config().ProductServiceURL, relatedID), &product); err == nil {
+                related[i] = product
+            }
+        }(i, relatedID)
+    }
+    wg.Wait()
+
+    // Drop products that could not be hydrated rather than failing the section
+    hydrated := []map[string]interface{}{}
+    for _, product := range related {
+        if product != nil {
+            hydrated = append(hydrated, product)
+        }
+    }
+
+    return hydrated, nil
+}
+
+// Health check endpoint
+func healthHandler(w http.ResponseWriter, r *http.Request) {
+    health := map[string]interface{}{
+        "status":    "healthy",
+        "service":   "gateway-service",
+        "timestamp": time.Now().Unix(),
+        "dependencies": map[string]string{
+            "product_service":   config().ProductServiceURL,
+            "inventory_service": config().InventoryServiceURL,
+            "search_service":    config().SearchServiceURL,
+            "review_service":    config().ReviewServiceURL,
+        },
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(health)
+}
+
+// Composed product page: catalog, availability, ratings and related products
+func storefrontProductHandler(w http.ResponseWriter, r *http.Request) {
+    vars := mux.Vars(r)
+    productID := vars["id"]
+    ctx := r.Context()
+
+    fetchers := map[string]func(context.Context, string) (interface{}, error){
+        DependencyCatalog:      fetchCatalog,
+        DependencyAvailability: fetchAvailability,
+        DependencyRatings:      fetchRatingSummary,
+        DependencyRelated:      fetchRelatedProducts,
+    }
+
+    results := make(map[string]dependencyResult)
+    var resultsMu sync.Mutex
+    var wg sync.WaitGroup
+
+    for name, fetch := range fetchers {
+        wg.Add(1)
+        go func(name string, fetch func(context.Context, string) (interface{}, error)) {
+            defer wg.Done()
+            result := callDependency(func() (interface{}, error) { return fetch(ctx, productID) })
+            resultsMu.Lock()
+            results[name] = result
+            resultsMu.Unlock()
+        }(name, fetch)
+    }
+    wg.Wait()
+
+    statsMu.Lock()
+    storefrontRequests++
+    statsMu.Unlock()
+
+    // The catalog entry is the only hard dependency
+    catalog := results[DependencyCatalog]
+    if catalog.Err != nil {
+        recordDependencyFailure(DependencyCatalog)
+        if errors.Is(catalog.Err, errNotFound) {
+            http.Error(w, "Product not found", http.StatusNotFound)
+            return
+        }
+        log.Printf("Catalog lookup failed for %s: %v", productID, catalog.Err)
+        http.Error(w, "Product catalog unavailable", http.StatusBadGateway)
+        return
+    }
+
+    response := StorefrontProductResponse{
+        Product:   catalog.Data.(map[string]interface{}),
+        Degraded:  make(map[string]string),
+        TimingsMs: make(map[string]int64),
+    }
+
+    for name, result := range results {
+        response.TimingsMs[name] = result.Duration.Milliseconds()
+        if name == DependencyCatalog {
+            continue
+        }
+        if result.Err != nil {
+            response.Degraded[name] = degradationReason(result.Err)
+            if !errors.Is(result.Err, errNotConfigured) {
+                recordDependencyFailure(name)
+                log.Printf("Storefront dependency %s failed for %s: %v", name, productID, result.Err)
+            }
+            continue
+        }
+
+        switch name {
+        case DependencyAvailability:
+            response.Availability = result.Data.(map[string]interface{})
+        case DependencyRatings:
+            response.RatingSummary = result.Data.(map[string]interface{})
+        case DependencyRelated:
+            response.RelatedProducts = result.Data.([]map[string]interface{})
+        }
+    }
+
+    if len(response.Degraded) > 0 {
+        response.Partial = true
+        statsMu.Lock()
+        partialResponses++
+        statsMu.Unlock()
+        w.Header().Set("X-Partial-Response", "true")
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(response)
+}
+
+// Helper function to describe why a section is missing
+func degradationReason(err error) string {
+    switch {
+    case errors.Is(err, errNotConfigured):
+        return "not_configured"
+    case errors.Is(err, errNotFound):
+        return "not_found"
+    case errors.Is(err, context.DeadlineExceeded):
+        return "timeout"
+    default:
+        return "unavailable"
+    }
+}
+
+func recordDependencyFailure(name string) {
+    statsMu.Lock()
+    dependencyFailures[name]++
+    statsMu.Unlock()
+}
+
+// Metrics endpoint
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+    statsMu.Lock()
+    requests := storefrontRequests
+    partial := partialResponses
+    failures := make(map[string]int)
+    for name, count := range dependencyFailures {
+        failures[name] = count
+    }
+    statsMu.Unlock()
+
+    limiterMu.Lock()
+    rateLimited := rateLimitedRequests
+    overQuota := quotaExceeded
+    limiterMu.Unlock()
+
+    keysMu.RLock()
+    keyCount := len(apiKeys)
+    keysMu.RUnlock()
+
+    metrics := fmt.Sprintf(`
+# HELP gateway_service_storefront_requests_total Total storefront product page requests
+# TYPE gateway_service_storefront_requests_total counter
+gateway_service_storefront_requests_total %d
+
+# HELP gateway_service_partial_responses_total Storefront responses served with degraded sections
+# TYPE gateway_service_partial_responses_total counter
+gateway_service_partial_responses_total %d
+
+# HELP gateway_service_dependency_failures_total Failed downstream calls by dependency
+# TYPE gateway_service_dependency_failures_total counter
+gateway_service_dependency_failures_total{dependency="catalog"} %d
+gateway_service_dependency_failures_total{dependency="availability"} %d
+gateway_service_dependency_failures_total{dependency="ratings"} %d
+gateway_service_dependency_failures_total{dependency="related"} %d
+
+# HELP gateway_service_rate_limited_requests_total Requests rejected by per-route rate limits
+# TYPE gateway_service_rate_limited_requests_total counter
+gateway_service_rate_limited_requests_total %d
+
+# HELP gateway_service_quota_exceeded_requests_total Requests rejected by per-key daily quotas
+# TYPE gateway_service_quota_exceeded_requests_total counter
+gateway_service_quota_exceeded_requests_total %d
+
+# HELP gateway_service_api_keys Number of issued API keys
+# TYPE gateway_service_api_keys gauge
+gateway_service_api_keys %d
+`, requests, partial,
+   failures[DependencyCatalog], failures[DependencyAvailability],
+   failures[DependencyRatings], failures[DependencyRelated],
+   rateLimited, overQuota, keyCount)
+
+    metrics += readiness.Metrics()
+    metrics += versioning.Metrics()
+    metrics += loadshed.Metrics()
+    metrics += slo.Metrics()
+    metrics += runtimemetrics.Text()
+
+    openmetrics.Write(w, r, metrics)
+}
+
+// Storefront API v1 routes
+func storefrontRoutesV1(api *mux.Router) {
+    api.HandleFunc("/products/{id}", storefrontProductHandler).Methods("GET")
+}
+
+func main() {
+    go liveConfig.Watch()
+    go readiness.Run(outbound.NewClient)
+
+    if err := loadAPIKeys(); err != nil {
+        log.Fatalf("Failed to load API keys %s: %v", keySnapshotPath, err)
+    }
+    go apiKeySnapshotLoop()
+
+    // Start rate window cleanup goroutine
+    go cleanupRateWindows()
+
+    router := mux.NewRouter()
+    router.Use(openmetrics.Observe)
+
+    // API routes (quota-enforced); anything not served here is proxied,
+    // versioned (/api/v1/...) or not, to the owning service
+    api := router.PathPrefix("/api").Subrouter()
+    api.Use(quotaMiddleware)
+    versioning.Mount(api, "/storefront", map[string]func(*mux.Router){
+        "v1": storefrontRoutesV1,
+    })
+    api.PathPrefix("/").HandlerFunc(proxyHandler)
+
+    // Admin routes
+    admin := router.PathPrefix("/admin").Subrouter()
+    admin.Use(adminauth.Middleware)
+    admin.HandleFunc("/api-keys", createAPIKeyHandler).Methods("POST")
+    admin.HandleFunc("/api-keys", listAPIKeysHandler).Methods("GET")
+    admin.HandleFunc("/api-keys/{keyId}", updateAPIKeyHandler).Methods("PUT")
+    admin.HandleFunc("/api-keys/{keyId}", revokeAPIKeyHandler).Methods("DELETE")
+    admin.HandleFunc("/config", liveConfig.Handler).Methods("GET")
+    admin.HandleFunc("/config/reload", liveConfig.ReloadHandler).Methods("POST")
+
+    // Utility routes
+    router.HandleFunc("/health", healthHandler).Methods("GET")
+    router.HandleFunc("/readyz", readiness.Handler).Methods("GET")
+    router.HandleFunc("/metrics", metricsHandler).Methods("GET")
+    router.HandleFunc("/slo", slo.Handler).Methods("GET")
+
+    // CORS policy from CORS_* settings; the gateway also exposes its rate
+    // limit and quota headers, and the order service's Duplicate-Of
+    c := corspolicy.New("X-RateLimit-Limit", "X-RateLimit-Remaining", "X-RateLimit-Reset", "X-Quota-Limit", "X-Quota-Remaining", "X-Quota-Reset", "Duplicate-Of")
+
+    handler := accesslog.Handler(serviceName, c.Handler(loadshed.Handler(router, nil)))
+
+    port := "8000"
+    log.Printf("Gateway service starting on port %s", port)
+    log.Printf("Access log: %s", accesslog.Settings())
+    log.Printf("Product service URL: %s", config().ProductServiceURL)
+    log.Printf("Inventory service URL: %s", config().InventoryServiceURL)
+    log.Printf("Search service URL: %s", config().SearchServiceURL)
+    log.Printf("Review service URL: %s", config().ReviewServiceURL)
+    log.Printf("API key required: %t, route limits: %v", config().RequireAPIKey, config().RouteLimits)
+
+    if err := httpserver.New(port, handler).ListenAndServe(); err != nil {
+        log.Fatal("Server failed to start:", err)
+    }
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+    "log"
+    "net/http"
+    "net/http/httputil"
+    "net/url"
+    "sort"
+    "strings"
+
+    "middleware/hotconfig"
+    "middleware/outbound"
+)
+
+// upstream routes a path prefix to a backend service
+type upstream struct {
+    prefix string
+    target *url.URL
+    proxy  *httputil.ReverseProxy
+}
+
+// Helper function to read a service URL from the configuration
+func serviceURL(name string, fallback string) string {
+    if value := configValue(name); value != "" {
+        return value
+    }
+    return fallback
+}
+
+// Build reverse proxies for every backend exposed through the gateway
+func buildUpstreams(cfg *serviceConfig) ([]upstream, error) {
+    routes := map[string]string{
+        "/api/products":      cfg.ProductServiceURL,
+        "/api/search":        cfg.SearchServiceURL,
+        "/api/inventory":     cfg.InventoryServiceURL,
+        "/api/cart":          cfg.CartServiceURL,
+        "/api/orders":        cfg.OrderServiceURL,
+        "/api/payments":      cfg.PaymentServiceURL,
+        "/api/notifications": cfg.NotificationServiceURL,
+        "/api/users":         cfg.UserServiceURL,
+    }
+
+    var upstreams []upstream
+    for prefix, rawURL := range routes {
+        if err := hotconfig.ValidateURL("upstream "+prefix, rawURL); err != nil {
+            return nil, err
+        }
+        target, _ := url.Parse(rawURL)
+
+        proxy := httputil.NewSingleHostReverseProxy(target)
+        proxy.Transport = outbound.Transport
+        // The gateway owns the CORS policy; drop the upstream's copies so
+        // browsers don't see duplicate Access-Control-* headers
+        proxy.ModifyResponse = func(resp *http.Response) error {
+            for header := range resp.Header {
+                if strings.HasPrefix(header, "Access-Control-") {
+                    resp.Header.Del(header)
+                }
+            }
+            return nil
+        }
+        proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+            log.Printf("Upstream request %s %s failed: %v", r.Method, r.URL.Path, err)
+            http.Error(w, "Upstream service unavailable", http.StatusBadGateway)
+        }
+
+        upstreams = append(upstreams, upstream{prefix: prefix, target: target, proxy: proxy})
+    }
+
+    sort.Slice(upstreams, func(i, j int) bool {
+        return len(upstreams[i].prefix) > len(upstreams[j].prefix)
+    })
+    return upstreams, nil
+}
+
+// Helper function to drop the version segment from /api/<version>/...
+// paths, so routing and rate limits treat every version of a resource
+// alike. The path forwarded upstream keeps its version.
+func unversionedPath(path string) string {
+    rest, found := strings.CutPrefix(path, "/api/v")
+    if !found {
+        return path
+    }
+    digits := 0
+    for digits < len(rest) && rest[digits] >= '0' && rest[digits] <= '9' {
+        digits++
+    }
+    if digits == 0 || (digits < len(rest) && rest[digits] != '/') {
+        return path
+    }
+    return "/api" + rest[digits:]
+}
+
+// Proxy handler: forwards /api requests to the owning service
+func proxyHandler(w http.ResponseWriter, r *http.Request) {
+    path := unversionedPath(r.URL.Path)
+    for _, u := range config().Upstreams {
+        if path == u.prefix || strings.HasPrefix(path, u.prefix+"/") {
+            u.proxy.ServeHTTP(w, r)
+            return
+        }
+    }
+
+    http.Error(w, "Not found", http.StatusNotFound)
+}
@@ -0,0 +1,477 @@
+package main
+
+import (
+    "crypto/rand"
+    "crypto/sha256"
+    "encoding/hex"
+    "encoding/json"
+    "fmt"
+    "log"
+    "net"
+    "net/http"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/google/uuid"
+    "github.com/gorilla/mux"
+)
+
+// APIKeyHeader carries the client's API key
+const APIKeyHeader = "X-API-Key"
+
+// Rate limit windows
+const (
+    RouteLimitWindow = time.Minute
+    QuotaWindow      = 24 * time.Hour
+)
+
+// APIKey identifies a client of the public API
+type APIKey struct {
+    KeyID      string `json:"key_id"`
+    Name       string `json:"name"`
+    Prefix     string `json:"prefix"` // first characters of the key, for identification
+    DailyQuota int    `json:"daily_quota"`
+    CreatedAt  int64  `json:"created_at"`
+    Revoked    bool   `json:"revoked"`
+    hash       string
+}
+
+// CreateAPIKeyRequest for issuing new API keys
+type CreateAPIKeyRequest struct {
+    Name       string `json:"name"`
+    DailyQuota int    `json:"daily_quota"`
+}
+
+// RouteLimit is a per-client request limit for a path prefix
+type RouteLimit struct {
+    Prefix string `json:"prefix"`
+    Limit  int    `json:"limit_per_minute"`
+}
+
+// rateWindow counts requests in a fixed window
+type rateWindow struct {
+    start time.Time
+    count int
+}
+
+// In-memory API key and limiter state
+var (
+    apiKeys      = make(map[string]*APIKey) // key hash -> key
+    apiKeyHashes = make(map[string]string)  // keyID -> key hash
+    keysMu       sync.RWMutex
+
+    routeWindows = make(map[string]*rateWindow) // client|route -> window
+    quotaWindows = make(map[string]*rateWindow) // keyID -> window
+    limiterMu    sync.Mutex
+
+    rateLimitedRequests int
+    quotaExceeded       int
+)
+
+// Search is cheap and browsed heavily; checkout and payments are capped much lower
+const defaultRouteLimits = "/api/search=600,/api/storefront=300,/api/products=300,/api/cart=120,/api/orders=30,/api/payments=30"
+
+// Helper function to read an integer from the configuration
+func intFromEnv(name string, fallback int) int {
+    value := configValue(name)
+    if value == "" {
+        return fallback
+    }
+
+    n, err := strconv.Atoi(value)
+    if err != nil || n <= 0 {
+        log.Printf("Invalid %s=%q, using default %d", name, value, fallback)
+        return fallback
+    }
+
+    return n
+}
+
+// Parse "prefix=limit,prefix=limit" into route limits, longest prefix first
+func parseRouteLimits(spec string) []RouteLimit {
+    if spec == "" {
+        spec = defaultRouteLimits
+    }
+
+    var limits []RouteLimit
+    for _, entry := range strings.Split(spec, ",") {
+        parts := strings.SplitN(strings.TrimSpace(entry), "=", 2)
+        if len(parts) != 2 {
+            continue
+        }
+        limit, err := strconv.Atoi(parts[1])
+        if err != nil || limit <= 0 {
+            log.Printf("Ignoring invalid route rate limit %q", entry)
+            continue
+        }
+        limits = append(limits, RouteLimit{Prefix: parts[0], Limit: limit})
+    }
+
+    sort.Slice(limits, func(i, j int) bool {
+        return len(limits[i].Prefix) > len(limits[j].Prefix)
+    })
+
+    return limits
+}
+
+// Helper function to find the rate limit that applies to a path; limits
+// are configured on unversioned prefixes and cover every API version
+func routeLimitFor(path string) RouteLimit {
+    path = unversionedPath(path)
+    cfg := config()
+    for _, limit := range cfg.RouteLimits {
+        if strings.HasPrefix(path, limit.Prefix) {
+            return limit
+        }
+    }
+    return RouteLimit{Prefix: "default", Limit: cfg.DefaultRouteLimit}
+}
+
+func hashAPIKey(key string) string {
+    sum := sha256.Sum256([]byte(key))
+    return hex.EncodeToString(sum[:])
+}
+
+func generateAPIKey() (string, error) {
+    buf := make([]byte, 24)
+    if _, err := rand.Read(buf); err != nil {
+        return "", err
+    }
+    return "gw_" + hex.EncodeToString(buf), nil
+}
+
+// Parse "ip,cidr,..." into the networks of trusted proxies; a bare IP
+// trusts that address only
+func parseTrustedProxies(spec string) ([]*net.IPNet, error) {
+    var networks []*net.IPNet
+    for _, entry := range strings.Split(spec, ",") {
+        entry = strings.TrimSpace(entry)
+        if entry == "" {
+            continue
+        }
+        if !strings.Contains(entry, "/") {
+            ip := net.ParseIP(entry)
+            if ip == nil {
+                return nil, fmt.Errorf("TRUSTED_PROXIES: %q is not an IP address or CIDR", entry)
+            }
+            bits := 8 * len(ip.To16())
+            if ip.To4() != nil {
+                ip, bits = ip.To4(), 32
+            }
+            networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+            continue
+        }
+        _, network, err := net.ParseCIDR(entry)
+        if err != nil {
+            return nil, fmt.Errorf("TRUSTED_PROXIES: %q is not an IP address or CIDR", entry)
+        }
+        networks = append(networks, network)
+    }
+    return networks, nil
+}
+
+// Helper function to check whether an address belongs to a trusted proxy
+func isTrustedProxy(address string) bool {
+    ip := net.ParseIP(address)
+    if ip == nil {
+        return false
+    }
+    for _, network := range config().TrustedProxies {
+        if network.Contains(ip) {
+            return true
+        }
+    }
+    return false
+}
+
+// Helper function to resolve the caller's identity for rate limiting.
+// X-Forwarded-For is only believed when the request came from a trusted
+// proxy; anyone else could pick a fresh address per request to dodge the
+// limits. Hops are read from the right, and the first one that isn't a
+// trusted proxy is the client.
+func clientIP(r *http.Request) string {
+    host, _, err := net.SplitHostPort(r.RemoteAddr)
+    if err != nil {
+        host = r.RemoteAddr
+    }
+    if !isTrustedProxy(host) {
+        return host
+    }
+
+    hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+    for i := len(hops) - 1; i >= 0; i-- {
+        hop := strings.TrimSpace(hops[i])
+        if hop == "" {
+            continue
+        }
+        if !isTrustedProxy(hop) {
+            return hop
+        }
+        host = hop
+    }
+    return host
+}
+
+// Count a request against a fixed window; returns remaining requests and reset time
+func takeFromWindow(windows map[string]*rateWindow, key string, limit int, size time.Duration, now time.Time) (int, time.Time, bool) {
+    start := now.Truncate(size)
+    window, exists := windows[key]
+    if !exists || !window.start.Equal(start) {
+        window = &rateWindow{start: start}
+        windows[key] = window
+    }
+
+    reset := start.Add(size)
+    if window.count >= limit {
+        return 0, reset, false
+    }
+
+    window.count++
+    return limit - window.count, reset, true
+}
+
+// Quota middleware: validates API keys, applies per-route limits and per-key
+// daily quotas, and reports the remaining budget on every response
+func quotaMiddleware(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if r.Method == "OPTIONS" {
+            next.ServeHTTP(w, r)
+            return
+        }
+
+        var key *APIKey
+        if rawKey := r.Header.Get(APIKeyHeader); rawKey != "" {
+            keysMu.RLock()
+            if stored, exists := apiKeys[hashAPIKey(rawKey)]; exists {
+                snapshot := *stored
+                key = &snapshot
+            }
+            keysMu.RUnlock()
+
+            if key == nil || key.Revoked {
+                http.Error(w, "Invalid API key", http.StatusUnauthorized)
+                return
+            }
+        } else if config().RequireAPIKey {
+            http.Error(w, "API key required", http.StatusUnauthorized)
+            return
+        }
+
+        client := "ip:" + clientIP(r)
+        if key != nil {
+            client = "key:" + key.KeyID
+        }
+
+        route := routeLimitFor(r.URL.Path)
+        now := time.Now()
+
+        limiterMu.Lock()
+        remaining, reset, allowed := takeFromWindow(routeWindows, client+"|"+route.Prefix, route.Limit, RouteLimitWindow, now)
+        quotaRemaining, quotaReset, quotaAllowed := 0, time.Time{}, true
+        if allowed && key != nil {
+            quotaRemaining, quotaReset, quotaAllowed = takeFromWindow(quotaWindows, key.KeyID, key.DailyQuota, QuotaWindow, now)
+            keySnapshotDirty.Store(true)
+        }
+        if !allowed {
+            rateLimitedRequests++
+        } else if !quotaAllowed {
+            quotaExceeded++
+        }
+        limiterMu.Unlock()
+
+        w.Header().Set("X-RateLimit-Limit", strconv.Itoa(route.Limit))
+        w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(remaining))
+        w.Header().Set("X-RateLimit-Reset", strconv.FormatInt(reset.Unix(), 10))
+        if key != nil {
+            w.Header().Set("X-Quota-Limit", strconv.Itoa(key.DailyQuota))
+            if allowed {
+                w.Header().Set("X-Quota-Remaining", strconv.Itoa(quotaRemaining))
+                w.Header().Set("X-Quota-Reset", strconv.FormatInt(quotaReset.Unix(), 10))
+            }
+        }
+
+        if !allowed {
+            w.Header().Set("Retry-After", strconv.Itoa(int(time.Until(reset).Seconds())+1))
+            http.Error(w, "Rate limit exceeded", http.StatusTooManyRequests)
+            return
+        }
+        if !quotaAllowed {
+            w.Header().Set("Retry-After", strconv.Itoa(int(time.Until(quotaReset).Seconds())+1))
+            http.Error(w, "Daily API quota exceeded", http.StatusTooManyRequests)
+            return
+        }
+
+        next.ServeHTTP(w, r)
+    })
+}
+
+// Create API key
+func createAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+    var req CreateAPIKeyRequest
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+        http.Error(w, "Invalid JSON", http.StatusBadRequest)
+        return
+    }
+
+    if req.Name == "" {
+        http.Error(w, "Name is required", http.StatusBadRequest)
+        return
+    }
+    if req.DailyQuota < 0 {
+        http.Error(w, "Daily quota must be positive", http.StatusBadRequest)
+        return
+    }
+    if req.DailyQuota == 0 {
+        req.DailyQuota = config().DefaultDailyQuota
+    }
+
+    rawKey, err := generateAPIKey()
+    if err != nil {
+        http.Error(w, "Failed to generate API key", http.StatusInternalServerError)
+        return
+    }
+
+    key := &APIKey{
+        KeyID:      uuid.New().String(),
+        Name:       req.Name,
+        Prefix:     rawKey[:10],
+        DailyQuota: req.DailyQuota,
+        CreatedAt:  time.Now().Unix(),
+        hash:       hashAPIKey(rawKey),
+    }
+
+    keysMu.Lock()
+    apiKeys[key.hash] = key
+    apiKeyHashes[key.KeyID] = key.hash
+    keysMu.Unlock()
+    persistAPIKeys()
+
+    // The raw key is only ever returned once
+    result := map[string]interface{}{
+        "api_key": rawKey,
+        "key":     key,
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(http.StatusCreated)
+    json.NewEncoder(w).Encode(result)
+}
+
+// List API keys with today's usage
+func listAPIKeysHandler(w http.ResponseWriter, r *http.Request) {
+    keysMu.RLock()
+    keys := make([]APIKey, 0, len(apiKeys))
+    for _, key := range apiKeys {
+        keys = append(keys, *key)
+    }
+    keysMu.RUnlock()
+
+    sort.Slice(keys, func(i, j int) bool {
+        return keys[i].CreatedAt < keys[j].CreatedAt
+    })
+
+    today := time.Now().Truncate(QuotaWindow)
+    usage := make(map[string]int)
+    limiterMu.Lock()
+    for _, key := range keys {
+        if window, exists := quotaWindows[key.KeyID]; exists && window.start.Equal(today) {
+            usage[key.KeyID] = window.count
+        }
+    }
+    limiterMu.Unlock()
+
+    result := map[string]interface{}{
+        "keys":         keys,
+        "usage_today":  usage,
+        "total":        len(keys),
+        "route_limits": config().RouteLimits,
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(result)
+}
+
+// Update an API key's quota
+func updateAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+    vars := mux.Vars(r)
+    keyID := vars["keyId"]
+
+    var req CreateAPIKeyRequest
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+        http.Error(w, "Invalid JSON", http.StatusBadRequest)
+        return
+    }
+
+    if req.DailyQuota <= 0 {
+        http.Error(w, "Daily quota must be positive", http.StatusBadRequest)
+        return
+    }
+
+    keysMu.Lock()
+    hash, exists := apiKeyHashes[keyID]
+    if !exists {
+        keysMu.Unlock()
+        http.Error(w, "API key not found", http.StatusNotFound)
+        return
+    }
+    key := apiKeys[hash]
+    key.DailyQuota = req.DailyQuota
+    if req.Name != "" {
+        key.Name = req.Name
+    }
+    updated := *key
+    keysMu.Unlock()
+    persistAPIKeys()
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(updated)
+}
+
+// Revoke an API key
+func revokeAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+    vars := mux.Vars(r)
+    keyID := vars["keyId"]
+
+    keysMu.Lock()
+    hash, exists := apiKeyHashes[keyID]
+    if !exists {
+        keysMu.Unlock()
+        http.Error(w, "API key not found", http.StatusNotFound)
+        return
+    }
+    apiKeys[hash].Revoked = true
+    keysMu.Unlock()
+    persistAPIKeys()
+
+    result := map[string]string{
+        "message": "API key revoked",
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(result)
+}
+
+// Background task to drop rate windows that have already reset
+func cleanupRateWindows() {
+    ticker := time.NewTicker(5 * time.Minute)
+    defer ticker.Stop()
+
+    for range ticker.C {
+        now := time.Now()
+        limiterMu.Lock()
+        for key, window := range routeWindows {
+            if now.Sub(window.start) > RouteLimitWindow {
+                delete(routeWindows, key)
+            }
+        }
+        for key, window := range quotaWindows {
+            if now.Sub(window.start) > QuotaWindow {
+                delete(quotaWindows, key)
+            }
+        }
+        limiterMu.Unlock()
+    }
+}
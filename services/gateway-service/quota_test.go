@@ -0,0 +1,50 @@
+package main
+
+import (
+    "net/http/httptest"
+    "testing"
+)
+
+func TestClientIP(t *testing.T) {
+    trusted, err := parseTrustedProxies("10.0.0.0/8, 192.168.1.5")
+    if err != nil {
+        t.Fatalf("parseTrustedProxies: %v", err)
+    }
+    cfg := *config()
+    cfg.TrustedProxies = trusted
+    previous := liveConfig.Set(&cfg)
+    defer liveConfig.Set(previous)
+
+    tests := []struct {
+        name      string
+        remote    string
+        forwarded []string
+        want      string
+    }{
+        {"direct", "203.0.113.7:4000", nil, "203.0.113.7"},
+        {"untrusted peer is not believed", "203.0.113.7:4000", []string{"198.51.100.1"}, "203.0.113.7"},
+        {"trusted proxy", "10.1.2.3:4000", []string{"198.51.100.1"}, "198.51.100.1"},
+        {"spoofed hops left of the proxy chain", "10.1.2.3:4000", []string{"1.2.3.4, 198.51.100.1, 192.168.1.5"}, "198.51.100.1"},
+        {"repeated headers", "192.168.1.5:4000", []string{"1.2.3.4", "198.51.100.1"}, "198.51.100.1"},
+        {"only proxies", "10.1.2.3:4000", []string{"10.9.9.9"}, "10.9.9.9"},
+        {"trusted proxy without the header", "10.1.2.3:4000", nil, "10.1.2.3"},
+    }
+    for _, tt := range tests {
+        r := httptest.NewRequest("GET", "/api/products", nil)
+        r.RemoteAddr = tt.remote
+        for _, value := range tt.forwarded {
+            r.Header.Add("X-Forwarded-For", value)
+        }
+        if got := clientIP(r); got != tt.want {
+            t.Errorf("%s: clientIP = %q, want %q", tt.name, got, tt.want)
+        }
+    }
+}
+
+func TestParseTrustedProxiesRejectsGarbage(t *testing.T) {
+    for _, spec := range []string{"proxy.local", "10.0.0.0/33", "10.0.0.1,10.0.0"} {
+        if _, err := parseTrustedProxies(spec); err == nil {
+            t.Errorf("parseTrustedProxies(%q) succeeded, want an error", spec)
+        }
+    }
+}
@@ -0,0 +1,28 @@
+package main
+
+import "middleware/readiness"
+
+func init() {
+    readiness.Setup(serviceName, readinessDependencies, nil)
+}
+
+// Dependencies probed for readiness. All are optional: the gateway fronts
+// every route, so one backend being down must not take the others out of
+// rotation. The statuses still show which upstreams are failing.
+func readinessDependencies() []readiness.Dependency {
+    cfg := config()
+    deps := []readiness.Dependency{
+        {Name: "product", URL: func() string { return config().ProductServiceURL }},
+        {Name: "inventory", URL: func() string { return config().InventoryServiceURL }},
+        {Name: "search", URL: func() string { return config().SearchServiceURL }},
+        {Name: "cart", URL: func() string { return config().CartServiceURL }},
+        {Name: "order", URL: func() string { return config().OrderServiceURL }},
+        {Name: "payment", URL: func() string { return config().PaymentServiceURL }},
+        {Name: "notification", URL: func() string { return config().NotificationServiceURL }},
+        {Name: "user", URL: func() string { return config().UserServiceURL }},
+    }
+    if cfg.ReviewServiceURL != "" {
+        deps = append(deps, readiness.Dependency{Name: "review", URL: func() string { return config().ReviewServiceURL }})
+    }
+    return deps
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+    "time"
+
+    "middleware/slo"
+)
+
+func init() {
+    slo.Setup(serviceName, serviceObjectives(), nil)
+}
+
+// SLOs for the gateway. Storefront pages fan out to several services, so
+// the latency target covers the slowest of them; proxied calls count
+// toward availability only.
+func serviceObjectives() []slo.Objective {
+    return []slo.Objective{
+        {
+            Name:        "storefront_latency",
+            Description: "99% of storefront product pages render within 1s",
+            Method:      "GET",
+            Route:       "/api/storefront/products/{id}",
+            Target:      0.99,
+            Latency:     time.Second,
+        },
+        {
+            Name:        "availability",
+            Description: "99.9% of requests succeed",
+            Target:      0.999,
+        },
+    }
+}
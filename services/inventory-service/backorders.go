@@ -0,0 +1,142 @@
+package main
+
+import (
+    "encoding/json"
+    "errors"
+    "log"
+    "net/http"
+    "sort"
+    "time"
+
+    "github.com/google/uuid"
+)
+
+// Backorders. A reservation no one warehouse can cover is refused, unless
+// the request opts in with "backorder": true. It is then kept as
+// backordered, without taking any stock, at the warehouse_id asked for, or
+// else the first warehouse in ship_to_country, or else the first in
+// WAREHOUSES. It is expected BACKORDER_LEAD_DAYS (reloadable) after it was
+// made. Whenever stock at that warehouse is added or put back (stock
+// changes, releases, expiry, order releases), its backorders are filled
+// oldest first: each becomes an ordinary reservation, held for
+// RESERVATION_TTL_SECONDS from the fill. A backorder is filled in full or
+// not at all, and one that doesn't fit yet holds up those behind it.
+// Backorders can be released like reservations, but are only committed
+// once filled. inventory.backordered and inventory.backorder_filled
+// events announce them (see events.go), so carts and orders can show
+// when the stock is expected.
+const DefaultBackorderLeadDays = 14
+
+// Helper function to choose the warehouse to backorder at: the first
+// configured warehouse in shipTo, else the first configured
+func backorderWarehouse(shipTo string) string {
+    warehouses := config().Warehouses
+    for _, warehouse := range warehouses {
+        if shipTo != "" && warehouse.Country == shipTo {
+            return warehouse.WarehouseID
+        }
+    }
+    return warehouses[0].WarehouseID
+}
+
+// Helper function to backorder a reservation the stock can't cover.
+// Callers must hold mu and have validated the request.
+func backorder(w http.ResponseWriter, r *http.Request, req ReservationRequest) {
+    warehouseID := req.WarehouseID
+    if warehouseID == "" {
+        warehouseID = backorderWarehouse(req.ShipToCountry)
+    }
+
+    now := time.Now()
+    reservationID := uuid.New().String()
+    expectedAt := now.AddDate(0, 0, config().BackorderLeadDays).Unix()
+    err := logAndApply(walEntry{
+        Op:            OpBackorder,
+        Timestamp:     now.Unix(),
+        ProductID:     req.ProductID,
+        Quantity:      req.Quantity,
+        ReservationID: reservationID,
+        ReferenceType: req.ReferenceType,
+        Reference:     req.Reference,
+        ExpectedAt:    expectedAt,
+        QueuedAt:      now.UnixNano(),
+        WarehouseID:   warehouseID,
+        Actor:         requestActor(r),
+    })
+    if err != nil {
+        http.Error(w, "Failed to persist backorder", http.StatusInternalServerError)
+        return
+    }
+    emitBackorderEvent(EventBackordered, reservations[reservationID])
+
+    response := map[string]interface{}{
+        "success":        true,
+        "reservation_id": reservationID,
+        "message":        "Stock backordered; the reservation is filled when it arrives",
+        "status":         "backordered",
+        "expected_at":    expectedAt,
+        "warehouse_id":   warehouseID,
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(http.StatusAccepted)
+    json.NewEncoder(w).Encode(response)
+}
+
+// Helper function to fill a product's backorders from the stock available
+// at their warehouses, oldest first. Backorders left waiting are tried
+// again on the next change that frees stock. Callers must hold mu.
+func fillBackorders(productID string) {
+    var waiting []Reservation
+    for _, reservation := range reservations {
+        if reservation.ProductID == productID && reservation.Status == "backordered" {
+            waiting = append(waiting, reservation)
+        }
+    }
+    if len(waiting) == 0 {
+        return
+    }
+    sort.Slice(waiting, func(i, j int) bool {
+        if waiting[i].QueuedAt != waiting[j].QueuedAt {
+            return waiting[i].QueuedAt < waiting[j].QueuedAt
+        }
+        return waiting[i].ReservationID < waiting[j].ReservationID
+    })
+
+    now := time.Now()
+    blocked := make(map[string]bool) // warehouses whose oldest backorder doesn't fit
+    for _, reservation := range waiting {
+        warehouseID := warehouseOf(reservation.WarehouseID)
+        if blocked[warehouseID] {
+            continue
+        }
+        if itemLocations(inventory[productID])[warehouseID].Available < reservation.Quantity {
+            blocked[warehouseID] = true
+            continue
+        }
+
+        err := logAndApply(walEntry{
+            Op:            OpFill,
+            Timestamp:     now.Unix(),
+            ProductID:     productID,
+            Quantity:      reservation.Quantity,
+            WarehouseID:   warehouseID,
+            ReservationID: reservation.ReservationID,
+            ExpiresAt:     now.Add(config().ReservationTTL).Unix(),
+            Actor:         ActorSystem,
+        })
+        if errors.Is(err, errStockChanged) {
+            // Memory now has the stored records. A backorder still waiting
+            // didn't fit after all, so it holds up the rest as before.
+            if reservations[reservation.ReservationID].Status == "backordered" {
+                blocked[warehouseID] = true
+            }
+            continue
+        }
+        if err != nil {
+            log.Printf("Failed to fill backorder %s: %v", reservation.ReservationID, err)
+            return
+        }
+        emitBackorderEvent(EventBackorderFilled, reservations[reservation.ReservationID])
+    }
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "log"
+    "net/http"
+    "time"
+
+    "middleware/adminauth"
+    "middleware/backup"
+    "middleware/httpserver"
+)
+
+// Admin endpoint to stream every stock record and reservation as a backup
+func backupInventoryHandler(w http.ResponseWriter, r *http.Request) {
+    // Copy under the lock so stock counts and reservations in the backup
+    // agree with each other
+    mu.RLock()
+    items := make([]InventoryItem, 0, len(inventory))
+    for _, item := range inventory {
+        items = append(items, item)
+    }
+    reservationList := make([]Reservation, 0, len(reservations))
+    for _, reservation := range reservations {
+        reservationList = append(reservationList, reservation)
+    }
+    mu.RUnlock()
+
+    writer := backup.NewWriter(w)
+    for _, item := range items {
+        if err := writer.Write("inventory_item", item.ProductID, item); err != nil {
+            log.Printf("Backup aborted after %d records: %v", writer.Count(), err)
+            return
+        }
+    }
+    for _, reservation := range reservationList {
+        if err := writer.Write("reservation", reservation.ReservationID, reservation); err != nil {
+            log.Printf("Backup aborted after %d records: %v", writer.Count(), err)
+            return
+        }
+    }
+
+    adminauth.Audit(r, "backup", map[string]interface{}{"records": writer.Count()})
+}
+
+// Admin endpoint to import stock records and reservations from a backup.
+// Records are restored as-is (stock counts already include their
+// reservations), each through the WAL so the restore survives a restart.
+func restoreInventoryHandler(w http.ResponseWriter, r *http.Request) {
+    policy, ok := backup.ParseConflictPolicy(w, r)
+    if !ok {
+        return
+    }
+
+    httpserver.LiftDeadlines(w)
+    records, err := backup.Read(r.Body)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+
+    entries := make([]walEntry, 0, len(records))
+    for _, record := range records {
+        entry := walEntry{Op: OpRestore, Timestamp: time.Now().Unix()}
+        switch record.Type {
+        case "inventory_item":
+            var item InventoryItem
+            if err := json.Unmarshal(record.Data, &item); err != nil || item.ProductID == "" {
+                http.Error(w, fmt.Sprintf("Invalid inventory record %q", record.ID), http.StatusBadRequest)
+                return
+            }
+            entry.Item = &item
+        case "reservation":
+            var reservation Reservation
+            if err := json.Unmarshal(record.Data, &reservation); err != nil || reservation.ReservationID == "" {
+                http.Error(w, fmt.Sprintf("Invalid reservation record %q", record.ID), http.StatusBadRequest)
+                return
+            }
+            entry.Reservation = &reservation
+        default:
+            http.Error(w, fmt.Sprintf("Unknown record type %q", record.Type), http.StatusBadRequest)
+            return
+        }
+        entries = append(entries, entry)
+    }
+
+    mu.Lock()
+    defer mu.Unlock()
+
+    var result backup.Result
+    actions := make([]string, len(entries))
+    for i, entry := range entries {
+        if entry.Item != nil {
+            existing, exists := inventory[entry.Item.ProductID]
+            actions[i] = result.Classify(policy, entry.Item.ProductID, exists, existing, *entry.Item)
+        } else {
+            existing, exists := reservations[entry.Reservation.ReservationID]
+            actions[i] = result.Classify(policy, entry.Reservation.ReservationID, exists, existing, *entry.Reservation)
+        }
+    }
+
+    if result.Applies(policy) {
+        for i, entry := range entries {
+            if actions[i] != backup.ActionCreate && actions[i] != backup.ActionUpdate {
+                continue
+            }
+            entry.Actor = ActorAdmin
+            if err := logAndApply(entry); err != nil {
+                http.Error(w, "Failed to persist restore", http.StatusInternalServerError)
+                return
+            }
+        }
+    }
+
+    backup.WriteResult(w, r, policy, result)
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+    "fmt"
+    "log"
+    "strconv"
+    "time"
+
+    "middleware/adminauth"
+    "middleware/hotconfig"
+)
+
+// Reloadable settings; see pkg/middleware/hotconfig. Everything else is
+// read once at startup.
+var liveConfig *hotconfig.Config[serviceConfig]
+
+func init() {
+    liveConfig = hotconfig.New(loadConfig, (*serviceConfig).settings)
+    liveConfig.Audit = adminauth.Audit
+    if err := liveConfig.Load(); err != nil {
+        log.Fatalf("Invalid configuration: %v", err)
+    }
+}
+
+// Helper function to get the live configuration
+func config() *serviceConfig {
+    return liveConfig.Get()
+}
+
+// Helper function to read a setting, preferring CONFIG_FILE over the
+// environment. Only valid while building a configuration.
+func configValue(name string) string {
+    return liveConfig.Value(name)
+}
+
+// serviceConfig holds the inventory service's reloadable settings
+type serviceConfig struct {
+    ReservationTTL    time.Duration // lifetime of new reservations
+    Warehouses        []Warehouse   // in order of preference; see warehouses.go
+    BackorderLeadDays int           // until backordered stock is expected; see backorders.go
+    EventsURL         string        // receives inventory events; "" disables them
+}
+
+// Helper function to load the reloadable settings. Called by liveConfig
+// while it builds a configuration, so configValue sees the current
+// CONFIG_FILE.
+func loadConfig() (*serviceConfig, error) {
+    cfg := &serviceConfig{
+        ReservationTTL:    ReservationTimeout,
+        BackorderLeadDays: DefaultBackorderLeadDays,
+        EventsURL:         configValue("INVENTORY_EVENTS_URL"),
+    }
+
+    if value := configValue("RESERVATION_TTL_SECONDS"); value != "" {
+        seconds, err := strconv.Atoi(value)
+        if err != nil || seconds <= 0 {
+            return nil, fmt.Errorf("RESERVATION_TTL_SECONDS=%q must be a positive number of seconds", value)
+        }
+        cfg.ReservationTTL = time.Duration(seconds) * time.Second
+    }
+
+    warehouses := configValue("WAREHOUSES")
+    if warehouses == "" {
+        warehouses = DefaultWarehouses
+    }
+    var err error
+    if cfg.Warehouses, err = parseWarehouses(warehouses); err != nil {
+        return nil, err
+    }
+
+    if value := configValue("BACKORDER_LEAD_DAYS"); value != "" {
+        days, err := strconv.Atoi(value)
+        if err != nil || days < 0 {
+            return nil, fmt.Errorf("BACKORDER_LEAD_DAYS=%q must be a non-negative number of days", value)
+        }
+        cfg.BackorderLeadDays = days
+    }
+
+    if cfg.EventsURL != "" {
+        if err := hotconfig.ValidateURL("INVENTORY_EVENTS_URL", cfg.EventsURL); err != nil {
+            return nil, err
+        }
+    }
+    return cfg, nil
+}
+
+// Helper function to list the settings for display and diffing
+func (cfg *serviceConfig) settings() map[string]string {
+    return map[string]string{
+        "RESERVATION_TTL_SECONDS": strconv.Itoa(int(cfg.ReservationTTL / time.Second)),
+        "WAREHOUSES":              formatWarehouses(cfg.Warehouses),
+        "BACKORDER_LEAD_DAYS":     strconv.Itoa(cfg.BackorderLeadDays),
+        "INVENTORY_EVENTS_URL":    cfg.EventsURL,
+    }
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+    "bytes"
+    "encoding/json"
+    "fmt"
+    "log"
+    "net/http"
+    "os"
+    "sync/atomic"
+    "time"
+
+    "events"
+    "github.com/google/uuid"
+    "middleware/outbound"
+    "webhooks"
+)
+
+// Inventory events, POSTed as {"events": [...]} to INVENTORY_EVENTS_URL
+// (reloadable; "" sends none): the backorder events (see backorders.go)
+// and low-stock alerts (see thresholds.go). Events wait in memory and one
+// goroutine sends them in order, retrying a failed batch with backoff;
+// they are lost if the service stops first, or when more than
+// EventQueueSize are waiting. Events are pkg/events envelopes at the
+// package's current schema version for their type, with events.Backorder
+// and events.LowStock payloads.
+const (
+    EventBackordered     = events.TypeBackordered
+    EventBackorderFilled = events.TypeBackorderFilled
+    EventLowStock        = events.TypeLowStock
+)
+
+// Delivery settings
+const (
+    EventQueueSize        = 1000
+    EventBatchSize        = 100
+    EventDeliveryAttempts = 5
+    EventRetryBackoff     = time.Second // doubled after each failed attempt
+)
+
+// Events are signed like order events, with pkg/webhooks: X-Signature:
+// t=<unix seconds>,v1=<hex HMAC-SHA256 of "<t>.<body>"> with
+// INVENTORY_EVENTS_SECRET, so subscribers can verify them with the same
+// package. Unset sends them unsigned.
+var inventoryEventsSecret = os.Getenv("INVENTORY_EVENTS_SECRET")
+
+// Event delivery. Events are queued encoded, whatever their type.
+var (
+    eventQueue      = make(chan json.RawMessage, EventQueueSize)
+    eventClient     = outbound.NewClient(5 * time.Second)
+    eventsDelivered atomic.Int64
+    eventsFailed    atomic.Int64
+    eventsDropped   atomic.Int64
+)
+
+// Helper function to build an event ID. IDs are derived from what the
+// event is about (the reservation of a backorder event, the product and
+// the moment it fell below its threshold for a low-stock alert), so a
+// repeated event carries the same one and consumers can deduplicate.
+func inventoryEventID(eventType string, subject string) string {
+    return uuid.NewSHA1(uuid.NameSpaceURL, []byte("inventory-event:"+subject+":"+eventType)).String()
+}
+
+// Helper function to queue an event, when events are sent anywhere.
+// subject names what it is about in logs.
+func queueEvent(eventType string, subject string, eventID string, occurredAt int64, payload interface{}) {
+    if config().EventsURL == "" {
+        return
+    }
+    event, err := events.New(eventType, eventID, occurredAt, "", payload)
+    if err != nil {
+        log.Printf("Failed to build %s for %s: %v", eventType, subject, err)
+        return
+    }
+    data, err := json.Marshal(event)
+    if err != nil {
+        log.Printf("Failed to encode %s for %s: %v", eventType, subject, err)
+        return
+    }
+
+    select {
+    case eventQueue <- data:
+    default:
+        eventsDropped.Add(1)
+        log.Printf("Event queue full, dropped %s for %s", eventType, subject)
+    }
+}
+
+// Helper function to queue an event about a backorder
+func emitBackorderEvent(eventType string, reservation Reservation) {
+    occurredAt := reservation.CreatedAt
+    if eventType == EventBackorderFilled {
+        occurredAt = reservation.FilledAt
+    }
+    payload := events.Backorder{
+        ReservationID: reservation.ReservationID,
+        ProductID:     reservation.ProductID,
+        Quantity:      reservation.Quantity,
+        WarehouseID:   warehouseOf(reservation.WarehouseID),
+        ReferenceType: reservation.ReferenceType,
+        Reference:     reservation.Reference,
+        CartID:        reservation.CartID,
+        Status:        reservation.Status,
+        ExpectedAt:    reservation.ExpectedAt,
+        FilledAt:      reservation.FilledAt,
+    }
+    if reservation.Status == "reserved" {
+        // When the filled backorder lapses unless committed
+        payload.ExpiresAt = reservation.ExpiresAt
+    }
+    queueEvent(eventType, "reservation "+reservation.ReservationID, inventoryEventID(eventType, reservation.ReservationID), occurredAt, payload)
+}
+
+// Background task to send queued events in batches
+func deliverInventoryEvents() {
+    for event := range eventQueue {
+        batch := []json.RawMessage{event}
+    collect:
+        for len(batch) < EventBatchSize {
+            select {
+            case next := <-eventQueue:
+                batch = append(batch, next)
+            default:
+                break collect
+            }
+        }
+
+        backoff := EventRetryBackoff
+        for attempt := 1; ; attempt++ {
+            err := postInventoryEvents(batch)
+            if err == nil {
+                eventsDelivered.Add(int64(len(batch)))
+                break
+            }
+            if attempt == EventDeliveryAttempts {
+                eventsFailed.Add(int64(len(batch)))
+                log.Printf("Gave up sending %d events after %d attempts: %v", len(batch), attempt, err)
+                break
+            }
+            time.Sleep(backoff)
+            backoff *= 2
+        }
+    }
+}
+
+// Helper function to POST a batch of events to INVENTORY_EVENTS_URL
+func postInventoryEvents(events []json.RawMessage) error {
+    sinkURL := config().EventsURL
+    if sinkURL == "" {
+        return nil
+    }
+
+    body, err := json.Marshal(map[string]interface{}{"events": events})
+    if err != nil {
+        return err
+    }
+    req, err := http.NewRequest(http.MethodPost, sinkURL, bytes.NewReader(body))
+    if err != nil {
+        return err
+    }
+    req.Header.Set("Content-Type", "application/json")
+    if inventoryEventsSecret != "" {
+        req.Header.Set(webhooks.SignatureHeader, webhooks.Sign(inventoryEventsSecret, time.Now(), body))
+    }
+
+    resp, err := eventClient.Do(req)
+    if err != nil {
+        return err
+    }
+    resp.Body.Close()
+    if resp.StatusCode >= 300 {
+        return fmt.Errorf("event sink returned status %d", resp.StatusCode)
+    }
+    return nil
+}
+
+// Helper function to render the event delivery metrics
+func inventoryEventMetrics() string {
+    return fmt.Sprintf(`
+# HELP inventory_service_events_delivered_total Events delivered to INVENTORY_EVENTS_URL
+# TYPE inventory_service_events_delivered_total counter
+inventory_service_events_delivered_total %d
+
+# HELP inventory_service_events_failed_total Events given up on after every delivery attempt failed
+# TYPE inventory_service_events_failed_total counter
+inventory_service_events_failed_total %d
+
+# HELP inventory_service_events_dropped_total Events dropped because the queue was full
+# TYPE inventory_service_events_dropped_total counter
+inventory_service_events_dropped_total %d
+`, eventsDelivered.Load(), eventsFailed.Load(), eventsDropped.Load())
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+    "encoding/json"
+    "net/http"
+
+    "middleware/adminauth"
+)
+
+// FixtureTimestamp is used for every fixture's update time so fixture
+// responses are byte-for-byte stable between runs (2024-01-01T00:00:00Z)
+const FixtureTimestamp = 1704067200
+
+// Fixture stock for end-to-end suites, matching the fixture products in
+// product-service. test-prod-4 and test-prod-5 are low-stock.
+var fixtureStock = []struct {
+    ProductID string
+    Stock     int
+}{
+    {"test-prod-1", 100},
+    {"test-prod-2", 50},
+    {"test-prod-3", 200},
+    {"test-prod-4", 2},
+    {"test-prod-5", 1},
+}
+
+// Helper function to replace all test stock with the fixture set. Stock
+// records are written whole through the WAL, so they replay identically.
+// Returns how many test products were removed first.
+func loadFixtures() (int, error) {
+    mu.Lock()
+    defer mu.Unlock()
+
+    removed, err := clearTestInventory()
+    if err != nil {
+        return removed, err
+    }
+
+    for _, fixture := range fixtureStock {
+        err := logAndApply(walEntry{
+            Op:        OpRestore,
+            Timestamp: FixtureTimestamp,
+            Item: &InventoryItem{
+                ProductID:   fixture.ProductID,
+                Available:   fixture.Stock,
+                TotalStock:  fixture.Stock,
+                LastUpdated: FixtureTimestamp,
+            },
+            Actor: ActorAdmin,
+        })
+        if err != nil {
+            return removed, err
+        }
+    }
+    return removed, nil
+}
+
+// Admin endpoint to (re)load the fixture stock. Other test stock and all
+// reservations against test products are removed, so every run starts
+// from the same levels.
+func loadFixturesHandler(w http.ResponseWriter, r *http.Request) {
+    removed, err := loadFixtures()
+    if err != nil {
+        http.Error(w, "Failed to persist fixtures", http.StatusInternalServerError)
+        return
+    }
+    adminauth.Audit(r, "fixtures_load", map[string]interface{}{"removed": removed, "products": len(fixtureStock)})
+
+    result := map[string]interface{}{
+        "message": "Fixtures loaded",
+        "removed": removed,
+        "loaded":  map[string]int{"products": len(fixtureStock)},
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(result)
+}
+
+// Admin endpoint to remove fixtures and any other test stock
+func resetFixturesHandler(w http.ResponseWriter, r *http.Request) {
+    mu.Lock()
+    removed, err := clearTestInventory()
+    mu.Unlock()
+    if err != nil {
+        http.Error(w, "Failed to persist reset", http.StatusInternalServerError)
+        return
+    }
+    adminauth.Audit(r, "fixtures_reset", map[string]interface{}{"removed": removed})
+
+    result := map[string]interface{}{
+        "message": "Fixtures reset",
+        "removed": removed,
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(result)
+}
@@ -3,7 +3,17 @@ module inventory-service
 go 1.21
 
 require (
+    events v0.0.0-00010101000000-000000000000
     github.com/google/uuid v1.4.0
     github.com/gorilla/mux v1.8.1
-    github.com/rs/cors v1.10.1
-)
\ No newline at end of file
+    middleware v0.0.0-00010101000000-000000000000
+    webhooks v0.0.0-00010101000000-000000000000
+)
+
+require github.com/rs/cors v1.10.1 // indirect
+
+replace (
+    events => ../../pkg/events
+    middleware => ../../pkg/middleware
+    webhooks => ../../pkg/webhooks
+)
@@ -0,0 +1,156 @@
+package main
+
+import (
+    "encoding/base64"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "net/http"
+    "sort"
+    "strconv"
+    "strings"
+)
+
+// Inventory listing pages. Pages are cut with a keyset cursor (the sort key
+// and product ID of the last item served), so stock changing between
+// requests never skips or repeats the items that didn't move.
+const (
+    DefaultInventoryPageSize = 100
+    MaxInventoryPageSize     = 1000
+)
+
+// Listing sort orders. Ties are always broken by product ID.
+var inventorySorts = map[string]func(item InventoryItem) int64{
+    "product_id_asc":    nil,
+    "available_asc":     func(item InventoryItem) int64 { return int64(item.Available) },
+    "available_desc":    func(item InventoryItem) int64 { return int64(item.Available) },
+    "reserved_asc":      func(item InventoryItem) int64 { return int64(item.Reserved) },
+    "reserved_desc":     func(item InventoryItem) int64 { return int64(item.Reserved) },
+    "last_updated_asc":  func(item InventoryItem) int64 { return item.LastUpdated },
+    "last_updated_desc": func(item InventoryItem) int64 { return item.LastUpdated },
+}
+
+// inventoryCursor is the position after the last item of a page, handed
+// to clients as opaque base64url JSON
+type inventoryCursor struct {
+    Sort      string `json:"s"`
+    Key       int64  `json:"k,omitempty"`
+    ProductID string `json:"p"`
+}
+
+// inventoryQuery is a parsed listing request
+type inventoryQuery struct {
+    Limit          int
+    Sort           string
+    After          *inventoryCursor
+    BelowThreshold int // only items with fewer available; 0 disables
+    ProductPrefix  string
+    Warehouse      string // only items stocked there; BelowThreshold then counts its stock
+}
+
+// Helper function to parse listing parameters
+func parseInventoryQuery(r *http.Request) (inventoryQuery, error) {
+    params := r.URL.Query()
+    query := inventoryQuery{Limit: DefaultInventoryPageSize, Sort: "product_id_asc"}
+
+    if value := params.Get("limit"); value != "" {
+        limit, err := strconv.Atoi(value)
+        if err != nil || limit <= 0 || limit > MaxInventoryPageSize {
+            return query, fmt.Errorf("limit must be between 1 and %d", MaxInventoryPageSize)
+        }
+        query.Limit = limit
+    }
+
+    if value := params.Get("sort"); value != "" {
+        if _, exists := inventorySorts[value]; !exists {
+            return query, errors.New("sort must be product_id_asc, available_asc, available_desc, reserved_asc, reserved_desc, last_updated_asc or last_updated_desc")
+        }
+        query.Sort = value
+    }
+
+    if value := params.Get("cursor"); value != "" {
+        var cursor inventoryCursor
+        data, err := base64.RawURLEncoding.DecodeString(value)
+        if err != nil || json.Unmarshal(data, &cursor) != nil {
+            return query, errors.New("invalid cursor")
+        }
+        if cursor.Sort != query.Sort {
+            return query, errors.New("cursor belongs to a different sort order")
+        }
+        query.After = &cursor
+    }
+
+    if value := params.Get("below_threshold"); value != "" {
+        threshold, err := strconv.Atoi(value)
+        if err != nil || threshold <= 0 {
+            return query, errors.New("below_threshold must be a positive number")
+        }
+        query.BelowThreshold = threshold
+    }
+    query.ProductPrefix = params.Get("product_id_prefix")
+    query.Warehouse = params.Get("warehouse")
+    return query, nil
+}
+
+// Helper function to check an item against the listing filters
+func (query inventoryQuery) matches(item InventoryItem) bool {
+    available := item.Available
+    if query.Warehouse != "" {
+        stock, stocked := itemLocations(item)[query.Warehouse]
+        if !stocked {
+            return false
+        }
+        available = stock.Available
+    }
+    if query.BelowThreshold > 0 && available >= query.BelowThreshold {
+        return false
+    }
+    return strings.HasPrefix(item.ProductID, query.ProductPrefix)
+}
+
+// Helper function to order two items by the query's sort
+func (query inventoryQuery) less(a InventoryItem, ak int64, b InventoryItem, bk int64) bool {
+    if ak != bk {
+        if strings.HasSuffix(query.Sort, "_desc") {
+            return ak > bk
+        }
+        return ak < bk
+    }
+    return a.ProductID < b.ProductID
+}
+
+// Helper function to filter, sort and cut one page of items. Returns the
+// page, the number of items matching the filters and the cursor for the
+// next page ("" on the last page).
+func listInventory(items []InventoryItem, query inventoryQuery) ([]InventoryItem, int, string) {
+    key := inventorySorts[query.Sort]
+    if key == nil {
+        key = func(item InventoryItem) int64 { return 0 }
+    }
+
+    matched := make([]InventoryItem, 0, len(items))
+    for _, item := range items {
+        if query.matches(item) {
+            matched = append(matched, item)
+        }
+    }
+    sort.Slice(matched, func(i, j int) bool {
+        return query.less(matched[i], key(matched[i]), matched[j], key(matched[j]))
+    })
+
+    start := 0
+    if query.After != nil {
+        after := InventoryItem{ProductID: query.After.ProductID}
+        start = sort.Search(len(matched), func(i int) bool {
+            return query.less(after, query.After.Key, matched[i], key(matched[i]))
+        })
+    }
+    end := start + query.Limit
+    if end >= len(matched) {
+        return matched[start:], len(matched), ""
+    }
+
+    last := matched[end-1]
+    data, _ := json.Marshal(inventoryCursor{Sort: query.Sort, Key: key(last), ProductID: last.ProductID})
+    return matched[start:end], len(matched), base64.RawURLEncoding.EncodeToString(data)
+}
@@ -2,25 +2,48 @@ package main
 
 import (
     "encoding/json"
+    "errors"
     "fmt"
+    "io"
     "log"
     "net/http"
-    "strconv"
+    "os"
+    "sort"
+    "strings"
     "sync"
     "time"
 
     "github.com/google/uuid"
     "github.com/gorilla/mux"
-    "github.com/rs/cors"
+    "middleware/accesslog"
+    "middleware/adminauth"
+    "middleware/corspolicy"
+    "middleware/httpserver"
+    "middleware/loadshed"
+    "middleware/openmetrics"
+    "middleware/outbound"
+    "middleware/readiness"
+    "middleware/runtimemetrics"
+    "middleware/slo"
+    "middleware/versioning"
 )
 
-// InventoryItem represents inventory for a product
+// InventoryItem represents inventory for a product. Available, Reserved
+// and TotalStock are summed over Locations, its stock at each warehouse
+// (see warehouses.go).
 type InventoryItem struct {
     ProductID     string `json:"product_id"`
     Available     int    `json:"available"`
     Reserved      int    `json:"reserved"`
     TotalStock    int    `json:"total_stock"`
     LastUpdated   int64  `json:"last_updated"`
+
+    Locations map[string]LocationStock `json:"locations,omitempty"` // by warehouse ID
+
+    // Low-stock alerting (see thresholds.go): the reorder threshold, 0 for
+    // none, and since when Available has been below it
+    ReorderThreshold int   `json:"reorder_threshold,omitempty"`
+    LowStockSince    int64 `json:"low_stock_since,omitempty"`
 }
 
 // Reservation represents a stock reservation
@@ -28,24 +51,71 @@ type Reservation struct {
     ReservationID string `json:"reservation_id"`
     ProductID     string `json:"product_id"`
     Quantity      int    `json:"quantity"`
-    CartID        string `json:"cart_id"`
+    CartID        string `json:"cart_id,omitempty"` // set for cart reservations, same as Reference
+    ReferenceType string `json:"reference_type"`    // cart, order, rma, subscription, ...
+    Reference     string `json:"reference"`         // the cart, order, RMA, ... ID holding the stock
     CreatedAt     int64  `json:"created_at"`
     ExpiresAt     int64  `json:"expires_at"`
-    Status        string `json:"status"` // reserved, committed, expired
+    CommittedAt   int64  `json:"committed_at,omitempty"`
+    Status        string `json:"status"` // reserved, committed, expired, backordered
+    WarehouseID   string `json:"warehouse_id,omitempty"` // where the stock is held; "" is DefaultWarehouseID
+
+    // Set on backorders (see backorders.go): when the stock is expected,
+    // and when it came in. Backorders have no expiry until filled, and are
+    // filled in QueuedAt order (Unix nanoseconds, as several can be made
+    // in one second).
+    ExpectedAt int64 `json:"expected_at,omitempty"`
+    FilledAt   int64 `json:"filled_at,omitempty"`
+    QueuedAt   int64 `json:"queued_at,omitempty"`
+
+    // Set on committed reservations: the order the stock was sold to, and
+    // the units put back since by releases for that order (refunds,
+    // returns), with the release IDs already applied
+    OrderID    string   `json:"order_id,omitempty"`
+    Returned   int      `json:"returned,omitempty"`
+    ReleaseIDs []string `json:"release_ids,omitempty"`
 }
 
-// ReservationRequest for creating reservations
+// ReservationRequest for creating reservations. Checkout holds stock for a
+// cart (cart_id); flows without a cart (admin orders, subscriptions,
+// exchanges) hold it for any other reference instead. The stock is held
+// at WarehouseID, or else at a warehouse chosen with ShipToCountry. With
+// Backorder, stock that isn't there yet is backordered instead of refused.
 type ReservationRequest struct {
-    ProductID string `json:"product_id"`
-    Quantity  int    `json:"quantity"`
-    CartID    string `json:"cart_id"`
+    ProductID     string `json:"product_id"`
+    Quantity      int    `json:"quantity"`
+    CartID        string `json:"cart_id"`
+    ReferenceType string `json:"reference_type"`
+    Reference     string `json:"reference"`
+    WarehouseID   string `json:"warehouse_id"`
+    ShipToCountry string `json:"ship_to_country"`
+    Backorder     bool   `json:"backorder"`
+}
+
+// ReferenceTypeCart is the reference type of reservations made with cart_id
+const ReferenceTypeCart = "cart"
+
+// Helper function to validate a reservation reference type: lower-case
+// letters and underscores, e.g. order or rma
+func validReferenceType(referenceType string) bool {
+    if referenceType == "" || len(referenceType) > 32 {
+        return false
+    }
+    for _, c := range referenceType {
+        if (c < 'a' || c > 'z') && c != '_' {
+            return false
+        }
+    }
+    return true
 }
 
-// StockUpdateRequest for updating stock levels
+// StockUpdateRequest for updating stock levels at a warehouse, by default
+// the first in WAREHOUSES
 type StockUpdateRequest struct {
-    ProductID string `json:"product_id"`
-    Quantity  int    `json:"quantity"`
-    Operation string `json:"operation"` // add, set
+    ProductID   string `json:"product_id"`
+    Quantity    int    `json:"quantity"`
+    Operation   string `json:"operation"` // add, set
+    WarehouseID string `json:"warehouse_id"`
 }
 
 // In-memory stores
@@ -57,11 +127,12 @@ var (
 
 // Constants
 const (
-    ReservationTimeout = 30 * time.Minute // Reservations expire after 30 minutes
+    ReservationTimeout = 30 * time.Minute // Default reservation lifetime; RESERVATION_TTL_SECONDS overrides it
 )
 
-// Initialize with sample inventory
-func initSampleInventory() {
+// Seed sample inventory for development; products that already have stock
+// records are left untouched. Returns the number of products seeded.
+func seedSampleInventory() (int, error) {
     sampleProducts := []struct {
         ProductID string
         Stock     int
@@ -76,23 +147,53 @@ func initSampleInventory() {
     mu.Lock()
     defer mu.Unlock()
 
+    seeded := 0
     for _, product := range sampleProducts {
-        inventory[product.ProductID] = InventoryItem{
-            ProductID:   product.ProductID,
-            Available:   product.Stock,
-            Reserved:    0,
-            TotalStock:  product.Stock,
-            LastUpdated: time.Now().Unix(),
+        if _, exists := inventory[product.ProductID]; exists {
+            continue
         }
+
+        err := logAndApply(walEntry{
+            Op:        OpAdjust,
+            Timestamp: time.Now().Unix(),
+            ProductID: product.ProductID,
+            Quantity:  product.Stock,
+            Operation: "set",
+            Actor:     ActorSystem,
+        })
+        if err != nil {
+            return seeded, err
+        }
+        seeded++
     }
 
-    log.Printf("Initialized inventory for %d products", len(sampleProducts))
+    log.Printf("Initialized inventory for %d products", seeded)
+    return seeded, nil
+}
+
+// Admin endpoint to seed sample inventory (development only)
+func seedInventoryHandler(w http.ResponseWriter, r *http.Request) {
+    seeded, err := seedSampleInventory()
+    if err != nil {
+        http.Error(w, "Failed to seed inventory", http.StatusInternalServerError)
+        return
+    }
+    adminauth.Audit(r, "seed", map[string]interface{}{"seeded": seeded})
+
+    result := map[string]interface{}{
+        "message": "Sample inventory seeded",
+        "seeded":  seeded,
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(result)
 }
 
 // Health check endpoint
 func healthHandler(w http.ResponseWriter, r *http.Request) {
+    inventoryCount := len(currentView.Load().items)
+
     mu.RLock()
-    inventoryCount := len(inventory)
     reservationCount := len(reservations)
     mu.RUnlock()
 
@@ -108,14 +209,17 @@ func healthHandler(w http.ResponseWriter, r *http.Request) {
     json.NewEncoder(w).Encode(health)
 }
 
-// Get inventory for a product
+// Get inventory for a product; ?as_of= rebuilds it at a past moment
 func getInventoryHandler(w http.ResponseWriter, r *http.Request) {
     vars := mux.Vars(r)
     productID := vars["productId"]
 
-    mu.RLock()
-    item, exists := inventory[productID]
-    mu.RUnlock()
+    if value := r.URL.Query().Get("as_of"); value != "" {
+        getInventoryAsOf(w, productID, value)
+        return
+    }
+
+    item, exists := loadItem(productID)
 
     if !exists {
         http.Error(w, "Product not found in inventory", http.StatusNotFound)
@@ -126,19 +230,51 @@ func getInventoryHandler(w http.ResponseWriter, r *http.Request) {
     json.NewEncoder(w).Encode(item)
 }
 
+// Helper function to serve a product's stock record as of a past moment
+func getInventoryAsOf(w http.ResponseWriter, productID string, value string) {
+    asOf, err := parseAsOf(value)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+    if storeBackend != StoreWAL || walPath == "" {
+        http.Error(w, "Historical queries need the stock ledger (INVENTORY_STORE=wal and WAL_PATH)", http.StatusConflict)
+        return
+    }
+
+    item, exists, err := stockAsOf(productID, asOf)
+    if err != nil {
+        log.Printf("Failed to replay WAL for %s as of %d: %v", productID, asOf, err)
+        http.Error(w, "Failed to read the stock ledger", http.StatusInternalServerError)
+        return
+    }
+    if !exists {
+        http.Error(w, "Product not found in inventory at that time", http.StatusNotFound)
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(item)
+}
+
 // Get all inventory items
 func getAllInventoryHandler(w http.ResponseWriter, r *http.Request) {
-    mu.RLock()
-    defer mu.RUnlock()
-
-    var items []InventoryItem
-    for _, item := range inventory {
-        items = append(items, item)
+    query, err := parseInventoryQuery(r)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
     }
 
+    page, total, nextCursor := listInventory(loadAllItems(), query)
+
     result := map[string]interface{}{
-        "inventory": items,
-        "total":     len(items),
+        "inventory": page,
+        "total":     total,
+        "limit":     query.Limit,
+        "sort":      query.Sort,
+    }
+    if nextCursor != "" {
+        result["next_cursor"] = nextCursor
     }
 
     w.Header().Set("Content-Type", "application/json")
@@ -157,41 +293,47 @@ func updateStockHandler(w http.ResponseWriter, r *http.Request) {
         http.Error(w, "Product ID and non-negative quantity required", http.StatusBadRequest)
         return
     }
+    if req.WarehouseID == "" {
+        req.WarehouseID = config().Warehouses[0].WarehouseID
+    }
+    if !warehouseConfigured(req.WarehouseID) {
+        http.Error(w, "Unknown warehouse_id; see GET /api/inventory/warehouses", http.StatusBadRequest)
+        return
+    }
 
     mu.Lock()
     defer mu.Unlock()
 
-    item, exists := inventory[req.ProductID]
-    if !exists {
-        // Create new inventory item
-        item = InventoryItem{
-            ProductID:   req.ProductID,
-            Available:   0,
-            Reserved:    0,
-            TotalStock:  0,
-            LastUpdated: time.Now().Unix(),
-        }
-    }
+    item := inventory[req.ProductID]
 
     switch req.Operation {
     case "add":
-        item.Available += req.Quantity
-        item.TotalStock += req.Quantity
     case "set":
         // Ensure we don't set below reserved quantity
-        if req.Quantity < item.Reserved {
+        if req.Quantity < itemLocations(item)[req.WarehouseID].Reserved {
             http.Error(w, "Cannot set stock below reserved quantity", http.StatusBadRequest)
             return
         }
-        item.TotalStock = req.Quantity
-        item.Available = req.Quantity - item.Reserved
     default:
         http.Error(w, "Operation must be 'add' or 'set'", http.StatusBadRequest)
         return
     }
 
-    item.LastUpdated = time.Now().Unix()
-    inventory[req.ProductID] = item
+    err := logAndApply(walEntry{
+        Op:          OpAdjust,
+        Timestamp:   time.Now().Unix(),
+        ProductID:   req.ProductID,
+        Quantity:    req.Quantity,
+        Operation:   req.Operation,
+        WarehouseID: req.WarehouseID,
+        Actor:       requestActor(r),
+    })
+    if err != nil {
+        http.Error(w, "Failed to persist stock update", http.StatusInternalServerError)
+        return
+    }
+    fillBackorders(req.ProductID)
+    item = inventory[req.ProductID]
 
     w.Header().Set("Content-Type", "application/json")
     json.NewEncoder(w).Encode(item)
@@ -205,10 +347,27 @@ func reserveInventoryHandler(w http.ResponseWriter, r *http.Request) {
         return
     }
 
-    if req.ProductID == "" || req.Quantity <= 0 || req.CartID == "" {
-        http.Error(w, "Product ID, positive quantity, and cart ID required", http.StatusBadRequest)
+    if req.CartID != "" {
+        if req.Reference != "" || (req.ReferenceType != "" && req.ReferenceType != ReferenceTypeCart) {
+            http.Error(w, "Give either cart_id or reference_type and reference, not both", http.StatusBadRequest)
+            return
+        }
+        req.ReferenceType = ReferenceTypeCart
+        req.Reference = req.CartID
+    }
+    if req.ProductID == "" || req.Quantity <= 0 || req.Reference == "" {
+        http.Error(w, "Product ID, positive quantity, and cart ID or reference required", http.StatusBadRequest)
+        return
+    }
+    if !validReferenceType(req.ReferenceType) {
+        http.Error(w, "reference_type must be lower-case letters and underscores, e.g. order or rma", http.StatusBadRequest)
         return
     }
+    if req.WarehouseID != "" && !warehouseConfigured(req.WarehouseID) {
+        http.Error(w, "Unknown warehouse_id; see GET /api/inventory/warehouses", http.StatusBadRequest)
+        return
+    }
+    req.ShipToCountry = strings.ToUpper(strings.TrimSpace(req.ShipToCountry))
 
     mu.Lock()
     defer mu.Unlock()
@@ -219,11 +378,25 @@ func reserveInventoryHandler(w http.ResponseWriter, r *http.Request) {
         return
     }
 
-    // Check if enough stock is available
-    if item.Available < req.Quantity {
+    // Check if one warehouse has enough stock available
+    warehouseID, found := req.WarehouseID, itemLocations(item)[req.WarehouseID].Available >= req.Quantity
+    if warehouseID == "" {
+        warehouseID, found = pickWarehouse(item, req.Quantity, req.ShipToCountry)
+    }
+    if !found && req.Backorder {
+        backorder(w, r, req)
+        return
+    }
+    if !found {
+        message := fmt.Sprintf("Insufficient stock. Available: %d, Requested: %d", item.Available, req.Quantity)
+        if req.WarehouseID != "" {
+            message = fmt.Sprintf("Insufficient stock at %s. Available: %d, Requested: %d", req.WarehouseID, itemLocations(item)[req.WarehouseID].Available, req.Quantity)
+        } else if item.Available >= req.Quantity {
+            message = fmt.Sprintf("Insufficient stock at any one warehouse. Available: %d across warehouses, Requested: %d", item.Available, req.Quantity)
+        }
         response := map[string]interface{}{
             "success": false,
-            "message": fmt.Sprintf("Insufficient stock. Available: %d, Requested: %d", item.Available, req.Quantity),
+            "message": message,
         }
         w.Header().Set("Content-Type", "application/json")
         w.WriteHeader(http.StatusBadRequest)
@@ -231,30 +404,39 @@ func reserveInventoryHandler(w http.ResponseWriter, r *http.Request) {
         return
     }
 
-    // Create reservation
-    reservation := Reservation{
-        ReservationID: uuid.New().String(),
+    // Create reservation and update inventory
+    now := time.Now()
+    reservationID := uuid.New().String()
+    expiresAt := now.Add(config().ReservationTTL).Unix()
+    err := logAndApply(walEntry{
+        Op:            OpReserve,
+        Timestamp:     now.Unix(),
         ProductID:     req.ProductID,
         Quantity:      req.Quantity,
-        CartID:        req.CartID,
-        CreatedAt:     time.Now().Unix(),
-        ExpiresAt:     time.Now().Add(ReservationTimeout).Unix(),
-        Status:        "reserved",
+        ReservationID: reservationID,
+        ReferenceType: req.ReferenceType,
+        Reference:     req.Reference,
+        ExpiresAt:     expiresAt,
+        WarehouseID:   warehouseID,
+        Actor:         requestActor(r),
+    })
+    if errors.Is(err, errStockChanged) {
+        // Another writer to the store took the stock; memory now has it
+        http.Error(w, "Stock changed while reserving, try again", http.StatusConflict)
+        return
+    }
+    if err != nil {
+        http.Error(w, "Failed to persist reservation", http.StatusInternalServerError)
+        return
     }
-
-    reservations[reservation.ReservationID] = reservation
-
-    // Update inventory
-    item.Available -= req.Quantity
-    item.Reserved += req.Quantity
-    item.LastUpdated = time.Now().Unix()
-    inventory[req.ProductID] = item
 
     response := map[string]interface{}{
         "success":        true,
-        "reservation_id": reservation.ReservationID,
+        "reservation_id": reservationID,
         "message":        "Stock reserved successfully",
-        "expires_at":     reservation.ExpiresAt,
+        "status":         "reserved",
+        "expires_at":     expiresAt,
+        "warehouse_id":   warehouseID,
     }
 
     w.Header().Set("Content-Type", "application/json")
@@ -275,21 +457,23 @@ func releaseReservationHandler(w http.ResponseWriter, r *http.Request) {
         return
     }
 
-    if reservation.Status != "reserved" {
+    if reservation.Status != "reserved" && reservation.Status != "backordered" {
         http.Error(w, "Reservation already processed", http.StatusBadRequest)
         return
     }
 
-    // Update inventory
-    item := inventory[reservation.ProductID]
-    item.Available += reservation.Quantity
-    item.Reserved -= reservation.Quantity
-    item.LastUpdated = time.Now().Unix()
-    inventory[reservation.ProductID] = item
-
-    // Mark reservation as expired
-    reservation.Status = "expired"
-    reservations[reservationID] = reservation
+    // Return stock (backorders hold none) and mark reservation as expired
+    err := logAndApply(walEntry{
+        Op:            OpRelease,
+        Timestamp:     time.Now().Unix(),
+        ReservationID: reservationID,
+        Actor:         requestActor(r),
+    })
+    if err != nil {
+        http.Error(w, "Failed to persist release", http.StatusInternalServerError)
+        return
+    }
+    fillBackorders(reservation.ProductID)
 
     response := map[string]interface{}{
         "success": true,
@@ -300,11 +484,22 @@ func releaseReservationHandler(w http.ResponseWriter, r *http.Request) {
     json.NewEncoder(w).Encode(response)
 }
 
-// Commit reservation (convert to actual sale)
+// Commit reservation (convert to actual sale). Idempotent: committing a
+// reservation again returns the original result, so callers can safely
+// retry after a timeout. The optional body {"order_id": "..."} records the
+// order the stock was sold to, so releases for that order can put it back.
 func commitReservationHandler(w http.ResponseWriter, r *http.Request) {
     vars := mux.Vars(r)
     reservationID := vars["reservationId"]
 
+    var req struct {
+        OrderID string `json:"order_id"`
+    }
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+        http.Error(w, "Invalid JSON", http.StatusBadRequest)
+        return
+    }
+
     mu.Lock()
     defer mu.Unlock()
 
@@ -314,25 +509,125 @@ func commitReservationHandler(w http.ResponseWriter, r *http.Request) {
         return
     }
 
-    if reservation.Status != "reserved" {
-        http.Error(w, "Reservation already processed", http.StatusBadRequest)
+    replayed := reservation.Status == "committed"
+    if !replayed {
+        if reservation.Status == "backordered" {
+            http.Error(w, "Reservation is backordered; commit it once it is filled", http.StatusConflict)
+            return
+        }
+        if reservation.Status != "reserved" {
+            // Released or expired: the stock is gone, a retry won't help
+            http.Error(w, "Reservation was released or expired", http.StatusConflict)
+            return
+        }
+
+        // Reduce total stock and mark reservation as committed
+        err := logAndApply(walEntry{
+            Op:            OpCommit,
+            Timestamp:     time.Now().Unix(),
+            ReservationID: reservationID,
+            OrderID:       req.OrderID,
+            Actor:         requestActor(r),
+        })
+        if err != nil {
+            http.Error(w, "Failed to persist commit", http.StatusInternalServerError)
+            return
+        }
+        reservation = reservations[reservationID]
+    }
+
+    response := map[string]interface{}{
+        "success":     true,
+        "message":     "Reservation committed successfully",
+        "reservation": reservation,
+        "replayed":    replayed,
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(response)
+}
+
+// Commit every reservation a cart holds to an order, all in one store
+// write, so an order never gets part of its cart. Idempotent like single
+// commits: with the same {"order_id": "..."}, a retry reports the
+// reservations already committed to that order with "replayed": true.
+// Backorders not yet filled aren't committed; they are listed apart, as in
+// the cart's reservations.
+func commitCartHandler(w http.ResponseWriter, r *http.Request) {
+    cartID := mux.Vars(r)["cartId"]
+
+    var req struct {
+        OrderID string `json:"order_id"`
+    }
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+        http.Error(w, "Invalid JSON", http.StatusBadRequest)
         return
     }
 
-    // Update inventory - reduce total stock
-    item := inventory[reservation.ProductID]
-    item.Reserved -= reservation.Quantity
-    item.TotalStock -= reservation.Quantity
-    item.LastUpdated = time.Now().Unix()
-    inventory[reservation.ProductID] = item
+    mu.Lock()
+    defer mu.Unlock()
 
-    // Mark reservation as committed
-    reservation.Status = "committed"
-    reservations[reservationID] = reservation
+    var committed, backordered []Reservation
+    var reservationIDs []string
+    for _, reservation := range reservations {
+        if reservation.ReferenceType != ReferenceTypeCart || reservation.Reference != cartID {
+            continue
+        }
+        switch reservation.Status {
+        case "reserved":
+            reservationIDs = append(reservationIDs, reservation.ReservationID)
+        case "committed":
+            if req.OrderID != "" && reservation.OrderID == req.OrderID {
+                committed = append(committed, reservation)
+            }
+        case "backordered":
+            backordered = append(backordered, reservation)
+        }
+    }
+
+    replayed := len(reservationIDs) == 0 && len(committed) > 0
+    if len(reservationIDs) > 0 {
+        sort.Strings(reservationIDs)
+        err := logAndApply(walEntry{
+            Op:             OpCommitAll,
+            Timestamp:      time.Now().Unix(),
+            ReservationIDs: reservationIDs,
+            OrderID:        req.OrderID,
+            Actor:          requestActor(r),
+        })
+        if errors.Is(err, errStockChanged) {
+            // Another writer released or committed one; memory now has it
+            http.Error(w, "Cart reservations changed while committing, try again", http.StatusConflict)
+            return
+        }
+        if err != nil {
+            http.Error(w, "Failed to persist commit", http.StatusInternalServerError)
+            return
+        }
+        for _, reservationID := range reservationIDs {
+            committed = append(committed, reservations[reservationID])
+        }
+    }
+
+    quantity := 0
+    for _, reservation := range committed {
+        quantity += reservation.Quantity
+    }
+    sort.Slice(committed, func(i, j int) bool {
+        return committed[i].ReservationID < committed[j].ReservationID
+    })
 
     response := map[string]interface{}{
-        "success": true,
-        "message": "Reservation committed successfully",
+        "success":      true,
+        "cart_id":      cartID,
+        "order_id":     req.OrderID,
+        "reservations": append([]Reservation{}, committed...),
+        "count":        len(committed),
+        "quantity":     quantity,
+        "replayed":     replayed,
+    }
+    if len(backordered) > 0 {
+        response["backordered"] = backordered
     }
 
     w.Header().Set("Content-Type", "application/json")
@@ -341,38 +636,97 @@ func commitReservationHandler(w http.ResponseWriter, r *http.Request) {
 
 // Get reservations for a cart
 func getCartReservationsHandler(w http.ResponseWriter, r *http.Request) {
+    writeReferenceReservations(w, ReferenceTypeCart, mux.Vars(r)["cartId"])
+}
+
+// Get reservations held for any reference, e.g. /reservations/order/{orderId}
+func getReferenceReservationsHandler(w http.ResponseWriter, r *http.Request) {
     vars := mux.Vars(r)
-    cartID := vars["cartId"]
+    writeReferenceReservations(w, vars["referenceType"], vars["reference"])
+}
 
+// Helper function to list a reference's active reservations. Backorders
+// waiting for stock are listed apart, so callers committing what is held
+// don't trip over them.
+func writeReferenceReservations(w http.ResponseWriter, referenceType string, reference string) {
     mu.RLock()
     defer mu.RUnlock()
 
-    var cartReservations []Reservation
+    var held, backordered []Reservation
     for _, reservation := range reservations {
-        if reservation.CartID == cartID && reservation.Status == "reserved" {
-            cartReservations = append(cartReservations, reservation)
+        if reservation.ReferenceType != referenceType || reservation.Reference != reference {
+            continue
+        }
+        switch reservation.Status {
+        case "reserved":
+            held = append(held, reservation)
+        case "backordered":
+            backordered = append(backordered, reservation)
         }
     }
 
     result := map[string]interface{}{
-        "reservations": cartReservations,
-        "count":        len(cartReservations),
+        "reservations": held,
+        "count":        len(held),
+    }
+    if len(backordered) > 0 {
+        result["backordered"] = backordered
     }
 
     w.Header().Set("Content-Type", "application/json")
     json.NewEncoder(w).Encode(result)
 }
 
+// Helper function to remove stock records (and their reservations) for
+// test products. Callers must hold mu.
+func clearTestInventory() (int, error) {
+    cleared := 0
+    for productID := range inventory {
+        if !strings.HasPrefix(productID, adminauth.TestDataPrefix) {
+            continue
+        }
+        err := logAndApply(walEntry{Op: OpRemove, Timestamp: time.Now().Unix(), ProductID: productID, Actor: ActorAdmin})
+        if err != nil {
+            return cleared, err
+        }
+        cleared++
+    }
+    return cleared, nil
+}
+
 // Admin endpoint to clear all inventory
 func clearInventoryHandler(w http.ResponseWriter, r *http.Request) {
+    scope, ok := adminauth.ConfirmClear(w, r)
+    if !ok {
+        return
+    }
+
     mu.Lock()
     defer mu.Unlock()
 
-    inventory = make(map[string]InventoryItem)
-    reservations = make(map[string]Reservation)
+    cleared := 0
+    if scope == "test" {
+        var err error
+        cleared, err = clearTestInventory()
+        if err != nil {
+            http.Error(w, "Failed to persist clear", http.StatusInternalServerError)
+            return
+        }
+    } else {
+        cleared = len(inventory)
+        err := logAndApply(walEntry{Op: OpClear, Timestamp: time.Now().Unix(), Actor: ActorAdmin})
+        if err != nil {
+            http.Error(w, "Failed to persist clear", http.StatusInternalServerError)
+            return
+        }
+    }
 
-    result := map[string]string{
-        "message": "All inventory and reservations cleared",
+    adminauth.Audit(r, "clear", map[string]interface{}{"scope": scope, "cleared": cleared})
+
+    result := map[string]interface{}{
+        "message": "Inventory and reservations cleared",
+        "scope":   scope,
+        "cleared": cleared,
     }
 
     w.Header().Set("Content-Type", "application/json")
@@ -383,14 +737,23 @@ func clearInventoryHandler(w http.ResponseWriter, r *http.Request) {
 func metricsHandler(w http.ResponseWriter, r *http.Request) {
     mu.RLock()
     inventoryCount := len(inventory)
+    lowStockCount := 0
+    for _, item := range inventory {
+        if item.LowStockSince != 0 {
+            lowStockCount++
+        }
+    }
     reservationCount := 0
     expiredReservations := 0
+    backorderedReservations := 0
     
     for _, reservation := range reservations {
         if reservation.Status == "reserved" {
             reservationCount++
         } else if reservation.Status == "expired" {
             expiredReservations++
+        } else if reservation.Status == "backordered" {
+            backorderedReservations++
         }
     }
     mu.RUnlock()
@@ -407,10 +770,24 @@ inventory_service_reservations_active_total %d
 # HELP inventory_service_reservations_expired_total Total number of expired reservations
 # TYPE inventory_service_reservations_expired_total counter
 inventory_service_reservations_expired_total %d
-`, inventoryCount, reservationCount, expiredReservations)
 
-    w.Header().Set("Content-Type", "text/plain")
-    w.Write([]byte(metrics))
+# HELP inventory_service_reservations_backordered Backorders waiting for stock
+# TYPE inventory_service_reservations_backordered gauge
+inventory_service_reservations_backordered %d
+
+# HELP inventory_service_products_low_stock Products with less available than their reorder threshold
+# TYPE inventory_service_products_low_stock gauge
+inventory_service_products_low_stock %d
+`, inventoryCount, reservationCount, expiredReservations, backorderedReservations, lowStockCount)
+
+    metrics += inventoryEventMetrics()
+    metrics += readiness.Metrics()
+    metrics += versioning.Metrics()
+    metrics += loadshed.Metrics()
+    metrics += slo.Metrics()
+    metrics += runtimemetrics.Text()
+
+    openmetrics.Write(w, r, metrics)
 }
 
 // Background task to clean up expired reservations
@@ -422,22 +799,27 @@ func cleanupExpiredReservations() {
         mu.Lock()
         now := time.Now().Unix()
         expiredCount := 0
+        freed := make(map[string]bool)
 
         for reservationID, reservation := range reservations {
             if reservation.Status == "reserved" && now > reservation.ExpiresAt {
-                // Release the reservation
-                item := inventory[reservation.ProductID]
-                item.Available += reservation.Quantity
-                item.Reserved -= reservation.Quantity
-                item.LastUpdated = now
-                inventory[reservation.ProductID] = item
-
-                // Mark as expired
-                reservation.Status = "expired"
-                reservations[reservationID] = reservation
+                // Release the reservation and mark as expired
+                err := logAndApply(walEntry{
+                    Op:            OpExpire,
+                    Timestamp:     now,
+                    ReservationID: reservationID,
+                    Actor:         ActorSystem,
+                })
+                if err != nil {
+                    break
+                }
                 expiredCount++
+                freed[reservation.ProductID] = true
             }
         }
+        for productID := range freed {
+            fillBackorders(productID)
+        }
 
         if expiredCount > 0 {
             log.Printf("Expired %d reservations", expiredCount)
@@ -446,46 +828,89 @@ func cleanupExpiredReservations() {
     }
 }
 
-func main() {
-    // Initialize sample inventory
-    initSampleInventory()
-
-    // Start cleanup goroutine
-    go cleanupExpiredReservations()
-
-    router := mux.NewRouter()
-
-    // API routes
-    api := router.PathPrefix("/api/inventory").Subrouter()
+// Inventory API v1 routes
+func inventoryRoutesV1(api *mux.Router) {
     api.HandleFunc("", getAllInventoryHandler).Methods("GET")
+    api.HandleFunc("/warehouses", listWarehousesHandler).Methods("GET") // ahead of /{productId}
+    api.HandleFunc("/low-stock", lowStockReportHandler).Methods("GET")  // ahead of /{productId}
     api.HandleFunc("/{productId}", getInventoryHandler).Methods("GET")
+    api.Handle("/{productId}/threshold", adminauth.Middleware(http.HandlerFunc(setThresholdHandler))).Methods("POST")
+    api.HandleFunc("/{productId}/movements", getMovementsHandler).Methods("GET")
     api.HandleFunc("/stock", updateStockHandler).Methods("POST")
     api.HandleFunc("/reserve", reserveInventoryHandler).Methods("POST")
     api.HandleFunc("/release/{reservationId}", releaseReservationHandler).Methods("DELETE")
     api.HandleFunc("/commit/{reservationId}", commitReservationHandler).Methods("POST")
     api.HandleFunc("/cart/{cartId}/reservations", getCartReservationsHandler).Methods("GET")
+    api.HandleFunc("/cart/{cartId}/commit", commitCartHandler).Methods("POST")
+    api.HandleFunc("/reservations/{referenceType}/{reference}", getReferenceReservationsHandler).Methods("GET")
+    api.HandleFunc("/orders/{orderId}/release", releaseOrderStockHandler).Methods("POST")
+}
+
+func main() {
+    // Rebuild state from the store
+    var err error
+    if store, err = openStore(); err != nil {
+        log.Fatalf("Invalid inventory store: %v", err)
+    }
+    replayed, err := store.Load()
+    if err != nil {
+        log.Fatalf("Failed to load inventory from %s: %v", store.Describe(), err)
+    }
+    if replayed > 0 {
+        log.Printf("Loaded %d records from %s", replayed, store.Describe())
+    }
+
+    // Sample data is opt-in so production stores start empty
+    if os.Getenv("SEED_SAMPLE_DATA") == "true" && replayed == 0 {
+        if _, err := seedSampleInventory(); err != nil {
+            log.Fatalf("Failed to seed inventory: %v", err)
+        }
+    }
+
+    // Start cleanup goroutine
+    go cleanupExpiredReservations()
+    go deliverInventoryEvents()
+    go liveConfig.Watch()
+    go readiness.Run(outbound.NewClient)
+
+    router := mux.NewRouter()
+    router.Use(openmetrics.Observe)
+
+    // API routes, served under /api/v1/inventory and the legacy /api/inventory
+    api := router.PathPrefix("/api").Subrouter()
+    versioning.Mount(api, "/inventory", map[string]func(*mux.Router){
+        "v1": inventoryRoutesV1,
+    })
 
     // Admin routes
-    router.HandleFunc("/admin/clear", clearInventoryHandler).Methods("DELETE")
+    admin := router.PathPrefix("/admin").Subrouter()
+    admin.Use(adminauth.Middleware)
+    admin.HandleFunc("/clear", clearInventoryHandler).Methods("DELETE")
+    admin.HandleFunc("/backup", backupInventoryHandler).Methods("GET")
+    admin.HandleFunc("/restore", restoreInventoryHandler).Methods("POST")
+    admin.HandleFunc("/config", liveConfig.Handler).Methods("GET")
+    admin.HandleFunc("/config/reload", liveConfig.ReloadHandler).Methods("POST")
+    admin.HandleFunc("/seed", seedInventoryHandler).Methods("POST")
+    admin.HandleFunc("/test/fixtures", loadFixturesHandler).Methods("POST")
+    admin.HandleFunc("/test/fixtures", resetFixturesHandler).Methods("DELETE")
 
     // Utility routes
     router.HandleFunc("/health", healthHandler).Methods("GET")
+    router.HandleFunc("/readyz", readiness.Handler).Methods("GET")
     router.HandleFunc("/metrics", metricsHandler).Methods("GET")
+    router.HandleFunc("/slo", slo.Handler).Methods("GET")
 
-    // CORS configuration
-    c := cors.New(cors.Options{
-        AllowedOrigins:   []string{"*"},
-        AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
-        AllowedHeaders:   []string{"*"},
-        AllowCredentials: true,
-    })
+    // CORS policy from CORS_* settings
+    c := corspolicy.New()
 
-    handler := c.Handler(router)
+    handler := accesslog.Handler(serviceName, c.Handler(loadshed.Handler(router, nil)))
 
     port := "8004"
     log.Printf("Inventory service starting on port %s", port)
+    log.Printf("Access log: %s", accesslog.Settings())
+    log.Printf("Inventory store: %s", store.Describe())
     
-    if err := http.ListenAndServe(":"+port, handler); err != nil {
+    if err := httpserver.New(port, handler).ListenAndServe(); err != nil {
         log.Fatal("Server failed to start:", err)
     }
 }
\ No newline at end of file
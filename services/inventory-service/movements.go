@@ -0,0 +1,286 @@
+package main
+
+import (
+    "bufio"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "log"
+    "net/http"
+    "os"
+    "strconv"
+    "strings"
+
+    "github.com/gorilla/mux"
+)
+
+// Stock movements. Every change to a product's available, reserved or
+// total stock is a movement: the mutation that made it, the units moved,
+// the stock after, who made it and what it was for (the reservation and
+// its cart or order, the order release). Movements are never changed or
+// dropped, not even with the product, and
+// GET /api/inventory/{productId}/movements pages through them oldest
+// first, for audits and shrinkage investigations. The WAL store rebuilds
+// them from the log on each request, as as_of does, so they need WAL_PATH;
+// the Redis store appends each one to movements:{productId} in the
+// transaction that makes the change.
+//
+// The actor is the caller's X-Actor header (e.g. "order-service" or
+// "admin:jane"), taken at its word as the API has no authentication of its
+// own, and "api" without one. Admin endpoints record "admin", and
+// background work (expiry, backorder fills, seeding) "system". Changes
+// made before actors were recorded have none.
+const (
+    ActorHeader = "X-Actor"
+    ActorAPI    = "api"
+    ActorAdmin  = "admin"
+    ActorSystem = "system"
+)
+
+// Movement pages
+const (
+    DefaultMovementPageSize = 100
+    MaxMovementPageSize     = 1000
+)
+
+// StockMovement is one change to a product's stock. The deltas are signed;
+// Quantity is the units moved.
+type StockMovement struct {
+    Seq             int64  `json:"seq"` // position in the product's movements
+    Type            string `json:"type"` // the mutation: adjust, reserve, fill, release, expire, commit, commit_all, return, restore, remove or clear
+    ProductID       string `json:"product_id"`
+    WarehouseID     string `json:"warehouse_id,omitempty"` // unset when several warehouses changed at once
+    Quantity        int    `json:"quantity"`
+    AvailableDelta  int    `json:"available_delta"`
+    ReservedDelta   int    `json:"reserved_delta"`
+    TotalStockDelta int    `json:"total_stock_delta"`
+    Available       int    `json:"available"`
+    Reserved        int    `json:"reserved"`
+    TotalStock      int    `json:"total_stock"`
+    Actor           string `json:"actor,omitempty"`
+    ReservationID   string `json:"reservation_id,omitempty"`
+    ReferenceType   string `json:"reference_type,omitempty"`
+    Reference       string `json:"reference,omitempty"`
+    OrderID         string `json:"order_id,omitempty"`
+    ReleaseID       string `json:"release_id,omitempty"`
+    At              int64  `json:"at"`
+}
+
+// errNoLedger is returned for movements when the store keeps no history
+var errNoLedger = errors.New("no stock ledger")
+
+// Helper function to name who is making a change, from X-Actor
+func requestActor(r *http.Request) string {
+    actor := strings.TrimSpace(r.Header.Get(ActorHeader))
+    if actor == "" {
+        return ActorAPI
+    }
+    if len(actor) > 64 {
+        actor = actor[:64]
+    }
+    return strings.Map(func(c rune) rune {
+        if c < ' ' || c == 0x7f {
+            return -1
+        }
+        return c
+    }, actor)
+}
+
+// Helper function to find the reservation a mutation changed a product's
+// stock through, as it stood after. A commit_all names several; when it
+// commits more than one of the product's reservations, only their
+// reference and order are kept.
+func movementReservation(reservations map[string]Reservation, entry walEntry, productID string) Reservation {
+    if entry.Op != OpCommitAll {
+        return reservations[entry.ReservationID]
+    }
+    var found Reservation
+    for _, reservationID := range entry.ReservationIDs {
+        reservation := reservations[reservationID]
+        if reservation.ProductID != productID {
+            continue
+        }
+        if found.ProductID != "" {
+            return Reservation{ReferenceType: found.ReferenceType, Reference: found.Reference, OrderID: found.OrderID}
+        }
+        found = reservation
+    }
+    return found
+}
+
+// Helper function to describe what a mutation did to a product's stock,
+// from the record before and after it. reservation is the one it went
+// through (see movementReservation). Returns false when the stock didn't
+// change.
+func stockMovement(entry walEntry, before InventoryItem, after InventoryItem, reservation Reservation) (StockMovement, bool) {
+    movement := StockMovement{
+        Type:            entry.Op,
+        ProductID:       after.ProductID,
+        AvailableDelta:  after.Available - before.Available,
+        ReservedDelta:   after.Reserved - before.Reserved,
+        TotalStockDelta: after.TotalStock - before.TotalStock,
+        Available:       after.Available,
+        Reserved:        after.Reserved,
+        TotalStock:      after.TotalStock,
+        Actor:           entry.Actor,
+        ReservationID:   reservation.ReservationID,
+        ReferenceType:   reservation.ReferenceType,
+        Reference:       reservation.Reference,
+        OrderID:         entry.OrderID,
+        ReleaseID:       entry.ReleaseID,
+        At:              entry.Timestamp,
+    }
+    if movement.AvailableDelta == 0 && movement.ReservedDelta == 0 && movement.TotalStockDelta == 0 {
+        return movement, false
+    }
+    if movement.ProductID == "" {
+        movement.ProductID = before.ProductID
+    }
+    if (entry.Op == OpCommit || entry.Op == OpCommitAll) && movement.OrderID == "" {
+        movement.OrderID = reservation.OrderID
+    }
+    movement.Quantity = max(abs(movement.AvailableDelta), abs(movement.ReservedDelta), abs(movement.TotalStockDelta))
+
+    // The warehouse is the one location that changed
+    beforeLocations, afterLocations := itemLocations(before), itemLocations(after)
+    changed := 0
+    for id := range mergeKeys(beforeLocations, afterLocations) {
+        if beforeLocations[id] != afterLocations[id] {
+            movement.WarehouseID = id
+            changed++
+        }
+    }
+    if changed != 1 {
+        movement.WarehouseID = ""
+    }
+    return movement, true
+}
+
+// Helper function to get the absolute value of n
+func abs(n int) int {
+    if n < 0 {
+        return -n
+    }
+    return n
+}
+
+// Helper function to collect the keys of two location maps
+func mergeKeys(a map[string]LocationStock, b map[string]LocationStock) map[string]bool {
+    keys := make(map[string]bool, len(a)+len(b))
+    for id := range a {
+        keys[id] = true
+    }
+    for id := range b {
+        keys[id] = true
+    }
+    return keys
+}
+
+// Helper function to rebuild a product's movements from the WAL: those
+// after position cursor, at most limit of them. Returns the cursor of the
+// next page, 0 when there is none. The log is read through its own file
+// handle without taking mu, as stockAsOf does.
+func walMovements(productID string, cursor int64, limit int) ([]StockMovement, int64, error) {
+    if walPath == "" {
+        return nil, 0, errNoLedger
+    }
+    file, err := os.Open(walPath)
+    if err != nil {
+        return nil, 0, err
+    }
+    defer file.Close()
+
+    inventory := make(map[string]InventoryItem)
+    reservations := make(map[string]Reservation)
+
+    var movements []StockMovement
+    var seq int64
+    reader := bufio.NewReader(file)
+    for len(movements) <= limit {
+        line, err := reader.ReadBytes('\n')
+        if err == io.EOF {
+            // A line without its newline is still being written
+            break
+        }
+        if err != nil {
+            return nil, 0, err
+        }
+
+        var entry walEntry
+        if err := json.Unmarshal(line, &entry); err != nil {
+            return nil, 0, fmt.Errorf("corrupt WAL record after movement %d: %v", seq, err)
+        }
+        if !entryTouchesProduct(entry, productID) {
+            continue
+        }
+        before := inventory[productID]
+        applyEntryTo(inventory, reservations, entry)
+        movement, moved := stockMovement(entry, before, inventory[productID], movementReservation(reservations, entry, productID))
+        if !moved || movement.ProductID != productID {
+            continue
+        }
+        seq++
+        if seq > cursor {
+            movement.Seq = seq
+            movements = append(movements, movement)
+        }
+    }
+
+    if len(movements) > limit {
+        return movements[:limit], movements[limit-1].Seq, nil
+    }
+    return movements, 0, nil
+}
+
+// List a product's stock movements, oldest first. ?limit= sets the page
+// size; ?cursor= takes the next_cursor of the previous page.
+func getMovementsHandler(w http.ResponseWriter, r *http.Request) {
+    productID := mux.Vars(r)["productId"]
+    params := r.URL.Query()
+
+    limit := DefaultMovementPageSize
+    if value := params.Get("limit"); value != "" {
+        parsed, err := strconv.Atoi(value)
+        if err != nil || parsed <= 0 || parsed > MaxMovementPageSize {
+            http.Error(w, fmt.Sprintf("limit must be between 1 and %d", MaxMovementPageSize), http.StatusBadRequest)
+            return
+        }
+        limit = parsed
+    }
+    var cursor int64
+    if value := params.Get("cursor"); value != "" {
+        parsed, err := strconv.ParseInt(value, 10, 64)
+        if err != nil || parsed < 0 {
+            http.Error(w, "invalid cursor", http.StatusBadRequest)
+            return
+        }
+        cursor = parsed
+    }
+
+    movements, next, err := store.Movements(productID, cursor, limit)
+    if errors.Is(err, errNoLedger) {
+        http.Error(w, "Stock movements need the stock ledger (WAL_PATH or INVENTORY_STORE=redis)", http.StatusConflict)
+        return
+    }
+    if err != nil {
+        log.Printf("Failed to read stock movements of %s: %v", productID, err)
+        http.Error(w, "Failed to read the stock ledger", http.StatusInternalServerError)
+        return
+    }
+    if _, exists := loadItem(productID); !exists && len(movements) == 0 && cursor == 0 {
+        http.Error(w, "Product not found in inventory", http.StatusNotFound)
+        return
+    }
+
+    result := map[string]interface{}{
+        "product_id": productID,
+        "movements":  append([]StockMovement{}, movements...),
+    }
+    if next != 0 {
+        result["next_cursor"] = strconv.FormatInt(next, 10)
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(result)
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+    "encoding/json"
+    "net/http"
+    "sort"
+    "time"
+
+    "github.com/gorilla/mux"
+)
+
+// OrderReleaseRequest puts stock sold to an order back, e.g. after a
+// refund. Items lists the units per product; when it is empty, everything
+// the order still holds is released. ReleaseID identifies the release so a
+// retried call is applied once.
+type OrderReleaseRequest struct {
+    ReleaseID string             `json:"release_id"`
+    Items     []OrderReleaseItem `json:"items"`
+}
+
+// OrderReleaseItem is one product's units in a release
+type OrderReleaseItem struct {
+    ProductID string `json:"product_id"`
+    Quantity  int    `json:"quantity"`
+}
+
+// Helper function to list the committed reservations sold to an order,
+// oldest first. Callers must hold mu.
+func orderReservations(orderID string) []Reservation {
+    var sold []Reservation
+    for _, reservation := range reservations {
+        if reservation.Status == "committed" && reservation.OrderID == orderID {
+            sold = append(sold, reservation)
+        }
+    }
+    sort.Slice(sold, func(i, j int) bool {
+        if sold[i].CommittedAt != sold[j].CommittedAt {
+            return sold[i].CommittedAt < sold[j].CommittedAt
+        }
+        return sold[i].ReservationID < sold[j].ReservationID
+    })
+    return sold
+}
+
+// Release stock sold to an order back into available stock. Units are
+// taken from the order's committed reservations; asking for more than the
+// order still holds is refused without releasing anything.
+func releaseOrderStockHandler(w http.ResponseWriter, r *http.Request) {
+    orderID := mux.Vars(r)["orderId"]
+
+    var req OrderReleaseRequest
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+        http.Error(w, "Invalid JSON", http.StatusBadRequest)
+        return
+    }
+    if req.ReleaseID == "" {
+        http.Error(w, "release_id required", http.StatusBadRequest)
+        return
+    }
+    requested := make(map[string]int)
+    for _, item := range req.Items {
+        if item.ProductID == "" || item.Quantity <= 0 {
+            http.Error(w, "Each item needs a product ID and positive quantity", http.StatusBadRequest)
+            return
+        }
+        requested[item.ProductID] += item.Quantity
+    }
+
+    mu.Lock()
+    defer mu.Unlock()
+
+    sold := orderReservations(orderID)
+    if len(sold) == 0 {
+        http.Error(w, "No stock committed for order", http.StatusNotFound)
+        return
+    }
+
+    // A retried release was applied the first time; don't apply it again
+    replayed := false
+    for _, reservation := range sold {
+        for _, releaseID := range reservation.ReleaseIDs {
+            if releaseID == req.ReleaseID {
+                replayed = true
+            }
+        }
+    }
+
+    released := make(map[string]int)
+    if !replayed {
+        remaining := make(map[string]int)
+        for _, reservation := range sold {
+            remaining[reservation.ProductID] += reservation.Quantity - reservation.Returned
+        }
+        if len(requested) == 0 {
+            for productID, quantity := range remaining {
+                if quantity > 0 {
+                    requested[productID] = quantity
+                }
+            }
+        }
+        for productID, quantity := range requested {
+            if quantity > remaining[productID] {
+                http.Error(w, "Release exceeds the stock the order holds for "+productID, http.StatusConflict)
+                return
+            }
+        }
+
+        now := time.Now().Unix()
+        for _, reservation := range sold {
+            quantity := min(requested[reservation.ProductID], reservation.Quantity-reservation.Returned)
+            if quantity <= 0 {
+                continue
+            }
+            err := logAndApply(walEntry{
+                Op:            OpReturn,
+                Timestamp:     now,
+                ProductID:     reservation.ProductID,
+                Quantity:      quantity,
+                ReservationID: reservation.ReservationID,
+                ReleaseID:     req.ReleaseID,
+                Actor:         requestActor(r),
+            })
+            if err != nil {
+                http.Error(w, "Failed to persist release", http.StatusInternalServerError)
+                return
+            }
+            requested[reservation.ProductID] -= quantity
+            released[reservation.ProductID] += quantity
+        }
+        for productID := range released {
+            fillBackorders(productID)
+        }
+    }
+
+    items := []OrderReleaseItem{}
+    for productID, quantity := range released {
+        items = append(items, OrderReleaseItem{ProductID: productID, Quantity: quantity})
+    }
+    sort.Slice(items, func(i, j int) bool { return items[i].ProductID < items[j].ProductID })
+
+    response := map[string]interface{}{
+        "success":    true,
+        "order_id":   orderID,
+        "release_id": req.ReleaseID,
+        "released":   items,
+        "replayed":   replayed,
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(response)
+}
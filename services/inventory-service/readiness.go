@@ -0,0 +1,13 @@
+package main
+
+import "middleware/readiness"
+
+func init() {
+    readiness.Setup(serviceName, readinessDependencies, nil)
+}
+
+// Dependencies probed for readiness. Inventory is self-contained; it is
+// ready as soon as the WAL has been replayed and the server is up.
+func readinessDependencies() []readiness.Dependency {
+    return nil
+}
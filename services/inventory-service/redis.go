@@ -0,0 +1,617 @@
+package main
+
+import (
+    "bufio"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "net"
+    "net/url"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// Redis inventory store. Stock records and reservations are JSON values
+// under REDIS_KEY_PREFIX (default "inventory:"):
+//
+//   - item:{productId} and reservation:{reservationId}, the records
+//   - items and reservations, sets of every ID
+//   - product:{productId}:reservations, the reservations of one product
+//   - movements:{productId}, a list of the product's stock movements, kept
+//     after the product is removed (see movements.go)
+//
+// A mutation WATCHes the records it touches, reads them, applies the entry
+// to them with the same rules as the WAL (applyEntryTo) and writes the
+// result back in MULTI/EXEC, retrying when another writer got in first. A
+// reservation is refused if the stored stock no longer covers it, so the
+// service can't over-sell even if its in-memory copy is stale. Commands are
+// spoken directly over RESP, as order-service does with NATS.
+const (
+    DefaultRedisURL       = "redis://localhost:6379/0"
+    DefaultRedisKeyPrefix = "inventory:"
+    RedisTimeout          = 5 * time.Second
+    RedisTxnAttempts      = 5 // WATCH conflicts before a mutation gives up
+)
+
+// redisError is an error reply from Redis
+type redisError string
+
+func (e redisError) Error() string { return "redis: " + string(e) }
+
+// redisConn is one connection speaking RESP
+type redisConn struct {
+    conn   net.Conn
+    reader *bufio.Reader
+}
+
+// Helper function to connect to redis://[user:password@]host:port/db
+func dialRedis(rawURL string) (*redisConn, error) {
+    parsed, err := url.Parse(rawURL)
+    if err != nil || parsed.Scheme != "redis" || parsed.Host == "" {
+        return nil, fmt.Errorf("REDIS_URL=%q must be a redis://host:port/db URL", rawURL)
+    }
+    address := parsed.Host
+    if parsed.Port() == "" {
+        address = net.JoinHostPort(parsed.Hostname(), "6379")
+    }
+
+    conn, err := net.DialTimeout("tcp", address, RedisTimeout)
+    if err != nil {
+        return nil, err
+    }
+    c := &redisConn{conn: conn, reader: bufio.NewReader(conn)}
+
+    if password, set := parsed.User.Password(); set {
+        args := []string{"AUTH", password}
+        if username := parsed.User.Username(); username != "" {
+            args = []string{"AUTH", username, password}
+        }
+        if _, err := c.do(args...); err != nil {
+            conn.Close()
+            return nil, err
+        }
+    }
+    if db := strings.TrimPrefix(parsed.Path, "/"); db != "" && db != "0" {
+        if _, err := c.do("SELECT", db); err != nil {
+            conn.Close()
+            return nil, err
+        }
+    }
+    return c, nil
+}
+
+// Helper function to send a command and read its reply: a string for
+// status and bulk replies, an int64, a []interface{} for arrays, or nil
+func (c *redisConn) do(args ...string) (interface{}, error) {
+    c.conn.SetDeadline(time.Now().Add(RedisTimeout))
+
+    var command strings.Builder
+    fmt.Fprintf(&command, "*%d\r\n", len(args))
+    for _, arg := range args {
+        fmt.Fprintf(&command, "$%d\r\n%s\r\n", len(arg), arg)
+    }
+    if _, err := io.WriteString(c.conn, command.String()); err != nil {
+        return nil, err
+    }
+    return c.readReply()
+}
+
+// Helper function to read one RESP reply
+func (c *redisConn) readReply() (interface{}, error) {
+    line, err := c.reader.ReadString('\n')
+    if err != nil {
+        return nil, err
+    }
+    line = strings.TrimSuffix(line, "\r\n")
+    if line == "" {
+        return nil, fmt.Errorf("redis: empty reply")
+    }
+
+    switch line[0] {
+    case '+':
+        return line[1:], nil
+    case '-':
+        return nil, redisError(line[1:])
+    case ':':
+        return strconv.ParseInt(line[1:], 10, 64)
+    case '$':
+        length, err := strconv.Atoi(line[1:])
+        if err != nil {
+            return nil, err
+        }
+        if length < 0 {
+            return nil, nil // no such key
+        }
+        data := make([]byte, length+2)
+        if _, err := io.ReadFull(c.reader, data); err != nil {
+            return nil, err
+        }
+        return string(data[:length]), nil
+    case '*':
+        count, err := strconv.Atoi(line[1:])
+        if err != nil {
+            return nil, err
+        }
+        if count < 0 {
+            return nil, nil // EXEC after a WATCHed key changed
+        }
+        replies := make([]interface{}, count)
+        for i := range replies {
+            // Error replies inside EXEC's array belong to one command
+            if replies[i], err = c.readReply(); err != nil {
+                var replyErr redisError
+                if !errors.As(err, &replyErr) {
+                    return nil, err
+                }
+                replies[i] = err
+            }
+        }
+        return replies, nil
+    }
+    return nil, fmt.Errorf("redis: unexpected reply %q", line)
+}
+
+func (c *redisConn) Close() error {
+    return c.conn.Close()
+}
+
+// redisStore keeps inventory in Redis. The connection is only used with mu
+// held, so one is enough; it is dialled again after a failure.
+type redisStore struct {
+    url    string
+    prefix string
+    conn   *redisConn
+}
+
+// Helper function to set up the Redis store; the connection is checked
+// by Load
+func newRedisStore(rawURL string, prefix string) (*redisStore, error) {
+    if rawURL == "" {
+        rawURL = DefaultRedisURL
+    }
+    if prefix == "" {
+        prefix = DefaultRedisKeyPrefix
+    }
+    if parsed, err := url.Parse(rawURL); err != nil || parsed.Scheme != "redis" || parsed.Host == "" {
+        return nil, fmt.Errorf("REDIS_URL=%q must be a redis://host:port/db URL", rawURL)
+    }
+    return &redisStore{url: rawURL, prefix: prefix}, nil
+}
+
+func (s *redisStore) Describe() string {
+    parsed, _ := url.Parse(s.url)
+    return "Redis " + parsed.Redacted() + " under " + s.prefix
+}
+
+// Helper function to run a command, dialling first if need be. A failed
+// connection is dropped so the next command starts afresh.
+func (s *redisStore) do(args ...string) (interface{}, error) {
+    if s.conn == nil {
+        conn, err := dialRedis(s.url)
+        if err != nil {
+            return nil, err
+        }
+        s.conn = conn
+    }
+    reply, err := s.conn.do(args...)
+    var replyErr redisError
+    if err != nil && !errors.As(err, &replyErr) {
+        s.conn.Close()
+        s.conn = nil
+    }
+    return reply, err
+}
+
+func (s *redisStore) itemKey(productID string) string {
+    return s.prefix + "item:" + productID
+}
+
+func (s *redisStore) reservationKey(reservationID string) string {
+    return s.prefix + "reservation:" + reservationID
+}
+
+func (s *redisStore) productReservationsKey(productID string) string {
+    return s.prefix + "product:" + productID + ":reservations"
+}
+
+func (s *redisStore) movementsKey(productID string) string {
+    return s.prefix + "movements:" + productID
+}
+
+// Helper function to queue the command recording what a mutation did to a
+// product's stock, if it changed. A movement's position in the list is
+// its sequence number, so it is stored without one.
+func (s *redisStore) recordMovement(commands [][]string, entry *walEntry, before InventoryItem, after InventoryItem, reservation Reservation) [][]string {
+    movement, moved := stockMovement(*entry, before, after, reservation)
+    if !moved {
+        return commands
+    }
+    data, _ := json.Marshal(movement)
+    return append(commands, []string{"RPUSH", s.movementsKey(movement.ProductID), string(data)})
+}
+
+// Helper function to read a set's members
+func (s *redisStore) members(key string) ([]string, error) {
+    reply, err := s.do("SMEMBERS", key)
+    if err != nil {
+        return nil, err
+    }
+    values, _ := reply.([]interface{})
+    members := make([]string, 0, len(values))
+    for _, value := range values {
+        if member, ok := value.(string); ok {
+            members = append(members, member)
+        }
+    }
+    return members, nil
+}
+
+// Helper function to read a JSON record into out. Returns false when the
+// key doesn't exist.
+func (s *redisStore) get(key string, out interface{}) (bool, error) {
+    reply, err := s.do("GET", key)
+    if err != nil || reply == nil {
+        return false, err
+    }
+    data, _ := reply.(string)
+    if err := json.Unmarshal([]byte(data), out); err != nil {
+        return false, fmt.Errorf("corrupt record %s: %v", key, err)
+    }
+    return true, nil
+}
+
+// Helper function to run queued commands in one MULTI/EXEC. Returns false
+// when a WATCHed key changed and nothing was written.
+func (s *redisStore) exec(commands [][]string) (bool, error) {
+    if _, err := s.do("MULTI"); err != nil {
+        return false, err
+    }
+    for _, command := range commands {
+        if _, err := s.do(command...); err != nil {
+            s.do("DISCARD")
+            return false, err
+        }
+    }
+    reply, err := s.do("EXEC")
+    if err != nil {
+        return false, err
+    }
+    if reply == nil {
+        return false, nil
+    }
+    for _, result := range reply.([]interface{}) {
+        if err, failed := result.(error); failed {
+            return false, err
+        }
+    }
+    return true, nil
+}
+
+// Load reads every stock record and reservation into memory
+func (s *redisStore) Load() (int, error) {
+    mu.Lock()
+    defer mu.Unlock()
+
+    productIDs, err := s.members(s.prefix + "items")
+    if err != nil {
+        return 0, err
+    }
+    reservationIDs, err := s.members(s.prefix + "reservations")
+    if err != nil {
+        return 0, err
+    }
+
+    loaded := 0
+    for _, productID := range productIDs {
+        var item InventoryItem
+        if exists, err := s.get(s.itemKey(productID), &item); err != nil {
+            return loaded, err
+        } else if exists {
+            inventory[productID] = item
+            loaded++
+        }
+    }
+    for _, reservationID := range reservationIDs {
+        var reservation Reservation
+        if exists, err := s.get(s.reservationKey(reservationID), &reservation); err != nil {
+            return loaded, err
+        } else if exists {
+            reservations[reservationID] = reservation
+            loaded++
+        }
+    }
+
+    publishInventory()
+    return loaded, nil
+}
+
+// Apply writes a mutation to Redis, then to memory. Callers hold mu.
+func (s *redisStore) Apply(entry *walEntry) (string, error) {
+    entry.Seq = walSeq + 1
+
+    for attempt := 0; attempt < RedisTxnAttempts; attempt++ {
+        // Clearing and removing affect the whole store, as in applyEntryTo
+        var productID string
+        var done bool
+        var err error
+        switch entry.Op {
+        case OpClear:
+            done, err = s.clear(entry)
+        case OpRemove:
+            done, err = s.remove(entry)
+        case OpCommitAll:
+            done, err = s.commitAll(entry)
+        default:
+            productID, done, err = s.applyRecords(entry)
+        }
+        if err != nil {
+            s.do("UNWATCH")
+            return "", err
+        }
+        if done {
+            walSeq = entry.Seq
+            return productID, nil
+        }
+    }
+    return "", fmt.Errorf("%s on %s kept conflicting with other writers", entry.Op, entry.ProductID)
+}
+
+// Helper function to apply an entry that touches one stock record and at
+// most one reservation
+func (s *redisStore) applyRecords(entry *walEntry) (string, bool, error) {
+    scratchItems := make(map[string]InventoryItem)
+    scratchReservations := make(map[string]Reservation)
+
+    reservationID, productID := entry.ReservationID, entry.ProductID
+    if entry.Item != nil {
+        productID = entry.Item.ProductID
+    }
+    if entry.Reservation != nil {
+        reservationID, productID = entry.Reservation.ReservationID, entry.Reservation.ProductID
+    }
+
+    if reservationID != "" {
+        if _, err := s.do("WATCH", s.reservationKey(reservationID)); err != nil {
+            return "", false, err
+        }
+        var reservation Reservation
+        exists, err := s.get(s.reservationKey(reservationID), &reservation)
+        if err != nil {
+            return "", false, err
+        }
+        if exists {
+            scratchReservations[reservationID] = reservation
+            if productID == "" {
+                productID = reservation.ProductID
+            }
+        }
+    }
+    if productID != "" {
+        if _, err := s.do("WATCH", s.itemKey(productID)); err != nil {
+            return "", false, err
+        }
+        var item InventoryItem
+        exists, err := s.get(s.itemKey(productID), &item)
+        if err != nil {
+            return "", false, err
+        }
+        if exists {
+            scratchItems[productID] = item
+        }
+    }
+
+    // The handler checked memory; the stored records have the last word.
+    // A fill also needs the backorder still waiting, as another instance
+    // may have filled or released it.
+    stored := itemLocations(scratchItems[productID])[warehouseOf(entry.WarehouseID)]
+    stale := entry.Op == OpFill && scratchReservations[reservationID].Status != "backordered"
+    if (entry.Op == OpReserve || entry.Op == OpFill) && (stored.Available < entry.Quantity || stale) {
+        s.do("UNWATCH")
+        if item, exists := scratchItems[productID]; exists {
+            inventory[productID] = item
+        }
+        if reservation, exists := scratchReservations[reservationID]; exists {
+            reservations[reservationID] = reservation
+        }
+        return "", false, errStockChanged
+    }
+
+    before := scratchItems[productID]
+    touched := applyEntryTo(scratchItems, scratchReservations, *entry)
+    if touched == "" {
+        // Nothing to change, e.g. releasing a reservation already released
+        s.do("UNWATCH")
+        return "", true, nil
+    }
+
+    var commands [][]string
+    if item, exists := scratchItems[productID]; exists {
+        data, _ := json.Marshal(item)
+        commands = append(commands,
+            []string{"SET", s.itemKey(productID), string(data)},
+            []string{"SADD", s.prefix + "items", productID})
+    }
+    if reservation, exists := scratchReservations[reservationID]; exists {
+        data, _ := json.Marshal(reservation)
+        commands = append(commands,
+            []string{"SET", s.reservationKey(reservationID), string(data)},
+            []string{"SADD", s.prefix + "reservations", reservationID},
+            []string{"SADD", s.productReservationsKey(reservation.ProductID), reservationID})
+    }
+    commands = s.recordMovement(commands, entry, before, scratchItems[productID], scratchReservations[reservationID])
+    done, err := s.exec(commands)
+    if !done || err != nil {
+        return "", done, err
+    }
+
+    if item, exists := scratchItems[productID]; exists {
+        inventory[productID] = item
+    }
+    if reservation, exists := scratchReservations[reservationID]; exists {
+        reservations[reservationID] = reservation
+    }
+    return touched, true, nil
+}
+
+// Helper function to commit several reservations in one transaction. All
+// of them must still be held in the store, or none is committed.
+func (s *redisStore) commitAll(entry *walEntry) (bool, error) {
+    scratchItems := make(map[string]InventoryItem)
+    scratchReservations := make(map[string]Reservation)
+
+    var productIDs []string
+    for _, reservationID := range entry.ReservationIDs {
+        if _, err := s.do("WATCH", s.reservationKey(reservationID)); err != nil {
+            return false, err
+        }
+        var reservation Reservation
+        exists, err := s.get(s.reservationKey(reservationID), &reservation)
+        if err != nil {
+            return false, err
+        }
+        if exists {
+            scratchReservations[reservationID] = reservation
+        }
+        if !exists || reservation.Status != "reserved" {
+            // Released, expired or committed by another instance
+            s.do("UNWATCH")
+            if exists {
+                reservations[reservationID] = reservation
+            } else {
+                delete(reservations, reservationID)
+            }
+            return false, errStockChanged
+        }
+        if _, seen := scratchItems[reservation.ProductID]; seen {
+            continue
+        }
+        if _, err := s.do("WATCH", s.itemKey(reservation.ProductID)); err != nil {
+            return false, err
+        }
+        var item InventoryItem
+        if _, err := s.get(s.itemKey(reservation.ProductID), &item); err != nil {
+            return false, err
+        }
+        scratchItems[reservation.ProductID] = item
+        productIDs = append(productIDs, reservation.ProductID)
+    }
+
+    before := make(map[string]InventoryItem, len(scratchItems))
+    for productID, item := range scratchItems {
+        before[productID] = item
+    }
+    applyEntryTo(scratchItems, scratchReservations, *entry)
+
+    var commands [][]string
+    for _, productID := range productIDs {
+        data, _ := json.Marshal(scratchItems[productID])
+        commands = append(commands, []string{"SET", s.itemKey(productID), string(data)})
+        commands = s.recordMovement(commands, entry, before[productID], scratchItems[productID], movementReservation(scratchReservations, *entry, productID))
+    }
+    for reservationID, reservation := range scratchReservations {
+        data, _ := json.Marshal(reservation)
+        commands = append(commands, []string{"SET", s.reservationKey(reservationID), string(data)})
+    }
+    done, err := s.exec(commands)
+    if !done || err != nil {
+        return done, err
+    }
+
+    for productID, item := range scratchItems {
+        inventory[productID] = item
+    }
+    for reservationID, reservation := range scratchReservations {
+        reservations[reservationID] = reservation
+    }
+    return true, nil
+}
+
+// Helper function to drop one product, its stock record and reservations
+func (s *redisStore) remove(entry *walEntry) (bool, error) {
+    indexKey := s.productReservationsKey(entry.ProductID)
+    if _, err := s.do("WATCH", indexKey); err != nil {
+        return false, err
+    }
+    reservationIDs, err := s.members(indexKey)
+    if err != nil {
+        return false, err
+    }
+
+    commands := [][]string{
+        {"DEL", s.itemKey(entry.ProductID), indexKey},
+        {"SREM", s.prefix + "items", entry.ProductID},
+    }
+    for _, reservationID := range reservationIDs {
+        commands = append(commands,
+            []string{"DEL", s.reservationKey(reservationID)},
+            []string{"SREM", s.prefix + "reservations", reservationID})
+    }
+    commands = s.recordMovement(commands, entry, inventory[entry.ProductID], InventoryItem{}, Reservation{})
+    done, err := s.exec(commands)
+    if done {
+        applyEntry(*entry)
+    }
+    return done, err
+}
+
+// Helper function to drop every stock record and reservation
+func (s *redisStore) clear(entry *walEntry) (bool, error) {
+    if _, err := s.do("WATCH", s.prefix+"items", s.prefix+"reservations"); err != nil {
+        return false, err
+    }
+    productIDs, err := s.members(s.prefix + "items")
+    if err != nil {
+        return false, err
+    }
+    reservationIDs, err := s.members(s.prefix + "reservations")
+    if err != nil {
+        return false, err
+    }
+
+    keys := []string{"DEL", s.prefix + "items", s.prefix + "reservations"}
+    for _, productID := range productIDs {
+        keys = append(keys, s.itemKey(productID), s.productReservationsKey(productID))
+    }
+    for _, reservationID := range reservationIDs {
+        keys = append(keys, s.reservationKey(reservationID))
+    }
+    commands := [][]string{keys}
+    for _, productID := range productIDs {
+        commands = s.recordMovement(commands, entry, inventory[productID], InventoryItem{}, Reservation{})
+    }
+    done, err := s.exec(commands)
+    if done {
+        applyEntry(*entry)
+    }
+    return done, err
+}
+
+// Movements reads a page of a product's movements list
+func (s *redisStore) Movements(productID string, cursor int64, limit int) ([]StockMovement, int64, error) {
+    mu.Lock()
+    defer mu.Unlock()
+
+    // One more than asked for tells whether there is another page
+    reply, err := s.do("LRANGE", s.movementsKey(productID), strconv.FormatInt(cursor, 10), strconv.FormatInt(cursor+int64(limit), 10))
+    if err != nil {
+        return nil, 0, err
+    }
+    values, _ := reply.([]interface{})
+
+    var movements []StockMovement
+    for i, value := range values {
+        if i == limit {
+            return movements, cursor + int64(limit), nil
+        }
+        data, _ := value.(string)
+        var movement StockMovement
+        if err := json.Unmarshal([]byte(data), &movement); err != nil {
+            return nil, 0, fmt.Errorf("corrupt movement %d of %s: %v", cursor+int64(i)+1, productID, err)
+        }
+        movement.Seq = cursor + int64(i) + 1
+        movements = append(movements, movement)
+    }
+    return movements, 0, nil
+}
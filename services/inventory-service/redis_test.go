@@ -0,0 +1,96 @@
+package main
+
+import (
+    "bufio"
+    "errors"
+    "net"
+    "reflect"
+    "strings"
+    "testing"
+)
+
+// Helper function to make a connection that reads replies from raw
+func replyConn(raw string) *redisConn {
+    return &redisConn{reader: bufio.NewReader(strings.NewReader(raw))}
+}
+
+func TestReadReply(t *testing.T) {
+    tests := []struct {
+        name string
+        raw  string
+        want interface{}
+        err  error
+    }{
+        {"status", "+OK\r\n", "OK", nil},
+        {"error", "-WRONGTYPE Operation against a key\r\n", nil, redisError("WRONGTYPE Operation against a key")},
+        {"integer", ":42\r\n", int64(42), nil},
+        {"negative integer", ":-1\r\n", int64(-1), nil},
+        {"bulk", "$5\r\nhello\r\n", "hello", nil},
+        {"bulk with CRLF inside", "$7\r\nab\r\ncde\r\n", "ab\r\ncde", nil},
+        {"empty bulk", "$0\r\n\r\n", "", nil},
+        {"nil bulk", "$-1\r\n", nil, nil},
+        {"array", "*3\r\n$3\r\nfoo\r\n:7\r\n$-1\r\n", []interface{}{"foo", int64(7), nil}, nil},
+        {"empty array", "*0\r\n", []interface{}{}, nil},
+        {"nil array", "*-1\r\n", nil, nil},
+        {"nested array", "*2\r\n*1\r\n+QUEUED\r\n:1\r\n", []interface{}{[]interface{}{"QUEUED"}, int64(1)}, nil},
+        {"error inside an array", "*2\r\n+OK\r\n-ERR no such key\r\n", []interface{}{"OK", redisError("ERR no such key")}, nil},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            got, err := replyConn(tt.raw).readReply()
+            if !reflect.DeepEqual(err, tt.err) {
+                t.Fatalf("readReply(%q) error = %v, want %v", tt.raw, err, tt.err)
+            }
+            if !reflect.DeepEqual(got, tt.want) {
+                t.Errorf("readReply(%q) = %#v, want %#v", tt.raw, got, tt.want)
+            }
+        })
+    }
+}
+
+func TestReadReplyRejects(t *testing.T) {
+    for _, raw := range []string{"\r\n", "?what\r\n", ":abc\r\n", "$abc\r\n", "$5\r\nhi\r\n", "*2\r\n+OK\r\n", "*x\r\n", ""} {
+        got, err := replyConn(raw).readReply()
+        if err == nil {
+            t.Errorf("readReply(%q) = %#v, want an error", raw, got)
+        }
+        var replyErr redisError
+        if errors.As(err, &replyErr) {
+            t.Errorf("readReply(%q) error = %v, want a protocol error, not a reply", raw, err)
+        }
+    }
+}
+
+// Commands go out as arrays of bulk strings, and the reply is read back
+func TestDoRoundTrip(t *testing.T) {
+    client, server := net.Pipe()
+    defer client.Close()
+    defer server.Close()
+
+    received := make(chan string, 1)
+    go func() {
+        reader := bufio.NewReader(server)
+        var command strings.Builder
+        for i := 0; i < 7; i++ {
+            line, err := reader.ReadString('\n')
+            if err != nil {
+                break
+            }
+            command.WriteString(line)
+        }
+        received <- command.String()
+        server.Write([]byte("$3\r\nbar\r\n"))
+    }()
+
+    conn := &redisConn{conn: client, reader: bufio.NewReader(client)}
+    got, err := conn.do("SET", "foo", "bar")
+    if err != nil {
+        t.Fatalf("do(SET foo bar) failed: %v", err)
+    }
+    if got != "bar" {
+        t.Errorf("do(SET foo bar) = %#v, want \"bar\"", got)
+    }
+    if command, want := <-received, "*3\r\n$3\r\nSET\r\n$3\r\nfoo\r\n$3\r\nbar\r\n"; command != want {
+        t.Errorf("sent %q, want %q", command, want)
+    }
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+    "time"
+
+    "middleware/slo"
+)
+
+func init() {
+    slo.Setup(serviceName, serviceObjectives(), nil)
+}
+
+// SLOs for the inventory service. Reservations sit on the add-to-cart
+// path, so they have to leave the cart service most of its budget.
+func serviceObjectives() []slo.Objective {
+    return []slo.Objective{
+        {
+            Name:        "reserve_latency",
+            Description: "99.5% of reservations complete within 200ms",
+            Method:      "POST",
+            Route:       "/api/inventory/reserve",
+            Target:      0.995,
+            Latency:     200 * time.Millisecond,
+        },
+        {
+            Name:        "availability",
+            Description: "99.9% of requests succeed",
+            Target:      0.999,
+        },
+    }
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+    "errors"
+    "fmt"
+    "os"
+)
+
+// Inventory storage. Every mutation is a walEntry; the store makes it
+// durable and applies it to the in-memory stores, which serve reads.
+// INVENTORY_STORE picks the store:
+//
+//   - wal (the default): appended to the write-ahead log at WAL_PATH and
+//     replayed from it on startup (see wal.go)
+//   - redis: written to REDIS_URL, each mutation in one transaction that
+//     re-checks the stored stock and reservation first (see redis.go)
+//
+// Settings are read once at startup.
+const (
+    StoreWAL   = "wal"
+    StoreRedis = "redis"
+)
+
+// inventoryStore persists inventory mutations
+type inventoryStore interface {
+    // Load fills the in-memory stores from what was persisted, on startup.
+    // Returns the number of records loaded; zero means a fresh store.
+    Load() (int, error)
+
+    // Apply makes a mutation durable, then applies it to the in-memory
+    // stores. Returns the product it touched, "" when it affects the whole
+    // store. Nothing is applied when it returns an error. Callers hold mu.
+    Apply(entry *walEntry) (string, error)
+
+    // Movements lists a product's stock movements after position cursor,
+    // at most limit of them, oldest first (see movements.go). Returns the
+    // cursor of the next page, 0 when there is none. Callers don't hold mu.
+    Movements(productID string, cursor int64, limit int) ([]StockMovement, int64, error)
+
+    // Describe names where the store keeps its data, for logs
+    Describe() string
+}
+
+// errStockChanged is returned for a reservation or backorder fill the
+// stored stock no longer covers, or a commit_all of reservations no longer
+// all held, because something else wrote to the store
+var errStockChanged = errors.New("stored stock no longer covers the reservation")
+
+var (
+    storeBackend = os.Getenv("INVENTORY_STORE")
+    store        inventoryStore
+)
+
+// Helper function to open the configured store
+func openStore() (inventoryStore, error) {
+    switch storeBackend {
+    case "", StoreWAL:
+        storeBackend = StoreWAL
+        return walStore{}, nil
+    case StoreRedis:
+        return newRedisStore(os.Getenv("REDIS_URL"), os.Getenv("REDIS_KEY_PREFIX"))
+    default:
+        return nil, fmt.Errorf("INVENTORY_STORE=%q must be %s or %s", storeBackend, StoreWAL, StoreRedis)
+    }
+}
+
+// walStore keeps inventory in the write-ahead log
+type walStore struct{}
+
+func (walStore) Load() (int, error) {
+    return openWAL()
+}
+
+func (walStore) Apply(entry *walEntry) (string, error) {
+    if err := appendWAL(entry); err != nil {
+        return "", err
+    }
+    return applyEntry(*entry), nil
+}
+
+func (walStore) Movements(productID string, cursor int64, limit int) ([]StockMovement, int64, error) {
+    return walMovements(productID, cursor, limit)
+}
+
+func (walStore) Describe() string {
+    if walPath == "" {
+        return "memory only (WAL_PATH is empty)"
+    }
+    return "WAL " + walPath
+}
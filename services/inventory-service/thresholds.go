@@ -0,0 +1,142 @@
+package main
+
+import (
+    "encoding/json"
+    "log"
+    "net/http"
+    "sort"
+    "strconv"
+    "time"
+
+    "events"
+    "github.com/gorilla/mux"
+    "middleware/adminauth"
+)
+
+// Low-stock alerts. POST /api/inventory/{productId}/threshold with
+// {"threshold": N} sets a product's reorder threshold; 0 removes it. When
+// the product's available stock, over every warehouse, falls below its
+// threshold, low_stock_since records when, the drop is logged and an
+// inventory.low_stock event is sent (see events.go). Each drop is
+// announced once: stock has to come back up to the threshold before the
+// next drop alerts again. The mark is kept with the stock record, so a
+// restart doesn't repeat alerts. GET /api/inventory/low-stock lists the
+// products below their threshold.
+
+// ThresholdRequest sets a product's reorder threshold
+type ThresholdRequest struct {
+    Threshold *int `json:"threshold"`
+}
+
+// lowStockItem is a product below its threshold, in the low-stock report
+type lowStockItem struct {
+    InventoryItem
+    Shortfall int `json:"shortfall"` // units short of the threshold
+}
+
+// Helper function to mark an item low on stock, or no longer low, after a
+// change. Part of every applied mutation, so replays mark the same drops.
+func markLowStock(item InventoryItem, at int64) InventoryItem {
+    if item.ReorderThreshold > 0 && item.Available < item.ReorderThreshold {
+        if item.LowStockSince == 0 {
+            item.LowStockSince = at
+        }
+    } else {
+        item.LowStockSince = 0
+    }
+    return item
+}
+
+// Helper function to get the product a mutation will change, before it
+// is applied. Callers must hold mu.
+func entryProductID(entry walEntry) string {
+    switch {
+    case entry.Item != nil:
+        return entry.Item.ProductID
+    case entry.Reservation != nil:
+        return entry.Reservation.ProductID
+    case entry.ProductID != "":
+        return entry.ProductID
+    }
+    return reservations[entry.ReservationID].ProductID
+}
+
+// Helper function to alert on an item that a mutation took below its
+// threshold. before is the item as it was. Callers must hold mu.
+func alertLowStock(before InventoryItem, productID string) {
+    item, exists := inventory[productID]
+    if !exists || item.LowStockSince == 0 || (before.ProductID == productID && before.LowStockSince != 0) {
+        return
+    }
+
+    log.Printf("Product %s is low on stock: %d available, reorder threshold %d", productID, item.Available, item.ReorderThreshold)
+    eventID := inventoryEventID(EventLowStock, productID+"@"+strconv.FormatInt(item.LowStockSince, 10))
+    queueEvent(EventLowStock, "product "+productID, eventID, item.LowStockSince, events.LowStock{
+        ProductID:        productID,
+        Available:        item.Available,
+        Reserved:         item.Reserved,
+        TotalStock:       item.TotalStock,
+        ReorderThreshold: item.ReorderThreshold,
+    })
+}
+
+// Admin endpoint to set a product's reorder threshold. It sits with the
+// inventory API but needs ADMIN_TOKEN like the /admin routes.
+func setThresholdHandler(w http.ResponseWriter, r *http.Request) {
+    productID := mux.Vars(r)["productId"]
+
+    var req ThresholdRequest
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+        http.Error(w, "Invalid JSON", http.StatusBadRequest)
+        return
+    }
+    if req.Threshold == nil || *req.Threshold < 0 {
+        http.Error(w, "threshold must be a non-negative number of units; 0 removes it", http.StatusBadRequest)
+        return
+    }
+
+    mu.Lock()
+    defer mu.Unlock()
+
+    if _, exists := inventory[productID]; !exists {
+        http.Error(w, "Product not found in inventory", http.StatusNotFound)
+        return
+    }
+    err := logAndApply(walEntry{
+        Op:        OpThreshold,
+        Timestamp: time.Now().Unix(),
+        ProductID: productID,
+        Quantity:  *req.Threshold,
+        Actor:     ActorAdmin,
+    })
+    if err != nil {
+        http.Error(w, "Failed to persist threshold", http.StatusInternalServerError)
+        return
+    }
+    adminauth.Audit(r, "threshold", map[string]interface{}{"product_id": productID, "threshold": *req.Threshold})
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(inventory[productID])
+}
+
+// List the products below their reorder threshold, furthest below first
+func lowStockReportHandler(w http.ResponseWriter, r *http.Request) {
+    low := []lowStockItem{}
+    for _, item := range loadAllItems() {
+        if item.LowStockSince != 0 {
+            low = append(low, lowStockItem{InventoryItem: item, Shortfall: item.ReorderThreshold - item.Available})
+        }
+    }
+    sort.Slice(low, func(i, j int) bool {
+        if low[i].Shortfall != low[j].Shortfall {
+            return low[i].Shortfall > low[j].Shortfall
+        }
+        return low[i].ProductID < low[j].ProductID
+    })
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "items": low,
+        "count": len(low),
+    })
+}
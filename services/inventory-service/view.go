@@ -0,0 +1,73 @@
+package main
+
+import "sync/atomic"
+
+// inventoryView is the read path for availability checks. The map itself is
+// immutable once published and each item sits behind its own atomic pointer,
+// so readers never touch mu: a stock change swaps one item pointer, and only
+// adding products or clearing the store copies the map (copy-on-write).
+type inventoryView struct {
+    items map[string]*atomic.Pointer[InventoryItem]
+}
+
+var currentView atomic.Pointer[inventoryView]
+
+func init() {
+    currentView.Store(&inventoryView{items: make(map[string]*atomic.Pointer[InventoryItem])})
+}
+
+// Helper function to rebuild the whole view (startup, clear).
+// Callers must hold mu.
+func publishInventory() {
+    items := make(map[string]*atomic.Pointer[InventoryItem], len(inventory))
+    for productID, item := range inventory {
+        item := item
+        slot := &atomic.Pointer[InventoryItem]{}
+        slot.Store(&item)
+        items[productID] = slot
+    }
+    currentView.Store(&inventoryView{items: items})
+}
+
+// Helper function to publish one product's latest state. Callers must hold mu.
+func publishItem(productID string) {
+    item, exists := inventory[productID]
+    if !exists {
+        return
+    }
+
+    view := currentView.Load()
+    if slot, exists := view.items[productID]; exists {
+        slot.Store(&item)
+        return
+    }
+
+    // New product: copy the map so in-flight readers keep a consistent view
+    items := make(map[string]*atomic.Pointer[InventoryItem], len(view.items)+1)
+    for id, slot := range view.items {
+        items[id] = slot
+    }
+    slot := &atomic.Pointer[InventoryItem]{}
+    slot.Store(&item)
+    items[productID] = slot
+    currentView.Store(&inventoryView{items: items})
+}
+
+// Helper function to read a product's availability without locking
+func loadItem(productID string) (InventoryItem, bool) {
+    slot, exists := currentView.Load().items[productID]
+    if !exists {
+        return InventoryItem{}, false
+    }
+    return *slot.Load(), true
+}
+
+// Helper function to read every product without locking
+func loadAllItems() []InventoryItem {
+    view := currentView.Load()
+    items := make([]InventoryItem, 0, len(view.items))
+    for _, slot := range view.items {
+        items = append(items, *slot.Load())
+    }
+    return items
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+    "fmt"
+    "sync"
+    "sync/atomic"
+    "testing"
+)
+
+// Availability reads from many goroutines while reservations change stock
+// back to back: the published view against reading inventory under mu, as
+// reads did before the view
+func BenchmarkInventoryReads(b *testing.B) {
+    const products = 1000
+    productIDs := make([]string, products)
+
+    mu.Lock()
+    inventory = make(map[string]InventoryItem, products)
+    for i := range productIDs {
+        productIDs[i] = fmt.Sprintf("bench-product-%d", i)
+        inventory[productIDs[i]] = InventoryItem{ProductID: productIDs[i], Available: 1 << 30, TotalStock: 1 << 30}
+    }
+    publishInventory()
+    mu.Unlock()
+
+    reads := []struct {
+        name string
+        read func(productID string) (InventoryItem, bool)
+    }{
+        {"view", loadItem},
+        {"locked", func(productID string) (InventoryItem, bool) {
+            mu.RLock()
+            defer mu.RUnlock()
+            item, exists := inventory[productID]
+            return item, exists
+        }},
+    }
+
+    for _, read := range reads {
+        b.Run(read.name, func(b *testing.B) {
+            stop := make(chan struct{})
+            var reservations sync.WaitGroup
+            reservations.Add(1)
+            go func() {
+                defer reservations.Done()
+                for n := 0; ; n++ {
+                    select {
+                    case <-stop:
+                        return
+                    default:
+                    }
+                    productID := productIDs[n%products]
+                    mu.Lock()
+                    item := inventory[productID]
+                    item.Available--
+                    item.Reserved++
+                    inventory[productID] = item
+                    publishItem(productID)
+                    mu.Unlock()
+                }
+            }()
+
+            var next atomic.Int64
+            b.ResetTimer()
+            b.RunParallel(func(pb *testing.PB) {
+                for pb.Next() {
+                    if _, exists := read.read(productIDs[int(next.Add(1))%products]); !exists {
+                        b.Error("product missing")
+                        return
+                    }
+                }
+            })
+            b.StopTimer()
+            close(stop)
+            reservations.Wait()
+        })
+    }
+}
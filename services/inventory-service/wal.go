@@ -0,0 +1,383 @@
+package main
+
+import (
+    "bufio"
+    "encoding/json"
+    "fmt"
+    "log"
+    "os"
+    "path/filepath"
+)
+
+// WAL operations
+const (
+    OpAdjust  = "adjust"
+    OpReserve = "reserve"
+    OpRelease = "release"
+    OpCommit  = "commit"
+    OpExpire  = "expire"
+    OpClear   = "clear"
+    OpRemove  = "remove" // drop one product and its reservations
+    OpRestore = "restore" // write a stock record or reservation from a backup
+    OpReturn    = "return"    // put units of a committed reservation back into stock
+    OpBackorder = "backorder" // hold a reservation the stock can't cover yet
+    OpFill      = "fill"      // take the stock for a backordered reservation
+    OpThreshold = "threshold" // set a product's reorder threshold
+    OpCommitAll = "commit_all" // commit several reservations at once
+)
+
+// walEntry is one inventory mutation. Entries carry everything needed to
+// re-apply the mutation deterministically (IDs, timestamps), so replaying the
+// log rebuilds the exact same stock counts and reservations.
+type walEntry struct {
+    Seq            int64          `json:"seq"`
+    Op             string         `json:"op"`
+    Timestamp      int64          `json:"ts"`
+    ProductID      string         `json:"product_id,omitempty"`
+    Quantity       int            `json:"quantity,omitempty"` // the threshold for threshold entries
+    Operation      string         `json:"operation,omitempty"` // add, set (adjust only)
+    WarehouseID    string         `json:"warehouse_id,omitempty"` // adjust and reserve; "" before warehouses
+    ReservationID  string         `json:"reservation_id,omitempty"`
+    ReservationIDs []string       `json:"reservation_ids,omitempty"` // commit_all only
+    CartID         string         `json:"cart_id,omitempty"` // reserve entries written before references
+    ReferenceType  string         `json:"reference_type,omitempty"`
+    Reference      string         `json:"reference,omitempty"`
+    ExpiresAt      int64          `json:"expires_at,omitempty"`
+    ExpectedAt     int64          `json:"expected_at,omitempty"` // backorder only
+    QueuedAt       int64          `json:"queued_at,omitempty"`   // backorder only
+    OrderID        string         `json:"order_id,omitempty"`   // commit and commit_all only
+    ReleaseID      string         `json:"release_id,omitempty"` // return only
+    Actor          string         `json:"actor,omitempty"`      // who made it (see movements.go); "" before actors
+    Item           *InventoryItem `json:"item,omitempty"`        // restore only
+    Reservation    *Reservation   `json:"reservation,omitempty"` // restore only
+}
+
+// Write-ahead log settings (WAL_PATH="" disables the log). The log file and
+// walSeq are guarded by mu, which also serializes the in-memory mutations,
+// so log order always matches apply order.
+var (
+    walPath = os.Getenv("WAL_PATH")
+    walFile *os.File
+    walSeq  int64
+)
+
+func init() {
+    if _, set := os.LookupEnv("WAL_PATH"); !set {
+        walPath = "data/inventory.wal"
+    }
+}
+
+// Helper function to append an entry and fsync it. Callers must hold mu and
+// must not mutate state if this returns an error.
+func appendWAL(entry *walEntry) error {
+    entry.Seq = walSeq + 1
+    if walFile == nil {
+        walSeq = entry.Seq
+        return nil
+    }
+
+    data, err := json.Marshal(entry)
+    if err != nil {
+        return err
+    }
+    data = append(data, '\n')
+
+    if _, err := walFile.Write(data); err != nil {
+        return err
+    }
+    if err := walFile.Sync(); err != nil {
+        return err
+    }
+
+    walSeq = entry.Seq
+    return nil
+}
+
+// Helper function to persist then apply a mutation through the configured
+// store (see store.go). Callers must hold mu.
+func logAndApply(entry walEntry) error {
+    before := inventory[entryProductID(entry)]
+    productID, err := store.Apply(&entry)
+    if err != nil {
+        log.Printf("Failed to persist %s: %v", entry.Op, err)
+        return err
+    }
+    if productID != "" {
+        publishItem(productID)
+        alertLowStock(before, productID)
+    } else {
+        publishInventory()
+    }
+    return nil
+}
+
+// Apply a logged mutation to the in-memory stores and return the product it
+// touched ("" when it affects the whole store). Callers must hold mu.
+// Validation happens before logging, so this never rejects an entry.
+func applyEntry(entry walEntry) string {
+    return applyEntryTo(inventory, reservations, entry)
+}
+
+// Helper function to apply a logged mutation to the given stores. Replays
+// into scratch stores (as-of queries) share it with the live path, so
+// history is rebuilt with exactly the same rules.
+func applyEntryTo(inventory map[string]InventoryItem, reservations map[string]Reservation, entry walEntry) string {
+    productID := applyMutation(inventory, reservations, entry)
+    if item, exists := inventory[productID]; exists {
+        inventory[productID] = markLowStock(item, entry.Timestamp)
+    }
+    return productID
+}
+
+// Helper function to apply a mutation's own change, for applyEntryTo
+func applyMutation(inventory map[string]InventoryItem, reservations map[string]Reservation, entry walEntry) string {
+    switch entry.Op {
+    case OpAdjust:
+        item, exists := inventory[entry.ProductID]
+        if !exists {
+            item = InventoryItem{ProductID: entry.ProductID}
+        }
+        item = withLocation(item, warehouseOf(entry.WarehouseID), func(stock *LocationStock) {
+            switch entry.Operation {
+            case "add":
+                stock.Available += entry.Quantity
+                stock.TotalStock += entry.Quantity
+            case "set":
+                stock.TotalStock = entry.Quantity
+                stock.Available = entry.Quantity - stock.Reserved
+            }
+        })
+        item.LastUpdated = entry.Timestamp
+        inventory[entry.ProductID] = item
+        return entry.ProductID
+
+    case OpReserve, OpBackorder:
+        referenceType, reference := entry.ReferenceType, entry.Reference
+        if referenceType == "" {
+            referenceType, reference = ReferenceTypeCart, entry.CartID
+        }
+        cartID := ""
+        if referenceType == ReferenceTypeCart {
+            cartID = reference
+        }
+        reservation := Reservation{
+            ReservationID: entry.ReservationID,
+            ProductID:     entry.ProductID,
+            Quantity:      entry.Quantity,
+            CartID:        cartID,
+            ReferenceType: referenceType,
+            Reference:     reference,
+            CreatedAt:     entry.Timestamp,
+            ExpiresAt:     entry.ExpiresAt,
+            Status:        "reserved",
+            WarehouseID:   warehouseOf(entry.WarehouseID),
+        }
+        if entry.Op == OpBackorder {
+            // No stock is taken until the backorder is filled
+            reservation.Status = "backordered"
+            reservation.ExpectedAt = entry.ExpectedAt
+            reservation.QueuedAt = entry.QueuedAt
+            reservations[entry.ReservationID] = reservation
+            return entry.ProductID
+        }
+        reservations[entry.ReservationID] = reservation
+
+        item := withLocation(inventory[entry.ProductID], warehouseOf(entry.WarehouseID), func(stock *LocationStock) {
+            stock.Available -= entry.Quantity
+            stock.Reserved += entry.Quantity
+        })
+        item.LastUpdated = entry.Timestamp
+        inventory[entry.ProductID] = item
+        return entry.ProductID
+
+    case OpFill:
+        reservation, exists := reservations[entry.ReservationID]
+        if !exists || reservation.Status != "backordered" {
+            return ""
+        }
+
+        item := withLocation(inventory[reservation.ProductID], warehouseOf(reservation.WarehouseID), func(stock *LocationStock) {
+            stock.Available -= reservation.Quantity
+            stock.Reserved += reservation.Quantity
+        })
+        item.LastUpdated = entry.Timestamp
+        inventory[reservation.ProductID] = item
+
+        reservation.Status = "reserved"
+        reservation.FilledAt = entry.Timestamp
+        reservation.ExpiresAt = entry.ExpiresAt
+        reservations[entry.ReservationID] = reservation
+        return reservation.ProductID
+
+    case OpRelease, OpExpire:
+        reservation, exists := reservations[entry.ReservationID]
+        if exists && reservation.Status == "backordered" {
+            // Nothing was taken from stock yet
+            reservation.Status = "expired"
+            reservations[entry.ReservationID] = reservation
+            return reservation.ProductID
+        }
+        if !exists || reservation.Status != "reserved" {
+            return ""
+        }
+
+        item := withLocation(inventory[reservation.ProductID], warehouseOf(reservation.WarehouseID), func(stock *LocationStock) {
+            stock.Available += reservation.Quantity
+            stock.Reserved -= reservation.Quantity
+        })
+        item.LastUpdated = entry.Timestamp
+        inventory[reservation.ProductID] = item
+
+        reservation.Status = "expired"
+        reservations[entry.ReservationID] = reservation
+        return reservation.ProductID
+
+    case OpCommit:
+        return commitTo(inventory, reservations, entry.ReservationID, entry)
+
+    case OpCommitAll:
+        // Touches several products, so it is reported like a clear
+        for _, reservationID := range entry.ReservationIDs {
+            commitTo(inventory, reservations, reservationID, entry)
+        }
+
+    case OpReturn:
+        reservation, exists := reservations[entry.ReservationID]
+        if !exists || reservation.Status != "committed" {
+            return ""
+        }
+
+        item := withLocation(inventory[reservation.ProductID], warehouseOf(reservation.WarehouseID), func(stock *LocationStock) {
+            stock.Available += entry.Quantity
+            stock.TotalStock += entry.Quantity
+        })
+        item.LastUpdated = entry.Timestamp
+        inventory[reservation.ProductID] = item
+
+        reservation.Returned += entry.Quantity
+        reservation.ReleaseIDs = append(reservation.ReleaseIDs, entry.ReleaseID)
+        reservations[entry.ReservationID] = reservation
+        return reservation.ProductID
+
+    case OpThreshold:
+        item, exists := inventory[entry.ProductID]
+        if !exists {
+            return ""
+        }
+        item.ReorderThreshold = entry.Quantity
+        inventory[entry.ProductID] = item
+        return entry.ProductID
+
+    case OpRemove:
+        delete(inventory, entry.ProductID)
+        for reservationID, reservation := range reservations {
+            if reservation.ProductID == entry.ProductID {
+                delete(reservations, reservationID)
+            }
+        }
+
+    case OpRestore:
+        if entry.Item != nil {
+            inventory[entry.Item.ProductID] = *entry.Item
+            return entry.Item.ProductID
+        }
+        if entry.Reservation != nil {
+            reservation := *entry.Reservation
+            if reservation.ReferenceType == "" {
+                // Backups taken before references hold cart reservations only
+                reservation.ReferenceType, reservation.Reference = ReferenceTypeCart, reservation.CartID
+            }
+            reservations[reservation.ReservationID] = reservation
+            return entry.Reservation.ProductID
+        }
+
+    case OpClear:
+        clear(inventory)
+        clear(reservations)
+    }
+    return ""
+}
+
+// Helper function to commit one reservation, for commit and commit_all
+// entries. Returns the product it touched, "" when it wasn't held.
+func commitTo(inventory map[string]InventoryItem, reservations map[string]Reservation, reservationID string, entry walEntry) string {
+    reservation, exists := reservations[reservationID]
+    if !exists || reservation.Status != "reserved" {
+        return ""
+    }
+
+    item := withLocation(inventory[reservation.ProductID], warehouseOf(reservation.WarehouseID), func(stock *LocationStock) {
+        stock.Reserved -= reservation.Quantity
+        stock.TotalStock -= reservation.Quantity
+    })
+    item.LastUpdated = entry.Timestamp
+    inventory[reservation.ProductID] = item
+
+    reservation.Status = "committed"
+    reservation.CommittedAt = entry.Timestamp
+    reservation.OrderID = entry.OrderID
+    if reservation.OrderID == "" && reservation.ReferenceType == "order" {
+        reservation.OrderID = reservation.Reference
+    }
+    reservations[reservationID] = reservation
+    return reservation.ProductID
+}
+
+// Replay the WAL into memory and open it for appending. Returns the number
+// of entries replayed; zero means this is a fresh store.
+func openWAL() (int, error) {
+    if walPath == "" {
+        return 0, nil
+    }
+
+    if err := os.MkdirAll(filepath.Dir(walPath), 0755); err != nil {
+        return 0, err
+    }
+
+    file, err := os.OpenFile(walPath, os.O_RDWR|os.O_CREATE, 0644)
+    if err != nil {
+        return 0, err
+    }
+
+    mu.Lock()
+    defer mu.Unlock()
+
+    replayed := 0
+    validBytes := int64(0)
+    reader := bufio.NewReader(file)
+    for {
+        line, err := reader.ReadBytes('\n')
+        if err != nil {
+            // A trailing line without a newline is a write torn by a crash;
+            // it was never acknowledged, so drop it
+            if len(line) > 0 {
+                log.Printf("Discarding incomplete WAL record at offset %d", validBytes)
+            }
+            break
+        }
+
+        var entry walEntry
+        if err := json.Unmarshal(line, &entry); err != nil {
+            file.Close()
+            return replayed, fmt.Errorf("corrupt WAL record at offset %d: %v", validBytes, err)
+        }
+
+        applyEntry(entry)
+        walSeq = entry.Seq
+        validBytes += int64(len(line))
+        replayed++
+    }
+
+    if err := file.Truncate(validBytes); err != nil {
+        file.Close()
+        return replayed, err
+    }
+    if _, err := file.Seek(validBytes, 0); err != nil {
+        file.Close()
+        return replayed, err
+    }
+
+    walFile = file
+    publishInventory()
+    return replayed, nil
+}
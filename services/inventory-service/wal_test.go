@@ -0,0 +1,199 @@
+package main
+
+import (
+    "encoding/json"
+    "os"
+    "path/filepath"
+    "testing"
+)
+
+// Helper function to write entries to a WAL file, one JSON line each,
+// followed by torn (a record cut off by a crash)
+func writeWAL(t *testing.T, path string, entries []walEntry, torn string) {
+    t.Helper()
+    var data []byte
+    for i, entry := range entries {
+        entry.Seq = int64(i + 1)
+        line, err := json.Marshal(entry)
+        if err != nil {
+            t.Fatal(err)
+        }
+        data = append(append(data, line...), '\n')
+    }
+    data = append(data, torn...)
+    if err := os.WriteFile(path, data, 0644); err != nil {
+        t.Fatal(err)
+    }
+}
+
+// Helper function to replay the WAL at path into empty stores, as at
+// startup. The live stores and WAL settings are put back after the test.
+func replayWAL(t *testing.T, path string) int {
+    t.Helper()
+    savedPath, savedFile, savedSeq := walPath, walFile, walSeq
+    savedInventory, savedReservations := inventory, reservations
+    t.Cleanup(func() {
+        if walFile != nil {
+            walFile.Close()
+        }
+        mu.Lock()
+        walPath, walFile, walSeq = savedPath, savedFile, savedSeq
+        inventory, reservations = savedInventory, savedReservations
+        publishInventory()
+        mu.Unlock()
+    })
+
+    mu.Lock()
+    walPath, walFile, walSeq = path, nil, 0
+    inventory = make(map[string]InventoryItem)
+    reservations = make(map[string]Reservation)
+    mu.Unlock()
+
+    replayed, err := openWAL()
+    if err != nil {
+        t.Fatalf("openWAL() failed: %v", err)
+    }
+    return replayed
+}
+
+// Stock, reservations and commits come back from the log as they were
+// made, including commit_all entries and order references
+func TestOpenWALReplay(t *testing.T) {
+    path := filepath.Join(t.TempDir(), "inventory.wal")
+    entries := []walEntry{
+        {Op: OpAdjust, Timestamp: 100, ProductID: "prod-1", Operation: "add", Quantity: 10},
+        {Op: OpAdjust, Timestamp: 100, ProductID: "prod-2", Operation: "set", Quantity: 5},
+        {Op: OpReserve, Timestamp: 110, ProductID: "prod-1", Quantity: 3, ReservationID: "res-1", ReferenceType: ReferenceTypeCart, Reference: "cart-1", ExpiresAt: 1000},
+        {Op: OpReserve, Timestamp: 110, ProductID: "prod-2", Quantity: 2, ReservationID: "res-2", ReferenceType: ReferenceTypeCart, Reference: "cart-1", ExpiresAt: 1000},
+        {Op: OpReserve, Timestamp: 120, ProductID: "prod-1", Quantity: 1, ReservationID: "res-3", ReferenceType: "order", Reference: "order-9", ExpiresAt: 1000},
+        {Op: OpReserve, Timestamp: 120, ProductID: "prod-2", Quantity: 1, ReservationID: "res-4", CartID: "cart-old", ExpiresAt: 1000},
+        {Op: OpCommitAll, Timestamp: 130, ReservationIDs: []string{"res-1", "res-2", "res-missing"}, OrderID: "order-1"},
+        {Op: OpCommit, Timestamp: 140, ReservationID: "res-3"},
+        {Op: OpCommitAll, Timestamp: 150, ReservationIDs: []string{"res-1"}, OrderID: "order-2"},
+        {Op: OpExpire, Timestamp: 160, ReservationID: "res-4"},
+    }
+    torn := `{"seq":11,"op":"adjust","product_id":"prod-1","operat`
+    writeWAL(t, path, entries, torn)
+    written, err := os.Stat(path)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    if replayed := replayWAL(t, path); replayed != len(entries) {
+        t.Errorf("replayed %d entries, want %d", replayed, len(entries))
+    }
+    if walSeq != int64(len(entries)) {
+        t.Errorf("walSeq = %d, want %d", walSeq, len(entries))
+    }
+
+    stock := map[string]LocationStock{
+        "prod-1": {Available: 6, Reserved: 0, TotalStock: 6},
+        "prod-2": {Available: 3, Reserved: 0, TotalStock: 3},
+    }
+    for productID, want := range stock {
+        item, exists := loadItem(productID)
+        if !exists {
+            t.Errorf("%s is missing after replay", productID)
+            continue
+        }
+        got := LocationStock{Available: item.Available, Reserved: item.Reserved, TotalStock: item.TotalStock}
+        if got != want {
+            t.Errorf("%s stock = %+v, want %+v", productID, got, want)
+        }
+        if location := item.Locations[DefaultWarehouseID]; location != want {
+            t.Errorf("%s stock at %s = %+v, want %+v", productID, DefaultWarehouseID, location, want)
+        }
+    }
+
+    held := []struct {
+        reservationID string
+        status        string
+        orderID       string
+        committedAt   int64
+        reference     string
+    }{
+        {"res-1", "committed", "order-1", 130, "cart-1"}, // the second commit_all is a no-op
+        {"res-2", "committed", "order-1", 130, "cart-1"},
+        {"res-3", "committed", "order-9", 140, "order-9"}, // the order comes from the reference
+        {"res-4", "expired", "", 0, "cart-old"},           // written before references
+    }
+    for _, want := range held {
+        reservation, exists := reservations[want.reservationID]
+        if !exists {
+            t.Errorf("%s is missing after replay", want.reservationID)
+            continue
+        }
+        if reservation.Status != want.status || reservation.OrderID != want.orderID || reservation.CommittedAt != want.committedAt || reservation.Reference != want.reference {
+            t.Errorf("%s = %s for order %q at %d (reference %q), want %s for order %q at %d (reference %q)",
+                want.reservationID, reservation.Status, reservation.OrderID, reservation.CommittedAt, reservation.Reference,
+                want.status, want.orderID, want.committedAt, want.reference)
+        }
+    }
+    if _, exists := reservations["res-missing"]; exists {
+        t.Error("commit_all made a reservation that was never held")
+    }
+
+    replayedLog, err := os.Stat(path)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if want := written.Size() - int64(len(torn)); replayedLog.Size() != want {
+        t.Errorf("log is %d bytes after replay, want %d with the torn record dropped", replayedLog.Size(), want)
+    }
+}
+
+// A corrupt record that ends in a newline was acknowledged, so it stops
+// the replay rather than being dropped like a torn write
+func TestOpenWALCorrupt(t *testing.T) {
+    path := filepath.Join(t.TempDir(), "inventory.wal")
+    writeWAL(t, path, []walEntry{{Op: OpAdjust, Timestamp: 100, ProductID: "prod-1", Operation: "add", Quantity: 10}}, "not json\n")
+
+    savedPath := walPath
+    defer func() { walPath = savedPath }()
+    walPath = path
+    mu.Lock()
+    savedInventory, savedReservations := inventory, reservations
+    inventory, reservations = make(map[string]InventoryItem), make(map[string]Reservation)
+    mu.Unlock()
+    defer func() {
+        mu.Lock()
+        inventory, reservations = savedInventory, savedReservations
+        mu.Unlock()
+    }()
+
+    if _, err := openWAL(); err == nil {
+        t.Error("openWAL() replayed a corrupt log, want an error")
+    }
+}
+
+// Replays into scratch stores (as-of queries) leave the live stores alone
+func TestApplyEntryToScratchStores(t *testing.T) {
+    scratchInventory := make(map[string]InventoryItem)
+    scratchReservations := make(map[string]Reservation)
+    for _, entry := range []walEntry{
+        {Op: OpAdjust, Timestamp: 100, ProductID: "prod-1", Operation: "add", Quantity: 4, WarehouseID: "wh-east"},
+        {Op: OpReserve, Timestamp: 110, ProductID: "prod-1", Quantity: 4, ReservationID: "res-1", ReferenceType: "order", Reference: "order-1", WarehouseID: "wh-east"},
+        {Op: OpThreshold, Timestamp: 115, ProductID: "prod-1", Quantity: 2},
+        {Op: OpCommitAll, Timestamp: 120, ReservationIDs: []string{"res-1"}},
+    } {
+        applyEntryTo(scratchInventory, scratchReservations, entry)
+    }
+
+    item := scratchInventory["prod-1"]
+    if got := item.Locations["wh-east"]; got != (LocationStock{}) {
+        t.Errorf("stock at wh-east = %+v, want none left", got)
+    }
+    if item.LowStockSince != 115 {
+        t.Errorf("LowStockSince = %d, want 115, when the threshold was set", item.LowStockSince)
+    }
+    if reservation := scratchReservations["res-1"]; reservation.Status != "committed" || reservation.OrderID != "order-1" {
+        t.Errorf("res-1 = %s for order %q, want committed for order-1", reservation.Status, reservation.OrderID)
+    }
+
+    mu.RLock()
+    _, leaked := reservations["res-1"]
+    mu.RUnlock()
+    if leaked {
+        t.Error("applyEntryTo wrote to the live reservations")
+    }
+}
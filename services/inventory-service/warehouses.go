@@ -0,0 +1,206 @@
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "net/http"
+    "sort"
+    "strings"
+)
+
+// Warehouses. Stock is kept per warehouse (InventoryItem.Locations), and
+// the item's own available, reserved and total_stock are the sums over its
+// locations. The warehouses on offer come from WAREHOUSES (reloadable):
+// comma-separated ID or ID:COUNTRY entries in order of preference, e.g.
+// "us-east:US,eu-west:DE". A reservation is held at one warehouse: the one
+// it names, else the first that covers it, trying warehouses in the
+// country it ships to first. Stock and reservations from before warehouses
+// are at DefaultWarehouseID.
+const DefaultWarehouseID = "default"
+
+// DefaultWarehouses is WAREHOUSES when it isn't set
+const DefaultWarehouses = DefaultWarehouseID
+
+// Warehouse is a location stock is kept at
+type Warehouse struct {
+    WarehouseID string `json:"warehouse_id"`
+    Country     string `json:"country,omitempty"` // ISO 3166-1 alpha-2; reservations shipping there prefer it
+}
+
+// LocationStock is a product's stock at one warehouse
+type LocationStock struct {
+    Available  int `json:"available"`
+    Reserved   int `json:"reserved"`
+    TotalStock int `json:"total_stock"`
+}
+
+// Helper function to parse WAREHOUSES
+func parseWarehouses(value string) ([]Warehouse, error) {
+    var warehouses []Warehouse
+    seen := make(map[string]bool)
+    for _, entry := range strings.Split(value, ",") {
+        entry = strings.TrimSpace(entry)
+        if entry == "" {
+            continue
+        }
+        id, country, _ := strings.Cut(entry, ":")
+        id = strings.TrimSpace(id)
+        country = strings.ToUpper(strings.TrimSpace(country))
+        if !validWarehouseID(id) {
+            return nil, fmt.Errorf("WAREHOUSES entry %q: IDs are lower-case letters, digits, - and _", entry)
+        }
+        if country != "" && (len(country) != 2 || strings.Trim(country, "ABCDEFGHIJKLMNOPQRSTUVWXYZ") != "") {
+            return nil, fmt.Errorf("WAREHOUSES entry %q: the country must be a two-letter code", entry)
+        }
+        if seen[id] {
+            return nil, fmt.Errorf("WAREHOUSES lists %s twice", id)
+        }
+        seen[id] = true
+        warehouses = append(warehouses, Warehouse{WarehouseID: id, Country: country})
+    }
+    if len(warehouses) == 0 {
+        return nil, fmt.Errorf("WAREHOUSES must list at least one warehouse")
+    }
+    return warehouses, nil
+}
+
+// Helper function to validate a warehouse ID
+func validWarehouseID(id string) bool {
+    if id == "" || len(id) > 32 {
+        return false
+    }
+    for _, c := range id {
+        if (c < 'a' || c > 'z') && (c < '0' || c > '9') && c != '-' && c != '_' {
+            return false
+        }
+    }
+    return true
+}
+
+// Helper function to format warehouses back into WAREHOUSES form
+func formatWarehouses(warehouses []Warehouse) string {
+    entries := make([]string, 0, len(warehouses))
+    for _, warehouse := range warehouses {
+        entry := warehouse.WarehouseID
+        if warehouse.Country != "" {
+            entry += ":" + warehouse.Country
+        }
+        entries = append(entries, entry)
+    }
+    return strings.Join(entries, ",")
+}
+
+// Helper function to check whether a warehouse is configured
+func warehouseConfigured(warehouseID string) bool {
+    for _, warehouse := range config().Warehouses {
+        if warehouse.WarehouseID == warehouseID {
+            return true
+        }
+    }
+    return false
+}
+
+// Helper function to get the warehouse of a mutation or reservation,
+// DefaultWarehouseID for those from before warehouses
+func warehouseOf(warehouseID string) string {
+    if warehouseID == "" {
+        return DefaultWarehouseID
+    }
+    return warehouseID
+}
+
+// Helper function to get an item's stock by warehouse. Items from before
+// warehouses hold all their stock at DefaultWarehouseID.
+func itemLocations(item InventoryItem) map[string]LocationStock {
+    if len(item.Locations) > 0 {
+        return item.Locations
+    }
+    if item.Available == 0 && item.Reserved == 0 && item.TotalStock == 0 {
+        return nil
+    }
+    return map[string]LocationStock{
+        DefaultWarehouseID: {Available: item.Available, Reserved: item.Reserved, TotalStock: item.TotalStock},
+    }
+}
+
+// Helper function to change an item's stock at one warehouse. The
+// locations are copied, since published items share them with readers,
+// and the item's totals summed again.
+func withLocation(item InventoryItem, warehouseID string, change func(stock *LocationStock)) InventoryItem {
+    locations := make(map[string]LocationStock)
+    for id, stock := range itemLocations(item) {
+        locations[id] = stock
+    }
+    stock := locations[warehouseID]
+    change(&stock)
+    locations[warehouseID] = stock
+
+    item.Locations = locations
+    item.Available, item.Reserved, item.TotalStock = 0, 0, 0
+    for _, stock := range locations {
+        item.Available += stock.Available
+        item.Reserved += stock.Reserved
+        item.TotalStock += stock.TotalStock
+    }
+    return item
+}
+
+// Helper function to choose the warehouse to reserve quantity units of an
+// item at: the first configured warehouse in shipTo that has them, else
+// the first anywhere. Returns false when no one warehouse has them.
+func pickWarehouse(item InventoryItem, quantity int, shipTo string) (string, bool) {
+    locations := itemLocations(item)
+    warehouses := config().Warehouses
+    for _, preferLocal := range []bool{true, false} {
+        for _, warehouse := range warehouses {
+            local := shipTo != "" && warehouse.Country == shipTo
+            if local != preferLocal {
+                continue
+            }
+            if locations[warehouse.WarehouseID].Available >= quantity {
+                return warehouse.WarehouseID, true
+            }
+        }
+    }
+    return "", false
+}
+
+// List the configured warehouses with the stock held at each
+func listWarehousesHandler(w http.ResponseWriter, r *http.Request) {
+    type warehouseStock struct {
+        Warehouse
+        Products   int  `json:"products"`
+        Available  int  `json:"available"`
+        Reserved   int  `json:"reserved"`
+        TotalStock int  `json:"total_stock"`
+        Configured bool `json:"configured"` // false for stock left at a warehouse no longer in WAREHOUSES
+    }
+
+    configured := config().Warehouses
+    var result []*warehouseStock
+    byID := make(map[string]*warehouseStock)
+    for _, warehouse := range configured {
+        entry := &warehouseStock{Warehouse: warehouse, Configured: true}
+        result = append(result, entry)
+        byID[warehouse.WarehouseID] = entry
+    }
+    for _, item := range loadAllItems() {
+        for id, stock := range itemLocations(item) {
+            entry, exists := byID[id]
+            if !exists {
+                entry = &warehouseStock{Warehouse: Warehouse{WarehouseID: id}}
+                result = append(result, entry)
+                byID[id] = entry
+            }
+            entry.Products++
+            entry.Available += stock.Available
+            entry.Reserved += stock.Reserved
+            entry.TotalStock += stock.TotalStock
+        }
+    }
+    unlisted := result[len(configured):]
+    sort.Slice(unlisted, func(i, j int) bool { return unlisted[i].WarehouseID < unlisted[j].WarehouseID })
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]interface{}{"warehouses": result})
+}
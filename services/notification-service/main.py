@@ -1,5 +1,7 @@
-from fastapi import FastAPI, HTTPException, BackgroundTasks
+from fastapi import FastAPI, HTTPException, BackgroundTasks, Request, Header, Depends
 from fastapi.middleware.cors import CORSMiddleware
+from fastapi.responses import JSONResponse, HTMLResponse, PlainTextResponse
+from starlette.routing import Match
 from pydantic import BaseModel, EmailStr
 from typing import Dict, List, Optional, Any
 import logging
@@ -8,6 +10,11 @@ import json
 import asyncio
 from collections import defaultdict, deque
 import os
+import re
+from datetime import datetime, timezone
+from email.utils import format_datetime
+import hmac
+from jinja2 import Environment, StrictUndefined, TemplateError, meta
 
 # Configure logging
 logging.basicConfig(level=logging.INFO)
@@ -15,20 +22,181 @@ logger = logging.getLogger(__name__)
 
 app = FastAPI(title="Notification Service", version="1.0.0")
 
+# CORS policy from CORS_* settings, matching the Go services: origins are
+# listed explicitly (the local frontend when APP_ENV=development, none
+# otherwise), and "*" turns credentialed requests off
+def cors_list(name: str, fallback: List[str]) -> List[str]:
+    value = os.getenv(name)
+    if value is None:
+        return fallback
+    return [item.strip() for item in value.split(",") if item.strip()]
+
+
+def cors_options() -> Dict[str, Any]:
+    fallback_origins = (
+        ["http://localhost:3000", "http://127.0.0.1:3000", "http://localhost"]
+        if os.getenv("APP_ENV") == "development"
+        else []
+    )
+    origins = cors_list("CORS_ALLOWED_ORIGINS", fallback_origins)
+    any_origin = "*" in origins
+    try:
+        max_age = max(int(os.getenv("CORS_MAX_AGE_SECONDS", "600")), 0)
+    except ValueError:
+        max_age = 600
+
+    return {
+        "allow_origins": ["*"] if any_origin else origins,
+        "allow_methods": cors_list("CORS_ALLOWED_METHODS", ["GET", "POST", "PUT", "DELETE", "OPTIONS"]),
+        "allow_headers": cors_list(
+            "CORS_ALLOWED_HEADERS",
+            ["Authorization", "Content-Type", "Accept", "Accept-Language", "X-API-Key",
+             "X-Request-ID", "X-Acting-As", "traceparent"],
+        ),
+        "expose_headers": ["X-Request-ID", "X-Error-Code", "Content-Language", "API-Version",
+                           "Deprecation", "Sunset", "Link", "Retry-After"],
+        "allow_credentials": not any_origin and os.getenv("CORS_ALLOW_CREDENTIALS") != "false",
+        "max_age": max_age,
+    }
+
+
 # CORS middleware
-app.add_middleware(
-    CORSMiddleware,
-    allow_origins=["*"],
-    allow_credentials=True,
-    allow_methods=["*"],
-    allow_headers=["*"],
-)
+app.add_middleware(CORSMiddleware, **cors_options())
+
+# API versions, oldest first. Routes are served under /api/<version>/... and
+# under the legacy unversioned /api/... paths, which alias the default
+# version. To change an endpoint in a new version, add the version here and
+# declare the route with its /api/<version>/ path; versioned requests with no
+# dedicated route fall through to the unversioned handlers.
+API_VERSIONS = ["v1"]
+DEFAULT_API_VERSION = "v1"
+API_VERSION_PATH = re.compile(r"^/api/(v\d+)(?=/|$)")
+
+def parse_api_deprecations(spec: str) -> Dict[str, Optional[datetime]]:
+    """Parse API_DEPRECATIONS ("v1=2027-06-30,v2") into version -> sunset date"""
+    deprecations = {}
+    for entry in spec.split(","):
+        name, _, date = entry.strip().partition("=")
+        if not name:
+            continue
+        if name not in API_VERSIONS:
+            logger.warning(f"Ignoring API_DEPRECATIONS entry for unknown version {name}")
+            continue
+        sunset = None
+        if date:
+            try:
+                sunset = datetime.strptime(date, "%Y-%m-%d").replace(tzinfo=timezone.utc)
+            except ValueError:
+                logger.warning(f"Ignoring invalid sunset date {date} for API {name}")
+                continue
+        deprecations[name] = sunset
+    return deprecations
+
+API_DEPRECATIONS = parse_api_deprecations(os.getenv("API_DEPRECATIONS", ""))
+# Requests served per (version, legacy unversioned path)
+api_version_requests = defaultdict(int)
+
+@app.middleware("http")
+async def api_version_middleware(request: Request, call_next):
+    """Tag responses with the API version served, add Deprecation/Sunset/Link
+    headers (RFC 8594) for deprecated versions, and route /api/<version>/...
+    to the unversioned handlers"""
+    path = request.scope["path"]
+    match = API_VERSION_PATH.match(path)
+    if not match and not path.startswith("/api/"):
+        return await call_next(request)
+
+    version = match.group(1) if match else DEFAULT_API_VERSION
+    if version not in API_VERSIONS:
+        return JSONResponse(status_code=404, content={"detail": f"Unknown API version {version}"})
+    api_version_requests[(version, not match)] += 1
+
+    unversioned = "/api" + path[match.end():] if match else path
+    headers = {"API-Version": version}
+    if version in API_DEPRECATIONS:
+        headers["Deprecation"] = "true"
+        index = API_VERSIONS.index(version)
+        if index + 1 < len(API_VERSIONS):
+            resource = unversioned.split("/")[2] if unversioned.count("/") >= 2 else ""
+            headers["Link"] = f'</api/{API_VERSIONS[index + 1]}/{resource}>; rel="successor-version"'
+        sunset = API_DEPRECATIONS[version]
+        if sunset:
+            headers["Sunset"] = format_datetime(sunset, usegmt=True)
+            if datetime.now(timezone.utc) > sunset:
+                return JSONResponse(status_code=410, headers=headers,
+                                    content={"detail": f"API {version} was retired on {sunset:%Y-%m-%d}"})
+
+    if match and not any(route.matches(request.scope)[0] == Match.FULL for route in app.router.routes):
+        request.scope["path"] = unversioned
+
+    response = await call_next(request)
+    response.headers.update(headers)
+    return response
+
+def api_version_metrics() -> str:
+    """Prometheus metrics for API version usage"""
+    metrics = """
+# HELP api_version_requests_total Requests served per API version (legacy = unversioned /api paths)
+# TYPE api_version_requests_total counter
+"""
+    for version in API_VERSIONS:
+        for legacy in (False, True):
+            if legacy and version != DEFAULT_API_VERSION:
+                continue
+            count = api_version_requests[(version, legacy)]
+            metrics += f'api_version_requests_total{{version="{version}",legacy="{str(legacy).lower()}"}} {count}\n'
+
+    metrics += """
+# HELP api_version_deprecated Whether an API version is deprecated
+# TYPE api_version_deprecated gauge
+"""
+    for version in API_VERSIONS:
+        metrics += f'api_version_deprecated{{version="{version}"}} {int(version in API_DEPRECATIONS)}\n'
+    return metrics
 
 # Environment variables
 SENDGRID_API_KEY = os.getenv("SENDGRID_API_KEY", "mock_key")
 TWILIO_SID = os.getenv("TWILIO_SID", "mock_sid")
 TWILIO_AUTH_TOKEN = os.getenv("TWILIO_AUTH_TOKEN", "mock_token")
 
+# Admin endpoints are disabled entirely unless ADMIN_TOKEN is configured
+ADMIN_TOKEN = os.getenv("ADMIN_TOKEN", "")
+SERVICE_NAME = "notification-service"
+# IDs created by tests and load generators; scoped clears (?scope=test) only remove these
+TEST_DATA_PREFIX = "test-"
+
+def audit_admin_action(request: Request, action: str, **details):
+    """Record an audit event for an admin action"""
+    event = {
+        "event": "admin_action",
+        "service": SERVICE_NAME,
+        "action": action,
+        "method": request.method,
+        "path": request.url.path,
+        "remote_addr": request.client.host if request.client else None,
+        "user_agent": request.headers.get("user-agent"),
+        "timestamp": time.time(),
+        **details,
+    }
+    logger.info("AUDIT %s", json.dumps(event))
+
+async def require_admin(request: Request, authorization: str = Header(default="")):
+    """Admin dependency: requires the ADMIN_TOKEN bearer token"""
+    if not ADMIN_TOKEN:
+        raise HTTPException(status_code=403, detail="Admin endpoints disabled: ADMIN_TOKEN not configured")
+    token = authorization[len("Bearer "):] if authorization.startswith("Bearer ") else authorization
+    if not hmac.compare_digest(token.encode(), ADMIN_TOKEN.encode()):
+        audit_admin_action(request, "auth_failed")
+        raise HTTPException(status_code=401, detail="Admin token required")
+
+def confirm_clear(scope: str, confirm: Optional[str]) -> str:
+    """Destructive calls must name the service in ?confirm= and may narrow to ?scope=test"""
+    if scope not in ("all", "test"):
+        raise HTTPException(status_code=400, detail="Scope must be 'all' or 'test'")
+    if confirm != SERVICE_NAME:
+        raise HTTPException(status_code=400, detail=f"Confirmation required: pass ?confirm={SERVICE_NAME}")
+    return scope
+
 # Pydantic models
 class NotificationRequest(BaseModel):
     type: str  # email, sms, push
@@ -70,12 +238,12 @@ notification_stats = defaultdict(int)
 EMAIL_TEMPLATES = {
     "welcome": {
         "subject": "Welcome to our E-commerce Platform!",
-        "body": "Hi {name},\n\nWelcome to our platform! We're excited to have you on board.\n\nBest regards,\nThe E-commerce Team",
+        "body": "Hi {{ name }},\n\nWelcome to our platform! We're excited to have you on board.\n\nBest regards,\nThe E-commerce Team",
         "html_body": """
         <html>
         <body>
             <h2>Welcome to our E-commerce Platform!</h2>
-            <p>Hi {name},</p>
+            <p>Hi {{ name }},</p>
             <p>Welcome to our platform! We're excited to have you on board.</p>
             <p>Best regards,<br>The E-commerce Team</p>
         </body>
@@ -83,15 +251,15 @@ EMAIL_TEMPLATES = {
         """
     },
     "order_confirmation": {
-        "subject": "Order Confirmation - #{order_id}",
-        "body": "Hi there,\n\nYour order #{order_id} has been confirmed and is being processed.\n\nOrder Date: {timestamp}\n\nThank you for your purchase!\n\nBest regards,\nThe E-commerce Team",
+        "subject": "Order Confirmation - #{{ order_id }}",
+        "body": "Hi there,\n\nYour order #{{ order_id }} has been confirmed and is being processed.\n\nOrder Date: {{ timestamp }}\n\nThank you for your purchase!\n\nBest regards,\nThe E-commerce Team",
         "html_body": """
         <html>
         <body>
             <h2>Order Confirmation</h2>
             <p>Hi there,</p>
-            <p>Your order <strong>#{order_id}</strong> has been confirmed and is being processed.</p>
-            <p>Order Date: {timestamp}</p>
+            <p>Your order <strong>#{{ order_id }}</strong> has been confirmed and is being processed.</p>
+            <p>Order Date: {{ timestamp }}</p>
             <p>Thank you for your purchase!</p>
             <p>Best regards,<br>The E-commerce Team</p>
         </body>
@@ -99,31 +267,47 @@ EMAIL_TEMPLATES = {
         """
     },
     "order_shipped": {
-        "subject": "Your Order Has Shipped - #{order_id}",
-        "body": "Hi there,\n\nGreat news! Your order #{order_id} has been shipped and is on its way to you.\n\nShipped Date: {timestamp}\n\nYou should receive it within 3-5 business days.\n\nBest regards,\nThe E-commerce Team",
+        "subject": "Your Order Has Shipped - #{{ order_id }}",
+        "body": "Hi there,\n\nGreat news! Your order #{{ order_id }} has been shipped and is on its way to you.\n\nShipped Date: {{ timestamp }}\n\n{% if estimated_delivery_from is defined %}Estimated delivery: {{ estimated_delivery_from }} to {{ estimated_delivery_to }}{% else %}You should receive it within 3-5 business days.{% endif %}\n\nBest regards,\nThe E-commerce Team",
         "html_body": """
         <html>
         <body>
             <h2>Your Order Has Shipped!</h2>
             <p>Hi there,</p>
-            <p>Great news! Your order <strong>#{order_id}</strong> has been shipped and is on its way to you.</p>
-            <p>Shipped Date: {timestamp}</p>
-            <p>You should receive it within 3-5 business days.</p>
+            <p>Great news! Your order <strong>#{{ order_id }}</strong> has been shipped and is on its way to you.</p>
+            <p>Shipped Date: {{ timestamp }}</p>
+            {% if estimated_delivery_from is defined %}<p>Estimated delivery: {{ estimated_delivery_from }} to {{ estimated_delivery_to }}</p>{% else %}<p>You should receive it within 3-5 business days.</p>{% endif %}
             <p>Best regards,<br>The E-commerce Team</p>
         </body>
         </html>
         """
     },
     "order_cancelled": {
-        "subject": "Order Cancellation - #{order_id}",
-        "body": "Hi there,\n\nYour order #{order_id} has been cancelled as requested.\n\nCancellation Date: {timestamp}\n\nIf you have any questions, please contact our support team.\n\nBest regards,\nThe E-commerce Team",
+        "subject": "Order Cancellation - #{{ order_id }}",
+        "body": "Hi there,\n\nYour order #{{ order_id }} has been cancelled as requested.\n\nCancellation Date: {{ timestamp }}\n\nIf you have any questions, please contact our support team.\n\nBest regards,\nThe E-commerce Team",
         "html_body": """
         <html>
         <body>
             <h2>Order Cancellation</h2>
             <p>Hi there,</p>
-            <p>Your order <strong>#{order_id}</strong> has been cancelled as requested.</p>
-            <p>Cancellation Date: {timestamp}</p>
+            <p>Your order <strong>#{{ order_id }}</strong> has been cancelled as requested.</p>
+            <p>Cancellation Date: {{ timestamp }}</p>
+            <p>If you have any questions, please contact our support team.</p>
+            <p>Best regards,<br>The E-commerce Team</p>
+        </body>
+        </html>
+        """
+    },
+    "order_refunded": {
+        "subject": "Refund Issued - #{{ order_id }}",
+        "body": "Hi there,\n\nWe've issued a refund for your order #{{ order_id }}. It should reach your original payment method within 5-10 business days.\n\nRefund Date: {{ timestamp }}\n\nIf you have any questions, please contact our support team.\n\nBest regards,\nThe E-commerce Team",
+        "html_body": """
+        <html>
+        <body>
+            <h2>Refund Issued</h2>
+            <p>Hi there,</p>
+            <p>We've issued a refund for your order <strong>#{{ order_id }}</strong>. It should reach your original payment method within 5-10 business days.</p>
+            <p>Refund Date: {{ timestamp }}</p>
             <p>If you have any questions, please contact our support team.</p>
             <p>Best regards,<br>The E-commerce Team</p>
         </body>
@@ -132,12 +316,12 @@ EMAIL_TEMPLATES = {
     },
     "password_reset": {
         "subject": "Password Reset Request",
-        "body": "Hi {name},\n\nWe received a request to reset your password.\n\nIf you didn't request this, please ignore this email.\n\nBest regards,\nThe E-commerce Team",
+        "body": "Hi {{ name }},\n\nWe received a request to reset your password.\n\nIf you didn't request this, please ignore this email.\n\nBest regards,\nThe E-commerce Team",
         "html_body": """
         <html>
         <body>
             <h2>Password Reset Request</h2>
-            <p>Hi {name},</p>
+            <p>Hi {{ name }},</p>
             <p>We received a request to reset your password.</p>
             <p>If you didn't request this, please ignore this email.</p>
             <p>Best regards,<br>The E-commerce Team</p>
@@ -149,29 +333,127 @@ EMAIL_TEMPLATES = {
 
 # Initialize SMS templates
 SMS_TEMPLATES = {
-    "order_confirmation": "Your order #{order_id} has been confirmed! Thank you for your purchase. - E-commerce Team",
-    "order_shipped": "Good news! Your order #{order_id} has shipped and is on its way. Expected delivery in 3-5 business days.",
-    "order_cancelled": "Your order #{order_id} has been cancelled as requested. Contact support if you have questions.",
-    "promotional": "Hi {name}! Don't miss our special offer: {offer_text}. Shop now and save!",
-    "verification": "Your verification code is: {code}. This code expires in 10 minutes."
+    "order_confirmation": "Your order #{{ order_id }} has been confirmed! Thank you for your purchase. - E-commerce Team",
+    "order_shipped": "Good news! Your order #{{ order_id }} has shipped and is on its way. {% if estimated_delivery_from is defined %}Expected between {{ estimated_delivery_from }} and {{ estimated_delivery_to }}.{% else %}Expected delivery in 3-5 business days.{% endif %}",
+    "order_cancelled": "Your order #{{ order_id }} has been cancelled as requested. Contact support if you have questions.",
+    "order_refunded": "We've refunded your order #{{ order_id }}. Allow 5-10 business days for it to reach your payment method.",
+    "promotional": "Hi {{ name }}! Don't miss our special offer: {{ offer_text }}. Shop now and save!",
+    "verification": "Your verification code is: {{ code }}. This code expires in 10 minutes."
 }
 
+# Variables each template expects, shared by its email and SMS versions.
+# Types are checked before rendering; examples are the sample data used by
+# the preview endpoint. Templates may only reference declared variables
+# (checked at startup).
+TEMPLATE_VARIABLES = {
+    "welcome": {
+        "name": {"type": "string", "required": True, "example": "Ada Lovelace"},
+    },
+    "order_confirmation": {
+        "order_id": {"type": "string", "required": True, "example": "3f1c9a52-7b1e-4d0a-9a57-2c6f0e8b1d44"},
+        "timestamp": {"type": "string", "required": True, "example": "2024-01-01T12:00:00Z"},
+    },
+    "order_shipped": {
+        "order_id": {"type": "string", "required": True, "example": "3f1c9a52-7b1e-4d0a-9a57-2c6f0e8b1d44"},
+        "timestamp": {"type": "string", "required": True, "example": "2024-01-03T09:30:00Z"},
+        "estimated_delivery_from": {"type": "string", "required": False, "example": "2024-01-08"},
+        "estimated_delivery_to": {"type": "string", "required": False, "example": "2024-01-10"},
+    },
+    "order_cancelled": {
+        "order_id": {"type": "string", "required": True, "example": "3f1c9a52-7b1e-4d0a-9a57-2c6f0e8b1d44"},
+        "timestamp": {"type": "string", "required": True, "example": "2024-01-02T16:45:00Z"},
+    },
+    "order_refunded": {
+        "order_id": {"type": "string", "required": True, "example": "3f1c9a52-7b1e-4d0a-9a57-2c6f0e8b1d44"},
+        "timestamp": {"type": "string", "required": True, "example": "2024-01-05T10:15:00Z"},
+    },
+    "password_reset": {
+        "name": {"type": "string", "required": True, "example": "Ada Lovelace"},
+    },
+    "promotional": {
+        "name": {"type": "string", "required": True, "example": "Ada"},
+        "offer_text": {"type": "string", "required": True, "example": "20% off all accessories"},
+    },
+    "verification": {
+        "code": {"type": "string", "required": True, "example": "482913"},
+    },
+}
+
+VARIABLE_TYPES = {
+    "string": (str,),
+    "number": (int, float),
+    "boolean": (bool,),
+}
+
+# Templates use Jinja2 ({{ order_id }}). Missing variables are errors rather
+# than blanks, and HTML bodies escape their values.
+TEXT_ENV = Environment(undefined=StrictUndefined, keep_trailing_newline=True)
+HTML_ENV = Environment(undefined=StrictUndefined, autoescape=True)
+
+class TemplateNotFoundError(LookupError):
+    """No template with that name for the channel"""
+
+class TemplateDataError(ValueError):
+    """Template data doesn't match the template's declared variables"""
+    def __init__(self, template: str, problems: List[str]):
+        super().__init__(f"Template '{template}': " + "; ".join(problems))
+        self.problems = problems
+
+def template_sources(channel: str, template: str) -> Dict[str, str]:
+    """Source of each rendered part of a template: subject/text/html for email, text for SMS"""
+    if channel == "email" and template in EMAIL_TEMPLATES:
+        source = EMAIL_TEMPLATES[template]
+        return {"subject": source["subject"], "text": source["body"], "html": source["html_body"]}
+    if channel == "sms" and template in SMS_TEMPLATES:
+        return {"text": SMS_TEMPLATES[template]}
+    raise TemplateNotFoundError(f"{'SMS' if channel == 'sms' else channel.title()} template '{template}' not found")
+
+def check_template_data(template: str, data: Dict[str, Any]):
+    """Validate data against the template's declared variables"""
+    problems = []
+    for name, spec in TEMPLATE_VARIABLES.get(template, {}).items():
+        if name not in data or data[name] is None:
+            if spec.get("required"):
+                problems.append(f"missing required variable '{name}'")
+            continue
+        expected = VARIABLE_TYPES[spec["type"]]
+        value = data[name]
+        if not isinstance(value, expected) or (spec["type"] == "number" and isinstance(value, bool)):
+            problems.append(f"variable '{name}' must be a {spec['type']}")
+    if problems:
+        raise TemplateDataError(template, problems)
+
+def render_notification(channel: str, template: str, data: Dict[str, Any]) -> Dict[str, str]:
+    """Validate data and render every part of a template"""
+    sources = template_sources(channel, template)
+    check_template_data(template, data)
+    rendered = {}
+    for part, source in sources.items():
+        env = HTML_ENV if part == "html" else TEXT_ENV
+        try:
+            rendered[part] = env.from_string(source).render(**data)
+        except TemplateError as e:
+            raise TemplateDataError(template, [f"{part}: {e}"])
+    return rendered
+
+def check_template_declarations():
+    """Fail at startup if a template uses a variable its schema doesn't declare"""
+    sources = [("email", name) for name in EMAIL_TEMPLATES] + [("sms", name) for name in SMS_TEMPLATES]
+    for channel, name in sources:
+        declared = set(TEMPLATE_VARIABLES.get(name, {}))
+        for part, source in template_sources(channel, name).items():
+            env = HTML_ENV if part == "html" else TEXT_ENV
+            used = meta.find_undeclared_variables(env.parse(source))
+            if used - declared:
+                raise RuntimeError(f"{channel} template '{name}' ({part}) uses undeclared variables: {sorted(used - declared)}")
+
+check_template_declarations()
+
 def generate_notification_id() -> str:
     """Generate unique notification ID"""
     import uuid
     return f"notif_{int(time.time())}_{uuid.uuid4().hex[:8]}"
 
-def render_template(template_content: str, data: Dict[str, Any]) -> str:
-    """Simple template rendering with variable substitution"""
-    try:
-        return template_content.format(**data)
-    except KeyError as e:
-        logger.warning(f"Template variable missing: {e}")
-        return template_content
-    except Exception as e:
-        logger.error(f"Template rendering error: {e}")
-        return template_content
-
 async def simulate_email_delivery(recipient: str, subject: str, body: str) -> bool:
     """Simulate email delivery with realistic delays and failure rates"""
     # Simulate processing delay
@@ -287,14 +569,12 @@ async def process_email_notification(
 ):
     """Process email notification"""
     try:
-        # Get template
-        if template not in EMAIL_TEMPLATES:
-            raise ValueError(f"Email template '{template}' not found")
-        
-        template_data = EMAIL_TEMPLATES[template]
-        subject = render_template(template_data["subject"], data)
-        body = render_template(template_data["body"], data)
-        html_body = render_template(template_data["html_body"], data)
+        # Render template; bad or missing data fails the notification
+        # rather than sending placeholders
+        rendered = render_notification("email", template, data)
+        subject = rendered["subject"]
+        body = rendered["text"]
+        html_body = rendered["html"]
         
         # Simulate sending email
         success = await simulate_email_delivery(recipient, subject, body)
@@ -336,11 +616,7 @@ async def process_sms_notification(
 ):
     """Process SMS notification"""
     try:
-        # Get template
-        if template not in SMS_TEMPLATES:
-            raise ValueError(f"SMS template '{template}' not found")
-        
-        message = render_template(SMS_TEMPLATES[template], data)
+        message = render_notification("sms", template, data)["text"]
         
         # Validate message length (SMS limit)
         if len(message) > 160:
@@ -467,11 +743,57 @@ async def get_templates():
         "email_templates": list(EMAIL_TEMPLATES.keys()),
         "sms_templates": list(SMS_TEMPLATES.keys()),
         "templates": {
-            "email": {name: {"subject": template["subject"]} for name, template in EMAIL_TEMPLATES.items()},
-            "sms": {name: {"preview": template[:50] + "..."} for name, template in SMS_TEMPLATES.items()}
+            "email": {name: {"subject": template["subject"], "variables": TEMPLATE_VARIABLES.get(name, {})}
+                      for name, template in EMAIL_TEMPLATES.items()},
+            "sms": {name: {"preview": template[:50] + "...", "variables": TEMPLATE_VARIABLES.get(name, {})}
+                    for name, template in SMS_TEMPLATES.items()}
         }
     }
 
+class TemplatePreviewRequest(BaseModel):
+    channel: str = "email"  # email, sms
+    data: Dict[str, Any] = {}  # overrides the declared example values
+
+@app.post("/api/notifications/templates/{template_id}/preview")
+async def preview_template(template_id: str, preview: Optional[TemplatePreviewRequest] = None, format: str = "json"):
+    """Render a template with sample data so it can be checked before going live.
+    ?format=html or ?format=text returns just that part, e.g. to open the email in a browser."""
+    preview = preview or TemplatePreviewRequest()
+    if preview.channel not in ("email", "sms"):
+        raise HTTPException(status_code=400, detail="Channel must be 'email' or 'sms'")
+    if format not in ("json", "html", "text"):
+        raise HTTPException(status_code=400, detail="Format must be 'json', 'html' or 'text'")
+
+    variables = TEMPLATE_VARIABLES.get(template_id, {})
+    data = {name: spec["example"] for name, spec in variables.items() if "example" in spec}
+    data.update(preview.data)
+
+    try:
+        rendered = render_notification(preview.channel, template_id, data)
+    except TemplateNotFoundError as e:
+        raise HTTPException(status_code=404, detail=str(e))
+    except TemplateDataError as e:
+        raise HTTPException(status_code=422, detail={"message": "Template data does not match its variables", "problems": e.problems})
+
+    if format == "html":
+        if "html" not in rendered:
+            raise HTTPException(status_code=400, detail="SMS templates have no HTML part")
+        return HTMLResponse(rendered["html"])
+    if format == "text":
+        return PlainTextResponse(rendered["text"])
+
+    result = {
+        "template": template_id,
+        "channel": preview.channel,
+        "variables": variables,
+        "data": data,
+        "rendered": rendered,
+    }
+    if preview.channel == "sms":
+        result["length"] = len(rendered["text"])
+        result["truncated"] = len(rendered["text"]) > 160
+    return result
+
 @app.post("/api/notifications/test")
 async def send_test_notification(test_data: dict):
     """Send test notification for development"""
@@ -560,19 +882,37 @@ async def get_notification_analytics():
         logger.error(f"Analytics error: {str(e)}")
         raise HTTPException(status_code=500, detail=f"Analytics failed: {str(e)}")
 
-@app.delete("/admin/clear")
-async def clear_notification_data():
+@app.delete("/admin/clear", dependencies=[Depends(require_admin)])
+async def clear_notification_data(request: Request, scope: str = "all", confirm: Optional[str] = None):
     """Clear all notification data (admin endpoint)"""
+    scope = confirm_clear(scope, confirm)
     try:
         global notifications_history, failed_notifications, notification_stats
         
-        notifications_history.clear()
-        failed_notifications.clear()
-        notification_stats.clear()
+        if scope == "test":
+            # Only notifications sent to test recipients; aggregate stats are kept
+            test_ids = [
+                notification_id for notification_id, status in notifications_history.items()
+                if status["recipient"].startswith(TEST_DATA_PREFIX)
+            ]
+            for notification_id in test_ids:
+                del notifications_history[notification_id]
+            remaining = [n for n in failed_notifications if not n["recipient"].startswith(TEST_DATA_PREFIX)]
+            failed_notifications.clear()
+            failed_notifications.extend(remaining)
+            cleared = len(test_ids)
+        else:
+            cleared = len(notifications_history)
+            notifications_history.clear()
+            failed_notifications.clear()
+            notification_stats.clear()
         
+        audit_admin_action(request, "clear", scope=scope, cleared=cleared)
         return {
             "success": True,
-            "message": "All notification data cleared"
+            "message": "Notification data cleared",
+            "scope": scope,
+            "cleared": cleared
         }
         
     except Exception as e:
@@ -611,6 +951,7 @@ notification_service_sms_total {notification_stats.get("type_sms", 0)}
 # TYPE notification_service_push_total counter
 notification_service_push_total {notification_stats.get("type_push", 0)}
 """
+    metrics += api_version_metrics()
     
     from fastapi.responses import PlainTextResponse
     return PlainTextResponse(content=metrics, media_type="text/plain")
@@ -0,0 +1,217 @@
+package main
+
+import (
+    "encoding/json"
+    "log"
+    "net/http"
+    "strings"
+    "time"
+
+    "github.com/gorilla/mux"
+    "middleware/i18n"
+    "money"
+)
+
+// Order addresses. An order may carry a shipping address (where it goes,
+// and what tax is worked out from; see tax.go) and a billing address (the
+// payer's). Both are optional, but one that is given must be complete.
+// The shipping address can be changed until the first item ships.
+
+// MaxAddressFieldLength bounds each address field, in characters
+const MaxAddressFieldLength = 200
+
+// Address is a postal address. Country is an ISO 3166-1 alpha-2 code and
+// Region, where tax varies within the country, the state or province code.
+type Address struct {
+    Name       string `json:"name"`
+    Company    string `json:"company,omitempty"`
+    Line1      string `json:"line1"`
+    Line2      string `json:"line2,omitempty"`
+    City       string `json:"city"`
+    Region     string `json:"region,omitempty"`
+    PostalCode string `json:"postal_code,omitempty"`
+    Country    string `json:"country"`
+    Phone      string `json:"phone,omitempty"`
+}
+
+// Lines returns the address as it is printed, one line per part
+func (a Address) Lines() []string {
+    var lines []string
+    for _, line := range []string{a.Name, a.Company, a.Line1, a.Line2,
+        strings.Join(strings.Fields(a.City+" "+a.Region+" "+a.PostalCode), " "), a.Country} {
+        if line != "" {
+            lines = append(lines, line)
+        }
+    }
+    return lines
+}
+
+// ISO 3166-1 alpha-2 country codes
+var countryCodes = make(map[string]bool)
+
+// Countries that don't use postal codes; everywhere else one is required
+var countriesWithoutPostalCodes = map[string]bool{
+    "AE": true, "AG": true, "AO": true, "AW": true, "BF": true, "BI": true,
+    "BJ": true, "BO": true, "BS": true, "BW": true, "BZ": true, "CD": true,
+    "CF": true, "CG": true, "CI": true, "CK": true, "CM": true, "DJ": true,
+    "DM": true, "ER": true, "FJ": true, "GD": true, "GH": true, "GM": true,
+    "GQ": true, "GY": true, "HK": true, "KI": true, "KM": true, "KN": true,
+    "KP": true, "LY": true, "ML": true, "MO": true, "MR": true, "MW": true,
+    "NR": true, "NU": true, "QA": true, "RW": true, "SB": true, "SC": true,
+    "SL": true, "SR": true, "ST": true, "SY": true, "TD": true, "TF": true,
+    "TG": true, "TK": true, "TL": true, "TO": true, "TV": true, "UG": true,
+    "VU": true, "YE": true, "ZW": true,
+}
+
+func init() {
+    for _, code := range strings.Fields(`
+        AD AE AF AG AI AL AM AO AQ AR AS AT AU AW AX AZ BA BB BD BE BF BG BH BI
+        BJ BL BM BN BO BQ BR BS BT BV BW BY BZ CA CC CD CF CG CH CI CK CL CM CN
+        CO CR CU CV CW CX CY CZ DE DJ DK DM DO DZ EC EE EG EH ER ES ET FI FJ FK
+        FM FO FR GA GB GD GE GF GG GH GI GL GM GN GP GQ GR GS GT GU GW GY HK HM
+        HN HR HT HU ID IE IL IM IN IO IQ IR IS IT JE JM JO JP KE KG KH KI KM KN
+        KP KR KW KY KZ LA LB LC LI LK LR LS LT LU LV LY MA MC MD ME MF MG MH MK
+        ML MM MN MO MP MQ MR MS MT MU MV MW MX MY MZ NA NC NE NF NG NI NL NO NP
+        NR NU NZ OM PA PE PF PG PH PK PL PM PN PR PS PT PW PY QA RE RO RS RU RW
+        SA SB SC SD SE SG SH SI SJ SK SL SM SN SO SR SS ST SV SX SY SZ TC TD TF
+        TG TH TJ TK TL TM TN TO TR TT TV TW TZ UA UG UM US UY UZ VA VC VE VG VI
+        VN VU WF WS YE YT ZA ZM ZW`) {
+        countryCodes[code] = true
+    }
+}
+
+// Helper function to check an address and normalize it: fields are
+// trimmed and the country and region codes upper-cased. field names the
+// address in errors (shipping_address, billing_address).
+func normalizeAddress(address *Address, field string) error {
+    for _, value := range []*string{&address.Name, &address.Company, &address.Line1, &address.Line2,
+        &address.City, &address.Region, &address.PostalCode, &address.Country, &address.Phone} {
+        *value = strings.TrimSpace(*value)
+    }
+    address.Country = strings.ToUpper(address.Country)
+    address.Region = strings.ToUpper(address.Region)
+
+    if address.Country == "" {
+        return i18n.NewError("order.address_field_required", field+".country")
+    }
+    if !countryCodes[address.Country] {
+        return i18n.NewError("order.address_country_invalid", field+".country", address.Country)
+    }
+    required := [][2]string{{"name", address.Name}, {"line1", address.Line1}, {"city", address.City}}
+    if !countriesWithoutPostalCodes[address.Country] {
+        required = append(required, [2]string{"postal_code", address.PostalCode})
+    }
+    for _, part := range required {
+        if part[1] == "" {
+            return i18n.NewError("order.address_field_required", field+"."+part[0])
+        }
+    }
+
+    fields := [][2]string{
+        {"name", address.Name}, {"company", address.Company}, {"line1", address.Line1}, {"line2", address.Line2},
+        {"city", address.City}, {"region", address.Region}, {"postal_code", address.PostalCode}, {"phone", address.Phone},
+    }
+    for _, part := range fields {
+        if len([]rune(part[1])) > MaxAddressFieldLength {
+            return i18n.NewError("order.address_field_too_long", field+"."+part[0], MaxAddressFieldLength)
+        }
+    }
+    return nil
+}
+
+// Helper function to check whether an order's shipping address may still
+// change: nothing has shipped, and it hasn't been closed
+func addressChangeable(order Order) bool {
+    if len(order.Shipments) > 0 {
+        return false
+    }
+    switch order.Status {
+    case StatusCreated, StatusPendingPayment, StatusOnHold, StatusPaid:
+        return true
+    }
+    return false
+}
+
+// Change an order's shipping address before it ships. The order is
+// already charged, so an address that would change its tax is refused.
+func updateShippingAddressHandler(w http.ResponseWriter, r *http.Request) {
+    orderID := resolveOrderID(mux.Vars(r)["orderId"])
+
+    var address Address
+    if err := json.NewDecoder(r.Body).Decode(&address); err != nil {
+        i18n.WriteError(w, r, http.StatusBadRequest, "request.invalid_json")
+        return
+    }
+    if err := normalizeAddress(&address, "shipping_address"); err != nil {
+        i18n.WriteMessageError(w, r, http.StatusBadRequest, err, "order.address_field_required")
+        return
+    }
+
+    order, exists := getOrder(orderID)
+    if !exists {
+        i18n.WriteError(w, r, http.StatusNotFound, "order.not_found")
+        return
+    }
+    if checkoutInProgress(order.Status) {
+        w.Header().Set("Retry-After", "1")
+        i18n.WriteError(w, r, http.StatusConflict, "order.checkout_in_progress")
+        return
+    }
+    if !addressChangeable(order) {
+        i18n.WriteError(w, r, http.StatusConflict, "order.address_change_not_allowed", order.Status)
+        return
+    }
+
+    // Quoted outside the shard lock; providers may call out
+    moved := order
+    moved.ShippingAddress = &address
+    if rule, err := config().OrderRules.check(moved, RuleRestrictedProducts); err != nil {
+        log.Printf("Order rule %q refused moving order %s: %v", rule.Name, orderID, err)
+        i18n.WriteMessageError(w, r, http.StatusBadRequest, err, "order.rule_violated")
+        return
+    }
+    taxable, err := money.New(order.SubtotalCents, order.Currency).Sub(money.New(order.DiscountCents, order.Currency))
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+    quote, err := currentTaxProvider().Quote(moved, taxable)
+    if err != nil {
+        log.Printf("Failed to work out tax for order %s at its new address: %v", orderID, err)
+        i18n.WriteError(w, r, http.StatusBadGateway, "order.tax_unavailable")
+        return
+    }
+    if quote.TaxCents != order.TaxCents {
+        i18n.WriteError(w, r, http.StatusConflict, "order.address_change_tax")
+        return
+    }
+
+    shard := shardFor(orderID)
+    shard.mu.Lock()
+    order, exists = shard.orders[orderID]
+    if !exists {
+        shard.mu.Unlock()
+        i18n.WriteError(w, r, http.StatusNotFound, "order.not_found")
+        return
+    }
+    // Shipped or settled while the tax was quoted
+    if !addressChangeable(order) {
+        shard.mu.Unlock()
+        i18n.WriteError(w, r, http.StatusConflict, "order.address_change_not_allowed", order.Status)
+        return
+    }
+    order.ShippingAddress = &address
+    order.TaxRegion = quote.Region
+    if order.ShippingMethod != "" {
+        order.EstimatedDelivery = estimateDelivery(order.ShippingMethod, order.ShippingAddress, order.CreatedAt)
+    }
+    order.UpdatedAt = time.Now().Unix()
+    putOrder(shard, order)
+    shard.mu.Unlock()
+    persistOrders()
+
+    log.Printf("Shipping address of order %s changed by %s", orderID, requestActor(r))
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(order)
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+    "net/http"
+    "strings"
+
+    "middleware/adminauth"
+)
+
+// serviceName identifies the service in audit events and SLO reports, and
+// is the value destructive admin calls must confirm with
+const serviceName = "order-service"
+
+func init() {
+    adminauth.Setup(serviceName)
+}
+
+// Admin middleware: requires the ADMIN_TOKEN bearer token, or a user or
+// service token with a role the route allows (see rbac.go). Disabled (403)
+// when none of them is configured.
+func adminAuthMiddleware(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if adminauth.Token() == "" && jwtSecret == "" && serviceTokenSecret == "" {
+            http.Error(w, "Admin endpoints disabled: ADMIN_TOKEN not configured", http.StatusForbidden)
+            return
+        }
+
+        caller, authenticated := requestPrincipal(r)
+        if !authenticated {
+            adminauth.Audit(r, "auth_failed", nil)
+            http.Error(w, "Admin token required", http.StatusUnauthorized)
+            return
+        }
+        if roles := allowedRoles(r); !caller.hasRole(roles...) {
+            adminauth.Audit(r, "access_denied", map[string]interface{}{
+                "principal": caller.ID,
+                "roles":     caller.Roles,
+                "allowed":   roles,
+            })
+            http.Error(w, "Requires one of the roles: "+strings.Join(roles, ", "), http.StatusForbidden)
+            return
+        }
+
+        next.ServeHTTP(w, r)
+    })
+}
@@ -0,0 +1,488 @@
+package main
+
+import (
+    "encoding/csv"
+    "encoding/json"
+    "fmt"
+    "net/http"
+    "net/url"
+    "sort"
+    "strconv"
+    "sync"
+    "time"
+)
+
+// Revenue bucket granularities
+const (
+    GranularityHour = "hour"
+    GranularityDay  = "day"
+    GranularityWeek = "week"
+)
+
+// MaxRevenueBuckets bounds the size of a single time-series response
+const MaxRevenueBuckets = 2000
+
+// Report size limits
+const (
+    DefaultReportLimit = 10
+    MaxReportLimit     = 1000
+)
+
+// revenueBucket accumulates revenue for one hour of order creation time
+type revenueBucket struct {
+    RevenueCents  int
+    DiscountCents int
+    OrderCount    int
+}
+
+// RevenuePoint is one bucket of the revenue time series
+type RevenuePoint struct {
+    Start                  int64 `json:"start"`
+    End                    int64 `json:"end"`
+    RevenueCents           int   `json:"revenue_cents"`
+    DiscountCents          int   `json:"discount_cents"` // given away by coupons
+    OrderCount             int   `json:"order_count"`
+    AverageOrderValueCents int   `json:"average_order_value_cents"`
+}
+
+// ProductSales aggregates line items for a single product
+type ProductSales struct {
+    ProductID    string `json:"product_id"`
+    UnitsSold    int    `json:"units_sold"`
+    RevenueCents int    `json:"revenue_cents"`
+    OrderCount   int    `json:"order_count"`
+}
+
+// CustomerValue aggregates orders for a single customer
+type CustomerValue struct {
+    UserID                 string `json:"user_id"`
+    OrderCount             int    `json:"order_count"`
+    RevenueCents           int    `json:"revenue_cents"`
+    AverageOrderValueCents int    `json:"average_order_value_cents"`
+    LastOrderAt            int64  `json:"last_order_at"`
+}
+
+// Hourly revenue buckets keyed by the bucket's start (unix seconds).
+// Maintained incrementally on every order write.
+var (
+    revenueByHour = make(map[int64]*revenueBucket)
+    revenueMu     sync.Mutex
+)
+
+// Orders count towards revenue once paid and until cancelled or refunded
+func countsAsRevenue(order Order) bool {
+    return paymentCompleted(order.Status) && order.Status != StatusRefunded
+}
+
+// Helper function to get what an order brought in: its total less any
+// partial refunds, in the settlement currency when it has one, so orders
+// in different currencies add up
+func netRevenueCents(order Order) int {
+    if order.SettlementCurrency != "" {
+        return order.SettlementTotalCents - order.SettlementRefundedCents
+    }
+    return order.TotalCents - order.RefundedCents
+}
+
+// Add (sign=1) or remove (sign=-1) an order's contribution to the revenue
+// buckets. Callers must hold revenueMu.
+func applyRevenueDelta(order Order, sign int) {
+    if !countsAsRevenue(order) {
+        return
+    }
+
+    hour := time.Unix(order.CreatedAt, 0).UTC().Truncate(time.Hour).Unix()
+    bucket, exists := revenueByHour[hour]
+    if !exists {
+        bucket = &revenueBucket{}
+        revenueByHour[hour] = bucket
+    }
+
+    bucket.RevenueCents += sign * netRevenueCents(order)
+    bucket.DiscountCents += sign * order.DiscountCents
+    bucket.OrderCount += sign
+
+    if bucket.OrderCount == 0 {
+        delete(revenueByHour, hour)
+    }
+}
+
+// Helper function to parse a time query parameter (unix seconds or RFC 3339)
+func parseTimeParam(value string, fallback time.Time) (time.Time, error) {
+    if value == "" {
+        return fallback, nil
+    }
+    if unix, err := strconv.ParseInt(value, 10, 64); err == nil {
+        return time.Unix(unix, 0).UTC(), nil
+    }
+    return time.Parse(time.RFC3339, value)
+}
+
+// Helper function to align a time to the start of its bucket
+func bucketStart(t time.Time, granularity string) time.Time {
+    t = t.UTC()
+    switch granularity {
+    case GranularityHour:
+        return t.Truncate(time.Hour)
+    case GranularityWeek:
+        // Weeks start on Monday
+        day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+        offset := (int(day.Weekday()) + 6) % 7
+        return day.AddDate(0, 0, -offset)
+    default:
+        return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+    }
+}
+
+// Helper function to advance to the next bucket
+func nextBucket(t time.Time, granularity string) time.Time {
+    switch granularity {
+    case GranularityHour:
+        return t.Add(time.Hour)
+    case GranularityWeek:
+        return t.AddDate(0, 0, 7)
+    default:
+        return t.AddDate(0, 0, 1)
+    }
+}
+
+// Helper function to parse the granularity and from/to range of a time
+// series, defaulting to a span that suits the granularity
+func parseSeriesParams(query url.Values) (string, time.Time, time.Time, error) {
+    granularity := query.Get("granularity")
+    if granularity == "" {
+        granularity = GranularityDay
+    }
+
+    var defaultSpan time.Duration
+    switch granularity {
+    case GranularityHour:
+        defaultSpan = 48 * time.Hour
+    case GranularityDay:
+        defaultSpan = 30 * 24 * time.Hour
+    case GranularityWeek:
+        defaultSpan = 12 * 7 * 24 * time.Hour
+    default:
+        return "", time.Time{}, time.Time{}, fmt.Errorf("Granularity must be 'hour', 'day' or 'week'")
+    }
+
+    to, err := parseTimeParam(query.Get("to"), time.Now().UTC())
+    if err != nil {
+        return "", time.Time{}, time.Time{}, fmt.Errorf("Invalid 'to' timestamp")
+    }
+    from, err := parseTimeParam(query.Get("from"), to.Add(-defaultSpan))
+    if err != nil {
+        return "", time.Time{}, time.Time{}, fmt.Errorf("Invalid 'from' timestamp")
+    }
+    if !from.Before(to) {
+        return "", time.Time{}, time.Time{}, fmt.Errorf("'from' must be before 'to'")
+    }
+    return granularity, from, to, nil
+}
+
+// Helper function to build the revenue time series for a range, one
+// (zero-filled) point per bucket, with each bucket's average order value
+func revenueSeries(granularity string, from time.Time, to time.Time) ([]RevenuePoint, error) {
+    // Build the bucket list first so its size can be bounded
+    var points []RevenuePoint
+    for start := bucketStart(from, granularity); start.Before(to); start = nextBucket(start, granularity) {
+        if len(points) >= MaxRevenueBuckets {
+            return nil, fmt.Errorf("Requested range produces too many buckets")
+        }
+        points = append(points, RevenuePoint{
+            Start: start.Unix(),
+            End:   nextBucket(start, granularity).Unix(),
+        })
+    }
+
+    // Roll hourly buckets up into the requested granularity; cost is
+    // proportional to the number of hours in range, not the number of orders
+    revenueMu.Lock()
+    idx := 0
+    for hour := from.Truncate(time.Hour); hour.Before(to); hour = hour.Add(time.Hour) {
+        bucket, exists := revenueByHour[hour.Unix()]
+        if !exists {
+            continue
+        }
+        for idx < len(points) && hour.Unix() >= points[idx].End {
+            idx++
+        }
+        if idx == len(points) {
+            break
+        }
+        points[idx].RevenueCents += bucket.RevenueCents
+        points[idx].DiscountCents += bucket.DiscountCents
+        points[idx].OrderCount += bucket.OrderCount
+    }
+    revenueMu.Unlock()
+
+    for i := range points {
+        if points[i].OrderCount > 0 {
+            points[i].AverageOrderValueCents = points[i].RevenueCents / points[i].OrderCount
+        }
+    }
+    return points, nil
+}
+
+// Helper function to total a revenue time series
+func seriesTotals(points []RevenuePoint) map[string]interface{} {
+    totalRevenue := 0
+    totalDiscount := 0
+    totalOrders := 0
+    for _, point := range points {
+        totalRevenue += point.RevenueCents
+        totalDiscount += point.DiscountCents
+        totalOrders += point.OrderCount
+    }
+
+    totals := map[string]interface{}{
+        "revenue_cents":             totalRevenue,
+        "discount_cents":            totalDiscount,
+        "order_count":               totalOrders,
+        "average_order_value_cents": 0,
+    }
+    if totalOrders > 0 {
+        totals["average_order_value_cents"] = totalRevenue / totalOrders
+    }
+    return totals
+}
+
+// Revenue time series
+func getRevenueAnalyticsHandler(w http.ResponseWriter, r *http.Request) {
+    granularity, from, to, err := parseSeriesParams(r.URL.Query())
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+    points, err := revenueSeries(granularity, from, to)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+
+    result := map[string]interface{}{
+        "granularity": granularity,
+        "from":        from.Unix(),
+        "to":          to.Unix(),
+        "buckets":     points,
+        "totals":      seriesTotals(points),
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(result)
+}
+
+// reportParams holds the common date range / limit / format parameters
+type reportParams struct {
+    From   time.Time
+    To     time.Time
+    Limit  int
+    Format string
+}
+
+// Helper function to parse report query parameters (defaults to the last 30 days)
+func parseReportParams(r *http.Request) (reportParams, error) {
+    query := r.URL.Query()
+    params := reportParams{Limit: DefaultReportLimit, Format: "json"}
+
+    var err error
+    params.To, err = parseTimeParam(query.Get("to"), time.Now().UTC())
+    if err != nil {
+        return params, fmt.Errorf("invalid 'to' timestamp")
+    }
+    params.From, err = parseTimeParam(query.Get("from"), params.To.AddDate(0, 0, -30))
+    if err != nil {
+        return params, fmt.Errorf("invalid 'from' timestamp")
+    }
+    if !params.From.Before(params.To) {
+        return params, fmt.Errorf("'from' must be before 'to'")
+    }
+
+    if limitStr := query.Get("limit"); limitStr != "" {
+        limit, err := strconv.Atoi(limitStr)
+        if err != nil || limit <= 0 || limit > MaxReportLimit {
+            return params, fmt.Errorf("limit must be between 1 and %d", MaxReportLimit)
+        }
+        params.Limit = limit
+    }
+
+    if format := query.Get("format"); format != "" {
+        if format != "json" && format != "csv" {
+            return params, fmt.Errorf("format must be 'json' or 'csv'")
+        }
+        params.Format = format
+    }
+
+    return params, nil
+}
+
+// Helper function to collect revenue-bearing orders created within a range
+func revenueOrdersBetween(from, to time.Time) []Order {
+    var result []Order
+    forEachOrder(func(order Order) {
+        if !countsAsRevenue(order) {
+            return
+        }
+        if order.CreatedAt < from.Unix() || order.CreatedAt > to.Unix() {
+            return
+        }
+        result = append(result, order)
+    })
+    return result
+}
+
+// Helper function to stream a CSV attachment
+func writeCSV(w http.ResponseWriter, filename string, header []string, rows [][]string) {
+    w.Header().Set("Content-Type", "text/csv")
+    w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+
+    writer := csv.NewWriter(w)
+    writer.Write(header)
+    writer.WriteAll(rows)
+}
+
+// Best-selling products by units or revenue, built from order line items
+func getTopProductsHandler(w http.ResponseWriter, r *http.Request) {
+    params, err := parseReportParams(r)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+
+    sortBy := r.URL.Query().Get("sort")
+    if sortBy == "" {
+        sortBy = "units"
+    }
+    if sortBy != "units" && sortBy != "revenue" {
+        http.Error(w, "Sort must be 'units' or 'revenue'", http.StatusBadRequest)
+        return
+    }
+
+    byProduct := make(map[string]*ProductSales)
+    for _, order := range revenueOrdersBetween(params.From, params.To) {
+        seen := make(map[string]bool)
+        for _, item := range order.Items {
+            sales, exists := byProduct[item.ProductID]
+            if !exists {
+                sales = &ProductSales{ProductID: item.ProductID}
+                byProduct[item.ProductID] = sales
+            }
+            sold := item.Quantity - item.RefundedQty
+            sales.UnitsSold += sold
+            sales.RevenueCents += sold * item.PriceCents
+            if !seen[item.ProductID] {
+                sales.OrderCount++
+                seen[item.ProductID] = true
+            }
+        }
+    }
+
+    products := make([]ProductSales, 0, len(byProduct))
+    for _, sales := range byProduct {
+        products = append(products, *sales)
+    }
+    sort.Slice(products, func(i, j int) bool {
+        a, b := products[i], products[j]
+        if sortBy == "revenue" && a.RevenueCents != b.RevenueCents {
+            return a.RevenueCents > b.RevenueCents
+        }
+        if a.UnitsSold != b.UnitsSold {
+            return a.UnitsSold > b.UnitsSold
+        }
+        if a.RevenueCents != b.RevenueCents {
+            return a.RevenueCents > b.RevenueCents
+        }
+        return a.ProductID < b.ProductID
+    })
+    if len(products) > params.Limit {
+        products = products[:params.Limit]
+    }
+
+    if params.Format == "csv" {
+        rows := make([][]string, 0, len(products))
+        for _, p := range products {
+            rows = append(rows, []string{
+                p.ProductID,
+                strconv.Itoa(p.UnitsSold),
+                strconv.Itoa(p.RevenueCents),
+                strconv.Itoa(p.OrderCount),
+            })
+        }
+        writeCSV(w, "top-products.csv", []string{"product_id", "units_sold", "revenue_cents", "order_count"}, rows)
+        return
+    }
+
+    result := map[string]interface{}{
+        "from":     params.From.Unix(),
+        "to":       params.To.Unix(),
+        "sort":     sortBy,
+        "products": products,
+        "total":    len(products),
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(result)
+}
+
+// Highest-value customers over a date range
+func getTopCustomersHandler(w http.ResponseWriter, r *http.Request) {
+    params, err := parseReportParams(r)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+
+    byCustomer := make(map[string]*CustomerValue)
+    for _, order := range revenueOrdersBetween(params.From, params.To) {
+        customer, exists := byCustomer[order.UserID]
+        if !exists {
+            customer = &CustomerValue{UserID: order.UserID}
+            byCustomer[order.UserID] = customer
+        }
+        customer.OrderCount++
+        customer.RevenueCents += netRevenueCents(order)
+        if order.CreatedAt > customer.LastOrderAt {
+            customer.LastOrderAt = order.CreatedAt
+        }
+    }
+
+    customers := make([]CustomerValue, 0, len(byCustomer))
+    for _, customer := range byCustomer {
+        customer.AverageOrderValueCents = customer.RevenueCents / customer.OrderCount
+        customers = append(customers, *customer)
+    }
+    sort.Slice(customers, func(i, j int) bool {
+        if customers[i].RevenueCents != customers[j].RevenueCents {
+            return customers[i].RevenueCents > customers[j].RevenueCents
+        }
+        return customers[i].UserID < customers[j].UserID
+    })
+    if len(customers) > params.Limit {
+        customers = customers[:params.Limit]
+    }
+
+    if params.Format == "csv" {
+        rows := make([][]string, 0, len(customers))
+        for _, c := range customers {
+            rows = append(rows, []string{
+                c.UserID,
+                strconv.Itoa(c.OrderCount),
+                strconv.Itoa(c.RevenueCents),
+                strconv.Itoa(c.AverageOrderValueCents),
+                strconv.FormatInt(c.LastOrderAt, 10),
+            })
+        }
+        writeCSV(w, "top-customers.csv", []string{"user_id", "order_count", "revenue_cents", "average_order_value_cents", "last_order_at"}, rows)
+        return
+    }
+
+    result := map[string]interface{}{
+        "from":      params.From.Unix(),
+        "to":        params.To.Unix(),
+        "customers": customers,
+        "total":     len(customers),
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(result)
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+    "crypto/hmac"
+    "crypto/sha256"
+    "encoding/hex"
+    "encoding/json"
+    "log"
+    "net/http"
+    "os"
+    "strings"
+
+    "middleware/adminauth"
+)
+
+// Staging anonymization. Personal data is replaced with keyed pseudonyms
+// (HMAC-SHA256 under ANONYMIZE_KEY), so one value always maps to the same
+// pseudonym, in every service that shares the key. An email used as a
+// user ID in orders therefore still matches the same user's cart. Opaque
+// identifiers (UUID user, cart and order IDs) carry no personal data and
+// are kept, so references between services stay intact. Values that are
+// already pseudonyms are left alone, which makes anonymizing twice a no-op.
+var anonymizeKey = os.Getenv("ANONYMIZE_KEY")
+
+// AnonymizedEmailDomain is reserved (RFC 2606), so anonymized addresses
+// can never reach a real mailbox
+const AnonymizedEmailDomain = "example.invalid"
+
+// AnonymizedPaymentPrefix marks pseudonymous payment references
+const AnonymizedPaymentPrefix = "pay_anon_"
+
+// AnonymizedAddressPrefix marks pseudonymous address fields
+const AnonymizedAddressPrefix = "anon-"
+
+// Helper function to derive a pseudonym for a value
+func pseudonym(kind string, value string) string {
+    mac := hmac.New(sha256.New, []byte(anonymizeKey))
+    mac.Write([]byte(kind + ":" + value))
+    return hex.EncodeToString(mac.Sum(nil))[:16]
+}
+
+// Helper function to anonymize an email address. Anything that isn't an
+// address is returned unchanged. Test users keep their prefix so test
+// scoped clears still find them.
+func anonymizeEmail(value string) string {
+    if !strings.Contains(value, "@") || strings.HasSuffix(value, "@"+AnonymizedEmailDomain) {
+        return value
+    }
+    prefix := ""
+    if strings.HasPrefix(value, adminauth.TestDataPrefix) {
+        prefix = adminauth.TestDataPrefix
+    }
+    return prefix + "user-" + pseudonym("email", strings.ToLower(value)) + "@" + AnonymizedEmailDomain
+}
+
+// Helper function to anonymize a payment provider reference
+func anonymizePaymentRef(value string) string {
+    if value == "" || strings.HasPrefix(value, AnonymizedPaymentPrefix) {
+        return value
+    }
+    return AnonymizedPaymentPrefix + pseudonym("payment", value)
+}
+
+// Helper function to anonymize an address. Name, street, postal code and
+// phone become pseudonyms; the city, region and country are kept, so tax
+// and regional reports still work.
+func anonymizeAddress(address *Address) *Address {
+    if address == nil {
+        return nil
+    }
+    anonymized := *address
+    for kind, value := range map[string]*string{
+        "name": &anonymized.Name, "company": &anonymized.Company, "line1": &anonymized.Line1,
+        "line2": &anonymized.Line2, "postal_code": &anonymized.PostalCode, "phone": &anonymized.Phone,
+    } {
+        if *value != "" && !strings.HasPrefix(*value, AnonymizedAddressPrefix) {
+            *value = AnonymizedAddressPrefix + pseudonym("address-"+kind, *value)
+        }
+    }
+    return &anonymized
+}
+
+// Helper function to check that anonymization can run. Writes the error
+// response and returns false when it can't.
+func checkAnonymizeKey(w http.ResponseWriter) bool {
+    if anonymizeKey == "" {
+        http.Error(w, "ANONYMIZE_KEY is not set; use the same key in every service so pseudonyms match", http.StatusBadRequest)
+        return false
+    }
+    return true
+}
+
+// Helper function to anonymize one order. The user ID may be an email, the
+// addresses name the customer, and the payment fields point at the
+// customer's payment.
+func anonymizeOrder(order Order) Order {
+    order.UserID = anonymizeEmail(order.UserID)
+    order.ShippingAddress = anonymizeAddress(order.ShippingAddress)
+    order.BillingAddress = anonymizeAddress(order.BillingAddress)
+    order.PaymentID = anonymizePaymentRef(order.PaymentID)
+    if len(order.Payments) > 0 {
+        payments := make([]OrderPayment, len(order.Payments))
+        for i, payment := range order.Payments {
+            payment.PaymentID = anonymizePaymentRef(payment.PaymentID)
+            payments[i] = payment
+        }
+        order.Payments = payments
+    }
+    order.PaymentAction = nil // carries the payment's client secret
+    return order
+}
+
+// Admin endpoint to anonymize every order in place, hot and archived, e.g.
+// after restoring a production backup into staging
+func anonymizeOrdersHandler(w http.ResponseWriter, r *http.Request) {
+    if r.URL.Query().Get("confirm") != serviceName {
+        http.Error(w, "Confirmation required: pass ?confirm="+serviceName, http.StatusBadRequest)
+        return
+    }
+    if !checkAnonymizeKey(w) {
+        return
+    }
+
+    // Same lock order as the test-scope clear: userMu, then every shard
+    userMu.Lock()
+    for _, shard := range orderShards {
+        shard.mu.Lock()
+    }
+
+    anonymized := 0
+    for _, shard := range orderShards {
+        for _, order := range shard.orders {
+            updated := anonymizeOrder(order)
+            if updated.UserID != order.UserID || updated.PaymentID != order.PaymentID || order.PaymentAction != nil {
+                putOrder(shard, updated)
+                anonymized++
+            }
+        }
+    }
+
+    // Re-key the per-user index, keeping each user's orders in order
+    anonymizedUsers := make(map[string][]string, len(userOrders))
+    for userID, orderIDs := range userOrders {
+        key := anonymizeEmail(userID)
+        anonymizedUsers[key] = append(anonymizedUsers[key], orderIDs...)
+    }
+    userOrders = anonymizedUsers
+
+    for _, shard := range orderShards {
+        shard.mu.Unlock()
+    }
+    userMu.Unlock()
+
+    archived := 0
+    _, err := rewriteArchive(func(order *Order) bool {
+        updated := anonymizeOrder(*order)
+        if updated.UserID != order.UserID || updated.PaymentID != order.PaymentID || order.PaymentAction != nil {
+            archived++
+        }
+        *order = updated
+        return true
+    })
+    if err != nil {
+        log.Printf("Failed to anonymize the order archive: %v", err)
+        http.Error(w, "Failed to anonymize the order archive", http.StatusInternalServerError)
+        return
+    }
+
+    // Notes are free text about the customer; none of it is safe to keep,
+    // nor the reasons fraud screening gave about them
+    dropOrderNotes()
+    dropFraudScreenings()
+    dropOrderActivity()
+
+    persistOrders()
+    adminauth.Audit(r, "anonymize", map[string]interface{}{"orders": anonymized, "archived_orders": archived})
+
+    result := map[string]interface{}{
+        "message":         "Orders anonymized",
+        "orders":          anonymized,
+        "archived_orders": archived,
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(result)
+}
@@ -0,0 +1,572 @@
+package main
+
+import (
+    "bufio"
+    "bytes"
+    "encoding/json"
+    "fmt"
+    "io"
+    "log"
+    "net/http"
+    "os"
+    "path/filepath"
+    "strconv"
+    "sync"
+    "sync/atomic"
+    "time"
+
+    "github.com/gorilla/mux"
+    "middleware/adminauth"
+)
+
+// Order archival. Settled orders older than ORDER_RETENTION_MONTHS are
+// moved out of the in-memory store into an append-only NDJSON archive
+// file, one order per line. Only a small index (order ID -> file offset)
+// stays in memory; archived orders are read back from disk on lookup and
+// are no longer part of listings, analytics or snapshots.
+
+// Archive settings (ARCHIVE_PATH="" disables archival)
+var (
+    archivePath     = os.Getenv("ARCHIVE_PATH")
+    archiveInterval = time.Hour
+)
+
+// Orders still waiting on a payment outcome are never archived, so late
+// payment callbacks always find them in the hot store
+var archivableStatuses = map[string]bool{
+    StatusPaid:      true,
+    StatusShipped:   true,
+    StatusDelivered: true,
+    StatusCancelled: true,
+    StatusRefunded:  true,
+}
+
+// archiveEntry locates one archived order in the archive file
+type archiveEntry struct {
+    Offset      int64
+    Length      int
+    UserID      string
+    OrderNumber string
+}
+
+// Archive file and indexes, guarded by archiveMu
+var (
+    archiveMu          sync.RWMutex
+    archiveFile        *os.File
+    archiveSize        int64
+    archiveIndex       = make(map[string]archiveEntry) // orderID -> location
+    archiveUserIndex   = make(map[string][]string)     // userID -> archived orderIDs
+    archiveNumberIndex = make(map[string]string)       // order number -> archived orderID
+    lastArchiveRun     atomic.Int64
+)
+
+func init() {
+    if _, set := os.LookupEnv("ARCHIVE_PATH"); !set {
+        archivePath = "data/orders.archive.ndjson"
+    }
+    if value := os.Getenv("ARCHIVE_INTERVAL_SECONDS"); value != "" {
+        if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+            archiveInterval = time.Duration(seconds) * time.Second
+        } else {
+            log.Printf("Ignoring invalid ARCHIVE_INTERVAL_SECONDS=%q", value)
+        }
+    }
+}
+
+// Helper function to open the archive and rebuild its index. Runs after
+// the snapshot is loaded: an order found in both (a crash between the
+// archive write and the snapshot) stays hot and is archived again on the
+// next run.
+func openArchive() error {
+    if archivePath == "" {
+        return nil
+    }
+
+    if err := os.MkdirAll(filepath.Dir(archivePath), 0755); err != nil {
+        return err
+    }
+    file, err := os.OpenFile(archivePath, os.O_RDWR|os.O_CREATE, 0644)
+    if err != nil {
+        return err
+    }
+
+    archiveMu.Lock()
+    defer archiveMu.Unlock()
+
+    archiveFile = file
+    if err := indexArchive(); err != nil {
+        return err
+    }
+    log.Printf("Archive %s holds %d orders", archivePath, len(archiveIndex))
+    return nil
+}
+
+// Helper function to scan the archive file and rebuild the indexes. A
+// torn final line from a crash mid-append is truncated away. Callers must
+// hold archiveMu.
+func indexArchive() error {
+    archiveIndex = make(map[string]archiveEntry)
+    archiveUserIndex = make(map[string][]string)
+    archiveNumberIndex = make(map[string]string)
+
+    if _, err := archiveFile.Seek(0, io.SeekStart); err != nil {
+        return err
+    }
+    reader := bufio.NewReader(archiveFile)
+
+    var offset int64
+    for {
+        line, err := reader.ReadBytes('\n')
+        if err == io.EOF {
+            if len(line) > 0 {
+                log.Printf("Truncating torn record at offset %d of %s", offset, archivePath)
+                if err := archiveFile.Truncate(offset); err != nil {
+                    return err
+                }
+            }
+            break
+        }
+        if err != nil {
+            return err
+        }
+
+        var order Order
+        if err := json.Unmarshal(line, &order); err != nil {
+            return fmt.Errorf("corrupt archive record at offset %d: %v", offset, err)
+        }
+        if _, hot := getOrder(order.OrderID); !hot {
+            indexArchivedOrder(order, offset, len(line))
+        }
+        offset += int64(len(line))
+    }
+
+    archiveSize = offset
+    return nil
+}
+
+// Helper function to index one archived order. A later copy of the same
+// order replaces the earlier one. Callers must hold archiveMu.
+func indexArchivedOrder(order Order, offset int64, length int) {
+    if _, exists := archiveIndex[order.OrderID]; !exists {
+        archiveUserIndex[order.UserID] = append(archiveUserIndex[order.UserID], order.OrderID)
+    }
+    archiveIndex[order.OrderID] = archiveEntry{Offset: offset, Length: length, UserID: order.UserID, OrderNumber: order.OrderNumber}
+    if order.OrderNumber != "" {
+        archiveNumberIndex[order.OrderNumber] = order.OrderID
+    }
+}
+
+// Helper function to drop an order from the archive indexes. Callers must
+// hold archiveMu.
+func unindexArchivedOrder(orderID string) {
+    entry, exists := archiveIndex[orderID]
+    if !exists {
+        return
+    }
+    delete(archiveIndex, orderID)
+    if entry.OrderNumber != "" {
+        delete(archiveNumberIndex, entry.OrderNumber)
+    }
+    archiveUserIndex[entry.UserID] = removeOrderID(archiveUserIndex[entry.UserID], orderID)
+    if len(archiveUserIndex[entry.UserID]) == 0 {
+        delete(archiveUserIndex, entry.UserID)
+    }
+}
+
+// Helper function to move settled orders created before cutoff into the
+// archive. Orders are appended and fsynced before they leave the hot
+// store, so a crash can duplicate an order but never lose one.
+func archiveOrders(cutoff time.Time) (int, error) {
+    if archivePath == "" {
+        return 0, fmt.Errorf("archival is disabled (ARCHIVE_PATH is empty)")
+    }
+
+    var candidates []Order
+    forEachOrder(func(order Order) {
+        if archivableStatuses[order.Status] && order.CreatedAt < cutoff.Unix() {
+            candidates = append(candidates, order)
+        }
+    })
+    lastArchiveRun.Store(time.Now().Unix())
+    if len(candidates) == 0 {
+        return 0, nil
+    }
+
+    archiveMu.Lock()
+
+    var buf bytes.Buffer
+    offsets := make([]int64, len(candidates))
+    lengths := make([]int, len(candidates))
+    for i, order := range candidates {
+        line, err := json.Marshal(order)
+        if err != nil {
+            archiveMu.Unlock()
+            return 0, err
+        }
+        offsets[i] = archiveSize + int64(buf.Len())
+        lengths[i] = len(line) + 1
+        buf.Write(line)
+        buf.WriteByte('\n')
+    }
+
+    if _, err := archiveFile.WriteAt(buf.Bytes(), archiveSize); err != nil {
+        archiveFile.Truncate(archiveSize)
+        archiveMu.Unlock()
+        return 0, err
+    }
+    if err := archiveFile.Sync(); err != nil {
+        archiveFile.Truncate(archiveSize)
+        archiveMu.Unlock()
+        return 0, err
+    }
+    archiveSize += int64(buf.Len())
+
+    // Remove from the hot store only if the order hasn't changed since it
+    // was copied; otherwise it stays hot and the stale copy is ignored
+    var archived []Order
+    for i, order := range candidates {
+        shard := shardFor(order.OrderID)
+        shard.mu.Lock()
+        current, exists := shard.orders[order.OrderID]
+        if exists && current.UpdatedAt == order.UpdatedAt && current.Status == order.Status {
+            deleteOrder(shard, order.OrderID)
+            indexArchivedOrder(order, offsets[i], lengths[i])
+            archived = append(archived, order)
+        }
+        shard.mu.Unlock()
+    }
+    archiveMu.Unlock()
+
+    userMu.Lock()
+    for _, order := range archived {
+        userOrders[order.UserID] = removeOrderID(userOrders[order.UserID], order.OrderID)
+        if len(userOrders[order.UserID]) == 0 {
+            delete(userOrders, order.UserID)
+        }
+    }
+    userMu.Unlock()
+
+    persistOrders()
+    return len(archived), nil
+}
+
+// Helper function to compute the archival cutoff for a retention period
+func retentionCutoff(months int) time.Time {
+    return time.Now().AddDate(0, -months, 0)
+}
+
+// Archive old orders every archive interval while retention is configured
+func archiveLoop() {
+    if archivePath == "" {
+        return
+    }
+
+    ticker := time.NewTicker(archiveInterval)
+    defer ticker.Stop()
+    for range ticker.C {
+        months := config().OrderRetentionMonths
+        if months == 0 {
+            continue
+        }
+        archived, err := archiveOrders(retentionCutoff(months))
+        if err != nil {
+            log.Printf("Order archival failed: %v", err)
+            continue
+        }
+        if archived > 0 {
+            log.Printf("Archived %d orders older than %d months", archived, months)
+        }
+    }
+}
+
+// Helper function to read an archived order back from disk
+func readArchivedOrder(orderID string) (Order, bool, error) {
+    var order Order
+
+    archiveMu.RLock()
+    defer archiveMu.RUnlock()
+
+    entry, exists := archiveIndex[orderID]
+    if !exists {
+        return order, false, nil
+    }
+
+    buf := make([]byte, entry.Length)
+    if _, err := archiveFile.ReadAt(buf, entry.Offset); err != nil {
+        return order, false, err
+    }
+    if err := json.Unmarshal(buf, &order); err != nil {
+        return order, false, err
+    }
+    return order, true, nil
+}
+
+// Helper function to visit every archived order, reading each from disk
+func forEachArchivedOrder(fn func(order Order)) error {
+    archiveMu.RLock()
+    orderIDs := make([]string, 0, len(archiveIndex))
+    for orderID := range archiveIndex {
+        orderIDs = append(orderIDs, orderID)
+    }
+    archiveMu.RUnlock()
+
+    for _, orderID := range orderIDs {
+        order, exists, err := readArchivedOrder(orderID)
+        if err != nil {
+            return err
+        }
+        if exists {
+            fn(order)
+        }
+    }
+    return nil
+}
+
+// Helper function to rewrite the archive keeping only orders that pass
+// keep; used by admin clears. Returns the number of orders removed.
+func compactArchive(keep func(order Order) bool) (int, error) {
+    return rewriteArchive(func(order *Order) bool { return keep(*order) })
+}
+
+// Helper function to rewrite the archive, passing every order through
+// rewrite, which may change it in place or return false to drop it.
+// Returns the number of orders dropped.
+func rewriteArchive(rewrite func(order *Order) bool) (int, error) {
+    if archivePath == "" {
+        return 0, nil
+    }
+
+    archiveMu.Lock()
+    defer archiveMu.Unlock()
+
+    tmp, err := os.CreateTemp(filepath.Dir(archivePath), ".orders-archive-*")
+    if err != nil {
+        return 0, err
+    }
+    defer os.Remove(tmp.Name())
+
+    writer := bufio.NewWriter(tmp)
+    removed := 0
+    for orderID, entry := range archiveIndex {
+        buf := make([]byte, entry.Length)
+        if _, err := archiveFile.ReadAt(buf, entry.Offset); err != nil {
+            tmp.Close()
+            return 0, err
+        }
+        var order Order
+        if err := json.Unmarshal(buf, &order); err != nil {
+            tmp.Close()
+            return 0, fmt.Errorf("corrupt archive record for order %s: %v", orderID, err)
+        }
+        if !rewrite(&order) {
+            removed++
+            continue
+        }
+        data, err := json.Marshal(order)
+        if err != nil {
+            tmp.Close()
+            return 0, err
+        }
+        writer.Write(append(data, '\n'))
+    }
+
+    if err := writer.Flush(); err != nil {
+        tmp.Close()
+        return 0, err
+    }
+    if err := tmp.Sync(); err != nil {
+        tmp.Close()
+        return 0, err
+    }
+    tmp.Close()
+    if err := os.Rename(tmp.Name(), archivePath); err != nil {
+        return 0, err
+    }
+
+    file, err := os.OpenFile(archivePath, os.O_RDWR, 0644)
+    if err != nil {
+        return 0, err
+    }
+    archiveFile.Close()
+    archiveFile = file
+    return removed, indexArchive()
+}
+
+// Helper function to find an archived order by its order number
+func archivedOrderIDForNumber(number string) (string, bool) {
+    archiveMu.RLock()
+    defer archiveMu.RUnlock()
+    orderID, exists := archiveNumberIndex[number]
+    return orderID, exists
+}
+
+// Helper function to check whether an archived order holds a number
+func archivedOrderNumberTaken(number string) bool {
+    _, exists := archivedOrderIDForNumber(number)
+    return exists
+}
+
+// Helper function to count archived orders
+func countArchivedOrders() int {
+    archiveMu.RLock()
+    defer archiveMu.RUnlock()
+    return len(archiveIndex)
+}
+
+// Get an archived order by ID
+func getArchivedOrderHandler(w http.ResponseWriter, r *http.Request) {
+    orderID := mux.Vars(r)["orderId"]
+    if archivedID, exists := archivedOrderIDForNumber(normalizeOrderNumber(orderID)); exists {
+        orderID = archivedID
+    }
+
+    order, exists, err := readArchivedOrder(orderID)
+    if err != nil {
+        log.Printf("Failed to read archived order %s: %v", orderID, err)
+        http.Error(w, "Failed to read order archive", http.StatusInternalServerError)
+        return
+    }
+    if !exists {
+        http.Error(w, "Archived order not found", http.StatusNotFound)
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(order)
+}
+
+// Helper function to visit a user's archived orders, reading each from
+// disk
+func forEachArchivedUserOrder(userID string, fn func(order Order)) error {
+    archiveMu.RLock()
+    orderIDs := append([]string(nil), archiveUserIndex[userID]...)
+    archiveMu.RUnlock()
+
+    for _, orderID := range orderIDs {
+        order, exists, err := readArchivedOrder(orderID)
+        if err != nil {
+            return fmt.Errorf("reading archived order %s: %w", orderID, err)
+        }
+        if exists {
+            fn(order)
+        }
+    }
+    return nil
+}
+
+// Get a user's archived orders
+func getArchivedUserOrdersHandler(w http.ResponseWriter, r *http.Request) {
+    userID := mux.Vars(r)["userId"]
+
+    orders := []Order{}
+    if err := forEachArchivedUserOrder(userID, func(order Order) { orders = append(orders, order) }); err != nil {
+        log.Printf("Failed to read archived orders of user %s: %v", userID, err)
+        http.Error(w, "Failed to read order archive", http.StatusInternalServerError)
+        return
+    }
+
+    result := map[string]interface{}{
+        "orders":   orders,
+        "total":    len(orders),
+        "archived": true,
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(result)
+}
+
+// Admin endpoint to list archived orders, with the filters and paging of
+// the hot listing (see parseOrderFilter and parseOrderPaging). With
+// ?user_id= only that user's orders are read from disk; otherwise the
+// whole archive is.
+func listArchivedOrdersHandler(w http.ResponseWriter, r *http.Request) {
+    filter, err := parseOrderFilter(r)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+    paging, err := parseOrderPaging(r)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+
+    orders := []Order{}
+    collect := func(order Order) {
+        if filter.matches(order) {
+            orders = append(orders, order)
+        }
+    }
+    if filter.UserID != "" {
+        err = forEachArchivedUserOrder(filter.UserID, collect)
+    } else {
+        err = forEachArchivedOrder(collect)
+    }
+    if err != nil {
+        log.Printf("Failed to list archived orders: %v", err)
+        http.Error(w, "Failed to read order archive", http.StatusInternalServerError)
+        return
+    }
+
+    result := paging.page(orders)
+    result["archived"] = true
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(result)
+}
+
+// Admin endpoint to archive old orders now. ?older_than_months= overrides
+// ORDER_RETENTION_MONTHS for this run.
+func runArchiveHandler(w http.ResponseWriter, r *http.Request) {
+    if archivePath == "" {
+        http.Error(w, "Archival is disabled (ARCHIVE_PATH is empty)", http.StatusConflict)
+        return
+    }
+
+    months := config().OrderRetentionMonths
+    if value := r.URL.Query().Get("older_than_months"); value != "" {
+        parsed, err := strconv.Atoi(value)
+        if err != nil || parsed < 0 {
+            http.Error(w, "older_than_months must be a non-negative integer", http.StatusBadRequest)
+            return
+        }
+        months = parsed
+    }
+    if months == 0 && r.URL.Query().Get("older_than_months") == "" {
+        http.Error(w, "Retention is not configured: set ORDER_RETENTION_MONTHS or pass ?older_than_months=", http.StatusBadRequest)
+        return
+    }
+
+    cutoff := retentionCutoff(months)
+    archived, err := archiveOrders(cutoff)
+    if err != nil {
+        log.Printf("Order archival failed: %v", err)
+        http.Error(w, "Archival failed: "+err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    adminauth.Audit(r, "archive", map[string]interface{}{"older_than_months": months, "archived": archived})
+
+    result := map[string]interface{}{
+        "message":        "Orders archived",
+        "cutoff":         cutoff.Unix(),
+        "archived":       archived,
+        "archived_total": countArchivedOrders(),
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(result)
+}
+
+// Helper function to report archival metrics
+func archiveMetrics() string {
+    return fmt.Sprintf(`
+# HELP order_service_archived_orders_total Orders moved to the archive
+# TYPE order_service_archived_orders_total gauge
+order_service_archived_orders_total %d
+
+# HELP order_service_archive_last_run_timestamp_seconds When archival last ran
+# TYPE order_service_archive_last_run_timestamp_seconds gauge
+order_service_archive_last_run_timestamp_seconds %d
+`, countArchivedOrders(), lastArchiveRun.Load())
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "log"
+    "net/http"
+
+    "middleware/adminauth"
+    "middleware/backup"
+    "middleware/httpserver"
+    "money"
+)
+
+// Helper function to parse ?anonymize=true, which anonymizes records as
+// they are imported. Writes the error response and returns false on
+// failure.
+func parseAnonymizeFlag(w http.ResponseWriter, r *http.Request) (bool, bool) {
+    switch r.URL.Query().Get("anonymize") {
+    case "", "false":
+        return false, true
+    case "true":
+        return true, checkAnonymizeKey(w)
+    }
+    http.Error(w, "anonymize must be 'true' or 'false'", http.StatusBadRequest)
+    return false, false
+}
+
+// Admin endpoint to stream every order as a backup. The per-user index is
+// rebuilt from the orders on restore, so it isn't part of the stream.
+func backupOrdersHandler(w http.ResponseWriter, r *http.Request) {
+    // Copy first so slow clients never hold shard locks
+    snapshot := make([]Order, 0, countOrders())
+    forEachOrder(func(order Order) {
+        snapshot = append(snapshot, order)
+    })
+
+    writer := backup.NewWriter(w)
+    for _, order := range snapshot {
+        if err := writer.Write("order", order.OrderID, order); err != nil {
+            log.Printf("Backup aborted after %d records: %v", writer.Count(), err)
+            return
+        }
+    }
+
+    adminauth.Audit(r, "backup", map[string]interface{}{"records": writer.Count()})
+}
+
+// Admin endpoint to import orders from a backup
+func restoreOrdersHandler(w http.ResponseWriter, r *http.Request) {
+    policy, ok := backup.ParseConflictPolicy(w, r)
+    if !ok {
+        return
+    }
+    anonymize, ok := parseAnonymizeFlag(w, r)
+    if !ok {
+        return
+    }
+
+    httpserver.LiftDeadlines(w)
+    records, err := backup.Read(r.Body)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+
+    incoming := make([]Order, 0, len(records))
+    for _, record := range records {
+        if record.Type != "order" {
+            http.Error(w, fmt.Sprintf("Unknown record type %q", record.Type), http.StatusBadRequest)
+            return
+        }
+        var order Order
+        if err := json.Unmarshal(record.Data, &order); err != nil || order.OrderID == "" {
+            http.Error(w, fmt.Sprintf("Invalid order record %q", record.ID), http.StatusBadRequest)
+            return
+        }
+        if order.Currency == "" {
+            order.Currency = money.DefaultCurrency // backups taken before orders had a currency
+        }
+        if anonymize {
+            order = anonymizeOrder(order)
+        }
+        incoming = append(incoming, order)
+    }
+
+    // Lock every shard (always in index order) so a
+    // fail-policy restore checks and applies atomically
+    for _, shard := range orderShards {
+        shard.mu.Lock()
+    }
+
+    var result backup.Result
+    actions := make([]string, len(incoming))
+    previousOwners := make(map[string]string) // order ID -> user ID before the restore
+    for i, order := range incoming {
+        existing, exists := shardFor(order.OrderID).orders[order.OrderID]
+        actions[i] = result.Classify(policy, order.OrderID, exists, existing, order)
+        if exists {
+            previousOwners[order.OrderID] = existing.UserID
+        }
+    }
+
+    var changed []Order
+    if result.Applies(policy) {
+        for i, order := range incoming {
+            if actions[i] == backup.ActionCreate || actions[i] == backup.ActionUpdate {
+                putOrder(shardFor(order.OrderID), order)
+                changed = append(changed, order)
+            }
+        }
+    }
+
+    for _, shard := range orderShards {
+        shard.mu.Unlock()
+    }
+
+    // Index restored orders by user (after the shards are released, since
+    // the test-scope clear takes userMu before shard locks)
+    userMu.Lock()
+    for _, order := range changed {
+        if previous, exists := previousOwners[order.OrderID]; exists {
+            if previous == order.UserID {
+                continue
+            }
+            userOrders[previous] = removeOrderID(userOrders[previous], order.OrderID)
+            if len(userOrders[previous]) == 0 {
+                delete(userOrders, previous)
+            }
+        }
+        userOrders[order.UserID] = append(userOrders[order.UserID], order.OrderID)
+    }
+    userMu.Unlock()
+
+    // Restored orders are hot again; stop serving their archived copies
+    archiveMu.Lock()
+    for _, order := range changed {
+        unindexArchivedOrder(order.OrderID)
+    }
+    archiveMu.Unlock()
+
+    if len(changed) > 0 {
+        persistOrders()
+    }
+
+    backup.WriteResult(w, r, policy, result)
+}
+
+// Helper function to drop an order ID from a user's order list
+func removeOrderID(orderIDs []string, orderID string) []string {
+    kept := orderIDs[:0]
+    for _, id := range orderIDs {
+        if id != orderID {
+            kept = append(kept, id)
+        }
+    }
+    return kept
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+    "errors"
+    "fmt"
+    "log"
+    "net/http"
+    "sync"
+    "sync/atomic"
+    "time"
+)
+
+// Circuit breakers. Calls to payment-service, inventory-service and
+// notification-service each go through their service's breaker, so when
+// one is down callers fail at once instead of waiting out the timeout:
+//
+//   - closed: calls go through. CIRCUIT_BREAKER_FAILURE_THRESHOLD failures
+//     in a row (transport errors or 5xx responses) open it.
+//   - open: calls fail with errCircuitOpen without being sent, for
+//     CIRCUIT_BREAKER_OPEN_SECONDS.
+//   - half_open: one probe call is let through. If it succeeds the breaker
+//     closes; if it fails the breaker opens again.
+//
+// Readiness probes don't go through the breakers; they report on the
+// dependencies rather than depend on them.
+const (
+    BreakerClosed   = "closed"
+    BreakerOpen     = "open"
+    BreakerHalfOpen = "half_open"
+
+    DefaultBreakerFailureThreshold = 5
+    DefaultBreakerOpenSeconds      = 30
+)
+
+var errCircuitOpen = errors.New("circuit breaker open")
+
+// circuitBreaker tracks the health of calls to one service
+type circuitBreaker struct {
+    Target string // service name, for logs and metrics
+
+    mu       sync.Mutex
+    state    string
+    failures int       // consecutive failures while closed
+    openedAt time.Time // when it last opened
+    probing  bool      // the half-open probe is in flight
+
+    openedTotal   atomic.Int64
+    rejectedTotal atomic.Int64
+}
+
+var (
+    paymentBreaker      = &circuitBreaker{Target: "payment", state: BreakerClosed}
+    inventoryBreaker    = &circuitBreaker{Target: "inventory", state: BreakerClosed}
+    notificationBreaker = &circuitBreaker{Target: "notification", state: BreakerClosed}
+    circuitBreakers     = []*circuitBreaker{paymentBreaker, inventoryBreaker, notificationBreaker}
+)
+
+// breakerTransport sends requests through a breaker on the shared
+// outbound transport
+type breakerTransport struct {
+    Breaker *circuitBreaker
+    Next    http.RoundTripper
+}
+
+func (t *breakerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+    if !t.Breaker.allow() {
+        if req.Body != nil {
+            req.Body.Close()
+        }
+        return nil, fmt.Errorf("%s service: %w", t.Breaker.Target, errCircuitOpen)
+    }
+    resp, err := t.Next.RoundTrip(req)
+    t.Breaker.record(err == nil && resp.StatusCode < 500)
+    return resp, err
+}
+
+// Helper function to create an HTTP client for a service behind its breaker
+func newServiceClient(breaker *circuitBreaker, timeout time.Duration) *http.Client {
+    return &http.Client{Transport: &breakerTransport{Breaker: breaker, Next: outboundTransport}, Timeout: timeout}
+}
+
+// Helper function to check whether a call failed because its breaker is open
+func isCircuitOpen(err error) bool {
+    return errors.Is(err, errCircuitOpen)
+}
+
+// Helper function to read the breaker settings into a configuration
+func loadBreakerSettings(cfg *serviceConfig) error {
+    return loadIntSettings([]intSetting{
+        {"CIRCUIT_BREAKER_FAILURE_THRESHOLD", &cfg.BreakerFailureThreshold, DefaultBreakerFailureThreshold, 1, 1000},
+        {"CIRCUIT_BREAKER_OPEN_SECONDS", &cfg.BreakerOpenSeconds, DefaultBreakerOpenSeconds, 1, 3600},
+    })
+}
+
+// Helper function to get how long a breaker stays open
+func breakerOpenDuration() time.Duration {
+    return time.Duration(config().BreakerOpenSeconds) * time.Second
+}
+
+// Helper function to decide whether a call may be sent. An open breaker
+// turns half-open once its open time is up, and lets one probe through.
+func (b *circuitBreaker) allow() bool {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+
+    switch b.state {
+    case BreakerOpen:
+        if time.Since(b.openedAt) < breakerOpenDuration() {
+            b.rejectedTotal.Add(1)
+            return false
+        }
+        b.state = BreakerHalfOpen
+        b.probing = true
+        log.Printf("Circuit breaker for %s service is half-open, probing", b.Target)
+    case BreakerHalfOpen:
+        if b.probing {
+            b.rejectedTotal.Add(1)
+            return false
+        }
+        b.probing = true
+    }
+    return true
+}
+
+// Helper function to record a call's outcome
+func (b *circuitBreaker) record(success bool) {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+
+    switch b.state {
+    case BreakerClosed:
+        if success {
+            b.failures = 0
+            return
+        }
+        b.failures++
+        if b.failures >= config().BreakerFailureThreshold {
+            b.trip(fmt.Sprintf("%d failures in a row", b.failures))
+        }
+    case BreakerHalfOpen:
+        b.probing = false
+        if !success {
+            b.trip("probe failed")
+            return
+        }
+        b.state = BreakerClosed
+        b.failures = 0
+        log.Printf("Circuit breaker for %s service closed, probe succeeded", b.Target)
+    }
+    // Calls sent before the breaker opened don't change an open breaker
+}
+
+// Helper function to open the breaker. Callers must hold b.mu.
+func (b *circuitBreaker) trip(reason string) {
+    b.state = BreakerOpen
+    b.openedAt = time.Now()
+    b.failures = 0
+    b.openedTotal.Add(1)
+    log.Printf("Circuit breaker for %s service opened (%s); failing calls for %s", b.Target, reason, breakerOpenDuration())
+}
+
+// Helper function to read a breaker's state
+func (b *circuitBreaker) currentState() string {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    return b.state
+}
+
+// Helper function to report circuit breaker metrics
+func breakerMetrics() string {
+    metrics := `
+# HELP order_service_circuit_breaker_state Circuit breaker state per downstream service (1 for the current state)
+# TYPE order_service_circuit_breaker_state gauge
+`
+    for _, breaker := range circuitBreakers {
+        state := breaker.currentState()
+        for _, candidate := range []string{BreakerClosed, BreakerOpen, BreakerHalfOpen} {
+            value := 0
+            if state == candidate {
+                value = 1
+            }
+            metrics += fmt.Sprintf("order_service_circuit_breaker_state{target=%q,state=%q} %d\n", breaker.Target, candidate, value)
+        }
+    }
+    metrics += `
+# HELP order_service_circuit_breaker_opened_total Times a circuit breaker opened
+# TYPE order_service_circuit_breaker_opened_total counter
+`
+    for _, breaker := range circuitBreakers {
+        metrics += fmt.Sprintf("order_service_circuit_breaker_opened_total{target=%q} %d\n", breaker.Target, breaker.openedTotal.Load())
+    }
+    metrics += `
+# HELP order_service_circuit_breaker_rejected_total Calls failed without being sent because a circuit breaker was open
+# TYPE order_service_circuit_breaker_rejected_total counter
+`
+    for _, breaker := range circuitBreakers {
+        metrics += fmt.Sprintf("order_service_circuit_breaker_rejected_total{target=%q} %d\n", breaker.Target, breaker.rejectedTotal.Load())
+    }
+    return metrics
+}
@@ -0,0 +1,330 @@
+package main
+
+import (
+    "bufio"
+    "bytes"
+    "encoding/json"
+    "fmt"
+    "net"
+    "net/http"
+    "net/url"
+    "strings"
+    "sync"
+    "sync/atomic"
+    "time"
+)
+
+// Message brokers order events can be published to (ORDER_EVENTS_BROKER)
+const (
+    BrokerNATS  = "nats"  // core NATS; the subject is the event type
+    BrokerKafka = "kafka" // through a Kafka REST proxy; keyed by order ID
+)
+
+// DefaultOrderEventsTopic is the Kafka topic when ORDER_EVENTS_TOPIC is unset
+const DefaultOrderEventsTopic = "order-events"
+
+// BrokerTimeout bounds connecting to and waiting on the broker
+const BrokerTimeout = 5 * time.Second
+
+// eventPublisher sends order events to a message broker. Publish returns
+// once the broker has accepted the events.
+type eventPublisher interface {
+    Publish(events []OrderEvent) error
+    Close() error
+}
+
+// Broker publishing counters
+var (
+    eventsPublished     atomic.Int64
+    eventsPublishFailed atomic.Int64
+)
+
+// The publisher for the configured broker, rebuilt when the broker
+// settings change on a config reload
+var (
+    publisherMu  sync.Mutex
+    publisher    eventPublisher
+    publisherKey string
+)
+
+// Helper function to get the publisher for the configured broker; nil
+// when no broker is configured
+func currentPublisher() eventPublisher {
+    cfg := config()
+    key := cfg.OrderEventsBroker + "|" + cfg.OrderEventsBrokerURL + "|" + cfg.OrderEventsTopic
+
+    publisherMu.Lock()
+    defer publisherMu.Unlock()
+
+    if key == publisherKey {
+        return publisher
+    }
+    if publisher != nil {
+        publisher.Close()
+    }
+
+    switch cfg.OrderEventsBroker {
+    case BrokerNATS:
+        publisher = newNATSPublisher(cfg.OrderEventsBrokerURL)
+    case BrokerKafka:
+        publisher = &kafkaPublisher{
+            url:    strings.TrimSuffix(cfg.OrderEventsBrokerURL, "/"),
+            topic:  cfg.OrderEventsTopic,
+            client: newHTTPClient(BrokerTimeout),
+        }
+    default:
+        publisher = nil
+    }
+    publisherKey = key
+    return publisher
+}
+
+// Helper function to publish events to the configured broker, if any
+func publishOrderEvents(events []OrderEvent) error {
+    target := currentPublisher()
+    if target == nil || len(events) == 0 {
+        return nil
+    }
+    if err := target.Publish(events); err != nil {
+        eventsPublishFailed.Add(int64(len(events)))
+        return err
+    }
+    eventsPublished.Add(int64(len(events)))
+    return nil
+}
+
+// natsPublisher speaks the NATS client protocol over one long-lived
+// connection: a PUB per event, then a PING whose PONG confirms the server
+// has processed them. Server PINGs that arrive while idle go unanswered
+// and the server drops the connection, so a publish that fails on an old
+// connection is retried once on a new one.
+type natsPublisher struct {
+    mu       sync.Mutex
+    address  string // host:port
+    user     string
+    password string
+    token    string
+    conn     net.Conn
+    reader   *bufio.Reader
+}
+
+// Helper function to set up a NATS publisher for a nats://[user:pass@]host:port
+// or nats://token@host:port URL. It connects on first use.
+func newNATSPublisher(rawURL string) *natsPublisher {
+    parsed, _ := url.Parse(rawURL) // validated when the config was loaded
+    publisher := &natsPublisher{address: parsed.Host}
+    if parsed.Port() == "" {
+        publisher.address = net.JoinHostPort(parsed.Hostname(), "4222")
+    }
+    if parsed.User != nil {
+        if password, set := parsed.User.Password(); set {
+            publisher.user = parsed.User.Username()
+            publisher.password = password
+        } else {
+            publisher.token = parsed.User.Username()
+        }
+    }
+    return publisher
+}
+
+// Helper function to open a connection: read the server's INFO, then send
+// CONNECT. Callers must hold mu.
+func (p *natsPublisher) connect() error {
+    conn, err := net.DialTimeout("tcp", p.address, BrokerTimeout)
+    if err != nil {
+        return err
+    }
+    conn.SetDeadline(time.Now().Add(BrokerTimeout))
+    reader := bufio.NewReader(conn)
+
+    line, err := reader.ReadString('\n')
+    if err != nil {
+        conn.Close()
+        return err
+    }
+    if !strings.HasPrefix(line, "INFO ") {
+        conn.Close()
+        return fmt.Errorf("nats: expected INFO, got %q", strings.TrimSpace(line))
+    }
+    var info struct {
+        TLSRequired bool `json:"tls_required"`
+    }
+    json.Unmarshal([]byte(strings.TrimPrefix(line, "INFO ")), &info)
+    if info.TLSRequired {
+        conn.Close()
+        return fmt.Errorf("nats: server at %s requires TLS, which is not supported", p.address)
+    }
+
+    options := map[string]interface{}{
+        "verbose":  false,
+        "pedantic": false,
+        "name":     serviceName,
+        "lang":     "go",
+        "version":  "1.0.0",
+        "protocol": 1,
+    }
+    if p.user != "" {
+        options["user"] = p.user
+        options["pass"] = p.password
+    }
+    if p.token != "" {
+        options["auth_token"] = p.token
+    }
+    connectOptions, _ := json.Marshal(options)
+    if _, err := fmt.Fprintf(conn, "CONNECT %s\r\n", connectOptions); err != nil {
+        conn.Close()
+        return err
+    }
+
+    p.conn = conn
+    p.reader = reader
+    return nil
+}
+
+// Helper function to drop the connection. Callers must hold mu.
+func (p *natsPublisher) disconnect() {
+    if p.conn != nil {
+        p.conn.Close()
+        p.conn = nil
+        p.reader = nil
+    }
+}
+
+// Helper function to publish over the current connection and wait for
+// the server to confirm. Callers must hold mu.
+func (p *natsPublisher) publishOnce(events []OrderEvent) error {
+    var buffer bytes.Buffer
+    for _, event := range events {
+        payload, err := json.Marshal(event)
+        if err != nil {
+            return err
+        }
+        fmt.Fprintf(&buffer, "PUB %s %d\r\n", event.Type, len(payload))
+        buffer.Write(payload)
+        buffer.WriteString("\r\n")
+    }
+    buffer.WriteString("PING\r\n")
+
+    p.conn.SetDeadline(time.Now().Add(BrokerTimeout))
+    if _, err := p.conn.Write(buffer.Bytes()); err != nil {
+        return err
+    }
+
+    for {
+        line, err := p.reader.ReadString('\n')
+        if err != nil {
+            return err
+        }
+        line = strings.TrimSpace(line)
+        switch {
+        case line == "PONG":
+            return nil
+        case line == "PING":
+            if _, err := p.conn.Write([]byte("PONG\r\n")); err != nil {
+                return err
+            }
+        case strings.HasPrefix(line, "-ERR"):
+            return fmt.Errorf("nats: %s", strings.TrimSpace(strings.TrimPrefix(line, "-ERR")))
+        }
+        // +OK and INFO updates need no answer
+    }
+}
+
+// Publish sends each event on the subject named by its type
+func (p *natsPublisher) Publish(events []OrderEvent) error {
+    p.mu.Lock()
+    defer p.mu.Unlock()
+
+    reused := p.conn != nil
+    for {
+        if p.conn == nil {
+            if err := p.connect(); err != nil {
+                return err
+            }
+        }
+        err := p.publishOnce(events)
+        if err == nil {
+            return nil
+        }
+        p.disconnect()
+        if !reused {
+            return err
+        }
+        reused = false
+    }
+}
+
+// Close drops the connection
+func (p *natsPublisher) Close() error {
+    p.mu.Lock()
+    defer p.mu.Unlock()
+    p.disconnect()
+    return nil
+}
+
+// kafkaPublisher produces events through a Kafka REST proxy (Confluent
+// REST Proxy v2 or Redpanda's HTTP proxy). Records are keyed by order ID,
+// so an order's events land on one partition in order.
+type kafkaPublisher struct {
+    url    string
+    topic  string
+    client *http.Client
+}
+
+// Publish produces one record per event in a single request
+func (p *kafkaPublisher) Publish(events []OrderEvent) error {
+    type record struct {
+        Key   string     `json:"key"`
+        Value OrderEvent `json:"value"`
+    }
+    records := make([]record, 0, len(events))
+    for _, event := range events {
+        records = append(records, record{Key: eventOrderID(event), Value: event})
+    }
+    body, err := json.Marshal(map[string]interface{}{"records": records})
+    if err != nil {
+        return err
+    }
+
+    req, err := http.NewRequest(http.MethodPost, p.url+"/topics/"+url.PathEscape(p.topic), bytes.NewReader(body))
+    if err != nil {
+        return err
+    }
+    req.Header.Set("Content-Type", "application/vnd.kafka.json.v2+json")
+    req.Header.Set("Accept", "application/vnd.kafka.v2+json")
+
+    resp, err := p.client.Do(req)
+    if err != nil {
+        return err
+    }
+    defer resp.Body.Close()
+
+    var produced struct {
+        Offsets []struct {
+            Partition int     `json:"partition"`
+            Offset    int64   `json:"offset"`
+            ErrorCode *int    `json:"error_code"`
+            Error     *string `json:"error"`
+        } `json:"offsets"`
+        Message string `json:"message"`
+    }
+    json.NewDecoder(resp.Body).Decode(&produced)
+    if resp.StatusCode >= 300 {
+        return fmt.Errorf("kafka proxy returned status %d: %s", resp.StatusCode, produced.Message)
+    }
+    for _, offset := range produced.Offsets {
+        if offset.ErrorCode != nil || offset.Error != nil {
+            message := ""
+            if offset.Error != nil {
+                message = *offset.Error
+            }
+            return fmt.Errorf("kafka proxy failed to produce a record: %s", message)
+        }
+    }
+    return nil
+}
+
+// Close has nothing to release; requests share no connection state
+func (p *kafkaPublisher) Close() error {
+    return nil
+}
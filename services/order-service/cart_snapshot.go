@@ -0,0 +1,96 @@
+package main
+
+import (
+    "crypto/hmac"
+    "crypto/sha256"
+    "encoding/base64"
+    "encoding/hex"
+    "encoding/json"
+    "strings"
+    "sync"
+    "time"
+
+    "middleware/i18n"
+)
+
+// CartSnapshot is the cart contents cart-service froze at checkout
+// (POST /api/cart/{userId}/checkout). Orders are built from it rather than
+// from a fresh read of the cart, so the cart can't change between the
+// read and the payment.
+type CartSnapshot struct {
+    SnapshotID    string      `json:"snapshot_id"`
+    CartID        string      `json:"cart_id"`
+    UserID        string      `json:"user_id"`
+    Items         []OrderItem `json:"items"`
+    SubtotalCents int         `json:"subtotal_cents"`
+    Currency      string      `json:"currency"`
+    CreatedAt     int64       `json:"created_at"`
+    ExpiresAt     int64       `json:"expires_at"`
+}
+
+// Snapshot IDs already turned into orders, with their expiry. A snapshot
+// is single use; entries are dropped once the snapshot would have expired
+// anyway.
+var (
+    usedCartSnapshots   = make(map[string]int64)
+    usedCartSnapshotsMu sync.Mutex
+)
+
+// Helper function to verify and decode a checkout snapshot token,
+// "<base64url JSON>.<hex HMAC-SHA256 of the encoded JSON>"
+func decodeCartSnapshot(token string, now time.Time) (CartSnapshot, error) {
+    var snapshot CartSnapshot
+
+    payload, signature, found := strings.Cut(token, ".")
+    if !found || payload == "" {
+        return snapshot, i18n.NewError("order.cart_snapshot_invalid")
+    }
+    if cartSnapshotSecret != "" {
+        mac := hmac.New(sha256.New, []byte(cartSnapshotSecret))
+        mac.Write([]byte(payload))
+        if !hmac.Equal([]byte(signature), []byte(hex.EncodeToString(mac.Sum(nil)))) {
+            return snapshot, i18n.NewError("order.cart_snapshot_invalid")
+        }
+    }
+
+    data, err := base64.RawURLEncoding.DecodeString(payload)
+    if err != nil {
+        return snapshot, i18n.NewError("order.cart_snapshot_invalid")
+    }
+    if err := json.Unmarshal(data, &snapshot); err != nil {
+        return snapshot, i18n.NewError("order.cart_snapshot_invalid")
+    }
+    if snapshot.SnapshotID == "" || len(snapshot.Items) == 0 {
+        return snapshot, i18n.NewError("order.cart_snapshot_empty")
+    }
+    if now.Unix() > snapshot.ExpiresAt {
+        return snapshot, i18n.NewError("order.cart_snapshot_expired")
+    }
+    return snapshot, nil
+}
+
+// Helper function to mark a snapshot as used. Returns false if an order
+// was already created from it.
+func claimCartSnapshot(snapshot CartSnapshot, now time.Time) bool {
+    usedCartSnapshotsMu.Lock()
+    defer usedCartSnapshotsMu.Unlock()
+
+    for snapshotID, expiresAt := range usedCartSnapshots {
+        if now.Unix() > expiresAt {
+            delete(usedCartSnapshots, snapshotID)
+        }
+    }
+    if _, used := usedCartSnapshots[snapshot.SnapshotID]; used {
+        return false
+    }
+    usedCartSnapshots[snapshot.SnapshotID] = snapshot.ExpiresAt
+    return true
+}
+
+// Helper function to give a snapshot back when the order couldn't be
+// attempted (payment service unreachable), so the client can retry
+func releaseCartSnapshot(snapshotID string) {
+    usedCartSnapshotsMu.Lock()
+    delete(usedCartSnapshots, snapshotID)
+    usedCartSnapshotsMu.Unlock()
+}
@@ -0,0 +1,500 @@
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "log"
+    "net/http"
+    "os"
+    "slices"
+    "strconv"
+    "strings"
+    "sync"
+    "sync/atomic"
+    "time"
+
+    "github.com/gorilla/mux"
+    "middleware/i18n"
+    "middleware/openmetrics"
+)
+
+// Checkout modes. In async mode (CHECKOUT_MODE=async, or a client sending
+// "Prefer: respond-async") a checkout is validated, stored as "pending"
+// and answered with 202 straight away; a worker then moves it to
+// "processing", takes the payment, commits inventory and queues the
+// confirmation, so checkout latency no longer depends on the downstream
+// services. Clients poll GET /api/orders/{orderId}/status or follow the
+// order lifecycle events.
+// In auto mode checkouts run synchronously until payment-service slows
+// down: while the p99 of its recent calls is at or above
+// CHECKOUT_ASYNC_LATENCY_MS they are answered with 202 as in async mode.
+const (
+    CheckoutModeSync  = "sync"
+    CheckoutModeAsync = "async"
+    CheckoutModeAuto  = "auto"
+)
+
+// Auto mode looks at the last PaymentLatencySamples payment calls, and
+// needs MinPaymentLatencySamples before it goes by them
+const (
+    DefaultCheckoutAsyncLatencyMS = 1000
+    PaymentLatencySamples         = 200
+    MinPaymentLatencySamples      = 20
+)
+
+// checkoutJob is one accepted checkout waiting for a worker. The payment
+// methods to charge only live here until they are charged; they are never
+// written to the order snapshot.
+type checkoutJob struct {
+    OrderID    string
+    Payments   []PaymentInstrument // see planPayments
+    SnapshotID string
+    TraceID    string // of the checkout request, for the order events
+    ClientIP   string // for fraud screening
+    Priority   string // express jobs are taken first; see priority.go
+}
+
+// Checkout worker settings
+var (
+    checkoutWorkers   = 4
+    checkoutQueueSize = 1000
+)
+
+// checkoutsPending counts accepted checkouts not yet finished. It is capped
+// at the queue size, so sends to either queue never block. Workers take
+// from expressCheckoutQueue first.
+var (
+    checkoutQueue        chan *checkoutJob
+    expressCheckoutQueue chan *checkoutJob
+    checkoutsPending     atomic.Int64
+)
+
+// Asynchronous checkout counters
+var (
+    checkoutsAccepted    atomic.Int64
+    checkoutsCompleted   atomic.Int64
+    checkoutsFailed      atomic.Int64
+    checkoutsRejected    atomic.Int64
+    checkoutsInterrupted atomic.Int64
+    checkoutsDeferred    atomic.Int64
+)
+
+// Durations of recent payment-service calls, oldest overwritten first
+var (
+    paymentLatencies    [PaymentLatencySamples]time.Duration
+    paymentLatencyCount int
+    paymentLatencyMu    sync.Mutex
+)
+
+func init() {
+    if value, err := strconv.Atoi(os.Getenv("CHECKOUT_WORKERS")); err == nil && value > 0 {
+        checkoutWorkers = value
+    }
+    if value, err := strconv.Atoi(os.Getenv("CHECKOUT_QUEUE_SIZE")); err == nil && value > 0 {
+        checkoutQueueSize = value
+    }
+    checkoutQueue = make(chan *checkoutJob, checkoutQueueSize)
+    expressCheckoutQueue = make(chan *checkoutJob, checkoutQueueSize)
+}
+
+// Helper function to check whether a checkout should be answered before
+// it is processed
+func wantsAsyncCheckout(r *http.Request) bool {
+    cfg := config()
+    if cfg.CheckoutMode == CheckoutModeAsync {
+        return true
+    }
+    for _, preference := range strings.Split(r.Header.Get("Prefer"), ",") {
+        if strings.EqualFold(strings.TrimSpace(preference), "respond-async") {
+            return true
+        }
+    }
+    if cfg.CheckoutMode == CheckoutModeAuto && paymentLatencyP99() >= time.Duration(cfg.CheckoutAsyncLatencyMS)*time.Millisecond {
+        checkoutsDeferred.Add(1)
+        return true
+    }
+    return false
+}
+
+// Helper function to record how long a payment-service call took
+func observePaymentLatency(elapsed time.Duration) {
+    paymentLatencyMu.Lock()
+    defer paymentLatencyMu.Unlock()
+
+    paymentLatencies[paymentLatencyCount%PaymentLatencySamples] = elapsed
+    paymentLatencyCount++
+}
+
+// Helper function to get the p99 of recent payment-service calls. Returns
+// 0 until there are MinPaymentLatencySamples of them.
+func paymentLatencyP99() time.Duration {
+    paymentLatencyMu.Lock()
+    samples := append([]time.Duration(nil), paymentLatencies[:min(paymentLatencyCount, PaymentLatencySamples)]...)
+    paymentLatencyMu.Unlock()
+
+    if len(samples) < MinPaymentLatencySamples {
+        return 0
+    }
+    slices.Sort(samples)
+    return samples[(len(samples)*99+99)/100-1]
+}
+
+// Helper function to accept a validated checkout for background
+// processing. The caller has already claimed the cart snapshot.
+func acceptCheckout(w http.ResponseWriter, r *http.Request, order Order, plan []PaymentInstrument, snapshotID string) {
+    if checkoutsPending.Add(1) > int64(cap(checkoutQueue)) {
+        checkoutsPending.Add(-1)
+        checkoutsRejected.Add(1)
+        if snapshotID != "" {
+            releaseCartSnapshot(snapshotID)
+        }
+        w.Header().Set("Retry-After", "5")
+        i18n.WriteError(w, r, http.StatusServiceUnavailable, "order.checkout_busy")
+        return
+    }
+
+    setStatus(&order, StatusPending, ActorCheckout, "")
+    traceID := openmetrics.TraceID(r)
+    storeOrder(order, orderEffects{TraceID: traceID, Events: []string{EventOrderCreated}})
+    persistOrders()
+
+    enqueueCheckout(&checkoutJob{
+        OrderID:    order.OrderID,
+        Payments:   plan,
+        SnapshotID: snapshotID,
+        TraceID:    traceID,
+        ClientIP:   clientIP(r),
+        Priority:   priorityOf(order),
+    })
+
+    statusURL := fmt.Sprintf("/api/v1/orders/%s/status", order.OrderID)
+    result := map[string]interface{}{
+        "order":      order,
+        "status_url": statusURL,
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    w.Header().Set("Location", statusURL)
+    w.Header().Set("Preference-Applied", "respond-async")
+    w.WriteHeader(http.StatusAccepted)
+    json.NewEncoder(w).Encode(result)
+}
+
+// Helper function to queue an accepted checkout for the workers. The
+// caller has counted it in checkoutsPending.
+func enqueueCheckout(job *checkoutJob) {
+    checkoutsAccepted.Add(1)
+    if job.Priority == PriorityExpress {
+        expressCheckoutQueue <- job
+        return
+    }
+    checkoutQueue <- job
+}
+
+// Helper function to apply a checkout outcome to an order whose checkout
+// is still in progress, recording its side effects with it. Returns false when
+// something else (an admin, a cancellation) settled the order first; the
+// outcome is then left unapplied.
+func settleCheckout(orderID string, effects orderEffects, apply func(order *Order)) (Order, bool) {
+    shard := shardFor(orderID)
+    shard.mu.Lock()
+    order, exists := shard.orders[orderID]
+    if !exists || !checkoutInProgress(order.Status) {
+        shard.mu.Unlock()
+        return order, false
+    }
+
+    apply(&order)
+    order.UpdatedAt = time.Now().Unix()
+    putOrder(shard, order)
+    recordEffects(shard, order, effects)
+    shard.mu.Unlock()
+    persistOrders()
+    return order, true
+}
+
+// Helper function to move an accepted checkout from pending to processing
+// as a worker takes it up. Payment retries run synchronously are already
+// processing. Returns false when the order has left the checkout since.
+func claimCheckout(orderID string) (Order, bool) {
+    shard := shardFor(orderID)
+    shard.mu.Lock()
+    order, exists := shard.orders[orderID]
+    if !exists || !checkoutInProgress(order.Status) {
+        shard.mu.Unlock()
+        return order, false
+    }
+    if order.Status == StatusProcessing {
+        shard.mu.Unlock()
+        return order, true
+    }
+
+    setStatus(&order, StatusProcessing, ActorCheckout, "")
+    putOrder(shard, order)
+    shard.mu.Unlock()
+    persistOrders()
+    return order, true
+}
+
+// Helper function to run one accepted checkout: the same payment,
+// inventory and notification steps as a synchronous checkout
+func processCheckout(job *checkoutJob) {
+    order, claimed := claimCheckout(job.OrderID)
+    if !claimed {
+        log.Printf("Skipping checkout for order %s: no longer pending", job.OrderID)
+        return
+    }
+
+    saga := beginCheckoutSaga(order, "")
+    fail := func(reason string) {
+        checkoutsFailed.Add(1)
+        if job.SnapshotID != "" {
+            releaseCartSnapshot(job.SnapshotID)
+        }
+        settleCheckout(job.OrderID, orderEffects{
+            TraceID:       job.TraceID,
+            Events:        []string{EventOrderCancelled},
+            Notifications: []string{"order_cancelled"},
+        }, func(order *Order) {
+            setStatus(order, StatusCancelled, ActorCheckout, reason)
+        })
+    }
+
+    screening := screenOrder(order, job.ClientIP)
+    if screening.Outcome == FraudDeny {
+        keepFraudScreening(screening)
+        fail(i18n.Message(i18n.DefaultLocale, "order.fraud_declined"))
+        finishCheckoutSaga(saga)
+        return
+    }
+
+    recordFunnelEvent(order.CartID, FunnelPaymentAttempted, 0)
+    taken, paymentResp, err := chargePayments(order, job.Payments)
+    if err != nil {
+        log.Printf("Payment for order %s failed: %v", order.OrderID, err)
+        fail(i18n.Message(i18n.DefaultLocale, "order.payment_failed"))
+        // The charge may have gone through before the call failed
+        go func() {
+            if err := compensateCheckout(saga, i18n.Message(i18n.DefaultLocale, "order.payment_failed")); err != nil {
+                log.Printf("Compensation for order %s failed, will retry: %v", job.OrderID, err)
+            }
+        }()
+        return
+    }
+
+    // The customer must complete a 3-D Secure challenge; the payment
+    // callback settles the order from here, as for synchronous checkouts
+    if paymentResp.Status == "requires_action" {
+        keepFraudScreening(screening)
+        _, settled := settleCheckout(job.OrderID, orderEffects{}, func(order *Order) {
+            recordPayments(order, taken)
+            setStatus(order, StatusPendingPayment, ActorCheckout, "")
+            order.PaymentAction = &PaymentAction{
+                PaymentID:    paymentResp.PaymentID,
+                Status:       paymentResp.Status,
+                ClientSecret: paymentResp.ClientSecret,
+                NextAction:   paymentResp.NextAction,
+            }
+        })
+        finishCheckoutSaga(saga)
+        if settled {
+            checkoutsCompleted.Add(1)
+        }
+        return
+    }
+
+    if !paymentResp.Success {
+        // A later part of a split payment was declined; the parts already
+        // taken go back and the order is cancelled, as it can't be retried
+        if len(taken) > 0 {
+            fail(paymentResp.Message)
+            if err := compensateCheckout(saga, paymentResp.Message); err != nil {
+                log.Printf("Compensation for order %s failed, will retry: %v", job.OrderID, err)
+            }
+            return
+        }
+        // Nothing was taken: the order waits for the customer to retry
+        checkoutsFailed.Add(1)
+        settleCheckout(job.OrderID, orderEffects{TraceID: job.TraceID}, func(order *Order) {
+            setStatus(order, StatusPaymentFailed, ActorCheckout, paymentResp.Message)
+        })
+        finishCheckoutSaga(saga)
+        return
+    }
+    saga.paymentTaken(taken[0].PaymentID)
+
+    // Without the stock the order can't be fulfilled: the saga puts back
+    // what was committed, refunds the payment and cancels the order
+    if err := commitCheckoutInventory(saga); err != nil {
+        log.Printf("Failed to commit inventory for order %s: %v", order.OrderID, err)
+        checkoutsFailed.Add(1)
+        if job.SnapshotID != "" {
+            releaseCartSnapshot(job.SnapshotID)
+        }
+        if err := compensateCheckout(saga, i18n.Message(i18n.DefaultLocale, "order.inventory_unavailable")); err != nil {
+            log.Printf("Compensation for order %s failed, will retry: %v", order.OrderID, err)
+        }
+        return
+    }
+
+    // Flagged for review: held instead of confirmed, keeping the payment
+    status, reason := StatusPaid, ""
+    effects := orderEffects{
+        TraceID:       job.TraceID,
+        Events:        []string{EventOrderPaid},
+        Notifications: []string{"order_confirmation"},
+    }
+    if screening.Outcome == FraudReview {
+        screening.Committed = saga.Committed
+        keepFraudScreening(screening)
+        status, reason = StatusOnHold, i18n.Message(i18n.DefaultLocale, "order.held_for_review")
+        effects = orderEffects{}
+    }
+    order, settled := settleCheckout(job.OrderID, effects, func(order *Order) {
+        recordPayments(order, taken)
+        setStatus(order, status, ActorCheckout, reason)
+    })
+    if !settled {
+        // Cancelled (or otherwise settled) while the payment was taken
+        log.Printf("Order %s changed while its payment %s was taken; status %q, reversing the checkout",
+            job.OrderID, taken[0].PaymentID, order.Status)
+        if err := compensateCheckout(saga, "Order was cancelled while its payment completed"); err != nil {
+            log.Printf("Compensation for order %s failed, will retry: %v", order.OrderID, err)
+        }
+        return
+    }
+    finishCheckoutSaga(saga)
+    checkoutsCompleted.Add(1)
+    if status == StatusPaid {
+        recordFunnelEvent(order.CartID, FunnelOrderPaid, 0)
+    }
+}
+
+// Worker loop: run accepted checkouts one at a time, express ones first
+// whenever any are waiting
+func checkoutWorker() {
+    for {
+        var job *checkoutJob
+        select {
+        case job = <-expressCheckoutQueue:
+        default:
+            select {
+            case job = <-expressCheckoutQueue:
+            case job = <-checkoutQueue:
+            }
+        }
+        processCheckout(job)
+        checkoutsPending.Add(-1)
+    }
+}
+
+// Cancel checkouts a restart interrupted and start the worker pool. The
+// queue is in memory and payment methods are never persisted, so those
+// checkouts can't be resumed; cancelling them tells the customer to check
+// out again instead of leaving the order pending or processing forever.
+func startCheckoutWorkers() {
+    var interrupted []string
+    forEachOrder(func(order Order) {
+        if checkoutInProgress(order.Status) {
+            interrupted = append(interrupted, order.OrderID)
+        }
+    })
+    for _, orderID := range interrupted {
+        _, settled := settleCheckout(orderID, orderEffects{Events: []string{EventOrderCancelled}}, func(order *Order) {
+            setStatus(order, StatusCancelled, ActorRestart, "Checkout was interrupted by a restart, please check out again")
+        })
+        if settled {
+            checkoutsInterrupted.Add(1)
+        }
+    }
+    if len(interrupted) > 0 {
+        log.Printf("Cancelled %d checkouts interrupted by a restart", len(interrupted))
+    }
+
+    for i := 0; i < checkoutWorkers; i++ {
+        go checkoutWorker()
+    }
+}
+
+// Get an order's status, for clients polling an asynchronous checkout
+func getOrderStatusHandler(w http.ResponseWriter, r *http.Request) {
+    vars := mux.Vars(r)
+    orderID := resolveOrderID(vars["orderId"])
+
+    order, exists := getOrder(orderID)
+    if !exists {
+        i18n.WriteError(w, r, http.StatusNotFound, "order.not_found")
+        return
+    }
+
+    result := map[string]interface{}{
+        "order_id":     order.OrderID,
+        "order_number": order.OrderNumber,
+        "status":       order.Status,
+        "updated_at":   order.UpdatedAt,
+    }
+    if order.StatusReason != "" {
+        result["status_reason"] = order.StatusReason
+    }
+    if order.PaymentAction != nil {
+        result["payment"] = order.PaymentAction
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    if checkoutInProgress(order.Status) {
+        w.Header().Set("Retry-After", "1")
+    }
+    json.NewEncoder(w).Encode(result)
+}
+
+// Helper function to report asynchronous checkout metrics
+func checkoutMetrics() string {
+    return fmt.Sprintf(`
+# HELP order_service_checkout_queue_depth Accepted checkouts waiting for a worker
+# TYPE order_service_checkout_queue_depth gauge
+order_service_checkout_queue_depth %d
+
+# HELP order_service_checkout_queue_express_depth Accepted express checkouts waiting for a worker; see priority.go
+# TYPE order_service_checkout_queue_express_depth gauge
+order_service_checkout_queue_express_depth %d
+
+# HELP order_service_checkouts_pending Accepted checkouts not yet finished
+# TYPE order_service_checkouts_pending gauge
+order_service_checkouts_pending %d
+
+# HELP order_service_checkout_queue_capacity Maximum checkouts accepted but not finished
+# TYPE order_service_checkout_queue_capacity gauge
+order_service_checkout_queue_capacity %d
+
+# HELP order_service_checkouts_accepted_total Checkouts answered with 202 for background processing
+# TYPE order_service_checkouts_accepted_total counter
+order_service_checkouts_accepted_total %d
+
+# HELP order_service_checkouts_completed_total Background checkouts paid or handed to customer authentication
+# TYPE order_service_checkouts_completed_total counter
+order_service_checkouts_completed_total %d
+
+# HELP order_service_checkouts_failed_total Background checkouts whose payment failed
+# TYPE order_service_checkouts_failed_total counter
+order_service_checkouts_failed_total %d
+
+# HELP order_service_checkouts_rejected_total Checkouts refused because the queue was full
+# TYPE order_service_checkouts_rejected_total counter
+order_service_checkouts_rejected_total %d
+
+# HELP order_service_checkouts_interrupted_total Checkouts cancelled at startup after a restart
+# TYPE order_service_checkouts_interrupted_total counter
+order_service_checkouts_interrupted_total %d
+
+# HELP order_service_checkouts_deferred_total Checkouts answered with 202 in auto mode because payment-service was slow
+# TYPE order_service_checkouts_deferred_total counter
+order_service_checkouts_deferred_total %d
+
+# HELP order_service_payment_latency_p99_seconds p99 of recent payment-service calls, as auto mode sees it
+# TYPE order_service_payment_latency_p99_seconds gauge
+order_service_payment_latency_p99_seconds %g
+`, len(checkoutQueue)+len(expressCheckoutQueue), len(expressCheckoutQueue), checkoutsPending.Load(), cap(checkoutQueue),
+        checkoutsAccepted.Load(), checkoutsCompleted.Load(), checkoutsFailed.Load(),
+        checkoutsRejected.Load(), checkoutsInterrupted.Load(), checkoutsDeferred.Load(),
+        paymentLatencyP99().Seconds())
+}
@@ -0,0 +1,399 @@
+package main
+
+import (
+    "fmt"
+    "log"
+    "net/url"
+    "strconv"
+    "strings"
+
+    "middleware/adminauth"
+    "middleware/hotconfig"
+    "money"
+)
+
+// Reloadable settings; see pkg/middleware/hotconfig. Everything else is
+// read once at startup.
+var liveConfig *hotconfig.Config[serviceConfig]
+
+func init() {
+    liveConfig = hotconfig.New(loadConfig, (*serviceConfig).settings)
+    liveConfig.Audit = adminauth.Audit
+    if err := liveConfig.Load(); err != nil {
+        log.Fatalf("Invalid configuration: %v", err)
+    }
+}
+
+// Helper function to get the live configuration
+func config() *serviceConfig {
+    return liveConfig.Get()
+}
+
+// Helper function to read a setting, preferring CONFIG_FILE over the
+// environment. Only valid while building a configuration.
+func configValue(name string) string {
+    return liveConfig.Value(name)
+}
+
+// serviceConfig holds the order service's reloadable settings
+type serviceConfig struct {
+    PaymentServiceURL         string
+    InventoryServiceURL       string
+    NotificationServiceURL    string
+    UserServiceURL            string            // looks up notification recipients; "" only uses token and user ID emails (see recipients.go)
+    OrderRetentionMonths      int               // settled orders older than this are archived; 0 keeps everything hot
+    UnpaidOrderTimeoutMinutes int               // unpaid orders untouched this long are cancelled; 0 never (see expiry.go)
+    OrderEventsURL            string            // receives order lifecycle events; "" disables them
+    OrderEventsBroker         string            // nats or kafka to also publish them to a broker; "" disables it
+    OrderEventsBrokerURL      string            // nats://host:4222, or the Kafka REST proxy's URL
+    OrderEventsTopic          string            // Kafka topic
+    CheckoutMode              string            // sync, async to answer checkouts with 202 and finish them in the background, or auto
+    CheckoutAsyncLatencyMS    int               // payment p99 at which auto mode answers checkouts with 202
+    TaxProvider               string            // none, or rate_table to charge TaxRates; see tax.go
+    TaxRates                  map[string]int    // region -> rate in parts per million
+    DeliverySLAs              slaTable          // shipping methods and how long they take; see delivery.go
+    ExpressShippingMethods    []string          // shipping methods that make an order express; see priority.go
+    PromotionsServiceURL      string            // checks coupon codes; "" refuses them (see coupons.go)
+    ProductServiceURL         string            // prices orders are checked against; "" skips the check (see pricing.go)
+    PriceChangePolicy         string            // confirm to offer the new prices, or reject
+    FraudProvider             string            // none, or http to have FraudServiceURL score orders (see fraud.go)
+    FraudServiceURL           string
+    FraudReviewScore          int               // scores at or above this hold the order for review
+    FraudDenyScore            int               // scores at or above this refuse the checkout
+    DuplicateWindowSeconds    int               // identical checkouts this close together are duplicates; 0 off (see dedupe.go)
+    DuplicateOrderPolicy      string            // block to refuse duplicates, or warn
+    OrderRules                orderRules        // checked when orders are created; see order_rules.go
+    OrderRulesFile            string            // where OrderRules came from; "" for ORDER_RULES
+    SettlementCurrency        string            // currency the books are kept in; "" records none (see exchange.go)
+    FXProvider                string            // none, static to convert at FXRates, or http to ask FXRatesURL
+    FXRates                   map[string]string // currency -> settlement units per unit, as payment-service's FX_RATES
+    FXRatesURL                string
+    OutboundRetryAttempts     int               // attempts per payment and inventory call; see retry.go
+    OutboundRetryBackoffMS    int               // wait before the first retry, doubling after each
+    OutboundRetryMaxBackoffMS int               // longest wait between retries
+    OutboundRetryJitter       int               // percent of each wait taken off at random
+    OutboundRetryBudget       int               // retries allowed per 100 calls to a service
+    BreakerFailureThreshold   int               // failures in a row that open a service's circuit breaker; see breaker.go
+    BreakerOpenSeconds        int               // how long an open breaker fails calls before probing
+}
+
+// Helper function to load the reloadable settings. Called by liveConfig
+// while it builds a configuration, so configValue sees the current
+// CONFIG_FILE.
+func loadConfig() (*serviceConfig, error) {
+    cfg := &serviceConfig{
+        PaymentServiceURL:      configValue("PAYMENT_SERVICE_URL"),
+        InventoryServiceURL:    configValue("INVENTORY_SERVICE_URL"),
+        NotificationServiceURL: configValue("NOTIFICATION_SERVICE_URL"),
+        UserServiceURL:         configValue("USER_SERVICE_URL"),
+        OrderEventsURL:         configValue("ORDER_EVENTS_URL"),
+        OrderEventsBroker:      configValue("ORDER_EVENTS_BROKER"),
+        OrderEventsBrokerURL:   configValue("ORDER_EVENTS_BROKER_URL"),
+        OrderEventsTopic:       configValue("ORDER_EVENTS_TOPIC"),
+        CheckoutMode:           configValue("CHECKOUT_MODE"),
+        TaxProvider:            configValue("TAX_PROVIDER"),
+        PromotionsServiceURL:   configValue("PROMOTIONS_SERVICE_URL"),
+        ProductServiceURL:      configValue("PRODUCT_SERVICE_URL"),
+        PriceChangePolicy:      configValue("PRICE_CHANGE_POLICY"),
+        FraudProvider:          configValue("FRAUD_PROVIDER"),
+        FraudServiceURL:        configValue("FRAUD_SERVICE_URL"),
+        DuplicateOrderPolicy:   configValue("DUPLICATE_ORDER_POLICY"),
+        FXProvider:             configValue("FX_PROVIDER"),
+        FXRatesURL:             configValue("FX_RATES_URL"),
+    }
+    if cfg.PaymentServiceURL == "" {
+        cfg.PaymentServiceURL = "http://payment-service:3002"
+    }
+    if cfg.InventoryServiceURL == "" {
+        cfg.InventoryServiceURL = "http://inventory-service:8004"
+    }
+    if cfg.NotificationServiceURL == "" {
+        cfg.NotificationServiceURL = "http://notification-service:8006"
+    }
+
+    if err := hotconfig.ValidateURL("PAYMENT_SERVICE_URL", cfg.PaymentServiceURL); err != nil {
+        return nil, err
+    }
+    if err := hotconfig.ValidateURL("INVENTORY_SERVICE_URL", cfg.InventoryServiceURL); err != nil {
+        return nil, err
+    }
+    if err := hotconfig.ValidateURL("NOTIFICATION_SERVICE_URL", cfg.NotificationServiceURL); err != nil {
+        return nil, err
+    }
+
+    if cfg.UserServiceURL != "" {
+        if err := hotconfig.ValidateURL("USER_SERVICE_URL", cfg.UserServiceURL); err != nil {
+            return nil, err
+        }
+    }
+    if cfg.PromotionsServiceURL != "" {
+        if err := hotconfig.ValidateURL("PROMOTIONS_SERVICE_URL", cfg.PromotionsServiceURL); err != nil {
+            return nil, err
+        }
+    }
+
+    if cfg.ProductServiceURL != "" {
+        if err := hotconfig.ValidateURL("PRODUCT_SERVICE_URL", cfg.ProductServiceURL); err != nil {
+            return nil, err
+        }
+    }
+    switch cfg.PriceChangePolicy {
+    case "":
+        cfg.PriceChangePolicy = PriceChangeConfirm
+    case PriceChangeConfirm, PriceChangeReject:
+    default:
+        return nil, fmt.Errorf("PRICE_CHANGE_POLICY=%q must be %s or %s", cfg.PriceChangePolicy, PriceChangeConfirm, PriceChangeReject)
+    }
+
+    switch cfg.FraudProvider {
+    case "":
+        cfg.FraudProvider = FraudProviderNone
+    case FraudProviderNone:
+    case FraudProviderHTTP:
+        if err := hotconfig.ValidateURL("FRAUD_SERVICE_URL", cfg.FraudServiceURL); err != nil {
+            return nil, err
+        }
+    default:
+        return nil, fmt.Errorf("FRAUD_PROVIDER=%q must be %s or %s", cfg.FraudProvider, FraudProviderNone, FraudProviderHTTP)
+    }
+    cfg.FraudReviewScore = DefaultFraudReviewScore
+    if value := configValue("FRAUD_REVIEW_SCORE"); value != "" {
+        score, err := strconv.Atoi(value)
+        if err != nil || score < 0 || score > 100 {
+            return nil, fmt.Errorf("FRAUD_REVIEW_SCORE=%q must be a score from 0 to 100", value)
+        }
+        cfg.FraudReviewScore = score
+    }
+    cfg.FraudDenyScore = DefaultFraudDenyScore
+    if value := configValue("FRAUD_DENY_SCORE"); value != "" {
+        score, err := strconv.Atoi(value)
+        if err != nil || score < 0 || score > 100 {
+            return nil, fmt.Errorf("FRAUD_DENY_SCORE=%q must be a score from 0 to 100", value)
+        }
+        cfg.FraudDenyScore = score
+    }
+    if cfg.FraudDenyScore < cfg.FraudReviewScore {
+        return nil, fmt.Errorf("FRAUD_DENY_SCORE=%d must not be below FRAUD_REVIEW_SCORE=%d", cfg.FraudDenyScore, cfg.FraudReviewScore)
+    }
+
+    cfg.DuplicateWindowSeconds = DefaultDuplicateWindowSeconds
+    if value := configValue("DUPLICATE_ORDER_WINDOW_SECONDS"); value != "" {
+        seconds, err := strconv.Atoi(value)
+        if err != nil || seconds < 0 {
+            return nil, fmt.Errorf("DUPLICATE_ORDER_WINDOW_SECONDS=%q must be a non-negative number of seconds", value)
+        }
+        cfg.DuplicateWindowSeconds = seconds
+    }
+    switch cfg.DuplicateOrderPolicy {
+    case "":
+        cfg.DuplicateOrderPolicy = DuplicatePolicyBlock
+    case DuplicatePolicyBlock, DuplicatePolicyWarn:
+    default:
+        return nil, fmt.Errorf("DUPLICATE_ORDER_POLICY=%q must be %s or %s", cfg.DuplicateOrderPolicy, DuplicatePolicyBlock, DuplicatePolicyWarn)
+    }
+
+    // The file is read again on every reload, so editing it and reloading
+    // is enough
+    cfg.OrderRulesFile = configValue("ORDER_RULES_FILE")
+    rules, err := loadOrderRules(configValue("ORDER_RULES"), cfg.OrderRulesFile)
+    if err != nil {
+        return nil, err
+    }
+    cfg.OrderRules = rules
+
+    if cfg.OrderEventsURL != "" {
+        if err := hotconfig.ValidateURL("ORDER_EVENTS_URL", cfg.OrderEventsURL); err != nil {
+            return nil, err
+        }
+    }
+
+    switch cfg.OrderEventsBroker {
+    case "":
+    case BrokerNATS:
+        if parsed, err := url.Parse(cfg.OrderEventsBrokerURL); err != nil || parsed.Scheme != "nats" || parsed.Host == "" {
+            return nil, fmt.Errorf("ORDER_EVENTS_BROKER_URL=%q must be a nats://host:port URL", cfg.OrderEventsBrokerURL)
+        }
+    case BrokerKafka:
+        if err := hotconfig.ValidateURL("ORDER_EVENTS_BROKER_URL", cfg.OrderEventsBrokerURL); err != nil {
+            return nil, err
+        }
+    default:
+        return nil, fmt.Errorf("ORDER_EVENTS_BROKER=%q must be %s or %s", cfg.OrderEventsBroker, BrokerNATS, BrokerKafka)
+    }
+    if cfg.OrderEventsTopic == "" {
+        cfg.OrderEventsTopic = DefaultOrderEventsTopic
+    }
+
+    if value := configValue("ORDER_RETENTION_MONTHS"); value != "" {
+        months, err := strconv.Atoi(value)
+        if err != nil || months < 0 {
+            return nil, fmt.Errorf("ORDER_RETENTION_MONTHS=%q must be a non-negative number of months", value)
+        }
+        cfg.OrderRetentionMonths = months
+    }
+
+    cfg.UnpaidOrderTimeoutMinutes = DefaultUnpaidOrderTimeoutMinutes
+    if value := configValue("UNPAID_ORDER_TIMEOUT_MINUTES"); value != "" {
+        minutes, err := strconv.Atoi(value)
+        if err != nil || minutes < 0 {
+            return nil, fmt.Errorf("UNPAID_ORDER_TIMEOUT_MINUTES=%q must be a non-negative number of minutes", value)
+        }
+        cfg.UnpaidOrderTimeoutMinutes = minutes
+    }
+
+    switch cfg.CheckoutMode {
+    case "":
+        cfg.CheckoutMode = CheckoutModeSync
+    case CheckoutModeSync, CheckoutModeAsync, CheckoutModeAuto:
+    default:
+        return nil, fmt.Errorf("CHECKOUT_MODE=%q must be %s, %s or %s", cfg.CheckoutMode, CheckoutModeSync, CheckoutModeAsync, CheckoutModeAuto)
+    }
+    cfg.CheckoutAsyncLatencyMS = DefaultCheckoutAsyncLatencyMS
+    if value := configValue("CHECKOUT_ASYNC_LATENCY_MS"); value != "" {
+        latency, err := strconv.Atoi(value)
+        if err != nil || latency <= 0 {
+            return nil, fmt.Errorf("CHECKOUT_ASYNC_LATENCY_MS=%q must be a positive number of milliseconds", value)
+        }
+        cfg.CheckoutAsyncLatencyMS = latency
+    }
+
+    switch cfg.TaxProvider {
+    case "":
+        cfg.TaxProvider = TaxProviderNone
+    case TaxProviderNone, TaxProviderRateTable:
+    default:
+        return nil, fmt.Errorf("TAX_PROVIDER=%q must be %s or %s", cfg.TaxProvider, TaxProviderNone, TaxProviderRateTable)
+    }
+    rates, err := parseTaxRates(configValue("TAX_RATES"))
+    if err != nil {
+        return nil, err
+    }
+    cfg.TaxRates = rates
+
+    slas := configValue("DELIVERY_SLAS")
+    if slas == "" {
+        slas = DefaultDeliverySLAs
+    }
+    if cfg.DeliverySLAs, err = parseDeliverySLAs(slas); err != nil {
+        return nil, err
+    }
+    // The default needn't be offered; orders can't pick it if it isn't
+    cfg.ExpressShippingMethods = []string{DefaultExpressShippingMethods}
+    if value := configValue("EXPRESS_SHIPPING_METHODS"); value != "" {
+        if cfg.ExpressShippingMethods, err = parseExpressShippingMethods(value, cfg.DeliverySLAs); err != nil {
+            return nil, err
+        }
+    }
+
+    if value := configValue("SETTLEMENT_CURRENCY"); value != "" {
+        currency, err := money.NormalizeCurrency(value)
+        if err != nil {
+            return nil, fmt.Errorf("SETTLEMENT_CURRENCY=%q must be an ISO 4217 currency code", value)
+        }
+        cfg.SettlementCurrency = currency
+    }
+    switch cfg.FXProvider {
+    case "":
+        cfg.FXProvider = FXProviderNone
+    case FXProviderNone, FXProviderStatic:
+    case FXProviderHTTP:
+        if err := hotconfig.ValidateURL("FX_RATES_URL", cfg.FXRatesURL); err != nil {
+            return nil, err
+        }
+    default:
+        return nil, fmt.Errorf("FX_PROVIDER=%q must be %s, %s or %s", cfg.FXProvider,
+            FXProviderNone, FXProviderStatic, FXProviderHTTP)
+    }
+    fxRates, err := parseExchangeRates(configValue("FX_RATES"))
+    if err != nil {
+        return nil, err
+    }
+    cfg.FXRates = fxRates
+
+    if err := loadRetrySettings(cfg); err != nil {
+        return nil, err
+    }
+    if err := loadBreakerSettings(cfg); err != nil {
+        return nil, err
+    }
+    return cfg, nil
+}
+
+// intSetting is a whole-number setting with a default and bounds
+type intSetting struct {
+    Name     string
+    Field    *int
+    Default  int
+    Min, Max int
+}
+
+// Helper function to read whole-number settings, checking their bounds
+func loadIntSettings(settings []intSetting) error {
+    for _, setting := range settings {
+        *setting.Field = setting.Default
+        value := configValue(setting.Name)
+        if value == "" {
+            continue
+        }
+        parsed, err := strconv.Atoi(value)
+        if err != nil || parsed < setting.Min || parsed > setting.Max {
+            return fmt.Errorf("%s=%q must be a number from %d to %d", setting.Name, value, setting.Min, setting.Max)
+        }
+        *setting.Field = parsed
+    }
+    return nil
+}
+
+// Helper function to hide the credentials in a URL setting, for display
+func redactURL(value string) string {
+    parsed, err := url.Parse(value)
+    if err != nil || parsed.User == nil {
+        return value
+    }
+    parsed.User = url.User("xxxxx")
+    return parsed.String()
+}
+
+// Helper function to list the settings for display and diffing
+func (cfg *serviceConfig) settings() map[string]string {
+    return map[string]string{
+        "PAYMENT_SERVICE_URL":               cfg.PaymentServiceURL,
+        "INVENTORY_SERVICE_URL":             cfg.InventoryServiceURL,
+        "NOTIFICATION_SERVICE_URL":          cfg.NotificationServiceURL,
+        "USER_SERVICE_URL":                  cfg.UserServiceURL,
+        "ORDER_RETENTION_MONTHS":            strconv.Itoa(cfg.OrderRetentionMonths),
+        "UNPAID_ORDER_TIMEOUT_MINUTES":      strconv.Itoa(cfg.UnpaidOrderTimeoutMinutes),
+        "ORDER_EVENTS_URL":                  cfg.OrderEventsURL,
+        "ORDER_EVENTS_BROKER":               cfg.OrderEventsBroker,
+        "ORDER_EVENTS_BROKER_URL":           redactURL(cfg.OrderEventsBrokerURL),
+        "ORDER_EVENTS_TOPIC":                cfg.OrderEventsTopic,
+        "CHECKOUT_MODE":                     cfg.CheckoutMode,
+        "CHECKOUT_ASYNC_LATENCY_MS":         strconv.Itoa(cfg.CheckoutAsyncLatencyMS),
+        "TAX_PROVIDER":                      cfg.TaxProvider,
+        "TAX_RATES":                         formatTaxRates(cfg.TaxRates),
+        "DELIVERY_SLAS":                     cfg.DeliverySLAs.String(),
+        "EXPRESS_SHIPPING_METHODS":          strings.Join(cfg.ExpressShippingMethods, ","),
+        "PROMOTIONS_SERVICE_URL":            cfg.PromotionsServiceURL,
+        "PRODUCT_SERVICE_URL":               cfg.ProductServiceURL,
+        "PRICE_CHANGE_POLICY":               cfg.PriceChangePolicy,
+        "FRAUD_PROVIDER":                    cfg.FraudProvider,
+        "FRAUD_SERVICE_URL":                 redactURL(cfg.FraudServiceURL),
+        "FRAUD_REVIEW_SCORE":                strconv.Itoa(cfg.FraudReviewScore),
+        "FRAUD_DENY_SCORE":                  strconv.Itoa(cfg.FraudDenyScore),
+        "DUPLICATE_ORDER_WINDOW_SECONDS":    strconv.Itoa(cfg.DuplicateWindowSeconds),
+        "DUPLICATE_ORDER_POLICY":            cfg.DuplicateOrderPolicy,
+        "ORDER_RULES":                       cfg.OrderRules.String(),
+        "ORDER_RULES_FILE":                  cfg.OrderRulesFile,
+        "SETTLEMENT_CURRENCY":               cfg.SettlementCurrency,
+        "FX_PROVIDER":                       cfg.FXProvider,
+        "FX_RATES":                          formatExchangeRates(cfg.FXRates),
+        "FX_RATES_URL":                      redactURL(cfg.FXRatesURL),
+        "OUTBOUND_RETRY_ATTEMPTS":           strconv.Itoa(cfg.OutboundRetryAttempts),
+        "OUTBOUND_RETRY_BACKOFF_MS":         strconv.Itoa(cfg.OutboundRetryBackoffMS),
+        "OUTBOUND_RETRY_MAX_BACKOFF_MS":     strconv.Itoa(cfg.OutboundRetryMaxBackoffMS),
+        "OUTBOUND_RETRY_JITTER_PERCENT":     strconv.Itoa(cfg.OutboundRetryJitter),
+        "OUTBOUND_RETRY_BUDGET_PERCENT":     strconv.Itoa(cfg.OutboundRetryBudget),
+        "CIRCUIT_BREAKER_FAILURE_THRESHOLD": strconv.Itoa(cfg.BreakerFailureThreshold),
+        "CIRCUIT_BREAKER_OPEN_SECONDS":      strconv.Itoa(cfg.BreakerOpenSeconds),
+    }
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "net/http"
+    "net/url"
+    "strconv"
+    "time"
+
+    "middleware/i18n"
+    "money"
+)
+
+// Coupon types returned by the promotions backend
+const (
+    CouponPercent = "percent" // PercentOff of the subtotal
+    CouponFixed   = "fixed"   // AmountOffCents, in the coupon's currency
+)
+
+var promotionsClient = newHTTPClient(3 * time.Second)
+
+// Coupon is the promotions backend's answer for a coupon code. The backend
+// decides whether the code applies to this user and subtotal (expiry,
+// usage limits, minimum spend); the order service only works out the
+// discount from it.
+type Coupon struct {
+    Code           string  `json:"code"`
+    Valid          bool    `json:"valid"`
+    Type           string  `json:"type"`
+    PercentOff     float64 `json:"percent_off,omitempty"`
+    AmountOffCents int     `json:"amount_off_cents,omitempty"`
+    Currency       string  `json:"currency,omitempty"`
+}
+
+// Helper function to look up a coupon code with the promotions backend
+// (PROMOTIONS_SERVICE_URL). Codes it doesn't know or refuses, and every
+// code when no backend is configured, give a nil coupon; an error means
+// the backend couldn't be asked.
+func lookupCoupon(code string, userID string, subtotal money.Money) (*Coupon, error) {
+    baseURL := config().PromotionsServiceURL
+    if baseURL == "" {
+        return nil, nil
+    }
+
+    query := url.Values{}
+    query.Set("user_id", userID)
+    query.Set("subtotal_cents", strconv.Itoa(subtotal.Amount))
+    query.Set("currency", subtotal.Currency)
+    resp, err := promotionsClient.Get(fmt.Sprintf("%s/api/promotions/coupons/%s?%s",
+        baseURL, url.PathEscape(code), query.Encode()))
+    if err != nil {
+        return nil, err
+    }
+    defer resp.Body.Close()
+
+    if resp.StatusCode == http.StatusNotFound {
+        return nil, nil
+    }
+    if resp.StatusCode != http.StatusOK {
+        return nil, fmt.Errorf("promotions service returned status %d", resp.StatusCode)
+    }
+    var coupon Coupon
+    if err := json.NewDecoder(resp.Body).Decode(&coupon); err != nil {
+        return nil, err
+    }
+    if !coupon.Valid {
+        return nil, nil
+    }
+    if coupon.Code == "" {
+        coupon.Code = code
+    }
+    return &coupon, nil
+}
+
+// Helper function to work out a coupon's discount on a subtotal, rounded
+// half up to the minor unit and never more than the subtotal
+func (c Coupon) discount(subtotal money.Money) (money.Money, error) {
+    var amount int
+    switch c.Type {
+    case CouponPercent:
+        ppm := int(c.PercentOff*10000 + 0.5)
+        if ppm <= 0 || ppm > 1000000 {
+            return money.Money{}, i18n.NewError("order.coupon_invalid", c.Code)
+        }
+        discount, remainder := money.MulDiv(subtotal.Amount, ppm, 1000000)
+        if remainder*2 >= 1000000 {
+            discount++
+        }
+        amount = discount
+    case CouponFixed:
+        currency, err := money.NormalizeCurrency(c.Currency)
+        if err != nil || currency != subtotal.Currency || c.AmountOffCents <= 0 {
+            return money.Money{}, i18n.NewError("order.coupon_invalid", c.Code)
+        }
+        amount = c.AmountOffCents
+    default:
+        return money.Money{}, i18n.NewError("order.coupon_invalid", c.Code)
+    }
+    return money.New(min(amount, subtotal.Amount), subtotal.Currency), nil
+}
+
+// Helper function to take a coupon's discount off an order before tax. The
+// discount is spread over the lines by line total (see Money.Allocate), so
+// a line refund returns what was paid for the line, not its list price.
+func applyDiscount(order *Order, subtotal money.Money, coupon Coupon) error {
+    discount, err := coupon.discount(subtotal)
+    if err != nil {
+        return err
+    }
+    order.CouponCode = coupon.Code
+    order.DiscountCents = discount.Amount
+
+    order.Items = append([]OrderItem(nil), order.Items...)
+    if discount.Amount == 0 {
+        return nil
+    }
+    weights := make([]int, len(order.Items))
+    for i, item := range order.Items {
+        weights[i] = item.PriceCents * item.Quantity
+    }
+    shares, err := discount.Allocate(weights)
+    if err != nil {
+        return err
+    }
+    for i := range order.Items {
+        order.Items[i].DiscountCents = shares[i].Amount
+    }
+    return nil
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+    "crypto/sha256"
+    "encoding/hex"
+    "encoding/json"
+    "fmt"
+    "net/http"
+    "sort"
+    "strings"
+    "sync"
+    "sync/atomic"
+    "time"
+
+    "middleware/i18n"
+)
+
+// Duplicate order detection. A checkout is fingerprinted by its user, its
+// lines and its total; a second checkout with the same fingerprint within
+// DUPLICATE_ORDER_WINDOW_SECONDS of the first (a double click, a retried
+// request) is refused with 409 under DUPLICATE_ORDER_POLICY=block, or
+// placed with a Duplicate-Of header under warn. Sending force=true places
+// it regardless. Checkouts that didn't end up placing an order, or whose
+// order was cancelled, don't count.
+const (
+    DuplicatePolicyBlock = "block"
+    DuplicatePolicyWarn  = "warn"
+)
+
+// DefaultDuplicateWindowSeconds is how long a checkout's fingerprint
+// is remembered by default; 0 turns detection off
+const DefaultDuplicateWindowSeconds = 60
+
+// DuplicateOfHeader names the earlier order a checkout duplicates
+const DuplicateOfHeader = "Duplicate-Of"
+
+// Expired fingerprints are swept out once this many are remembered
+const MaxOrderFingerprints = 100000
+
+type orderFingerprint struct {
+    OrderID  string
+    PlacedAt time.Time
+}
+
+var (
+    orderFingerprints   = make(map[string]orderFingerprint)
+    orderFingerprintsMu sync.Mutex
+)
+
+// Duplicate detection counters
+var (
+    duplicatesBlocked atomic.Int64
+    duplicatesWarned  atomic.Int64
+    duplicatesForced  atomic.Int64
+)
+
+// Helper function to fingerprint a checkout by its user, lines and total.
+// Lines are sorted, so the same cart in another order matches.
+func fingerprintOrder(order Order) string {
+    lines := make([]string, 0, len(order.Items))
+    for _, item := range order.Items {
+        lines = append(lines, fmt.Sprintf("%s:%d:%d", item.ProductID, item.Quantity, item.PriceCents))
+    }
+    sort.Strings(lines)
+
+    sum := sha256.Sum256([]byte(fmt.Sprintf("%s|%s|%d %s", order.UserID, strings.Join(lines, ","), order.TotalCents, order.Currency)))
+    return hex.EncodeToString(sum[:])
+}
+
+// Helper function to claim a checkout's fingerprint. Returns the order it
+// duplicates, if an earlier checkout within the window claimed it and its
+// order is still in flight or was placed; otherwise the fingerprint is
+// now this order's.
+func claimFingerprint(fingerprint string, orderID string) string {
+    window := time.Duration(config().DuplicateWindowSeconds) * time.Second
+    now := time.Now()
+
+    orderFingerprintsMu.Lock()
+    defer orderFingerprintsMu.Unlock()
+
+    if claimed, exists := orderFingerprints[fingerprint]; exists && now.Sub(claimed.PlacedAt) < window {
+        // A synchronous checkout stores its order once it completes, so
+        // one that isn't stored yet is still in flight
+        if order, stored := getOrder(claimed.OrderID); !stored || order.Status != StatusCancelled {
+            return claimed.OrderID
+        }
+    }
+
+    if len(orderFingerprints) >= MaxOrderFingerprints {
+        for key, claimed := range orderFingerprints {
+            if now.Sub(claimed.PlacedAt) >= window {
+                delete(orderFingerprints, key)
+            }
+        }
+    }
+    orderFingerprints[fingerprint] = orderFingerprint{OrderID: orderID, PlacedAt: now}
+    return ""
+}
+
+// Helper function to give up a fingerprint whose checkout placed no order
+func releaseFingerprint(fingerprint string, orderID string) {
+    orderFingerprintsMu.Lock()
+    defer orderFingerprintsMu.Unlock()
+
+    if claimed, exists := orderFingerprints[fingerprint]; exists && claimed.OrderID == orderID {
+        delete(orderFingerprints, fingerprint)
+    }
+}
+
+// Helper function to check a checkout against recent ones from the same
+// user. Returns false when it was refused as a duplicate (the response is
+// written), and a function to call once the checkout has finished, which
+// gives the fingerprint up if no order was placed.
+func checkDuplicateOrder(w http.ResponseWriter, r *http.Request, order Order) (func(), bool) {
+    cfg := config()
+    if cfg.DuplicateWindowSeconds == 0 {
+        return func() {}, true
+    }
+    if r.URL.Query().Get("force") == "true" {
+        duplicatesForced.Add(1)
+        return func() {}, true
+    }
+
+    fingerprint := fingerprintOrder(order)
+    if duplicateOf := claimFingerprint(fingerprint, order.OrderID); duplicateOf != "" {
+        if cfg.DuplicateOrderPolicy == DuplicatePolicyBlock {
+            duplicatesBlocked.Add(1)
+            writeDuplicateOrder(w, r, duplicateOf, cfg.DuplicateWindowSeconds)
+            return nil, false
+        }
+        duplicatesWarned.Add(1)
+        w.Header().Set(DuplicateOfHeader, duplicateOf)
+        return func() {}, true
+    }
+
+    return func() {
+        if placed, stored := getOrder(order.OrderID); !stored || placed.Status == StatusCancelled {
+            releaseFingerprint(fingerprint, order.OrderID)
+        }
+    }, true
+}
+
+// Helper function to refuse a duplicate checkout, in the caller's
+// language, naming the order it duplicates
+func writeDuplicateOrder(w http.ResponseWriter, r *http.Request, duplicateOf string, windowSeconds int) {
+    locale := i18n.NegotiateLocale(r.Header.Get("Accept-Language"))
+
+    w.Header().Set(i18n.ErrorCodeHeader, "order.duplicate")
+    w.Header().Set(DuplicateOfHeader, duplicateOf)
+    w.Header().Set("Content-Language", locale)
+    w.Header().Add("Vary", "Accept-Language")
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(http.StatusConflict)
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "error":        i18n.Message(locale, "order.duplicate", windowSeconds),
+        "code":         "order.duplicate",
+        "duplicate_of": duplicateOf,
+    })
+}
+
+// Helper function to report duplicate order metrics
+func duplicateOrderMetrics() string {
+    return fmt.Sprintf(`
+# HELP order_service_duplicate_orders_blocked_total Checkouts refused as duplicates of a recent one
+# TYPE order_service_duplicate_orders_blocked_total counter
+order_service_duplicate_orders_blocked_total %d
+
+# HELP order_service_duplicate_orders_warned_total Duplicate checkouts placed with a Duplicate-Of warning
+# TYPE order_service_duplicate_orders_warned_total counter
+order_service_duplicate_orders_warned_total %d
+
+# HELP order_service_duplicate_orders_forced_total Checkouts placed with force=true, skipping the duplicate check
+# TYPE order_service_duplicate_orders_forced_total counter
+order_service_duplicate_orders_forced_total %d
+`, duplicatesBlocked.Load(), duplicatesWarned.Load(), duplicatesForced.Load())
+}
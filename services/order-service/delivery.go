@@ -0,0 +1,183 @@
+package main
+
+import (
+    "fmt"
+    "sort"
+    "strconv"
+    "strings"
+    "time"
+
+    "middleware/i18n"
+)
+
+// Estimated delivery. Each order is given a shipping method at checkout
+// and, from the SLA for that method to its shipping address, a window of
+// dates it should arrive in, counted in business days (Monday to Friday,
+// UTC) from when it was placed. The window is kept on the order, worked
+// out again when the shipping address changes, and sent with the shipped
+// notification.
+
+// DefaultShippingMethod is used when a checkout names none
+const DefaultShippingMethod = "standard"
+
+// DefaultDeliverySLAs is DELIVERY_SLAS when it isn't set
+const DefaultDeliverySLAs = "standard:*=3-5,express:*=1-2"
+
+// DeliverySLA is how many business days a shipping method takes to a
+// destination
+type DeliverySLA struct {
+    MinDays int
+    MaxDays int
+    Region  string // what the SLA was looked up by, e.g. US-CA
+}
+
+// DeliveryWindow is when an order should arrive: dates (YYYY-MM-DD, UTC)
+// it should arrive between, inclusive
+type DeliveryWindow struct {
+    Earliest string `json:"earliest"`
+    Latest   string `json:"latest"`
+    MinDays  int    `json:"min_business_days"`
+    MaxDays  int    `json:"max_business_days"`
+}
+
+// DeliveryEstimator knows the shipping methods on offer and how long each
+// takes to an address. Addresses may be nil for orders without one.
+type DeliveryEstimator interface {
+    Methods() []string
+    SLA(method string, address *Address) (DeliverySLA, bool)
+}
+
+// slaTable looks SLAs up in DELIVERY_SLAS by METHOD:COUNTRY-REGION, then
+// METHOD:COUNTRY, then METHOD:*, like TAX_RATES. A method is offered when
+// it has any entry.
+type slaTable struct {
+    SLAs map[string]DeliverySLA // method:region -> SLA
+}
+
+func (t slaTable) Methods() []string {
+    seen := make(map[string]bool)
+    var methods []string
+    for key := range t.SLAs {
+        method, _, _ := strings.Cut(key, ":")
+        if !seen[method] {
+            seen[method] = true
+            methods = append(methods, method)
+        }
+    }
+    sort.Strings(methods)
+    return methods
+}
+
+func (t slaTable) SLA(method string, address *Address) (DeliverySLA, bool) {
+    var regions []string
+    if address != nil {
+        if address.Region != "" {
+            regions = append(regions, address.Country+"-"+address.Region)
+        }
+        regions = append(regions, address.Country)
+    }
+    regions = append(regions, TaxDefaultRegion)
+
+    for _, region := range regions {
+        if sla, exists := t.SLAs[method+":"+region]; exists {
+            sla.Region = region
+            return sla, true
+        }
+    }
+    return DeliverySLA{}, false
+}
+
+// Helper function to get the estimator for the configured settings
+func currentDeliveryEstimator() DeliveryEstimator {
+    return config().DeliverySLAs
+}
+
+// Helper function to check a checkout's shipping method, defaulting it.
+// Returns the method, or an error naming the ones on offer.
+func normalizeShippingMethod(method string) (string, error) {
+    method = strings.ToLower(strings.TrimSpace(method))
+    if method == "" {
+        method = DefaultShippingMethod
+    }
+    methods := currentDeliveryEstimator().Methods()
+    for _, offered := range methods {
+        if offered == method {
+            return method, nil
+        }
+    }
+    return "", i18n.NewError("order.shipping_method_invalid", method, strings.Join(methods, ", "))
+}
+
+// Helper function to add business days to a date
+func addBusinessDays(from time.Time, days int) time.Time {
+    date := from
+    for days > 0 {
+        date = date.AddDate(0, 0, 1)
+        if date.Weekday() != time.Saturday && date.Weekday() != time.Sunday {
+            days--
+        }
+    }
+    return date
+}
+
+// Helper function to work out when an order placed at placedAt should
+// arrive. Returns nil when there is no SLA for its method and address.
+func estimateDelivery(method string, address *Address, placedAt int64) *DeliveryWindow {
+    sla, exists := currentDeliveryEstimator().SLA(method, address)
+    if !exists {
+        return nil
+    }
+    placed := time.Unix(placedAt, 0).UTC()
+    return &DeliveryWindow{
+        Earliest: addBusinessDays(placed, sla.MinDays).Format(time.DateOnly),
+        Latest:   addBusinessDays(placed, sla.MaxDays).Format(time.DateOnly),
+        MinDays:  sla.MinDays,
+        MaxDays:  sla.MaxDays,
+    }
+}
+
+// Helper function to parse DELIVERY_SLAS: comma-separated
+// METHOD:REGION=MIN-MAX entries in business days, e.g.
+// "standard:US=3-5,standard:*=7-14,express:US=1-2". A single number is a
+// window of one day.
+func parseDeliverySLAs(value string) (slaTable, error) {
+    slas := make(map[string]DeliverySLA)
+    for _, entry := range strings.Split(value, ",") {
+        entry = strings.TrimSpace(entry)
+        if entry == "" {
+            continue
+        }
+        key, days, found := strings.Cut(entry, "=")
+        method, region, hasRegion := strings.Cut(strings.TrimSpace(key), ":")
+        method = strings.ToLower(strings.TrimSpace(method))
+        region = strings.ToUpper(strings.TrimSpace(region))
+        if !found || !hasRegion || method == "" || region == "" {
+            return slaTable{}, fmt.Errorf("DELIVERY_SLAS entry %q must be METHOD:REGION=MIN-MAX", entry)
+        }
+
+        low, high, isRange := strings.Cut(strings.TrimSpace(days), "-")
+        if !isRange {
+            high = low
+        }
+        minDays, minErr := strconv.Atoi(strings.TrimSpace(low))
+        maxDays, maxErr := strconv.Atoi(strings.TrimSpace(high))
+        if minErr != nil || maxErr != nil || minDays < 0 || maxDays < minDays {
+            return slaTable{}, fmt.Errorf("DELIVERY_SLAS days for %s:%s must be MIN-MAX business days, MIN no more than MAX", method, region)
+        }
+        slas[method+":"+region] = DeliverySLA{MinDays: minDays, MaxDays: maxDays}
+    }
+    if len(slas) == 0 {
+        return slaTable{}, fmt.Errorf("DELIVERY_SLAS must offer at least one shipping method")
+    }
+    return slaTable{SLAs: slas}, nil
+}
+
+// String formats the table back into DELIVERY_SLAS form, for display
+func (t slaTable) String() string {
+    entries := make([]string, 0, len(t.SLAs))
+    for key, sla := range t.SLAs {
+        entries = append(entries, fmt.Sprintf("%s=%d-%d", key, sla.MinDays, sla.MaxDays))
+    }
+    sort.Strings(entries)
+    return strings.Join(entries, ",")
+}
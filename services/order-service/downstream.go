@@ -0,0 +1,92 @@
+package main
+
+import (
+    "context"
+    "errors"
+    "net"
+    "net/http"
+    "net/url"
+    "strings"
+    "time"
+)
+
+// Downstream call metrics. Every outbound call goes through
+// downstreamTransport, which counts it by the service it went to and how
+// it ended, times it, and tracks how many are in flight (the collectors
+// are in metrics.go). Calls a circuit breaker refused never get here; see
+// breaker.go for those.
+const (
+    DownstreamSuccess     = "success"      // 1xx-3xx
+    DownstreamClientError = "client_error" // 4xx
+    DownstreamServerError = "server_error" // 5xx
+    DownstreamTimeout     = "timeout"      // no response in time
+    DownstreamError       = "error"        // no response: refused, reset, DNS
+)
+
+// DownstreamOther names calls to hosts that aren't a configured service
+// (webhook receivers), so their URLs don't become labels
+const DownstreamOther = "other"
+
+// downstreamTransport instruments the shared outbound transport
+type downstreamTransport struct {
+    Next http.RoundTripper
+}
+
+func (t *downstreamTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+    downstream := downstreamName(req.URL)
+    inFlight := downstreamInFlight.WithLabelValues(downstream)
+    inFlight.Inc()
+    defer inFlight.Dec()
+
+    start := time.Now()
+    resp, err := t.Next.RoundTrip(req)
+    downstreamDuration.WithLabelValues(downstream).Observe(time.Since(start).Seconds())
+    downstreamRequests.WithLabelValues(downstream, downstreamResult(resp, err)).Inc()
+    return resp, err
+}
+
+// Helper function to name the service a URL belongs to, by the configured
+// service URLs
+func downstreamName(target *url.URL) string {
+    cfg := config()
+    services := []struct {
+        Name string
+        URL  string
+    }{
+        {"payment", cfg.PaymentServiceURL},
+        {"inventory", cfg.InventoryServiceURL},
+        {"notification", cfg.NotificationServiceURL},
+        {"user", cfg.UserServiceURL},
+        {"promotions", cfg.PromotionsServiceURL},
+        {"product", cfg.ProductServiceURL},
+        {"fraud", cfg.FraudServiceURL},
+        {"fx_rates", cfg.FXRatesURL},
+        {"order_events", cfg.OrderEventsURL},
+        {"broker", cfg.OrderEventsBrokerURL},
+    }
+    for _, service := range services {
+        if service.URL == "" {
+            continue
+        }
+        if configured, err := url.Parse(service.URL); err == nil && strings.EqualFold(configured.Host, target.Host) {
+            return service.Name
+        }
+    }
+    return DownstreamOther
+}
+
+// Helper function to classify how a call ended
+func downstreamResult(resp *http.Response, err error) string {
+    var netErr net.Error
+    switch {
+    case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+        return DownstreamTimeout
+    case err != nil:
+        return DownstreamError
+    case resp.StatusCode >= 500:
+        return DownstreamServerError
+    case resp.StatusCode >= 400:
+        return DownstreamClientError
+    }
+    return DownstreamSuccess
+}
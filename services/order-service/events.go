@@ -0,0 +1,315 @@
+package main
+
+import (
+    "bytes"
+    "encoding/json"
+    "fmt"
+    "log"
+    "net/http"
+    "sort"
+    "strconv"
+    "sync/atomic"
+    "time"
+
+    "events"
+    "github.com/google/uuid"
+    "middleware/adminauth"
+)
+
+// Order lifecycle events, POSTed as {"events": [...]} to ORDER_EVENTS_URL
+// (a webhook receiver) and/or published to the message broker set by
+// ORDER_EVENTS_BROKER (see broker.go) whenever an order changes state.
+// Events are recorded in the outbox with the order change and delivered
+// from there (see outbox.go). Events are pkg/events envelopes at the
+// package's current schema version for their type.
+const (
+    EventOrderCreated   = events.TypeOrderCreated
+    EventOrderPaid      = events.TypeOrderPaid
+    EventOrderShipped   = events.TypeOrderShipped
+    EventOrderCancelled = events.TypeOrderCancelled
+    EventOrderRefunded  = events.TypeOrderRefunded
+)
+
+// ReplayBatchSize caps the number of events per replay delivery
+const ReplayBatchSize = 100
+
+// OrderEvent is one order lifecycle event. Event IDs are derived from the
+// order and event type, so a replayed event carries the same ID as the
+// original and consumers can use it to deduplicate. The trace ID is that
+// of the request that changed the order.
+type OrderEvent = events.Envelope
+
+// orderEventPayload is the payload of the order events: the
+// events.OrderChanged fields, with the whole order as the service holds it
+type orderEventPayload struct {
+    OrderID string `json:"order_id"`
+    Order   Order  `json:"order"`
+}
+
+// Event delivery counters
+var (
+    eventsDelivered atomic.Int64
+    eventsFailed    atomic.Int64
+    eventsReplayed  atomic.Int64
+)
+
+var eventClient = newHTTPClient(5 * time.Second)
+
+// Helper function to build an event for an order. eventType is one of the
+// order event types above, which pkg/events knows, so New only fails if
+// the two fall out of step.
+func newOrderEvent(eventType string, order Order, occurredAt int64, traceID string) OrderEvent {
+    eventID := uuid.NewSHA1(uuid.NameSpaceURL, []byte("order-event:"+order.OrderID+":"+eventType)).String()
+    event, err := events.New(eventType, eventID, occurredAt, traceID, orderEventPayload{OrderID: order.OrderID, Order: order})
+    if err != nil {
+        log.Printf("Failed to build %s event for order %s: %v", eventType, order.OrderID, err)
+    }
+    return event
+}
+
+// Helper function to get the order an event is about
+func eventOrderID(event OrderEvent) string {
+    var payload struct {
+        OrderID string `json:"order_id"`
+    }
+    event.Payload(&payload)
+    return payload.OrderID
+}
+
+// Helper function to map an order status to the event announcing it
+func eventForStatus(status string) string {
+    switch status {
+    case StatusPaid:
+        return EventOrderPaid
+    case StatusShipped:
+        return EventOrderShipped
+    case StatusCancelled:
+        return EventOrderCancelled
+    case StatusRefunded:
+        return EventOrderRefunded
+    }
+    return ""
+}
+
+// Helper function to check whether events go anywhere
+func orderEventsEnabled() bool {
+    return config().OrderEventsURL != "" || config().OrderEventsBroker != ""
+}
+
+// Helper function to send a batch of events to the webhook sink and the
+// broker, whichever are configured
+func deliverOrderEvents(events []OrderEvent) error {
+    postErr := postOrderEvents(events)
+    if err := publishOrderEvents(events); err != nil {
+        return fmt.Errorf("publishing to %s: %w", config().OrderEventsBroker, err)
+    }
+    return postErr
+}
+
+// Helper function to POST a batch of events to the configured sink
+func postOrderEvents(events []OrderEvent) error {
+    sinkURL := config().OrderEventsURL
+    if sinkURL == "" || len(events) == 0 {
+        return nil
+    }
+
+    body, err := json.Marshal(map[string]interface{}{"events": events})
+    if err != nil {
+        return err
+    }
+    req, err := http.NewRequest(http.MethodPost, sinkURL, bytes.NewReader(body))
+    if err != nil {
+        return err
+    }
+    req.Header.Set("Content-Type", "application/json")
+    if orderEventsSecret != "" {
+        req.Header.Set(SignatureHeader, signPayload(orderEventsSecret, time.Now().Unix(), body))
+    }
+
+    resp, err := eventClient.Do(req)
+    if err != nil {
+        eventsFailed.Add(int64(len(events)))
+        return err
+    }
+    resp.Body.Close()
+
+    if resp.StatusCode >= 300 {
+        eventsFailed.Add(int64(len(events)))
+        return fmt.Errorf("event sink returned status %d", resp.StatusCode)
+    }
+    eventsDelivered.Add(int64(len(events)))
+    return nil
+}
+
+// Helper function to reconstruct an order's lifecycle events from its
+// status history. Orders from before the history was kept fall back to
+// their current state: events other than order.created are stamped with
+// the last update, except order.paid on a shipped or refunded order, which
+// is stamped with creation time. Trace IDs aren't stored, so reconstructed
+// events carry none.
+func lifecycleEvents(order Order) []OrderEvent {
+    events := []OrderEvent{newOrderEvent(EventOrderCreated, order, order.CreatedAt, "")}
+
+    if len(order.StatusHistory) > 0 {
+        for _, change := range order.StatusHistory {
+            if eventType := eventForStatus(change.To); eventType != "" {
+                events = append(events, newOrderEvent(eventType, order, change.At, ""))
+            }
+        }
+        return events
+    }
+
+    switch order.Status {
+    case StatusPaid:
+        events = append(events, newOrderEvent(EventOrderPaid, order, order.UpdatedAt, ""))
+    case StatusShipped:
+        events = append(events, newOrderEvent(EventOrderPaid, order, order.CreatedAt, ""))
+        events = append(events, newOrderEvent(EventOrderShipped, order, order.UpdatedAt, ""))
+    case StatusCancelled:
+        events = append(events, newOrderEvent(EventOrderCancelled, order, order.UpdatedAt, ""))
+    case StatusRefunded:
+        events = append(events, newOrderEvent(EventOrderPaid, order, order.CreatedAt, ""))
+        events = append(events, newOrderEvent(EventOrderRefunded, order, order.UpdatedAt, ""))
+    }
+    return events
+}
+
+// Helper function to parse a replay bound as Unix seconds or RFC 3339
+func parseReplayTime(value string, fallback int64) (int64, error) {
+    if value == "" {
+        return fallback, nil
+    }
+    if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+        return seconds, nil
+    }
+    parsed, err := time.Parse(time.RFC3339, value)
+    if err != nil {
+        return 0, fmt.Errorf("%q is not a Unix timestamp or RFC 3339 time", value)
+    }
+    return parsed.Unix(), nil
+}
+
+// Admin endpoint to re-emit lifecycle events that occurred in [from, to]
+// for hot and archived orders, oldest first, so downstream read models
+// (analytics, search projections) can be rebuilt. ?type= limits the
+// replay to one event type; ?dry_run=true returns the events instead of
+// sending them.
+func replayOrderEventsHandler(w http.ResponseWriter, r *http.Request) {
+    query := r.URL.Query()
+
+    from, err := parseReplayTime(query.Get("from"), 0)
+    if err != nil {
+        http.Error(w, "Invalid from: "+err.Error(), http.StatusBadRequest)
+        return
+    }
+    to, err := parseReplayTime(query.Get("to"), time.Now().Unix())
+    if err != nil {
+        http.Error(w, "Invalid to: "+err.Error(), http.StatusBadRequest)
+        return
+    }
+    if from > to {
+        http.Error(w, "from must not be after to", http.StatusBadRequest)
+        return
+    }
+    eventType := query.Get("type")
+    dryRun := query.Get("dry_run") == "true"
+
+    if !dryRun && !orderEventsEnabled() {
+        http.Error(w, "No event sink configured: set ORDER_EVENTS_URL or ORDER_EVENTS_BROKER", http.StatusConflict)
+        return
+    }
+
+    var events []OrderEvent
+    collect := func(order Order) {
+        for _, event := range lifecycleEvents(order) {
+            if event.OccurredAt < from || event.OccurredAt > to {
+                continue
+            }
+            if eventType != "" && event.Type != eventType {
+                continue
+            }
+            event.Replayed = true
+            events = append(events, event)
+        }
+    }
+    forEachOrder(collect)
+    if err := forEachArchivedOrder(collect); err != nil {
+        log.Printf("Failed to read order archive for replay: %v", err)
+        http.Error(w, "Failed to read order archive", http.StatusInternalServerError)
+        return
+    }
+
+    // Stable, so an order's events that share a timestamp stay in
+    // lifecycle order
+    sort.SliceStable(events, func(i, j int) bool {
+        if events[i].OccurredAt != events[j].OccurredAt {
+            return events[i].OccurredAt < events[j].OccurredAt
+        }
+        return eventOrderID(events[i]) < eventOrderID(events[j])
+    })
+
+    result := map[string]interface{}{
+        "from":    from,
+        "to":      to,
+        "events":  len(events),
+        "dry_run": dryRun,
+    }
+
+    if dryRun {
+        result["replay"] = events
+        w.Header().Set("Content-Type", "application/json")
+        json.NewEncoder(w).Encode(result)
+        return
+    }
+
+    delivered := 0
+    status := http.StatusOK
+    for start := 0; start < len(events); start += ReplayBatchSize {
+        end := start + ReplayBatchSize
+        if end > len(events) {
+            end = len(events)
+        }
+        if err := deliverOrderEvents(events[start:end]); err != nil {
+            log.Printf("Order event replay stopped after %d events: %v", delivered, err)
+            result["error"] = err.Error()
+            status = http.StatusBadGateway
+            break
+        }
+        delivered = end
+    }
+    eventsReplayed.Add(int64(delivered))
+    result["delivered"] = delivered
+
+    adminauth.Audit(r, "replay_events", map[string]interface{}{
+        "from": from, "to": to, "type": eventType, "events": len(events), "delivered": delivered,
+    })
+
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(status)
+    json.NewEncoder(w).Encode(result)
+}
+
+// Helper function to report event delivery metrics
+func eventMetrics() string {
+    return fmt.Sprintf(`
+# HELP order_service_events_delivered_total Order lifecycle events delivered to the event sink
+# TYPE order_service_events_delivered_total counter
+order_service_events_delivered_total %d
+
+# HELP order_service_events_failed_total Order lifecycle events the event sink did not accept
+# TYPE order_service_events_failed_total counter
+order_service_events_failed_total %d
+
+# HELP order_service_events_replayed_total Order lifecycle events re-sent by replays
+# TYPE order_service_events_replayed_total counter
+order_service_events_replayed_total %d
+
+# HELP order_service_events_published_total Order lifecycle events the message broker accepted
+# TYPE order_service_events_published_total counter
+order_service_events_published_total %d
+
+# HELP order_service_events_publish_failed_total Order lifecycle events that could not be published to the message broker
+# TYPE order_service_events_publish_failed_total counter
+order_service_events_publish_failed_total %d
+`, eventsDelivered.Load(), eventsFailed.Load(), eventsReplayed.Load(), eventsPublished.Load(), eventsPublishFailed.Load())
+}
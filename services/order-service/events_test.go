@@ -0,0 +1,32 @@
+package main
+
+import (
+    "encoding/json"
+    "testing"
+    "time"
+
+    "events"
+)
+
+// Events as the order service sends them must decode and validate against
+// the pkg/events schemas, and keep the order they are about as the key
+func TestOrderEventsMatchSchema(t *testing.T) {
+    order := benchmarkOrder(1, time.Now().Unix())
+    for _, eventType := range []string{EventOrderCreated, EventOrderPaid, EventOrderShipped, EventOrderCancelled, EventOrderRefunded} {
+        event := newOrderEvent(eventType, order, order.UpdatedAt, "trace-1")
+        data, err := json.Marshal(event)
+        if err != nil {
+            t.Fatalf("%s: marshal failed: %v", eventType, err)
+        }
+        decoded, err := events.Decode(data)
+        if err != nil {
+            t.Fatalf("%s: decode failed: %v", eventType, err)
+        }
+        if err := events.Validate(decoded); err != nil {
+            t.Errorf("%s: %v", eventType, err)
+        }
+        if got := eventOrderID(decoded); got != order.OrderID {
+            t.Errorf("%s: event is about order %q, want %q", eventType, got, order.OrderID)
+        }
+    }
+}
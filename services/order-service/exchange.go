@@ -0,0 +1,262 @@
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "math/big"
+    "net/http"
+    "net/url"
+    "regexp"
+    "sort"
+    "strings"
+    "sync"
+    "time"
+
+    "money"
+)
+
+// Exchange rate providers (FX_PROVIDER)
+const (
+    FXProviderNone   = "none"
+    FXProviderStatic = "static"
+    FXProviderHTTP   = "http"
+)
+
+// Rates fetched from FX_RATES_URL are reused for this long
+const ExchangeRateCacheTTL = 10 * time.Minute
+
+// ExchangeRateProvider gives the rate to convert an order's currency into
+// the settlement currency (SETTLEMENT_CURRENCY): how many units of to one
+// unit of from is worth, as a decimal string. An empty rate means the
+// provider has none for the pair; an error means it couldn't be asked.
+type ExchangeRateProvider interface {
+    Name() string
+    Rate(from string, to string) (string, error)
+}
+
+// noExchangeRates converts nothing, so only orders already in the
+// settlement currency can be taken (the default)
+type noExchangeRates struct{}
+
+func (noExchangeRates) Name() string {
+    return FXProviderNone
+}
+
+func (noExchangeRates) Rate(from string, to string) (string, error) {
+    return "", nil
+}
+
+// staticExchangeRates converts at the fixed rates in FX_RATES, each
+// the worth of one unit of a currency in the settlement currency
+type staticExchangeRates struct {
+    Rates map[string]string // currency -> rate
+}
+
+func (staticExchangeRates) Name() string {
+    return FXProviderStatic
+}
+
+func (p staticExchangeRates) Rate(from string, to string) (string, error) {
+    return p.Rates[from], nil
+}
+
+// httpExchangeRates asks a rates service at FX_RATES_URL, as
+// GET {url}?from=EUR&to=USD answered with {"rates": {"USD": 1.0842}}
+// (the form Frankfurter and similar services use). Answers are cached for
+// ExchangeRateCacheTTL.
+type httpExchangeRates struct {
+    URL string
+}
+
+type cachedExchangeRate struct {
+    Rate      string
+    FetchedAt time.Time
+}
+
+var (
+    exchangeRateCache   = make(map[string]cachedExchangeRate)
+    exchangeRateCacheMu sync.Mutex
+    exchangeRateClient  = newHTTPClient(3 * time.Second)
+)
+
+func (httpExchangeRates) Name() string {
+    return FXProviderHTTP
+}
+
+func (p httpExchangeRates) Rate(from string, to string) (string, error) {
+    key := p.URL + " " + from + ":" + to
+    exchangeRateCacheMu.Lock()
+    cached, exists := exchangeRateCache[key]
+    exchangeRateCacheMu.Unlock()
+    if exists && time.Since(cached.FetchedAt) < ExchangeRateCacheTTL {
+        return cached.Rate, nil
+    }
+
+    query := url.Values{}
+    query.Set("from", from)
+    query.Set("to", to)
+    resp, err := exchangeRateClient.Get(p.URL + "?" + query.Encode())
+    if err != nil {
+        return "", err
+    }
+    defer resp.Body.Close()
+    if resp.StatusCode == http.StatusNotFound {
+        return "", nil
+    }
+    if resp.StatusCode != http.StatusOK {
+        return "", fmt.Errorf("exchange rates service returned status %d", resp.StatusCode)
+    }
+
+    var body struct {
+        Rates map[string]json.Number `json:"rates"`
+    }
+    decoder := json.NewDecoder(resp.Body)
+    decoder.UseNumber()
+    if err := decoder.Decode(&body); err != nil {
+        return "", err
+    }
+    rate := body.Rates[to].String()
+    if rate == "" {
+        return "", nil
+    }
+    if _, err := parseExchangeRate(rate); err != nil {
+        return "", err
+    }
+
+    exchangeRateCacheMu.Lock()
+    exchangeRateCache[key] = cachedExchangeRate{Rate: rate, FetchedAt: time.Now()}
+    exchangeRateCacheMu.Unlock()
+    return rate, nil
+}
+
+// Helper function to get the provider for the configured settings
+func currentExchangeRateProvider() ExchangeRateProvider {
+    cfg := config()
+    switch cfg.FXProvider {
+    case FXProviderStatic:
+        return staticExchangeRates{Rates: cfg.FXRates}
+    case FXProviderHTTP:
+        return httpExchangeRates{URL: cfg.FXRatesURL}
+    }
+    return noExchangeRates{}
+}
+
+// Exchange rates are decimal strings, as in payment-service, so
+// conversions are exact
+var fxRatePattern = regexp.MustCompile(`^\d+(\.\d{1,10})?$`)
+
+// Helper function to parse a positive decimal exchange rate exactly
+func parseExchangeRate(value string) (*big.Rat, error) {
+    if !fxRatePattern.MatchString(value) {
+        return nil, fmt.Errorf("invalid exchange rate %q", value)
+    }
+    rate, ok := new(big.Rat).SetString(value)
+    if !ok || rate.Sign() <= 0 {
+        return nil, fmt.Errorf("invalid exchange rate %q", value)
+    }
+    return rate, nil
+}
+
+// Helper function to parse FX_RATES: comma-separated CURRENCY=RATE
+// entries, e.g. "EUR=1.0842,GBP=1.2701,JPY=0.00667"
+func parseExchangeRates(value string) (map[string]string, error) {
+    rates := make(map[string]string)
+    for _, entry := range strings.Split(value, ",") {
+        entry = strings.TrimSpace(entry)
+        if entry == "" {
+            continue
+        }
+        code, rate, found := strings.Cut(entry, "=")
+        if !found {
+            return nil, fmt.Errorf("FX_RATES entry %q must be CURRENCY=RATE", entry)
+        }
+        currency, err := money.NormalizeCurrency(code)
+        if err != nil || strings.TrimSpace(code) == "" {
+            return nil, fmt.Errorf("FX_RATES entry %q has an unsupported currency", entry)
+        }
+        rate = strings.TrimSpace(rate)
+        if _, err := parseExchangeRate(rate); err != nil {
+            return nil, fmt.Errorf("FX_RATES rate for %s must be a positive number", currency)
+        }
+        rates[currency] = rate
+    }
+    return rates, nil
+}
+
+// Helper function to format exchange rates back into FX_RATES form,
+// for display
+func formatExchangeRates(rates map[string]string) string {
+    entries := make([]string, 0, len(rates))
+    for currency, rate := range rates {
+        entries = append(entries, currency+"="+rate)
+    }
+    sort.Strings(entries)
+    return strings.Join(entries, ",")
+}
+
+// Helper function to convert a minor-unit amount at a rate, allowing for
+// the two currencies' minor units and rounding half away from zero
+func convertAmount(amount money.Money, rate string, to string) (money.Money, error) {
+    parsed, err := parseExchangeRate(rate)
+    if err != nil {
+        return money.Money{}, err
+    }
+    scale := new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(money.MinorUnits(to))), nil)
+    numerator := new(big.Int).Mul(big.NewInt(int64(amount.Amount)), parsed.Num())
+    numerator.Mul(numerator, scale)
+    denominator := new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(money.MinorUnits(amount.Currency))), nil)
+    denominator.Mul(denominator, parsed.Denom())
+
+    quotient, remainder := new(big.Int).QuoRem(numerator, denominator, new(big.Int))
+    if new(big.Int).Mul(new(big.Int).Abs(remainder), big.NewInt(2)).Cmp(denominator) >= 0 {
+        quotient.Add(quotient, big.NewInt(int64(numerator.Sign())))
+    }
+    if !quotient.IsInt64() {
+        return money.Money{}, money.ErrAmountOverflow
+    }
+    return money.New(int(quotient.Int64()), to), nil
+}
+
+// Helper function to get the rate to settle an amount of a currency at. An
+// empty rate means the provider has none.
+func settlementRate(currency string, settlement string) (string, error) {
+    if currency == settlement {
+        return "1", nil
+    }
+    provider := currentExchangeRateProvider()
+    rate, err := provider.Rate(currency, settlement)
+    if err != nil {
+        return "", fmt.Errorf("%s exchange rate provider: %w", provider.Name(), err)
+    }
+    return rate, nil
+}
+
+// Helper function to record an order's total in the settlement currency
+// at a rate from settlementRate. Refunds are converted at the same rate,
+// so the order's books balance.
+func applySettlement(order *Order, settlement string, rate string) error {
+    total, err := convertAmount(order.Total(), rate, settlement)
+    if err != nil {
+        return err
+    }
+    order.SettlementCurrency = settlement
+    order.FXRate = rate
+    order.SettlementTotalCents = total.Amount
+    return nil
+}
+
+// Helper function to convert a refund of an order into its settlement
+// currency at the order's rate. Refunds so far are converted together with
+// this one, so the rounding never drifts and refunding everything returns
+// the whole settlement total. Orders taken without a settlement currency
+// report 0.
+func settlementRefundCents(order Order, cents int) int {
+    if order.SettlementCurrency == "" {
+        return 0
+    }
+    refunded, err := convertAmount(money.New(order.RefundedCents+cents, order.Currency), order.FXRate, order.SettlementCurrency)
+    if err != nil {
+        return 0
+    }
+    return refunded.Amount - order.SettlementRefundedCents
+}
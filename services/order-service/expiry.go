@@ -0,0 +1,208 @@
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "log"
+    "net/http"
+    "os"
+    "strconv"
+    "sync/atomic"
+    "time"
+
+    "middleware/adminauth"
+    "middleware/i18n"
+)
+
+// Unpaid order expiry. Orders left in created, pending_payment (a 3-D
+// Secure challenge the customer never finished) or payment_failed (a
+// declined payment the customer never retried) for longer than
+// UNPAID_ORDER_TIMEOUT_MINUTES are cancelled, and the stock their cart
+// reserved is released so other customers can buy it. Orders pending or
+// processing have a checkout under way and are left to it.
+
+// DefaultUnpaidOrderTimeoutMinutes is longer than payment-service's own
+// authentication timeout, so an abandoned challenge normally fails there
+// first and this only catches orders whose callback never came
+const DefaultUnpaidOrderTimeoutMinutes = 120
+
+// Expiry check interval (ORDER_EXPIRY_INTERVAL_SECONDS)
+var expiryInterval = time.Minute
+
+var (
+    ordersExpired atomic.Int64
+    lastExpiryRun atomic.Int64
+)
+
+func init() {
+    if value := os.Getenv("ORDER_EXPIRY_INTERVAL_SECONDS"); value != "" {
+        if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+            expiryInterval = time.Duration(seconds) * time.Second
+        } else {
+            log.Printf("Ignoring invalid ORDER_EXPIRY_INTERVAL_SECONDS=%q", value)
+        }
+    }
+}
+
+// Helper function to check whether an order is waiting to be paid
+func awaitingPayment(status string) bool {
+    return status == StatusCreated || status == StatusPendingPayment || status == StatusPaymentFailed
+}
+
+// Helper function to cancel unpaid orders that haven't changed since
+// cutoff. Returns the orders cancelled.
+func expireUnpaidOrders(cutoff time.Time, timeout time.Duration) []Order {
+    var candidates []string
+    forEachOrder(func(order Order) {
+        if awaitingPayment(order.Status) && order.UpdatedAt < cutoff.Unix() {
+            candidates = append(candidates, order.OrderID)
+        }
+    })
+    lastExpiryRun.Store(time.Now().Unix())
+
+    reason := i18n.Message(i18n.DefaultLocale, "order.payment_timed_out", int(timeout.Minutes()))
+    var expired []Order
+    for _, orderID := range candidates {
+        shard := shardFor(orderID)
+        shard.mu.Lock()
+        // Paid or changed since it was picked; leave it be
+        order, exists := shard.orders[orderID]
+        if !exists || !awaitingPayment(order.Status) || order.UpdatedAt >= cutoff.Unix() {
+            shard.mu.Unlock()
+            continue
+        }
+        pendingPayment := order.Status == StatusPendingPayment
+        setStatus(&order, StatusCancelled, ActorExpiry, reason)
+        order.PaymentAction = nil
+        putOrder(shard, order)
+        recordEffects(shard, order, orderEffects{
+            Events:        []string{EventOrderCancelled},
+            Notifications: []string{"order_cancelled"},
+        })
+        shard.mu.Unlock()
+        expired = append(expired, order)
+        ordersExpired.Add(1)
+
+        if order.CartID != "" {
+            if err := releaseCartReservations(order.CartID); err != nil {
+                log.Printf("Failed to release reservations of cart %s for expired order %s: %v", order.CartID, orderID, err)
+            }
+        }
+        // A challenge finished at the last moment may have settled
+        if pendingPayment {
+            if err := reverseOrderPayments(orderID); err != nil {
+                log.Printf("Failed to reverse payments of expired order %s: %v", orderID, err)
+            }
+        }
+    }
+    if len(expired) > 0 {
+        persistOrders()
+    }
+    return expired
+}
+
+// Helper function to release the stock a cart still has reserved
+func releaseCartReservations(cartID string) error {
+    if config().InventoryServiceURL == "" {
+        return nil
+    }
+
+    client := newServiceClient(inventoryBreaker, 10*time.Second)
+    resp, err := client.Get(fmt.Sprintf("%s/api/inventory/cart/%s/reservations", config().InventoryServiceURL, cartID))
+    if err != nil {
+        return err
+    }
+    defer resp.Body.Close()
+    if resp.StatusCode >= 300 {
+        return fmt.Errorf("inventory service returned status %d", resp.StatusCode)
+    }
+
+    var reservationsResp struct {
+        Reservations []committedReservation `json:"reservations"`
+    }
+    if err := json.NewDecoder(resp.Body).Decode(&reservationsResp); err != nil {
+        return err
+    }
+
+    for _, reservation := range reservationsResp.Reservations {
+        req, err := http.NewRequest(http.MethodDelete,
+            fmt.Sprintf("%s/api/inventory/release/%s", config().InventoryServiceURL, reservation.ReservationID), nil)
+        if err != nil {
+            return err
+        }
+        releaseResp, err := client.Do(req)
+        if err != nil {
+            return err
+        }
+        releaseResp.Body.Close()
+        // Released or committed in the meantime is fine too
+        if releaseResp.StatusCode >= 300 && releaseResp.StatusCode != http.StatusBadRequest && releaseResp.StatusCode != http.StatusNotFound {
+            return fmt.Errorf("releasing reservation %s: inventory service returned status %d", reservation.ReservationID, releaseResp.StatusCode)
+        }
+    }
+    return nil
+}
+
+// Cancel stale unpaid orders every expiry interval while a timeout is set
+func expiryLoop() {
+    ticker := time.NewTicker(expiryInterval)
+    defer ticker.Stop()
+    for range ticker.C {
+        minutes := config().UnpaidOrderTimeoutMinutes
+        if minutes == 0 {
+            continue
+        }
+        timeout := time.Duration(minutes) * time.Minute
+        if expired := expireUnpaidOrders(time.Now().Add(-timeout), timeout); len(expired) > 0 {
+            log.Printf("Cancelled %d orders left unpaid for %d minutes", len(expired), minutes)
+        }
+    }
+}
+
+// Admin endpoint to cancel stale unpaid orders now. ?older_than_minutes=
+// overrides UNPAID_ORDER_TIMEOUT_MINUTES for this run.
+func expireOrdersHandler(w http.ResponseWriter, r *http.Request) {
+    minutes := config().UnpaidOrderTimeoutMinutes
+    if value := r.URL.Query().Get("older_than_minutes"); value != "" {
+        parsed, err := strconv.Atoi(value)
+        if err != nil || parsed < 0 {
+            http.Error(w, "older_than_minutes must be a non-negative integer", http.StatusBadRequest)
+            return
+        }
+        minutes = parsed
+    } else if minutes == 0 {
+        http.Error(w, "Expiry is not configured: set UNPAID_ORDER_TIMEOUT_MINUTES or pass ?older_than_minutes=", http.StatusBadRequest)
+        return
+    }
+
+    timeout := time.Duration(minutes) * time.Minute
+    cutoff := time.Now().Add(-timeout)
+    expired := expireUnpaidOrders(cutoff, timeout)
+
+    orderIDs := make([]string, 0, len(expired))
+    for _, order := range expired {
+        orderIDs = append(orderIDs, order.OrderID)
+    }
+    adminauth.Audit(r, "orders_expire", map[string]interface{}{"older_than_minutes": minutes, "expired": len(expired)})
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "message":   "Unpaid orders cancelled",
+        "cutoff":    cutoff.Unix(),
+        "expired":   len(expired),
+        "order_ids": orderIDs,
+    })
+}
+
+// Helper function to report expiry metrics
+func expiryMetrics() string {
+    return fmt.Sprintf(`
+# HELP order_service_orders_expired_total Unpaid orders cancelled after UNPAID_ORDER_TIMEOUT_MINUTES
+# TYPE order_service_orders_expired_total counter
+order_service_orders_expired_total %d
+
+# HELP order_service_order_expiry_last_run_timestamp_seconds When unpaid orders were last checked
+# TYPE order_service_order_expiry_last_run_timestamp_seconds gauge
+order_service_order_expiry_last_run_timestamp_seconds %d
+`, ordersExpired.Load(), lastExpiryRun.Load())
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+    "encoding/json"
+    "net/http"
+
+    "middleware/adminauth"
+    "money"
+)
+
+// FixtureTimestamp is used for every fixture's created/updated time so
+// fixture responses are byte-for-byte stable between runs
+// (2024-01-01T00:00:00Z)
+const FixtureTimestamp = 1704067200
+
+// Fixture orders for end-to-end suites: paid orders placed by the fixture
+// users in user-service, settled by the fixture payments in payment-service
+var fixtureOrders = []Order{
+    {
+        OrderID:   "test-order-1",
+        UserID:    "test-user-1",
+        Items:     []OrderItem{{ProductID: "test-prod-2", Quantity: 1, PriceCents: 4999}},
+        PaymentID: "test-pay-1",
+    },
+    {
+        OrderID:   "test-order-2",
+        UserID:    "test-user-3",
+        Items:     []OrderItem{{ProductID: "test-prod-1", Quantity: 3, PriceCents: 1999}},
+        PaymentID: "test-pay-2",
+    },
+    {
+        OrderID:   "test-order-3",
+        UserID:    "test-user-3",
+        Items:     []OrderItem{{ProductID: "test-prod-3", Quantity: 2, PriceCents: 999}},
+        PaymentID: "test-pay-3",
+    },
+}
+
+// Helper function to replace all test users' orders with the fixture set.
+// Returns how many test orders were removed first.
+func loadFixtures() int {
+    removed := clearTestOrders()
+
+    for _, order := range fixtureOrders {
+        order.Items = append([]OrderItem{}, order.Items...)
+        total, _ := orderTotal(order.Items, money.DefaultCurrency)
+        order.SubtotalCents = total.Amount
+        order.GrandTotalCents = total.Amount
+        order.TotalCents = total.Amount
+        order.Currency = total.Currency
+        order.Status = StatusPaid
+        order.StatusHistory = []StatusChange{
+            {To: StatusCreated, At: FixtureTimestamp},
+            {From: StatusCreated, To: StatusPaid, At: FixtureTimestamp},
+        }
+        order.CreatedAt = FixtureTimestamp
+        order.UpdatedAt = FixtureTimestamp
+        storeOrder(order, orderEffects{})
+    }
+
+    persistOrders()
+    return removed
+}
+
+// Admin endpoint to (re)load the fixture orders. Any other test users'
+// orders are removed, so every run starts from the same order history.
+func loadFixturesHandler(w http.ResponseWriter, r *http.Request) {
+    removed := loadFixtures()
+    adminauth.Audit(r, "fixtures_load", map[string]interface{}{"removed": removed, "orders": len(fixtureOrders)})
+
+    result := map[string]interface{}{
+        "message": "Fixtures loaded",
+        "removed": removed,
+        "loaded":  map[string]int{"orders": len(fixtureOrders)},
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(result)
+}
+
+// Admin endpoint to remove fixtures and any other test users' orders
+func resetFixturesHandler(w http.ResponseWriter, r *http.Request) {
+    removed := clearTestOrders()
+    persistOrders()
+    adminauth.Audit(r, "fixtures_reset", map[string]interface{}{"removed": removed})
+
+    result := map[string]interface{}{
+        "message": "Fixtures reset",
+        "removed": removed,
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(result)
+}
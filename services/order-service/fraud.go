@@ -0,0 +1,445 @@
+package main
+
+import (
+    "bytes"
+    "encoding/json"
+    "fmt"
+    "io"
+    "log"
+    "net"
+    "net/http"
+    "sort"
+    "sync"
+    "sync/atomic"
+    "time"
+
+    "github.com/gorilla/mux"
+    "middleware/adminauth"
+    "middleware/i18n"
+    "middleware/openmetrics"
+)
+
+// Fraud screening. Before an order's payment is taken, the provider
+// FRAUD_PROVIDER names scores it from 0 (looks fine) to 100. At
+// FRAUD_DENY_SCORE or above the checkout is refused. At FRAUD_REVIEW_SCORE
+// or above the payment is taken but the order is put on hold instead of
+// paid, and waits in the admin review queue until someone approves it
+// (it becomes paid and the customer is told) or rejects it (its stock is
+// put back, its payments reversed and it is cancelled, through the
+// checkout saga). A provider that can't be asked sends the order to
+// review rather than turning the customer away.
+const (
+    FraudProviderNone = "none"
+    FraudProviderHTTP = "http"
+)
+
+// Screening outcomes
+const (
+    FraudAllow  = "allow"
+    FraudReview = "review"
+    FraudDeny   = "deny"
+)
+
+// Review decisions
+const (
+    ReviewApproved = "approved"
+    ReviewRejected = "rejected"
+)
+
+// Default score thresholds
+const (
+    DefaultFraudReviewScore = 60
+    DefaultFraudDenyScore   = 90
+)
+
+// FraudScreening is the outcome of screening an order, and of its review
+type FraudScreening struct {
+    OrderID      string                 `json:"order_id"`
+    Provider     string                 `json:"provider"`
+    Score        int                    `json:"score"`
+    Outcome      string                 `json:"outcome"`
+    Reasons      []string               `json:"reasons,omitempty"`
+    Error        string                 `json:"error,omitempty"` // why the provider couldn't be asked
+    ScreenedAt   int64                  `json:"screened_at"`
+    Committed    []committedReservation `json:"committed,omitempty"` // stock a held order took, put back if it is rejected
+    Decision     string                 `json:"decision,omitempty"`
+    DecidedBy    string                 `json:"decided_by,omitempty"`
+    DecisionNote string                 `json:"decision_note,omitempty"`
+    DecidedAt    int64                  `json:"decided_at,omitempty"`
+}
+
+// ReviewDecision for POST /api/v1/admin/orders/{orderId}/review/approve
+// and /reject. The note is kept with the screening, for staff only.
+type ReviewDecision struct {
+    Note string `json:"note"`
+}
+
+// FraudScreener scores an order before its payment is taken. An error
+// means the provider couldn't be asked.
+type FraudScreener interface {
+    Name() string
+    Score(order Order, clientIP string) (int, []string, error)
+}
+
+// noFraudScreening lets every order through (the default)
+type noFraudScreening struct{}
+
+func (noFraudScreening) Name() string {
+    return FraudProviderNone
+}
+
+func (noFraudScreening) Score(order Order, clientIP string) (int, []string, error) {
+    return 0, nil, nil
+}
+
+// httpFraudScreening asks a scoring service at FRAUD_SERVICE_URL, as
+// POST {url} with {"order_id", "user_id", "total_cents", "currency",
+// "items", "shipping_address", "client_ip"}, answered with
+// {"score": 0-100, "reasons": [...]}
+type httpFraudScreening struct {
+    URL string
+}
+
+var fraudClient = newHTTPClient(3 * time.Second)
+
+func (httpFraudScreening) Name() string {
+    return FraudProviderHTTP
+}
+
+func (p httpFraudScreening) Score(order Order, clientIP string) (int, []string, error) {
+    body, err := json.Marshal(map[string]interface{}{
+        "order_id":         order.OrderID,
+        "user_id":          order.UserID,
+        "total_cents":      order.TotalCents,
+        "currency":         order.Currency,
+        "items":            order.Items,
+        "shipping_address": order.ShippingAddress,
+        "billing_address":  order.BillingAddress,
+        "client_ip":        clientIP,
+    })
+    if err != nil {
+        return 0, nil, err
+    }
+    resp, err := fraudClient.Post(p.URL, "application/json", bytes.NewReader(body))
+    if err != nil {
+        return 0, nil, err
+    }
+    defer resp.Body.Close()
+    if resp.StatusCode != http.StatusOK {
+        return 0, nil, fmt.Errorf("fraud service returned status %d", resp.StatusCode)
+    }
+
+    var result struct {
+        Score   *int     `json:"score"`
+        Reasons []string `json:"reasons"`
+    }
+    if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+        return 0, nil, err
+    }
+    if result.Score == nil || *result.Score < 0 || *result.Score > 100 {
+        return 0, nil, fmt.Errorf("fraud service answered without a score from 0 to 100")
+    }
+    return *result.Score, result.Reasons, nil
+}
+
+// Helper function to get the screener for the configured settings
+func currentFraudScreener() FraudScreener {
+    cfg := config()
+    if cfg.FraudProvider == FraudProviderHTTP {
+        return httpFraudScreening{URL: cfg.FraudServiceURL}
+    }
+    return noFraudScreening{}
+}
+
+// Screenings that flagged an order, by order ID. They're kept apart from
+// the orders, as notes are, so scores can't reach customers through any
+// order response, and saved in the order snapshot.
+var (
+    fraudScreenings = make(map[string]FraudScreening)
+    fraudMu         sync.RWMutex
+)
+
+// Fraud screening counters
+var (
+    fraudScreened atomic.Int64
+    fraudDenied   atomic.Int64
+    fraudHeld     atomic.Int64
+    fraudErrors   atomic.Int64
+)
+
+// Helper function to screen an order before its payment is taken
+func screenOrder(order Order, clientIP string) FraudScreening {
+    screener := currentFraudScreener()
+    screening := FraudScreening{
+        OrderID:    order.OrderID,
+        Provider:   screener.Name(),
+        Outcome:    FraudAllow,
+        ScreenedAt: time.Now().Unix(),
+    }
+    if screener.Name() == FraudProviderNone {
+        return screening
+    }
+
+    fraudScreened.Add(1)
+    score, reasons, err := screener.Score(order, clientIP)
+    cfg := config()
+    switch {
+    case err != nil:
+        fraudErrors.Add(1)
+        log.Printf("Fraud screening for order %s failed, holding it for review: %v", order.OrderID, err)
+        screening.Outcome = FraudReview
+        screening.Error = err.Error()
+    case score >= cfg.FraudDenyScore:
+        screening.Outcome = FraudDeny
+    case score >= cfg.FraudReviewScore:
+        screening.Outcome = FraudReview
+    }
+    screening.Score = score
+    screening.Reasons = reasons
+
+    switch screening.Outcome {
+    case FraudDeny:
+        fraudDenied.Add(1)
+        log.Printf("Fraud screening denied order %s (score %d)", order.OrderID, score)
+    case FraudReview:
+        fraudHeld.Add(1)
+    }
+    return screening
+}
+
+// Helper function to get the IP address a request came from
+func clientIP(r *http.Request) string {
+    host, _, err := net.SplitHostPort(r.RemoteAddr)
+    if err != nil {
+        return r.RemoteAddr
+    }
+    return host
+}
+
+// Helper function to keep a screening that flagged an order, once the
+// order is stored. Screenings that let it through aren't kept.
+func keepFraudScreening(screening FraudScreening) {
+    if screening.Outcome == FraudAllow {
+        return
+    }
+    fraudMu.Lock()
+    defer fraudMu.Unlock()
+    fraudScreenings[screening.OrderID] = screening
+}
+
+// Helper function to look up the screening that flagged an order
+func fraudScreeningFor(orderID string) (FraudScreening, bool) {
+    fraudMu.RLock()
+    defer fraudMu.RUnlock()
+    screening, exists := fraudScreenings[orderID]
+    return screening, exists
+}
+
+// Helper function to check whether an order's screening asked for review
+// and nobody has decided it yet
+func awaitingReview(orderID string) bool {
+    screening, exists := fraudScreeningFor(orderID)
+    return exists && screening.Outcome == FraudReview && screening.Decision == ""
+}
+
+// Helper function to record the stock a held order's checkout committed,
+// so a rejection can put it back
+func holdReservations(orderID string, committed []committedReservation) {
+    fraudMu.Lock()
+    defer fraudMu.Unlock()
+    if screening, exists := fraudScreenings[orderID]; exists {
+        screening.Committed = append([]committedReservation(nil), committed...)
+        fraudScreenings[orderID] = screening
+    }
+}
+
+// Helper function to record a review decision
+func decideReview(orderID string, decision string, decidedBy string, note string) {
+    fraudMu.Lock()
+    defer fraudMu.Unlock()
+    if screening, exists := fraudScreenings[orderID]; exists {
+        screening.Decision = decision
+        screening.DecidedBy = decidedBy
+        screening.DecisionNote = note
+        screening.DecidedAt = time.Now().Unix()
+        fraudScreenings[orderID] = screening
+    }
+}
+
+// Helper function to copy the screenings for a snapshot
+func snapshotFraudScreenings() map[string]FraudScreening {
+    fraudMu.RLock()
+    defer fraudMu.RUnlock()
+
+    screenings := make(map[string]FraudScreening, len(fraudScreenings))
+    for orderID, screening := range fraudScreenings {
+        screenings[orderID] = screening
+    }
+    return screenings
+}
+
+// Helper function to restore screenings from a snapshot
+func restoreFraudScreenings(screenings map[string]FraudScreening) {
+    fraudMu.Lock()
+    defer fraudMu.Unlock()
+
+    for orderID, screening := range screenings {
+        fraudScreenings[orderID] = screening
+    }
+}
+
+// Helper function to drop the screenings of orders that were removed. No
+// IDs drops every screening.
+func dropFraudScreenings(orderIDs ...string) {
+    fraudMu.Lock()
+    defer fraudMu.Unlock()
+
+    if len(orderIDs) == 0 {
+        fraudScreenings = make(map[string]FraudScreening)
+        return
+    }
+    for _, orderID := range orderIDs {
+        delete(fraudScreenings, orderID)
+    }
+}
+
+// Helper function to read a review decision body, which may be empty
+func decodeReviewDecision(w http.ResponseWriter, r *http.Request) (ReviewDecision, bool) {
+    var decision ReviewDecision
+    if err := json.NewDecoder(r.Body).Decode(&decision); err != nil && err != io.EOF {
+        http.Error(w, "Invalid JSON", http.StatusBadRequest)
+        return decision, false
+    }
+    return decision, true
+}
+
+// Admin endpoint listing the orders held for review, oldest first, with
+// their screenings
+func listReviewsHandler(w http.ResponseWriter, r *http.Request) {
+    type review struct {
+        Order     Order          `json:"order"`
+        Screening FraudScreening `json:"screening"`
+    }
+
+    reviews := []review{}
+    forEachOrder(func(order Order) {
+        if order.Status != StatusOnHold {
+            return
+        }
+        screening, _ := fraudScreeningFor(order.OrderID)
+        reviews = append(reviews, review{Order: order, Screening: screening})
+    })
+    sort.Slice(reviews, func(i, j int) bool {
+        return reviews[i].Order.UpdatedAt < reviews[j].Order.UpdatedAt
+    })
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "reviews": reviews,
+        "total":   len(reviews),
+    })
+}
+
+// Admin endpoint to approve a held order: it becomes paid, and the
+// customer gets their confirmation
+func approveReviewHandler(w http.ResponseWriter, r *http.Request) {
+    orderID := resolveOrderID(mux.Vars(r)["orderId"])
+    decision, ok := decodeReviewDecision(w, r)
+    if !ok {
+        return
+    }
+
+    shard := shardFor(orderID)
+    shard.mu.Lock()
+    order, exists := shard.orders[orderID]
+    if !exists {
+        shard.mu.Unlock()
+        i18n.WriteError(w, r, http.StatusNotFound, "order.not_found")
+        return
+    }
+    if order.Status != StatusOnHold {
+        shard.mu.Unlock()
+        http.Error(w, "Order is not held for review", http.StatusConflict)
+        return
+    }
+
+    setStatus(&order, StatusPaid, returnActor, "")
+    putOrder(shard, order)
+    recordEffects(shard, order, orderEffects{
+        TraceID:       openmetrics.TraceID(r),
+        Events:        []string{EventOrderPaid},
+        Notifications: []string{"order_confirmation"},
+    })
+    shard.mu.Unlock()
+    decideReview(orderID, ReviewApproved, returnActor, decision.Note)
+    persistOrders()
+    adminauth.Audit(r, "approve_review", map[string]interface{}{"order_id": orderID})
+    recordFunnelEvent(order.CartID, FunnelOrderPaid, 0)
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(order)
+}
+
+// Admin endpoint to reject a held order. The checkout saga undoes it: the
+// stock it committed goes back, its payments are reversed and it is
+// cancelled. A step that fails is retried by the saga, so the order may
+// stay on hold for a while after this answers.
+func rejectReviewHandler(w http.ResponseWriter, r *http.Request) {
+    orderID := resolveOrderID(mux.Vars(r)["orderId"])
+    decision, ok := decodeReviewDecision(w, r)
+    if !ok {
+        return
+    }
+
+    order, exists := getOrder(orderID)
+    if !exists {
+        i18n.WriteError(w, r, http.StatusNotFound, "order.not_found")
+        return
+    }
+    if order.Status != StatusOnHold {
+        http.Error(w, "Order is not held for review", http.StatusConflict)
+        return
+    }
+    screening, _ := fraudScreeningFor(orderID)
+    decideReview(orderID, ReviewRejected, returnActor, decision.Note)
+    adminauth.Audit(r, "reject_review", map[string]interface{}{"order_id": orderID})
+
+    saga := beginCheckoutSaga(order, order.PaymentID)
+    sagaMu.Lock()
+    saga.Committed = screening.Committed
+    saveSaga(saga)
+    sagaMu.Unlock()
+    if err := compensateCheckout(saga, i18n.Message(i18n.DefaultLocale, "order.fraud_rejected")); err != nil {
+        log.Printf("Compensation for rejected order %s failed, will retry: %v", orderID, err)
+        order, _ = getOrder(orderID)
+        w.Header().Set("Content-Type", "application/json")
+        w.WriteHeader(http.StatusAccepted)
+        json.NewEncoder(w).Encode(order)
+        return
+    }
+
+    order, _ = getOrder(orderID)
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(order)
+}
+
+// Helper function to report fraud screening metrics
+func fraudMetrics() string {
+    return fmt.Sprintf(`
+# HELP order_service_fraud_screenings_total Orders sent to the fraud screening provider
+# TYPE order_service_fraud_screenings_total counter
+order_service_fraud_screenings_total %d
+
+# HELP order_service_fraud_denied_total Checkouts refused by fraud screening
+# TYPE order_service_fraud_denied_total counter
+order_service_fraud_denied_total %d
+
+# HELP order_service_fraud_held_total Orders fraud screening flagged for review
+# TYPE order_service_fraud_held_total counter
+order_service_fraud_held_total %d
+
+# HELP order_service_fraud_screening_errors_total Screenings the provider couldn't answer, held for review
+# TYPE order_service_fraud_screening_errors_total counter
+order_service_fraud_screening_errors_total %d
+`, fraudScreened.Load(), fraudDenied.Load(), fraudHeld.Load(), fraudErrors.Load())
+}
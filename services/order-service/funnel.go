@@ -0,0 +1,204 @@
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "net/http"
+    "sync"
+    "time"
+)
+
+// Funnel steps, in the order a cart is expected to move through them
+const (
+    FunnelCartCreated      = "cart_created"
+    FunnelItemAdded        = "item_added"
+    FunnelCheckoutStarted  = "checkout_started"
+    FunnelPaymentAttempted = "payment_attempted"
+    FunnelOrderPaid        = "order_paid"
+)
+
+var funnelSteps = []string{
+    FunnelCartCreated,
+    FunnelItemAdded,
+    FunnelCheckoutStarted,
+    FunnelPaymentAttempted,
+    FunnelOrderPaid,
+}
+
+// Journeys are dropped once their first event is older than this
+const FunnelRetention = 30 * 24 * time.Hour
+
+// FunnelEventRequest is posted by other services (e.g. cart-service)
+type FunnelEventRequest struct {
+    Event     string `json:"event"`
+    CartID    string `json:"cart_id"`
+    Timestamp int64  `json:"timestamp"`
+}
+
+// FunnelStep is one row of the funnel report
+type FunnelStep struct {
+    Step           string  `json:"step"`
+    Count          int     `json:"count"`
+    DropOffRate    float64 `json:"drop_off_rate"`
+    ConversionRate float64 `json:"conversion_rate"`
+}
+
+// funnelJourney records when a cart first reached each step
+type funnelJourney struct {
+    FirstSeen int64
+    Steps     map[string]int64
+}
+
+// Funnel journeys keyed by cart ID. Kept under their own lock so event
+// tracking never contends with order writes.
+var (
+    funnelJourneys = make(map[string]*funnelJourney)
+    funnelEvents   = make(map[string]int)
+    funnelMu       sync.Mutex
+)
+
+// Helper function to check an event name against the known steps
+func isFunnelStep(event string) bool {
+    for _, step := range funnelSteps {
+        if step == event {
+            return true
+        }
+    }
+    return false
+}
+
+// Helper function to record a funnel event; only the first occurrence of a
+// step per cart counts towards the funnel
+func recordFunnelEvent(cartID string, event string, timestamp int64) {
+    if cartID == "" {
+        return
+    }
+    if timestamp == 0 {
+        timestamp = time.Now().Unix()
+    }
+
+    funnelMu.Lock()
+    defer funnelMu.Unlock()
+
+    funnelEvents[event]++
+
+    journey, exists := funnelJourneys[cartID]
+    if !exists {
+        journey = &funnelJourney{FirstSeen: timestamp, Steps: make(map[string]int64)}
+        funnelJourneys[cartID] = journey
+    }
+    if timestamp < journey.FirstSeen {
+        journey.FirstSeen = timestamp
+    }
+    if first, seen := journey.Steps[event]; !seen || timestamp < first {
+        journey.Steps[event] = timestamp
+    }
+}
+
+// Ingest a funnel event from another service
+func trackFunnelEventHandler(w http.ResponseWriter, r *http.Request) {
+    var req FunnelEventRequest
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+        http.Error(w, "Invalid JSON", http.StatusBadRequest)
+        return
+    }
+
+    if req.CartID == "" || !isFunnelStep(req.Event) {
+        http.Error(w, "Cart ID and a valid funnel event required", http.StatusBadRequest)
+        return
+    }
+
+    recordFunnelEvent(req.CartID, req.Event, req.Timestamp)
+    w.WriteHeader(http.StatusAccepted)
+}
+
+// Funnel report: carts whose journey started within the window, counted at
+// each step they reached, with drop-off relative to the previous step
+func getFunnelHandler(w http.ResponseWriter, r *http.Request) {
+    query := r.URL.Query()
+
+    to, err := parseTimeParam(query.Get("to"), time.Now().UTC())
+    if err != nil {
+        http.Error(w, "Invalid 'to' timestamp", http.StatusBadRequest)
+        return
+    }
+    from, err := parseTimeParam(query.Get("from"), to.AddDate(0, 0, -7))
+    if err != nil {
+        http.Error(w, "Invalid 'from' timestamp", http.StatusBadRequest)
+        return
+    }
+    if !from.Before(to) {
+        http.Error(w, "'from' must be before 'to'", http.StatusBadRequest)
+        return
+    }
+
+    counts := make(map[string]int)
+    funnelMu.Lock()
+    for _, journey := range funnelJourneys {
+        if journey.FirstSeen < from.Unix() || journey.FirstSeen > to.Unix() {
+            continue
+        }
+        for step := range journey.Steps {
+            counts[step]++
+        }
+    }
+    funnelMu.Unlock()
+
+    steps := make([]FunnelStep, 0, len(funnelSteps))
+    for i, name := range funnelSteps {
+        step := FunnelStep{Step: name, Count: counts[name]}
+        if i > 0 && steps[i-1].Count > 0 {
+            step.DropOffRate = 1 - float64(step.Count)/float64(steps[i-1].Count)
+            if step.DropOffRate < 0 {
+                // Journeys can enter mid-funnel (e.g. events lost upstream)
+                step.DropOffRate = 0
+            }
+        }
+        if first := counts[funnelSteps[0]]; first > 0 {
+            step.ConversionRate = float64(step.Count) / float64(first)
+        }
+        steps = append(steps, step)
+    }
+
+    result := map[string]interface{}{
+        "from":  from.Unix(),
+        "to":    to.Unix(),
+        "steps": steps,
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(result)
+}
+
+// Drop funnel journeys past the retention window (runs every hour)
+func cleanupFunnelJourneys() {
+    ticker := time.NewTicker(time.Hour)
+    defer ticker.Stop()
+
+    for range ticker.C {
+        cutoff := time.Now().Add(-FunnelRetention).Unix()
+
+        funnelMu.Lock()
+        for cartID, journey := range funnelJourneys {
+            if journey.FirstSeen < cutoff {
+                delete(funnelJourneys, cartID)
+            }
+        }
+        funnelMu.Unlock()
+    }
+}
+
+// Helper function to report funnel metrics
+func funnelMetrics() string {
+    funnelMu.Lock()
+    defer funnelMu.Unlock()
+
+    metrics := `
+# HELP order_service_funnel_events_total Funnel events by step
+# TYPE order_service_funnel_events_total counter
+`
+    for _, step := range funnelSteps {
+        metrics += fmt.Sprintf("order_service_funnel_events_total{step=\"%s\"} %d\n", step, funnelEvents[step])
+    }
+    return metrics
+}
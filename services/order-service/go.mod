@@ -3,7 +3,29 @@ module order-service
 go 1.21
 
 require (
+    events v0.0.0-00010101000000-000000000000
     github.com/google/uuid v1.4.0
     github.com/gorilla/mux v1.8.1
-    github.com/rs/cors v1.10.1
-)
\ No newline at end of file
+    github.com/prometheus/client_golang v1.19.1
+    github.com/prometheus/client_model v0.5.0
+    github.com/prometheus/common v0.48.0
+    middleware v0.0.0-00010101000000-000000000000
+    money v0.0.0-00010101000000-000000000000
+    webhooks v0.0.0-00010101000000-000000000000
+)
+
+require (
+    github.com/beorn7/perks v1.0.1 // indirect
+    github.com/cespare/xxhash/v2 v2.2.0 // indirect
+    github.com/prometheus/procfs v0.12.0 // indirect
+    github.com/rs/cors v1.10.1 // indirect
+    golang.org/x/sys v0.17.0 // indirect
+    google.golang.org/protobuf v1.33.0 // indirect
+)
+
+replace (
+    events => ../../pkg/events
+    middleware => ../../pkg/middleware
+    money => ../../pkg/money
+    webhooks => ../../pkg/webhooks
+)
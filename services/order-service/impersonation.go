@@ -0,0 +1,174 @@
+package main
+
+import (
+    "crypto/hmac"
+    "crypto/sha256"
+    "encoding/base64"
+    "encoding/json"
+    "errors"
+    "net/http"
+    "os"
+    "strings"
+    "time"
+
+    "github.com/gorilla/mux"
+    "middleware"
+    "middleware/adminauth"
+)
+
+// ActingAsHeader names the customer a support agent is acting for. The
+// agent authenticates with their own user-service JWT, which must carry
+// one of impersonatorRoles.
+const ActingAsHeader = "X-Acting-As"
+
+// Roles allowed to act on a customer's behalf
+var impersonatorRoles = []string{"support", "admin"}
+
+// Verifies user-service JWTs. Impersonation is refused entirely unless it
+// is configured.
+var jwtSecret = os.Getenv("JWT_SECRET")
+
+// agentClaims are the user-service JWT claims impersonation relies on
+type agentClaims struct {
+    UserID    string   `json:"user_id"`
+    Email     string   `json:"email"`
+    Roles     []string `json:"roles"`
+    ExpiresAt int64    `json:"exp"`
+}
+
+// Helper function to verify an HS256 JWT issued by user-service and return
+// its claims
+func verifyAgentToken(token string, now time.Time) (agentClaims, error) {
+    return verifyToken(jwtSecret, token, now)
+}
+
+// Helper function to verify an HS256 JWT signed with secret and return its
+// claims
+func verifyToken(secret string, token string, now time.Time) (agentClaims, error) {
+    var claims agentClaims
+
+    parts := strings.Split(token, ".")
+    if len(parts) != 3 {
+        return claims, errors.New("malformed token")
+    }
+
+    var header struct {
+        Alg string `json:"alg"`
+    }
+    headerJSON, err := base64.RawURLEncoding.DecodeString(parts[0])
+    if err != nil || json.Unmarshal(headerJSON, &header) != nil || header.Alg != "HS256" {
+        return claims, errors.New("unsupported token")
+    }
+
+    mac := hmac.New(sha256.New, []byte(secret))
+    mac.Write([]byte(parts[0] + "." + parts[1]))
+    signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+    if err != nil || !hmac.Equal(signature, mac.Sum(nil)) {
+        return claims, errors.New("invalid signature")
+    }
+
+    payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+    if err != nil || json.Unmarshal(payload, &claims) != nil {
+        return claims, errors.New("malformed token")
+    }
+    if claims.ExpiresAt == 0 || now.Unix() >= claims.ExpiresAt {
+        return claims, errors.New("token expired")
+    }
+    if claims.UserID == "" {
+        return claims, errors.New("token has no user")
+    }
+    return claims, nil
+}
+
+// Helper function to check whether an agent may impersonate customers
+func canImpersonate(claims agentClaims) bool {
+    return hasRole(claims, impersonatorRoles)
+}
+
+// Impersonation middleware: requests carrying X-Acting-As must come from a
+// support agent's JWT and may only touch that customer's data. Every
+// impersonated request, allowed or not, is written to the audit log.
+// Requests without the header are unaffected.
+func actingAsMiddleware(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        actingAs := strings.TrimSpace(r.Header.Get(ActingAsHeader))
+        if actingAs == "" {
+            next.ServeHTTP(w, r)
+            return
+        }
+
+        deny := func(status int, reason string, agent agentClaims) {
+            adminauth.Audit(r, "impersonation_denied", map[string]interface{}{
+                "agent_id":  agent.UserID,
+                "acting_as": actingAs,
+                "reason":    reason,
+            })
+            http.Error(w, "Impersonation denied: "+reason, status)
+        }
+
+        if jwtSecret == "" {
+            deny(http.StatusForbidden, "JWT_SECRET not configured", agentClaims{})
+            return
+        }
+        agent, err := verifyAgentToken(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "), time.Now())
+        if err != nil {
+            deny(http.StatusUnauthorized, err.Error(), agent)
+            return
+        }
+        if !canImpersonate(agent) {
+            deny(http.StatusForbidden, "agent lacks a support role", agent)
+            return
+        }
+        if !ownedBy(r, actingAs) {
+            deny(http.StatusForbidden, "resource does not belong to "+actingAs, agent)
+            return
+        }
+
+        recorder := &middleware.StatusRecorder{ResponseWriter: w}
+        next.ServeHTTP(recorder, r)
+
+        if recorder.Status == 0 {
+            recorder.Status = http.StatusOK
+        }
+        adminauth.Audit(r, "impersonation", map[string]interface{}{
+            "agent_id":    agent.UserID,
+            "agent_email": agent.Email,
+            "acting_as":   actingAs,
+            "status":      recorder.Status,
+        })
+    })
+}
+
+// Helper function to check that an impersonated request only touches the
+// customer named in X-Acting-As: routes keyed by user must name them, and
+// routes keyed by order (hot or archived) must hit one of their orders.
+// Unknown orders pass so the handler reports them as not found.
+func ownedBy(r *http.Request, userID string) bool {
+    vars := mux.Vars(r)
+    if pathUser, exists := vars["userId"]; exists {
+        if legacyOrderLookup(r) {
+            if order, found := getOrder(resolveOrderID(pathUser)); found {
+                return order.UserID == userID
+            }
+        }
+        return pathUser == userID
+    }
+
+    idOrNumber, exists := vars["orderId"]
+    if !exists {
+        idOrNumber, exists = vars["orderNumber"]
+    }
+    if !exists {
+        return false
+    }
+    orderID := resolveOrderID(idOrNumber)
+    order, found := getOrder(orderID)
+    if !found {
+        archived, archivedFound, err := readArchivedOrder(orderID)
+        if err != nil {
+            return false
+        }
+        order, found = archived, archivedFound
+    }
+    return !found || order.UserID == userID
+}
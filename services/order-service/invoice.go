@@ -0,0 +1,397 @@
+package main
+
+import (
+    "bytes"
+    "encoding/json"
+    "fmt"
+    "html/template"
+    "log"
+    "net/http"
+    "os"
+    "strings"
+    "time"
+
+    "github.com/gorilla/mux"
+    "middleware/i18n"
+    "money"
+)
+
+// MerchantDetails identify the seller on invoices (MERCHANT_* settings)
+type MerchantDetails struct {
+    Name    string `json:"name"`
+    Address string `json:"address,omitempty"` // lines separated by "\n"
+    Email   string `json:"email,omitempty"`
+    TaxID   string `json:"tax_id,omitempty"`
+}
+
+// Invoice is the invoice for a paid order
+type Invoice struct {
+    InvoiceNumber string          `json:"invoice_number"`
+    IssuedAt      int64           `json:"issued_at"`
+    OrderID       string          `json:"order_id"`
+    OrderNumber   string          `json:"order_number,omitempty"`
+    CustomerID    string          `json:"customer_id"`
+    BillTo        *Address        `json:"bill_to,omitempty"` // the billing address, or else the shipping address
+    Merchant      MerchantDetails `json:"merchant"`
+    Currency      string          `json:"currency"`
+    Lines         []InvoiceLine   `json:"lines"`
+    SubtotalCents int             `json:"subtotal_cents"`
+    CouponCode    string          `json:"coupon_code,omitempty"`
+    DiscountCents int             `json:"discount_cents,omitempty"`
+    TaxCents      int             `json:"tax_cents"`
+    TotalCents    int             `json:"total_cents"`
+    RefundedCents int             `json:"refunded_cents,omitempty"`
+}
+
+// InvoiceLine is one line item of an invoice
+type InvoiceLine struct {
+    ProductID      string `json:"product_id"`
+    Quantity       int    `json:"qty"`
+    UnitPriceCents int    `json:"unit_price_cents"`
+    AmountCents    int    `json:"amount_cents"`
+}
+
+// Invoice settings. Invoice numbers (PREFIX-YYYY-NNNNNN) come from their
+// own yearly sequence, so they run without gaps whatever the order
+// numbering does.
+var (
+    invoicePrefix = "INV"
+    merchant      = MerchantDetails{Name: "E-Commerce Store"}
+)
+
+func init() {
+    if prefix := strings.ToUpper(strings.TrimSpace(os.Getenv("INVOICE_NUMBER_PREFIX"))); prefix != "" {
+        invoicePrefix = prefix
+    }
+    if name := os.Getenv("MERCHANT_NAME"); name != "" {
+        merchant.Name = name
+    }
+    merchant.Address = strings.ReplaceAll(os.Getenv("MERCHANT_ADDRESS"), `\n`, "\n")
+    merchant.Email = os.Getenv("MERCHANT_EMAIL")
+    merchant.TaxID = os.Getenv("MERCHANT_TAX_ID")
+}
+
+// Helper function to issue the next invoice number. The sequence is kept
+// with the order number sequences (and so in the snapshot) under a key of
+// its own. Callers must hold the order's shard lock, so the number and the
+// order carrying it are saved together.
+func nextInvoiceNumber(issuedAt int64) string {
+    scope := fmt.Sprintf("%s-%d", invoicePrefix, time.Unix(issuedAt, 0).UTC().Year())
+
+    numberMu.Lock()
+    defer numberMu.Unlock()
+    numberSequences["invoice:"+scope]++
+    snapshotDirty.Store(true)
+    return fmt.Sprintf("%s-%06d", scope, numberSequences["invoice:"+scope])
+}
+
+// Helper function to give an order its invoice number, once. Only orders
+// whose payment completed are invoiced. Returns the order as stored.
+func invoiceOrder(orderID string) (Order, bool, error) {
+    shard := shardFor(orderID)
+    shard.mu.Lock()
+    order, exists := shard.orders[orderID]
+    if !exists {
+        shard.mu.Unlock()
+        return order, false, nil
+    }
+    if order.InvoiceNumber != "" {
+        shard.mu.Unlock()
+        return order, true, nil
+    }
+    if !paymentCompleted(order.Status) {
+        shard.mu.Unlock()
+        return order, true, i18n.NewError("order.invoice_not_available", order.Status)
+    }
+
+    order.InvoicedAt = time.Now().Unix()
+    order.InvoiceNumber = nextInvoiceNumber(order.InvoicedAt)
+    putOrder(shard, order)
+    shard.mu.Unlock()
+    persistOrders()
+
+    log.Printf("Issued invoice %s for order %s", order.InvoiceNumber, orderID)
+    return order, true, nil
+}
+
+// Helper function to build the invoice for an invoiced order
+func buildInvoice(order Order) Invoice {
+    invoice := Invoice{
+        InvoiceNumber: order.InvoiceNumber,
+        IssuedAt:      order.InvoicedAt,
+        OrderID:       order.OrderID,
+        OrderNumber:   order.OrderNumber,
+        CustomerID:    order.UserID,
+        BillTo:        order.BillingAddress,
+        Merchant:      merchant,
+        Currency:      order.Currency,
+        Lines:         []InvoiceLine{},
+        CouponCode:    order.CouponCode,
+        DiscountCents: order.DiscountCents,
+        TaxCents:      order.TaxCents,
+        TotalCents:    order.TotalCents,
+        RefundedCents: order.RefundedCents,
+    }
+    if invoice.BillTo == nil {
+        invoice.BillTo = order.ShippingAddress
+    }
+    for _, item := range order.Items {
+        invoice.Lines = append(invoice.Lines, InvoiceLine{
+            ProductID:      item.ProductID,
+            Quantity:       item.Quantity,
+            UnitPriceCents: item.PriceCents,
+            AmountCents:    item.PriceCents * item.Quantity,
+        })
+        invoice.SubtotalCents += item.PriceCents * item.Quantity
+    }
+    return invoice
+}
+
+// invoiceHTML lays out an invoice as a printable page
+var invoiceHTML = template.Must(template.New("invoice").Funcs(template.FuncMap{
+    "amount": func(cents int, currency string) string { return money.FormatAmount(cents, currency) + " " + currency },
+    "date":   func(unix int64) string { return time.Unix(unix, 0).UTC().Format("2006-01-02") },
+    "lines":  func(text string) []string { return strings.Split(text, "\n") },
+}).Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>Invoice {{.InvoiceNumber}}</title>
+<style>
+body { font-family: Helvetica, Arial, sans-serif; color: #222; max-width: 800px; margin: 40px auto; }
+table { width: 100%; border-collapse: collapse; margin-top: 24px; }
+th, td { padding: 6px 8px; border-bottom: 1px solid #ddd; text-align: left; }
+td.num, th.num { text-align: right; }
+tfoot td { border-bottom: none; }
+.muted { color: #666; }
+</style>
+</head>
+<body>
+<h1>Invoice {{.InvoiceNumber}}</h1>
+<p>
+<strong>{{.Merchant.Name}}</strong><br>
+{{range lines .Merchant.Address}}{{.}}<br>{{end}}
+{{with .Merchant.Email}}{{.}}<br>{{end}}
+{{with .Merchant.TaxID}}Tax ID: {{.}}<br>{{end}}
+</p>
+<p>
+Invoice date: {{date .IssuedAt}}<br>
+Order: {{if .OrderNumber}}{{.OrderNumber}}{{else}}{{.OrderID}}{{end}}<br>
+Customer: {{.CustomerID}}
+</p>
+{{with .BillTo}}<p>
+Bill to:<br>
+{{range .Lines}}{{.}}<br>{{end}}
+</p>{{end}}
+<table>
+<thead><tr><th>Product</th><th class="num">Qty</th><th class="num">Unit price</th><th class="num">Amount</th></tr></thead>
+<tbody>
+{{range .Lines}}<tr><td>{{.ProductID}}</td><td class="num">{{.Quantity}}</td><td class="num">{{amount .UnitPriceCents $.Currency}}</td><td class="num">{{amount .AmountCents $.Currency}}</td></tr>
+{{end}}</tbody>
+<tfoot>
+<tr><td colspan="3" class="num">Subtotal</td><td class="num">{{amount .SubtotalCents .Currency}}</td></tr>
+{{if .DiscountCents}}<tr><td colspan="3" class="num">Discount ({{.CouponCode}})</td><td class="num">-{{amount .DiscountCents .Currency}}</td></tr>{{end}}
+<tr><td colspan="3" class="num">Tax</td><td class="num">{{amount .TaxCents .Currency}}</td></tr>
+<tr><td colspan="3" class="num"><strong>Total</strong></td><td class="num"><strong>{{amount .TotalCents .Currency}}</strong></td></tr>
+{{if .RefundedCents}}<tr><td colspan="3" class="num muted">Refunded</td><td class="num muted">-{{amount .RefundedCents .Currency}}</td></tr>{{end}}
+</tfoot>
+</table>
+</body>
+</html>
+`))
+
+// Helper function to lay out an invoice as lines of fixed-width text for
+// the PDF rendering
+func invoiceTextLines(invoice Invoice) []string {
+    formatCents := func(cents int) string { return money.FormatAmount(cents, invoice.Currency) + " " + invoice.Currency }
+    row := func(product string, qty string, unit string, amount string) string {
+        return fmt.Sprintf("%-34.34s %5s %17s %17s", product, qty, unit, amount)
+    }
+
+    lines := []string{invoice.Merchant.Name}
+    for _, line := range strings.Split(invoice.Merchant.Address, "\n") {
+        if line != "" {
+            lines = append(lines, line)
+        }
+    }
+    if invoice.Merchant.Email != "" {
+        lines = append(lines, invoice.Merchant.Email)
+    }
+    if invoice.Merchant.TaxID != "" {
+        lines = append(lines, "Tax ID: "+invoice.Merchant.TaxID)
+    }
+
+    order := invoice.OrderNumber
+    if order == "" {
+        order = invoice.OrderID
+    }
+    lines = append(lines, "",
+        "Invoice date: "+time.Unix(invoice.IssuedAt, 0).UTC().Format("2006-01-02"),
+        "Order: "+order,
+        "Customer: "+invoice.CustomerID,
+    )
+    if invoice.BillTo != nil {
+        lines = append(lines, "", "Bill to:")
+        lines = append(lines, invoice.BillTo.Lines()...)
+    }
+    lines = append(lines,
+        "",
+        row("Product", "Qty", "Unit price", "Amount"),
+        strings.Repeat("-", 76),
+    )
+    for _, line := range invoice.Lines {
+        lines = append(lines, row(line.ProductID, fmt.Sprint(line.Quantity), formatCents(line.UnitPriceCents), formatCents(line.AmountCents)))
+    }
+    lines = append(lines,
+        strings.Repeat("-", 76),
+        row("", "", "Subtotal", formatCents(invoice.SubtotalCents)),
+    )
+    if invoice.DiscountCents > 0 {
+        lines = append(lines, row("", "", "Discount", "-"+formatCents(invoice.DiscountCents)))
+    }
+    lines = append(lines,
+        row("", "", "Tax", formatCents(invoice.TaxCents)),
+        row("", "", "Total", formatCents(invoice.TotalCents)),
+    )
+    if invoice.RefundedCents > 0 {
+        lines = append(lines, row("", "", "Refunded", "-"+formatCents(invoice.RefundedCents)))
+    }
+    return lines
+}
+
+// Helper function to escape text for a PDF string literal. The standard
+// fonts are set up with WinAnsiEncoding, so Latin-1 passes through and
+// anything else becomes "?".
+func pdfEscape(text string) string {
+    var escaped strings.Builder
+    for _, r := range text {
+        switch {
+        case r == '(' || r == ')' || r == '\\':
+            escaped.WriteByte('\\')
+            escaped.WriteRune(r)
+        case r < 32 || r > 255:
+            escaped.WriteByte('?')
+        default:
+            escaped.WriteByte(byte(r))
+        }
+    }
+    return escaped.String()
+}
+
+// Helper function to render a title and lines of text as a PDF: A4 pages
+// in 10pt Courier, so the fixed-width columns line up
+func renderPDF(title string, lines []string) []byte {
+    const linesPerPage = 60
+
+    var pages [][]string
+    for start := 0; start < len(lines) || start == 0; start += linesPerPage {
+        pages = append(pages, lines[start:min(start+linesPerPage, len(lines))])
+    }
+
+    // Objects: 1 catalog, 2 page tree, 3 and 4 fonts, then a page and its
+    // content stream per page
+    var objects []string
+    kids := make([]string, len(pages))
+    for i := range pages {
+        kids[i] = fmt.Sprintf("%d 0 R", 5+2*i)
+    }
+    objects = append(objects,
+        "<< /Type /Catalog /Pages 2 0 R >>",
+        fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(pages)),
+        "<< /Type /Font /Subtype /Type1 /BaseFont /Courier /Encoding /WinAnsiEncoding >>",
+        "<< /Type /Font /Subtype /Type1 /BaseFont /Courier-Bold /Encoding /WinAnsiEncoding >>",
+    )
+    for i, page := range pages {
+        var content bytes.Buffer
+        content.WriteString("BT\n")
+        if i == 0 {
+            fmt.Fprintf(&content, "/F2 16 Tf 50 790 Td (%s) Tj\n/F1 10 Tf 0 -28 Td 12 TL\n", pdfEscape(title))
+        } else {
+            content.WriteString("/F1 10 Tf 50 790 Td 12 TL\n")
+        }
+        for _, line := range page {
+            fmt.Fprintf(&content, "(%s) Tj T*\n", pdfEscape(line))
+        }
+        content.WriteString("ET\n")
+
+        objects = append(objects,
+            fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 595 842] /Resources << /Font << /F1 3 0 R /F2 4 0 R >> >> /Contents %d 0 R >>", 6+2*i),
+            fmt.Sprintf("<< /Length %d >>\nstream\n%sendstream", content.Len(), content.String()),
+        )
+    }
+
+    var pdf bytes.Buffer
+    pdf.WriteString("%PDF-1.4\n")
+    offsets := make([]int, len(objects))
+    for i, object := range objects {
+        offsets[i] = pdf.Len()
+        fmt.Fprintf(&pdf, "%d 0 obj\n%s\nendobj\n", i+1, object)
+    }
+    xref := pdf.Len()
+    fmt.Fprintf(&pdf, "xref\n0 %d\n0000000000 65535 f \n", len(objects)+1)
+    for _, offset := range offsets {
+        fmt.Fprintf(&pdf, "%010d 00000 n \n", offset)
+    }
+    fmt.Fprintf(&pdf, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(objects)+1, xref)
+    return pdf.Bytes()
+}
+
+// Get an order's invoice as HTML (the default), PDF (?format=pdf) or JSON
+// (?format=json). The first request for a paid order issues its invoice
+// number; later ones show the same invoice.
+func getInvoiceHandler(w http.ResponseWriter, r *http.Request) {
+    orderID := resolveOrderID(mux.Vars(r)["orderId"])
+
+    format := r.URL.Query().Get("format")
+    if format == "" {
+        format = "html"
+    }
+    if format != "html" && format != "pdf" && format != "json" {
+        http.Error(w, "format must be 'html', 'pdf' or 'json'", http.StatusBadRequest)
+        return
+    }
+
+    order, exists, err := invoiceOrder(orderID)
+    if !exists {
+        // Archived orders keep the invoice they were given, but can't be
+        // given one any more
+        archived, found, readErr := readArchivedOrder(orderID)
+        if readErr != nil {
+            log.Printf("Failed to read archived order %s: %v", orderID, readErr)
+            http.Error(w, "Failed to read order archive", http.StatusInternalServerError)
+            return
+        }
+        if !found {
+            i18n.WriteError(w, r, http.StatusNotFound, "order.not_found")
+            return
+        }
+        order = archived
+        if order.InvoiceNumber == "" {
+            err = i18n.NewError("order.invoice_not_available", order.Status)
+        }
+    }
+    if err != nil {
+        i18n.WriteMessageError(w, r, http.StatusConflict, err, "order.invoice_not_available")
+        return
+    }
+
+    invoice := buildInvoice(order)
+    switch format {
+    case "json":
+        w.Header().Set("Content-Type", "application/json")
+        json.NewEncoder(w).Encode(invoice)
+    case "pdf":
+        w.Header().Set("Content-Type", "application/pdf")
+        w.Header().Set("Content-Disposition", fmt.Sprintf("inline; filename=%q", invoice.InvoiceNumber+".pdf"))
+        w.Write(renderPDF("Invoice "+invoice.InvoiceNumber, invoiceTextLines(invoice)))
+    default:
+        var page bytes.Buffer
+        if err := invoiceHTML.Execute(&page, invoice); err != nil {
+            log.Printf("Failed to render invoice %s: %v", invoice.InvoiceNumber, err)
+            http.Error(w, "Failed to render invoice", http.StatusInternalServerError)
+            return
+        }
+        w.Header().Set("Content-Type", "text/html; charset=utf-8")
+        w.Write(page.Bytes())
+    }
+}
@@ -1,57 +1,187 @@
 package main
 
 import (
-    "bytes"
     "encoding/json"
+    "errors"
     "fmt"
+    "io"
     "log"
     "net/http"
-    "os"
+    "strconv"
+    "strings"
     "sync"
     "time"
 
     "github.com/google/uuid"
     "github.com/gorilla/mux"
-    "github.com/rs/cors"
+    "middleware/accesslog"
+    "middleware/adminauth"
+    "middleware/corspolicy"
+    "middleware/httpserver"
+    "middleware/i18n"
+    "middleware/loadshed"
+    "middleware/openmetrics"
+    "middleware/readiness"
+    "middleware/slo"
+    "middleware/versioning"
+    "money"
 )
 
 // OrderItem represents an item in an order
 type OrderItem struct {
-    ProductID  string `json:"product_id"`
-    Quantity   int    `json:"qty"`
-    PriceCents int    `json:"price_cents"`
+    ProductID     string `json:"product_id"`
+    Quantity      int    `json:"qty"`
+    PriceCents    int    `json:"price_cents"`
+    RefundedQty   int    `json:"refunded_qty,omitempty"`   // units refunded so far; see refunds.go
+    TaxCents      int    `json:"tax_cents,omitempty"`      // the line's share of the order's tax; see tax.go
+    DiscountCents int    `json:"discount_cents,omitempty"` // the line's share of the coupon discount; see coupons.go
+}
+
+// LineTotal returns the item's unit price times quantity in the order's currency
+func (i OrderItem) LineTotal(currency string) (money.Money, error) {
+    return money.New(i.PriceCents, currency).Multiply(i.Quantity)
 }
 
 // Order represents a customer order
 type Order struct {
     OrderID     string      `json:"order_id"`
+    OrderNumber string      `json:"order_number,omitempty"` // e.g. ORD-2024-000123; see numbering.go
     UserID      string      `json:"user_id"`
     Items       []OrderItem `json:"items"`
-    TotalCents  int         `json:"total_cents"`
-    Status      string      `json:"status"` // created, paid, shipped, cancelled
+    TotalCents  int         `json:"total_cents"` // the amount charged, tax included
+    Currency    string      `json:"currency"`
+    Status      string      `json:"status"` // see order_status.go
     PaymentID   string      `json:"payment_id"`
+    CartID      string      `json:"cart_id,omitempty"`
     CreatedAt   int64       `json:"created_at"`
     UpdatedAt   int64       `json:"updated_at"`
+
+    // Items before any discount and tax, the coupon discount (see
+    // coupons.go), the tax charged on what is left (worked out at checkout
+    // for the shipping address; see tax.go) and what that comes to, which
+    // total_cents repeats for older clients
+    SubtotalCents   int              `json:"subtotal_cents"`
+    CouponCode      string           `json:"coupon_code,omitempty"`
+    DiscountCents   int              `json:"discount_cents,omitempty"`
+    TaxCents        int              `json:"tax_cents"`
+    TaxRatePPM      int              `json:"tax_rate_ppm,omitempty"` // parts per million
+    TaxRegion       string           `json:"tax_region,omitempty"`
+    GrandTotalCents int              `json:"grand_total_cents"`
+    ShippingAddress *Address         `json:"shipping_address,omitempty"` // see address.go
+    BillingAddress  *Address         `json:"billing_address,omitempty"`
+
+    // The shipping method chosen at checkout, the priority it gives the
+    // order (see priority.go) and when the order should arrive by it (see
+    // delivery.go)
+    ShippingMethod    string          `json:"shipping_method,omitempty"`
+    Priority          string          `json:"priority,omitempty"`
+    EstimatedDelivery *DeliveryWindow `json:"estimated_delivery,omitempty"`
+
+    // Set when SETTLEMENT_CURRENCY is: the currency the books are kept in,
+    // the rate the order was converted at (settlement units per unit of
+    // its currency) and its total and refunds so far in that currency;
+    // see exchange.go
+    SettlementCurrency      string `json:"settlement_currency,omitempty"`
+    FXRate                  string `json:"fx_rate,omitempty"`
+    SettlementTotalCents    int    `json:"settlement_total_cents,omitempty"`
+    SettlementRefundedCents int    `json:"settlement_refunded_cents,omitempty"`
+
+    // Who or what made the last status change (a user, an agent or a
+    // system:* step) and why; see setStatus
+    StatusActor  string `json:"status_actor,omitempty"`
+    StatusReason string `json:"status_reason,omitempty"`
+
+    // Every status the order has had, oldest first; see setStatus
+    StatusHistory []StatusChange `json:"status_history,omitempty"`
+
+    // Set by asynchronous checkouts (see checkout.go): the authentication
+    // step a pending payment waits on
+    PaymentAction *PaymentAction `json:"payment_action,omitempty"`
+
+    // Set for orders paid with more than one payment method: each payment
+    // and what it covered, in the order they were charged; see
+    // split_payments.go
+    Payments []OrderPayment `json:"payments,omitempty"`
+
+    // Refunds so far, full or by line item (see refunds.go), and returns
+    // requested by the customer (see returns.go)
+    RefundedCents int           `json:"refunded_cents,omitempty"`
+    Refunds       []OrderRefund `json:"refunds,omitempty"`
+    Returns       []OrderReturn `json:"returns,omitempty"`
+
+    // Parcels the items went out in; see shipments.go
+    Shipments []OrderShipment `json:"shipments,omitempty"`
+
+    // Set when the order's invoice is first requested; see invoice.go
+    InvoiceNumber string `json:"invoice_number,omitempty"`
+    InvoicedAt    int64  `json:"invoiced_at,omitempty"`
+
+    // Channel, campaign, ERP reference and the like; see metadata.go
+    Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+// Total returns the order total as Money
+func (o Order) Total() money.Money {
+    return money.New(o.TotalCents, o.Currency)
 }
 
-// CreateOrderRequest for creating new orders
+// CreateOrderRequest for creating new orders. CartSnapshot is the token
+// from cart-service's checkout call; the order is built from it, and
+// cart_id and currency come from it when omitted. Payments splits the
+// order over several payment methods instead of PaymentMethod.
 type CreateOrderRequest struct {
-    CartID        string `json:"cart_id"`
-    PaymentMethod string `json:"payment_method"`
+    CartID          string              `json:"cart_id"`
+    CartSnapshot    string              `json:"cart_snapshot"`
+    PaymentMethod   string              `json:"payment_method"`
+    Payments        []PaymentInstrument `json:"payments"`
+    Currency        string              `json:"currency"` // ISO 4217, defaults to USD
+    ShippingAddress *Address            `json:"shipping_address"`
+    BillingAddress  *Address            `json:"billing_address"`
+    ShippingMethod  string              `json:"shipping_method"` // see delivery.go; defaults to standard
+    CouponCode      string              `json:"coupon_code"`
+    ConfirmedPrices map[string]int      `json:"confirmed_prices"` // product ID -> price, after a price change (see pricing.go)
+    Metadata        map[string]string   `json:"metadata"` // see metadata.go
 }
 
-// PaymentRequest for payment service
+// PaymentRequest for payment service. SplitIndex numbers the payments of
+// a split order, so payment-service takes one charge for each.
 type PaymentRequest struct {
     Amount        int    `json:"amount"`
     Currency      string `json:"currency"`
     PaymentMethod string `json:"payment_method"`
     OrderID       string `json:"order_id"`
+    SplitIndex    int    `json:"split_index,omitempty"`
+}
+
+// Money returns the amount to charge as Money
+func (r PaymentRequest) Money() money.Money {
+    return money.New(r.Amount, r.Currency)
 }
 
 // PaymentResponse from payment service
 type PaymentResponse struct {
-    Success   bool   `json:"success"`
+    Success      bool                   `json:"success"`
+    PaymentID    string                 `json:"payment_id"`
+    Status       string                 `json:"status"`
+    Message      string                 `json:"message"`
+    ClientSecret string                 `json:"client_secret,omitempty"`
+    NextAction   map[string]interface{} `json:"next_action,omitempty"`
+}
+
+// PaymentAction is the customer authentication (3-D Secure) an
+// asynchronous checkout's payment is waiting on
+type PaymentAction struct {
+    PaymentID    string                 `json:"payment_id"`
+    Status       string                 `json:"status"`
+    ClientSecret string                 `json:"client_secret,omitempty"`
+    NextAction   map[string]interface{} `json:"next_action,omitempty"`
+}
+
+// PaymentCallbackRequest is sent by the payment service when an
+// authentication challenge (3-D Secure) completes
+type PaymentCallbackRequest struct {
     PaymentID string `json:"payment_id"`
+    Status    string `json:"status"`
     Message   string `json:"message"`
 }
 
@@ -63,35 +193,31 @@ type NotificationRequest struct {
     Data      map[string]interface{} `json:"data"`
 }
 
-// In-memory order store
+// In-memory order index by user; orders themselves live in orderShards
 var (
-    orders   = make(map[string]Order)
     userOrders = make(map[string][]string) // userID -> orderIDs
-    mu       sync.RWMutex
+    userMu     sync.RWMutex
 )
 
-// Environment variables
-var (
-    paymentServiceURL      = os.Getenv("PAYMENT_SERVICE_URL")
-    inventoryServiceURL    = os.Getenv("INVENTORY_SERVICE_URL")
-    notificationServiceURL = os.Getenv("NOTIFICATION_SERVICE_URL")
-)
-
-func init() {
-    if paymentServiceURL == "" {
-        paymentServiceURL = "http://payment-service:3002"
-    }
-    if inventoryServiceURL == "" {
-        inventoryServiceURL = "http://inventory-service:8004"
-    }
-    if notificationServiceURL == "" {
-        notificationServiceURL = "http://notification-service:8006"
+// Helper function to sum order line totals in one currency
+func orderTotal(items []OrderItem, currency string) (money.Money, error) {
+    total := money.New(0, currency)
+    for _, item := range items {
+        line, err := item.LineTotal(currency)
+        if err != nil {
+            return money.Money{}, err
+        }
+        if total, err = total.Add(line); err != nil {
+            return money.Money{}, err
+        }
     }
+    return total, nil
 }
 
-// Helper function to process payment
-func processPayment(orderID string, amount int, currency string, paymentMethod string) (*PaymentResponse, error) {
-    if paymentServiceURL == "" {
+// Helper function to process payment. part is the payment's place in a
+// split order, 0 for the first (or only) one.
+func processPayment(orderID string, part int, amount money.Money, paymentMethod string) (*PaymentResponse, error) {
+    if config().PaymentServiceURL == "" {
         return &PaymentResponse{
             Success:   true,
             PaymentID: "mock_payment_" + uuid.New().String()[:8],
@@ -100,10 +226,11 @@ func processPayment(orderID string, amount int, currency string, paymentMethod s
     }
 
     reqData := PaymentRequest{
-        Amount:        amount,
-        Currency:      currency,
+        Amount:        amount.Amount,
+        Currency:      amount.Currency,
         PaymentMethod: paymentMethod,
         OrderID:       orderID,
+        SplitIndex:    part,
     }
 
     jsonData, err := json.Marshal(reqData)
@@ -111,17 +238,23 @@ func processPayment(orderID string, amount int, currency string, paymentMethod s
         return nil, err
     }
 
-    resp, err := http.Post(
-        paymentServiceURL+"/api/payments/process",
-        "application/json",
-        bytes.NewBuffer(jsonData),
-    )
+    start := time.Now()
+    resp, err := paymentClient.Post(config().PaymentServiceURL+"/api/payments/process", "application/json", jsonData)
+    observePaymentLatency(time.Since(start))
     if err != nil {
         log.Printf("Failed to call payment service: %v", err)
         return nil, err
     }
     defer resp.Body.Close()
 
+    // The order is already charged: a retry whose first attempt landed
+    // but lost its response. Answer with that charge.
+    if resp.StatusCode == http.StatusConflict {
+        if payment, err := orderPayment(orderID, part); err != nil || payment != nil {
+            return payment, err
+        }
+    }
+
     var paymentResp PaymentResponse
     if err := json.NewDecoder(resp.Body).Decode(&paymentResp); err != nil {
         return nil, err
@@ -130,90 +263,91 @@ func processPayment(orderID string, amount int, currency string, paymentMethod s
     return &paymentResp, nil
 }
 
-// Helper function to commit inventory reservations
-func commitInventoryReservations(cartID string) error {
-    if inventoryServiceURL == "" {
-        return nil
-    }
-
-    // Get cart reservations
-    resp, err := http.Get(fmt.Sprintf("%s/api/inventory/cart/%s/reservations", inventoryServiceURL, cartID))
+// Helper function to find the charge already settled for a payment of an
+// order, as payment-service's 409 for a second charge counts it: succeeded
+// or authorized for capture. Returns nil if there is none.
+func orderPayment(orderID string, part int) (*PaymentResponse, error) {
+    resp, err := paymentClient.Get(fmt.Sprintf("%s/api/payments/orders/%s", config().PaymentServiceURL, orderID))
     if err != nil {
-        return err
+        return nil, err
     }
     defer resp.Body.Close()
-
-    var reservationsResp struct {
-        Reservations []struct {
-            ReservationID string `json:"reservation_id"`
-        } `json:"reservations"`
+    if resp.StatusCode >= 300 {
+        return nil, fmt.Errorf("payment service returned status %d", resp.StatusCode)
     }
 
-    if err := json.NewDecoder(resp.Body).Decode(&reservationsResp); err != nil {
-        return err
+    var paymentsResp struct {
+        Payments []struct {
+            PaymentID  string `json:"payment_id"`
+            Status     string `json:"status"`
+            SplitIndex int    `json:"split_index"`
+        } `json:"payments"`
     }
-
-    // Commit each reservation
-    for _, reservation := range reservationsResp.Reservations {
-        commitURL := fmt.Sprintf("%s/api/inventory/commit/%s", inventoryServiceURL, reservation.ReservationID)
-        req, _ := http.NewRequest("POST", commitURL, nil)
-        
-        client := &http.Client{Timeout: 10 * time.Second}
-        _, err := client.Do(req)
-        if err != nil {
-            log.Printf("Failed to commit reservation %s: %v", reservation.ReservationID, err)
-            return err
+    if err := json.NewDecoder(resp.Body).Decode(&paymentsResp); err != nil {
+        return nil, err
+    }
+    for _, payment := range paymentsResp.Payments {
+        if payment.SplitIndex == part && (payment.Status == "succeeded" || payment.Status == "requires_capture") {
+            return &PaymentResponse{Success: true, PaymentID: payment.PaymentID, Status: payment.Status}, nil
         }
     }
-
-    return nil
+    return nil, nil
 }
 
-// Helper function to send notification
-func sendNotification(orderID string, userEmail string, template string) {
-    if notificationServiceURL == "" {
-        return
+// Helper function to commit a cart's inventory reservations to an order.
+// Inventory commits them all in one call or none at all, and the call is
+// idempotent for the order, so inventoryClient retries timeouts and 5xx
+// responses; a commit that landed before the timeout reports the same
+// reservations again. Inventory records the order so refunds can release
+// its stock. onCommit is called with each reservation committed.
+func commitInventoryReservations(cartID string, orderID string, onCommit func(reservation committedReservation)) error {
+    if config().InventoryServiceURL == "" {
+        return nil
     }
 
-    notificationReq := NotificationRequest{
-        Type:      "email",
-        Recipient: userEmail,
-        Template:  template,
-        Data: map[string]interface{}{
-            "order_id": orderID,
-            "timestamp": time.Now().Format(time.RFC3339),
-        },
+    body, err := json.Marshal(map[string]string{"order_id": orderID})
+    if err != nil {
+        return err
     }
-
-    jsonData, err := json.Marshal(notificationReq)
+    resp, err := inventoryClient.Post(
+        fmt.Sprintf("%s/api/inventory/cart/%s/commit", config().InventoryServiceURL, cartID),
+        "application/json",
+        body,
+    )
     if err != nil {
-        log.Printf("Failed to marshal notification request: %v", err)
-        return
+        return err
     }
+    defer resp.Body.Close()
 
-    go func() {
-        _, err := http.Post(
-            notificationServiceURL+"/api/notifications/send",
-            "application/json",
-            bytes.NewBuffer(jsonData),
-        )
-        if err != nil {
-            log.Printf("Failed to send notification: %v", err)
-        }
-    }()
+    // Nothing was committed, e.g. the reservations changed mid-commit
+    if resp.StatusCode >= 300 {
+        return fmt.Errorf("inventory service returned status %d", resp.StatusCode)
+    }
+
+    var commitResp struct {
+        Reservations []committedReservation `json:"reservations"`
+    }
+    if err := json.NewDecoder(resp.Body).Decode(&commitResp); err != nil {
+        return err
+    }
+    for _, reservation := range commitResp.Reservations {
+        onCommit(reservation)
+    }
+
+    return nil
 }
 
 // Health check endpoint
 func healthHandler(w http.ResponseWriter, r *http.Request) {
-    mu.RLock()
-    orderCount := len(orders)
-    mu.RUnlock()
+    orderCount := countOrders()
 
     health := map[string]interface{}{
-        "status":      "healthy",
-        "service":     "order-service",
-        "timestamp":   time.Now().Unix(),
-        "order_count": orderCount,
+        "status":               "healthy",
+        "service":              "order-service",
+        "timestamp":            time.Now().Unix(),
+        "order_count":          orderCount,
+        "archived_order_count": countArchivedOrders(),
+        "schema":               schemaStatus(),
     }
 
     w.Header().Set("Content-Type", "application/json")
@@ -227,162 +361,601 @@ func createOrderHandler(w http.ResponseWriter, r *http.Request) {
 
     var req CreateOrderRequest
     if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-        http.Error(w, "Invalid JSON", http.StatusBadRequest)
+        i18n.WriteError(w, r, http.StatusBadRequest, "request.invalid_json")
+        return
+    }
+
+    var snapshot CartSnapshot
+    if req.CartSnapshot != "" {
+        decoded, err := decodeCartSnapshot(req.CartSnapshot, time.Now())
+        if err != nil {
+            i18n.WriteMessageError(w, r, http.StatusBadRequest, err, "order.cart_snapshot_invalid")
+            return
+        }
+        if decoded.UserID != userID || (req.CartID != "" && req.CartID != decoded.CartID) ||
+            (req.Currency != "" && !strings.EqualFold(req.Currency, decoded.Currency)) {
+            i18n.WriteError(w, r, http.StatusBadRequest, "order.cart_snapshot_mismatch")
+            return
+        }
+        snapshot = decoded
+        req.CartID = snapshot.CartID
+        req.Currency = snapshot.Currency
+    }
+
+    if req.CartID == "" || (req.PaymentMethod == "" && len(req.Payments) == 0) {
+        i18n.WriteError(w, r, http.StatusBadRequest, "order.cart_and_payment_required")
+        return
+    }
+    currency, err := money.NormalizeCurrency(req.Currency)
+    if err != nil {
+        i18n.WriteError(w, r, http.StatusBadRequest, "currency.unsupported", req.Currency)
+        return
+    }
+    if req.ShippingAddress != nil {
+        if err := normalizeAddress(req.ShippingAddress, "shipping_address"); err != nil {
+            i18n.WriteMessageError(w, r, http.StatusBadRequest, err, "order.address_field_required")
+            return
+        }
+    }
+    if req.BillingAddress != nil {
+        if err := normalizeAddress(req.BillingAddress, "billing_address"); err != nil {
+            i18n.WriteMessageError(w, r, http.StatusBadRequest, err, "order.address_field_required")
+            return
+        }
+    }
+    if req.ShippingMethod, err = normalizeShippingMethod(req.ShippingMethod); err != nil {
+        i18n.WriteMessageError(w, r, http.StatusBadRequest, err, "order.shipping_method_invalid")
+        return
+    }
+    if req.Metadata, err = normalizeMetadata(req.Metadata); err != nil {
+        i18n.WriteMessageError(w, r, http.StatusBadRequest, err, "order.metadata_key_invalid")
         return
     }
 
-    if req.CartID == "" || req.PaymentMethod == "" {
-        http.Error(w, "Cart ID and payment method required", http.StatusBadRequest)
+    // Without a snapshot, fall back to simulated cart data (MVP clients
+    // that only send cart_id)
+    items := []OrderItem{
+        {ProductID: "sku-12345678", Quantity: 2, PriceCents: 15999},
+        {ProductID: "sku-23456789", Quantity: 1, PriceCents: 24999},
+    }
+    if snapshot.SnapshotID != "" {
+        items = snapshot.Items
+    }
+    total, err := orderTotal(items, currency)
+    if err != nil {
+        i18n.WriteError(w, r, http.StatusBadRequest, "order.invalid_total")
+        return
+    }
+    if snapshot.SnapshotID != "" && total.Amount != snapshot.SubtotalCents {
+        i18n.WriteError(w, r, http.StatusBadRequest, "order.cart_snapshot_subtotal")
         return
     }
 
-    // For MVP, we'll simulate cart data since we don't have direct cart access
-    // In production, this would fetch from cart service
+    // Check the cart's prices against product-service's current ones
+    if config().ProductServiceURL != "" {
+        prices, changes, err := priceChanges(items, currency)
+        if err != nil {
+            var messageErr *i18n.MessageError
+            if errors.As(err, &messageErr) {
+                i18n.WriteMessageError(w, r, http.StatusConflict, err, "order.prices_unavailable")
+                return
+            }
+            log.Printf("Failed to check prices for cart %s: %v", req.CartID, err)
+            i18n.WriteError(w, r, http.StatusBadGateway, "order.prices_unavailable")
+            return
+        }
+        if len(changes) > 0 {
+            if config().PriceChangePolicy != PriceChangeConfirm || !pricesConfirmed(changes, req.ConfirmedPrices) {
+                writePriceChanged(w, r, changes)
+                return
+            }
+            items = repriceItems(items, prices)
+            if total, err = orderTotal(items, currency); err != nil {
+                i18n.WriteError(w, r, http.StatusBadRequest, "order.invalid_total")
+                return
+            }
+        }
+    }
+
+    now := time.Now().Unix()
     order := Order{
-        OrderID:   uuid.New().String(),
-        UserID:    userID,
-        Items: []OrderItem{
-            {ProductID: "sku-12345678", Quantity: 2, PriceCents: 15999},
-            {ProductID: "sku-23456789", Quantity: 1, PriceCents: 24999},
-        },
-        TotalCents: 56997,
-        Status:     "created",
-        CreatedAt:  time.Now().Unix(),
-        UpdatedAt:  time.Now().Unix(),
-    }
-
-    // Process payment
-    paymentResp, err := processPayment(order.OrderID, order.TotalCents, "USD", req.PaymentMethod)
+        OrderID:         uuid.New().String(),
+        UserID:          userID,
+        CartID:          req.CartID,
+        Items:           items,
+        Currency:        total.Currency,
+        ShippingAddress: req.ShippingAddress,
+        BillingAddress:  req.BillingAddress,
+        ShippingMethod:  req.ShippingMethod,
+        Priority:        shippingPriority(req.ShippingMethod),
+        Metadata:        req.Metadata,
+        Status:          StatusCreated,
+        StatusActor:     requestActor(r),
+        StatusHistory:   []StatusChange{{To: StatusCreated, Actor: requestActor(r), At: now}},
+        CreatedAt:       now,
+        UpdatedAt:       now,
+    }
+    order.EstimatedDelivery = estimateDelivery(order.ShippingMethod, order.ShippingAddress, now)
+    if req.CouponCode = strings.TrimSpace(req.CouponCode); req.CouponCode != "" {
+        coupon, err := lookupCoupon(req.CouponCode, userID, total)
+        if err != nil {
+            log.Printf("Failed to look up coupon %q for cart %s: %v", req.CouponCode, req.CartID, err)
+            i18n.WriteError(w, r, http.StatusBadGateway, "order.coupon_unavailable")
+            return
+        }
+        if coupon == nil {
+            i18n.WriteError(w, r, http.StatusBadRequest, "order.coupon_invalid", req.CouponCode)
+            return
+        }
+        if err := applyDiscount(&order, total, *coupon); err != nil {
+            i18n.WriteMessageError(w, r, http.StatusBadRequest, err, "order.invalid_total")
+            return
+        }
+    }
+    if err := applyTax(&order, total); err != nil {
+        log.Printf("Failed to work out tax for cart %s: %v", req.CartID, err)
+        i18n.WriteError(w, r, http.StatusBadGateway, "order.tax_unavailable")
+        return
+    }
+    if settlement := config().SettlementCurrency; settlement != "" {
+        rate, err := settlementRate(order.Currency, settlement)
+        if err != nil {
+            log.Printf("Failed to get a %s/%s exchange rate for cart %s: %v", order.Currency, settlement, req.CartID, err)
+            i18n.WriteError(w, r, http.StatusBadGateway, "order.exchange_rate_unavailable")
+            return
+        }
+        if rate == "" {
+            i18n.WriteError(w, r, http.StatusBadRequest, "currency.not_settleable", order.Currency)
+            return
+        }
+        if err := applySettlement(&order, settlement, rate); err != nil {
+            i18n.WriteError(w, r, http.StatusBadRequest, "order.invalid_total")
+            return
+        }
+    }
+    if rule, err := config().OrderRules.check(order); err != nil {
+        log.Printf("Order rule %q refused cart %s: %v", rule.Name, req.CartID, err)
+        i18n.WriteMessageError(w, r, http.StatusBadRequest, err, "order.rule_violated")
+        return
+    }
+    plan, err := planPayments(req, order.Total())
     if err != nil {
-        http.Error(w, "Payment processing failed", http.StatusInternalServerError)
+        i18n.WriteMessageError(w, r, http.StatusBadRequest, err, "order.payments_invalid")
+        return
+    }
+    finishDuplicateCheck, ok := checkDuplicateOrder(w, r, order)
+    if !ok {
+        return
+    }
+    defer finishDuplicateCheck()
+    if snapshot.SnapshotID != "" && !claimCartSnapshot(snapshot, time.Now()) {
+        i18n.WriteError(w, r, http.StatusConflict, "order.cart_snapshot_already_used")
         return
     }
 
-    if !paymentResp.Success {
-        http.Error(w, paymentResp.Message, http.StatusBadRequest)
+    recordFunnelEvent(req.CartID, FunnelCheckoutStarted, 0)
+    rememberRecipient(r, userID)
+    order.OrderNumber = nextOrderNumber(order)
+
+    if wantsAsyncCheckout(r) {
+        acceptCheckout(w, r, order, plan, snapshot.SnapshotID)
+        return
+    }
+
+    // Screen the order before any payment is taken; see fraud.go
+    screening := screenOrder(order, clientIP(r))
+    if screening.Outcome == FraudDeny {
+        if snapshot.SnapshotID != "" {
+            releaseCartSnapshot(snapshot.SnapshotID)
+        }
+        i18n.WriteError(w, r, http.StatusForbidden, "order.fraud_declined")
+        return
+    }
+
+    // Process payment. The saga records each step, so a failure after the
+    // payment is taken (or a crash) refunds it; see saga.go.
+    saga := beginCheckoutSaga(order, "")
+    recordFunnelEvent(req.CartID, FunnelPaymentAttempted, 0)
+    taken, paymentResp, err := chargePayments(order, plan)
+    if err != nil {
+        if snapshot.SnapshotID != "" {
+            releaseCartSnapshot(snapshot.SnapshotID)
+        }
+        // The charge may have gone through before the call failed
+        go func() {
+            if err := compensateCheckout(saga, i18n.Message(i18n.DefaultLocale, "order.payment_failed")); err != nil {
+                log.Printf("Compensation for order %s failed, will retry: %v", order.OrderID, err)
+            }
+        }()
+        // Nothing was sent; tell the customer to try again once the
+        // breaker probes the payment service
+        if isCircuitOpen(err) {
+            w.Header().Set("Retry-After", strconv.Itoa(config().BreakerOpenSeconds))
+            i18n.WriteError(w, r, http.StatusServiceUnavailable, "order.payment_unavailable")
+            return
+        }
+        i18n.WriteError(w, r, http.StatusInternalServerError, "order.payment_failed")
+        return
+    }
+
+    // The customer must complete a 3-D Secure challenge; hold the order until
+    // the payment service calls back with the outcome
+    if paymentResp.Status == "requires_action" {
+        recordPayments(&order, taken)
+        setStatus(&order, StatusPendingPayment, ActorCheckout, "")
+        keepFraudScreening(screening)
+        storeOrder(order, orderEffects{TraceID: openmetrics.TraceID(r), Events: []string{EventOrderCreated}})
+        persistOrders()
+        finishCheckoutSaga(saga) // the callback takes over from here
+
+        result := map[string]interface{}{
+            "order": order,
+            "payment": map[string]interface{}{
+                "payment_id":    paymentResp.PaymentID,
+                "status":        paymentResp.Status,
+                "client_secret": paymentResp.ClientSecret,
+                "next_action":   paymentResp.NextAction,
+            },
+        }
+
+        w.Header().Set("Content-Type", "application/json")
+        w.WriteHeader(http.StatusAccepted)
+        json.NewEncoder(w).Encode(result)
         return
     }
 
-    order.PaymentID = paymentResp.PaymentID
-    order.Status = "paid"
-    order.UpdatedAt = time.Now().Unix()
+    if !paymentResp.Success {
+        if len(taken) > 0 {
+            // A later part of a split payment was declined; the parts
+            // already taken go back. payment-service won't take a part
+            // twice, so the order can't be retried; check out again.
+            if err := compensateCheckout(saga, paymentResp.Message); err != nil {
+                log.Printf("Compensation for order %s failed, will retry: %v", order.OrderID, err)
+            }
+            writePaymentDeclined(w, r, paymentResp.Message, nil)
+            return
+        }
+        // Nothing was taken: keep the order, and its cart's reservations,
+        // for the customer to retry with another payment method
+        finishCheckoutSaga(saga)
+        setStatus(&order, StatusPaymentFailed, ActorCheckout, paymentResp.Message)
+        storeOrder(order, orderEffects{TraceID: openmetrics.TraceID(r), Events: []string{EventOrderCreated}})
+        persistOrders()
+        writePaymentDeclined(w, r, paymentResp.Message, &order)
+        return
+    }
+    recordPayments(&order, taken)
+    saga.paymentTaken(order.PaymentID)
 
-    // Commit inventory reservations
-    if err := commitInventoryReservations(req.CartID); err != nil {
+    // Commit inventory reservations; without the stock the order can't be
+    // fulfilled, so the payment is refunded and the order cancelled
+    if err := commitCheckoutInventory(saga); err != nil {
         log.Printf("Failed to commit inventory for order %s: %v", order.OrderID, err)
-        // Continue with order creation but log the error
+        reason := i18n.Message(i18n.DefaultLocale, "order.inventory_unavailable")
+        if err := compensateCheckout(saga, reason); err != nil {
+            log.Printf("Compensation for order %s failed, will retry: %v", order.OrderID, err)
+        }
+        if snapshot.SnapshotID != "" {
+            releaseCartSnapshot(snapshot.SnapshotID)
+        }
+
+        setStatus(&order, StatusCancelled, ActorSaga, reason)
+        storeOrder(order, orderEffects{
+            TraceID: openmetrics.TraceID(r),
+            Events:  []string{EventOrderCreated, EventOrderCancelled},
+        })
+        persistOrders()
+        i18n.WriteError(w, r, http.StatusConflict, "order.inventory_unavailable")
+        return
     }
 
-    // Store order
-    mu.Lock()
-    orders[order.OrderID] = order
-    if userOrders[userID] == nil {
-        userOrders[userID] = []string{}
+    // Flagged for review: the payment stays taken, but the order waits on
+    // hold for a decision instead of being confirmed
+    if screening.Outcome == FraudReview {
+        screening.Committed = saga.Committed
+        keepFraudScreening(screening)
+        setStatus(&order, StatusOnHold, ActorCheckout, i18n.Message(i18n.DefaultLocale, "order.held_for_review"))
+        storeOrder(order, orderEffects{TraceID: openmetrics.TraceID(r), Events: []string{EventOrderCreated}})
+        persistOrders()
+        finishCheckoutSaga(saga)
+
+        w.Header().Set("Content-Type", "application/json")
+        w.WriteHeader(http.StatusCreated)
+        json.NewEncoder(w).Encode(order)
+        return
     }
-    userOrders[userID] = append(userOrders[userID], order.OrderID)
-    mu.Unlock()
 
-    // Send notification (async)
-    go sendNotification(order.OrderID, "user@example.com", "order_confirmation")
+    setStatus(&order, StatusPaid, ActorCheckout, "")
+    storeOrder(order, orderEffects{
+        TraceID:       openmetrics.TraceID(r),
+        Events:        []string{EventOrderCreated, EventOrderPaid},
+        Notifications: []string{"order_confirmation"},
+    })
+    persistOrders()
+    finishCheckoutSaga(saga)
+    recordFunnelEvent(order.CartID, FunnelOrderPaid, 0)
 
     w.Header().Set("Content-Type", "application/json")
     w.WriteHeader(http.StatusCreated)
     json.NewEncoder(w).Encode(order)
 }
 
-// Get order by ID
-func getOrderHandler(w http.ResponseWriter, r *http.Request) {
+// Payment callback for orders waiting on customer authentication
+func paymentCallbackHandler(w http.ResponseWriter, r *http.Request) {
     vars := mux.Vars(r)
-    orderID := vars["orderId"]
+    orderID := resolveOrderID(vars["orderId"])
 
-    mu.RLock()
-    order, exists := orders[orderID]
-    mu.RUnlock()
+    body, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+    if err != nil {
+        http.Error(w, "Failed to read body", http.StatusBadRequest)
+        return
+    }
+    // Only the payment service may settle orders, so without the secret
+    // to check that no callback is taken
+    if paymentCallbackSecret == "" {
+        log.Printf("Refused payment callback for order %s: PAYMENT_CALLBACK_SECRET not configured", orderID)
+        http.Error(w, "Payment callbacks are not configured", http.StatusServiceUnavailable)
+        return
+    }
+    if err := verifySignature(paymentCallbackSecret, r.Header.Get(SignatureHeader), body, time.Now()); err != nil {
+        log.Printf("Rejected payment callback for order %s: %v", orderID, err)
+        http.Error(w, "Invalid signature", http.StatusUnauthorized)
+        return
+    }
+
+    var req PaymentCallbackRequest
+    if err := json.Unmarshal(body, &req); err != nil {
+        http.Error(w, "Invalid JSON", http.StatusBadRequest)
+        return
+    }
 
+    shard := shardFor(orderID)
+    shard.mu.Lock()
+    order, exists := shard.orders[orderID]
     if !exists {
+        shard.mu.Unlock()
         http.Error(w, "Order not found", http.StatusNotFound)
         return
     }
 
+    if !hasPayment(order, req.PaymentID) {
+        shard.mu.Unlock()
+        http.Error(w, "Payment does not belong to this order", http.StatusBadRequest)
+        return
+    }
+
+    if order.Status != StatusPendingPayment {
+        // Already resolved; callbacks may be delivered more than once. A
+        // payment that completes after its order was cancelled (it expired
+        // waiting, see expiry.go) goes back to the customer.
+        shard.mu.Unlock()
+        if order.Status == StatusCancelled && (req.Status == "succeeded" || req.Status == "requires_capture") {
+            go func() {
+                if err := reverseOrderPayments(orderID); err != nil {
+                    log.Printf("Failed to reverse late payment %s of cancelled order %s: %v", req.PaymentID, orderID, err)
+                }
+            }()
+        }
+        w.Header().Set("Content-Type", "application/json")
+        json.NewEncoder(w).Encode(order)
+        return
+    }
+
+    var status string
+    switch req.Status {
+    case "succeeded", "requires_capture":
+        status = StatusPaid
+    case "failed":
+        // Split orders are cancelled: their earlier parts go back below
+        status = StatusPaymentFailed
+        if len(order.Payments) > 1 {
+            status = StatusCancelled
+        }
+    default:
+        shard.mu.Unlock()
+        http.Error(w, "Unsupported payment status", http.StatusBadRequest)
+        return
+    }
+    shard.mu.Unlock()
+    recordPaymentAttempt(orderID, PaymentAttempt{PaymentID: req.PaymentID, Status: req.Status, Message: req.Message, Callback: true})
+
+    // Commit inventory before settling the order, as a synchronous checkout
+    // does; if that fails the saga refunds the payment and cancels the order
+    var saga *checkoutSaga
+    if status == StatusPaid {
+        saga = beginCheckoutSaga(order, req.PaymentID)
+        if err := commitCheckoutInventory(saga); err != nil {
+            log.Printf("Failed to commit inventory for order %s: %v", order.OrderID, err)
+            if err := compensateCheckout(saga, i18n.Message(i18n.DefaultLocale, "order.inventory_unavailable")); err != nil {
+                log.Printf("Compensation for order %s failed, will retry: %v", order.OrderID, err)
+            }
+            order, _ = getOrder(orderID)
+            w.Header().Set("Content-Type", "application/json")
+            json.NewEncoder(w).Encode(order)
+            return
+        }
+    }
+
+    shard.mu.Lock()
+    order = shard.orders[orderID]
+    if order.Status != StatusPendingPayment {
+        // Settled while the inventory was committed: by a concurrent
+        // callback, or cancelled, in which case the payment goes back
+        shard.mu.Unlock()
+        if saga != nil {
+            if paymentCompleted(order.Status) {
+                finishCheckoutSaga(saga)
+            } else if err := compensateCheckout(saga, "Order was cancelled while its payment completed"); err != nil {
+                log.Printf("Compensation for order %s failed, will retry: %v", order.OrderID, err)
+            }
+        }
+        w.Header().Set("Content-Type", "application/json")
+        json.NewEncoder(w).Encode(order)
+        return
+    }
+    reason := ""
+    if status == StatusCancelled || status == StatusPaymentFailed {
+        reason = req.Message
+    }
+    // Flagged for review at checkout: held instead of confirmed
+    if status == StatusPaid && awaitingReview(orderID) {
+        status = StatusOnHold
+        reason = i18n.Message(i18n.DefaultLocale, "order.held_for_review")
+        holdReservations(orderID, saga.Committed)
+    }
+    setStatus(&order, status, ActorPaymentCallback, reason)
+    order.PaymentAction = nil
+    putOrder(shard, order)
+    effects := orderEffects{
+        TraceID: openmetrics.TraceID(r),
+        Events:  []string{eventForStatus(order.Status)},
+    }
+    switch order.Status {
+    case StatusPaid:
+        effects.Notifications = []string{"order_confirmation"}
+    case StatusCancelled:
+        effects.Notifications = []string{"order_cancelled"}
+    }
+    recordEffects(shard, order, effects)
+    shard.mu.Unlock()
+    persistOrders()
+    if saga != nil {
+        finishCheckoutSaga(saga)
+    }
+
+    if order.Status == StatusPaid {
+        recordFunnelEvent(order.CartID, FunnelOrderPaid, 0)
+    } else if order.Status == StatusPaymentFailed {
+        log.Printf("Payment authentication failed for order %s, waiting for a retry: %s", order.OrderID, req.Message)
+    } else if order.Status == StatusCancelled {
+        log.Printf("Payment authentication failed for order %s: %s", order.OrderID, req.Message)
+        // The earlier parts of a split payment were taken; give them back
+        if len(order.Payments) > 1 {
+            saga := beginCheckoutSaga(order, "")
+            go func() {
+                if err := compensateCheckout(saga, reason); err != nil {
+                    log.Printf("Compensation for order %s failed, will retry: %v", order.OrderID, err)
+                }
+            }()
+        }
+    }
+
     w.Header().Set("Content-Type", "application/json")
     json.NewEncoder(w).Encode(order)
 }
 
-// Get orders for user
+// Helper function to save an order, record its side effects and index it
+// by user
+func storeOrder(order Order, effects orderEffects) {
+    shard := shardFor(order.OrderID)
+    shard.mu.Lock()
+    putOrder(shard, order)
+    recordEffects(shard, order, effects)
+    shard.mu.Unlock()
+
+    userMu.Lock()
+    defer userMu.Unlock()
+
+    if userOrders[order.UserID] == nil {
+        userOrders[order.UserID] = []string{}
+    }
+    userOrders[order.UserID] = append(userOrders[order.UserID], order.OrderID)
+}
+
+// Get order by ID
+func getOrderHandler(w http.ResponseWriter, r *http.Request) {
+    vars := mux.Vars(r)
+    orderID := resolveOrderID(vars["orderId"])
+
+    order, exists := getOrder(orderID)
+
+    if !exists {
+        i18n.WriteError(w, r, http.StatusNotFound, "order.not_found")
+        return
+    }
+
+    writeOrder(w, r, order)
+}
+
+// Get a user's orders, newest first by default. Takes the admin listing's
+// filters (?status= and the rest; see parseOrderFilter) and paging (see
+// parseOrderPaging).
 func getUserOrdersHandler(w http.ResponseWriter, r *http.Request) {
     vars := mux.Vars(r)
     userID := vars["userId"]
 
-    mu.RLock()
-    orderIDs, exists := userOrders[userID]
-    if !exists {
-        mu.RUnlock()
-        result := map[string]interface{}{
-            "orders": []Order{},
-            "total":  0,
-        }
-        w.Header().Set("Content-Type", "application/json")
-        json.NewEncoder(w).Encode(result)
+    filter, err := parseOrderFilter(r)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+    filter.UserID = userID
+    paging, err := parseOrderPaging(r)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
         return
     }
 
-    var userOrderList []Order
+    userMu.RLock()
+    orderIDs := userOrders[userID]
+    userMu.RUnlock()
+
+    userOrderList := []Order{}
     for _, orderID := range orderIDs {
-        if order, exists := orders[orderID]; exists {
+        if order, exists := getOrder(orderID); exists && filter.matches(order) {
             userOrderList = append(userOrderList, order)
         }
     }
-    mu.RUnlock()
-
-    result := map[string]interface{}{
-        "orders": userOrderList,
-        "total":  len(userOrderList),
-    }
 
     w.Header().Set("Content-Type", "application/json")
-    json.NewEncoder(w).Encode(result)
+    json.NewEncoder(w).Encode(paging.page(userOrderList))
 }
 
 // Update order status
 func updateOrderStatusHandler(w http.ResponseWriter, r *http.Request) {
     vars := mux.Vars(r)
-    orderID := vars["orderId"]
+    orderID := resolveOrderID(vars["orderId"])
 
     var req struct {
         Status string `json:"status"`
+        Reason string `json:"reason"`
     }
 
     if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-        http.Error(w, "Invalid JSON", http.StatusBadRequest)
+        i18n.WriteError(w, r, http.StatusBadRequest, "request.invalid_json")
         return
     }
 
-    validStatuses := map[string]bool{
-        "created": true, "paid": true, "shipped": true, "cancelled": true,
-    }
-
-    if !validStatuses[req.Status] {
-        http.Error(w, "Invalid status", http.StatusBadRequest)
+    // Only fulfillment moves are made by hand; see manualStatuses
+    if !manualStatuses[req.Status] {
+        i18n.WriteError(w, r, http.StatusBadRequest, "order.invalid_status")
         return
     }
 
-    mu.Lock()
-    order, exists := orders[orderID]
+    shard := shardFor(orderID)
+    shard.mu.Lock()
+    order, exists := shard.orders[orderID]
     if !exists {
-        mu.Unlock()
-        http.Error(w, "Order not found", http.StatusNotFound)
+        shard.mu.Unlock()
+        i18n.WriteError(w, r, http.StatusNotFound, "order.not_found")
         return
     }
 
-    order.Status = req.Status
-    order.UpdatedAt = time.Now().Unix()
-    orders[orderID] = order
-    mu.Unlock()
+    if !canTransition(order.Status, req.Status) {
+        shard.mu.Unlock()
+        i18n.WriteError(w, r, http.StatusConflict, "order.invalid_transition", order.Status, req.Status)
+        return
+    }
 
-    // Send status update notification
-    if req.Status == "shipped" {
-        go sendNotification(order.OrderID, "user@example.com", "order_shipped")
+    setStatus(&order, req.Status, requestActor(r), req.Reason)
+    putOrder(shard, order)
+    effects := orderEffects{TraceID: openmetrics.TraceID(r), Events: []string{eventForStatus(order.Status)}}
+    if req.Status == StatusShipped {
+        effects.Notifications = []string{"order_shipped"}
     }
+    recordEffects(shard, order, effects)
+    shard.mu.Unlock()
+    persistOrders()
 
     w.Header().Set("Content-Type", "application/json")
     json.NewEncoder(w).Encode(order)
@@ -391,43 +964,147 @@ func updateOrderStatusHandler(w http.ResponseWriter, r *http.Request) {
 // Cancel order
 func cancelOrderHandler(w http.ResponseWriter, r *http.Request) {
     vars := mux.Vars(r)
-    orderID := vars["orderId"]
+    orderID := resolveOrderID(vars["orderId"])
 
-    mu.Lock()
-    order, exists := orders[orderID]
+    shard := shardFor(orderID)
+    shard.mu.Lock()
+    order, exists := shard.orders[orderID]
     if !exists {
-        mu.Unlock()
-        http.Error(w, "Order not found", http.StatusNotFound)
+        shard.mu.Unlock()
+        i18n.WriteError(w, r, http.StatusNotFound, "order.not_found")
         return
     }
 
-    if order.Status == "shipped" {
-        mu.Unlock()
-        http.Error(w, "Cannot cancel shipped order", http.StatusBadRequest)
+    if order.Status == StatusShipped || order.Status == StatusPartiallyShipped {
+        shard.mu.Unlock()
+        i18n.WriteError(w, r, http.StatusBadRequest, "order.cannot_cancel_shipped")
+        return
+    }
+    // The payment may already be under way
+    if checkoutInProgress(order.Status) {
+        shard.mu.Unlock()
+        w.Header().Set("Retry-After", "1")
+        i18n.WriteError(w, r, http.StatusConflict, "order.checkout_in_progress")
+        return
+    }
+    // Its payment was taken; only a review decides what happens to it
+    if order.Status == StatusOnHold {
+        shard.mu.Unlock()
+        i18n.WriteError(w, r, http.StatusConflict, "order.held_for_review")
+        return
+    }
+    // Cancelling wouldn't return the money or the stock; a refund does
+    if order.Status == StatusPaid {
+        shard.mu.Unlock()
+        i18n.WriteError(w, r, http.StatusConflict, "order.paid_use_refund")
+        return
+    }
+    if !canTransition(order.Status, StatusCancelled) {
+        shard.mu.Unlock()
+        i18n.WriteError(w, r, http.StatusConflict, "order.invalid_transition", order.Status, StatusCancelled)
         return
     }
 
-    order.Status = "cancelled"
-    order.UpdatedAt = time.Now().Unix()
-    orders[orderID] = order
-    mu.Unlock()
-
-    // Send cancellation notification
-    go sendNotification(order.OrderID, "user@example.com", "order_cancelled")
+    setStatus(&order, StatusCancelled, requestActor(r), "")
+    putOrder(shard, order)
+    recordEffects(shard, order, orderEffects{
+        TraceID:       openmetrics.TraceID(r),
+        Events:        []string{EventOrderCancelled},
+        Notifications: []string{"order_cancelled"},
+    })
+    shard.mu.Unlock()
+    persistOrders()
 
     w.Header().Set("Content-Type", "application/json")
     json.NewEncoder(w).Encode(order)
 }
 
+// Helper function to remove orders placed by test users
+func clearTestOrders() int {
+    userMu.Lock()
+
+    cleared := 0
+    for userID, orderIDs := range userOrders {
+        if !strings.HasPrefix(userID, adminauth.TestDataPrefix) {
+            continue
+        }
+        for _, orderID := range orderIDs {
+            shard := shardFor(orderID)
+            shard.mu.Lock()
+            deleteOrder(shard, orderID)
+            shard.mu.Unlock()
+            cleared++
+        }
+        dropOrderNotes(orderIDs...)
+        dropFraudScreenings(orderIDs...)
+        dropOrderActivity(orderIDs...)
+        delete(userOrders, userID)
+    }
+    userMu.Unlock()
+
+    // Archived test orders go too, so fixture runs start from a clean history
+    removed, err := compactArchive(func(order Order) bool {
+        return !strings.HasPrefix(order.UserID, adminauth.TestDataPrefix)
+    })
+    if err != nil {
+        log.Printf("Failed to remove test orders from the archive: %v", err)
+    }
+    return cleared + removed
+}
+
 // Admin endpoint to clear all orders
 func clearOrdersHandler(w http.ResponseWriter, r *http.Request) {
-    mu.Lock()
-    orders = make(map[string]Order)
-    userOrders = make(map[string][]string)
-    mu.Unlock()
+    scope, ok := adminauth.ConfirmClear(w, r)
+    if !ok {
+        return
+    }
+
+    cleared := 0
+    if scope == "test" {
+        cleared = clearTestOrders()
+    } else {
+        cleared = countOrders()
+        resetOrderShards()
+
+        numberMu.Lock()
+        numberIndex = make(map[string]string)
+        numberMu.Unlock()
+
+        userMu.Lock()
+        userOrders = make(map[string][]string)
+        userMu.Unlock()
+
+        dropOrderNotes()
+        dropFraudScreenings()
+        dropOrderActivity()
 
-    result := map[string]string{
-        "message": "All orders cleared",
+        revenueMu.Lock()
+        revenueByHour = make(map[int64]*revenueBucket)
+        revenueMu.Unlock()
+
+        funnelMu.Lock()
+        funnelJourneys = make(map[string]*funnelJourney)
+        funnelEvents = make(map[string]int)
+        funnelMu.Unlock()
+
+        removed, err := compactArchive(func(order Order) bool { return false })
+        if err != nil {
+            log.Printf("Failed to clear the order archive: %v", err)
+            http.Error(w, "Failed to clear the order archive", http.StatusInternalServerError)
+            return
+        }
+        cleared += removed
+    }
+
+    snapshotDirty.Store(true)
+    persistOrders()
+
+    adminauth.Audit(r, "clear", map[string]interface{}{"scope": scope, "cleared": cleared})
+
+    result := map[string]interface{}{
+        "message": "Orders cleared",
+        "scope":   scope,
+        "cleared": cleared,
     }
 
     w.Header().Set("Content-Type", "application/json")
@@ -436,109 +1113,164 @@ func clearOrdersHandler(w http.ResponseWriter, r *http.Request) {
 
 // Get order analytics
 func getAnalyticsHandler(w http.ResponseWriter, r *http.Request) {
-    mu.RLock()
-    defer mu.RUnlock()
-
+    orderCount := 0
     statusCounts := make(map[string]int)
     totalRevenue := 0
     
-    for _, order := range orders {
+    forEachOrder(func(order Order) {
+        orderCount++
         statusCounts[order.Status]++
-        if order.Status == "paid" || order.Status == "shipped" {
-            totalRevenue += order.TotalCents
+        if countsAsRevenue(order) {
+            totalRevenue += netRevenueCents(order)
         }
-    }
+    })
 
     analytics := map[string]interface{}{
-        "total_orders":    len(orders),
+        "total_orders":    orderCount,
         "total_revenue":   totalRevenue,
         "status_breakdown": statusCounts,
         "average_order_value": 0,
     }
 
-    if len(orders) > 0 {
-        analytics["average_order_value"] = totalRevenue / len(orders)
+    if orderCount > 0 {
+        analytics["average_order_value"] = totalRevenue / orderCount
     }
 
-    w.Header().Set("Content-Type", "application/json")
-    json.NewEncoder(w).Encode(analytics)
-}
-
-// Metrics endpoint
-func metricsHandler(w http.ResponseWriter, r *http.Request) {
-    mu.RLock()
-    defer mu.RUnlock()
-
-    orderCount := len(orders)
-    statusCounts := make(map[string]int)
-    totalRevenue := 0
-
-    for _, order := range orders {
-        statusCounts[order.Status]++
-        if order.Status == "paid" || order.Status == "shipped" {
-            totalRevenue += order.TotalCents
+    // Asked for a time range: its revenue, order count and average order
+    // value per bucket too (see analytics.go)
+    query := r.URL.Query()
+    if query.Has("granularity") || query.Has("from") || query.Has("to") {
+        granularity, from, to, err := parseSeriesParams(query)
+        if err != nil {
+            http.Error(w, err.Error(), http.StatusBadRequest)
+            return
         }
+        points, err := revenueSeries(granularity, from, to)
+        if err != nil {
+            http.Error(w, err.Error(), http.StatusBadRequest)
+            return
+        }
+        analytics["granularity"] = granularity
+        analytics["from"] = from.Unix()
+        analytics["to"] = to.Unix()
+        analytics["buckets"] = points
+        analytics["range_totals"] = seriesTotals(points)
     }
 
-    metrics := fmt.Sprintf(`
-# HELP order_service_orders_total Total number of orders
-# TYPE order_service_orders_total counter
-order_service_orders_total %d
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(analytics)
+}
 
-# HELP order_service_revenue_total Total revenue in cents
-# TYPE order_service_revenue_total counter
-order_service_revenue_total %d
+// Helper function to build the service's router. Routes are matched in
+// registration order; see routes.go.
+func newRouter() *mux.Router {
+    router := mux.NewRouter()
+    router.Use(observeLatency)
+
+    // API routes, served under /api/v1/orders and the legacy /api/orders
+    api := router.PathPrefix("/api").Subrouter()
+    api.Use(actingAsMiddleware)
+    versioning.Mount(api, "/orders", map[string]func(*mux.Router){
+        "v1": orderRoutesV1,
+    }, orderAuthMiddleware)
+    // Admin API, served under /api/v1/admin/orders
+    versioning.Mount(api, "/admin/orders", map[string]func(*mux.Router){
+        "v1": adminOrderRoutesV1,
+    }, adminAuthMiddleware)
 
-# HELP order_service_orders_by_status Orders by status
-# TYPE order_service_orders_by_status counter
-order_service_orders_by_status{status="created"} %d
-order_service_orders_by_status{status="paid"} %d
-order_service_orders_by_status{status="shipped"} %d
-order_service_orders_by_status{status="cancelled"} %d
-`, orderCount, totalRevenue, 
-   statusCounts["created"], statusCounts["paid"], 
-   statusCounts["shipped"], statusCounts["cancelled"])
+    // Admin routes
+    admin := router.PathPrefix("/admin").Subrouter()
+    admin.Use(adminAuthMiddleware)
+    admin.HandleFunc("/clear", clearOrdersHandler).Methods("DELETE")
+    admin.HandleFunc("/backup", backupOrdersHandler).Methods("GET")
+    admin.HandleFunc("/restore", restoreOrdersHandler).Methods("POST")
+    admin.HandleFunc("/anonymize", anonymizeOrdersHandler).Methods("POST")
+    admin.HandleFunc("/migrate", migrateHandler).Methods("POST")
+    admin.HandleFunc("/archive/run", runArchiveHandler).Methods("POST")
+    admin.HandleFunc("/orders", listOrdersHandler).Methods("GET")
+    admin.HandleFunc("/orders/export", exportOrdersHandler).Methods("GET")
+    admin.HandleFunc("/orders/replay", replayOrderEventsHandler).Methods("POST")
+    admin.HandleFunc("/orders/expire", expireOrdersHandler).Methods("POST")
+    admin.HandleFunc("/returns", listReturnsHandler).Methods("GET")
+    admin.HandleFunc("/webhooks", createWebhookHandler).Methods("POST")
+    admin.HandleFunc("/webhooks", listWebhooksHandler).Methods("GET")
+    admin.HandleFunc("/webhooks/{webhookId}", deleteWebhookHandler).Methods("DELETE")
+    admin.HandleFunc("/webhooks/{webhookId}/deliveries", getWebhookDeliveriesHandler).Methods("GET")
+    admin.HandleFunc("/orders/{orderId}/returns/{returnId}/approve", approveReturnHandler).Methods("POST")
+    admin.HandleFunc("/orders/{orderId}/returns/{returnId}/reject", rejectReturnHandler).Methods("POST")
+    admin.HandleFunc("/test/fixtures", loadFixturesHandler).Methods("POST")
+    admin.HandleFunc("/test/fixtures", resetFixturesHandler).Methods("DELETE")
+    admin.HandleFunc("/config", liveConfig.Handler).Methods("GET")
+    admin.HandleFunc("/config/reload", liveConfig.ReloadHandler).Methods("POST")
 
-    w.Header().Set("Content-Type", "text/plain")
-    w.Write([]byte(metrics))
+    // Utility routes
+    router.HandleFunc("/health", healthHandler).Methods("GET")
+    router.HandleFunc("/readyz", readiness.Handler).Methods("GET")
+    router.Handle("/metrics", metricsHandler).Methods("GET")
+    router.HandleFunc("/slo", slo.Handler).Methods("GET")
+    return router
 }
 
 func main() {
-    router := mux.NewRouter()
+    // Restore orders from the last snapshot
+    if err := loadSnapshot(); err != nil {
+        log.Fatalf("Failed to load order snapshot %s: %v", snapshotPath, err)
+    }
+    if err := openArchive(); err != nil {
+        log.Fatalf("Failed to open order archive %s: %v", archivePath, err)
+    }
+    go snapshotLoop()
+    go outboxDispatcher()
+    go archiveLoop()
+    go expiryLoop()
+    go liveConfig.Watch()
+    go readiness.Run(newHTTPClient)
+
+    // Resume undelivered notifications and start the worker pool
+    if err := startNotificationWorkers(); err != nil {
+        log.Fatalf("Failed to open notification queue %s: %v", notificationQueuePath, err)
+    }
+    // Reverse checkouts a crash interrupted, then start the checkout workers
+    if err := startCheckoutSagas(); err != nil {
+        log.Fatalf("Failed to open checkout saga journal %s: %v", sagaJournalPath, err)
+    }
+    startCheckoutWorkers()
 
-    // API routes
-    api := router.PathPrefix("/api/orders").Subrouter()
-    api.HandleFunc("/{userId}", createOrderHandler).Methods("POST")
-    api.HandleFunc("/{userId}", getUserOrdersHandler).Methods("GET")
-    api.HandleFunc("/{orderId}", getOrderHandler).Methods("GET")
-    api.HandleFunc("/{orderId}/status", updateOrderStatusHandler).Methods("PUT")
-    api.HandleFunc("/{orderId}/cancel", cancelOrderHandler).Methods("POST")
-    api.HandleFunc("/analytics", getAnalyticsHandler).Methods("GET")
+    // Start funnel retention goroutine
+    go cleanupFunnelJourneys()
 
-    // Admin routes
-    router.HandleFunc("/admin/clear", clearOrdersHandler).Methods("DELETE")
+    router := newRouter()
 
-    // Utility routes
-    router.HandleFunc("/health", healthHandler).Methods("GET")
-    router.HandleFunc("/metrics", metricsHandler).Methods("GET")
-
-    // CORS configuration
-    c := cors.New(cors.Options{
-        AllowedOrigins:   []string{"*"},
-        AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
-        AllowedHeaders:   []string{"*"},
-        AllowCredentials: true,
-    })
+    // CORS policy from CORS_* settings; duplicate checkouts also expose
+    // the order they duplicate
+    c := corspolicy.New(DuplicateOfHeader)
 
-    handler := c.Handler(router)
+    // Order event streams are never shed; they have their own cap, see
+    // order_stream.go
+    handler := accesslog.Handler(serviceName, c.Handler(loadshed.Handler(router, isOrderStreamRequest)))
 
     port := "8003"
     log.Printf("Order service starting on port %s", port)
-    log.Printf("Payment service URL: %s", paymentServiceURL)
-    log.Printf("Inventory service URL: %s", inventoryServiceURL)
-    log.Printf("Notification service URL: %s", notificationServiceURL)
-    
-    if err := http.ListenAndServe(":"+port, handler); err != nil {
-        log.Fatal("Server failed to start:", err)
+    log.Printf("Access log: %s", accesslog.Settings())
+    switch {
+    case !requireOrderAuth:
+        log.Printf("Order auth: off (REQUIRE_ORDER_AUTH=false), anyone can reach any order")
+    case jwtSecret == "":
+        log.Printf("Order auth: JWT_SECRET not configured, order routes accept only ADMIN_TOKEN")
+    default:
+        log.Printf("Order auth: user-service tokens required")
+    }
+    if paymentCallbackSecret == "" {
+        log.Printf("Payment callbacks: PAYMENT_CALLBACK_SECRET not configured, callbacks are refused with 503")
     }
+    if serviceTokenSecret == "" {
+        log.Printf("Service tokens: SERVICE_TOKEN_SECRET not configured, service-only routes refuse every call")
+    }
+    log.Printf("Payment service URL: %s", config().PaymentServiceURL)
+    log.Printf("Inventory service URL: %s", config().InventoryServiceURL)
+    log.Printf("Notification service URL: %s", config().NotificationServiceURL)
+    log.Printf("Order snapshot path: %s", snapshotPath)
+    log.Printf("Order archive path: %s (retention: %d months)", archivePath, config().OrderRetentionMonths)
+
+    serveUntilSignalled(httpserver.New(port, handler))
 }
\ No newline at end of file
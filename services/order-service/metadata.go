@@ -0,0 +1,129 @@
+package main
+
+import (
+    "encoding/json"
+    "net/http"
+    "regexp"
+    "sort"
+    "strings"
+    "time"
+
+    "github.com/gorilla/mux"
+    "middleware/adminauth"
+    "middleware/i18n"
+)
+
+// Order metadata. Orders carry a small map of strings for the systems
+// around them, e.g. the sales channel, a campaign or an ERP reference. It
+// is set at checkout (metadata), changed by admins with
+// PATCH /api/admin/orders/{orderId}/metadata, and filtered on in the
+// admin listing (metadata.<key>=<value>). The service itself never reads
+// it.
+
+// Metadata limits
+const (
+    MaxMetadataKeys        = 20
+    MaxMetadataKeyLength   = 40
+    MaxMetadataValueLength = 500
+)
+
+// Metadata keys are lower-case letters, digits, _, - and ., starting with
+// a letter or digit, so they read the same in query strings and exports
+var metadataKeyPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_.-]*$`)
+
+// Helper function to check a metadata key
+func validMetadataKey(key string) bool {
+    return len(key) <= MaxMetadataKeyLength && metadataKeyPattern.MatchString(key)
+}
+
+// Helper function to check metadata and normalize it: values are trimmed
+// and empty ones dropped. Returns nil for no metadata.
+func normalizeMetadata(metadata map[string]string) (map[string]string, error) {
+    normalized := make(map[string]string, len(metadata))
+    for key, value := range metadata {
+        if !validMetadataKey(key) {
+            return nil, i18n.NewError("order.metadata_key_invalid", key, MaxMetadataKeyLength)
+        }
+        value = strings.TrimSpace(value)
+        if len([]rune(value)) > MaxMetadataValueLength {
+            return nil, i18n.NewError("order.metadata_value_too_long", key, MaxMetadataValueLength)
+        }
+        if value != "" {
+            normalized[key] = value
+        }
+    }
+    if len(normalized) > MaxMetadataKeys {
+        return nil, i18n.NewError("order.metadata_too_many", MaxMetadataKeys)
+    }
+    if len(normalized) == 0 {
+        return nil, nil
+    }
+    return normalized, nil
+}
+
+// Helper function to apply a metadata patch: keys set to a string are set,
+// keys set to null removed, others kept. Returns the metadata to check.
+func patchMetadata(current map[string]string, patch map[string]*string) map[string]string {
+    patched := make(map[string]string, len(current)+len(patch))
+    for key, value := range current {
+        patched[key] = value
+    }
+    for key, value := range patch {
+        if value == nil {
+            delete(patched, key)
+        } else {
+            patched[key] = *value
+        }
+    }
+    return patched
+}
+
+// Admin endpoint to change an order's metadata. The body is a JSON merge
+// patch: {"channel": "amazon", "campaign": null} sets channel and removes
+// campaign.
+func updateOrderMetadataHandler(w http.ResponseWriter, r *http.Request) {
+    orderID := resolveOrderID(mux.Vars(r)["orderId"])
+
+    var patch map[string]*string
+    if err := json.NewDecoder(r.Body).Decode(&patch); err != nil {
+        i18n.WriteError(w, r, http.StatusBadRequest, "request.invalid_json")
+        return
+    }
+    // Removing a key that isn't there is harmless; only keys set are checked
+    for key, value := range patch {
+        if value != nil && !validMetadataKey(key) {
+            i18n.WriteError(w, r, http.StatusBadRequest, "order.metadata_key_invalid", key, MaxMetadataKeyLength)
+            return
+        }
+    }
+
+    shard := shardFor(orderID)
+    shard.mu.Lock()
+    order, exists := shard.orders[orderID]
+    if !exists {
+        shard.mu.Unlock()
+        i18n.WriteError(w, r, http.StatusNotFound, "order.not_found")
+        return
+    }
+    metadata, err := normalizeMetadata(patchMetadata(order.Metadata, patch))
+    if err != nil {
+        shard.mu.Unlock()
+        i18n.WriteMessageError(w, r, http.StatusBadRequest, err, "order.metadata_key_invalid")
+        return
+    }
+    order.Metadata = metadata
+    order.UpdatedAt = time.Now().Unix()
+    putOrder(shard, order)
+    shard.mu.Unlock()
+    persistOrders()
+
+    keys := make([]string, 0, len(patch))
+    for key := range patch {
+        keys = append(keys, key)
+    }
+    sort.Strings(keys)
+    adminauth.Audit(r, "order_metadata", map[string]interface{}{"order_id": orderID, "keys": keys})
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(order)
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+    "net/http"
+    "sort"
+    "strings"
+    "time"
+
+    "github.com/gorilla/mux"
+    "github.com/prometheus/client_golang/prometheus"
+    "github.com/prometheus/client_golang/prometheus/collectors"
+    "github.com/prometheus/client_golang/prometheus/promhttp"
+    dto "github.com/prometheus/client_model/go"
+    "github.com/prometheus/common/expfmt"
+    "middleware"
+    "middleware/accesslog"
+    "middleware/loadshed"
+    "middleware/openmetrics"
+    "middleware/readiness"
+    "middleware/slo"
+    "middleware/versioning"
+)
+
+// Metrics, served on /metrics by promhttp: in the OpenMetrics format to
+// scrapers that ask for it (Prometheus does by default), which carries the
+// trace exemplars on the latency histograms through to Grafana, and in the
+// Prometheus text format otherwise. Request latency, downstream calls (see
+// downstream.go), the order gauges and the Go runtime and process metrics
+// are collectors in metricsRegistry. The other sections are still rendered
+// as text by the files that own them (textMetrics) and parsed into the
+// same output, so they can move to collectors one at a time.
+
+// Latency histograms use the buckets of the other services'
+// hand-written ones (pkg/middleware/openmetrics)
+var (
+    metricsRegistry = prometheus.NewRegistry()
+
+    requestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+        Name:    "http_request_duration_seconds",
+        Help:    "Time taken to serve requests, by route",
+        Buckets: openmetrics.LatencyBuckets,
+    }, []string{"method", "route"})
+
+    downstreamRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+        Name: "order_service_downstream_requests_total",
+        Help: "Calls to other services, by service and result",
+    }, []string{"downstream", "result"})
+
+    downstreamInFlight = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+        Name: "order_service_downstream_requests_in_flight",
+        Help: "Calls to other services awaiting a response",
+    }, []string{"downstream"})
+
+    downstreamDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+        Name:    "order_service_downstream_request_duration_seconds",
+        Help:    "Time until other services responded, by service",
+        Buckets: openmetrics.LatencyBuckets,
+    }, []string{"downstream"})
+)
+
+func init() {
+    metricsRegistry.MustRegister(
+        collectors.NewGoCollector(),
+        collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+        requestDuration,
+        downstreamRequests,
+        downstreamInFlight,
+        downstreamDuration,
+        orderCollector{},
+    )
+}
+
+// orderCollector reports the order gauges, counted from the hot store at
+// each scrape
+type orderCollector struct{}
+
+var (
+    ordersDesc = prometheus.NewDesc("order_service_orders_total",
+        "Orders held, hot (not archived); clears and archiving lower it", nil, nil)
+    revenueDesc = prometheus.NewDesc("order_service_revenue_total",
+        "Revenue in cents of the orders held, net of refunds; refunds lower it", nil, nil)
+    ordersByStatusDesc = prometheus.NewDesc("order_service_orders_by_status",
+        "Orders by status", []string{"status"}, nil)
+)
+
+// Statuses reported by order_service_orders_by_status, even at zero
+var reportedStatuses = []string{
+    StatusCreated, StatusPending, StatusProcessing, StatusPendingPayment, StatusPaymentFailed, StatusOnHold, StatusPaid,
+    StatusPartiallyShipped, StatusShipped, StatusDelivered, StatusCancelled, StatusRefunded,
+}
+
+func (orderCollector) Describe(ch chan<- *prometheus.Desc) {
+    prometheus.DescribeByCollect(orderCollector{}, ch)
+}
+
+func (orderCollector) Collect(ch chan<- prometheus.Metric) {
+    orderCount := 0
+    statusCounts := make(map[string]int)
+    totalRevenue := 0
+
+    forEachOrder(func(order Order) {
+        orderCount++
+        statusCounts[order.Status]++
+        if countsAsRevenue(order) {
+            totalRevenue += netRevenueCents(order)
+        }
+    })
+
+    ch <- prometheus.MustNewConstMetric(ordersDesc, prometheus.GaugeValue, float64(orderCount))
+    ch <- prometheus.MustNewConstMetric(revenueDesc, prometheus.GaugeValue, float64(totalRevenue))
+    for _, status := range reportedStatuses {
+        ch <- prometheus.MustNewConstMetric(ordersByStatusDesc, prometheus.GaugeValue, float64(statusCounts[status]), status)
+    }
+}
+
+// Helper function to render the metrics sections not yet moved to
+// collectors, in the Prometheus text format
+func textMetrics() string {
+    metrics := funnelMetrics()
+    metrics += notificationMetrics()
+    metrics += checkoutMetrics()
+    metrics += sagaMetrics()
+    metrics += archiveMetrics()
+    metrics += expiryMetrics()
+    metrics += outboundRetryMetrics()
+    metrics += breakerMetrics()
+    metrics += eventMetrics()
+    metrics += outboxMetrics()
+    metrics += recipientMetrics()
+    metrics += fraudMetrics()
+    metrics += duplicateOrderMetrics()
+    metrics += orderRuleMetrics()
+    metrics += orderStreamMetrics()
+    metrics += readiness.Metrics()
+    metrics += versioning.Metrics()
+    metrics += loadshed.Metrics()
+    metrics += slo.Metrics()
+    return metrics
+}
+
+// Helper function to gather the text sections as metric families. Families
+// without samples are left out, as the encoders refuse them.
+func gatherTextMetrics() ([]*dto.MetricFamily, error) {
+    var parser expfmt.TextParser
+    parsed, err := parser.TextToMetricFamilies(strings.NewReader(textMetrics()))
+    if err != nil {
+        return nil, err
+    }
+
+    families := make([]*dto.MetricFamily, 0, len(parsed))
+    for _, family := range parsed {
+        if len(family.Metric) > 0 {
+            families = append(families, family)
+        }
+    }
+    sort.Slice(families, func(i, j int) bool {
+        return families[i].GetName() < families[j].GetName()
+    })
+    return families, nil
+}
+
+// Metrics endpoint
+var metricsHandler = promhttp.HandlerFor(
+    prometheus.Gatherers{metricsRegistry, prometheus.GathererFunc(gatherTextMetrics)},
+    promhttp.HandlerOpts{EnableOpenMetrics: true, ErrorHandling: promhttp.ContinueOnError},
+)
+
+// Latency middleware: records how long each routed request took, by route
+// template so IDs in paths don't explode the label set, and scores it
+// against the SLOs. Probe, metrics and SLO routes are left out, as are
+// order event streams, which stay open as long as the client wants.
+func observeLatency(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        route := ""
+        if current := mux.CurrentRoute(r); current != nil {
+            route, _ = current.GetPathTemplate()
+        }
+        accesslog.NoteRoute(r, route, mux.Vars(r)["userId"])
+        if route == "" || route == "/health" || route == "/readyz" || route == "/metrics" || route == "/slo" || isOrderStreamRequest(r) {
+            next.ServeHTTP(w, r)
+            return
+        }
+
+        start := time.Now()
+        recorder := &middleware.StatusRecorder{ResponseWriter: w}
+        next.ServeHTTP(recorder, r)
+        elapsed := time.Since(start)
+
+        if recorder.Status == 0 {
+            recorder.Status = http.StatusOK
+        }
+        recordLatency(r.Method, route, elapsed, openmetrics.TraceID(r))
+        slo.Record(r.Method, route, recorder.Status, elapsed)
+    })
+}
+
+// Helper function to add one observation to a route's histogram, with the
+// request's trace as the bucket's exemplar when it was traced
+func recordLatency(method string, route string, elapsed time.Duration, traceID string) {
+    observer := requestDuration.WithLabelValues(method, route)
+    if traceID != "" {
+        observer.(prometheus.ExemplarObserver).ObserveWithExemplar(elapsed.Seconds(), prometheus.Labels{"trace_id": traceID})
+        return
+    }
+    observer.Observe(elapsed.Seconds())
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+    "bytes"
+    "encoding/json"
+    "fmt"
+    "log"
+    "net/http"
+    "sync/atomic"
+
+    "middleware/adminauth"
+    "money"
+)
+
+// snapshotMigration upgrades a snapshot document from version From to
+// From+1. Migrations work on the raw JSON object rather than orderSnapshot
+// so they can reshape fields the current types no longer have.
+type snapshotMigration struct {
+    From        int
+    Description string
+    Apply       func(doc map[string]interface{}) error
+}
+
+// snapshotMigrations must cover every version from 1 to SnapshotVersion-1.
+// When changing the snapshot layout, bump SnapshotVersion and append the
+// migration here.
+var snapshotMigrations = []snapshotMigration{
+    {
+        From:        1,
+        Description: "orders default to USD",
+        Apply: func(doc map[string]interface{}) error {
+            orders, _ := doc["orders"].(map[string]interface{})
+            for orderID, value := range orders {
+                order, ok := value.(map[string]interface{})
+                if !ok {
+                    return fmt.Errorf("order %s is not an object", orderID)
+                }
+                if currency, _ := order["currency"].(string); currency == "" {
+                    order["currency"] = money.DefaultCurrency
+                }
+            }
+            return nil
+        },
+    },
+    {
+        From:        2,
+        Description: "orders carry subtotal, tax and grand total",
+        Apply: func(doc map[string]interface{}) error {
+            orders, _ := doc["orders"].(map[string]interface{})
+            for orderID, value := range orders {
+                order, ok := value.(map[string]interface{})
+                if !ok {
+                    return fmt.Errorf("order %s is not an object", orderID)
+                }
+                // Orders so far were charged no tax
+                if _, exists := order["subtotal_cents"]; !exists {
+                    order["subtotal_cents"] = order["total_cents"]
+                    order["tax_cents"] = 0
+                    order["grand_total_cents"] = order["total_cents"]
+                }
+            }
+            return nil
+        },
+    },
+}
+
+// Version of the snapshot file on disk (0 until one is loaded or written),
+// reported by /health so drift between the file and this build is visible
+var snapshotDiskVersion atomic.Int64
+
+// Helper function to bring a raw snapshot up to SnapshotVersion. Returns
+// the migrated document, the version it started at and the migrations run.
+func migrateSnapshot(data []byte) ([]byte, int, []string, error) {
+    decoder := json.NewDecoder(bytes.NewReader(data))
+    decoder.UseNumber() // keep int64 timestamps exact
+    var doc map[string]interface{}
+    if err := decoder.Decode(&doc); err != nil {
+        return nil, 0, nil, err
+    }
+
+    number, _ := doc["version"].(json.Number)
+    version64, err := number.Int64()
+    if err != nil {
+        return nil, 0, nil, fmt.Errorf("snapshot has no valid version")
+    }
+    from := int(version64)
+    if from > SnapshotVersion {
+        return nil, from, nil, fmt.Errorf("snapshot version %d is newer than this build supports (%d)", from, SnapshotVersion)
+    }
+    if from == SnapshotVersion {
+        return data, from, nil, nil
+    }
+
+    var applied []string
+    for version := from; version < SnapshotVersion; version++ {
+        var migration *snapshotMigration
+        for i := range snapshotMigrations {
+            if snapshotMigrations[i].From == version {
+                migration = &snapshotMigrations[i]
+                break
+            }
+        }
+        if migration == nil {
+            return nil, from, applied, fmt.Errorf("no migration from snapshot version %d", version)
+        }
+
+        if err := migration.Apply(doc); err != nil {
+            return nil, from, applied, fmt.Errorf("migration %d->%d (%s): %v", version, version+1, migration.Description, err)
+        }
+        doc["version"] = version + 1
+        applied = append(applied, fmt.Sprintf("%d->%d: %s", version, version+1, migration.Description))
+        log.Printf("Applied snapshot migration %d->%d: %s", version, version+1, migration.Description)
+    }
+
+    migrated, err := json.Marshal(doc)
+    return migrated, from, applied, err
+}
+
+// Helper function to report schema state for /health
+func schemaStatus() map[string]interface{} {
+    diskVersion := snapshotDiskVersion.Load()
+    return map[string]interface{}{
+        "snapshot_version":  diskVersion,
+        "supported_version": SnapshotVersion,
+        "pending":           snapshotPath != "" && diskVersion != 0 && diskVersion < SnapshotVersion,
+    }
+}
+
+// Admin endpoint to rewrite the snapshot at the current version. Startup
+// already does this after migrating; this covers a failed startup write.
+func migrateHandler(w http.ResponseWriter, r *http.Request) {
+    if snapshotPath == "" {
+        http.Error(w, "Snapshot persistence is disabled", http.StatusConflict)
+        return
+    }
+
+    from := snapshotDiskVersion.Load()
+    if err := flushSnapshot(); err != nil {
+        http.Error(w, "Failed to write snapshot: "+err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    adminauth.Audit(r, "migrate", map[string]interface{}{"from": from, "to": SnapshotVersion})
+
+    result := map[string]interface{}{
+        "message": "Snapshot is at the current version",
+        "from":    from,
+        "to":      SnapshotVersion,
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(result)
+}
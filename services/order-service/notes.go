@@ -0,0 +1,231 @@
+package main
+
+import (
+    "encoding/json"
+    "log"
+    "net/http"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/google/uuid"
+    "github.com/gorilla/mux"
+    "middleware/adminauth"
+    "middleware/i18n"
+)
+
+// Note visibility
+const (
+    NoteInternal = "internal" // support staff only (the default)
+    NoteCustomer = "customer" // shown to the customer too
+)
+
+// MaxNoteLength bounds a note's body, in characters
+const MaxNoteLength = 2000
+
+// OrderNote is a comment support staff attached to an order
+type OrderNote struct {
+    NoteID     string `json:"note_id"`
+    Author     string `json:"author"` // the agent, as requestActor names them, or admin
+    Visibility string `json:"visibility"`
+    Body       string `json:"body"`
+    CreatedAt  int64  `json:"created_at"`
+}
+
+// NoteRequest for POST /api/orders/{orderId}/notes
+type NoteRequest struct {
+    Body       string `json:"body"`
+    Visibility string `json:"visibility"`
+}
+
+// Notes by order ID, oldest first. They're kept apart from the orders so
+// internal notes can't reach customers through any order response, and
+// adding one doesn't touch the order (or its updated_at). They're saved
+// in the order snapshot and kept when the order is archived.
+var (
+    orderNotes = make(map[string][]OrderNote)
+    notesMu    sync.RWMutex
+)
+
+// Helper function to identify support staff: the ADMIN_TOKEN, or a
+// user-service JWT with a support or admin role. Returns the author to
+// record on their notes.
+func staffAuthor(r *http.Request) (string, bool) {
+    token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+    if adminauth.IsAdminToken(token) {
+        return "admin", true
+    }
+    if jwtSecret == "" {
+        return "", false
+    }
+    claims, err := verifyAgentToken(token, time.Now())
+    if err != nil || !canImpersonate(claims) {
+        return "", false
+    }
+    return requestActor(r), true
+}
+
+// Helper function to list an order's notes, leaving out internal ones
+// unless asked for
+func notesFor(orderID string, includeInternal bool) []OrderNote {
+    notesMu.RLock()
+    defer notesMu.RUnlock()
+
+    notes := []OrderNote{}
+    for _, note := range orderNotes[orderID] {
+        if includeInternal || note.Visibility == NoteCustomer {
+            notes = append(notes, note)
+        }
+    }
+    return notes
+}
+
+// Helper function to copy the notes for a snapshot
+func snapshotOrderNotes() map[string][]OrderNote {
+    notesMu.RLock()
+    defer notesMu.RUnlock()
+
+    notes := make(map[string][]OrderNote, len(orderNotes))
+    for orderID, list := range orderNotes {
+        notes[orderID] = list
+    }
+    return notes
+}
+
+// Helper function to restore notes from a snapshot
+func restoreOrderNotes(notes map[string][]OrderNote) {
+    notesMu.Lock()
+    defer notesMu.Unlock()
+
+    for orderID, list := range notes {
+        orderNotes[orderID] = list
+    }
+}
+
+// Helper function to drop the notes of orders that were removed. No IDs
+// drops every note.
+func dropOrderNotes(orderIDs ...string) {
+    notesMu.Lock()
+    defer notesMu.Unlock()
+
+    if len(orderIDs) == 0 {
+        orderNotes = make(map[string][]OrderNote)
+        return
+    }
+    for _, orderID := range orderIDs {
+        delete(orderNotes, orderID)
+    }
+}
+
+// Helper function to find an order, hot or archived, for its notes
+func noteOrder(orderID string) (Order, bool, error) {
+    if order, exists := getOrder(orderID); exists {
+        return order, true, nil
+    }
+    return readArchivedOrder(orderID)
+}
+
+// Helper function to write an order for GET. Support staff get all its
+// notes with it, and the fraud screening that flagged it if one did, so
+// they see the order as support does.
+func writeOrder(w http.ResponseWriter, r *http.Request, order Order) {
+    w.Header().Set("Content-Type", "application/json")
+    if _, staff := staffAuthor(r); staff {
+        var fraud *FraudScreening
+        if screening, exists := fraudScreeningFor(order.OrderID); exists {
+            fraud = &screening
+        }
+        json.NewEncoder(w).Encode(struct {
+            Order
+            Notes []OrderNote     `json:"notes"`
+            Fraud *FraudScreening `json:"fraud,omitempty"`
+        }{order, notesFor(order.OrderID, true), fraud})
+        return
+    }
+    json.NewEncoder(w).Encode(order)
+}
+
+// Add a note to an order. Support staff only.
+func createNoteHandler(w http.ResponseWriter, r *http.Request) {
+    author, ok := staffAuthor(r)
+    if !ok {
+        i18n.WriteError(w, r, http.StatusForbidden, "order.notes_staff_only")
+        return
+    }
+
+    var req NoteRequest
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+        i18n.WriteError(w, r, http.StatusBadRequest, "request.invalid_json")
+        return
+    }
+    req.Body = strings.TrimSpace(req.Body)
+    if req.Body == "" || len([]rune(req.Body)) > MaxNoteLength {
+        i18n.WriteError(w, r, http.StatusBadRequest, "order.note_body_invalid", MaxNoteLength)
+        return
+    }
+    switch req.Visibility {
+    case "":
+        req.Visibility = NoteInternal
+    case NoteInternal, NoteCustomer:
+    default:
+        i18n.WriteError(w, r, http.StatusBadRequest, "order.note_visibility_invalid")
+        return
+    }
+
+    orderID := resolveOrderID(mux.Vars(r)["orderId"])
+    _, exists, err := noteOrder(orderID)
+    if err != nil {
+        log.Printf("Failed to read archived order %s: %v", orderID, err)
+        http.Error(w, "Failed to read order archive", http.StatusInternalServerError)
+        return
+    }
+    if !exists {
+        i18n.WriteError(w, r, http.StatusNotFound, "order.not_found")
+        return
+    }
+
+    note := OrderNote{
+        NoteID:     "note_" + uuid.New().String(),
+        Author:     author,
+        Visibility: req.Visibility,
+        Body:       req.Body,
+        CreatedAt:  time.Now().Unix(),
+    }
+    notesMu.Lock()
+    orderNotes[orderID] = append(append([]OrderNote(nil), orderNotes[orderID]...), note)
+    notesMu.Unlock()
+    snapshotDirty.Store(true)
+    persistOrders()
+
+    log.Printf("Note %s (%s) added to order %s by %s", note.NoteID, note.Visibility, orderID, author)
+
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(http.StatusCreated)
+    json.NewEncoder(w).Encode(note)
+}
+
+// List an order's notes, oldest first. Customers see the customer-facing
+// ones; support staff see them all.
+func getNotesHandler(w http.ResponseWriter, r *http.Request) {
+    orderID := resolveOrderID(mux.Vars(r)["orderId"])
+    _, exists, err := noteOrder(orderID)
+    if err != nil {
+        log.Printf("Failed to read archived order %s: %v", orderID, err)
+        http.Error(w, "Failed to read order archive", http.StatusInternalServerError)
+        return
+    }
+    if !exists {
+        i18n.WriteError(w, r, http.StatusNotFound, "order.not_found")
+        return
+    }
+
+    _, staff := staffAuthor(r)
+    notes := notesFor(orderID, staff)
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "order_id": orderID,
+        "notes":    notes,
+        "total":    len(notes),
+    })
+}
@@ -0,0 +1,392 @@
+package main
+
+import (
+    "bufio"
+    "bytes"
+    "encoding/json"
+    "fmt"
+    "log"
+    "os"
+    "path/filepath"
+    "strconv"
+    "sync"
+    "sync/atomic"
+    "time"
+
+    "github.com/google/uuid"
+)
+
+// notificationJob is one notification waiting to be delivered
+type notificationJob struct {
+    ID         string              `json:"id"`
+    Request    NotificationRequest `json:"request"`
+    EnqueuedAt int64               `json:"enqueued_at"`
+    Attempts   int                 `json:"-"` // restarts begin a fresh retry budget
+}
+
+// notificationJournalEntry is one line of the queue journal. Jobs are
+// journaled on enqueue and marked done once delivered or given up on, so
+// replaying the journal yields exactly the undelivered jobs.
+type notificationJournalEntry struct {
+    Op  string           `json:"op"` // enqueue, done
+    Job *notificationJob `json:"job,omitempty"`
+    ID  string           `json:"id,omitempty"`
+}
+
+// Compact the journal once this many jobs have completed since the last rewrite
+const NotificationJournalCompactEvery = 1000
+
+// Notification queue settings (NOTIFICATION_QUEUE_PATH="" keeps the queue
+// in memory only)
+var (
+    notificationQueuePath   = os.Getenv("NOTIFICATION_QUEUE_PATH")
+    notificationWorkers     = 4
+    notificationQueueSize   = 1000
+    notificationMaxAttempts = 5
+    notificationRetryBase   = time.Second
+    notificationRetryMax    = time.Minute
+)
+
+// Queue state, guarded by journalMu. pendingJobs is capped at the queue
+// size, which bounds memory and guarantees sends to the channel never
+// block; the journal makes queued work survive a restart.
+var (
+    notificationQueue     chan *notificationJob
+    journalMu             sync.Mutex
+    journalFile           *os.File
+    pendingJobs           = make(map[string]*notificationJob) // queued or waiting to retry
+    completedSinceCompact int
+)
+
+// Notification metrics
+var (
+    notificationsSent    atomic.Int64
+    notificationsRetried atomic.Int64
+    notificationsFailed  atomic.Int64
+    notificationsDropped atomic.Int64
+)
+
+func init() {
+    if _, set := os.LookupEnv("NOTIFICATION_QUEUE_PATH"); !set {
+        notificationQueuePath = "data/notifications.queue"
+    }
+    if value, err := strconv.Atoi(os.Getenv("NOTIFICATION_WORKERS")); err == nil && value > 0 {
+        notificationWorkers = value
+    }
+    if value, err := strconv.Atoi(os.Getenv("NOTIFICATION_QUEUE_SIZE")); err == nil && value > 0 {
+        notificationQueueSize = value
+    }
+    if value, err := strconv.Atoi(os.Getenv("NOTIFICATION_MAX_ATTEMPTS")); err == nil && value > 0 {
+        notificationMaxAttempts = value
+    }
+    notificationQueue = make(chan *notificationJob, notificationQueueSize)
+}
+
+// Helper function to queue a notification for delivery. Never blocks:
+// when the queue is full, or the job can't be journaled, it is refused and
+// the outbox (see outbox.go) offers it again later.
+func queueNotification(request NotificationRequest) error {
+    if config().NotificationServiceURL == "" {
+        return nil
+    }
+
+    job := &notificationJob{
+        ID:         uuid.New().String(),
+        Request:    request,
+        EnqueuedAt: time.Now().Unix(),
+    }
+
+    // Journal and enqueue under one lock so a job is never on disk without
+    // being queued (or the other way round)
+    journalMu.Lock()
+    defer journalMu.Unlock()
+
+    if len(pendingJobs) >= cap(notificationQueue) {
+        notificationsDropped.Add(1)
+        return fmt.Errorf("notification queue full")
+    }
+    if err := appendJournal(notificationJournalEntry{Op: "enqueue", Job: job}); err != nil {
+        return fmt.Errorf("journaling notification: %w", err)
+    }
+    pendingJobs[job.ID] = job
+    notificationQueue <- job
+    return nil
+}
+
+// Helper function to append a journal entry. Callers must hold journalMu.
+func appendJournal(entry notificationJournalEntry) error {
+    if journalFile == nil {
+        return nil
+    }
+
+    data, err := json.Marshal(entry)
+    if err != nil {
+        return err
+    }
+    data = append(data, '\n')
+
+    if _, err := journalFile.Write(data); err != nil {
+        return err
+    }
+    return journalFile.Sync()
+}
+
+// Helper function to mark a job finished (delivered or given up on)
+func completeNotification(job *notificationJob) {
+    journalMu.Lock()
+    defer journalMu.Unlock()
+
+    delete(pendingJobs, job.ID)
+    if err := appendJournal(notificationJournalEntry{Op: "done", ID: job.ID}); err != nil {
+        log.Printf("Failed to journal notification completion: %v", err)
+    }
+
+    completedSinceCompact++
+    if completedSinceCompact >= NotificationJournalCompactEvery {
+        if err := compactJournal(); err != nil {
+            log.Printf("Failed to compact notification journal: %v", err)
+        }
+    }
+}
+
+// Helper function to rewrite the journal with only the pending jobs, using
+// the same temp file + rename as order snapshots. Callers must hold journalMu.
+func compactJournal() error {
+    if journalFile == nil {
+        return nil
+    }
+
+    dir := filepath.Dir(notificationQueuePath)
+    tmp, err := os.CreateTemp(dir, ".notifications-queue-*")
+    if err != nil {
+        return err
+    }
+    defer os.Remove(tmp.Name())
+
+    writer := bufio.NewWriter(tmp)
+    for _, job := range pendingJobs {
+        data, err := json.Marshal(notificationJournalEntry{Op: "enqueue", Job: job})
+        if err != nil {
+            tmp.Close()
+            return err
+        }
+        writer.Write(append(data, '\n'))
+    }
+    if err := writer.Flush(); err != nil {
+        tmp.Close()
+        return err
+    }
+    if err := tmp.Sync(); err != nil {
+        tmp.Close()
+        return err
+    }
+    if err := tmp.Close(); err != nil {
+        return err
+    }
+    if err := os.Rename(tmp.Name(), notificationQueuePath); err != nil {
+        return err
+    }
+
+    file, err := os.OpenFile(notificationQueuePath, os.O_WRONLY|os.O_APPEND, 0644)
+    if err != nil {
+        return err
+    }
+    journalFile.Close()
+    journalFile = file
+    completedSinceCompact = 0
+    return nil
+}
+
+// Helper function to replay the journal and return the undelivered jobs
+// in enqueue order
+func openNotificationJournal() ([]*notificationJob, error) {
+    if notificationQueuePath == "" {
+        return nil, nil
+    }
+
+    if err := os.MkdirAll(filepath.Dir(notificationQueuePath), 0755); err != nil {
+        return nil, err
+    }
+
+    var order []string
+    pending := make(map[string]*notificationJob)
+    if file, err := os.Open(notificationQueuePath); err == nil {
+        scanner := bufio.NewScanner(file)
+        scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+        for scanner.Scan() {
+            var entry notificationJournalEntry
+            if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+                // A write torn by a crash; skip it
+                log.Printf("Ignoring unreadable notification journal entry: %v", err)
+                continue
+            }
+            switch entry.Op {
+            case "enqueue":
+                if entry.Job != nil {
+                    pending[entry.Job.ID] = entry.Job
+                    order = append(order, entry.Job.ID)
+                }
+            case "done":
+                delete(pending, entry.ID)
+            }
+        }
+        file.Close()
+        if err := scanner.Err(); err != nil {
+            return nil, err
+        }
+    } else if !os.IsNotExist(err) {
+        return nil, err
+    }
+
+    journalMu.Lock()
+    defer journalMu.Unlock()
+
+    var jobs []*notificationJob
+    for _, id := range order {
+        if job, exists := pending[id]; exists {
+            jobs = append(jobs, job)
+            pendingJobs[id] = job
+        }
+    }
+
+    // Start from a compacted journal holding just the replayed jobs
+    file, err := os.OpenFile(notificationQueuePath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+    if err != nil {
+        return nil, err
+    }
+    journalFile = file
+    if err := compactJournal(); err != nil {
+        return nil, err
+    }
+    return jobs, nil
+}
+
+// Helper function to deliver one notification
+func deliverNotification(job *notificationJob) error {
+    jsonData, err := json.Marshal(job.Request)
+    if err != nil {
+        return err
+    }
+
+    client := newServiceClient(notificationBreaker, 10*time.Second)
+    resp, err := client.Post(
+        config().NotificationServiceURL+"/api/notifications/send",
+        "application/json",
+        bytes.NewBuffer(jsonData),
+    )
+    if err != nil {
+        return err
+    }
+    defer resp.Body.Close()
+
+    if resp.StatusCode >= 300 {
+        return fmt.Errorf("notification service returned status %d", resp.StatusCode)
+    }
+    return nil
+}
+
+// Worker loop: deliver jobs, retrying failures with exponential backoff.
+// Retries wait on a timer rather than in the worker, so one flaky
+// notification never stalls the others.
+func notificationWorker() {
+    for job := range notificationQueue {
+        job.Attempts++
+        err := deliverNotification(job)
+        if err == nil {
+            notificationsSent.Add(1)
+            recordNotification(job, true)
+            completeNotification(job)
+            continue
+        }
+
+        // Nothing was sent; wait the breaker out without spending an attempt
+        if isCircuitOpen(err) {
+            job.Attempts--
+            retry := job
+            time.AfterFunc(breakerOpenDuration(), func() { notificationQueue <- retry })
+            continue
+        }
+
+        if job.Attempts >= notificationMaxAttempts {
+            notificationsFailed.Add(1)
+            log.Printf("Giving up on notification %s (%s) after %d attempts: %v",
+                job.ID, job.Request.Template, job.Attempts, err)
+            recordNotification(job, false)
+            completeNotification(job)
+            continue
+        }
+
+        delay := notificationRetryBase << (job.Attempts - 1)
+        if delay > notificationRetryMax {
+            delay = notificationRetryMax
+        }
+        notificationsRetried.Add(1)
+        log.Printf("Notification %s failed (attempt %d/%d), retrying in %s: %v",
+            job.ID, job.Attempts, notificationMaxAttempts, delay, err)
+
+        retry := job
+        time.AfterFunc(delay, func() { notificationQueue <- retry })
+    }
+}
+
+// Replay undelivered notifications and start the worker pool
+func startNotificationWorkers() error {
+    jobs, err := openNotificationJournal()
+    if err != nil {
+        return err
+    }
+
+    for i := 0; i < notificationWorkers; i++ {
+        go notificationWorker()
+    }
+
+    if len(jobs) > 0 {
+        log.Printf("Resuming %d undelivered notifications", len(jobs))
+        // Replayed jobs may exceed the queue size, so feed them in the background
+        go func() {
+            for _, job := range jobs {
+                notificationQueue <- job
+            }
+        }()
+    }
+    return nil
+}
+
+// Helper function to report notification queue metrics
+func notificationMetrics() string {
+    journalMu.Lock()
+    pending := len(pendingJobs)
+    journalMu.Unlock()
+
+    return fmt.Sprintf(`
+# HELP order_service_notification_queue_depth Notifications buffered for the workers
+# TYPE order_service_notification_queue_depth gauge
+order_service_notification_queue_depth %d
+
+# HELP order_service_notification_queue_capacity Maximum notifications buffered in memory
+# TYPE order_service_notification_queue_capacity gauge
+order_service_notification_queue_capacity %d
+
+# HELP order_service_notifications_pending Notifications not yet delivered, including those waiting to retry
+# TYPE order_service_notifications_pending gauge
+order_service_notifications_pending %d
+
+# HELP order_service_notifications_sent_total Notifications delivered
+# TYPE order_service_notifications_sent_total counter
+order_service_notifications_sent_total %d
+
+# HELP order_service_notifications_retries_total Failed delivery attempts that were retried
+# TYPE order_service_notifications_retries_total counter
+order_service_notifications_retries_total %d
+
+# HELP order_service_notifications_failed_total Notifications abandoned after the last retry
+# TYPE order_service_notifications_failed_total counter
+order_service_notifications_failed_total %d
+
+# HELP order_service_notifications_dropped_total Notifications turned away because the queue was full (the outbox retries them)
+# TYPE order_service_notifications_dropped_total counter
+order_service_notifications_dropped_total %d
+`, len(notificationQueue), cap(notificationQueue), pending,
+        notificationsSent.Load(), notificationsRetried.Load(),
+        notificationsFailed.Load(), notificationsDropped.Load())
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+    "fmt"
+    "log"
+    "net/http"
+    "os"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/gorilla/mux"
+    "middleware/i18n"
+)
+
+// OrderNumberStrategy turns an order's position in a sequence into the
+// short number shown to customers (ORD-2024-000123). Sequences are counted
+// per scope, so the strategy decides when numbering restarts.
+type OrderNumberStrategy interface {
+    Scope(order Order) string
+    Format(scope string, sequence int) string
+}
+
+// yearlyNumbers numbers orders PREFIX-YYYY-NNNNNN, restarting every year
+type yearlyNumbers struct {
+    Prefix     string
+    Width      int
+    CheckDigit bool
+}
+
+func (s yearlyNumbers) Scope(order Order) string {
+    return fmt.Sprintf("%s-%d", s.Prefix, time.Unix(order.CreatedAt, 0).UTC().Year())
+}
+
+func (s yearlyNumbers) Format(scope string, sequence int) string {
+    return withCheckDigit(fmt.Sprintf("%s-%0*d", scope, s.Width, sequence), s.CheckDigit)
+}
+
+// continuousNumbers numbers orders PREFIX-NNNNNNNN from one sequence that
+// never restarts
+type continuousNumbers struct {
+    Prefix     string
+    Width      int
+    CheckDigit bool
+}
+
+func (s continuousNumbers) Scope(order Order) string {
+    return s.Prefix
+}
+
+func (s continuousNumbers) Format(scope string, sequence int) string {
+    return withCheckDigit(fmt.Sprintf("%s-%0*d", scope, s.Width, sequence), s.CheckDigit)
+}
+
+// Order numbering settings. ORDER_NUMBER_PREFIX distinguishes tenants (or
+// environments) sharing reporting and support tooling; the check digit
+// catches mistyped numbers before they hit the wrong order.
+var orderNumbering OrderNumberStrategy
+
+func init() {
+    prefix := strings.ToUpper(strings.TrimSpace(os.Getenv("ORDER_NUMBER_PREFIX")))
+    if prefix == "" {
+        prefix = "ORD"
+    }
+    checkDigit := os.Getenv("ORDER_NUMBER_CHECK_DIGIT") == "true"
+
+    switch strategy := os.Getenv("ORDER_NUMBER_STRATEGY"); strategy {
+    case "", "yearly":
+        orderNumbering = yearlyNumbers{Prefix: prefix, Width: 6, CheckDigit: checkDigit}
+    case "continuous":
+        orderNumbering = continuousNumbers{Prefix: prefix, Width: 8, CheckDigit: checkDigit}
+    default:
+        log.Printf("Ignoring unknown ORDER_NUMBER_STRATEGY=%q, using yearly", strategy)
+        orderNumbering = yearlyNumbers{Prefix: prefix, Width: 6, CheckDigit: checkDigit}
+    }
+}
+
+// Sequence counters (persisted in the snapshot) and the index of hot
+// orders by number, guarded by numberMu. Archived orders are indexed
+// separately in archiveNumberIndex.
+var (
+    numberMu        sync.Mutex
+    numberSequences = make(map[string]int)    // scope -> last sequence issued
+    numberIndex     = make(map[string]string) // order number -> orderID
+)
+
+// Helper function to append a Luhn check digit over the digits of a number
+func withCheckDigit(number string, enabled bool) string {
+    if !enabled {
+        return number
+    }
+    sum := 0
+    double := true
+    for i := len(number) - 1; i >= 0; i-- {
+        if number[i] < '0' || number[i] > '9' {
+            continue
+        }
+        digit := int(number[i] - '0')
+        if double {
+            digit *= 2
+            if digit > 9 {
+                digit -= 9
+            }
+        }
+        sum += digit
+        double = !double
+    }
+    return number + "-" + strconv.Itoa((10-sum%10)%10)
+}
+
+// Helper function to issue the next number for an order. Numbers already
+// in use are skipped, so a counter that lags behind restored or archived
+// orders (e.g. after a crash between snapshots) never hands out a
+// duplicate. The archive is checked without numberMu held, since archival
+// takes archiveMu before the number index.
+func nextOrderNumber(order Order) string {
+    scope := orderNumbering.Scope(order)
+
+    for {
+        numberMu.Lock()
+        numberSequences[scope]++
+        number := orderNumbering.Format(scope, numberSequences[scope])
+        _, taken := numberIndex[number]
+        numberMu.Unlock()
+        snapshotDirty.Store(true)
+
+        if !taken && !archivedOrderNumberTaken(number) {
+            return number
+        }
+    }
+}
+
+// Helper function to index an order's number. Callers must hold the
+// order's shard lock.
+func indexOrderNumber(order Order) {
+    if order.OrderNumber == "" {
+        return
+    }
+    numberMu.Lock()
+    numberIndex[order.OrderNumber] = order.OrderID
+    numberMu.Unlock()
+}
+
+// Helper function to drop an order's number from the index. Callers must
+// hold the order's shard lock.
+func unindexOrderNumber(order Order) {
+    if order.OrderNumber == "" {
+        return
+    }
+    numberMu.Lock()
+    if numberIndex[order.OrderNumber] == order.OrderID {
+        delete(numberIndex, order.OrderNumber)
+    }
+    numberMu.Unlock()
+}
+
+// Helper function to copy the sequence counters for the snapshot
+func orderNumberSequences() map[string]int {
+    numberMu.Lock()
+    defer numberMu.Unlock()
+
+    sequences := make(map[string]int, len(numberSequences))
+    for scope, sequence := range numberSequences {
+        sequences[scope] = sequence
+    }
+    return sequences
+}
+
+// Helper function to restore sequence counters from a snapshot
+func restoreOrderNumberSequences(sequences map[string]int) {
+    numberMu.Lock()
+    defer numberMu.Unlock()
+
+    for scope, sequence := range sequences {
+        if sequence > numberSequences[scope] {
+            numberSequences[scope] = sequence
+        }
+    }
+}
+
+// Helper function to normalize an order number typed by a person
+func normalizeOrderNumber(value string) string {
+    return strings.ToUpper(strings.TrimSpace(value))
+}
+
+// Helper function to resolve an order ID or order number to the order ID.
+// Unknown values come back unchanged so callers report them as not found.
+func resolveOrderID(idOrNumber string) string {
+    if _, exists := getOrder(idOrNumber); exists {
+        return idOrNumber
+    }
+
+    number := normalizeOrderNumber(idOrNumber)
+    numberMu.Lock()
+    orderID, exists := numberIndex[number]
+    numberMu.Unlock()
+    if exists {
+        return orderID
+    }
+    if orderID, exists := archivedOrderIDForNumber(number); exists {
+        return orderID
+    }
+    return idOrNumber
+}
+
+// Get an order (hot or archived) by its order number
+func getOrderByNumberHandler(w http.ResponseWriter, r *http.Request) {
+    orderID := resolveOrderID(mux.Vars(r)["orderNumber"])
+
+    order, exists := getOrder(orderID)
+    if !exists {
+        archived, found, err := readArchivedOrder(orderID)
+        if err != nil {
+            log.Printf("Failed to read archived order %s: %v", orderID, err)
+            http.Error(w, "Failed to read order archive", http.StatusInternalServerError)
+            return
+        }
+        if !found {
+            i18n.WriteError(w, r, http.StatusNotFound, "order.not_found")
+            return
+        }
+        order = archived
+    }
+
+    writeOrder(w, r, order)
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+    "encoding/base64"
+    "encoding/json"
+    "fmt"
+    "net/http"
+    "sort"
+    "strconv"
+    "strings"
+)
+
+// Admin order listing page sizes
+const (
+    DefaultOrderListLimit = 50
+    MaxOrderListLimit     = 500
+)
+
+// Sort keys for the admin order listing
+var orderSortKeys = map[string]func(order Order) int64{
+    "created_at":  func(order Order) int64 { return order.CreatedAt },
+    "updated_at":  func(order Order) int64 { return order.UpdatedAt },
+    "total_cents": func(order Order) int64 { return int64(order.TotalCents) },
+}
+
+// orderFilter selects orders by the admin listing's query parameters.
+// Zero values match everything.
+type orderFilter struct {
+    Statuses      map[string]bool
+    UserID        string
+    Currency      string
+    From          int64 // created_at bounds, inclusive
+    To            int64
+    MinTotalCents int
+    MaxTotalCents int               // 0 for no maximum
+    Metadata      map[string]string // metadata values the order must have; see metadata.go
+    Priority      string            // see priority.go
+}
+
+// Helper function to parse ?status= (comma-separated), ?user_id=,
+// ?currency=, ?from=/?to= (Unix seconds or RFC 3339, on created_at),
+// ?min_total_cents=/?max_total_cents=, ?priority= and
+// ?metadata.<key>=<value>
+func parseOrderFilter(r *http.Request) (orderFilter, error) {
+    query := r.URL.Query()
+    filter := orderFilter{
+        UserID:   query.Get("user_id"),
+        Currency: strings.ToUpper(query.Get("currency")),
+        Priority: query.Get("priority"),
+    }
+    if filter.Priority != "" && filter.Priority != PriorityStandard && filter.Priority != PriorityExpress {
+        return filter, fmt.Errorf("priority must be %s or %s", PriorityStandard, PriorityExpress)
+    }
+
+    if value := query.Get("status"); value != "" {
+        filter.Statuses = make(map[string]bool)
+        for _, status := range strings.Split(value, ",") {
+            status = strings.TrimSpace(status)
+            if !isOrderStatus(status) {
+                return filter, fmt.Errorf("unknown status %q", status)
+            }
+            filter.Statuses[status] = true
+        }
+    }
+
+    var err error
+    if filter.From, err = parseReplayTime(query.Get("from"), 0); err != nil {
+        return filter, fmt.Errorf("invalid from: %v", err)
+    }
+    if filter.To, err = parseReplayTime(query.Get("to"), 0); err != nil {
+        return filter, fmt.Errorf("invalid to: %v", err)
+    }
+    if filter.To != 0 && filter.From > filter.To {
+        return filter, fmt.Errorf("from must not be after to")
+    }
+
+    for name, target := range map[string]*int{
+        "min_total_cents": &filter.MinTotalCents,
+        "max_total_cents": &filter.MaxTotalCents,
+    } {
+        if value := query.Get(name); value != "" {
+            cents, err := strconv.Atoi(value)
+            if err != nil || cents < 0 {
+                return filter, fmt.Errorf("%s must be a non-negative number of cents", name)
+            }
+            *target = cents
+        }
+    }
+    if filter.MaxTotalCents != 0 && filter.MinTotalCents > filter.MaxTotalCents {
+        return filter, fmt.Errorf("min_total_cents must not be above max_total_cents")
+    }
+
+    for name, values := range query {
+        key, isMetadata := strings.CutPrefix(name, "metadata.")
+        if !isMetadata {
+            continue
+        }
+        if !validMetadataKey(key) {
+            return filter, fmt.Errorf("invalid metadata key %q", key)
+        }
+        if filter.Metadata == nil {
+            filter.Metadata = make(map[string]string)
+        }
+        filter.Metadata[key] = values[0]
+    }
+    return filter, nil
+}
+
+// Helper function to check an order against a filter
+func (f orderFilter) matches(order Order) bool {
+    if f.Statuses != nil && !f.Statuses[order.Status] {
+        return false
+    }
+    if f.UserID != "" && order.UserID != f.UserID {
+        return false
+    }
+    if f.Currency != "" && order.Currency != f.Currency {
+        return false
+    }
+    if order.CreatedAt < f.From || (f.To != 0 && order.CreatedAt > f.To) {
+        return false
+    }
+    if order.TotalCents < f.MinTotalCents || (f.MaxTotalCents != 0 && order.TotalCents > f.MaxTotalCents) {
+        return false
+    }
+    if f.Priority != "" && priorityOf(order) != f.Priority {
+        return false
+    }
+    for key, value := range f.Metadata {
+        if order.Metadata[key] != value {
+            return false
+        }
+    }
+    return true
+}
+
+// orderCursor marks where a page of the listing ended: the last order's
+// sort value and ID, under the sort it was listed with
+type orderCursor struct {
+    Sort    string `json:"s"`
+    Desc    bool   `json:"d"`
+    Value   int64  `json:"v"`
+    OrderID string `json:"id"`
+}
+
+// Helper function to encode a cursor as an opaque token
+func (c orderCursor) encode() string {
+    data, _ := json.Marshal(c)
+    return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// Helper function to decode a cursor token
+func decodeOrderCursor(token string) (orderCursor, error) {
+    var cursor orderCursor
+    data, err := base64.RawURLEncoding.DecodeString(token)
+    if err == nil {
+        err = json.Unmarshal(data, &cursor)
+    }
+    if err != nil || cursor.OrderID == "" {
+        return cursor, fmt.Errorf("invalid cursor")
+    }
+    return cursor, nil
+}
+
+// orderPaging is how a listing is sorted and which page of it to return
+type orderPaging struct {
+    Sort   string
+    Desc   bool
+    Limit  int
+    Offset int
+    Cursor *orderCursor
+}
+
+// Helper function to parse ?sort= (created_at, the default, updated_at or
+// total_cents), ?order= (desc, the default, or asc), ?limit= and either
+// ?offset= or the next_cursor of the previous page. Cursors stay stable
+// while orders are added, offsets don't.
+func parseOrderPaging(r *http.Request) (orderPaging, error) {
+    query := r.URL.Query()
+    paging := orderPaging{Sort: query.Get("sort"), Limit: DefaultOrderListLimit}
+
+    if paging.Sort == "" {
+        paging.Sort = "created_at"
+    }
+    if _, known := orderSortKeys[paging.Sort]; !known {
+        return paging, fmt.Errorf("Sort must be 'created_at', 'updated_at' or 'total_cents'")
+    }
+    switch query.Get("order") {
+    case "", "desc":
+        paging.Desc = true
+    case "asc":
+    default:
+        return paging, fmt.Errorf("Order must be 'asc' or 'desc'")
+    }
+
+    var err error
+    if value := query.Get("limit"); value != "" {
+        paging.Limit, err = strconv.Atoi(value)
+        if err != nil || paging.Limit <= 0 || paging.Limit > MaxOrderListLimit {
+            return paging, fmt.Errorf("limit must be between 1 and %d", MaxOrderListLimit)
+        }
+    }
+    if value := query.Get("offset"); value != "" {
+        paging.Offset, err = strconv.Atoi(value)
+        if err != nil || paging.Offset < 0 {
+            return paging, fmt.Errorf("offset must be a non-negative number")
+        }
+    }
+    if token := query.Get("cursor"); token != "" {
+        if paging.Offset != 0 {
+            return paging, fmt.Errorf("Use either cursor or offset, not both")
+        }
+        decoded, err := decodeOrderCursor(token)
+        if err != nil || decoded.Sort != paging.Sort || decoded.Desc != paging.Desc {
+            return paging, fmt.Errorf("Invalid cursor for this sort")
+        }
+        paging.Cursor = &decoded
+    }
+    return paging, nil
+}
+
+// Helper function to sort orders and cut out the requested page, as the
+// listing's response: the page, the total before paging, the paging used
+// and next_cursor when more orders follow
+func (p orderPaging) page(orders []Order) map[string]interface{} {
+    sortValue := orderSortKeys[p.Sort]
+    direction := "asc"
+    if p.Desc {
+        direction = "desc"
+    }
+
+    // before reports whether a sorts ahead of b; ties go by order ID
+    before := func(aValue int64, aID string, bValue int64, bID string) bool {
+        if aValue != bValue {
+            return (aValue > bValue) == p.Desc
+        }
+        return aID < bID
+    }
+
+    sort.Slice(orders, func(i, j int) bool {
+        return before(sortValue(orders[i]), orders[i].OrderID, sortValue(orders[j]), orders[j].OrderID)
+    })
+
+    start := min(p.Offset, len(orders))
+    if p.Cursor != nil {
+        start = sort.Search(len(orders), func(i int) bool {
+            return before(p.Cursor.Value, p.Cursor.OrderID, sortValue(orders[i]), orders[i].OrderID)
+        })
+    }
+    end := min(start+p.Limit, len(orders))
+    page := orders[start:end]
+
+    result := map[string]interface{}{
+        "orders": page,
+        "total":  len(orders),
+        "limit":  p.Limit,
+        "sort":   p.Sort,
+        "order":  direction,
+    }
+    if p.Cursor == nil {
+        result["offset"] = p.Offset
+    }
+    if end < len(orders) {
+        last := page[len(page)-1]
+        result["next_cursor"] = orderCursor{Sort: p.Sort, Desc: p.Desc, Value: sortValue(last), OrderID: last.OrderID}.encode()
+    }
+    return result
+}
+
+// Admin endpoint to list orders across all users. Filters are described
+// at parseOrderFilter and paging at parseOrderPaging.
+func listOrdersHandler(w http.ResponseWriter, r *http.Request) {
+    filter, err := parseOrderFilter(r)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+    paging, err := parseOrderPaging(r)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+
+    orders := []Order{}
+    forEachOrder(func(order Order) {
+        if filter.matches(order) {
+            orders = append(orders, order)
+        }
+    })
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(paging.page(orders))
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+    "bytes"
+    "encoding/json"
+    "fmt"
+    "os"
+    "sort"
+    "strings"
+    "sync"
+
+    "middleware/i18n"
+    "money"
+)
+
+// Order validation rules. Ops can tighten what checkouts accept without a
+// deploy, e.g. during a fraud wave: ORDER_RULES holds the rules as a JSON
+// array, or ORDER_RULES_FILE names a file holding one. Either is read
+// again with the rest of the configuration (SIGHUP or
+// POST /admin/config/reload), and rules that don't parse leave the running
+// ones in place. Rules are checked when an order is created, once its
+// total is known and before any payment is taken; an order that breaks
+// one is refused with 400. Changing an order's shipping address checks
+// restricted_products again, so it can't be moved somewhere a product
+// isn't allowed to go.
+//
+//   [{"type": "max_total", "currency": "USD", "max_cents": 500000},
+//    {"type": "max_item_quantity", "max_quantity": 5, "products": ["sku-1"]},
+//    {"name": "no-batteries-by-air", "type": "restricted_products",
+//     "products": ["sku-2"], "regions": ["US-HI", "AU"]}]
+const (
+    RuleMaxTotal           = "max_total"
+    RuleMaxItemQuantity    = "max_item_quantity"
+    RuleRestrictedProducts = "restricted_products"
+)
+
+// OrderRule is one validation rule. Name identifies it in logs and
+// metrics, and defaults to its type; names must be unique.
+type OrderRule struct {
+    Name        string   `json:"name,omitempty"`
+    Type        string   `json:"type"`
+    Currency    string   `json:"currency,omitempty"`     // max_total: the orders it applies to
+    MaxCents    int      `json:"max_cents,omitempty"`    // max_total: the highest grand total, in minor units
+    MaxQuantity int      `json:"max_quantity,omitempty"` // max_item_quantity: the most units on one line
+    Products    []string `json:"products,omitempty"`     // max_item_quantity: products it applies to, all when empty; restricted_products: products refused
+    Regions     []string `json:"regions,omitempty"`      // restricted_products: COUNTRY, COUNTRY-REGION or * shipped to
+}
+
+// orderRules are the rules in force, in the order they are checked
+type orderRules []OrderRule
+
+// Refusals by rule name
+var (
+    ruleRejections   = make(map[string]int64)
+    ruleRejectionsMu sync.Mutex
+)
+
+// Helper function to check whether a rule covers a product. Rules without
+// products cover every one.
+func (rule OrderRule) coversProduct(productID string) bool {
+    if len(rule.Products) == 0 {
+        return true
+    }
+    for _, product := range rule.Products {
+        if product == productID {
+            return true
+        }
+    }
+    return false
+}
+
+// Helper function to check whether a restricted_products rule covers an
+// address. Orders without an address are only covered by *.
+func (rule OrderRule) coversAddress(address *Address) bool {
+    for _, region := range rule.Regions {
+        if region == TaxDefaultRegion {
+            return true
+        }
+        if address == nil {
+            continue
+        }
+        if region == address.Country || (address.Region != "" && region == address.Country+"-"+address.Region) {
+            return true
+        }
+    }
+    return false
+}
+
+// Helper function to describe where an order ships to, for messages
+func destination(address *Address) string {
+    if address == nil {
+        return TaxDefaultRegion
+    }
+    if address.Region != "" {
+        return address.Country + "-" + address.Region
+    }
+    return address.Country
+}
+
+// Helper function to check an order against one rule. Returns the
+// customer-facing reason when it breaks it.
+func (rule OrderRule) check(order Order) error {
+    switch rule.Type {
+    case RuleMaxTotal:
+        if order.Currency == rule.Currency && order.TotalCents > rule.MaxCents {
+            return i18n.NewError("order.rule_max_total", money.New(rule.MaxCents, rule.Currency).String())
+        }
+    case RuleMaxItemQuantity:
+        for _, item := range order.Items {
+            if rule.coversProduct(item.ProductID) && item.Quantity > rule.MaxQuantity {
+                return i18n.NewError("order.rule_max_quantity", rule.MaxQuantity, item.ProductID)
+            }
+        }
+    case RuleRestrictedProducts:
+        if !rule.coversAddress(order.ShippingAddress) {
+            return nil
+        }
+        for _, item := range order.Items {
+            if rule.coversProduct(item.ProductID) {
+                return i18n.NewError("order.rule_product_restricted", item.ProductID, destination(order.ShippingAddress))
+            }
+        }
+    }
+    return nil
+}
+
+// Helper function to check an order against the rules of the given types,
+// or every rule when none are given. Returns the first rule it breaks and
+// why; the refusal is counted.
+func (rules orderRules) check(order Order, types ...string) (OrderRule, error) {
+    for _, rule := range rules {
+        if len(types) > 0 && !containsString(types, rule.Type) {
+            continue
+        }
+        if err := rule.check(order); err != nil {
+            ruleRejectionsMu.Lock()
+            ruleRejections[rule.Name]++
+            ruleRejectionsMu.Unlock()
+            return rule, err
+        }
+    }
+    return OrderRule{}, nil
+}
+
+// Helper function to check whether values holds value
+func containsString(values []string, value string) bool {
+    for _, candidate := range values {
+        if candidate == value {
+            return true
+        }
+    }
+    return false
+}
+
+// Helper function to read the rules from ORDER_RULES, or the file
+// ORDER_RULES_FILE names. Neither set means no rules.
+func loadOrderRules(inline string, path string) (orderRules, error) {
+    source, data := "ORDER_RULES", []byte(inline)
+    if path != "" {
+        if inline != "" {
+            return nil, fmt.Errorf("set ORDER_RULES or ORDER_RULES_FILE, not both")
+        }
+        contents, err := os.ReadFile(path)
+        if err != nil {
+            return nil, fmt.Errorf("ORDER_RULES_FILE: %v", err)
+        }
+        source, data = "ORDER_RULES_FILE "+path, contents
+    }
+    if len(bytes.TrimSpace(data)) == 0 {
+        return nil, nil
+    }
+
+    // Unknown fields are refused, so a misspelt limit isn't silently ignored
+    var rules orderRules
+    decoder := json.NewDecoder(bytes.NewReader(data))
+    decoder.DisallowUnknownFields()
+    if err := decoder.Decode(&rules); err != nil {
+        return nil, fmt.Errorf("%s must be a JSON array of rules: %v", source, err)
+    }
+    if err := rules.normalize(); err != nil {
+        return nil, fmt.Errorf("%s: %v", source, err)
+    }
+    return rules, nil
+}
+
+// Helper function to check and normalize parsed rules
+func (rules orderRules) normalize() error {
+    names := make(map[string]bool)
+    for i := range rules {
+        rule := &rules[i]
+        rule.Name = strings.TrimSpace(rule.Name)
+        if rule.Name == "" {
+            rule.Name = rule.Type
+        }
+        if names[rule.Name] {
+            return fmt.Errorf("rule %q appears twice; give each rule its own name", rule.Name)
+        }
+        names[rule.Name] = true
+
+        for j, product := range rule.Products {
+            rule.Products[j] = strings.TrimSpace(product)
+        }
+        switch rule.Type {
+        case RuleMaxTotal:
+            currency, err := money.NormalizeCurrency(rule.Currency)
+            if err != nil || rule.Currency == "" {
+                return fmt.Errorf("rule %q needs the ISO 4217 currency of the orders it limits", rule.Name)
+            }
+            rule.Currency = currency
+            if rule.MaxCents <= 0 {
+                return fmt.Errorf("rule %q needs a positive max_cents", rule.Name)
+            }
+        case RuleMaxItemQuantity:
+            if rule.MaxQuantity <= 0 {
+                return fmt.Errorf("rule %q needs a positive max_quantity", rule.Name)
+            }
+        case RuleRestrictedProducts:
+            if len(rule.Products) == 0 || len(rule.Regions) == 0 {
+                return fmt.Errorf("rule %q needs the products it restricts and the regions they can't go to", rule.Name)
+            }
+            for j, region := range rule.Regions {
+                rule.Regions[j] = strings.ToUpper(strings.TrimSpace(region))
+            }
+        default:
+            return fmt.Errorf("rule %q has type %q; use %s, %s or %s", rule.Name, rule.Type,
+                RuleMaxTotal, RuleMaxItemQuantity, RuleRestrictedProducts)
+        }
+    }
+    return nil
+}
+
+// String formats the rules as JSON, for display
+func (rules orderRules) String() string {
+    if len(rules) == 0 {
+        return ""
+    }
+    data, _ := json.Marshal(rules)
+    return string(data)
+}
+
+// Helper function to render the rule metrics
+func orderRuleMetrics() string {
+    ruleRejectionsMu.Lock()
+    defer ruleRejectionsMu.Unlock()
+
+    names := make([]string, 0, len(ruleRejections))
+    for name := range ruleRejections {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+
+    metrics := `
+# HELP order_service_order_rule_rejections_total Orders refused by a validation rule, by rule; see order_rules.go
+# TYPE order_service_order_rule_rejections_total counter
+`
+    for _, name := range names {
+        metrics += fmt.Sprintf("order_service_order_rule_rejections_total{rule=%q} %d\n", name, ruleRejections[name])
+    }
+    return metrics
+}
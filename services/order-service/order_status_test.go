@@ -0,0 +1,137 @@
+package main
+
+import "testing"
+
+func TestCanTransition(t *testing.T) {
+    tests := []struct {
+        from string
+        to   string
+        want bool
+    }{
+        {StatusCreated, StatusPaid, true},
+        {StatusCreated, StatusPending, true},
+        {StatusPending, StatusProcessing, true},
+        {StatusPaymentFailed, StatusPending, true},
+        {StatusCreated, StatusProcessing, true},
+        {StatusProcessing, StatusPendingPayment, true},
+        {StatusPendingPayment, StatusPaid, true},
+        {StatusPaymentFailed, StatusProcessing, true},
+        {StatusOnHold, StatusPaid, true},
+        {StatusPaid, StatusPartiallyShipped, true},
+        {StatusPartiallyShipped, StatusShipped, true},
+        {StatusShipped, StatusDelivered, true},
+        {StatusDelivered, StatusRefunded, true},
+        {StatusOnHold, StatusCancelled, true},
+
+        {StatusCreated, StatusShipped, false},
+        {StatusCreated, StatusRefunded, false},
+        {StatusPaymentFailed, StatusPaid, false},
+        {StatusOnHold, StatusProcessing, false},
+        {StatusPaid, StatusCancelled, false},
+        {StatusShipped, StatusCancelled, false},
+        {StatusPartiallyShipped, StatusCancelled, false},
+        {StatusDelivered, StatusShipped, false},
+        {StatusPaid, StatusPaid, false},
+        {StatusCancelled, StatusPaid, false},
+        {StatusRefunded, StatusPaid, false},
+        {StatusPending, StatusPaid, false},
+        {StatusPaid, StatusPending, false},
+        {"unknown", StatusPaid, false},
+    }
+    for _, tt := range tests {
+        if got := canTransition(tt.from, tt.to); got != tt.want {
+            t.Errorf("canTransition(%q, %q) = %v, want %v", tt.from, tt.to, got, tt.want)
+        }
+    }
+}
+
+// Every transition leads to a known status, and every status but the final
+// ones can still move
+func TestOrderTransitionsAreClosed(t *testing.T) {
+    for from, next := range orderTransitions {
+        for _, to := range next {
+            if !isOrderStatus(to) {
+                t.Errorf("%s may move to unknown status %q", from, to)
+            }
+        }
+        final := from == StatusCancelled || from == StatusRefunded
+        if final != (len(next) == 0) {
+            t.Errorf("%s has %d transitions, final = %v", from, len(next), final)
+        }
+    }
+}
+
+// PUT /status can't move an order past payment, fraud review or
+// checkout: whatever it sets is only reachable from an order already paid
+func TestManualStatusesFollowPayment(t *testing.T) {
+    for from, next := range orderTransitions {
+        for _, to := range next {
+            if manualStatuses[to] && !paymentCompleted(from) {
+                t.Errorf("PUT /status could move %s to %s", from, to)
+            }
+        }
+    }
+}
+
+func TestPaymentCompleted(t *testing.T) {
+    completed := map[string]bool{
+        StatusPaid:             true,
+        StatusPartiallyShipped: true,
+        StatusShipped:          true,
+        StatusDelivered:        true,
+        StatusRefunded:         true,
+    }
+    for status := range orderTransitions {
+        if got := paymentCompleted(status); got != completed[status] {
+            t.Errorf("paymentCompleted(%q) = %v, want %v", status, got, completed[status])
+        }
+    }
+}
+
+// Status changes are recorded in order, and orders from before the history
+// get one backfilled first
+func TestSetStatusRecordsHistory(t *testing.T) {
+    order := Order{OrderID: "order-1", Status: StatusPaid, CreatedAt: 100, UpdatedAt: 200, StatusActor: ActorCheckout}
+    setStatus(&order, StatusShipped, "user:admin-1", "label printed")
+    setStatus(&order, StatusDelivered, ActorSaga, "")
+
+    want := []StatusChange{
+        {To: StatusCreated, At: 100, Backfilled: true},
+        {To: StatusPaid, Actor: ActorCheckout, At: 200, Backfilled: true},
+        {From: StatusPaid, To: StatusShipped, Actor: "user:admin-1", Reason: "label printed"},
+        {From: StatusShipped, To: StatusDelivered, Actor: ActorSaga},
+    }
+    if len(order.StatusHistory) != len(want) {
+        t.Fatalf("history has %d changes, want %d: %+v", len(order.StatusHistory), len(want), order.StatusHistory)
+    }
+    for i, change := range order.StatusHistory {
+        if i >= 2 {
+            if change.At == 0 {
+                t.Errorf("change %d has no time", i)
+            }
+            change.At = 0
+        }
+        if change != want[i] {
+            t.Errorf("change %d = %+v, want %+v", i, change, want[i])
+        }
+    }
+    if order.Status != StatusDelivered || order.StatusActor != ActorSaga || order.StatusReason != "" {
+        t.Errorf("order is %s by %q (%q), want %s by %q", order.Status, order.StatusActor, order.StatusReason, StatusDelivered, ActorSaga)
+    }
+}
+
+// The stored order's history is not changed through a copy that shares it
+func TestSetStatusCopiesHistory(t *testing.T) {
+    history := make([]StatusChange, 1, 4)
+    history[0] = StatusChange{To: StatusCreated, At: 100}
+    stored := Order{OrderID: "order-1", Status: StatusCreated, CreatedAt: 100, StatusHistory: history}
+
+    copied := stored
+    setStatus(&copied, StatusPaid, ActorCheckout, "")
+    if spare := history[:2][1]; spare != (StatusChange{}) {
+        t.Errorf("stored history changed through a copy: %+v", spare)
+    }
+    if len(copied.StatusHistory) != 2 {
+        t.Errorf("copy has %d changes, want 2", len(copied.StatusHistory))
+    }
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "log"
+    "net/http"
+    "os"
+    "strconv"
+    "strings"
+    "sync"
+    "sync/atomic"
+    "time"
+
+    "github.com/gorilla/mux"
+    "middleware/httpserver"
+    "middleware/i18n"
+)
+
+// Order stream settings. Streams are long-lived, so they don't count
+// against MAX_IN_FLIGHT_REQUESTS; MAX_ORDER_STREAMS caps them instead
+// (0 disables the cap).
+const (
+    DefaultMaxOrderStreams = 1000
+    OrderStreamHeartbeat   = 15 * time.Second
+    OrderStreamRetryMs     = 3000 // reconnect delay suggested to clients
+)
+
+// Open streams, by order ID. Watchers are only told that an order
+// changed; each stream reads the order itself and sends the status
+// changes it hasn't sent yet, so a burst of changes is never lost.
+var (
+    maxOrderStreams = DefaultMaxOrderStreams
+    orderWatchers   = make(map[string]map[chan struct{}]bool)
+    orderWatcherMu  sync.Mutex
+    openStreams     atomic.Int64
+    rejectedStreams atomic.Int64
+)
+
+func init() {
+    if value := os.Getenv("MAX_ORDER_STREAMS"); value != "" {
+        if parsed, err := strconv.Atoi(value); err == nil && parsed >= 0 {
+            maxOrderStreams = parsed
+        } else {
+            log.Printf("Ignoring invalid MAX_ORDER_STREAMS=%q", value)
+        }
+    }
+}
+
+// Helper function to check whether a request opens an order event stream
+func isOrderStreamRequest(r *http.Request) bool {
+    return r.Method == http.MethodGet && strings.HasPrefix(r.URL.Path, "/api/") && strings.HasSuffix(r.URL.Path, "/events")
+}
+
+// Helper function to start watching an order. The returned function stops.
+func watchOrder(orderID string) (chan struct{}, func()) {
+    changed := make(chan struct{}, 1)
+
+    orderWatcherMu.Lock()
+    if orderWatchers[orderID] == nil {
+        orderWatchers[orderID] = make(map[chan struct{}]bool)
+    }
+    orderWatchers[orderID][changed] = true
+    orderWatcherMu.Unlock()
+
+    return changed, func() {
+        orderWatcherMu.Lock()
+        delete(orderWatchers[orderID], changed)
+        if len(orderWatchers[orderID]) == 0 {
+            delete(orderWatchers, orderID)
+        }
+        orderWatcherMu.Unlock()
+    }
+}
+
+// Helper function to wake an order's streams without blocking. Called
+// under the order's shard lock.
+func notifyOrderWatchers(orderID string) {
+    orderWatcherMu.Lock()
+    defer orderWatcherMu.Unlock()
+
+    for changed := range orderWatchers[orderID] {
+        select {
+        case changed <- struct{}{}:
+        default:
+        }
+    }
+}
+
+// Helper function to write one server-sent event and flush it
+func writeSSE(w http.ResponseWriter, flusher http.Flusher, event string, id string, data interface{}) error {
+    payload, err := json.Marshal(data)
+    if err != nil {
+        return err
+    }
+    if id != "" {
+        if _, err := fmt.Fprintf(w, "id: %s\n", id); err != nil {
+            return err
+        }
+    }
+    if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, payload); err != nil {
+        return err
+    }
+    flusher.Flush()
+    return nil
+}
+
+// Stream an order's status changes as server-sent events. The stream opens
+// with an "order" event carrying the current status, then sends a
+// "status" event for each change, with the change's position in the
+// status history as its id. A client reconnecting with Last-Event-ID gets
+// the changes it missed instead of the "order" event. The stream ends
+// after a final status, or with a "gone" event if the order is archived.
+func streamOrderEventsHandler(w http.ResponseWriter, r *http.Request) {
+    orderID := resolveOrderID(mux.Vars(r)["orderId"])
+
+    flusher, canFlush := w.(http.Flusher)
+    if !canFlush {
+        http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+        return
+    }
+
+    // Watch before the first read so a change in between isn't missed
+    changed, stop := watchOrder(orderID)
+    defer stop()
+
+    order, exists := getOrder(orderID)
+    if !exists {
+        i18n.WriteError(w, r, http.StatusNotFound, "order.not_found")
+        return
+    }
+
+    open := openStreams.Add(1)
+    defer openStreams.Add(-1)
+    if maxOrderStreams > 0 && open > int64(maxOrderStreams) {
+        rejectedStreams.Add(1)
+        w.Header().Set("Retry-After", strconv.Itoa(OrderStreamRetryMs/1000))
+        http.Error(w, "Too many open order streams, retry later", http.StatusServiceUnavailable)
+        return
+    }
+
+    sent := 0
+    resuming := false
+    if value := r.Header.Get("Last-Event-ID"); value != "" {
+        if parsed, err := strconv.Atoi(value); err == nil && parsed >= 0 {
+            sent = parsed
+            resuming = true
+        }
+    }
+
+    httpserver.LiftDeadlines(w)
+    w.Header().Set("Content-Type", "text/event-stream")
+    w.Header().Set("Cache-Control", "no-cache")
+    w.Header().Set("X-Accel-Buffering", "no") // don't let nginx buffer the stream
+    w.WriteHeader(http.StatusOK)
+    fmt.Fprintf(w, "retry: %d\n\n", OrderStreamRetryMs)
+
+    if !resuming {
+        sent = len(statusHistory(order))
+        err := writeSSE(w, flusher, "order", strconv.Itoa(sent), map[string]interface{}{
+            "order_id":      order.OrderID,
+            "order_number":  order.OrderNumber,
+            "status":        order.Status,
+            "status_reason": order.StatusReason,
+            "updated_at":    order.UpdatedAt,
+        })
+        if err != nil {
+            return
+        }
+    }
+
+    heartbeat := time.NewTicker(OrderStreamHeartbeat)
+    defer heartbeat.Stop()
+
+    for {
+        history := statusHistory(order)
+        for ; sent < len(history); sent++ {
+            change := history[sent]
+            err := writeSSE(w, flusher, "status", strconv.Itoa(sent+1), map[string]interface{}{
+                "order_id":     order.OrderID,
+                "order_number": order.OrderNumber,
+                "from":         change.From,
+                "status":       change.To,
+                "reason":       change.Reason,
+                "at":           change.At,
+            })
+            if err != nil {
+                return
+            }
+        }
+        if len(orderTransitions[order.Status]) == 0 {
+            return
+        }
+
+        select {
+        case <-r.Context().Done():
+            return
+        case <-shutdownStarted:
+            // The client reconnects, to another instance, and resumes
+            return
+        case <-heartbeat.C:
+            if _, err := fmt.Fprint(w, ": ping\n\n"); err != nil {
+                return
+            }
+            flusher.Flush()
+        case <-changed:
+            order, exists = getOrder(orderID)
+            if !exists {
+                writeSSE(w, flusher, "gone", "", map[string]string{"order_id": orderID})
+                return
+            }
+        }
+    }
+}
+
+// Helper function to report order stream metrics
+func orderStreamMetrics() string {
+    return fmt.Sprintf(`
+# HELP order_service_order_streams_open Open order event streams
+# TYPE order_service_order_streams_open gauge
+order_service_order_streams_open %d
+
+# HELP order_service_order_streams_rejected_total Order event streams refused over MAX_ORDER_STREAMS
+# TYPE order_service_order_streams_rejected_total counter
+order_service_order_streams_rejected_total %d
+`, openStreams.Load(), rejectedStreams.Load())
+}
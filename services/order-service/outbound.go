@@ -0,0 +1,21 @@
+package main
+
+import (
+    "net/http"
+    "time"
+
+    "middleware/outbound"
+)
+
+// Outbound HTTP. Every call this service makes goes through clients built
+// by newHTTPClient, on the shared transport of pkg/middleware/outbound
+// (proxies from the environment, OUTBOUND_CA_BUNDLE), which this service
+// wraps to count and time each call by the service it went to (see
+// downstream.go)
+var outboundTransport http.RoundTripper = &downstreamTransport{Next: outbound.Transport}
+
+// Helper function to create an HTTP client on the outbound transport. A
+// zero timeout means none.
+func newHTTPClient(timeout time.Duration) *http.Client {
+    return &http.Client{Transport: outboundTransport, Timeout: timeout}
+}
@@ -0,0 +1,333 @@
+package main
+
+import (
+    "errors"
+    "fmt"
+    "log"
+    "sort"
+    "sync/atomic"
+    "time"
+
+    "github.com/google/uuid"
+)
+
+// Outbox settings. Failed deliveries back off exponentially up to
+// OutboxRetryMax and are retried until they succeed.
+const (
+    OutboxPollInterval = time.Second
+    OutboxRetryBase    = time.Second
+    OutboxRetryMax     = 5 * time.Minute
+    OutboxBatchSize    = 100 // events per delivery
+)
+
+// Kinds of outbox entry
+const (
+    OutboxEvent        = "event"
+    OutboxNotification = "notification"
+    OutboxWebhook      = "webhook"
+)
+
+// outboxEntry is a side effect of an order write waiting to be delivered.
+// Entries live in the order's shard and are written to the same snapshot
+// as the order, so an order change and its side effects are persisted
+// together or not at all.
+type outboxEntry struct {
+    ID            string               `json:"id"`
+    Seq           int64                `json:"seq"` // delivery order
+    Kind          string               `json:"kind"`
+    OrderID       string               `json:"order_id"`
+    Event         *OrderEvent          `json:"event,omitempty"`
+    Notification  *NotificationRequest `json:"notification,omitempty"`
+    WebhookID     string               `json:"webhook_id,omitempty"` // for webhook entries, which carry an Event
+    UserID        string               `json:"user_id,omitempty"`    // for notification entries, whose recipient is looked up on delivery
+    CreatedAt     int64                `json:"created_at"`
+    Attempts      int                  `json:"attempts,omitempty"`
+    NextAttemptAt int64                `json:"next_attempt_at,omitempty"`
+    LastError     string               `json:"last_error,omitempty"`
+}
+
+// orderEffects lists the side effects of an order write: the lifecycle
+// events to announce and the notifications to send
+type orderEffects struct {
+    TraceID       string   // of the request that changed the order
+    Events        []string // event types; "" is skipped
+    Notifications []string // notification templates
+}
+
+// Outbox sequencing. outboxDurableSeq is the highest sequence number known
+// to be in a snapshot on disk; only entries up to it are delivered, so a
+// side effect never goes out for an order change a crash could still lose.
+var (
+    outboxSeq        atomic.Int64
+    outboxDurableSeq atomic.Int64
+    outboxKick       = make(chan struct{}, 1)
+)
+
+// Outbox counters
+var (
+    outboxDelivered atomic.Int64
+    outboxRetried   atomic.Int64
+    outboxAbandoned atomic.Int64 // webhook deliveries given up on
+)
+
+// Helper function to record an order write's side effects in the outbox.
+// Callers must hold the order's shard lock and call this with the order
+// as written by putOrder.
+func recordEffects(shard *orderShard, order Order, effects orderEffects) {
+    now := time.Now().Unix()
+    add := func(entry *outboxEntry) {
+        entry.ID = "ob_" + uuid.New().String()
+        entry.Seq = outboxSeq.Add(1)
+        entry.OrderID = order.OrderID
+        entry.CreatedAt = now
+        shard.outbox[entry.ID] = entry
+    }
+
+    for _, eventType := range effects.Events {
+        if eventType == "" {
+            continue
+        }
+        event := newOrderEvent(eventType, order, order.UpdatedAt, effects.TraceID)
+        if orderEventsEnabled() {
+            add(&outboxEntry{Kind: OutboxEvent, Event: &event})
+        }
+        for _, webhookID := range webhooksFor(eventType) {
+            add(&outboxEntry{Kind: OutboxWebhook, WebhookID: webhookID, Event: &event})
+        }
+    }
+    if config().NotificationServiceURL != "" {
+        for _, template := range effects.Notifications {
+            data := map[string]interface{}{
+                "order_id":  order.OrderID,
+                "timestamp": time.Unix(now, 0).Format(time.RFC3339),
+            }
+            if template == "order_shipped" && order.EstimatedDelivery != nil {
+                data["estimated_delivery_from"] = order.EstimatedDelivery.Earliest
+                data["estimated_delivery_to"] = order.EstimatedDelivery.Latest
+            }
+            // The recipient is looked up on delivery; see recipients.go
+            add(&outboxEntry{Kind: OutboxNotification, UserID: order.UserID, Notification: &NotificationRequest{
+                Type:     "email",
+                Template: template,
+                Data:     data,
+            }})
+        }
+    }
+    snapshotDirty.Store(true)
+
+    // Without snapshots there is nothing to wait for
+    if snapshotPath == "" {
+        outboxDurableSeq.Store(outboxSeq.Load())
+        kickOutbox()
+    }
+}
+
+// Helper function to restore outbox entries from a snapshot
+func restoreOutbox(entries []outboxEntry) {
+    var highest int64
+    for i := range entries {
+        entry := entries[i]
+        shard := shardFor(entry.OrderID)
+        shard.mu.Lock()
+        shard.outbox[entry.ID] = &entry
+        shard.mu.Unlock()
+        highest = max(highest, entry.Seq)
+    }
+    if highest > outboxSeq.Load() {
+        outboxSeq.Store(highest)
+    }
+    // Everything restored came from disk
+    outboxDurableSeq.Store(outboxSeq.Load())
+}
+
+// Helper function to note that a snapshot holding every entry up to seq
+// reached disk, and wake the dispatcher to deliver them
+func outboxPersisted(seq int64) {
+    if seq > outboxDurableSeq.Load() {
+        outboxDurableSeq.Store(seq)
+    }
+    kickOutbox()
+}
+
+// Helper function to wake the dispatcher without blocking
+func kickOutbox() {
+    select {
+    case outboxKick <- struct{}{}:
+    default:
+    }
+}
+
+// Helper function to copy the pending entries, oldest first
+func pendingOutbox() []outboxEntry {
+    var entries []outboxEntry
+    for _, shard := range orderShards {
+        shard.mu.RLock()
+        for _, entry := range shard.outbox {
+            entries = append(entries, *entry)
+        }
+        shard.mu.RUnlock()
+    }
+    sort.Slice(entries, func(i, j int) bool { return entries[i].Seq < entries[j].Seq })
+    return entries
+}
+
+// Helper function to record a delivery attempt: delivered entries leave
+// the outbox, failed ones are scheduled for another try
+func settleOutboxEntry(entry outboxEntry, err error) {
+    shard := shardFor(entry.OrderID)
+    shard.mu.Lock()
+    defer shard.mu.Unlock()
+
+    stored, exists := shard.outbox[entry.ID]
+    if !exists {
+        return
+    }
+    if err == nil {
+        delete(shard.outbox, entry.ID)
+        snapshotDirty.Store(true)
+        outboxDelivered.Add(1)
+        return
+    }
+
+    stored.Attempts++
+    if stored.Kind == OutboxWebhook && stored.Attempts >= WebhookMaxAttempts {
+        delete(shard.outbox, entry.ID)
+        snapshotDirty.Store(true)
+        outboxAbandoned.Add(1)
+        log.Printf("Giving up on webhook %s delivery %s for order %s after %d attempts: %v",
+            stored.WebhookID, stored.ID, stored.OrderID, stored.Attempts, err)
+        return
+    }
+    delay := OutboxRetryMax
+    if stored.Attempts < 20 {
+        delay = min(OutboxRetryBase<<(stored.Attempts-1), OutboxRetryMax)
+    }
+    stored.NextAttemptAt = time.Now().Add(delay).Unix()
+    stored.LastError = err.Error()
+    outboxRetried.Add(1)
+    log.Printf("Outbox %s %s for order %s failed (attempt %d), retrying in %s: %v",
+        stored.Kind, stored.ID, stored.OrderID, stored.Attempts, delay, err)
+}
+
+// Helper function to take an entry out of the outbox without delivering it
+func removeOutboxEntry(entry outboxEntry) {
+    shard := shardFor(entry.OrderID)
+    shard.mu.Lock()
+    defer shard.mu.Unlock()
+
+    if _, exists := shard.outbox[entry.ID]; exists {
+        delete(shard.outbox, entry.ID)
+        snapshotDirty.Store(true)
+    }
+}
+
+// Helper function to make one delivery pass. Events go out in batches;
+// notifications are addressed and handed to the notification queue, whose
+// journal takes over from there, and webhooks are called one delivery at a time.
+// An order's entries go out in the order they were recorded, per kind and
+// webhook, so one waiting to retry holds back the ones after it.
+// Returns true when entries were left for lack of room in the batch.
+func dispatchOutbox() bool {
+    durable := outboxDurableSeq.Load()
+    now := time.Now().Unix()
+
+    var events []outboxEntry
+    more := false
+    blocked := make(map[string]bool) // kind:webhook ID:order ID
+    for _, entry := range pendingOutbox() {
+        key := entry.Kind + ":" + entry.WebhookID + ":" + entry.OrderID
+        if blocked[key] || entry.Seq > durable || entry.NextAttemptAt > now {
+            blocked[key] = true
+            continue
+        }
+
+        switch entry.Kind {
+        case OutboxEvent:
+            if len(events) == OutboxBatchSize {
+                more = true
+                blocked[key] = true
+                continue
+            }
+            events = append(events, entry)
+        case OutboxNotification:
+            notification, err := addressNotification(entry)
+            if errors.Is(err, errNoRecipient) {
+                dropUnaddressedNotification(entry)
+                continue
+            }
+            if err == nil {
+                err = queueNotification(notification)
+            }
+            settleOutboxEntry(entry, err)
+            if err != nil {
+                blocked[key] = true
+            }
+        case OutboxWebhook:
+            err := deliverWebhook(entry)
+            settleOutboxEntry(entry, err)
+            if err != nil {
+                blocked[key] = true
+            }
+        }
+    }
+
+    if len(events) > 0 {
+        batch := make([]OrderEvent, 0, len(events))
+        for _, entry := range events {
+            batch = append(batch, *entry.Event)
+        }
+        err := deliverOrderEvents(batch)
+        for _, entry := range events {
+            settleOutboxEntry(entry, err)
+        }
+    }
+    return more
+}
+
+// Dispatcher loop: deliver outbox entries once their snapshot is on disk,
+// and retry failed ones as they come due
+func outboxDispatcher() {
+    ticker := time.NewTicker(OutboxPollInterval)
+    defer ticker.Stop()
+
+    for {
+        select {
+        case <-outboxKick:
+        case <-ticker.C:
+        }
+        if dispatchOutbox() {
+            kickOutbox()
+        }
+    }
+}
+
+// Helper function to report outbox metrics
+func outboxMetrics() string {
+    entries := pendingOutbox()
+    oldest := int64(0)
+    if len(entries) > 0 {
+        oldest = time.Now().Unix() - entries[0].CreatedAt
+    }
+
+    return fmt.Sprintf(`
+# HELP order_service_outbox_pending Order side effects (events, notifications) not yet delivered
+# TYPE order_service_outbox_pending gauge
+order_service_outbox_pending %d
+
+# HELP order_service_outbox_oldest_age_seconds Age of the oldest undelivered side effect
+# TYPE order_service_outbox_oldest_age_seconds gauge
+order_service_outbox_oldest_age_seconds %d
+
+# HELP order_service_outbox_delivered_total Side effects delivered from the outbox
+# TYPE order_service_outbox_delivered_total counter
+order_service_outbox_delivered_total %d
+
+# HELP order_service_outbox_retries_total Failed outbox deliveries that were retried
+# TYPE order_service_outbox_retries_total counter
+order_service_outbox_retries_total %d
+
+# HELP order_service_webhook_deliveries_abandoned_total Webhook deliveries given up on after too many failures
+# TYPE order_service_webhook_deliveries_abandoned_total counter
+order_service_webhook_deliveries_abandoned_total %d
+`, len(entries), oldest, outboxDelivered.Load(), outboxRetried.Load(), outboxAbandoned.Load())
+}
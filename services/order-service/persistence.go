@@ -0,0 +1,268 @@
+package main
+
+import (
+    "encoding/json"
+    "log"
+    "os"
+    "path/filepath"
+    "strconv"
+    "sync"
+    "sync/atomic"
+    "time"
+)
+
+// SnapshotVersion is bumped whenever the on-disk layout changes
+const SnapshotVersion = 3
+
+// orderSnapshot is the on-disk representation of the order store
+type orderSnapshot struct {
+    Version              int                        `json:"version"`
+    TakenAt              int64                      `json:"taken_at"`
+    Orders               map[string]Order           `json:"orders"`
+    UserOrders           map[string][]string        `json:"user_orders"`
+    OrderNumberSequences map[string]int             `json:"order_number_sequences,omitempty"` // scope -> last number issued
+    Outbox               []outboxEntry              `json:"outbox,omitempty"`                 // undelivered side effects
+    Webhooks             []Webhook                  `json:"webhooks,omitempty"`
+    Notes                map[string][]OrderNote     `json:"notes,omitempty"`                  // order ID -> notes; see notes.go
+    FraudScreenings      map[string]FraudScreening  `json:"fraud_screenings,omitempty"`       // order ID -> screening that flagged it; see fraud.go
+    Activity             map[string][]TimelineEntry `json:"activity,omitempty"`               // order ID -> payment attempts, commits and notifications; see timeline.go
+}
+
+// Snapshot settings (SNAPSHOT_PATH="" disables persistence)
+var (
+    snapshotPath     = os.Getenv("SNAPSHOT_PATH")
+    snapshotInterval = 30 * time.Second
+    snapshotDirty    atomic.Bool
+    snapshotMu       sync.Mutex // serializes writers to the snapshot file
+)
+
+func init() {
+    if _, set := os.LookupEnv("SNAPSHOT_PATH"); !set {
+        snapshotPath = "data/orders.snapshot.json"
+    }
+    if value := os.Getenv("SNAPSHOT_INTERVAL_SECONDS"); value != "" {
+        if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+            snapshotInterval = time.Duration(seconds) * time.Second
+        }
+    }
+}
+
+// Helper function to reload orders from the last snapshot on startup
+func loadSnapshot() error {
+    if snapshotPath == "" {
+        return nil
+    }
+
+    data, err := os.ReadFile(snapshotPath)
+    if os.IsNotExist(err) {
+        return nil
+    }
+    if err != nil {
+        return err
+    }
+
+    data, from, applied, err := migrateSnapshot(data)
+    if err != nil {
+        return err
+    }
+
+    var snapshot orderSnapshot
+    if err := json.Unmarshal(data, &snapshot); err != nil {
+        return err
+    }
+
+    // Go through putOrder so derived indexes are rebuilt
+    for _, order := range snapshot.Orders {
+        shard := shardFor(order.OrderID)
+        shard.mu.Lock()
+        putOrder(shard, order)
+        shard.mu.Unlock()
+    }
+    if snapshot.UserOrders != nil {
+        userMu.Lock()
+        userOrders = snapshot.UserOrders
+        userMu.Unlock()
+    }
+    restoreOrderNumberSequences(snapshot.OrderNumberSequences)
+    restoreOutbox(snapshot.Outbox)
+    restoreWebhooks(snapshot.Webhooks)
+    restoreOrderNotes(snapshot.Notes)
+    restoreFraudScreenings(snapshot.FraudScreenings)
+    restoreOrderActivity(snapshot.Activity)
+    snapshotDirty.Store(false)
+    snapshotDiskVersion.Store(int64(from))
+
+    log.Printf("Restored %d orders from snapshot taken at %s",
+        len(snapshot.Orders), time.Unix(snapshot.TakenAt, 0).UTC().Format(time.RFC3339))
+
+    // Rewrite a migrated snapshot straight away so the file on disk matches
+    // this build; if that fails, /health reports it and /admin/migrate retries
+    if len(applied) > 0 {
+        if err := flushSnapshot(); err != nil {
+            log.Printf("Failed to write migrated order snapshot: %v", err)
+        }
+    }
+    return nil
+}
+
+// Helper function to write the order store to disk. The snapshot is written
+// to a temp file, fsynced, then renamed over the old one so a crash mid-write
+// never leaves a truncated snapshot behind.
+func saveSnapshot() error {
+    if snapshotPath == "" {
+        return nil
+    }
+
+    snapshotMu.Lock()
+    defer snapshotMu.Unlock()
+
+    // Clear the dirty flag before copying so writes that land during the
+    // copy are picked up by the next snapshot
+    snapshotDirty.Store(false)
+
+    // Outbox entries numbered up to here are in their shards by now, so
+    // the copy below includes them (unless they were already delivered)
+    outboxWatermark := outboxSeq.Load()
+
+    snapshot := orderSnapshot{
+        Version:              SnapshotVersion,
+        TakenAt:              time.Now().Unix(),
+        Orders:               make(map[string]Order),
+        OrderNumberSequences: orderNumberSequences(),
+        Webhooks:             snapshotWebhooks(),
+        Notes:                snapshotOrderNotes(),
+        FraudScreenings:      snapshotFraudScreenings(),
+        Activity:             snapshotOrderActivity(),
+    }
+    // Orders and their outbox entries are copied under one lock, so the
+    // snapshot holds a write and its side effects together
+    for _, shard := range orderShards {
+        shard.mu.RLock()
+        for orderID, order := range shard.orders {
+            snapshot.Orders[orderID] = order
+        }
+        for _, entry := range shard.outbox {
+            snapshot.Outbox = append(snapshot.Outbox, *entry)
+        }
+        shard.mu.RUnlock()
+    }
+
+    // The user index is copied rather than marshalled under its lock, which
+    // would hold up every checkout for as long as the store takes to encode
+    userMu.RLock()
+    snapshot.UserOrders = make(map[string][]string, len(userOrders))
+    for userID, orderIDs := range userOrders {
+        snapshot.UserOrders[userID] = append([]string(nil), orderIDs...)
+    }
+    userMu.RUnlock()
+
+    data, err := json.Marshal(snapshot)
+    if err != nil {
+        return err
+    }
+
+    dir := filepath.Dir(snapshotPath)
+    if err := os.MkdirAll(dir, 0755); err != nil {
+        return err
+    }
+
+    tmp, err := os.CreateTemp(dir, ".orders-snapshot-*")
+    if err != nil {
+        return err
+    }
+    defer os.Remove(tmp.Name())
+
+    if _, err := tmp.Write(data); err != nil {
+        tmp.Close()
+        return err
+    }
+    if err := tmp.Sync(); err != nil {
+        tmp.Close()
+        return err
+    }
+    if err := tmp.Close(); err != nil {
+        return err
+    }
+    if err := os.Rename(tmp.Name(), snapshotPath); err != nil {
+        return err
+    }
+
+    // Persist the rename itself
+    if d, err := os.Open(dir); err == nil {
+        d.Sync()
+        d.Close()
+    }
+    snapshotDiskVersion.Store(SnapshotVersion)
+    outboxPersisted(outboxWatermark)
+    return nil
+}
+
+// Flush requests from critical writes. Concurrent requests are coalesced
+// into one snapshot (group commit) so a burst of checkouts pays for one
+// write instead of queueing behind one another.
+var snapshotRequests = make(chan chan error, 1024)
+
+// Helper function to flush a snapshot after a critical write (payment
+// outcome, cancellation) and wait for it to reach disk. Failures are logged;
+// the periodic loop retries.
+func persistOrders() {
+    if snapshotPath == "" {
+        return
+    }
+
+    done := make(chan error, 1)
+    snapshotRequests <- done
+    if err := <-done; err != nil {
+        log.Printf("Failed to write order snapshot: %v", err)
+    }
+}
+
+// Helper function to write a snapshot, re-marking the store dirty on failure
+func flushSnapshot() error {
+    err := saveSnapshot()
+    if err != nil {
+        snapshotDirty.Store(true)
+    }
+    return err
+}
+
+// Write snapshots on request and periodically when the store has changed
+func snapshotLoop() {
+    if snapshotPath == "" {
+        return
+    }
+
+    ticker := time.NewTicker(snapshotInterval)
+    defer ticker.Stop()
+
+    for {
+        select {
+        case request := <-snapshotRequests:
+            // Every queued request was made after its write landed, so one
+            // snapshot started now covers all of them
+            waiters := []chan error{request}
+        drain:
+            for {
+                select {
+                case next := <-snapshotRequests:
+                    waiters = append(waiters, next)
+                default:
+                    break drain
+                }
+            }
+
+            err := flushSnapshot()
+            for _, waiter := range waiters {
+                waiter <- err
+            }
+
+        case <-ticker.C:
+            if snapshotDirty.Load() {
+                if err := flushSnapshot(); err != nil {
+                    log.Printf("Failed to write order snapshot: %v", err)
+                }
+            }
+        }
+    }
+}
+
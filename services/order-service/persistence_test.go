@@ -0,0 +1,135 @@
+package main
+
+import (
+    "fmt"
+    "path/filepath"
+    "sync"
+    "sync/atomic"
+    "testing"
+    "time"
+)
+
+// Orders in the store while persistence is benchmarked, about what a busy
+// day leaves hot
+const benchmarkOrderCount = 10000
+
+var startSnapshotLoop sync.Once
+
+// Helper function to fill the store with orders and point snapshots at a
+// temp dir. The snapshot loop is started once and follows snapshotPath.
+func setupPersistenceBenchmark(b *testing.B) {
+    b.Helper()
+    snapshotPath = filepath.Join(b.TempDir(), "orders.snapshot.json")
+    resetOrderShards()
+    userMu.Lock()
+    userOrders = make(map[string][]string)
+    userMu.Unlock()
+
+    now := time.Now().Unix()
+    for i := 0; i < benchmarkOrderCount; i++ {
+        order := benchmarkOrder(i, now)
+        shard := shardFor(order.OrderID)
+        shard.mu.Lock()
+        putOrder(shard, order)
+        shard.mu.Unlock()
+        userOrders[order.UserID] = append(userOrders[order.UserID], order.OrderID)
+    }
+    startSnapshotLoop.Do(func() { go snapshotLoop() })
+}
+
+// Helper function to build a paid order with a couple of items
+func benchmarkOrder(i int, now int64) Order {
+    return Order{
+        OrderID:    fmt.Sprintf("bench-order-%d", i),
+        UserID:     fmt.Sprintf("bench-user-%d", i%500),
+        Items:      []OrderItem{{ProductID: "prod-1", Quantity: 2, PriceCents: 1999}, {ProductID: "prod-2", Quantity: 1, PriceCents: 550}},
+        TotalCents: 4548,
+        Currency:   "USD",
+        Status:     StatusPaid,
+        PaymentID:  fmt.Sprintf("pay-%d", i),
+        CreatedAt:  now,
+        UpdatedAt:  now,
+    }
+}
+
+// Helper function to take the user index lock as a checkout does, without
+// growing the index
+func touchUserIndex(userID string) {
+    userMu.Lock()
+    userOrders[userID] = userOrders[userID]
+    userMu.Unlock()
+}
+
+// Critical writes as checkout makes them: update an order and the user
+// index, then wait for the snapshot. group_commit is persistOrders;
+// per_write flushes a snapshot for every write, as before group commit.
+func BenchmarkPersistOrders(b *testing.B) {
+    for _, mode := range []struct {
+        name    string
+        persist func()
+    }{
+        {"group_commit", persistOrders},
+        {"per_write", func() { flushSnapshot() }},
+    } {
+        b.Run(mode.name, func(b *testing.B) {
+            setupPersistenceBenchmark(b)
+            var next atomic.Int64
+            now := time.Now().Unix()
+
+            b.ResetTimer()
+            b.RunParallel(func(pb *testing.PB) {
+                for pb.Next() {
+                    order := benchmarkOrder(int(next.Add(1))%benchmarkOrderCount, now)
+                    shard := shardFor(order.OrderID)
+                    shard.mu.Lock()
+                    putOrder(shard, order)
+                    shard.mu.Unlock()
+
+                    touchUserIndex(order.UserID)
+
+                    mode.persist()
+                }
+            })
+        })
+    }
+}
+
+// Writes that don't wait for a snapshot, e.g. checkouts still processing,
+// while snapshots are written back to back: how long the snapshot holds
+// up the store
+func BenchmarkWritesDuringSnapshot(b *testing.B) {
+    setupPersistenceBenchmark(b)
+
+    stop := make(chan struct{})
+    var snapshots sync.WaitGroup
+    snapshots.Add(1)
+    go func() {
+        defer snapshots.Done()
+        for {
+            select {
+            case <-stop:
+                return
+            default:
+                flushSnapshot()
+            }
+        }
+    }()
+
+    var next atomic.Int64
+    now := time.Now().Unix()
+    b.ResetTimer()
+    b.RunParallel(func(pb *testing.PB) {
+        for pb.Next() {
+            order := benchmarkOrder(int(next.Add(1))%benchmarkOrderCount, now)
+            shard := shardFor(order.OrderID)
+            shard.mu.Lock()
+            putOrder(shard, order)
+            shard.mu.Unlock()
+
+            touchUserIndex(order.UserID)
+        }
+    })
+    b.StopTimer()
+    close(stop)
+    snapshots.Wait()
+}
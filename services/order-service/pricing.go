@@ -0,0 +1,126 @@
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "net/http"
+    "net/url"
+    "time"
+
+    "middleware/i18n"
+    "money"
+)
+
+// Price checks. The prices an order is built from come from the client
+// (a cart snapshot, or the placeholder cart), so when PRODUCT_SERVICE_URL
+// is set each product's current price is fetched from product-service at
+// order creation. If any price moved since the cart was priced, the order
+// isn't placed: PRICE_CHANGE_POLICY=confirm (the default) answers 409 with
+// the new prices, which the client confirms by sending them back as
+// confirmed_prices; reject answers 409 and the customer checks out again.
+const (
+    PriceChangeConfirm = "confirm"
+    PriceChangeReject  = "reject"
+)
+
+var productClient = newHTTPClient(3 * time.Second)
+
+// PriceChange is a product whose price moved since the cart was priced
+type PriceChange struct {
+    ProductID        string `json:"product_id"`
+    QuotedPriceCents int    `json:"quoted_price_cents"` // what the cart said
+    PriceCents       int    `json:"price_cents"`        // what product-service says now
+}
+
+// Helper function to fetch a product's current unit price from
+// product-service. A product it doesn't know gives a message error.
+func currentPrice(productID string, currency string) (int, error) {
+    resp, err := productClient.Get(fmt.Sprintf("%s/api/products/%s", config().ProductServiceURL, url.PathEscape(productID)))
+    if err != nil {
+        return 0, err
+    }
+    defer resp.Body.Close()
+
+    if resp.StatusCode == http.StatusNotFound {
+        return 0, i18n.NewError("order.product_unavailable", productID)
+    }
+    if resp.StatusCode != http.StatusOK {
+        return 0, fmt.Errorf("product service returned status %d", resp.StatusCode)
+    }
+    var product struct {
+        PriceCents int    `json:"price_cents"`
+        Currency   string `json:"currency"`
+    }
+    if err := json.NewDecoder(resp.Body).Decode(&product); err != nil {
+        return 0, err
+    }
+    // Products without a currency are priced in the default one, as in
+    // product-service
+    productCurrency, err := money.NormalizeCurrency(product.Currency)
+    if err != nil || productCurrency != currency {
+        return 0, i18n.NewError("order.product_currency_mismatch", productID, currency)
+    }
+    return product.PriceCents, nil
+}
+
+// Helper function to compare an order's lines with product-service's
+// current prices. Returns the prices by product and the lines whose price
+// moved, one per product.
+func priceChanges(items []OrderItem, currency string) (map[string]int, []PriceChange, error) {
+    prices := make(map[string]int)
+    var changes []PriceChange
+    for _, item := range items {
+        if _, checked := prices[item.ProductID]; checked {
+            continue
+        }
+        price, err := currentPrice(item.ProductID, currency)
+        if err != nil {
+            return nil, nil, err
+        }
+        prices[item.ProductID] = price
+        if price != item.PriceCents {
+            changes = append(changes, PriceChange{ProductID: item.ProductID, QuotedPriceCents: item.PriceCents, PriceCents: price})
+        }
+    }
+    return prices, changes, nil
+}
+
+// Helper function to check the client confirmed every changed price at
+// the price it has now
+func pricesConfirmed(changes []PriceChange, confirmed map[string]int) bool {
+    for _, change := range changes {
+        if price, exists := confirmed[change.ProductID]; !exists || price != change.PriceCents {
+            return false
+        }
+    }
+    return true
+}
+
+// Helper function to re-price an order's lines at the current prices
+func repriceItems(items []OrderItem, prices map[string]int) []OrderItem {
+    repriced := append([]OrderItem(nil), items...)
+    for i := range repriced {
+        repriced[i].PriceCents = prices[repriced[i].ProductID]
+    }
+    return repriced
+}
+
+// Helper function to answer a checkout whose prices moved, in the
+// caller's language. The changes are listed so the client can show them,
+// and confirmable says whether sending them back as confirmed_prices will
+// place the order.
+func writePriceChanged(w http.ResponseWriter, r *http.Request, changes []PriceChange) {
+    locale := i18n.NegotiateLocale(r.Header.Get("Accept-Language"))
+
+    w.Header().Set(i18n.ErrorCodeHeader, "order.price_changed")
+    w.Header().Set("Content-Language", locale)
+    w.Header().Add("Vary", "Accept-Language")
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(http.StatusConflict)
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "error":         i18n.Message(locale, "order.price_changed"),
+        "code":          "order.price_changed",
+        "price_changes": changes,
+        "confirmable":   config().PriceChangePolicy == PriceChangeConfirm,
+    })
+}
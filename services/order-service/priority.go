@@ -0,0 +1,61 @@
+package main
+
+import (
+    "fmt"
+    "strings"
+)
+
+// Order priority. Orders shipped by one of EXPRESS_SHIPPING_METHODS are
+// express, the rest standard. The priority is set at checkout from the
+// shipping method and carried on the order, so admin listings and exports
+// (priority=) and order events see it, and the checkout workers take
+// queued express checkouts ahead of standard ones (see checkout.go).
+// Orders from before priorities have none and count as standard.
+const (
+    PriorityStandard = "standard"
+    PriorityExpress  = "express"
+)
+
+// DefaultExpressShippingMethods is EXPRESS_SHIPPING_METHODS when it isn't set
+const DefaultExpressShippingMethods = "express"
+
+// Helper function to work out the priority a shipping method gives an order
+func shippingPriority(method string) string {
+    for _, express := range config().ExpressShippingMethods {
+        if express == method {
+            return PriorityExpress
+        }
+    }
+    return PriorityStandard
+}
+
+// Helper function to get an order's priority, standard for older orders
+// without one
+func priorityOf(order Order) string {
+    if order.Priority == "" {
+        return PriorityStandard
+    }
+    return order.Priority
+}
+
+// Helper function to parse EXPRESS_SHIPPING_METHODS: comma-separated
+// shipping methods, each offered by DELIVERY_SLAS
+func parseExpressShippingMethods(value string, slas slaTable) ([]string, error) {
+    offered := make(map[string]bool)
+    for _, method := range slas.Methods() {
+        offered[method] = true
+    }
+
+    var methods []string
+    for _, method := range strings.Split(value, ",") {
+        method = strings.ToLower(strings.TrimSpace(method))
+        if method == "" {
+            continue
+        }
+        if !offered[method] {
+            return nil, fmt.Errorf("EXPRESS_SHIPPING_METHODS names %q, which DELIVERY_SLAS doesn't offer", method)
+        }
+        methods = append(methods, method)
+    }
+    return methods, nil
+}
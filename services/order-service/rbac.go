@@ -0,0 +1,160 @@
+package main
+
+import (
+    "net/http"
+    "os"
+    "strings"
+    "time"
+
+    "github.com/gorilla/mux"
+    "middleware/adminauth"
+    "middleware/versioning"
+)
+
+// Role-based access control. Every order and admin route is allowed to a
+// set of roles (routeRoles); a request's roles come from how it
+// authenticated:
+//
+//   - customer: any signed-in user-service JWT (JWT_SECRET)
+//   - support, admin: a user-service JWT carrying that role; ADMIN_TOKEN
+//     is admin
+//   - system: another service, with an HS256 token signed with
+//     SERVICE_TOKEN_SECRET whose roles include system
+//
+// Service tokens use their own secret so user-service, which signs user
+// tokens, can't mint them; a user token claiming system is not trusted.
+const (
+    RoleCustomer = "customer"
+    RoleSupport  = "support"
+    RoleAdmin    = "admin"
+    RoleSystem   = "system"
+)
+
+// Verifies service tokens. Without it no caller gets the system role, so
+// routes only services call are refused, just as payment callbacks are
+// refused without PAYMENT_CALLBACK_SECRET.
+var serviceTokenSecret = os.Getenv("SERVICE_TOKEN_SECRET")
+
+// Roles allowed on each route, by method and path template without its
+// /api/<version> or /api prefix. Order routes not listed are open to every
+// role (customers only reach their own orders; see auth.go), admin routes
+// not listed to admins only.
+var routeRoles = map[string][]string{
+    "PUT /orders/{orderId}/status":                            {RoleSupport, RoleAdmin, RoleSystem},
+    "POST /orders/{orderId}/shipments":                        {RoleSupport, RoleAdmin, RoleSystem},
+    "POST /orders/{orderId}/refund":                           {RoleSupport, RoleAdmin},
+    "POST /orders/{orderId}/retry-payment":                    {RoleCustomer, RoleSupport, RoleAdmin},
+    "POST /orders/analytics/funnel/events":                    {RoleSystem},
+    "GET /orders/analytics":                                   {RoleAdmin},
+    "GET /orders/analytics/revenue":                           {RoleAdmin},
+    "GET /orders/analytics/top-products":                      {RoleAdmin},
+    "GET /orders/analytics/top-customers":                     {RoleAdmin},
+    "GET /orders/analytics/funnel":                            {RoleAdmin},
+    "GET /admin/orders":                                       {RoleSupport, RoleAdmin},
+    "GET /admin/orders/export":                                {RoleAdmin, RoleSystem},
+    "GET /admin/orders/archived":                              {RoleSupport, RoleAdmin},
+    "GET /admin/orders/archived/{orderId}":                    {RoleSupport, RoleAdmin},
+    "POST /admin/orders/replay":                               {RoleAdmin, RoleSystem},
+    "POST /admin/orders/expire":                               {RoleAdmin, RoleSystem},
+    "GET /admin/orders/reviews":                               {RoleSupport, RoleAdmin},
+    "POST /admin/orders/{orderId}/review/approve":             {RoleSupport, RoleAdmin},
+    "POST /admin/orders/{orderId}/review/reject":              {RoleSupport, RoleAdmin},
+    "POST /admin/orders/{orderId}/returns/{returnId}/approve": {RoleSupport, RoleAdmin},
+    "POST /admin/orders/{orderId}/returns/{returnId}/reject":  {RoleSupport, RoleAdmin},
+    "GET /admin/returns":                                      {RoleSupport, RoleAdmin},
+    "GET /admin/backup":                                       {RoleAdmin, RoleSystem},
+    "POST /admin/archive/run":                                 {RoleAdmin, RoleSystem},
+}
+
+// Routes that authenticate themselves and skip RBAC: payment-service signs
+// its callbacks (PAYMENT_CALLBACK_SECRET)
+var selfAuthenticatedRoutes = map[string]bool{
+    "POST /orders/{orderId}/payment-callback": true,
+}
+
+// principal is who a request comes from
+type principal struct {
+    ID       string // "admin", "user:<id>" or "system:<service>"
+    UserID   string // the user-service user, if any
+    ActingAs string // the customer a support agent acts for
+    Roles    []string
+}
+
+// Helper function to check whether a principal has one of roles
+func (p principal) hasRole(roles ...string) bool {
+    for _, role := range p.Roles {
+        for _, allowed := range roles {
+            if role == allowed {
+                return true
+            }
+        }
+    }
+    return false
+}
+
+// Helper function to work out who a request comes from. Returns false
+// when it carries no token any configured secret accepts.
+func requestPrincipal(r *http.Request) (principal, bool) {
+    token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+    if token == "" {
+        return principal{}, false
+    }
+    if adminauth.IsAdminToken(token) {
+        return principal{ID: "admin", Roles: []string{RoleAdmin}}, true
+    }
+
+    now := time.Now()
+    if serviceTokenSecret != "" {
+        if claims, err := verifyToken(serviceTokenSecret, token, now); err == nil && hasRole(claims, []string{RoleSystem}) {
+            return principal{ID: "system:" + claims.UserID, Roles: []string{RoleSystem}}, true
+        }
+    }
+    if jwtSecret == "" {
+        return principal{}, false
+    }
+    claims, err := verifyAgentToken(token, now)
+    if err != nil {
+        return principal{}, false
+    }
+
+    p := principal{
+        ID:       "user:" + claims.UserID,
+        UserID:   claims.UserID,
+        ActingAs: strings.TrimSpace(r.Header.Get(ActingAsHeader)),
+        Roles:    []string{RoleCustomer},
+    }
+    for _, role := range claims.Roles {
+        if role == RoleSupport || role == RoleAdmin {
+            p.Roles = append(p.Roles, role)
+        }
+    }
+    return p, true
+}
+
+// Helper function to name a request's route for routeRoles
+func routePolicyKey(r *http.Request) string {
+    route := mux.CurrentRoute(r)
+    if route == nil {
+        return ""
+    }
+    template, _ := route.GetPathTemplate()
+    for _, version := range versioning.Names() {
+        if strings.HasPrefix(template, "/api/"+version+"/") {
+            template = strings.TrimPrefix(template, "/api/"+version)
+            break
+        }
+    }
+    return r.Method + " " + strings.TrimPrefix(template, "/api")
+}
+
+// Helper function to list the roles allowed on a request's route
+func allowedRoles(r *http.Request) []string {
+    key := routePolicyKey(r)
+    if roles, exists := routeRoles[key]; exists {
+        return roles
+    }
+    if strings.Contains(key, " /admin/") {
+        return []string{RoleAdmin}
+    }
+    return []string{RoleCustomer, RoleSupport, RoleAdmin, RoleSystem}
+}
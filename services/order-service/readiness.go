@@ -0,0 +1,17 @@
+package main
+
+import "middleware/readiness"
+
+func init() {
+    readiness.Setup(serviceName, readinessDependencies, shuttingDown)
+}
+
+// Dependencies probed for readiness. Payments and inventory are needed to
+// take an order; notifications are queued and journaled, so they're optional.
+func readinessDependencies() []readiness.Dependency {
+    return []readiness.Dependency{
+        {Name: "payment", URL: func() string { return config().PaymentServiceURL }, Required: true},
+        {Name: "inventory", URL: func() string { return config().InventoryServiceURL }, Required: true},
+        {Name: "notification", URL: func() string { return config().NotificationServiceURL }, Required: false},
+    }
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+    "encoding/json"
+    "errors"
+    "fmt"
+    "log"
+    "net/http"
+    "net/mail"
+    "net/url"
+    "strings"
+    "sync"
+    "sync/atomic"
+    "time"
+
+    "middleware/adminauth"
+)
+
+// Notification recipients. Orders only carry the customer's user ID, so a
+// notification's email address is looked up when the outbox hands it to
+// the notification queue, not when the order changes: from the email
+// claim of the customer's own user-service JWT seen at checkout, from the
+// user ID when it is an email, or from user-service (USER_SERVICE_URL,
+// called with ADMIN_TOKEN). A lookup that fails leaves the notification in
+// the outbox, which retries it with backoff; one for a user that doesn't
+// exist, or with nowhere to look, is dropped.
+
+// Addresses are reused for this long before user-service is asked again.
+// Expired ones are swept out once the cache holds RecipientCacheSize.
+const (
+    RecipientCacheTTL  = 10 * time.Minute
+    RecipientCacheSize = 10000
+)
+
+// errNoRecipient means the customer has no address to notify
+var errNoRecipient = errors.New("no email address for user")
+
+type cachedRecipient struct {
+    Email     string
+    FetchedAt time.Time
+}
+
+var (
+    recipientCache   = make(map[string]cachedRecipient)
+    recipientCacheMu sync.Mutex
+    userClient       = newHTTPClient(3 * time.Second)
+)
+
+// Recipient counters
+var (
+    recipientLookups      atomic.Int64
+    recipientLookupErrors atomic.Int64
+    notificationsNoEmail  atomic.Int64
+)
+
+// Helper function to remember the email of the customer placing an order,
+// from their own verified user-service JWT. Agents acting for a customer
+// carry their own email, so it is ignored for them.
+func rememberRecipient(r *http.Request, userID string) {
+    if jwtSecret == "" || strings.TrimSpace(r.Header.Get(ActingAsHeader)) != "" {
+        return
+    }
+    token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+    claims, err := verifyAgentToken(token, time.Now())
+    if err != nil || claims.UserID != userID || claims.Email == "" {
+        return
+    }
+
+    cacheRecipient(userID, claims.Email)
+}
+
+// Helper function to cache a user's email address
+func cacheRecipient(userID string, email string) {
+    recipientCacheMu.Lock()
+    defer recipientCacheMu.Unlock()
+
+    if len(recipientCache) >= RecipientCacheSize {
+        for cachedID, cached := range recipientCache {
+            if time.Since(cached.FetchedAt) >= RecipientCacheTTL {
+                delete(recipientCache, cachedID)
+            }
+        }
+    }
+    recipientCache[userID] = cachedRecipient{Email: email, FetchedAt: time.Now()}
+}
+
+// Helper function to find the email address to notify a user at. Returns
+// errNoRecipient when there is none to find.
+func resolveRecipient(userID string) (string, error) {
+    recipientCacheMu.Lock()
+    cached, exists := recipientCache[userID]
+    recipientCacheMu.Unlock()
+    if exists && time.Since(cached.FetchedAt) < RecipientCacheTTL {
+        return cached.Email, nil
+    }
+
+    if address, err := mail.ParseAddress(userID); err == nil && address.Address == userID {
+        return userID, nil
+    }
+
+    email, err := lookupUserEmail(userID)
+    if err != nil {
+        return "", err
+    }
+    cacheRecipient(userID, email)
+    return email, nil
+}
+
+// Helper function to ask user-service for a user's email address
+func lookupUserEmail(userID string) (string, error) {
+    baseURL := config().UserServiceURL
+    if baseURL == "" || adminauth.Token() == "" {
+        return "", errNoRecipient
+    }
+
+    recipientLookups.Add(1)
+    req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("%s/admin/users/%s", baseURL, url.PathEscape(userID)), nil)
+    if err != nil {
+        return "", err
+    }
+    req.Header.Set("Authorization", "Bearer "+adminauth.Token())
+    resp, err := userClient.Do(req)
+    if err != nil {
+        recipientLookupErrors.Add(1)
+        return "", err
+    }
+    defer resp.Body.Close()
+
+    if resp.StatusCode == http.StatusNotFound {
+        return "", errNoRecipient
+    }
+    if resp.StatusCode != http.StatusOK {
+        recipientLookupErrors.Add(1)
+        return "", fmt.Errorf("user service returned status %d", resp.StatusCode)
+    }
+    var user struct {
+        Email string `json:"email"`
+    }
+    if err := json.NewDecoder(resp.Body).Decode(&user); err != nil {
+        recipientLookupErrors.Add(1)
+        return "", err
+    }
+    if user.Email == "" {
+        return "", errNoRecipient
+    }
+    return user.Email, nil
+}
+
+// Helper function to address an outbox notification before it is queued.
+// Entries recorded before recipients were looked up already carry one.
+func addressNotification(entry outboxEntry) (NotificationRequest, error) {
+    notification := *entry.Notification
+    if notification.Recipient != "" {
+        return notification, nil
+    }
+    email, err := resolveRecipient(entry.UserID)
+    if err != nil {
+        return notification, err
+    }
+    notification.Recipient = email
+    return notification, nil
+}
+
+// Helper function to give up on a notification nobody can receive
+func dropUnaddressedNotification(entry outboxEntry) {
+    notificationsNoEmail.Add(1)
+    log.Printf("Dropping %s notification for order %s: no email address for user %s",
+        entry.Notification.Template, entry.OrderID, entry.UserID)
+    removeOutboxEntry(entry)
+}
+
+// Helper function to report recipient lookup metrics
+func recipientMetrics() string {
+    return fmt.Sprintf(`
+# HELP order_service_recipient_lookups_total Notification email addresses requested from user-service
+# TYPE order_service_recipient_lookups_total counter
+order_service_recipient_lookups_total %d
+
+# HELP order_service_recipient_lookup_errors_total Email address lookups that failed and were left for retry
+# TYPE order_service_recipient_lookup_errors_total counter
+order_service_recipient_lookup_errors_total %d
+
+# HELP order_service_notifications_unaddressed_total Notifications dropped because the customer has no known email address
+# TYPE order_service_notifications_unaddressed_total counter
+order_service_notifications_unaddressed_total %d
+`, recipientLookups.Load(), recipientLookupErrors.Load(), notificationsNoEmail.Load())
+}
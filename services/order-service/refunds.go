@@ -0,0 +1,381 @@
+package main
+
+import (
+    "bytes"
+    "encoding/json"
+    "fmt"
+    "io"
+    "log"
+    "net/http"
+    "sync"
+    "time"
+
+    "github.com/google/uuid"
+    "github.com/gorilla/mux"
+    "middleware/i18n"
+    "middleware/openmetrics"
+    "money"
+)
+
+// OrderRefund records one refund of an order: the lines refunded, the
+// amount returned to the customer and whether the stock went back
+type OrderRefund struct {
+    RefundID        string       `json:"refund_id"`
+    PaymentRefundID string       `json:"payment_refund_id,omitempty"`
+    PaymentRefunds  []RefundPart `json:"payment_refunds,omitempty"` // split orders: the share refunded to each payment
+    Items           []RefundItem `json:"items"`
+    AmountCents     int          `json:"amount_cents"`
+    SettlementCents int          `json:"settlement_cents,omitempty"` // the amount in the order's settlement currency
+    Reason          string       `json:"reason,omitempty"`
+    Actor           string       `json:"actor"`
+    Restocked       bool         `json:"restocked"`
+    CreatedAt       int64        `json:"created_at"`
+}
+
+// RefundItem is one line of a refund
+type RefundItem struct {
+    ProductID string `json:"product_id"`
+    Quantity  int    `json:"qty"`
+}
+
+// RefundRequest for POST /api/orders/{orderId}/refund. Without items,
+// everything not yet refunded is refunded.
+type RefundRequest struct {
+    Items  []RefundItem `json:"items"`
+    Reason string       `json:"reason"`
+}
+
+// Orders with a refund under way; a second refund is turned away until the
+// first finishes, so the same lines can't be refunded twice
+var (
+    refundMu  sync.Mutex
+    refunding = make(map[string]bool)
+)
+
+// Helper function to work out which units a refund covers. Requested
+// lines are checked against what each order line has left to refund; no
+// lines means all of them.
+func refundLines(order Order, requested []RefundItem) ([]RefundItem, error) {
+    remaining := make(map[string]int)
+    for _, item := range order.Items {
+        remaining[item.ProductID] += item.Quantity - item.RefundedQty
+    }
+
+    if len(requested) == 0 {
+        var lines []RefundItem
+        for _, item := range order.Items {
+            if left := item.Quantity - item.RefundedQty; left > 0 {
+                lines = append(lines, RefundItem{ProductID: item.ProductID, Quantity: left})
+            }
+        }
+        return lines, nil
+    }
+
+    quantities := make(map[string]int)
+    var lines []RefundItem
+    for _, item := range requested {
+        if _, onOrder := remaining[item.ProductID]; !onOrder || item.Quantity <= 0 {
+            return nil, i18n.NewError("order.refund_item_invalid")
+        }
+        if quantities[item.ProductID] == 0 {
+            lines = append(lines, RefundItem{ProductID: item.ProductID})
+        }
+        quantities[item.ProductID] += item.Quantity
+    }
+    for i := range lines {
+        lines[i].Quantity = quantities[lines[i].ProductID]
+        if lines[i].Quantity > remaining[lines[i].ProductID] {
+            return nil, i18n.NewError("order.refund_exceeds_order", lines[i].ProductID)
+        }
+    }
+    return lines, nil
+}
+
+// Helper function to price refund lines at the order's prices, with their
+// share of the tax and less their share of any discount. Units are taken
+// from the order's lines in order, for orders listing a product on more
+// than one line.
+func refundAmount(order Order, lines []RefundItem) (money.Money, error) {
+    total := money.New(0, order.Currency)
+    for _, line := range lines {
+        left := line.Quantity
+        for _, item := range order.Items {
+            if item.ProductID != line.ProductID || left == 0 {
+                continue
+            }
+            units := min(left, item.Quantity-item.RefundedQty)
+            amount, err := money.New(item.PriceCents, order.Currency).Multiply(units)
+            if err != nil {
+                return money.Money{}, err
+            }
+            // The units' share of the tax goes back with them, less their
+            // share of the coupon discount
+            if amount, err = amount.Add(money.New(refundShareCents(item.TaxCents, item, units), order.Currency)); err != nil {
+                return money.Money{}, err
+            }
+            if amount, err = amount.Sub(money.New(refundShareCents(item.DiscountCents, item, units), order.Currency)); err != nil {
+                return money.Money{}, err
+            }
+            if total, err = total.Add(amount); err != nil {
+                return money.Money{}, err
+            }
+            left -= units
+        }
+    }
+    return total, nil
+}
+
+// Helper function to refund part of an order's payment. Returns the
+// payment service's refund ID. The order refund's ID is sent as the
+// Idempotency-Key, so a retried call refunds the payment once.
+func refundPayment(paymentID string, amount money.Money, reason string, refundID string) (string, error) {
+    if config().PaymentServiceURL == "" {
+        return "mock_refund_" + uuid.New().String()[:8], nil
+    }
+
+    body, err := json.Marshal(map[string]interface{}{
+        "amount": amount.Amount,
+        "reason": reason,
+    })
+    if err != nil {
+        return "", err
+    }
+
+    req, err := http.NewRequest(http.MethodPost,
+        fmt.Sprintf("%s/api/payments/%s/refund", config().PaymentServiceURL, paymentID),
+        bytes.NewReader(body))
+    if err != nil {
+        return "", err
+    }
+    req.Header.Set("Content-Type", "application/json")
+    req.Header.Set("Idempotency-Key", refundID)
+
+    resp, err := paymentClient.Do(req)
+    if err != nil {
+        return "", err
+    }
+    defer resp.Body.Close()
+
+    var refundResp struct {
+        Success  bool   `json:"success"`
+        RefundID string `json:"refund_id"`
+        Error    string `json:"error"`
+    }
+    if err := json.NewDecoder(resp.Body).Decode(&refundResp); err != nil {
+        return "", err
+    }
+    if resp.StatusCode >= 300 || !refundResp.Success {
+        return "", fmt.Errorf("payment service returned status %d: %s", resp.StatusCode, refundResp.Error)
+    }
+    return refundResp.RefundID, nil
+}
+
+// Helper function to put a refund's units back into stock. The release ID
+// is the refund's ID, so inventory-service applies a retried call once.
+func releaseOrderStock(orderID string, refundID string, lines []RefundItem) error {
+    if config().InventoryServiceURL == "" {
+        return nil
+    }
+
+    type releaseItem struct {
+        ProductID string `json:"product_id"`
+        Quantity  int    `json:"quantity"`
+    }
+    items := make([]releaseItem, 0, len(lines))
+    for _, line := range lines {
+        items = append(items, releaseItem{ProductID: line.ProductID, Quantity: line.Quantity})
+    }
+    body, err := json.Marshal(map[string]interface{}{
+        "release_id": refundID,
+        "items":      items,
+    })
+    if err != nil {
+        return err
+    }
+
+    client := newServiceClient(inventoryBreaker, 10*time.Second)
+    resp, err := client.Post(
+        fmt.Sprintf("%s/api/inventory/orders/%s/release", config().InventoryServiceURL, orderID),
+        "application/json",
+        bytes.NewReader(body),
+    )
+    if err != nil {
+        return err
+    }
+    resp.Body.Close()
+
+    if resp.StatusCode >= 300 {
+        return fmt.Errorf("inventory service returned status %d", resp.StatusCode)
+    }
+    return nil
+}
+
+// Helper function to mark a refund as under way for an order. Returns
+// false when one already is; callers that get true must call endRefund.
+func beginRefund(orderID string) bool {
+    refundMu.Lock()
+    defer refundMu.Unlock()
+    if refunding[orderID] {
+        return false
+    }
+    refunding[orderID] = true
+    return true
+}
+
+// Helper function to clear the mark set by beginRefund
+func endRefund(orderID string) {
+    refundMu.Lock()
+    delete(refunding, orderID)
+    refundMu.Unlock()
+}
+
+// Helper function to refund lines of an order (checked with refundLines).
+// The payment is refunded first; the units are then released back into
+// stock, and the refund is recorded on the order. Once every unit is
+// refunded the order moves to refunded. A failed restock doesn't undo the
+// refund: it is recorded with restocked false so the stock can be fixed
+// by hand. Callers must hold beginRefund for the order.
+func issueRefund(order Order, lines []RefundItem, reason string, actor string, traceID string) (OrderRefund, Order, error) {
+    amount, err := refundAmount(order, lines)
+    if err != nil {
+        return OrderRefund{}, order, err
+    }
+
+    refund := OrderRefund{
+        RefundID:        "rf_" + uuid.New().String(),
+        Items:           lines,
+        AmountCents:     amount.Amount,
+        SettlementCents: settlementRefundCents(order, amount.Amount),
+        Reason:          reason,
+        Actor:           actor,
+        CreatedAt:       time.Now().Unix(),
+    }
+
+    if amount.Amount > 0 {
+        paymentReason := reason
+        if paymentReason == "" {
+            paymentReason = "requested_by_customer"
+        }
+        if len(order.Payments) > 0 {
+            // Split orders are refunded payment by payment. A failure part
+            // way leaves the earlier shares refunded but unrecorded, and
+            // is logged so they can be reconciled by hand.
+            for _, part := range refundParts(order, amount) {
+                paymentRefundID, err := refundPayment(part.PaymentID, money.New(part.AmountCents, order.Currency), paymentReason, refund.RefundID)
+                if err != nil {
+                    log.Printf("Failed to refund payment %s for order %s after refunding %d of its payments: %v",
+                        part.PaymentID, order.OrderID, len(refund.PaymentRefunds), err)
+                    return OrderRefund{}, order, err
+                }
+                part.PaymentRefundID = paymentRefundID
+                refund.PaymentRefunds = append(refund.PaymentRefunds, part)
+            }
+        } else {
+            paymentRefundID, err := refundPayment(order.PaymentID, amount, paymentReason, refund.RefundID)
+            if err != nil {
+                log.Printf("Failed to refund payment %s for order %s: %v", order.PaymentID, order.OrderID, err)
+                return OrderRefund{}, order, err
+            }
+            refund.PaymentRefundID = paymentRefundID
+        }
+    }
+
+    if err := releaseOrderStock(order.OrderID, refund.RefundID, lines); err != nil {
+        log.Printf("Failed to restock refund %s for order %s: %v", refund.RefundID, order.OrderID, err)
+    } else {
+        refund.Restocked = true
+    }
+
+    shard := shardFor(order.OrderID)
+    shard.mu.Lock()
+    order = shard.orders[order.OrderID]
+    // Copy the lines so the stored order isn't changed in place
+    order.Items = append([]OrderItem(nil), order.Items...)
+    left := make(map[string]int)
+    for _, line := range lines {
+        left[line.ProductID] = line.Quantity
+    }
+    fullyRefunded := true
+    for i := range order.Items {
+        item := &order.Items[i]
+        units := min(left[item.ProductID], item.Quantity-item.RefundedQty)
+        item.RefundedQty += units
+        left[item.ProductID] -= units
+        if item.RefundedQty < item.Quantity {
+            fullyRefunded = false
+        }
+    }
+    order.RefundedCents += refund.AmountCents
+    if len(refund.PaymentRefunds) > 0 {
+        order.Payments = append([]OrderPayment(nil), order.Payments...)
+        for _, part := range refund.PaymentRefunds {
+            for i := range order.Payments {
+                if order.Payments[i].PaymentID == part.PaymentID {
+                    order.Payments[i].RefundedCents += part.AmountCents
+                }
+            }
+        }
+    }
+    order.SettlementRefundedCents += refund.SettlementCents
+    order.Refunds = append(append([]OrderRefund(nil), order.Refunds...), refund)
+    effects := orderEffects{TraceID: traceID, Notifications: []string{"order_refunded"}}
+    if fullyRefunded {
+        setStatus(&order, StatusRefunded, actor, reason)
+        effects.Events = []string{EventOrderRefunded}
+    } else {
+        order.UpdatedAt = time.Now().Unix()
+    }
+    putOrder(shard, order)
+    recordEffects(shard, order, effects)
+    shard.mu.Unlock()
+    persistOrders()
+
+    log.Printf("Refunded %s of order %s (%d lines, restocked: %t)", amount, order.OrderID, len(lines), refund.Restocked)
+    return refund, order, nil
+}
+
+// Refund an order, in full or by line item (see issueRefund)
+func refundOrderHandler(w http.ResponseWriter, r *http.Request) {
+    orderID := resolveOrderID(mux.Vars(r)["orderId"])
+
+    var req RefundRequest
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+        i18n.WriteError(w, r, http.StatusBadRequest, "request.invalid_json")
+        return
+    }
+
+    if !beginRefund(orderID) {
+        w.Header().Set("Retry-After", "1")
+        i18n.WriteError(w, r, http.StatusConflict, "order.refund_in_progress")
+        return
+    }
+    defer endRefund(orderID)
+
+    order, exists := getOrder(orderID)
+    if !exists {
+        i18n.WriteError(w, r, http.StatusNotFound, "order.not_found")
+        return
+    }
+    if !canTransition(order.Status, StatusRefunded) {
+        i18n.WriteError(w, r, http.StatusConflict, "order.invalid_transition", order.Status, StatusRefunded)
+        return
+    }
+
+    lines, err := refundLines(order, req.Items)
+    if err != nil {
+        i18n.WriteMessageError(w, r, http.StatusBadRequest, err, "order.refund_item_invalid")
+        return
+    }
+
+    refund, order, err := issueRefund(order, lines, req.Reason, requestActor(r), openmetrics.TraceID(r))
+    if err != nil {
+        i18n.WriteError(w, r, http.StatusBadGateway, "order.refund_failed")
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "refund": refund,
+        "order":  order,
+    })
+}
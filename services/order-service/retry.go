@@ -0,0 +1,232 @@
+package main
+
+import (
+    "bytes"
+    "fmt"
+    "io"
+    "log"
+    "math/rand"
+    "net/http"
+    "sync"
+    "sync/atomic"
+    "time"
+)
+
+// Retrying outbound calls. Checkout's calls to payment-service and
+// inventory-service go through a retryingClient, so a dropped connection
+// or a 502/503/504 from an instance that is restarting is retried instead
+// of failing the whole checkout:
+//
+//   - OUTBOUND_RETRY_ATTEMPTS bounds the attempts per call (1 turns
+//     retries off)
+//   - the wait doubles from OUTBOUND_RETRY_BACKOFF_MS up to
+//     OUTBOUND_RETRY_MAX_BACKOFF_MS, less a random part of up to
+//     OUTBOUND_RETRY_JITTER_PERCENT, so calls that failed together don't
+//     all retry together
+//   - OUTBOUND_RETRY_BUDGET_PERCENT caps each service's retries at that
+//     share of its calls over RetryBudgetWindow, so a service that is down
+//     gets each call once rather than several times over
+//
+// Each attempt goes through the service's circuit breaker (breaker.go); a
+// call the breaker refuses is not retried.
+//
+// Only calls that are safe to repeat go through it. Reservation commits are
+// idempotent, payment-service answers a second charge for an order with
+// 409, which processPayment resolves to the charge that landed, and
+// refunds carry an Idempotency-Key, so a repeat returns the first refund.
+const (
+    DefaultRetryAttempts      = 3
+    DefaultRetryBackoffMS     = 200
+    DefaultRetryMaxBackoffMS  = 2000
+    DefaultRetryJitterPercent = 50
+    DefaultRetryBudgetPercent = 20
+    MaxRetryAttempts          = 10
+
+    RetryBudgetWindow  = 10 * time.Second
+    RetryBudgetMinimum = 5 // retries always allowed per window, so a quiet service still gets some
+)
+
+// retryingClient retries one service's calls within that service's budget
+type retryingClient struct {
+    Target string // service name, for logs and metrics
+    Client *http.Client
+
+    mu          sync.Mutex
+    windowStart time.Time
+    calls       int // calls in the current budget window
+    retries     int // retries in the current budget window
+
+    retriesTotal    atomic.Int64
+    budgetExhausted atomic.Int64
+}
+
+var (
+    paymentClient   = newRetryingClient(paymentBreaker, 10*time.Second)
+    inventoryClient = newRetryingClient(inventoryBreaker, 10*time.Second)
+    retryingClients = []*retryingClient{paymentClient, inventoryClient}
+)
+
+// Helper function to create a retrying client for a service behind its breaker
+func newRetryingClient(breaker *circuitBreaker, timeout time.Duration) *retryingClient {
+    return &retryingClient{Target: breaker.Target, Client: newServiceClient(breaker, timeout)}
+}
+
+// Helper function to read the retry settings into a configuration
+func loadRetrySettings(cfg *serviceConfig) error {
+    err := loadIntSettings([]intSetting{
+        {"OUTBOUND_RETRY_ATTEMPTS", &cfg.OutboundRetryAttempts, DefaultRetryAttempts, 1, MaxRetryAttempts},
+        {"OUTBOUND_RETRY_BACKOFF_MS", &cfg.OutboundRetryBackoffMS, DefaultRetryBackoffMS, 0, 60000},
+        {"OUTBOUND_RETRY_MAX_BACKOFF_MS", &cfg.OutboundRetryMaxBackoffMS, DefaultRetryMaxBackoffMS, 0, 60000},
+        {"OUTBOUND_RETRY_JITTER_PERCENT", &cfg.OutboundRetryJitter, DefaultRetryJitterPercent, 0, 100},
+        {"OUTBOUND_RETRY_BUDGET_PERCENT", &cfg.OutboundRetryBudget, DefaultRetryBudgetPercent, 0, 100},
+    })
+    if err != nil {
+        return err
+    }
+    if cfg.OutboundRetryMaxBackoffMS < cfg.OutboundRetryBackoffMS {
+        return fmt.Errorf("OUTBOUND_RETRY_MAX_BACKOFF_MS=%d must not be less than OUTBOUND_RETRY_BACKOFF_MS=%d",
+            cfg.OutboundRetryMaxBackoffMS, cfg.OutboundRetryBackoffMS)
+    }
+    return nil
+}
+
+// Helper function to send a GET through the retrying client
+func (c *retryingClient) Get(url string) (*http.Response, error) {
+    req, err := http.NewRequest(http.MethodGet, url, nil)
+    if err != nil {
+        return nil, err
+    }
+    return c.Do(req)
+}
+
+// Helper function to send a POST through the retrying client
+func (c *retryingClient) Post(url string, contentType string, body []byte) (*http.Response, error) {
+    req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+    if err != nil {
+        return nil, err
+    }
+    req.Header.Set("Content-Type", contentType)
+    return c.Do(req)
+}
+
+// Helper function to send a request, retrying transport errors and
+// 502/503/504 responses. When the attempts or the budget run out, the last
+// response or error is returned as it came.
+func (c *retryingClient) Do(req *http.Request) (*http.Response, error) {
+    cfg := config()
+    c.recordCall()
+
+    for attempt := 1; ; attempt++ {
+        resp, err := c.Client.Do(req)
+        if !retryableResponse(resp, err) || attempt >= cfg.OutboundRetryAttempts {
+            return resp, err
+        }
+        // Requests built from a bytes.Reader can be replayed; others can't
+        if req.Body != nil && req.GetBody == nil {
+            return resp, err
+        }
+        if !c.takeRetry(cfg.OutboundRetryBudget) {
+            c.budgetExhausted.Add(1)
+            return resp, err
+        }
+
+        failure := ""
+        if err != nil {
+            failure = err.Error()
+        } else {
+            failure = fmt.Sprintf("status %d", resp.StatusCode)
+            io.Copy(io.Discard, resp.Body)
+            resp.Body.Close()
+        }
+        delay := retryDelay(cfg, attempt)
+        log.Printf("%s %s to %s service failed (attempt %d/%d), retrying in %s: %s",
+            req.Method, req.URL.Path, c.Target, attempt, cfg.OutboundRetryAttempts, delay, failure)
+        c.retriesTotal.Add(1)
+        time.Sleep(delay)
+
+        if req.GetBody != nil {
+            body, err := req.GetBody()
+            if err != nil {
+                return nil, err
+            }
+            req.Body = body
+        }
+    }
+}
+
+// Helper function to check whether a call's outcome is worth retrying:
+// the service couldn't be reached, or said it's briefly unavailable. Calls
+// refused by an open circuit breaker aren't retried; it stays open longer
+// than any backoff.
+func retryableResponse(resp *http.Response, err error) bool {
+    if err != nil {
+        return !isCircuitOpen(err)
+    }
+    switch resp.StatusCode {
+    case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+        return true
+    }
+    return false
+}
+
+// Helper function to work out the wait before a retry: exponential from
+// the base, capped, with up to the jitter percentage taken off at random
+func retryDelay(cfg *serviceConfig, attempt int) time.Duration {
+    delay := time.Duration(cfg.OutboundRetryBackoffMS) * time.Millisecond << (attempt - 1)
+    if maxDelay := time.Duration(cfg.OutboundRetryMaxBackoffMS) * time.Millisecond; delay > maxDelay {
+        delay = maxDelay
+    }
+    if jitter := int64(delay) * int64(cfg.OutboundRetryJitter) / 100; jitter > 0 {
+        delay -= time.Duration(rand.Int63n(jitter + 1))
+    }
+    return delay
+}
+
+// Helper function to start a new budget window once the current one is
+// over. Callers must hold c.mu.
+func (c *retryingClient) rollWindow() {
+    if time.Since(c.windowStart) >= RetryBudgetWindow {
+        c.windowStart = time.Now()
+        c.calls = 0
+        c.retries = 0
+    }
+}
+
+// Helper function to count a call towards the retry budget
+func (c *retryingClient) recordCall() {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    c.rollWindow()
+    c.calls++
+}
+
+// Helper function to spend one retry from the budget, if any is left
+func (c *retryingClient) takeRetry(budgetPercent int) bool {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    c.rollWindow()
+    if c.retries >= RetryBudgetMinimum+c.calls*budgetPercent/100 {
+        return false
+    }
+    c.retries++
+    return true
+}
+
+// Helper function to report retry metrics
+func outboundRetryMetrics() string {
+    metrics := `
+# HELP order_service_outbound_retries_total Outbound calls retried after a transport error or 502/503/504
+# TYPE order_service_outbound_retries_total counter
+`
+    for _, client := range retryingClients {
+        metrics += fmt.Sprintf("order_service_outbound_retries_total{target=%q} %d\n", client.Target, client.retriesTotal.Load())
+    }
+    metrics += `
+# HELP order_service_outbound_retry_budget_exhausted_total Outbound calls not retried because the retry budget was spent
+# TYPE order_service_outbound_retry_budget_exhausted_total counter
+`
+    for _, client := range retryingClients {
+        metrics += fmt.Sprintf("order_service_outbound_retry_budget_exhausted_total{target=%q} %d\n", client.Target, client.budgetExhausted.Load())
+    }
+    return metrics
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "net/http"
+    "strings"
+
+    "github.com/gorilla/mux"
+    "middleware/i18n"
+    "middleware/openmetrics"
+)
+
+// Payment retries. A checkout whose payment is declined before any of it
+// was taken keeps its order, in payment_failed, instead of dropping it.
+// The customer then retries with another payment method on
+// POST /api/orders/{orderId}/retry-payment rather than building the cart
+// again: the retry runs the checkout's payment, inventory and notification
+// steps on the stored order, as the checkout workers do (and counts with
+// them), so the reservations the cart still holds are committed as usual.
+// Orders nobody retries expire like other unpaid orders; see expiry.go.
+
+// RetryPaymentRequest names the payment methods to retry with, as at
+// checkout: payment_method, or payments to split the order over
+type RetryPaymentRequest struct {
+    PaymentMethod string              `json:"payment_method"`
+    Payments      []PaymentInstrument `json:"payments"`
+}
+
+// Helper function to answer a declined checkout in the caller's language,
+// with payment-service's reason. order is the order kept for a retry, if
+// there is one.
+func writePaymentDeclined(w http.ResponseWriter, r *http.Request, message string, order *Order) {
+    locale := i18n.NegotiateLocale(r.Header.Get("Accept-Language"))
+    result := map[string]interface{}{
+        "error":           i18n.Message(locale, "order.payment_declined"),
+        "code":            "order.payment_declined",
+        "payment_message": message,
+    }
+    if order != nil {
+        result["order"] = order
+        result["retry_url"] = fmt.Sprintf("/api/v1/orders/%s/retry-payment", order.OrderID)
+    }
+
+    w.Header().Set(i18n.ErrorCodeHeader, "order.payment_declined")
+    w.Header().Set("Content-Language", locale)
+    w.Header().Add("Vary", "Accept-Language")
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(http.StatusPaymentRequired)
+    json.NewEncoder(w).Encode(result)
+}
+
+// Retry the payment of an order whose payment was declined. Answers as a
+// checkout does: 402 when declined again, 202 with the payment when it
+// asks for authentication (or with Prefer: respond-async), otherwise the
+// order as the retry left it.
+func retryPaymentHandler(w http.ResponseWriter, r *http.Request) {
+    vars := mux.Vars(r)
+    orderID := resolveOrderID(vars["orderId"])
+
+    var req RetryPaymentRequest
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+        i18n.WriteError(w, r, http.StatusBadRequest, "request.invalid_json")
+        return
+    }
+    req.PaymentMethod = strings.TrimSpace(req.PaymentMethod)
+    if req.PaymentMethod == "" && len(req.Payments) == 0 {
+        i18n.WriteError(w, r, http.StatusBadRequest, "order.payment_method_required")
+        return
+    }
+
+    order, exists := getOrder(orderID)
+    if !exists {
+        i18n.WriteError(w, r, http.StatusNotFound, "order.not_found")
+        return
+    }
+    plan, err := planPayments(CreateOrderRequest{PaymentMethod: req.PaymentMethod, Payments: req.Payments}, order.Total())
+    if err != nil {
+        i18n.WriteMessageError(w, r, http.StatusBadRequest, err, "order.payments_invalid")
+        return
+    }
+    async := wantsAsyncCheckout(r)
+
+    // Claim the order; a second retry at the same time finds it in progress
+    shard := shardFor(orderID)
+    shard.mu.Lock()
+    order, exists = shard.orders[orderID]
+    if !exists {
+        shard.mu.Unlock()
+        i18n.WriteError(w, r, http.StatusNotFound, "order.not_found")
+        return
+    }
+    if checkoutInProgress(order.Status) {
+        shard.mu.Unlock()
+        w.Header().Set("Retry-After", "1")
+        i18n.WriteError(w, r, http.StatusConflict, "order.checkout_in_progress")
+        return
+    }
+    if order.Status != StatusPaymentFailed {
+        shard.mu.Unlock()
+        i18n.WriteError(w, r, http.StatusConflict, "order.retry_not_allowed", order.Status)
+        return
+    }
+    if async && checkoutsPending.Add(1) > int64(cap(checkoutQueue)) {
+        shard.mu.Unlock()
+        checkoutsPending.Add(-1)
+        checkoutsRejected.Add(1)
+        w.Header().Set("Retry-After", "5")
+        i18n.WriteError(w, r, http.StatusServiceUnavailable, "order.checkout_busy")
+        return
+    }
+
+    // The declined attempt's payment details go; the retry records its own.
+    // Queued retries wait in pending for a worker, as checkouts do.
+    status := StatusProcessing
+    if async {
+        status = StatusPending
+    }
+    setStatus(&order, status, requestActor(r), "")
+    order.PaymentID, order.Payments, order.PaymentAction = "", nil, nil
+    putOrder(shard, order)
+    shard.mu.Unlock()
+    persistOrders()
+
+    job := &checkoutJob{OrderID: orderID, Payments: plan, TraceID: openmetrics.TraceID(r), ClientIP: clientIP(r), Priority: priorityOf(order)}
+    if async {
+        enqueueCheckout(job)
+
+        statusURL := fmt.Sprintf("/api/v1/orders/%s/status", orderID)
+        w.Header().Set("Content-Type", "application/json")
+        w.Header().Set("Location", statusURL)
+        w.Header().Set("Preference-Applied", "respond-async")
+        w.WriteHeader(http.StatusAccepted)
+        json.NewEncoder(w).Encode(map[string]interface{}{
+            "order":      order,
+            "status_url": statusURL,
+        })
+        return
+    }
+
+    processCheckout(job)
+    order, _ = getOrder(orderID)
+    switch order.Status {
+    case StatusPaymentFailed:
+        writePaymentDeclined(w, r, order.StatusReason, &order)
+    case StatusPendingPayment:
+        w.Header().Set("Content-Type", "application/json")
+        w.WriteHeader(http.StatusAccepted)
+        json.NewEncoder(w).Encode(map[string]interface{}{
+            "order":   order,
+            "payment": order.PaymentAction,
+        })
+    default:
+        w.Header().Set("Content-Type", "application/json")
+        json.NewEncoder(w).Encode(order)
+    }
+}
@@ -0,0 +1,381 @@
+package main
+
+import (
+    "encoding/json"
+    "io"
+    "log"
+    "net/http"
+    "sort"
+    "time"
+
+    "github.com/google/uuid"
+    "github.com/gorilla/mux"
+    "middleware/adminauth"
+    "middleware/i18n"
+    "middleware/openmetrics"
+)
+
+// Return statuses. A customer requests a return of shipped items; an admin
+// rejects it, or approves it, which refunds the items and puts them back
+// into stock (see issueRefund). A return stays approved if the refund
+// fails, and approving it again retries the refund.
+const (
+    ReturnRequested = "requested"
+    ReturnApproved  = "approved"
+    ReturnRejected  = "rejected"
+    ReturnRefunded  = "refunded"
+)
+
+// OrderReturn is a return (RMA) of some of an order's items
+type OrderReturn struct {
+    ReturnID       string       `json:"return_id"`
+    Items          []RefundItem `json:"items"`
+    Reason         string       `json:"reason,omitempty"`
+    Status         string       `json:"status"`
+    RequestedBy    string       `json:"requested_by"`
+    DecidedBy      string       `json:"decided_by,omitempty"`
+    DecisionReason string       `json:"decision_reason,omitempty"`
+    RefundID       string       `json:"refund_id,omitempty"` // set once refunded
+    CreatedAt      int64        `json:"created_at"`
+    UpdatedAt      int64        `json:"updated_at"`
+}
+
+// ReturnRequest for POST /api/orders/{orderId}/returns
+type ReturnRequest struct {
+    Items  []RefundItem `json:"items"`
+    Reason string       `json:"reason"`
+}
+
+// ReturnDecision for the admin approve and reject endpoints
+type ReturnDecision struct {
+    Reason string `json:"reason"`
+}
+
+// returnActor is recorded for decisions made through the admin endpoints
+const returnActor = "admin"
+
+// Helper function to find a return on an order; -1 if there is none
+func findReturn(order Order, returnID string) int {
+    for i, orderReturn := range order.Returns {
+        if orderReturn.ReturnID == returnID {
+            return i
+        }
+    }
+    return -1
+}
+
+// Helper function to check whether an order's items can be returned:
+// only once they have shipped
+func returnable(status string) bool {
+    return status == StatusShipped || status == StatusDelivered
+}
+
+// Helper function to check the lines of a new return against what each
+// product has left: units not refunded and not already in an open return
+func returnLines(order Order, requested []RefundItem) ([]RefundItem, error) {
+    if len(requested) == 0 {
+        return nil, i18n.NewError("order.return_item_invalid")
+    }
+
+    left := make(map[string]int)
+    for _, item := range order.Items {
+        left[item.ProductID] += item.Quantity - item.RefundedQty
+    }
+    for _, orderReturn := range order.Returns {
+        if orderReturn.Status == ReturnRequested || orderReturn.Status == ReturnApproved {
+            for _, item := range orderReturn.Items {
+                left[item.ProductID] -= item.Quantity
+            }
+        }
+    }
+
+    quantities := make(map[string]int)
+    var lines []RefundItem
+    for _, item := range requested {
+        if _, onOrder := left[item.ProductID]; !onOrder || item.Quantity <= 0 {
+            return nil, i18n.NewError("order.return_item_invalid")
+        }
+        if quantities[item.ProductID] == 0 {
+            lines = append(lines, RefundItem{ProductID: item.ProductID})
+        }
+        quantities[item.ProductID] += item.Quantity
+    }
+    for i := range lines {
+        lines[i].Quantity = quantities[lines[i].ProductID]
+        if lines[i].Quantity > left[lines[i].ProductID] {
+            return nil, i18n.NewError("order.return_exceeds_order", lines[i].ProductID)
+        }
+    }
+    return lines, nil
+}
+
+// Request a return of some of an order's items
+func createReturnHandler(w http.ResponseWriter, r *http.Request) {
+    orderID := resolveOrderID(mux.Vars(r)["orderId"])
+
+    var req ReturnRequest
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+        i18n.WriteError(w, r, http.StatusBadRequest, "request.invalid_json")
+        return
+    }
+
+    shard := shardFor(orderID)
+    shard.mu.Lock()
+    order, exists := shard.orders[orderID]
+    if !exists {
+        shard.mu.Unlock()
+        i18n.WriteError(w, r, http.StatusNotFound, "order.not_found")
+        return
+    }
+    if !returnable(order.Status) {
+        shard.mu.Unlock()
+        i18n.WriteError(w, r, http.StatusConflict, "order.return_not_allowed", order.Status)
+        return
+    }
+
+    lines, err := returnLines(order, req.Items)
+    if err != nil {
+        shard.mu.Unlock()
+        i18n.WriteMessageError(w, r, http.StatusBadRequest, err, "order.return_item_invalid")
+        return
+    }
+
+    now := time.Now().Unix()
+    orderReturn := OrderReturn{
+        ReturnID:    "rma_" + uuid.New().String(),
+        Items:       lines,
+        Reason:      req.Reason,
+        Status:      ReturnRequested,
+        RequestedBy: requestActor(r),
+        CreatedAt:   now,
+        UpdatedAt:   now,
+    }
+    order.Returns = append(append([]OrderReturn(nil), order.Returns...), orderReturn)
+    order.UpdatedAt = now
+    putOrder(shard, order)
+    shard.mu.Unlock()
+    persistOrders()
+
+    log.Printf("Return %s requested for order %s (%d lines)", orderReturn.ReturnID, orderID, len(lines))
+
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(http.StatusCreated)
+    json.NewEncoder(w).Encode(orderReturn)
+}
+
+// List an order's returns
+func getReturnsHandler(w http.ResponseWriter, r *http.Request) {
+    order, exists := getOrder(resolveOrderID(mux.Vars(r)["orderId"]))
+    if !exists {
+        i18n.WriteError(w, r, http.StatusNotFound, "order.not_found")
+        return
+    }
+
+    returns := order.Returns
+    if returns == nil {
+        returns = []OrderReturn{}
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "returns": returns,
+        "total":   len(returns),
+    })
+}
+
+// Get one of an order's returns
+func getReturnHandler(w http.ResponseWriter, r *http.Request) {
+    vars := mux.Vars(r)
+    order, exists := getOrder(resolveOrderID(vars["orderId"]))
+    if !exists {
+        i18n.WriteError(w, r, http.StatusNotFound, "order.not_found")
+        return
+    }
+
+    i := findReturn(order, vars["returnId"])
+    if i < 0 {
+        i18n.WriteError(w, r, http.StatusNotFound, "order.return_not_found")
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(order.Returns[i])
+}
+
+// Helper function to change a return under the order's shard lock.
+// update reports whether it changed anything; unchanged returns aren't
+// written. Returns the order and return as they stand, and false if the
+// return doesn't exist.
+func updateReturn(orderID string, returnID string, update func(orderReturn *OrderReturn) bool) (Order, OrderReturn, bool) {
+    shard := shardFor(orderID)
+    shard.mu.Lock()
+    order, exists := shard.orders[orderID]
+    i := -1
+    if exists {
+        i = findReturn(order, returnID)
+    }
+    if i < 0 {
+        shard.mu.Unlock()
+        return order, OrderReturn{}, false
+    }
+
+    // Copy the returns so the stored order isn't changed in place
+    order.Returns = append([]OrderReturn(nil), order.Returns...)
+    if !update(&order.Returns[i]) {
+        shard.mu.Unlock()
+        return order, order.Returns[i], true
+    }
+    order.Returns[i].UpdatedAt = time.Now().Unix()
+    order.UpdatedAt = order.Returns[i].UpdatedAt
+    putOrder(shard, order)
+    shard.mu.Unlock()
+    persistOrders()
+    return order, order.Returns[i], true
+}
+
+// Helper function to read an admin decision body, which may be empty
+func decodeReturnDecision(w http.ResponseWriter, r *http.Request) (ReturnDecision, bool) {
+    var decision ReturnDecision
+    if err := json.NewDecoder(r.Body).Decode(&decision); err != nil && err != io.EOF {
+        http.Error(w, "Invalid JSON", http.StatusBadRequest)
+        return decision, false
+    }
+    return decision, true
+}
+
+// Admin endpoint to approve a return: its items are refunded and put back
+// into stock. Approving a return whose refund failed retries the refund.
+func approveReturnHandler(w http.ResponseWriter, r *http.Request) {
+    vars := mux.Vars(r)
+    orderID := resolveOrderID(vars["orderId"])
+    returnID := vars["returnId"]
+
+    decision, ok := decodeReturnDecision(w, r)
+    if !ok {
+        return
+    }
+
+    // The refund lock also keeps two approvals of one return apart
+    if !beginRefund(orderID) {
+        w.Header().Set("Retry-After", "1")
+        http.Error(w, "A refund for this order is already in progress", http.StatusConflict)
+        return
+    }
+    defer endRefund(orderID)
+
+    order, exists := getOrder(orderID)
+    i := -1
+    if exists {
+        i = findReturn(order, returnID)
+    }
+    if i < 0 {
+        http.Error(w, "Return not found", http.StatusNotFound)
+        return
+    }
+    if status := order.Returns[i].Status; status != ReturnRequested && status != ReturnApproved {
+        http.Error(w, "Return is already "+status, http.StatusConflict)
+        return
+    }
+
+    order, orderReturn, _ := updateReturn(orderID, returnID, func(orderReturn *OrderReturn) bool {
+        if orderReturn.Status != ReturnRequested {
+            return false
+        }
+        orderReturn.Status = ReturnApproved
+        orderReturn.DecidedBy = returnActor
+        orderReturn.DecisionReason = decision.Reason
+        return true
+    })
+    adminauth.Audit(r, "approve_return", map[string]interface{}{"order_id": orderID, "return_id": returnID})
+
+    // Units refunded since the return was requested can't be refunded again
+    lines, err := refundLines(order, orderReturn.Items)
+    if err != nil {
+        http.Error(w, "Return can no longer be refunded: "+err.Error(), http.StatusConflict)
+        return
+    }
+    refund, order, err := issueRefund(order, lines, "return "+returnID, returnActor, openmetrics.TraceID(r))
+    if err != nil {
+        http.Error(w, "Refund failed; the return stays approved, approve it again to retry", http.StatusBadGateway)
+        return
+    }
+
+    order, orderReturn, _ = updateReturn(orderID, returnID, func(orderReturn *OrderReturn) bool {
+        orderReturn.Status = ReturnRefunded
+        orderReturn.RefundID = refund.RefundID
+        return true
+    })
+    log.Printf("Return %s for order %s approved and refunded", returnID, orderID)
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "return": orderReturn,
+        "refund": refund,
+        "order":  order,
+    })
+}
+
+// Admin endpoint to reject a requested return
+func rejectReturnHandler(w http.ResponseWriter, r *http.Request) {
+    vars := mux.Vars(r)
+    orderID := resolveOrderID(vars["orderId"])
+    returnID := vars["returnId"]
+
+    decision, ok := decodeReturnDecision(w, r)
+    if !ok {
+        return
+    }
+
+    var previous string
+    _, orderReturn, found := updateReturn(orderID, returnID, func(orderReturn *OrderReturn) bool {
+        previous = orderReturn.Status
+        if orderReturn.Status != ReturnRequested {
+            return false
+        }
+        orderReturn.Status = ReturnRejected
+        orderReturn.DecidedBy = returnActor
+        orderReturn.DecisionReason = decision.Reason
+        return true
+    })
+    if !found {
+        http.Error(w, "Return not found", http.StatusNotFound)
+        return
+    }
+    if previous != ReturnRequested {
+        http.Error(w, "Only requested returns can be rejected; this one is "+previous, http.StatusConflict)
+        return
+    }
+    adminauth.Audit(r, "reject_return", map[string]interface{}{"order_id": orderID, "return_id": returnID})
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(orderReturn)
+}
+
+// Admin endpoint to list returns across orders, oldest first.
+// ?status= filters by return status, e.g. requested for the review queue.
+func listReturnsHandler(w http.ResponseWriter, r *http.Request) {
+    status := r.URL.Query().Get("status")
+
+    type returnEntry struct {
+        OrderID string `json:"order_id"`
+        UserID  string `json:"user_id"`
+        OrderReturn
+    }
+    returns := []returnEntry{}
+    forEachOrder(func(order Order) {
+        for _, orderReturn := range order.Returns {
+            if status == "" || orderReturn.Status == status {
+                returns = append(returns, returnEntry{OrderID: order.OrderID, UserID: order.UserID, OrderReturn: orderReturn})
+            }
+        }
+    })
+    sort.Slice(returns, func(i, j int) bool {
+        return returns[i].CreatedAt < returns[j].CreatedAt
+    })
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "returns": returns,
+        "total":   len(returns),
+    })
+}
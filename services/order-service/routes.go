@@ -0,0 +1,95 @@
+package main
+
+import (
+    "net/http"
+    "os"
+
+    "github.com/gorilla/mux"
+)
+
+// Route layout. gorilla/mux matches routes in registration order, so
+// literal paths (/archive/..., /by-number/...) are registered before the
+// /{orderId} patterns that would otherwise capture them. A user's orders
+// live under /users/{userId}, and the analytics reports under the admin
+// API (/api/v1/admin/orders/analytics).
+//
+// The routes these replace — /api/orders/{userId} for a user's orders and
+// /api/orders/analytics/... — stay registered for existing clients unless
+// LEGACY_ORDER_ROUTES=false. The legacy GET /api/orders/{id} returns the
+// order when one has that ID, and the user's orders otherwise.
+var legacyOrderRoutes = os.Getenv("LEGACY_ORDER_ROUTES") != "false"
+
+// Legacy route templates and the routes that replace them, so SLOs count
+// both as one
+var legacyRouteAliases = map[string]string{
+    "/api/orders/{userId}": "/api/orders/users/{userId}",
+}
+
+func orderRoutesV1(api *mux.Router) {
+    api.HandleFunc("/analytics/funnel/events", trackFunnelEventHandler).Methods("POST")
+    api.HandleFunc("/archive/users/{userId}", getArchivedUserOrdersHandler).Methods("GET")
+    api.HandleFunc("/archive/{orderId}", getArchivedOrderHandler).Methods("GET")
+    api.HandleFunc("/by-number/{orderNumber}", getOrderByNumberHandler).Methods("GET")
+    api.HandleFunc("/users/{userId}", createOrderHandler).Methods("POST")
+    api.HandleFunc("/users/{userId}", getUserOrdersHandler).Methods("GET")
+    if legacyOrderRoutes {
+        api.HandleFunc("/analytics", getAnalyticsHandler).Methods("GET")
+        api.HandleFunc("/analytics/revenue", getRevenueAnalyticsHandler).Methods("GET")
+        api.HandleFunc("/analytics/top-products", getTopProductsHandler).Methods("GET")
+        api.HandleFunc("/analytics/top-customers", getTopCustomersHandler).Methods("GET")
+        api.HandleFunc("/analytics/funnel", getFunnelHandler).Methods("GET")
+        api.HandleFunc("/{userId}", createOrderHandler).Methods("POST")
+        api.HandleFunc("/{userId}", legacyGetOrdersHandler).Methods("GET")
+    }
+    api.HandleFunc("/{orderId}", getOrderHandler).Methods("GET")
+    api.HandleFunc("/{orderId}/status", getOrderStatusHandler).Methods("GET")
+    api.HandleFunc("/{orderId}/status", updateOrderStatusHandler).Methods("PUT")
+    api.HandleFunc("/{orderId}/history", getOrderHistoryHandler).Methods("GET")
+    api.HandleFunc("/{orderId}/timeline", getOrderTimelineHandler).Methods("GET")
+    api.HandleFunc("/{orderId}/events", streamOrderEventsHandler).Methods("GET")
+    api.HandleFunc("/{orderId}/shipping-address", updateShippingAddressHandler).Methods("PUT")
+    api.HandleFunc("/{orderId}/cancel", cancelOrderHandler).Methods("POST")
+    api.HandleFunc("/{orderId}/retry-payment", retryPaymentHandler).Methods("POST")
+    api.HandleFunc("/{orderId}/refund", refundOrderHandler).Methods("POST")
+    api.HandleFunc("/{orderId}/invoice", getInvoiceHandler).Methods("GET")
+    api.HandleFunc("/{orderId}/shipments", createShipmentHandler).Methods("POST")
+    api.HandleFunc("/{orderId}/shipments", getShipmentsHandler).Methods("GET")
+    api.HandleFunc("/{orderId}/returns", createReturnHandler).Methods("POST")
+    api.HandleFunc("/{orderId}/returns", getReturnsHandler).Methods("GET")
+    api.HandleFunc("/{orderId}/returns/{returnId}", getReturnHandler).Methods("GET")
+    api.HandleFunc("/{orderId}/notes", createNoteHandler).Methods("POST")
+    api.HandleFunc("/{orderId}/notes", getNotesHandler).Methods("GET")
+    api.HandleFunc("/{orderId}/payment-callback", paymentCallbackHandler).Methods("POST")
+}
+
+// Admin API for orders, served under /api/v1/admin/orders with ADMIN_TOKEN
+func adminOrderRoutesV1(admin *mux.Router) {
+    admin.HandleFunc("", listOrdersHandler).Methods("GET")
+    admin.HandleFunc("/export", exportOrdersHandler).Methods("GET")
+    admin.HandleFunc("/archived", listArchivedOrdersHandler).Methods("GET")
+    admin.HandleFunc("/archived/{orderId}", getArchivedOrderHandler).Methods("GET")
+    admin.HandleFunc("/replay", replayOrderEventsHandler).Methods("POST")
+    admin.HandleFunc("/expire", expireOrdersHandler).Methods("POST")
+    admin.HandleFunc("/analytics", getAnalyticsHandler).Methods("GET")
+    admin.HandleFunc("/analytics/revenue", getRevenueAnalyticsHandler).Methods("GET")
+    admin.HandleFunc("/analytics/top-products", getTopProductsHandler).Methods("GET")
+    admin.HandleFunc("/analytics/top-customers", getTopCustomersHandler).Methods("GET")
+    admin.HandleFunc("/analytics/funnel", getFunnelHandler).Methods("GET")
+    admin.HandleFunc("/reviews", listReviewsHandler).Methods("GET")
+    admin.HandleFunc("/{orderId}/metadata", updateOrderMetadataHandler).Methods("PATCH")
+    admin.HandleFunc("/{orderId}/review/approve", approveReviewHandler).Methods("POST")
+    admin.HandleFunc("/{orderId}/review/reject", rejectReviewHandler).Methods("POST")
+    admin.HandleFunc("/{orderId}/returns/{returnId}/approve", approveReturnHandler).Methods("POST")
+    admin.HandleFunc("/{orderId}/returns/{returnId}/reject", rejectReturnHandler).Methods("POST")
+}
+
+// Legacy GET /api/orders/{id}: the order with that ID (or order number),
+// otherwise the orders of the user with that ID
+func legacyGetOrdersHandler(w http.ResponseWriter, r *http.Request) {
+    id := mux.Vars(r)["userId"]
+    if _, exists := getOrder(resolveOrderID(id)); exists {
+        getOrderHandler(w, mux.SetURLVars(r, map[string]string{"orderId": id}))
+        return
+    }
+    getUserOrdersHandler(w, r)
+}
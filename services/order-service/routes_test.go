@@ -0,0 +1,81 @@
+package main
+
+import (
+    "net/http/httptest"
+    "testing"
+
+    "github.com/gorilla/mux"
+)
+
+// Requests whose routing depends on registration order, and the route
+// template each must reach ("" when it must not be routed), with the
+// legacy routes on and off
+func TestRoutePrecedence(t *testing.T) {
+    type routeCase struct {
+        legacy bool
+        method string
+        path   string
+        route  string
+    }
+
+    // Routed the same either way
+    shared := []routeCase{
+        {false, "GET", "/api/v1/orders/users/user-1", "/api/v1/orders/users/{userId}"},
+        {false, "POST", "/api/v1/orders/users/user-1", "/api/v1/orders/users/{userId}"},
+        {false, "GET", "/api/v1/orders/archive/order-1", "/api/v1/orders/archive/{orderId}"},
+        {false, "GET", "/api/v1/orders/archive/users/user-1", "/api/v1/orders/archive/users/{userId}"},
+        {false, "GET", "/api/v1/orders/by-number/ORD-2026-000001", "/api/v1/orders/by-number/{orderNumber}"},
+        {false, "POST", "/api/v1/orders/analytics/funnel/events", "/api/v1/orders/analytics/funnel/events"},
+        {false, "GET", "/api/orders/users/user-1", "/api/orders/users/{userId}"},
+        {false, "GET", "/api/orders/archive/order-1", "/api/orders/archive/{orderId}"},
+        {false, "GET", "/api/v1/admin/orders", "/api/v1/admin/orders"},
+        {false, "GET", "/api/v1/admin/orders/export", "/api/v1/admin/orders/export"},
+        {false, "GET", "/api/v1/admin/orders/archived", "/api/v1/admin/orders/archived"},
+        {false, "GET", "/api/v1/admin/orders/archived/order-1", "/api/v1/admin/orders/archived/{orderId}"},
+        {false, "GET", "/api/v1/admin/orders/analytics", "/api/v1/admin/orders/analytics"},
+        {false, "GET", "/api/v1/admin/orders/analytics/revenue", "/api/v1/admin/orders/analytics/revenue"},
+        {false, "GET", "/api/v1/admin/orders/analytics/funnel", "/api/v1/admin/orders/analytics/funnel"},
+        {false, "GET", "/api/v1/admin/orders/reviews", "/api/v1/admin/orders/reviews"},
+        {false, "POST", "/api/v1/admin/orders/order-1/review/approve", "/api/v1/admin/orders/{orderId}/review/approve"},
+        {false, "POST", "/api/v1/admin/orders/order-1/returns/return-1/approve", "/api/v1/admin/orders/{orderId}/returns/{returnId}/approve"},
+        {false, "POST", "/api/v1/orders/order-1/payment-callback", "/api/v1/orders/{orderId}/payment-callback"},
+        {false, "GET", "/metrics", "/metrics"},
+    }
+
+    tests := []routeCase{
+        {true, "GET", "/api/orders/analytics", "/api/orders/analytics"},
+        {true, "GET", "/api/orders/analytics/revenue", "/api/orders/analytics/revenue"},
+        {true, "GET", "/api/v1/orders/analytics", "/api/v1/orders/analytics"},
+        {true, "GET", "/api/v1/orders/order-1", "/api/v1/orders/{userId}"},
+        {true, "GET", "/api/orders/user-1", "/api/orders/{userId}"},
+        {true, "POST", "/api/orders/user-1", "/api/orders/{userId}"},
+        {false, "GET", "/api/v1/orders/order-1", "/api/v1/orders/{orderId}"},
+        {false, "GET", "/api/orders/order-1", "/api/orders/{orderId}"},
+        {false, "POST", "/api/orders/user-1", ""},
+    }
+    for _, legacy := range []bool{true, false} {
+        for _, tt := range shared {
+            tt.legacy = legacy
+            tests = append(tests, tt)
+        }
+    }
+
+    defer func(enabled bool) { legacyOrderRoutes = enabled }(legacyOrderRoutes)
+    routers := make(map[bool]*mux.Router)
+    for _, legacy := range []bool{true, false} {
+        legacyOrderRoutes = legacy
+        routers[legacy] = newRouter()
+    }
+
+    for _, tt := range tests {
+        req := httptest.NewRequest(tt.method, tt.path, nil)
+        var match mux.RouteMatch
+        route := ""
+        if routers[tt.legacy].Match(req, &match) && match.MatchErr == nil {
+            route, _ = match.Route.GetPathTemplate()
+        }
+        if route != tt.route {
+            t.Errorf("legacy=%v: %s %s is routed to %q, want %q", tt.legacy, tt.method, tt.path, route, tt.route)
+        }
+    }
+}
@@ -0,0 +1,547 @@
+package main
+
+import (
+    "bufio"
+    "bytes"
+    "encoding/json"
+    "fmt"
+    "log"
+    "os"
+    "path/filepath"
+    "sync"
+    "sync/atomic"
+    "time"
+)
+
+// Checkout sagas. A checkout takes the payment and then commits inventory;
+// when a step after the payment fails, the steps that completed are undone
+// in reverse: committed stock is put back and the payment is refunded (or
+// voided, if it was only authorized). Every step is journaled before it
+// runs, so a crash mid-checkout leaves a record the next start picks up
+// and compensates.
+const (
+    SagaPaying       = "paying"       // payment requested, outcome not yet known
+    SagaPaid         = "paid"         // payment taken, committing inventory
+    SagaCompensating = "compensating" // undoing the completed steps
+)
+
+// SagaRetryInterval is how often compensations that failed are retried
+const SagaRetryInterval = 30 * time.Second
+
+// Compact the saga journal once this many sagas have finished since the
+// last rewrite
+const SagaJournalCompactEvery = 1000
+
+// checkoutSaga is the progress of one checkout
+type checkoutSaga struct {
+    OrderID   string                 `json:"order_id"`
+    CartID    string                 `json:"cart_id"`
+    Step      string                 `json:"step"`
+    PaymentID string                 `json:"payment_id,omitempty"`
+    Committed []committedReservation `json:"committed,omitempty"` // committed by this checkout
+    Restocked int                    `json:"restocked,omitempty"` // how many of Committed were put back
+    Reason    string                 `json:"reason,omitempty"`    // why it is being compensated
+    StartedAt int64                  `json:"started_at"`
+    UpdatedAt int64                  `json:"updated_at"`
+}
+
+// committedReservation is a reservation the checkout committed, with what
+// it took out of stock
+type committedReservation struct {
+    ReservationID string `json:"reservation_id"`
+    ProductID     string `json:"product_id"`
+    Quantity      int    `json:"quantity"`
+}
+
+// sagaJournalEntry is one line of the saga journal: the saga's state after
+// a step ("save"), or its end ("done"). Replaying the journal yields the
+// unfinished sagas at their last step.
+type sagaJournalEntry struct {
+    Op      string        `json:"op"` // save, done
+    Saga    *checkoutSaga `json:"saga,omitempty"`
+    OrderID string        `json:"order_id,omitempty"`
+}
+
+// Saga journal (CHECKOUT_SAGA_PATH="" keeps sagas in memory only)
+var sagaJournalPath = os.Getenv("CHECKOUT_SAGA_PATH")
+
+// Saga state, guarded by sagaMu. compensating marks sagas a goroutine is
+// compensating right now, so the retry loop leaves them alone.
+var (
+    sagaMu            sync.Mutex
+    sagaJournal       *os.File
+    activeSagas       = make(map[string]*checkoutSaga)
+    compensating      = make(map[string]bool)
+    sagasSinceCompact int
+)
+
+// Saga counters
+var (
+    sagasCompensated   atomic.Int64
+    sagasCompensateErr atomic.Int64
+    sagasResumed       atomic.Int64
+)
+
+func init() {
+    if _, set := os.LookupEnv("CHECKOUT_SAGA_PATH"); !set {
+        sagaJournalPath = "data/checkout.sagas"
+    }
+}
+
+// Helper function to append a journal entry. Callers must hold sagaMu.
+func appendSagaJournal(entry sagaJournalEntry) error {
+    if sagaJournal == nil {
+        return nil
+    }
+
+    data, err := json.Marshal(entry)
+    if err != nil {
+        return err
+    }
+    if _, err := sagaJournal.Write(append(data, '\n')); err != nil {
+        return err
+    }
+    return sagaJournal.Sync()
+}
+
+// Helper function to record a saga's new state. Callers must hold sagaMu.
+func saveSaga(saga *checkoutSaga) {
+    saga.UpdatedAt = time.Now().Unix()
+    activeSagas[saga.OrderID] = saga
+    if err := appendSagaJournal(sagaJournalEntry{Op: "save", Saga: saga}); err != nil {
+        log.Printf("Failed to journal checkout saga for order %s: %v", saga.OrderID, err)
+    }
+}
+
+// Helper function to start a checkout's saga, before its payment is
+// requested. Pass the payment ID when the payment was taken elsewhere
+// (a completed authentication challenge).
+func beginCheckoutSaga(order Order, paymentID string) *checkoutSaga {
+    saga := &checkoutSaga{
+        OrderID:   order.OrderID,
+        CartID:    order.CartID,
+        Step:      SagaPaying,
+        StartedAt: time.Now().Unix(),
+    }
+    if paymentID != "" {
+        saga.Step = SagaPaid
+        saga.PaymentID = paymentID
+    }
+
+    sagaMu.Lock()
+    defer sagaMu.Unlock()
+    saveSaga(saga)
+    return saga
+}
+
+// Helper function to record that the checkout's payment was taken
+func (saga *checkoutSaga) paymentTaken(paymentID string) {
+    sagaMu.Lock()
+    defer sagaMu.Unlock()
+    saga.Step = SagaPaid
+    saga.PaymentID = paymentID
+    saveSaga(saga)
+}
+
+// Helper function to end a saga whose checkout completed, or that has
+// nothing left to undo
+func finishCheckoutSaga(saga *checkoutSaga) {
+    // A checkout that placed no order leaves no timeline to show
+    if _, stored := getOrder(saga.OrderID); !stored {
+        dropOrderActivity(saga.OrderID)
+    }
+
+    sagaMu.Lock()
+    defer sagaMu.Unlock()
+
+    delete(activeSagas, saga.OrderID)
+    if err := appendSagaJournal(sagaJournalEntry{Op: "done", OrderID: saga.OrderID}); err != nil {
+        log.Printf("Failed to journal checkout saga completion: %v", err)
+    }
+
+    sagasSinceCompact++
+    if sagasSinceCompact >= SagaJournalCompactEvery {
+        if err := compactSagaJournal(); err != nil {
+            log.Printf("Failed to compact checkout saga journal: %v", err)
+        }
+    }
+}
+
+// Helper function to commit the checkout's inventory, recording each
+// reservation committed so a later failure can put the stock back. A
+// resumed saga gets the reservations it already recorded again, and keeps
+// them once.
+func commitCheckoutInventory(saga *checkoutSaga) error {
+    return commitInventoryReservations(saga.CartID, saga.OrderID, func(reservation committedReservation) {
+        sagaMu.Lock()
+        defer sagaMu.Unlock()
+        for _, recorded := range saga.Committed {
+            if recorded.ReservationID == reservation.ReservationID {
+                return
+            }
+        }
+        saga.Committed = append(saga.Committed, reservation)
+        saveSaga(saga)
+        recordInventoryCommit(saga.OrderID, reservation)
+    })
+}
+
+// Helper function to undo a checkout's completed steps: put committed
+// stock back, reverse the payment and cancel the order if it was stored.
+// Each step is journaled as it completes, so a compensation that fails
+// part way is retried from where it stopped. Returns nil once the saga is
+// finished.
+func compensateCheckout(saga *checkoutSaga, reason string) error {
+    sagaMu.Lock()
+    if compensating[saga.OrderID] {
+        sagaMu.Unlock()
+        return fmt.Errorf("compensation for order %s already running", saga.OrderID)
+    }
+    compensating[saga.OrderID] = true
+    if saga.Step != SagaCompensating {
+        saga.Step = SagaCompensating
+        saga.Reason = reason
+        saveSaga(saga)
+    }
+    sagaMu.Unlock()
+
+    defer func() {
+        sagaMu.Lock()
+        delete(compensating, saga.OrderID)
+        sagaMu.Unlock()
+    }()
+
+    // A checkout that reached paid completed before the saga was closed
+    // (a crash in between); there is nothing to undo
+    if order, exists := getOrder(saga.OrderID); exists && paymentCompleted(order.Status) {
+        finishCheckoutSaga(saga)
+        return nil
+    }
+
+    for saga.Restocked < len(saga.Committed) {
+        reservation := saga.Committed[saga.Restocked]
+        if err := restockReservation(reservation); err != nil {
+            sagasCompensateErr.Add(1)
+            return fmt.Errorf("restocking %s: %w", reservation.ProductID, err)
+        }
+        sagaMu.Lock()
+        saga.Restocked++
+        saveSaga(saga)
+        sagaMu.Unlock()
+    }
+
+    if err := reverseOrderPayments(saga.OrderID); err != nil {
+        sagasCompensateErr.Add(1)
+        return fmt.Errorf("reversing payment: %w", err)
+    }
+
+    settleCompensatedOrder(saga.OrderID, saga.Reason)
+    finishCheckoutSaga(saga)
+    sagasCompensated.Add(1)
+    log.Printf("Compensated checkout for order %s: %s", saga.OrderID, saga.Reason)
+    return nil
+}
+
+// Helper function to cancel a stored order whose checkout was compensated.
+// Orders that were never stored (synchronous checkouts store them after
+// the saga) or are already cancelled are left alone.
+func settleCompensatedOrder(orderID string, reason string) (Order, bool) {
+    shard := shardFor(orderID)
+    shard.mu.Lock()
+    order, exists := shard.orders[orderID]
+    if !exists || (order.Status != StatusCreated && order.Status != StatusProcessing && order.Status != StatusPendingPayment && order.Status != StatusOnHold) {
+        shard.mu.Unlock()
+        return order, false
+    }
+
+    setStatus(&order, StatusCancelled, ActorSaga, reason)
+    order.PaymentAction = nil
+    putOrder(shard, order)
+    recordEffects(shard, order, orderEffects{
+        Events:        []string{EventOrderCancelled},
+        Notifications: []string{"order_cancelled"},
+    })
+    shard.mu.Unlock()
+    persistOrders()
+    return order, true
+}
+
+// Helper function to put a committed reservation's stock back
+func restockReservation(reservation committedReservation) error {
+    body, err := json.Marshal(map[string]interface{}{
+        "product_id": reservation.ProductID,
+        "quantity":   reservation.Quantity,
+        "operation":  "add",
+    })
+    if err != nil {
+        return err
+    }
+
+    client := newServiceClient(inventoryBreaker, 10*time.Second)
+    resp, err := client.Post(config().InventoryServiceURL+"/api/inventory/stock", "application/json", bytes.NewReader(body))
+    if err != nil {
+        return err
+    }
+    resp.Body.Close()
+
+    if resp.StatusCode >= 300 {
+        return fmt.Errorf("inventory service returned status %d", resp.StatusCode)
+    }
+    return nil
+}
+
+// Helper function to reverse every payment settled for an order. The
+// payment service is asked for the order's payments rather than trusting
+// the saga's payment ID, so a charge whose response was lost (a timeout,
+// a crash) is found too; payments already reversed are skipped, which
+// makes this safe to repeat.
+func reverseOrderPayments(orderID string) error {
+    client := newServiceClient(paymentBreaker, 10*time.Second)
+    resp, err := client.Get(fmt.Sprintf("%s/api/payments/orders/%s", config().PaymentServiceURL, orderID))
+    if err != nil {
+        return err
+    }
+    defer resp.Body.Close()
+    if resp.StatusCode >= 300 {
+        return fmt.Errorf("payment service returned status %d", resp.StatusCode)
+    }
+
+    var paymentsResp struct {
+        Payments []struct {
+            PaymentID    string `json:"payment_id"`
+            Status       string `json:"status"`
+            RefundStatus string `json:"refund_status"`
+        } `json:"payments"`
+    }
+    if err := json.NewDecoder(resp.Body).Decode(&paymentsResp); err != nil {
+        return err
+    }
+
+    for _, payment := range paymentsResp.Payments {
+        var action string
+        switch {
+        case payment.Status == "requires_capture":
+            action = "void"
+        case payment.Status == "succeeded" && payment.RefundStatus != "fully_refunded":
+            action = "refund"
+        default:
+            continue
+        }
+
+        body, _ := json.Marshal(map[string]string{"reason": "checkout_failed"})
+        reverseResp, err := client.Post(
+            fmt.Sprintf("%s/api/payments/%s/%s", config().PaymentServiceURL, payment.PaymentID, action),
+            "application/json",
+            bytes.NewReader(body),
+        )
+        if err != nil {
+            return err
+        }
+        reverseResp.Body.Close()
+        if reverseResp.StatusCode >= 300 {
+            return fmt.Errorf("payment %s %s returned status %d", payment.PaymentID, action, reverseResp.StatusCode)
+        }
+        log.Printf("Reversed payment %s for order %s (%s)", payment.PaymentID, orderID, action)
+    }
+    return nil
+}
+
+// Helper function to rewrite the journal with only the unfinished sagas,
+// using the same temp file + rename as the notification journal. Callers
+// must hold sagaMu.
+func compactSagaJournal() error {
+    if sagaJournal == nil {
+        return nil
+    }
+
+    tmp, err := os.CreateTemp(filepath.Dir(sagaJournalPath), ".checkout-sagas-*")
+    if err != nil {
+        return err
+    }
+    defer os.Remove(tmp.Name())
+
+    writer := bufio.NewWriter(tmp)
+    for _, saga := range activeSagas {
+        data, err := json.Marshal(sagaJournalEntry{Op: "save", Saga: saga})
+        if err != nil {
+            tmp.Close()
+            return err
+        }
+        writer.Write(append(data, '\n'))
+    }
+    if err := writer.Flush(); err != nil {
+        tmp.Close()
+        return err
+    }
+    if err := tmp.Sync(); err != nil {
+        tmp.Close()
+        return err
+    }
+    if err := tmp.Close(); err != nil {
+        return err
+    }
+    if err := os.Rename(tmp.Name(), sagaJournalPath); err != nil {
+        return err
+    }
+
+    file, err := os.OpenFile(sagaJournalPath, os.O_WRONLY|os.O_APPEND, 0644)
+    if err != nil {
+        return err
+    }
+    sagaJournal.Close()
+    sagaJournal = file
+    sagasSinceCompact = 0
+    return nil
+}
+
+// Helper function to replay the journal and return the unfinished sagas
+func openSagaJournal() ([]*checkoutSaga, error) {
+    if sagaJournalPath == "" {
+        return nil, nil
+    }
+
+    if err := os.MkdirAll(filepath.Dir(sagaJournalPath), 0755); err != nil {
+        return nil, err
+    }
+
+    unfinished := make(map[string]*checkoutSaga)
+    if file, err := os.Open(sagaJournalPath); err == nil {
+        scanner := bufio.NewScanner(file)
+        scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+        for scanner.Scan() {
+            var entry sagaJournalEntry
+            if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+                // A write torn by a crash; skip it
+                log.Printf("Ignoring unreadable checkout saga journal entry: %v", err)
+                continue
+            }
+            switch entry.Op {
+            case "save":
+                if entry.Saga != nil {
+                    unfinished[entry.Saga.OrderID] = entry.Saga
+                }
+            case "done":
+                delete(unfinished, entry.OrderID)
+            }
+        }
+        file.Close()
+        if err := scanner.Err(); err != nil {
+            return nil, err
+        }
+    } else if !os.IsNotExist(err) {
+        return nil, err
+    }
+
+    sagaMu.Lock()
+    defer sagaMu.Unlock()
+
+    sagas := make([]*checkoutSaga, 0, len(unfinished))
+    for orderID, saga := range unfinished {
+        activeSagas[orderID] = saga
+        sagas = append(sagas, saga)
+    }
+
+    file, err := os.OpenFile(sagaJournalPath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+    if err != nil {
+        return nil, err
+    }
+    sagaJournal = file
+    if err := compactSagaJournal(); err != nil {
+        return nil, err
+    }
+    return sagas, nil
+}
+
+// Helper function to compensate every saga left unfinished, logging those
+// that fail for the next retry
+func retryCompensations(sagas []*checkoutSaga) {
+    for _, saga := range sagas {
+        reason := saga.Reason
+        if reason == "" {
+            reason = "Checkout was interrupted by a restart, please check out again"
+        }
+        if err := compensateCheckout(saga, reason); err != nil {
+            log.Printf("Compensation for order %s failed, will retry: %v", saga.OrderID, err)
+        }
+    }
+}
+
+// Resume the sagas a restart interrupted and keep retrying compensations
+// that fail. Checkouts can't be continued after a restart (the client's
+// request is gone and payment methods are never stored), so every
+// interrupted saga is compensated. Runs before the checkout workers
+// start, so their sagas are claimed here first.
+func startCheckoutSagas() error {
+    sagas, err := openSagaJournal()
+    if err != nil {
+        return err
+    }
+
+    if len(sagas) > 0 {
+        sagasResumed.Add(int64(len(sagas)))
+        log.Printf("Compensating %d checkouts interrupted by a restart", len(sagas))
+        for _, saga := range sagas {
+            sagaMu.Lock()
+            if saga.Step != SagaCompensating {
+                saga.Step = SagaCompensating
+                saga.Reason = "Checkout was interrupted by a restart, please check out again"
+                saveSaga(saga)
+            }
+            sagaMu.Unlock()
+        }
+    }
+
+    go func() {
+        retryCompensations(sagas)
+        ticker := time.NewTicker(SagaRetryInterval)
+        defer ticker.Stop()
+        for range ticker.C {
+            // Only sagas already compensating; the others are live checkouts
+            sagaMu.Lock()
+            var pending []*checkoutSaga
+            for _, saga := range activeSagas {
+                if saga.Step == SagaCompensating && !compensating[saga.OrderID] {
+                    pending = append(pending, saga)
+                }
+            }
+            sagaMu.Unlock()
+            retryCompensations(pending)
+        }
+    }()
+    return nil
+}
+
+// Helper function to report checkout saga metrics
+func sagaMetrics() string {
+    sagaMu.Lock()
+    active := len(activeSagas)
+    pending := 0
+    for _, saga := range activeSagas {
+        if saga.Step == SagaCompensating {
+            pending++
+        }
+    }
+    sagaMu.Unlock()
+
+    return fmt.Sprintf(`
+# HELP order_service_checkout_sagas_active Checkouts in progress or waiting on compensation
+# TYPE order_service_checkout_sagas_active gauge
+order_service_checkout_sagas_active %d
+
+# HELP order_service_checkout_sagas_compensating Checkouts whose compensation has not finished
+# TYPE order_service_checkout_sagas_compensating gauge
+order_service_checkout_sagas_compensating %d
+
+# HELP order_service_checkout_sagas_compensated_total Checkouts undone after a failed step
+# TYPE order_service_checkout_sagas_compensated_total counter
+order_service_checkout_sagas_compensated_total %d
+
+# HELP order_service_checkout_saga_compensation_errors_total Compensation attempts that failed and were left for retry
+# TYPE order_service_checkout_saga_compensation_errors_total counter
+order_service_checkout_saga_compensation_errors_total %d
+
+# HELP order_service_checkout_sagas_resumed_total Checkouts found unfinished at startup
+# TYPE order_service_checkout_sagas_resumed_total counter
+order_service_checkout_sagas_resumed_total %d
+`, active, pending, sagasCompensated.Load(), sagasCompensateErr.Load(), sagasResumed.Load())
+}
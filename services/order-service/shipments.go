@@ -0,0 +1,210 @@
+package main
+
+import (
+    "encoding/json"
+    "log"
+    "net/http"
+    "strings"
+    "time"
+
+    "github.com/google/uuid"
+    "github.com/gorilla/mux"
+    "middleware/i18n"
+    "middleware/openmetrics"
+)
+
+// OrderShipment is one parcel of an order's items handed to a carrier. An
+// order moves to partially_shipped with its first shipment and to shipped
+// once every unit not refunded is in one.
+type OrderShipment struct {
+    ShipmentID     string       `json:"shipment_id"`
+    Carrier        string       `json:"carrier"`
+    TrackingNumber string       `json:"tracking_number"`
+    TrackingURL    string       `json:"tracking_url,omitempty"`
+    Items          []RefundItem `json:"items"`
+    CreatedBy      string       `json:"created_by"`
+    CreatedAt      int64        `json:"created_at"`
+}
+
+// ShipmentRequest for POST /api/orders/{orderId}/shipments. Items may be
+// left out to ship everything not yet shipped.
+type ShipmentRequest struct {
+    Carrier        string       `json:"carrier"`
+    TrackingNumber string       `json:"tracking_number"`
+    TrackingURL    string       `json:"tracking_url"`
+    Items          []RefundItem `json:"items"`
+}
+
+// Helper function to check whether an order can have items shipped
+func shippable(status string) bool {
+    return status == StatusPaid || status == StatusPartiallyShipped
+}
+
+// Helper function to count, by product, the units of an order still to
+// ship: units not refunded and not already in a shipment
+func unshippedUnits(order Order) map[string]int {
+    left := make(map[string]int)
+    for _, item := range order.Items {
+        left[item.ProductID] += item.Quantity - item.RefundedQty
+    }
+    for _, shipment := range order.Shipments {
+        for _, item := range shipment.Items {
+            left[item.ProductID] -= item.Quantity
+        }
+    }
+    return left
+}
+
+// Helper function to check the lines of a new shipment against what each
+// product has left to ship. No lines means everything left.
+func shipmentLines(order Order, requested []RefundItem) ([]RefundItem, error) {
+    left := unshippedUnits(order)
+
+    if len(requested) == 0 {
+        var lines []RefundItem
+        for _, item := range order.Items {
+            if left[item.ProductID] > 0 {
+                lines = append(lines, RefundItem{ProductID: item.ProductID, Quantity: left[item.ProductID]})
+                left[item.ProductID] = 0
+            }
+        }
+        if len(lines) == 0 {
+            return nil, i18n.NewError("order.shipment_nothing_left")
+        }
+        return lines, nil
+    }
+
+    quantities := make(map[string]int)
+    var lines []RefundItem
+    for _, item := range requested {
+        if _, onOrder := left[item.ProductID]; !onOrder || item.Quantity <= 0 {
+            return nil, i18n.NewError("order.shipment_item_invalid")
+        }
+        if quantities[item.ProductID] == 0 {
+            lines = append(lines, RefundItem{ProductID: item.ProductID})
+        }
+        quantities[item.ProductID] += item.Quantity
+    }
+    for i := range lines {
+        lines[i].Quantity = quantities[lines[i].ProductID]
+        if lines[i].Quantity > left[lines[i].ProductID] {
+            return nil, i18n.NewError("order.shipment_exceeds_order", lines[i].ProductID)
+        }
+    }
+    return lines, nil
+}
+
+// Helper function to check whether every unit of an order still to ship
+// is in a shipment
+func fullyShipped(order Order) bool {
+    for _, units := range unshippedUnits(order) {
+        if units > 0 {
+            return false
+        }
+    }
+    return true
+}
+
+// Record a shipment of some or all of an order's items. The order moves to
+// partially_shipped, or to shipped once nothing is left to ship, which
+// announces order.shipped and tells the customer.
+func createShipmentHandler(w http.ResponseWriter, r *http.Request) {
+    orderID := resolveOrderID(mux.Vars(r)["orderId"])
+
+    var req ShipmentRequest
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+        i18n.WriteError(w, r, http.StatusBadRequest, "request.invalid_json")
+        return
+    }
+    req.Carrier = strings.TrimSpace(req.Carrier)
+    req.TrackingNumber = strings.TrimSpace(req.TrackingNumber)
+    if req.Carrier == "" || req.TrackingNumber == "" {
+        i18n.WriteError(w, r, http.StatusBadRequest, "order.shipment_tracking_required")
+        return
+    }
+
+    shard := shardFor(orderID)
+    shard.mu.Lock()
+    order, exists := shard.orders[orderID]
+    if !exists {
+        shard.mu.Unlock()
+        i18n.WriteError(w, r, http.StatusNotFound, "order.not_found")
+        return
+    }
+    if !shippable(order.Status) {
+        shard.mu.Unlock()
+        i18n.WriteError(w, r, http.StatusConflict, "order.shipment_not_allowed", order.Status)
+        return
+    }
+
+    lines, err := shipmentLines(order, req.Items)
+    if err != nil {
+        shard.mu.Unlock()
+        i18n.WriteMessageError(w, r, http.StatusBadRequest, err, "order.shipment_item_invalid")
+        return
+    }
+
+    actor := requestActor(r)
+    shipment := OrderShipment{
+        ShipmentID:     "shp_" + uuid.New().String(),
+        Carrier:        req.Carrier,
+        TrackingNumber: req.TrackingNumber,
+        TrackingURL:    req.TrackingURL,
+        Items:          lines,
+        CreatedBy:      actor,
+        CreatedAt:      time.Now().Unix(),
+    }
+    order.Shipments = append(append([]OrderShipment(nil), order.Shipments...), shipment)
+    order.UpdatedAt = shipment.CreatedAt
+
+    effects := orderEffects{TraceID: openmetrics.TraceID(r)}
+    switch {
+    case fullyShipped(order):
+        setStatus(&order, StatusShipped, actor, "")
+        effects.Events = []string{EventOrderShipped}
+        effects.Notifications = []string{"order_shipped"}
+    case order.Status != StatusPartiallyShipped:
+        setStatus(&order, StatusPartiallyShipped, actor, "")
+    }
+    putOrder(shard, order)
+    recordEffects(shard, order, effects)
+    shard.mu.Unlock()
+    persistOrders()
+
+    log.Printf("Shipment %s for order %s via %s (%d lines), order is %s",
+        shipment.ShipmentID, orderID, shipment.Carrier, len(lines), order.Status)
+
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(http.StatusCreated)
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "shipment":     shipment,
+        "order_status": order.Status,
+    })
+}
+
+// List an order's shipments, oldest first
+func getShipmentsHandler(w http.ResponseWriter, r *http.Request) {
+    order, exists := getOrder(resolveOrderID(mux.Vars(r)["orderId"]))
+    if !exists {
+        i18n.WriteError(w, r, http.StatusNotFound, "order.not_found")
+        return
+    }
+
+    shipments := order.Shipments
+    if shipments == nil {
+        shipments = []OrderShipment{}
+    }
+    unshipped := make(map[string]int)
+    for productID, units := range unshippedUnits(order) {
+        if units > 0 {
+            unshipped[productID] = units
+        }
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "shipments": shipments,
+        "total":     len(shipments),
+        "unshipped": unshipped,
+    })
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+    "context"
+    "log"
+    "net/http"
+    "os"
+    "os/signal"
+    "strconv"
+    "syscall"
+    "time"
+
+    "middleware/httpserver"
+)
+
+// Graceful shutdown. On SIGTERM (or SIGINT) the service:
+//
+//  1. reports not ready on /readyz, and waits SHUTDOWN_READINESS_DELAY_SECONDS
+//     (0 skips the wait) for load balancers to stop sending it traffic
+//  2. stops accepting connections and waits for requests in flight, such
+//     as synchronous checkouts part way through their saga, to finish
+//  3. waits for the checkout workers to finish queued checkouts and for
+//     running compensations to complete
+//  4. writes a final order snapshot
+//
+// Steps 2 and 3 share SHUTDOWN_TIMEOUT_SECONDS; keep it below the pod's
+// terminationGracePeriodSeconds. Whatever is still running when it is up
+// survives the exit: sagas are journaled step by step and resumed at the
+// next start (see saga.go), queued notifications are journaled, and
+// checkouts still pending or processing are cancelled at the next start.
+const (
+    DefaultShutdownReadinessDelay = 5 * time.Second
+    DefaultShutdownTimeout        = 25 * time.Second
+)
+
+// How often the drain checks whether background checkouts are done
+const ShutdownPollInterval = 100 * time.Millisecond
+
+// shutdownStarted is closed once the service starts shutting down
+var shutdownStarted = make(chan struct{})
+
+// Helper function to check whether the service is shutting down
+func shuttingDown() bool {
+    select {
+    case <-shutdownStarted:
+        return true
+    default:
+        return false
+    }
+}
+
+// Helper function to serve until a termination signal, then shut down
+// gracefully
+func serveUntilSignalled(server *http.Server) {
+    signals := make(chan os.Signal, 1)
+    signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+
+    errs := make(chan error, 1)
+    go func() { errs <- server.ListenAndServe() }()
+
+    select {
+    case err := <-errs:
+        log.Fatal("Server failed to start:", err)
+    case sig := <-signals:
+        log.Printf("Received %s, shutting down", sig)
+    }
+    shutdown(server)
+}
+
+// Helper function to drain the service and write its final state
+func shutdown(server *http.Server) {
+    close(shutdownStarted)
+
+    delay := DefaultShutdownReadinessDelay
+    if value := os.Getenv("SHUTDOWN_READINESS_DELAY_SECONDS"); value != "" {
+        if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+            delay = time.Duration(seconds) * time.Second
+        } else {
+            log.Printf("Ignoring invalid SHUTDOWN_READINESS_DELAY_SECONDS=%q", value)
+        }
+    }
+    if delay > 0 {
+        log.Printf("Reporting not ready, waiting %s for traffic to stop", delay)
+        time.Sleep(delay)
+    }
+
+    ctx, cancel := context.WithTimeout(context.Background(), httpserver.EnvSeconds("SHUTDOWN_TIMEOUT_SECONDS", DefaultShutdownTimeout))
+    defer cancel()
+
+    // Order event streams end on shutdownStarted; clients reconnect to
+    // another instance
+    if err := server.Shutdown(ctx); err != nil {
+        log.Printf("Requests still in flight at the shutdown deadline: %v", err)
+    } else {
+        log.Printf("Requests in flight finished")
+    }
+
+    if err := drainCheckouts(ctx); err != nil {
+        log.Printf("Checkouts still running at the shutdown deadline (%d queued, %d compensating); they are picked up at the next start",
+            checkoutsPending.Load(), compensationsRunning())
+    } else {
+        log.Printf("Background checkouts finished")
+    }
+
+    log.Printf("Writing final order snapshot")
+    persistOrders()
+}
+
+// Helper function to wait for the checkout workers to empty their queue
+// and for running compensations to finish
+func drainCheckouts(ctx context.Context) error {
+    ticker := time.NewTicker(ShutdownPollInterval)
+    defer ticker.Stop()
+
+    for checkoutsPending.Load() > 0 || compensationsRunning() > 0 {
+        select {
+        case <-ctx.Done():
+            return ctx.Err()
+        case <-ticker.C:
+        }
+    }
+    return nil
+}
+
+// Helper function to count the compensations running right now
+func compensationsRunning() int {
+    sagaMu.Lock()
+    defer sagaMu.Unlock()
+    return len(compensating)
+}
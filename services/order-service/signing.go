@@ -0,0 +1,36 @@
+package main
+
+import (
+    "os"
+    "time"
+
+    // Aliased, as the registered webhooks (webhooks.go) are named webhooks
+    webhookauth "webhooks"
+)
+
+// Callbacks between services and to subscribers are signed with a shared
+// secret: X-Signature: t=<unix seconds>,v1=<hex HMAC-SHA256 of "<t>.<body>">.
+// The timestamp is signed too, so a captured request can't be replayed once
+// it falls outside webhooks.Tolerance. The signing itself is pkg/webhooks,
+// the same package subscribers verify with.
+const SignatureHeader = webhookauth.SignatureHeader
+
+// Signing secrets, one per subscriber. Unset means unsigned, for local
+// development; payment callbacks are refused without theirs.
+var (
+    orderEventsSecret     = os.Getenv("ORDER_EVENTS_SECRET")     // signs events sent to ORDER_EVENTS_URL
+    paymentCallbackSecret = os.Getenv("PAYMENT_CALLBACK_SECRET") // verifies payment-service callbacks
+    cartSnapshotSecret    = os.Getenv("CART_SNAPSHOT_SECRET")    // verifies cart-service checkout snapshots
+)
+
+// Helper function to compute the X-Signature value for a body
+func signPayload(secret string, timestamp int64, body []byte) string {
+    return webhookauth.Sign(secret, time.Unix(timestamp, 0), body)
+}
+
+// Helper function to check an X-Signature value against a body. Several v1
+// entries are accepted so senders can sign with old and new secrets while
+// one is rotated.
+func verifySignature(secret string, header string, body []byte, now time.Time) error {
+    return webhookauth.Verify(secret, header, body, now)
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+    "time"
+
+    "middleware/slo"
+)
+
+func init() {
+    slo.Setup(serviceName, serviceObjectives(), legacyRouteAliases)
+}
+
+// SLOs for the order service. Checkout covers the payment round trip, so
+// it gets a looser latency target than the reads.
+func serviceObjectives() []slo.Objective {
+    return []slo.Objective{
+        {
+            Name:        "checkout_latency",
+            Description: "99.5% of checkouts complete within 800ms",
+            Method:      "POST",
+            Route:       "/api/orders/users/{userId}",
+            Target:      0.995,
+            Latency:     800 * time.Millisecond,
+        },
+        {
+            Name:        "availability",
+            Description: "99.9% of requests succeed",
+            Target:      0.999,
+        },
+    }
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+    "log"
+
+    "middleware/i18n"
+    "money"
+)
+
+// Split payments. An order can be paid with several payment methods, e.g.
+// part by gift card and the rest by card. The methods are charged one at
+// a time in the order given, each as its own payment for the order; if
+// one is declined, the ones already taken are reversed by the checkout
+// saga (see saga.go) and the order isn't placed. A decline before any was
+// taken leaves the order waiting for a retry; see retry_payment.go.
+
+// MaxPaymentInstruments caps how many payment methods one order is split over
+const MaxPaymentInstruments = 5
+
+// PaymentInstrument is one payment method to charge for an order
+type PaymentInstrument struct {
+    PaymentMethod string `json:"payment_method"`
+    AmountCents   int    `json:"amount_cents"` // may be left out on the last, to pay what is left
+}
+
+// OrderPayment is one payment a split order was paid with. Orders paid
+// with one method only have payment_id.
+type OrderPayment struct {
+    PaymentID     string `json:"payment_id"`
+    PaymentMethod string `json:"payment_method"`
+    AmountCents   int    `json:"amount_cents"`
+    RefundedCents int    `json:"refunded_cents,omitempty"`
+}
+
+// RefundPart is the share of a refund returned to one payment of a split order
+type RefundPart struct {
+    PaymentID       string `json:"payment_id"`
+    PaymentRefundID string `json:"payment_refund_id"`
+    AmountCents     int    `json:"amount_cents"`
+}
+
+// Helper function to work out what each payment method is charged. A
+// single payment_method pays the whole total; a list of payments must add
+// up to it, with the last one paying what is left when it has no amount.
+func planPayments(req CreateOrderRequest, total money.Money) ([]PaymentInstrument, error) {
+    if len(req.Payments) == 0 {
+        return []PaymentInstrument{{PaymentMethod: req.PaymentMethod, AmountCents: total.Amount}}, nil
+    }
+    if req.PaymentMethod != "" {
+        return nil, i18n.NewError("order.payment_method_conflict")
+    }
+    if len(req.Payments) > MaxPaymentInstruments {
+        return nil, i18n.NewError("order.payments_too_many", MaxPaymentInstruments)
+    }
+
+    plan := append([]PaymentInstrument(nil), req.Payments...)
+    paid := money.New(0, total.Currency)
+    for i := range plan {
+        part := &plan[i]
+        last := i == len(plan)-1
+        if part.PaymentMethod == "" || part.AmountCents < 0 || (part.AmountCents == 0 && !last) {
+            return nil, i18n.NewError("order.payments_invalid")
+        }
+        if part.AmountCents == 0 {
+            left, err := total.Sub(paid)
+            if err != nil || left.Amount <= 0 {
+                return nil, i18n.NewError("order.payments_total_mismatch", paid, total)
+            }
+            part.AmountCents = left.Amount
+        }
+        var err error
+        if paid, err = paid.Add(money.New(part.AmountCents, total.Currency)); err != nil {
+            return nil, err
+        }
+    }
+    if paid.Amount != total.Amount {
+        return nil, i18n.NewError("order.payments_total_mismatch", paid, total)
+    }
+    return plan, nil
+}
+
+// Helper function to charge an order's payment methods in turn. Returns
+// the payments taken and the answer for the last one charged, which is
+// the first that failed or asked for authentication, if any did. Only the
+// last method may ask for authentication: the callback for it settles
+// the order (see paymentCallbackHandler), and an earlier one would leave
+// the rest uncharged, so it is treated as declined.
+func chargePayments(order Order, plan []PaymentInstrument) ([]OrderPayment, *PaymentResponse, error) {
+    var taken []OrderPayment
+    for i, part := range plan {
+        paymentResp, err := processPayment(order.OrderID, i, money.New(part.AmountCents, order.Currency), part.PaymentMethod)
+        attempt := PaymentAttempt{PaymentMethod: part.PaymentMethod, AmountCents: part.AmountCents}
+        if err != nil {
+            attempt.Status, attempt.Message = "error", err.Error()
+            recordPaymentAttempt(order.OrderID, attempt)
+            return taken, nil, err
+        }
+        attempt.PaymentID, attempt.Status, attempt.Message = paymentResp.PaymentID, paymentResp.Status, paymentResp.Message
+        if attempt.Status == "" {
+            attempt.Status = "failed"
+            if paymentResp.Success {
+                attempt.Status = "succeeded"
+            }
+        }
+        recordPaymentAttempt(order.OrderID, attempt)
+        if paymentResp.Status == "requires_action" && i < len(plan)-1 {
+            log.Printf("Payment %s of order %s asked for authentication before the last payment method", paymentResp.PaymentID, order.OrderID)
+            return taken, &PaymentResponse{
+                PaymentID: paymentResp.PaymentID,
+                Status:    "failed",
+                Message:   i18n.Message(i18n.DefaultLocale, "order.split_payment_authentication"),
+            }, nil
+        }
+        if !paymentResp.Success && paymentResp.Status != "requires_action" {
+            return taken, paymentResp, nil
+        }
+        taken = append(taken, OrderPayment{
+            PaymentID:     paymentResp.PaymentID,
+            PaymentMethod: part.PaymentMethod,
+            AmountCents:   part.AmountCents,
+        })
+        if paymentResp.Status == "requires_action" {
+            return taken, paymentResp, nil
+        }
+    }
+    return taken, &PaymentResponse{Success: true, PaymentID: taken[len(taken)-1].PaymentID}, nil
+}
+
+// Helper function to record the payments taken on an order. The first is
+// the order's payment_id; split orders list them all.
+func recordPayments(order *Order, taken []OrderPayment) {
+    if len(taken) == 0 {
+        return
+    }
+    order.PaymentID = taken[0].PaymentID
+    if len(taken) > 1 {
+        order.Payments = taken
+    }
+}
+
+// Helper function to check a payment belongs to an order
+func hasPayment(order Order, paymentID string) bool {
+    if order.PaymentID == paymentID {
+        return true
+    }
+    for _, payment := range order.Payments {
+        if payment.PaymentID == paymentID {
+            return true
+        }
+    }
+    return false
+}
+
+// Helper function to split a refund over a split order's payments, the
+// last one charged first (so a card is refunded before a gift card), each
+// up to what it has left to refund
+func refundParts(order Order, amount money.Money) []RefundPart {
+    var parts []RefundPart
+    left := amount.Amount
+    for i := len(order.Payments) - 1; i >= 0 && left > 0; i-- {
+        payment := order.Payments[i]
+        share := min(left, payment.AmountCents-payment.RefundedCents)
+        if share <= 0 {
+            continue
+        }
+        parts = append(parts, RefundPart{PaymentID: payment.PaymentID, AmountCents: share})
+        left -= share
+    }
+    return parts
+}
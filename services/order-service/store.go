@@ -0,0 +1,115 @@
+package main
+
+import (
+    "hash/fnv"
+    "sync"
+)
+
+// OrderShardCount is the number of independently locked order partitions
+const OrderShardCount = 64
+
+// orderShard is one partition of the order store. Writes to different
+// orders only contend when they hash to the same shard. The shard's outbox
+// holds the undelivered side effects of its orders' writes.
+type orderShard struct {
+    mu     sync.RWMutex
+    orders map[string]Order
+    outbox map[string]*outboxEntry
+}
+
+var orderShards = newOrderShards()
+
+func newOrderShards() []*orderShard {
+    shards := make([]*orderShard, OrderShardCount)
+    for i := range shards {
+        shards[i] = &orderShard{orders: make(map[string]Order), outbox: make(map[string]*outboxEntry)}
+    }
+    return shards
+}
+
+// Helper function to find the shard owning an order
+func shardFor(orderID string) *orderShard {
+    h := fnv.New32a()
+    h.Write([]byte(orderID))
+    return orderShards[h.Sum32()%OrderShardCount]
+}
+
+// Helper function to write an order and keep derived indexes in sync.
+// Callers must hold the order's shard lock.
+func putOrder(shard *orderShard, order Order) {
+    previous, exists := shard.orders[order.OrderID]
+    revenueMu.Lock()
+    if exists {
+        applyRevenueDelta(previous, -1)
+    }
+    applyRevenueDelta(order, 1)
+    revenueMu.Unlock()
+
+    indexOrderNumber(order)
+
+    shard.orders[order.OrderID] = order
+    snapshotDirty.Store(true)
+
+    if exists && (previous.Status != order.Status || len(previous.StatusHistory) != len(order.StatusHistory)) {
+        notifyOrderWatchers(order.OrderID)
+    }
+}
+
+// Helper function to delete an order and its revenue contribution.
+// Callers must hold the order's shard lock.
+func deleteOrder(shard *orderShard, orderID string) {
+    previous, exists := shard.orders[orderID]
+    if !exists {
+        return
+    }
+
+    revenueMu.Lock()
+    applyRevenueDelta(previous, -1)
+    revenueMu.Unlock()
+
+    unindexOrderNumber(previous)
+    delete(shard.orders, orderID)
+    snapshotDirty.Store(true)
+    notifyOrderWatchers(orderID)
+}
+
+// Helper function to read a single order
+func getOrder(orderID string) (Order, bool) {
+    shard := shardFor(orderID)
+    shard.mu.RLock()
+    order, exists := shard.orders[orderID]
+    shard.mu.RUnlock()
+    return order, exists
+}
+
+// Helper function to visit every order. Shards are read-locked one at a
+// time, so this never blocks writers on other shards.
+func forEachOrder(fn func(order Order)) {
+    for _, shard := range orderShards {
+        shard.mu.RLock()
+        for _, order := range shard.orders {
+            fn(order)
+        }
+        shard.mu.RUnlock()
+    }
+}
+
+// Helper function to count orders across all shards
+func countOrders() int {
+    count := 0
+    for _, shard := range orderShards {
+        shard.mu.RLock()
+        count += len(shard.orders)
+        shard.mu.RUnlock()
+    }
+    return count
+}
+
+// Helper function to empty every shard
+func resetOrderShards() {
+    for _, shard := range orderShards {
+        shard.mu.Lock()
+        shard.orders = make(map[string]Order)
+        shard.mu.Unlock()
+    }
+}
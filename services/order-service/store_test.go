@@ -0,0 +1,64 @@
+package main
+
+import (
+    "fmt"
+    "sync/atomic"
+    "testing"
+    "time"
+)
+
+// Reads and writes of random orders from many goroutines, one write in
+// every writeEvery operations: the 64 FNV-keyed shards against the store
+// before sharding, every order behind one RWMutex
+func BenchmarkStoreParallel(b *testing.B) {
+    now := time.Now().Unix()
+    orders := make([]Order, benchmarkOrderCount)
+    for i := range orders {
+        orders[i] = benchmarkOrder(i, now)
+    }
+
+    single := &orderShard{orders: make(map[string]Order), outbox: make(map[string]*outboxEntry)}
+    stores := []struct {
+        name     string
+        shardFor func(orderID string) *orderShard
+    }{
+        {"sharded", shardFor},
+        {"single_mutex", func(string) *orderShard { return single }},
+    }
+
+    for _, writeEvery := range []int{2, 10} {
+        for _, store := range stores {
+            name := fmt.Sprintf("%s/writes=1in%d", store.name, writeEvery)
+            b.Run(name, func(b *testing.B) {
+                resetOrderShards()
+                single.orders = make(map[string]Order)
+                for _, order := range orders {
+                    shard := store.shardFor(order.OrderID)
+                    shard.mu.Lock()
+                    putOrder(shard, order)
+                    shard.mu.Unlock()
+                }
+
+                var next atomic.Int64
+                b.ResetTimer()
+                b.RunParallel(func(pb *testing.PB) {
+                    for pb.Next() {
+                        n := int(next.Add(1))
+                        order := orders[(n*7919)%len(orders)]
+                        shard := store.shardFor(order.OrderID)
+                        if n%writeEvery == 0 {
+                            order.UpdatedAt++
+                            shard.mu.Lock()
+                            putOrder(shard, order)
+                            shard.mu.Unlock()
+                            continue
+                        }
+                        shard.mu.RLock()
+                        _ = shard.orders[order.OrderID]
+                        shard.mu.RUnlock()
+                    }
+                })
+            })
+        }
+    }
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+    "fmt"
+    "sort"
+    "strconv"
+    "strings"
+
+    "money"
+)
+
+// Tax providers (TAX_PROVIDER)
+const (
+    TaxProviderNone      = "none"
+    TaxProviderRateTable = "rate_table"
+)
+
+// TaxDefaultRegion is the TAX_RATES entry used for addresses with no
+// entry of their own
+const TaxDefaultRegion = "*"
+
+// TaxQuote is the tax a provider worked out for an order
+type TaxQuote struct {
+    TaxCents int
+    RatePPM  int    // rate in parts per million, e.g. 72500 for 7.25%
+    Region   string // what the rate was looked up by, e.g. US-CA
+}
+
+// TaxProvider works out the tax on an order from its items, subtotal and
+// shipping address. Providers backed by an external service return an
+// error when it can't be reached; the checkout is refused rather than
+// taken without tax.
+type TaxProvider interface {
+    Name() string
+    Quote(order Order, subtotal money.Money) (TaxQuote, error)
+}
+
+// noTax charges no tax, for shops that don't collect it (the default)
+type noTax struct{}
+
+func (noTax) Name() string {
+    return TaxProviderNone
+}
+
+func (noTax) Quote(order Order, subtotal money.Money) (TaxQuote, error) {
+    return TaxQuote{}, nil
+}
+
+// rateTableTax charges one rate per region from TAX_RATES, looked up by
+// COUNTRY-REGION, then COUNTRY, then the "*" entry. Addresses that match
+// nothing, and orders without one, are charged no tax.
+type rateTableTax struct {
+    Rates map[string]int // region -> rate in parts per million
+}
+
+func (rateTableTax) Name() string {
+    return TaxProviderRateTable
+}
+
+func (t rateTableTax) Quote(order Order, subtotal money.Money) (TaxQuote, error) {
+    var keys []string
+    if address := order.ShippingAddress; address != nil {
+        if address.Region != "" {
+            keys = append(keys, address.Country+"-"+address.Region)
+        }
+        keys = append(keys, address.Country)
+    }
+    keys = append(keys, TaxDefaultRegion)
+
+    for _, key := range keys {
+        rate, exists := t.Rates[key]
+        if !exists {
+            continue
+        }
+        // Round half up to the minor unit
+        tax, remainder := money.MulDiv(subtotal.Amount, rate, 1000000)
+        if remainder*2 >= 1000000 {
+            tax++
+        }
+        return TaxQuote{TaxCents: tax, RatePPM: rate, Region: key}, nil
+    }
+    return TaxQuote{}, nil
+}
+
+// Helper function to get the provider for the configured settings
+func currentTaxProvider() TaxProvider {
+    cfg := config()
+    if cfg.TaxProvider == TaxProviderRateTable {
+        return rateTableTax{Rates: cfg.TaxRates}
+    }
+    return noTax{}
+}
+
+// Helper function to parse TAX_RATES: comma-separated REGION=PERCENT
+// entries, e.g. "US-CA=7.25,US-NY=8.875,DE=19,*=0"
+func parseTaxRates(value string) (map[string]int, error) {
+    rates := make(map[string]int)
+    for _, entry := range strings.Split(value, ",") {
+        entry = strings.TrimSpace(entry)
+        if entry == "" {
+            continue
+        }
+        region, percent, found := strings.Cut(entry, "=")
+        region = strings.ToUpper(strings.TrimSpace(region))
+        if !found || region == "" {
+            return nil, fmt.Errorf("TAX_RATES entry %q must be REGION=PERCENT", entry)
+        }
+        rate, err := strconv.ParseFloat(strings.TrimSpace(percent), 64)
+        if err != nil || rate < 0 || rate > 100 {
+            return nil, fmt.Errorf("TAX_RATES rate for %s must be a percentage between 0 and 100", region)
+        }
+        rates[region] = int(rate*10000 + 0.5)
+    }
+    return rates, nil
+}
+
+// Helper function to format tax rates back into TAX_RATES form, for display
+func formatTaxRates(rates map[string]int) string {
+    entries := make([]string, 0, len(rates))
+    for region, rate := range rates {
+        entries = append(entries, region+"="+strconv.FormatFloat(float64(rate)/10000, 'f', -1, 64))
+    }
+    sort.Strings(entries)
+    return strings.Join(entries, ",")
+}
+
+// Helper function to work out an order's tax and set its subtotal, tax and
+// totals. Tax is charged on the subtotal less any coupon discount (see
+// applyDiscount) and spread over the lines by what they cost after it
+// (see Money.Allocate), so a line refund can return its share.
+func applyTax(order *Order, subtotal money.Money) error {
+    taxable, err := subtotal.Sub(money.New(order.DiscountCents, subtotal.Currency))
+    if err != nil {
+        return err
+    }
+    provider := currentTaxProvider()
+    quote, err := provider.Quote(*order, taxable)
+    if err != nil {
+        return fmt.Errorf("%s tax provider: %w", provider.Name(), err)
+    }
+    grandTotal, err := taxable.Add(money.New(quote.TaxCents, subtotal.Currency))
+    if err != nil {
+        return err
+    }
+
+    order.SubtotalCents = subtotal.Amount
+    order.TaxCents = quote.TaxCents
+    order.TaxRatePPM = quote.RatePPM
+    order.TaxRegion = quote.Region
+    order.GrandTotalCents = grandTotal.Amount
+    order.TotalCents = grandTotal.Amount
+
+    order.Items = append([]OrderItem(nil), order.Items...)
+    if quote.TaxCents == 0 || taxable.Amount == 0 {
+        return nil
+    }
+    weights := make([]int, len(order.Items))
+    for i, item := range order.Items {
+        weights[i] = item.PriceCents*item.Quantity - item.DiscountCents
+    }
+    shares, err := money.New(quote.TaxCents, subtotal.Currency).Allocate(weights)
+    if err != nil {
+        return err
+    }
+    for i := range order.Items {
+        order.Items[i].TaxCents = shares[i].Amount
+    }
+    return nil
+}
+
+// Helper function to work out how much of a line's tax or discount goes
+// with units of it being refunded: the amount is split evenly over the
+// line's units, with the rounding left over going to the last units
+// refunded, so refunding every unit returns all of it
+func refundShareCents(cents int, item OrderItem, units int) int {
+    if cents == 0 || item.Quantity == 0 {
+        return 0
+    }
+    before, _ := money.MulDiv(cents, item.RefundedQty, item.Quantity)
+    after, _ := money.MulDiv(cents, item.RefundedQty+units, item.Quantity)
+    return after - before
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+    "encoding/json"
+    "log"
+    "net/http"
+    "sort"
+    "sync"
+    "time"
+
+    "github.com/gorilla/mux"
+    "middleware/i18n"
+)
+
+// Order timeline. GET /api/orders/{orderId}/timeline merges what happened
+// to an order into one feed for support: its status changes and shipments,
+// which the order carries, and the payment attempts, inventory commits and
+// notifications its checkout made, which are recorded here as they happen.
+const (
+    TimelinePayment      = "payment_attempt"
+    TimelineInventory    = "inventory_commit"
+    TimelineStatusChange = "status_change"
+    TimelineNotification = "notification"
+    TimelineShipment     = "shipment"
+)
+
+// Entries in the same second are shown in the order a checkout makes
+// them: the order is created, charged, its stock committed, its status
+// settled and the customer told
+var timelineRank = map[string]int{
+    TimelinePayment:      1,
+    TimelineInventory:    2,
+    TimelineStatusChange: 3,
+    TimelineNotification: 4,
+    TimelineShipment:     5,
+}
+
+// Helper function to rank an entry among others in the same second
+func timelineOrder(entry TimelineEntry) int {
+    if entry.StatusChange != nil && entry.StatusChange.From == "" {
+        return 0
+    }
+    return timelineRank[entry.Type]
+}
+
+// PaymentAttempt is one charge of an order's payment method, or the
+// callback that settled one
+type PaymentAttempt struct {
+    PaymentID     string `json:"payment_id,omitempty"`
+    PaymentMethod string `json:"payment_method,omitempty"`
+    AmountCents   int    `json:"amount_cents,omitempty"`
+    Status        string `json:"status"` // as payment-service reported it, or "error" when it couldn't be reached
+    Message       string `json:"message,omitempty"`
+    Callback      bool   `json:"callback,omitempty"` // reported by the payment callback
+}
+
+// NotificationSent is a notification about an order that was delivered, or
+// given up on
+type NotificationSent struct {
+    Type      string `json:"type"`
+    Template  string `json:"template"`
+    Delivered bool   `json:"delivered"`
+    Attempts  int    `json:"attempts"`
+}
+
+// TimelineEntry is one thing that happened to an order. Exactly one of
+// the detail fields is set, matching Type.
+type TimelineEntry struct {
+    Type         string                `json:"type"`
+    At           int64                 `json:"at"`
+    Payment      *PaymentAttempt       `json:"payment,omitempty"`
+    Inventory    *committedReservation `json:"inventory,omitempty"`
+    StatusChange *StatusChange         `json:"status_change,omitempty"`
+    Notification *NotificationSent     `json:"notification,omitempty"`
+    Shipment     *OrderShipment        `json:"shipment,omitempty"`
+}
+
+// Recorded activity by order ID, oldest first: the entries the order
+// itself doesn't carry. Saved in the order snapshot like notes.
+var (
+    orderActivity = make(map[string][]TimelineEntry)
+    activityMu    sync.RWMutex
+)
+
+// Helper function to record something that happened to an order
+func recordActivity(orderID string, entry TimelineEntry) {
+    entry.At = time.Now().Unix()
+
+    activityMu.Lock()
+    orderActivity[orderID] = append(orderActivity[orderID], entry)
+    activityMu.Unlock()
+    snapshotDirty.Store(true)
+}
+
+// Helper function to record a payment attempt on an order
+func recordPaymentAttempt(orderID string, attempt PaymentAttempt) {
+    recordActivity(orderID, TimelineEntry{Type: TimelinePayment, Payment: &attempt})
+}
+
+// Helper function to record a reservation committed to an order
+func recordInventoryCommit(orderID string, reservation committedReservation) {
+    recordActivity(orderID, TimelineEntry{Type: TimelineInventory, Inventory: &reservation})
+}
+
+// Helper function to record the outcome of a notification, if it is about
+// an order
+func recordNotification(job *notificationJob, delivered bool) {
+    orderID, _ := job.Request.Data["order_id"].(string)
+    if orderID == "" {
+        return
+    }
+    recordActivity(orderID, TimelineEntry{Type: TimelineNotification, Notification: &NotificationSent{
+        Type:      job.Request.Type,
+        Template:  job.Request.Template,
+        Delivered: delivered,
+        Attempts:  job.Attempts,
+    }})
+}
+
+// Helper function to build an order's timeline, oldest first
+func orderTimeline(order Order) []TimelineEntry {
+    activityMu.RLock()
+    timeline := append([]TimelineEntry{}, orderActivity[order.OrderID]...)
+    activityMu.RUnlock()
+
+    for _, change := range statusHistory(order) {
+        change := change
+        timeline = append(timeline, TimelineEntry{Type: TimelineStatusChange, At: change.At, StatusChange: &change})
+    }
+    for _, shipment := range order.Shipments {
+        shipment := shipment
+        timeline = append(timeline, TimelineEntry{Type: TimelineShipment, At: shipment.CreatedAt, Shipment: &shipment})
+    }
+
+    sort.SliceStable(timeline, func(i, j int) bool {
+        if timeline[i].At != timeline[j].At {
+            return timeline[i].At < timeline[j].At
+        }
+        return timelineOrder(timeline[i]) < timelineOrder(timeline[j])
+    })
+    return timeline
+}
+
+// Helper function to copy the recorded activity for a snapshot
+func snapshotOrderActivity() map[string][]TimelineEntry {
+    activityMu.RLock()
+    defer activityMu.RUnlock()
+
+    activity := make(map[string][]TimelineEntry, len(orderActivity))
+    for orderID, entries := range orderActivity {
+        activity[orderID] = entries
+    }
+    return activity
+}
+
+// Helper function to restore recorded activity from a snapshot
+func restoreOrderActivity(activity map[string][]TimelineEntry) {
+    activityMu.Lock()
+    defer activityMu.Unlock()
+
+    for orderID, entries := range activity {
+        orderActivity[orderID] = entries
+    }
+}
+
+// Helper function to drop the recorded activity of orders that were
+// removed. No IDs drops all of it.
+func dropOrderActivity(orderIDs ...string) {
+    activityMu.Lock()
+    defer activityMu.Unlock()
+
+    if len(orderIDs) == 0 {
+        orderActivity = make(map[string][]TimelineEntry)
+        return
+    }
+    for _, orderID := range orderIDs {
+        delete(orderActivity, orderID)
+    }
+}
+
+// Get an order's timeline. Support staff only.
+func getOrderTimelineHandler(w http.ResponseWriter, r *http.Request) {
+    if _, ok := staffAuthor(r); !ok {
+        i18n.WriteError(w, r, http.StatusForbidden, "order.timeline_staff_only")
+        return
+    }
+
+    orderID := resolveOrderID(mux.Vars(r)["orderId"])
+    order, exists, err := noteOrder(orderID)
+    if err != nil {
+        log.Printf("Failed to read archived order %s: %v", orderID, err)
+        http.Error(w, "Failed to read order archive", http.StatusInternalServerError)
+        return
+    }
+    if !exists {
+        i18n.WriteError(w, r, http.StatusNotFound, "order.not_found")
+        return
+    }
+
+    timeline := orderTimeline(order)
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "order_id":     order.OrderID,
+        "order_number": order.OrderNumber,
+        "status":       order.Status,
+        "timeline":     timeline,
+        "total":        len(timeline),
+    })
+}
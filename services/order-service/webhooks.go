@@ -0,0 +1,306 @@
+package main
+
+import (
+    "bytes"
+    "crypto/rand"
+    "encoding/hex"
+    "encoding/json"
+    "fmt"
+    "io"
+    "net/http"
+    "net/url"
+    "sort"
+    "sync"
+    "time"
+
+    "github.com/google/uuid"
+    "github.com/gorilla/mux"
+    "middleware/adminauth"
+)
+
+// Webhook settings. Deliveries go through the outbox (see outbox.go), so
+// they are retried with its backoff, but a receiver that keeps failing is
+// given up on after WebhookMaxAttempts.
+const (
+    WebhookMaxAttempts = 10
+    WebhookDeliveryLog = 100 // deliveries kept per webhook
+)
+
+// Webhook is a merchant endpoint that receives order lifecycle events.
+// Payloads are the same OrderEvent the event sink gets, signed with the
+// webhook's own secret as described in signing.go.
+type Webhook struct {
+    ID        string   `json:"id"`
+    URL       string   `json:"url"`
+    Secret    string   `json:"secret,omitempty"`
+    Events    []string `json:"events,omitempty"` // event types; empty for all
+    CreatedAt int64    `json:"created_at"`
+}
+
+// WebhookDelivery is one attempt to deliver an event to a webhook
+type WebhookDelivery struct {
+    OutboxID   string `json:"outbox_id"`
+    EventID    string `json:"event_id"`
+    EventType  string `json:"event_type"`
+    OrderID    string `json:"order_id"`
+    Attempt    int    `json:"attempt"`
+    StatusCode int    `json:"status_code,omitempty"`
+    Error      string `json:"error,omitempty"`
+    DurationMs int64  `json:"duration_ms"`
+    At         int64  `json:"at"`
+}
+
+// Registered webhooks and their recent deliveries, newest last. Webhooks
+// are saved in the order snapshot; the delivery log is kept in memory.
+var (
+    webhooks          = make(map[string]Webhook)
+    webhookDeliveries = make(map[string][]WebhookDelivery)
+    webhookMu         sync.RWMutex
+)
+
+var webhookClient = newHTTPClient(5 * time.Second)
+
+// Helper function to check whether a type is one of the lifecycle events
+func isOrderEventType(eventType string) bool {
+    switch eventType {
+    case EventOrderCreated, EventOrderPaid, EventOrderShipped, EventOrderCancelled, EventOrderRefunded:
+        return true
+    }
+    return false
+}
+
+// Helper function to check whether a webhook wants an event type
+func (w Webhook) wants(eventType string) bool {
+    if len(w.Events) == 0 {
+        return true
+    }
+    for _, wanted := range w.Events {
+        if wanted == eventType {
+            return true
+        }
+    }
+    return false
+}
+
+// Helper function to list the webhooks that want an event type. Called
+// under a shard lock, so it must not take one.
+func webhooksFor(eventType string) []string {
+    webhookMu.RLock()
+    defer webhookMu.RUnlock()
+
+    var ids []string
+    for id, webhook := range webhooks {
+        if webhook.wants(eventType) {
+            ids = append(ids, id)
+        }
+    }
+    sort.Strings(ids)
+    return ids
+}
+
+// Helper function to copy the webhooks for a snapshot
+func snapshotWebhooks() []Webhook {
+    webhookMu.RLock()
+    defer webhookMu.RUnlock()
+
+    list := make([]Webhook, 0, len(webhooks))
+    for _, webhook := range webhooks {
+        list = append(list, webhook)
+    }
+    return list
+}
+
+// Helper function to restore webhooks from a snapshot
+func restoreWebhooks(list []Webhook) {
+    webhookMu.Lock()
+    defer webhookMu.Unlock()
+
+    for _, webhook := range list {
+        webhooks[webhook.ID] = webhook
+    }
+}
+
+// Helper function to deliver an outbox entry to its webhook. A webhook
+// removed since the entry was recorded has nothing left to deliver to.
+func deliverWebhook(entry outboxEntry) error {
+    webhookMu.RLock()
+    webhook, exists := webhooks[entry.WebhookID]
+    webhookMu.RUnlock()
+    if !exists {
+        return nil
+    }
+
+    body, err := json.Marshal(entry.Event)
+    if err != nil {
+        return err
+    }
+    req, err := http.NewRequest(http.MethodPost, webhook.URL, bytes.NewReader(body))
+    if err != nil {
+        return err
+    }
+    req.Header.Set("Content-Type", "application/json")
+    req.Header.Set("X-Webhook-ID", webhook.ID)
+    req.Header.Set("X-Event-ID", entry.Event.EventID)
+    req.Header.Set(SignatureHeader, signPayload(webhook.Secret, time.Now().Unix(), body))
+
+    start := time.Now()
+    delivery := WebhookDelivery{
+        OutboxID:  entry.ID,
+        EventID:   entry.Event.EventID,
+        EventType: entry.Event.Type,
+        OrderID:   entry.OrderID,
+        Attempt:   entry.Attempts + 1,
+        At:        start.Unix(),
+    }
+    resp, err := webhookClient.Do(req)
+    if err == nil {
+        io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+        resp.Body.Close()
+        delivery.StatusCode = resp.StatusCode
+        if resp.StatusCode >= 300 {
+            err = fmt.Errorf("webhook returned status %d", resp.StatusCode)
+        }
+    }
+    delivery.DurationMs = time.Since(start).Milliseconds()
+    if err != nil {
+        delivery.Error = err.Error()
+    }
+
+    webhookMu.Lock()
+    recent := append(webhookDeliveries[webhook.ID], delivery)
+    if len(recent) > WebhookDeliveryLog {
+        recent = recent[len(recent)-WebhookDeliveryLog:]
+    }
+    webhookDeliveries[webhook.ID] = recent
+    webhookMu.Unlock()
+    return err
+}
+
+// Helper function to generate a signing secret
+func newWebhookSecret() string {
+    secret := make([]byte, 24)
+    rand.Read(secret)
+    return "whsec_" + hex.EncodeToString(secret)
+}
+
+// Admin endpoint to register a webhook. Takes {"url", "events", "secret"};
+// events defaults to every lifecycle event and a secret is generated when
+// none is given. The secret is only returned here.
+func createWebhookHandler(w http.ResponseWriter, r *http.Request) {
+    var req struct {
+        URL    string   `json:"url"`
+        Events []string `json:"events"`
+        Secret string   `json:"secret"`
+    }
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+        http.Error(w, "Invalid JSON", http.StatusBadRequest)
+        return
+    }
+
+    target, err := url.Parse(req.URL)
+    if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+        http.Error(w, "url must be an absolute http or https URL", http.StatusBadRequest)
+        return
+    }
+    for _, eventType := range req.Events {
+        if !isOrderEventType(eventType) {
+            http.Error(w, fmt.Sprintf("unknown event type %q", eventType), http.StatusBadRequest)
+            return
+        }
+    }
+    if req.Secret == "" {
+        req.Secret = newWebhookSecret()
+    }
+
+    webhook := Webhook{
+        ID:        "wh_" + uuid.New().String(),
+        URL:       target.String(),
+        Secret:    req.Secret,
+        Events:    req.Events,
+        CreatedAt: time.Now().Unix(),
+    }
+    webhookMu.Lock()
+    webhooks[webhook.ID] = webhook
+    webhookMu.Unlock()
+    persistOrders()
+
+    adminauth.Audit(r, "webhook_create", map[string]interface{}{
+        "webhook_id": webhook.ID, "url": webhook.URL, "events": webhook.Events,
+    })
+
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(http.StatusCreated)
+    json.NewEncoder(w).Encode(webhook)
+}
+
+// Admin endpoint to list webhooks, oldest first, without their secrets
+func listWebhooksHandler(w http.ResponseWriter, r *http.Request) {
+    list := snapshotWebhooks()
+    sort.Slice(list, func(i, j int) bool {
+        if list[i].CreatedAt != list[j].CreatedAt {
+            return list[i].CreatedAt < list[j].CreatedAt
+        }
+        return list[i].ID < list[j].ID
+    })
+    for i := range list {
+        list[i].Secret = ""
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "webhooks": list,
+        "total":    len(list),
+    })
+}
+
+// Admin endpoint to remove a webhook. Deliveries still waiting in the
+// outbox are dropped.
+func deleteWebhookHandler(w http.ResponseWriter, r *http.Request) {
+    webhookID := mux.Vars(r)["webhookId"]
+
+    webhookMu.Lock()
+    _, exists := webhooks[webhookID]
+    delete(webhooks, webhookID)
+    delete(webhookDeliveries, webhookID)
+    webhookMu.Unlock()
+    if !exists {
+        http.Error(w, "Webhook not found", http.StatusNotFound)
+        return
+    }
+    persistOrders()
+
+    adminauth.Audit(r, "webhook_delete", map[string]interface{}{"webhook_id": webhookID})
+    w.WriteHeader(http.StatusNoContent)
+}
+
+// Admin endpoint to list a webhook's recent deliveries, newest first,
+// and the deliveries still waiting to be retried
+func getWebhookDeliveriesHandler(w http.ResponseWriter, r *http.Request) {
+    webhookID := mux.Vars(r)["webhookId"]
+
+    webhookMu.RLock()
+    _, exists := webhooks[webhookID]
+    deliveries := make([]WebhookDelivery, 0, len(webhookDeliveries[webhookID]))
+    for i := len(webhookDeliveries[webhookID]) - 1; i >= 0; i-- {
+        deliveries = append(deliveries, webhookDeliveries[webhookID][i])
+    }
+    webhookMu.RUnlock()
+    if !exists {
+        http.Error(w, "Webhook not found", http.StatusNotFound)
+        return
+    }
+
+    pending := []outboxEntry{}
+    for _, entry := range pendingOutbox() {
+        if entry.Kind == OutboxWebhook && entry.WebhookID == webhookID {
+            pending = append(pending, entry)
+        }
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "webhook_id": webhookID,
+        "deliveries": deliveries,
+        "pending":    pending,
+    })
+}
@@ -0,0 +1,106 @@
+// Amounts are integers in the currency's minor unit: cents for USD, yen
+// for JPY (no minor unit), fils for KWD (thousandths). Mirrors money.go in
+// the Go services so every service agrees on codes and minor units.
+
+const DEFAULT_CURRENCY = 'USD';
+
+// ISO 4217 currencies by number of minor-unit digits. Codes not listed
+// (including precious metals and testing codes) are rejected.
+const CURRENCIES_BY_DIGITS = {
+  0: 'BIF CLP DJF GNF ISK JPY KMF KRW PYG RWF UGX UYI VND VUV XAF XOF XPF',
+  2: 'AED AFN ALL AMD ANG AOA ARS AUD AWG AZN BAM BBD BDT BGN BMD BND BOB BOV BRL BSD BTN ' +
+    'BWP BYN BZD CAD CDF CHE CHF CHW CNY COP COU CRC CUP CVE CZK DKK DOP DZD EGP ERN ETB ' +
+    'EUR FJD FKP GBP GEL GHS GIP GMD GTQ GYD HKD HNL HTG HUF IDR ILS INR IRR JMD KES KGS ' +
+    'KHR KPW KYD KZT LAK LBP LKR LRD LSL MAD MDL MGA MKD MMK MNT MOP MRU MUR MVR MWK MXN ' +
+    'MXV MYR MZN NAD NGN NIO NOK NPR NZD PAB PEN PGK PHP PKR PLN QAR RON RSD RUB SAR SBD ' +
+    'SCR SDG SEK SGD SHP SLE SOS SRD SSP STN SVC SYP SZL THB TJS TMT TOP TRY TTD TWD TZS ' +
+    'UAH USD USN UYU UZS VED VES WST XCD XCG YER ZAR ZMW ZWG',
+  3: 'BHD IQD JOD KWD LYD OMR TND',
+  4: 'CLF UYW'
+};
+
+const MINOR_UNITS = new Map();
+for (const [digits, codes] of Object.entries(CURRENCIES_BY_DIGITS)) {
+  for (const code of codes.split(' ')) {
+    MINOR_UNITS.set(code, Number(digits));
+  }
+}
+
+// Validate a currency code, returning it upper-cased (null if unsupported).
+// An empty code means DEFAULT_CURRENCY.
+const normalizeCurrency = (code) => {
+  if (code === undefined || code === null || code === '') {
+    return DEFAULT_CURRENCY;
+  }
+  if (typeof code !== 'string') {
+    return null;
+  }
+  const normalized = code.trim().toUpperCase();
+  return MINOR_UNITS.has(normalized) ? normalized : null;
+};
+
+const minorUnits = (currency) => (MINOR_UNITS.has(currency) ? MINOR_UNITS.get(currency) : 2);
+
+// Format a minor-unit amount in major units: 123456 USD is "1234.56"
+const formatAmount = (amount, currency) => {
+  const digits = minorUnits(currency);
+  const sign = amount < 0 ? '-' : '';
+  let text = String(Math.abs(amount));
+  if (digits > 0) {
+    text = text.padStart(digits + 1, '0');
+    text = `${text.slice(0, -digits)}.${text.slice(-digits)}`;
+  }
+  return `${sign}${text}`;
+};
+
+// Parse a decimal string in major units into minor units ("10.5" USD is
+// 1050). Returns null for malformed input or more decimals than the
+// currency has.
+const parseAmount = (value, currency) => {
+  const digits = minorUnits(currency);
+  const match = /^([+-]?)(\d+)(?:\.(\d+))?$/.exec(String(value).trim());
+  if (!match || (match[3] || '').length > digits) {
+    return null;
+  }
+  const fraction = (match[3] || '').padEnd(digits, '0');
+  const amount = Number(match[2] + fraction);
+  if (!Number.isSafeInteger(amount)) {
+    return null;
+  }
+  return match[1] === '-' ? -amount : amount;
+};
+
+// Exchange rates are decimal strings (units of the target currency per unit
+// of the source) so conversions can be done exactly with BigInt.
+const RATE_PATTERN = /^\d+(\.\d{1,10})?$/;
+
+const isValidRate = (rate) => typeof rate === 'string' && RATE_PATTERN.test(rate) && /[1-9]/.test(rate);
+
+// Reduce a rate by a markup in basis points: 1.0850 less 150 bps is 1.068725
+const applyMarkup = (rate, markupBps) => {
+  const [whole, fraction = ''] = rate.split('.');
+  const scaled = (BigInt(whole + fraction) * BigInt(10000 - markupBps)).toString().padStart(fraction.length + 5, '0');
+  const digits = fraction.length + 4;
+  const result = `${scaled.slice(0, -digits)}.${scaled.slice(-digits)}`.replace(/\.?0+$/, '');
+  return result === '' ? '0' : result;
+};
+
+// Convert a non-negative minor-unit amount between currencies at a decimal
+// rate, rounding half up: 10000 EUR (100.00) at 1.085 is 10850 USD
+const convertAmount = (amount, fromCurrency, toCurrency, rate) => {
+  const [whole, fraction = ''] = rate.split('.');
+  const numerator = BigInt(amount) * BigInt(whole + fraction) * 10n ** BigInt(minorUnits(toCurrency));
+  const denominator = 10n ** BigInt(fraction.length + minorUnits(fromCurrency));
+  return Number((numerator * 2n + denominator) / (2n * denominator));
+};
+
+module.exports = {
+  DEFAULT_CURRENCY,
+  normalizeCurrency,
+  minorUnits,
+  formatAmount,
+  parseAmount,
+  isValidRate,
+  applyMarkup,
+  convertAmount
+};
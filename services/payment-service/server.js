@@ -4,10 +4,67 @@ const helmet = require('helmet');
 const rateLimit = require('express-rate-limit');
 const { v4: uuidv4 } = require('uuid');
 const morgan = require('morgan');
+const crypto = require('crypto');
+const fs = require('fs');
+const tls = require('tls');
+const { EnvHttpProxyAgent, setGlobalDispatcher } = require('undici');
+const { normalizeCurrency, formatAmount, isValidRate, applyMarkup, convertAmount } = require('./money');
 
 const app = express();
 const PORT = process.env.PORT || 3002;
 const STRIPE_SECRET_KEY = process.env.STRIPE_SECRET_KEY || 'sk_test_mock_key';
+const ORDER_SERVICE_URL = process.env.ORDER_SERVICE_URL || '';
+// Shared with order-service, which rejects unsigned payment callbacks when it is set
+const PAYMENT_CALLBACK_SECRET = process.env.PAYMENT_CALLBACK_SECRET || '';
+// Card payments at or above this amount require 3-D Secure authentication (0 disables)
+const SCA_THRESHOLD_CENTS = parseInt(process.env.SCA_THRESHOLD_CENTS, 10) || 0;
+const SCA_CHALLENGE_TTL = 60 * 60 * 1000; // 1 hour
+
+// Shoppers pay in their presentment currency; funds settle in the merchant's
+// SETTLEMENT_CURRENCY. FX_RATES gives settlement units per unit of each
+// presentment currency ("EUR=1.085,GBP=1.27"), and FX_MARKUP_BPS is taken
+// off the rate as the conversion fee. Without FX_RATES, payments settle in
+// the currency they were taken in. Bad settings stop the service.
+const SETTLEMENT_CURRENCY = normalizeCurrency(process.env.SETTLEMENT_CURRENCY || '');
+if (!SETTLEMENT_CURRENCY) {
+  throw new Error(`Unsupported SETTLEMENT_CURRENCY: ${process.env.SETTLEMENT_CURRENCY}`);
+}
+const FX_MARKUP_BPS = Number(process.env.FX_MARKUP_BPS || 0);
+if (!Number.isInteger(FX_MARKUP_BPS) || FX_MARKUP_BPS < 0 || FX_MARKUP_BPS > 1000) {
+  throw new Error(`FX_MARKUP_BPS must be a whole number of basis points from 0 to 1000, got ${process.env.FX_MARKUP_BPS}`);
+}
+const parseFxRates = (spec) => {
+  const rates = new Map();
+  for (const entry of (spec || '').split(',').map((part) => part.trim()).filter(Boolean)) {
+    const [code, rate] = entry.split('=').map((part) => part.trim());
+    const currency = normalizeCurrency(code);
+    if (!currency || !isValidRate(rate)) {
+      throw new Error(`Invalid FX_RATES entry "${entry}", expected CODE=rate such as EUR=1.085`);
+    }
+    rates.set(currency, rate);
+  }
+  return rates;
+};
+const FX_RATES = parseFxRates(process.env.FX_RATES);
+
+// Outbound HTTP, matching the Go services: fetch() goes through
+// HTTPS_PROXY / HTTP_PROXY (except hosts in NO_PROXY) and trusts the CA
+// certificates in OUTBOUND_CA_BUNDLE on top of the bundled roots
+const configureOutbound = () => {
+  const bundlePath = process.env.OUTBOUND_CA_BUNDLE;
+  const proxied = ['HTTPS_PROXY', 'https_proxy', 'HTTP_PROXY', 'http_proxy'].some((name) => process.env[name]);
+  if (!bundlePath && !proxied) {
+    return;
+  }
+
+  const tlsOptions = {};
+  if (bundlePath) {
+    tlsOptions.ca = [...tls.rootCertificates, fs.readFileSync(bundlePath, 'utf8')];
+    console.log(`Trusting extra CA certificates from ${bundlePath} for outbound calls`);
+  }
+  setGlobalDispatcher(new EnvHttpProxyAgent({ connect: tlsOptions, requestTls: tlsOptions, proxyTls: tlsOptions }));
+};
+configureOutbound();
 
 // Stripe configuration (mocked for MVP)
 // const stripe = require('stripe')(STRIPE_SECRET_KEY);
@@ -15,13 +72,144 @@ const STRIPE_SECRET_KEY = process.env.STRIPE_SECRET_KEY || 'sk_test_mock_key';
 // In-memory payment store (for MVP)
 const payments = new Map();
 const transactions = new Map();
+const savedPaymentMethods = new Map(); // payment_method_id -> stored provider token
+
+// CORS policy from CORS_* settings, matching the Go services: origins are
+// listed explicitly (the local frontend when APP_ENV=development, none
+// otherwise), and "*" turns credentialed requests off
+const corsList = (name, fallback) => {
+  const value = process.env[name];
+  if (value === undefined) return fallback;
+  return value.split(',').map((item) => item.trim()).filter(Boolean);
+};
+
+const corsOptions = () => {
+  const fallbackOrigins = process.env.APP_ENV === 'development'
+    ? ['http://localhost:3000', 'http://127.0.0.1:3000', 'http://localhost']
+    : [];
+  const origins = corsList('CORS_ALLOWED_ORIGINS', fallbackOrigins);
+  const anyOrigin = origins.includes('*');
+  const maxAge = parseInt(process.env.CORS_MAX_AGE_SECONDS || '600', 10);
+
+  return {
+    origin: anyOrigin ? '*' : (origins.length > 0 ? origins : false),
+    methods: corsList('CORS_ALLOWED_METHODS', ['GET', 'POST', 'PUT', 'DELETE', 'OPTIONS']),
+    allowedHeaders: corsList('CORS_ALLOWED_HEADERS', ['Authorization', 'Content-Type', 'Accept', 'Accept-Language', 'X-API-Key', 'X-Request-ID', 'X-Acting-As', 'traceparent']),
+    exposedHeaders: ['X-Request-ID', 'X-Error-Code', 'Content-Language', 'API-Version', 'Deprecation', 'Sunset', 'Link', 'Retry-After'],
+    credentials: !anyOrigin && process.env.CORS_ALLOW_CREDENTIALS !== 'false',
+    maxAge: Number.isNaN(maxAge) || maxAge < 0 ? 600 : maxAge
+  };
+};
 
 // Middleware
 app.use(helmet());
-app.use(cors());
+app.use(cors(corsOptions()));
 app.use(morgan('combined'));
 app.use(express.json({ limit: '10mb' }));
 
+// API versions, oldest first. Routes are served under /api/<version>/...
+// and under the legacy unversioned /api/... paths, which alias the default
+// version. To change routes in a new version, add it here and mount an
+// express.Router at /api/<version> ahead of apiVersionMiddleware; requests
+// that router doesn't handle fall through to the existing routes.
+const API_VERSIONS = ['v1'];
+const DEFAULT_API_VERSION = 'v1';
+
+// API_DEPRECATIONS ("v1=2027-06-30,v2") marks versions deprecated, with an
+// optional sunset date after which they answer 410 Gone
+const parseApiDeprecations = (spec) => {
+  const deprecations = new Map();
+  for (const entry of (spec || '').split(',')) {
+    const [name, date] = entry.trim().split('=');
+    if (!name) {
+      continue;
+    }
+    if (!API_VERSIONS.includes(name)) {
+      console.warn(`Ignoring API_DEPRECATIONS entry for unknown version ${name}`);
+      continue;
+    }
+    const sunset = date ? new Date(`${date}T00:00:00Z`) : null;
+    if (sunset && isNaN(sunset.getTime())) {
+      console.warn(`Ignoring invalid sunset date ${date} for API ${name}`);
+      continue;
+    }
+    deprecations.set(name, { sunset });
+  }
+  return deprecations;
+};
+
+const apiDeprecations = parseApiDeprecations(process.env.API_DEPRECATIONS);
+// Requests served per version, split by legacy (unversioned) paths
+const apiVersionRequests = new Map();
+
+// Tag responses with the API version served, add Deprecation/Sunset/Link
+// headers (RFC 8594) for deprecated versions, and route /api/<version>/...
+// to the unversioned handlers
+const apiVersionMiddleware = (req, res, next) => {
+  const match = req.url.match(/^\/api\/(v\d+)(?=[/?]|$)/);
+  if (!match && !req.url.startsWith('/api/')) {
+    return next();
+  }
+
+  const version = match ? match[1] : DEFAULT_API_VERSION;
+  if (!API_VERSIONS.includes(version)) {
+    return res.status(404).json({ error: `Unknown API version ${version}` });
+  }
+
+  const key = `${version}|${!match}`;
+  apiVersionRequests.set(key, (apiVersionRequests.get(key) || 0) + 1);
+
+  const path = match ? '/api' + req.url.slice(match[0].length) : req.url;
+  res.set('API-Version', version);
+
+  const deprecation = apiDeprecations.get(version);
+  if (deprecation) {
+    res.set('Deprecation', 'true');
+    const successor = API_VERSIONS[API_VERSIONS.indexOf(version) + 1];
+    if (successor) {
+      const resource = path.split(/[/?]/)[2];
+      res.set('Link', `</api/${successor}/${resource}>; rel="successor-version"`);
+    }
+    if (deprecation.sunset) {
+      res.set('Sunset', deprecation.sunset.toUTCString());
+      if (Date.now() > deprecation.sunset.getTime()) {
+        const retired = deprecation.sunset.toISOString().slice(0, 10);
+        return res.status(410).json({ error: `API ${version} was retired on ${retired}` });
+      }
+    }
+  }
+
+  req.url = path;
+  next();
+};
+
+const apiVersionMetrics = () => {
+  let metrics = `
+# HELP api_version_requests_total Requests served per API version (legacy = unversioned /api paths)
+# TYPE api_version_requests_total counter
+`;
+  for (const version of API_VERSIONS) {
+    for (const legacy of [false, true]) {
+      if (legacy && version !== DEFAULT_API_VERSION) {
+        continue;
+      }
+      const count = apiVersionRequests.get(`${version}|${legacy}`) || 0;
+      metrics += `api_version_requests_total{version="${version}",legacy="${legacy}"} ${count}\n`;
+    }
+  }
+
+  metrics += `
+# HELP api_version_deprecated Whether an API version is deprecated
+# TYPE api_version_deprecated gauge
+`;
+  for (const version of API_VERSIONS) {
+    metrics += `api_version_deprecated{version="${version}"} ${apiDeprecations.has(version) ? 1 : 0}\n`;
+  }
+  return metrics;
+};
+
+app.use(apiVersionMiddleware);
+
 // Rate limiting
 const limiter = rateLimit({
   windowMs: 15 * 60 * 1000, // 15 minutes
@@ -29,6 +217,58 @@ const limiter = rateLimit({
 });
 app.use('/api/payments', limiter);
 
+// Admin endpoints are disabled entirely unless ADMIN_TOKEN is configured
+const ADMIN_TOKEN = process.env.ADMIN_TOKEN || '';
+const SERVICE_NAME = 'payment-service';
+// IDs created by tests and load generators; scoped clears (?scope=test) only remove these
+const TEST_DATA_PREFIX = 'test-';
+
+const auditAdminAction = (req, action, details = {}) => {
+  console.log('AUDIT ' + JSON.stringify({
+    event: 'admin_action',
+    service: SERVICE_NAME,
+    action,
+    method: req.method,
+    path: req.originalUrl,
+    remote_addr: req.ip,
+    user_agent: req.get('user-agent'),
+    timestamp: Date.now(),
+    ...details
+  }));
+};
+
+// Admin middleware: requires the ADMIN_TOKEN bearer token
+const requireAdmin = (req, res, next) => {
+  if (!ADMIN_TOKEN) {
+    return res.status(403).json({ error: 'Admin endpoints disabled: ADMIN_TOKEN not configured' });
+  }
+
+  const authHeader = req.headers['authorization'] || '';
+  const token = authHeader.replace(/^Bearer /, '');
+  const expected = Buffer.from(ADMIN_TOKEN);
+  const provided = Buffer.from(token);
+  if (provided.length !== expected.length || !crypto.timingSafeEqual(provided, expected)) {
+    auditAdminAction(req, 'auth_failed');
+    return res.status(401).json({ error: 'Admin token required' });
+  }
+
+  next();
+};
+
+// Destructive calls must name the service in ?confirm= and may narrow to ?scope=test
+const confirmClear = (req, res) => {
+  const scope = req.query.scope || 'all';
+  if (scope !== 'all' && scope !== 'test') {
+    res.status(400).json({ error: "Scope must be 'all' or 'test'" });
+    return null;
+  }
+  if (req.query.confirm !== SERVICE_NAME) {
+    res.status(400).json({ error: `Confirmation required: pass ?confirm=${SERVICE_NAME}` });
+    return null;
+  }
+  return scope;
+};
+
 // Mock payment methods
 const SUPPORTED_PAYMENT_METHODS = [
   'credit_card',
@@ -36,7 +276,28 @@ const SUPPORTED_PAYMENT_METHODS = [
   'paypal',
   'apple_pay',
   'google_pay',
-  'bank_transfer'
+  'bank_transfer',
+  'gift_card'
+];
+
+// Payment methods that can be stored as provider tokens for later reuse
+const SAVEABLE_PAYMENT_METHODS = ['credit_card', 'debit_card', 'paypal', 'bank_transfer'];
+
+// Provider tokens look like tok_xxx / pm_xxx / src_xxx; raw card numbers are never accepted
+const PROVIDER_TOKEN_PATTERN = /^(tok|pm|src)_[A-Za-z0-9]{8,}$/;
+const PAN_PATTERN = /^[0-9 -]{12,23}$/;
+
+// Payment methods subject to strong customer authentication
+const SCA_PAYMENT_METHODS = ['credit_card', 'debit_card'];
+
+// Mock decline reasons returned by the simulated processor
+const DECLINE_MESSAGES = [
+  'Insufficient funds',
+  'Card declined',
+  'Invalid card number',
+  'Expired card',
+  'Security code incorrect',
+  'Processing error'
 ];
 
 // Helper functions
@@ -44,8 +305,298 @@ const generatePaymentID = () => {
   return 'pi_' + uuidv4().replace(/-/g, '').substring(0, 24);
 };
 
+// Amounts are whole minor units of the payment's currency (see money.js)
+const MAX_PAYMENT_AMOUNT = 999999999;
+
 const validatePaymentAmount = (amount) => {
-  return typeof amount === 'number' && amount > 0 && amount <= 999999999; // Max $9,999,999.99
+  return Number.isInteger(amount) && amount > 0 && amount <= MAX_PAYMENT_AMOUNT;
+};
+
+const validatePaymentRequest = ({ amount, currency, payment_method, order_id, split_index }) => {
+  const normalizedCurrency = normalizeCurrency(currency);
+  if (!normalizedCurrency) {
+    return {
+      status: 400,
+      body: {
+        success: false,
+        error: `Unsupported currency: ${currency}`
+      }
+    };
+  }
+
+  if (!validatePaymentAmount(amount)) {
+    return {
+      status: 400,
+      body: {
+        success: false,
+        error: `Invalid payment amount. Must be a whole number of minor units (${formatAmount(1, normalizedCurrency)} to ${formatAmount(MAX_PAYMENT_AMOUNT, normalizedCurrency)} ${normalizedCurrency})`
+      }
+    };
+  }
+
+  if (!payment_method || !SUPPORTED_PAYMENT_METHODS.includes(payment_method)) {
+    return {
+      status: 400,
+      body: {
+        success: false,
+        error: 'Invalid or unsupported payment method',
+        supported_methods: SUPPORTED_PAYMENT_METHODS
+      }
+    };
+  }
+
+  if (!order_id) {
+    return {
+      status: 400,
+      body: {
+        success: false,
+        error: 'Order ID is required'
+      }
+    };
+  }
+
+  if (split_index !== undefined && !(Number.isInteger(split_index) && split_index >= 0)) {
+    return {
+      status: 400,
+      body: {
+        success: false,
+        error: 'split_index must be a whole number of at least 0'
+      }
+    };
+  }
+
+  return null;
+};
+
+// An order is settled once it has a captured payment or an open authorization.
+// Orders paid with several methods take one payment per split_index.
+const findSettledPaymentForOrder = (orderId, splitIndex = 0) => {
+  for (let payment of payments.values()) {
+    if (payment.order_id === orderId && (payment.split_index || 0) === splitIndex &&
+        ['succeeded', 'requires_capture'].includes(payment.status)) {
+      return payment;
+    }
+  }
+  return null;
+};
+
+const toSafePaymentMethod = (method) => {
+  const { provider_token, ...safeMethod } = method;
+  return safeMethod;
+};
+
+const getUserPaymentMethods = (userId) => {
+  return Array.from(savedPaymentMethods.values())
+    .filter(m => m.user_id === userId)
+    .sort((a, b) => a.created_at - b.created_at);
+};
+
+// Resolve saved_payment_method_id on a charge request into the underlying method type
+const resolveSavedPaymentMethod = ({ payment_method, saved_payment_method_id, user_id }) => {
+  if (!saved_payment_method_id) {
+    return { payment_method, savedMethod: null };
+  }
+
+  const savedMethod = savedPaymentMethods.get(saved_payment_method_id);
+  if (!savedMethod || (user_id && savedMethod.user_id !== user_id)) {
+    return {
+      error: {
+        status: 404,
+        body: {
+          success: false,
+          error: 'Saved payment method not found'
+        }
+      }
+    };
+  }
+
+  return { payment_method: savedMethod.type, savedMethod };
+};
+
+// Work out what a payment settles for. Returns the settlement fields stored
+// on the payment record, or an error when the currency can't be converted.
+const settlePayment = (amount, currency) => {
+  if (currency === SETTLEMENT_CURRENCY || FX_RATES.size === 0) {
+    return {
+      fields: {
+        settlement_amount: amount,
+        settlement_currency: currency,
+        fx_rate: '1',
+        fx_markup_bps: 0,
+        fx_effective_rate: '1',
+        fx_markup_amount: 0
+      }
+    };
+  }
+
+  const rate = FX_RATES.get(currency);
+  if (!rate) {
+    return {
+      error: {
+        status: 400,
+        body: {
+          success: false,
+          error: `Payments in ${currency} are not supported: no exchange rate to ${SETTLEMENT_CURRENCY}`
+        }
+      }
+    };
+  }
+
+  const effectiveRate = applyMarkup(rate, FX_MARKUP_BPS);
+  const settlementAmount = convertAmount(amount, currency, SETTLEMENT_CURRENCY, effectiveRate);
+  return {
+    fields: {
+      settlement_amount: settlementAmount,
+      settlement_currency: SETTLEMENT_CURRENCY,
+      fx_rate: rate,
+      fx_markup_bps: FX_MARKUP_BPS,
+      fx_effective_rate: effectiveRate,
+      fx_markup_amount: convertAmount(amount, currency, SETTLEMENT_CURRENCY, rate) - settlementAmount
+    }
+  };
+};
+
+// Convert part of a payment (a capture or refund) to the settlement currency
+// at the rate the payment was taken at
+const settledAmount = (payment, amount) => {
+  if (!payment.fx_effective_rate) {
+    return amount;
+  }
+  return convertAmount(amount, payment.currency, payment.settlement_currency, payment.fx_effective_rate);
+};
+
+// Settlement summary included in payment responses
+const settlementSummary = (payment) => ({
+  amount: payment.settlement_amount,
+  currency: payment.settlement_currency,
+  fx_rate: payment.fx_rate,
+  fx_markup_bps: payment.fx_markup_bps,
+  fx_effective_rate: payment.fx_effective_rate
+});
+
+// Amount actually taken from the customer; partial captures settle for less than authorized
+const capturedAmount = (payment) => {
+  return payment.amount_captured !== undefined ? payment.amount_captured : payment.amount;
+};
+
+const recordTransaction = (fields) => {
+  const transaction = {
+    transaction_id: 'txn_' + uuidv4().substring(0, 16),
+    status: 'completed',
+    created_at: Date.now(),
+    ...fields
+  };
+  transactions.set(transaction.transaction_id, transaction);
+  return transaction;
+};
+
+const randomDeclineMessage = () => {
+  return DECLINE_MESSAGES[Math.floor(Math.random() * DECLINE_MESSAGES.length)];
+};
+
+const requiresAuthentication = ({ require_authentication }, paymentMethod, amount) => {
+  if (!SCA_PAYMENT_METHODS.includes(paymentMethod)) {
+    return false;
+  }
+  return require_authentication === true || (SCA_THRESHOLD_CENTS > 0 && amount >= SCA_THRESHOLD_CENTS);
+};
+
+// Put the payment into requires_action and build the challenge the client must complete
+const startAuthenticationChallenge = (payment, returnUrl) => {
+  payment.status = 'requires_action';
+  payment.client_secret = `${payment.payment_id}_secret_${uuidv4().replace(/-/g, '').substring(0, 16)}`;
+  payment.next_action = {
+    type: 'redirect_to_url',
+    redirect_to_url: {
+      url: `https://acs.mock-3ds.test/challenge/${payment.payment_id}`,
+      return_url: returnUrl || null
+    }
+  };
+  payment.updated_at = Date.now();
+
+  return {
+    success: false,
+    payment_id: payment.payment_id,
+    status: 'requires_action',
+    amount: payment.amount,
+    currency: payment.currency,
+    client_secret: payment.client_secret,
+    next_action: payment.next_action,
+    message: 'Customer authentication required'
+  };
+};
+
+// Finish a payment once its authentication challenge has been passed
+const completeAuthenticatedPayment = async (payment) => {
+  const processingSuccess = await simulatePaymentProcessing();
+
+  if (processingSuccess) {
+    const manualCapture = payment.capture_method === 'manual';
+
+    if (manualCapture) {
+      payment.status = 'requires_capture';
+      payment.authorized_at = Date.now();
+    } else {
+      payment.status = 'succeeded';
+      payment.amount_captured = payment.amount;
+      payment.processed_at = Date.now();
+    }
+    payment.stripe_payment_id = 'pi_mock_' + uuidv4().substring(0, 8);
+    if (!payment.last_4_digits) {
+      payment.last_4_digits = Math.floor(Math.random() * 9000) + 1000;
+    }
+
+    recordTransaction({
+      payment_id: payment.payment_id,
+      type: manualCapture ? 'authorization' : 'payment',
+      amount: payment.amount,
+      currency: payment.currency
+    });
+  } else {
+    payment.status = 'failed';
+    payment.error_message = randomDeclineMessage();
+  }
+
+  payment.updated_at = Date.now();
+  payments.set(payment.payment_id, payment);
+};
+
+// X-Signature for a callback body: t=<unix seconds>,v1=<hex HMAC-SHA256 of "<t>.<body>">
+const signPayload = (secret, body) => {
+  const timestamp = Math.floor(Date.now() / 1000);
+  const signature = crypto.createHmac('sha256', secret).update(`${timestamp}.${body}`).digest('hex');
+  return `t=${timestamp},v1=${signature}`;
+};
+
+// Tell order-service how an asynchronously completed payment ended
+const notifyOrderService = async (payment) => {
+  if (!ORDER_SERVICE_URL || !payment.order_id) {
+    return;
+  }
+
+  const body = JSON.stringify({
+    payment_id: payment.payment_id,
+    status: payment.status,
+    message: payment.error_message || null
+  });
+  const headers = { 'Content-Type': 'application/json' };
+  if (PAYMENT_CALLBACK_SECRET) {
+    headers['X-Signature'] = signPayload(PAYMENT_CALLBACK_SECRET, body);
+  }
+
+  try {
+    const response = await fetch(`${ORDER_SERVICE_URL}/api/orders/${payment.order_id}/payment-callback`, {
+      method: 'POST',
+      headers,
+      body
+    });
+
+    if (!response.ok) {
+      console.error(`Order service callback for ${payment.payment_id} returned ${response.status}`);
+    }
+  } catch (error) {
+    console.error(`Order service callback for ${payment.payment_id} failed:`, error.message);
+  }
 };
 
 const simulatePaymentProcessing = () => {
@@ -74,39 +625,31 @@ app.get('/health', (req, res) => {
 // Process payment
 app.post('/api/payments/process', async (req, res) => {
   try {
-    const { amount, currency = 'USD', payment_method, order_id, customer_email } = req.body;
+    const { amount, order_id, customer_email } = req.body;
 
-    // Validation
-    if (!validatePaymentAmount(amount)) {
-      return res.status(400).json({ 
-        success: false,
-        error: 'Invalid payment amount. Must be between $0.01 and $99,999,999.99' 
-      });
+    const savedMethodResult = resolveSavedPaymentMethod(req.body);
+    if (savedMethodResult.error) {
+      return res.status(savedMethodResult.error.status).json(savedMethodResult.error.body);
     }
+    const { payment_method, savedMethod } = savedMethodResult;
 
-    if (!payment_method || !SUPPORTED_PAYMENT_METHODS.includes(payment_method)) {
-      return res.status(400).json({ 
-        success: false,
-        error: 'Invalid or unsupported payment method',
-        supported_methods: SUPPORTED_PAYMENT_METHODS
-      });
+    const validationError = validatePaymentRequest({ ...req.body, payment_method });
+    if (validationError) {
+      return res.status(validationError.status).json(validationError.body);
     }
-
-    if (!order_id) {
-      return res.status(400).json({ 
-        success: false,
-        error: 'Order ID is required' 
-      });
+    const currency = normalizeCurrency(req.body.currency);
+    const settlement = settlePayment(amount, currency);
+    if (settlement.error) {
+      return res.status(settlement.error.status).json(settlement.error.body);
     }
 
     // Check if order already has a successful payment
-    for (let payment of payments.values()) {
-      if (payment.order_id === order_id && payment.status === 'succeeded') {
-        return res.status(409).json({
-          success: false,
-          error: 'Payment already processed for this order'
-        });
-      }
+    const splitIndex = req.body.split_index || 0;
+    if (findSettledPaymentForOrder(order_id, splitIndex)) {
+      return res.status(409).json({
+        success: false,
+        error: 'Payment already processed for this order'
+      });
     }
 
     const paymentID = generatePaymentID();
@@ -115,9 +658,12 @@ app.post('/api/payments/process', async (req, res) => {
     const payment = {
       payment_id: paymentID,
       amount,
-      currency: currency.toUpperCase(),
+      currency,
+      ...settlement.fields,
       payment_method,
+      saved_payment_method_id: savedMethod ? savedMethod.payment_method_id : undefined,
       order_id,
+      split_index: splitIndex,
       customer_email,
       status: 'processing',
       created_at: Date.now(),
@@ -126,15 +672,20 @@ app.post('/api/payments/process', async (req, res) => {
 
     payments.set(paymentID, payment);
 
+    if (requiresAuthentication(req.body, payment_method, amount)) {
+      return res.json(startAuthenticationChallenge(payment, req.body.return_url));
+    }
+
     // Simulate payment processing
     const processingSuccess = await simulatePaymentProcessing();
 
     if (processingSuccess) {
       // Simulate successful payment with Stripe-like response
       payment.status = 'succeeded';
+      payment.amount_captured = amount;
       payment.processed_at = Date.now();
       payment.stripe_payment_id = 'pi_mock_' + uuidv4().substring(0, 8);
-      payment.last_4_digits = Math.floor(Math.random() * 9000) + 1000;
+      payment.last_4_digits = savedMethod ? savedMethod.last_4 : Math.floor(Math.random() * 9000) + 1000;
       payment.updated_at = Date.now();
 
       // Record transaction
@@ -143,7 +694,7 @@ app.post('/api/payments/process', async (req, res) => {
         payment_id: paymentID,
         type: 'payment',
         amount,
-        currency: currency.toUpperCase(),
+        currency,
         status: 'completed',
         created_at: Date.now()
       };
@@ -155,46 +706,242 @@ app.post('/api/payments/process', async (req, res) => {
         payment_id: paymentID,
         status: 'succeeded',
         amount,
-        currency: currency.toUpperCase(),
+        currency,
+        settlement: settlementSummary(payment),
         message: 'Payment processed successfully',
         transaction_id: transaction.transaction_id,
         processing_time: Date.now() - payment.created_at
       });
 
     } else {
-      // Simulate payment failure
-      const errorMessages = [
-        'Insufficient funds',
-        'Card declined',
-        'Invalid card number',
-        'Expired card',
-        'Security code incorrect',
-        'Processing error'
-      ];
-      
-      const errorMessage = errorMessages[Math.floor(Math.random() * errorMessages.length)];
-      
+      // Simulate payment failure
+      const errorMessage = randomDeclineMessage();
+      
+      payment.status = 'failed';
+      payment.error_message = errorMessage;
+      payment.updated_at = Date.now();
+
+      res.status(402).json({
+        success: false,
+        payment_id: paymentID,
+        status: 'failed',
+        message: errorMessage,
+        error_code: 'payment_failed'
+      });
+    }
+
+    payments.set(paymentID, payment);
+
+  } catch (error) {
+    console.error('Payment processing error:', error);
+    res.status(500).json({ 
+      success: false,
+      error: 'Payment processing failed due to internal error' 
+    });
+  }
+});
+
+// Authorize payment (hold funds without capturing)
+app.post('/api/payments/authorize', async (req, res) => {
+  try {
+    const { amount, order_id, customer_email } = req.body;
+
+    const savedMethodResult = resolveSavedPaymentMethod(req.body);
+    if (savedMethodResult.error) {
+      return res.status(savedMethodResult.error.status).json(savedMethodResult.error.body);
+    }
+    const { payment_method, savedMethod } = savedMethodResult;
+
+    const validationError = validatePaymentRequest({ ...req.body, payment_method });
+    if (validationError) {
+      return res.status(validationError.status).json(validationError.body);
+    }
+    const currency = normalizeCurrency(req.body.currency);
+    const settlement = settlePayment(amount, currency);
+    if (settlement.error) {
+      return res.status(settlement.error.status).json(settlement.error.body);
+    }
+
+    const splitIndex = req.body.split_index || 0;
+    if (findSettledPaymentForOrder(order_id, splitIndex)) {
+      return res.status(409).json({
+        success: false,
+        error: 'Payment already processed for this order'
+      });
+    }
+
+    const paymentID = generatePaymentID();
+
+    const payment = {
+      payment_id: paymentID,
+      amount,
+      amount_captured: 0,
+      currency,
+      ...settlement.fields,
+      payment_method,
+      saved_payment_method_id: savedMethod ? savedMethod.payment_method_id : undefined,
+      order_id,
+      split_index: splitIndex,
+      customer_email,
+      capture_method: 'manual',
+      status: 'processing',
+      created_at: Date.now(),
+      updated_at: Date.now()
+    };
+
+    payments.set(paymentID, payment);
+
+    if (requiresAuthentication(req.body, payment_method, amount)) {
+      return res.json(startAuthenticationChallenge(payment, req.body.return_url));
+    }
+
+    const authorizationSuccess = await simulatePaymentProcessing();
+
+    if (authorizationSuccess) {
+      payment.status = 'requires_capture';
+      payment.authorized_at = Date.now();
+      payment.stripe_payment_id = 'pi_mock_' + uuidv4().substring(0, 8);
+      payment.last_4_digits = savedMethod ? savedMethod.last_4 : Math.floor(Math.random() * 9000) + 1000;
+      payment.updated_at = Date.now();
+
+      const transaction = recordTransaction({
+        payment_id: paymentID,
+        type: 'authorization',
+        amount,
+        currency: payment.currency
+      });
+
+      res.json({
+        success: true,
+        payment_id: paymentID,
+        status: 'requires_capture',
+        amount,
+        currency: payment.currency,
+        settlement: settlementSummary(payment),
+        message: 'Payment authorized successfully',
+        transaction_id: transaction.transaction_id
+      });
+
+    } else {
+      const errorMessage = randomDeclineMessage();
+
+      payment.status = 'failed';
+      payment.error_message = errorMessage;
+      payment.updated_at = Date.now();
+
+      res.status(402).json({
+        success: false,
+        payment_id: paymentID,
+        status: 'failed',
+        message: errorMessage,
+        error_code: 'authorization_failed'
+      });
+    }
+
+    payments.set(paymentID, payment);
+
+  } catch (error) {
+    console.error('Payment authorization error:', error);
+    res.status(500).json({ 
+      success: false,
+      error: 'Payment authorization failed due to internal error' 
+    });
+  }
+});
+
+// Confirm a payment after the customer completes the 3-D Secure challenge
+app.post('/api/payments/:paymentId/confirm', async (req, res) => {
+  try {
+    const { paymentId } = req.params;
+    const { client_secret, authentication_result } = req.body;
+
+    const payment = payments.get(paymentId);
+
+    if (!payment) {
+      return res.status(404).json({ 
+        success: false,
+        error: 'Payment not found' 
+      });
+    }
+
+    if (!client_secret || client_secret !== payment.client_secret) {
+      return res.status(403).json({ 
+        success: false,
+        error: 'Invalid client secret' 
+      });
+    }
+
+    if (payment.status !== 'requires_action') {
+      return res.status(409).json({ 
+        success: false,
+        error: `Payment is not awaiting authentication (status: ${payment.status})` 
+      });
+    }
+
+    if (!['succeeded', 'failed'].includes(authentication_result)) {
+      return res.status(400).json({ 
+        success: false,
+        error: "authentication_result must be 'succeeded' or 'failed'" 
+      });
+    }
+
+    payment.authentication_status = authentication_result;
+    payment.authenticated_at = Date.now();
+    delete payment.next_action;
+
+    if (authentication_result === 'succeeded') {
+      await completeAuthenticatedPayment(payment);
+    } else {
       payment.status = 'failed';
-      payment.error_message = errorMessage;
+      payment.error_message = 'Customer authentication failed';
       payment.updated_at = Date.now();
-
-      res.status(402).json({
-        success: false,
-        payment_id: paymentID,
-        status: 'failed',
-        message: errorMessage,
-        error_code: 'payment_failed'
-      });
+      payments.set(paymentId, payment);
     }
 
-    payments.set(paymentID, payment);
+    notifyOrderService(payment);
+
+    const succeeded = ['succeeded', 'requires_capture'].includes(payment.status);
+
+    res.status(succeeded ? 200 : 402).json({
+      success: succeeded,
+      payment_id: paymentId,
+      order_id: payment.order_id,
+      status: payment.status,
+      amount: payment.amount,
+      currency: payment.currency,
+      message: succeeded ? 'Payment authenticated successfully' : payment.error_message,
+      error_code: succeeded ? undefined : 'authentication_failed'
+    });
 
   } catch (error) {
-    console.error('Payment processing error:', error);
+    console.error('Payment confirmation error:', error);
     res.status(500).json({ 
       success: false,
-      error: 'Payment processing failed due to internal error' 
+      error: 'Payment confirmation failed due to internal error' 
+    });
+  }
+});
+
+// List an order's payments, so order-service can find a charge whose
+// response it never saw (a timeout, a crash) and reverse it
+app.get('/api/payments/orders/:orderId', (req, res) => {
+  try {
+    const { orderId } = req.params;
+
+    const orderPayments = Array.from(payments.values())
+      .filter(payment => payment.order_id === orderId)
+      .sort((a, b) => a.created_at - b.created_at)
+      .map(({ stripe_payment_id, client_secret, ...safePayment }) => safePayment);
+
+    res.json({
+      order_id: orderId,
+      payments: orderPayments,
+      count: orderPayments.length
     });
+
+  } catch (error) {
+    console.error('Get order payments error:', error);
+    res.status(500).json({ error: 'Internal server error' });
   }
 });
 
@@ -209,7 +956,7 @@ app.get('/api/payments/:paymentId', (req, res) => {
     }
 
     // Remove sensitive information
-    const { stripe_payment_id, ...safePayment } = payment;
+    const { stripe_payment_id, client_secret, ...safePayment } = payment;
     
     res.json({ payment: safePayment });
 
@@ -219,11 +966,151 @@ app.get('/api/payments/:paymentId', (req, res) => {
   }
 });
 
-// Refund payment
+// Capture an authorized payment (full or partial)
+app.post('/api/payments/:paymentId/capture', (req, res) => {
+  try {
+    const { paymentId } = req.params;
+    const { amount: captureAmount } = req.body;
+
+    const payment = payments.get(paymentId);
+
+    if (!payment) {
+      return res.status(404).json({ 
+        success: false,
+        error: 'Payment not found' 
+      });
+    }
+
+    if (payment.status !== 'requires_capture') {
+      return res.status(400).json({ 
+        success: false,
+        error: 'Can only capture authorized payments' 
+      });
+    }
+
+    const finalCaptureAmount = captureAmount === undefined ? payment.amount : captureAmount;
+
+    if (!validatePaymentAmount(finalCaptureAmount) || finalCaptureAmount > payment.amount) {
+      return res.status(400).json({ 
+        success: false,
+        error: `Capture amount must be between ${formatAmount(1, payment.currency)} and ${formatAmount(payment.amount, payment.currency)} ${payment.currency}` 
+      });
+    }
+
+    // Any uncaptured remainder of the authorization is released
+    payment.amount_captured = finalCaptureAmount;
+    payment.status = 'succeeded';
+    payment.processed_at = Date.now();
+    payment.updated_at = Date.now();
+
+    const transaction = recordTransaction({
+      payment_id: paymentId,
+      type: 'capture',
+      amount: finalCaptureAmount,
+      currency: payment.currency
+    });
+
+    payments.set(paymentId, payment);
+
+    res.json({
+      success: true,
+      payment_id: paymentId,
+      status: 'succeeded',
+      amount_authorized: payment.amount,
+      amount_captured: finalCaptureAmount,
+      currency: payment.currency,
+      message: finalCaptureAmount < payment.amount ? 'Payment partially captured' : 'Payment captured successfully',
+      transaction_id: transaction.transaction_id
+    });
+
+  } catch (error) {
+    console.error('Capture processing error:', error);
+    res.status(500).json({ 
+      success: false,
+      error: 'Capture failed due to internal error' 
+    });
+  }
+});
+
+// Void an authorized payment before capture
+app.post('/api/payments/:paymentId/void', (req, res) => {
+  try {
+    const { paymentId } = req.params;
+    const { reason = 'requested_by_customer' } = req.body;
+
+    const payment = payments.get(paymentId);
+
+    if (!payment) {
+      return res.status(404).json({ 
+        success: false,
+        error: 'Payment not found' 
+      });
+    }
+
+    if (payment.status !== 'requires_capture') {
+      return res.status(400).json({ 
+        success: false,
+        error: 'Can only void uncaptured authorizations; refund captured payments instead' 
+      });
+    }
+
+    payment.status = 'voided';
+    payment.void_reason = reason;
+    payment.voided_at = Date.now();
+    payment.updated_at = Date.now();
+
+    const transaction = recordTransaction({
+      payment_id: paymentId,
+      type: 'void',
+      amount: payment.amount,
+      currency: payment.currency,
+      reason
+    });
+
+    payments.set(paymentId, payment);
+
+    res.json({
+      success: true,
+      payment_id: paymentId,
+      status: 'voided',
+      amount: payment.amount,
+      currency: payment.currency,
+      message: 'Authorization voided successfully',
+      transaction_id: transaction.transaction_id
+    });
+
+  } catch (error) {
+    console.error('Void processing error:', error);
+    res.status(500).json({ 
+      success: false,
+      error: 'Void failed due to internal error' 
+    });
+  }
+});
+
+// Response body for a refund that went through
+function refundSucceededBody(payment, refund) {
+  return {
+    success: true,
+    refund_id: refund.refund_id,
+    amount: refund.amount,
+    currency: refund.currency,
+    status: 'succeeded',
+    message: 'Refund processed successfully',
+    transaction_id: refund.transaction_id,
+    refunded_amount: payment.refunded_amount,
+    refund_status: payment.refund_status
+  };
+}
+
+// Refund payment. An Idempotency-Key header makes retries safe: a key
+// that already refunded returns that refund (replayed: true) instead of
+// refunding again, and one still in flight gets 409.
 app.post('/api/payments/:paymentId/refund', async (req, res) => {
   try {
     const { paymentId } = req.params;
     const { amount: refundAmount, reason = 'requested_by_customer' } = req.body;
+    const idempotencyKey = req.get('idempotency-key');
 
     const payment = payments.get(paymentId);
 
@@ -234,6 +1121,20 @@ app.post('/api/payments/:paymentId/refund', async (req, res) => {
       });
     }
 
+    if (idempotencyKey) {
+      const previous = (payment.refunds || []).find(r => r.idempotency_key === idempotencyKey && r.status !== 'failed');
+      if (previous && previous.status === 'pending') {
+        return res.status(409).json({
+          success: false,
+          refund_id: previous.refund_id,
+          error: 'A refund with this idempotency key is still being processed'
+        });
+      }
+      if (previous) {
+        return res.json({ ...refundSucceededBody(payment, previous), replayed: true });
+      }
+    }
+
     if (payment.status !== 'succeeded') {
       return res.status(400).json({ 
         success: false,
@@ -241,32 +1142,70 @@ app.post('/api/payments/:paymentId/refund', async (req, res) => {
       });
     }
 
-    const maxRefundAmount = payment.amount - (payment.refunded_amount || 0);
+    // Refunds still being processed count against the cap, so concurrent
+    // partial refunds can't return more than was captured between them
+    const maxRefundAmount = capturedAmount(payment) - (payment.refunded_amount || 0) - (payment.pending_refund_amount || 0);
+    if (maxRefundAmount <= 0) {
+      return res.status(400).json({ 
+        success: false,
+        error: payment.pending_refund_amount
+          ? 'The rest of this payment is already being refunded'
+          : 'Payment has already been fully refunded'
+      });
+    }
+
+    if (refundAmount !== undefined && !validatePaymentAmount(refundAmount)) {
+      return res.status(400).json({ 
+        success: false,
+        error: 'Refund amount must be a positive whole number of minor units' 
+      });
+    }
+
     const finalRefundAmount = refundAmount || maxRefundAmount;
 
     if (finalRefundAmount > maxRefundAmount) {
       return res.status(400).json({ 
         success: false,
-        error: `Refund amount cannot exceed ${maxRefundAmount} cents` 
+        error: `Refund amount cannot exceed ${formatAmount(maxRefundAmount, payment.currency)} ${payment.currency}` 
       });
     }
 
+    // Track every refund attempt on the payment so callers can reconcile
+    // partial refunds. The amount is reserved until the processor answers.
+    const refund = {
+      refund_id: 're_' + uuidv4().substring(0, 20),
+      amount: finalRefundAmount,
+      currency: payment.currency,
+      reason,
+      idempotency_key: idempotencyKey,
+      status: 'pending',
+      created_at: Date.now()
+    };
+    payment.refunds = [...(payment.refunds || []), refund];
+    payment.pending_refund_amount = (payment.pending_refund_amount || 0) + finalRefundAmount;
+    payment.updated_at = Date.now();
+    payments.set(paymentId, payment);
+
     // Simulate refund processing
-    const refundSuccess = await simulatePaymentProcessing();
+    let refundSuccess = false;
+    try {
+      refundSuccess = await simulatePaymentProcessing();
+    } finally {
+      payment.pending_refund_amount -= finalRefundAmount;
+      refund.status = refundSuccess ? 'succeeded' : 'failed';
+      payment.updated_at = Date.now();
+    }
 
     if (refundSuccess) {
-      const refundID = 're_' + uuidv4().substring(0, 20);
-      
       // Update payment record
       payment.refunded_amount = (payment.refunded_amount || 0) + finalRefundAmount;
-      payment.refund_status = payment.refunded_amount >= payment.amount ? 'fully_refunded' : 'partially_refunded';
-      payment.updated_at = Date.now();
+      payment.refund_status = payment.refunded_amount >= capturedAmount(payment) ? 'fully_refunded' : 'partially_refunded';
 
       // Create refund transaction
       const refundTransaction = {
         transaction_id: 'txn_' + uuidv4().substring(0, 16),
         payment_id: paymentId,
-        refund_id: refundID,
+        refund_id: refund.refund_id,
         type: 'refund',
         amount: finalRefundAmount,
         currency: payment.currency,
@@ -274,23 +1213,19 @@ app.post('/api/payments/:paymentId/refund', async (req, res) => {
         reason,
         created_at: Date.now()
       };
+      refund.transaction_id = refundTransaction.transaction_id;
 
       transactions.set(refundTransaction.transaction_id, refundTransaction);
       payments.set(paymentId, payment);
 
-      res.json({
-        success: true,
-        refund_id: refundID,
-        amount: finalRefundAmount,
-        currency: payment.currency,
-        status: 'succeeded',
-        message: 'Refund processed successfully',
-        transaction_id: refundTransaction.transaction_id
-      });
+      res.json(refundSucceededBody(payment, refund));
 
     } else {
+      payments.set(paymentId, payment);
+
       res.status(500).json({
         success: false,
+        refund_id: refund.refund_id,
         error: 'Refund processing failed',
         message: 'Unable to process refund at this time'
       });
@@ -305,7 +1240,47 @@ app.post('/api/payments/:paymentId/refund', async (req, res) => {
   }
 });
 
+// List refunds for a payment
+app.get('/api/payments/:paymentId/refunds', (req, res) => {
+  try {
+    const { paymentId } = req.params;
+    const payment = payments.get(paymentId);
+
+    if (!payment) {
+      return res.status(404).json({ error: 'Payment not found' });
+    }
+
+    const refunds = payment.refunds || [];
+
+    res.json({
+      payment_id: paymentId,
+      amount_captured: capturedAmount(payment),
+      refunded_amount: payment.refunded_amount || 0,
+      refund_status: payment.refund_status || 'not_refunded',
+      refunds,
+      total: refunds.length
+    });
+
+  } catch (error) {
+    console.error('Get refunds error:', error);
+    res.status(500).json({ error: 'Internal server error' });
+  }
+});
+
 // Get payment methods
+// Exchange rates used to settle payments in other currencies
+app.get('/api/payments/fx/rates', (req, res) => {
+  const rates = {};
+  for (const [currency, rate] of FX_RATES.entries()) {
+    rates[currency] = { rate, effective_rate: applyMarkup(rate, FX_MARKUP_BPS) };
+  }
+  res.json({
+    settlement_currency: SETTLEMENT_CURRENCY,
+    markup_bps: FX_MARKUP_BPS,
+    rates
+  });
+});
+
 app.get('/api/payments/methods', (req, res) => {
   res.json({
     supported_methods: SUPPORTED_PAYMENT_METHODS.map(method => ({
@@ -316,6 +1291,156 @@ app.get('/api/payments/methods', (req, res) => {
   });
 });
 
+// List a user's saved payment methods
+app.get('/api/payments/users/:userId/methods', (req, res) => {
+  try {
+    const methods = getUserPaymentMethods(req.params.userId).map(toSafePaymentMethod);
+
+    res.json({
+      payment_methods: methods,
+      total: methods.length
+    });
+
+  } catch (error) {
+    console.error('List saved payment methods error:', error);
+    res.status(500).json({ error: 'Internal server error' });
+  }
+});
+
+// Save a tokenized payment method for a user
+app.post('/api/payments/users/:userId/methods', (req, res) => {
+  try {
+    const { userId } = req.params;
+    const { type, provider_token, brand, last_4, exp_month, exp_year, is_default = false } = req.body;
+
+    // Reject anything that looks like card data; only provider tokens may be stored
+    const forbiddenFields = ['card_number', 'number', 'pan', 'cvc', 'cvv'];
+    if (forbiddenFields.some(field => req.body[field] !== undefined) ||
+        (typeof provider_token === 'string' && PAN_PATTERN.test(provider_token))) {
+      return res.status(400).json({ 
+        success: false,
+        error: 'Raw card data must not be sent; tokenize with the payment provider first' 
+      });
+    }
+
+    if (!type || !SAVEABLE_PAYMENT_METHODS.includes(type)) {
+      return res.status(400).json({ 
+        success: false,
+        error: 'Invalid or unsupported payment method type',
+        supported_types: SAVEABLE_PAYMENT_METHODS
+      });
+    }
+
+    if (typeof provider_token !== 'string' || !PROVIDER_TOKEN_PATTERN.test(provider_token)) {
+      return res.status(400).json({ 
+        success: false,
+        error: 'A valid provider token (tok_, pm_ or src_) is required' 
+      });
+    }
+
+    if (last_4 !== undefined && !/^[0-9]{4}$/.test(String(last_4))) {
+      return res.status(400).json({ 
+        success: false,
+        error: 'last_4 must be exactly four digits' 
+      });
+    }
+
+    const existing = getUserPaymentMethods(userId);
+    const duplicate = existing.find(m => m.provider_token === provider_token);
+    if (duplicate) {
+      return res.status(409).json({ 
+        success: false,
+        error: 'Payment method already saved',
+        payment_method_id: duplicate.payment_method_id
+      });
+    }
+
+    // The first saved method becomes the default automatically
+    const makeDefault = Boolean(is_default) || existing.length === 0;
+    if (makeDefault) {
+      existing.forEach(m => { m.is_default = false; });
+    }
+
+    const method = {
+      payment_method_id: 'pm_' + uuidv4().replace(/-/g, '').substring(0, 24),
+      user_id: userId,
+      type,
+      provider_token,
+      brand: brand || null,
+      last_4: last_4 !== undefined ? String(last_4) : null,
+      exp_month: exp_month || null,
+      exp_year: exp_year || null,
+      is_default: makeDefault,
+      created_at: Date.now()
+    };
+
+    savedPaymentMethods.set(method.payment_method_id, method);
+
+    res.status(201).json({ 
+      success: true,
+      payment_method: toSafePaymentMethod(method) 
+    });
+
+  } catch (error) {
+    console.error('Save payment method error:', error);
+    res.status(500).json({ error: 'Internal server error' });
+  }
+});
+
+// Mark a saved payment method as the user's default
+app.put('/api/payments/users/:userId/methods/:methodId/default', (req, res) => {
+  try {
+    const { userId, methodId } = req.params;
+    const method = savedPaymentMethods.get(methodId);
+
+    if (!method || method.user_id !== userId) {
+      return res.status(404).json({ error: 'Saved payment method not found' });
+    }
+
+    getUserPaymentMethods(userId).forEach(m => { m.is_default = m.payment_method_id === methodId; });
+
+    res.json({ 
+      success: true,
+      payment_method: toSafePaymentMethod(method) 
+    });
+
+  } catch (error) {
+    console.error('Set default payment method error:', error);
+    res.status(500).json({ error: 'Internal server error' });
+  }
+});
+
+// Delete a saved payment method
+app.delete('/api/payments/users/:userId/methods/:methodId', (req, res) => {
+  try {
+    const { userId, methodId } = req.params;
+    const method = savedPaymentMethods.get(methodId);
+
+    if (!method || method.user_id !== userId) {
+      return res.status(404).json({ error: 'Saved payment method not found' });
+    }
+
+    savedPaymentMethods.delete(methodId);
+
+    // Promote the oldest remaining method so the user always has a default
+    if (method.is_default) {
+      const [next] = getUserPaymentMethods(userId);
+      if (next) {
+        next.is_default = true;
+      }
+    }
+
+    res.json({ 
+      success: true,
+      message: 'Payment method deleted' 
+    });
+
+  } catch (error) {
+    console.error('Delete payment method error:', error);
+    res.status(500).json({ error: 'Internal server error' });
+  }
+});
+
 // Get transaction history
 app.get('/api/payments/transactions', (req, res) => {
   try {
@@ -359,11 +1484,13 @@ app.get('/api/payments/analytics', (req, res) => {
       total_payments: paymentList.length,
       successful_payments: paymentList.filter(p => p.status === 'succeeded').length,
       failed_payments: paymentList.filter(p => p.status === 'failed').length,
+      // Totals are in the settlement currency so mixed-currency payments add up
+      revenue_currency: SETTLEMENT_CURRENCY,
       total_revenue: paymentList
         .filter(p => p.status === 'succeeded')
-        .reduce((sum, p) => sum + p.amount, 0),
+        .reduce((sum, p) => sum + settledAmount(p, capturedAmount(p)), 0),
       total_refunded: paymentList
-        .reduce((sum, p) => sum + (p.refunded_amount || 0), 0),
+        .reduce((sum, p) => sum + settledAmount(p, p.refunded_amount || 0), 0),
       payment_methods: {},
       success_rate: 0
     };
@@ -389,11 +1516,97 @@ app.get('/api/payments/analytics', (req, res) => {
   }
 });
 
+// Remove payments for test orders, plus their transactions, and test users'
+// saved methods, returning how many payments were removed
+const clearTestPayments = () => {
+  const isTest = (value) => typeof value === 'string' && value.startsWith(TEST_DATA_PREFIX);
+  const removed = new Set();
+  for (const [paymentId, payment] of payments.entries()) {
+    if (isTest(payment.order_id) || isTest(payment.customer_email)) {
+      payments.delete(paymentId);
+      removed.add(paymentId);
+    }
+  }
+  for (const [transactionId, transaction] of transactions.entries()) {
+    if (removed.has(transaction.payment_id)) {
+      transactions.delete(transactionId);
+    }
+  }
+  for (const [methodId, method] of savedPaymentMethods.entries()) {
+    if (isTest(method.user_id)) {
+      savedPaymentMethods.delete(methodId);
+    }
+  }
+  return removed.size;
+};
+
+// Fixture payments for end-to-end suites: the settled card payments behind
+// the paid fixture orders in order-service, so refunds work against them
+const FIXTURE_TIMESTAMP = Date.UTC(2024, 0, 1); // fixtures never carry wall-clock times
+const FIXTURE_PAYMENTS = [
+  { payment_id: 'test-pay-1', order_id: 'test-order-1', customer_email: 'test-user-1@example.com', amount: 4999 },
+  { payment_id: 'test-pay-2', order_id: 'test-order-2', customer_email: 'test-user-3@example.com', amount: 5997 },
+  { payment_id: 'test-pay-3', order_id: 'test-order-3', customer_email: 'test-user-3@example.com', amount: 1998 }
+];
+
+// Admin endpoint to (re)load the fixture payments. Any other test payments
+// are removed, so every run starts from the same ledger.
+app.post('/admin/test/fixtures', requireAdmin, (req, res) => {
+  const removed = clearTestPayments();
+  FIXTURE_PAYMENTS.forEach((fixture, i) => {
+    payments.set(fixture.payment_id, {
+      ...fixture,
+      currency: 'USD',
+      payment_method: 'credit_card',
+      status: 'succeeded',
+      amount_captured: fixture.amount,
+      processed_at: FIXTURE_TIMESTAMP,
+      stripe_payment_id: `pi_mock_fixture${i + 1}`,
+      last_4_digits: 4242,
+      created_at: FIXTURE_TIMESTAMP,
+      updated_at: FIXTURE_TIMESTAMP
+    });
+
+    const transactionId = `test-txn-${i + 1}`;
+    transactions.set(transactionId, {
+      transaction_id: transactionId,
+      payment_id: fixture.payment_id,
+      type: 'payment',
+      amount: fixture.amount,
+      currency: 'USD',
+      status: 'completed',
+      created_at: FIXTURE_TIMESTAMP
+    });
+  });
+
+  auditAdminAction(req, 'fixtures_load', { removed, payments: FIXTURE_PAYMENTS.length });
+  res.json({ message: 'Fixtures loaded', removed, loaded: { payments: FIXTURE_PAYMENTS.length } });
+});
+
+// Admin endpoint to remove fixtures and any other test payments
+app.delete('/admin/test/fixtures', requireAdmin, (req, res) => {
+  const removed = clearTestPayments();
+  auditAdminAction(req, 'fixtures_reset', { removed });
+  res.json({ message: 'Fixtures reset', removed });
+});
+
 // Admin endpoint to clear payment data
-app.delete('/admin/clear', (req, res) => {
-  payments.clear();
-  transactions.clear();
-  res.json({ message: 'All payment data cleared' });
+app.delete('/admin/clear', requireAdmin, (req, res) => {
+  const scope = confirmClear(req, res);
+  if (!scope) return;
+
+  let cleared = 0;
+  if (scope === 'test') {
+    cleared = clearTestPayments();
+  } else {
+    cleared = payments.size;
+    payments.clear();
+    transactions.clear();
+    savedPaymentMethods.clear();
+  }
+
+  auditAdminAction(req, 'clear', { scope, cleared });
+  res.json({ message: 'Payment data cleared', scope, cleared });
 });
 
 // Metrics endpoint
@@ -403,7 +1616,7 @@ app.get('/metrics', (req, res) => {
   const failedPayments = paymentList.filter(p => p.status === 'failed').length;
   const totalRevenue = paymentList
     .filter(p => p.status === 'succeeded')
-    .reduce((sum, p) => sum + p.amount, 0);
+    .reduce((sum, p) => sum + settledAmount(p, capturedAmount(p)), 0);
 
   res.set('Content-Type', 'text/plain');
   res.send(`
@@ -419,14 +1632,14 @@ payment_service_successful_payments_total ${successfulPayments}
 # TYPE payment_service_failed_payments_total counter
 payment_service_failed_payments_total ${failedPayments}
 
-# HELP payment_service_revenue_total Total revenue in cents
+# HELP payment_service_revenue_total Total revenue in minor units of the settlement currency
 # TYPE payment_service_revenue_total counter
 payment_service_revenue_total ${totalRevenue}
 
 # HELP payment_service_transactions_total Total number of transactions
 # TYPE payment_service_transactions_total counter
 payment_service_transactions_total ${transactions.size}
-  `);
+${apiVersionMetrics()}  `);
 });
 
 // Clean up old failed payments (runs every hour)
@@ -441,7 +1654,24 @@ setInterval(() => {
   }
 }, 60 * 60 * 1000);
 
+// Fail authentication challenges the customer abandoned (runs every 5 minutes)
+setInterval(() => {
+  const now = Date.now();
+
+  for (let payment of payments.values()) {
+    if (payment.status === 'requires_action' && now - payment.created_at > SCA_CHALLENGE_TTL) {
+      payment.status = 'failed';
+      payment.error_message = 'Customer authentication timed out';
+      payment.updated_at = now;
+      delete payment.next_action;
+      notifyOrderService(payment);
+    }
+  }
+}, 5 * 60 * 1000);
+
 app.listen(PORT, () => {
   console.log(`Payment service running on port ${PORT}`);
   console.log(`Stripe integration: ${STRIPE_SECRET_KEY.includes('mock') ? 'MOCKED' : 'ENABLED'}`);
+  console.log(`3-D Secure threshold: ${SCA_THRESHOLD_CENTS > 0 ? SCA_THRESHOLD_CENTS + ' cents' : 'on request only'}`);
+  console.log(`Settlement currency: ${SETTLEMENT_CURRENCY} (FX rates for ${FX_RATES.size} currencies, markup ${FX_MARKUP_BPS} bps)`);
 });
\ No newline at end of file
@@ -0,0 +1,11 @@
+package main
+
+import "middleware/adminauth"
+
+// serviceName identifies the service in audit events and SLO reports, and
+// is the value destructive admin calls must confirm with
+const serviceName = "product-service"
+
+func init() {
+    adminauth.Setup(serviceName)
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "log"
+    "net/http"
+
+    "middleware/adminauth"
+    "middleware/backup"
+    "middleware/httpserver"
+)
+
+// Admin endpoint to stream every product as a backup
+func backupProductsHandler(w http.ResponseWriter, r *http.Request) {
+    // Copy under the lock so the backup is a point-in-time view and slow
+    // clients never hold up writers
+    mu.RLock()
+    snapshot := make([]Product, 0, len(products))
+    for _, product := range products {
+        snapshot = append(snapshot, product)
+    }
+    mu.RUnlock()
+
+    writer := backup.NewWriter(w)
+    for _, product := range snapshot {
+        if err := writer.Write("product", product.ProductID, product); err != nil {
+            log.Printf("Backup aborted after %d records: %v", writer.Count(), err)
+            return
+        }
+    }
+
+    adminauth.Audit(r, "backup", map[string]interface{}{"records": writer.Count()})
+}
+
+// Admin endpoint to import products from a backup
+func restoreProductsHandler(w http.ResponseWriter, r *http.Request) {
+    policy, ok := backup.ParseConflictPolicy(w, r)
+    if !ok {
+        return
+    }
+
+    httpserver.LiftDeadlines(w)
+    records, err := backup.Read(r.Body)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+
+    incoming := make([]Product, 0, len(records))
+    for _, record := range records {
+        if record.Type != "product" {
+            http.Error(w, fmt.Sprintf("Unknown record type %q", record.Type), http.StatusBadRequest)
+            return
+        }
+        var product Product
+        if err := json.Unmarshal(record.Data, &product); err != nil || product.ProductID == "" {
+            http.Error(w, fmt.Sprintf("Invalid product record %q", record.ID), http.StatusBadRequest)
+            return
+        }
+        incoming = append(incoming, product)
+    }
+
+    mu.Lock()
+    var result backup.Result
+    actions := make([]string, len(incoming))
+    for i, product := range incoming {
+        existing, exists := products[product.ProductID]
+        actions[i] = result.Classify(policy, product.ProductID, exists, existing, product)
+    }
+
+    var changed []Product
+    if result.Applies(policy) {
+        for i, product := range incoming {
+            if actions[i] == backup.ActionCreate || actions[i] == backup.ActionUpdate {
+                putProduct(product)
+                changed = append(changed, product)
+            }
+        }
+    }
+    mu.Unlock()
+
+    // Keep search in step with the restored catalog
+    for _, product := range changed {
+        go indexProductInSearch(product)
+    }
+
+    backup.WriteResult(w, r, policy, result)
+}
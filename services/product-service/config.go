@@ -0,0 +1,60 @@
+package main
+
+import (
+    "log"
+
+    "middleware/adminauth"
+    "middleware/hotconfig"
+)
+
+// Reloadable settings; see pkg/middleware/hotconfig. Everything else is
+// read once at startup.
+var liveConfig *hotconfig.Config[serviceConfig]
+
+func init() {
+    liveConfig = hotconfig.New(loadConfig, (*serviceConfig).settings)
+    liveConfig.Audit = adminauth.Audit
+    if err := liveConfig.Load(); err != nil {
+        log.Fatalf("Invalid configuration: %v", err)
+    }
+}
+
+// Helper function to get the live configuration
+func config() *serviceConfig {
+    return liveConfig.Get()
+}
+
+// Helper function to read a setting, preferring CONFIG_FILE over the
+// environment. Only valid while building a configuration.
+func configValue(name string) string {
+    return liveConfig.Value(name)
+}
+
+// serviceConfig holds the product service's reloadable settings
+type serviceConfig struct {
+    SearchServiceURL string
+}
+
+// Helper function to load the reloadable settings. Called by liveConfig
+// while it builds a configuration, so configValue sees the current
+// CONFIG_FILE.
+func loadConfig() (*serviceConfig, error) {
+    cfg := &serviceConfig{
+        SearchServiceURL: configValue("SEARCH_SERVICE_URL"),
+    }
+    if cfg.SearchServiceURL == "" {
+        cfg.SearchServiceURL = "http://search-service:8005"
+    }
+
+    if err := hotconfig.ValidateURL("SEARCH_SERVICE_URL", cfg.SearchServiceURL); err != nil {
+        return nil, err
+    }
+    return cfg, nil
+}
+
+// Helper function to list the settings for display and diffing
+func (cfg *serviceConfig) settings() map[string]string {
+    return map[string]string{
+        "SEARCH_SERVICE_URL": cfg.SearchServiceURL,
+    }
+}
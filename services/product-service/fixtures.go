@@ -0,0 +1,114 @@
+package main
+
+import (
+    "encoding/json"
+    "net/http"
+
+    "middleware/adminauth"
+)
+
+// FixtureTimestamp is used for every fixture's created/updated time so
+// fixture responses are byte-for-byte stable between runs
+// (2024-01-01T00:00:00Z)
+const FixtureTimestamp = 1704067200
+
+// Fixture products for end-to-end suites. Stock lines up with the fixture
+// stock in inventory-service; test-prod-4 and test-prod-5 are low-stock.
+var fixtureProducts = []Product{
+    {
+        ProductID:   "test-prod-1",
+        Title:       "Fixture Widget",
+        Description: "Everyday widget for checkout tests",
+        Categories:  []string{"fixtures", "widgets"},
+        PriceCents:  1999,
+        Stock:       100,
+    },
+    {
+        ProductID:   "test-prod-2",
+        Title:       "Fixture Gadget",
+        Description: "Mid-priced gadget for checkout tests",
+        Categories:  []string{"fixtures", "gadgets"},
+        PriceCents:  4999,
+        Stock:       50,
+    },
+    {
+        ProductID:   "test-prod-3",
+        Title:       "Fixture Gizmo",
+        Description: "Cheap gizmo for checkout tests",
+        Categories:  []string{"fixtures", "gadgets"},
+        PriceCents:  999,
+        Stock:       200,
+    },
+    {
+        ProductID:   "test-prod-4",
+        Title:       "Fixture Low-Stock Lamp",
+        Description: "Nearly sold out; only two left",
+        Categories:  []string{"fixtures", "lighting"},
+        PriceCents:  2999,
+        Stock:       2,
+    },
+    {
+        ProductID:   "test-prod-5",
+        Title:       "Fixture Last-One Clock",
+        Description: "Only one left",
+        Categories:  []string{"fixtures", "clocks"},
+        PriceCents:  7999,
+        Stock:       1,
+    },
+}
+
+// Helper function to replace all test products with the fixture set.
+// Returns how many test products were removed first.
+func loadFixtures() int {
+    mu.Lock()
+    removed := clearTestProducts()
+    loaded := make([]Product, 0, len(fixtureProducts))
+    for _, product := range fixtureProducts {
+        product.Currency = "USD"
+        product.Images = []string{}
+        product.ImageRenditions = []ImageRendition{}
+        product.Metadata = map[string]interface{}{"fixture": true}
+        product.CreatedAt = FixtureTimestamp
+        product.UpdatedAt = FixtureTimestamp
+        putProduct(product)
+        loaded = append(loaded, product)
+    }
+    mu.Unlock()
+
+    for _, product := range loaded {
+        go indexProductInSearch(product)
+    }
+    return removed
+}
+
+// Admin endpoint to (re)load the fixture products. Any other test products
+// are removed, so every run starts from the same catalog.
+func loadFixturesHandler(w http.ResponseWriter, r *http.Request) {
+    removed := loadFixtures()
+    adminauth.Audit(r, "fixtures_load", map[string]interface{}{"removed": removed, "products": len(fixtureProducts)})
+
+    result := map[string]interface{}{
+        "message": "Fixtures loaded",
+        "removed": removed,
+        "loaded":  map[string]int{"products": len(fixtureProducts)},
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(result)
+}
+
+// Admin endpoint to remove fixtures and any other test products
+func resetFixturesHandler(w http.ResponseWriter, r *http.Request) {
+    mu.Lock()
+    removed := clearTestProducts()
+    mu.Unlock()
+    adminauth.Audit(r, "fixtures_reset", map[string]interface{}{"removed": removed})
+
+    result := map[string]interface{}{
+        "message": "Fixtures reset",
+        "removed": removed,
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(result)
+}
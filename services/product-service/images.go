@@ -0,0 +1,546 @@
+package main
+
+import (
+    "bytes"
+    "crypto/sha1"
+    "encoding/hex"
+    "encoding/json"
+    "fmt"
+    "image"
+    _ "image/gif"
+    "image/jpeg"
+    _ "image/png"
+    "io"
+    "log"
+    "net/http"
+    "net/url"
+    "os"
+    "path/filepath"
+    "strconv"
+    "strings"
+    "sync"
+    "sync/atomic"
+    "time"
+
+    "github.com/google/uuid"
+    "github.com/gorilla/mux"
+    "middleware/adminauth"
+    "middleware/i18n"
+    "middleware/outbound"
+)
+
+// Image limits
+const (
+    MaxImageBytes  = 10 << 20 // per source image, fetched or uploaded
+    MaxImagePixels = 40e6     // refuse decompression bombs before decoding
+    ThumbnailSize  = 150      // longest edge, in pixels
+    MediumSize     = 600
+)
+
+// Rendition states
+const (
+    RenditionPending = "pending"
+    RenditionReady   = "ready"
+    RenditionFailed  = "failed"
+)
+
+// ImageRendition holds the derived versions of one product image. Sources
+// are checked and resized by the image workers, so a new image starts out
+// pending.
+type ImageRendition struct {
+    Source      string `json:"source"`
+    Status      string `json:"status"`
+    ContentType string `json:"content_type,omitempty"`
+    Width       int    `json:"width,omitempty"`
+    Height      int    `json:"height,omitempty"`
+    Thumbnail   string `json:"thumbnail,omitempty"`
+    Medium      string `json:"medium,omitempty"`
+    Error       string `json:"error,omitempty"`
+}
+
+// Accepted source image types
+var imageContentTypes = map[string]string{
+    "image/jpeg": ".jpg",
+    "image/png":  ".png",
+    "image/gif":  ".gif",
+}
+
+// Image pipeline settings. Files live under IMAGE_DIR/<product id>/ and
+// are served at /api/products/<id>/images/<name>; IMAGE_BASE_URL prefixes
+// the stored URLs (empty keeps them relative to the API host).
+var (
+    imageDir       = os.Getenv("IMAGE_DIR")
+    imageBaseURL   = strings.TrimSuffix(os.Getenv("IMAGE_BASE_URL"), "/")
+    imageWorkers   = 2
+    imageQueueSize = 100
+)
+
+// Products waiting for the image workers. queuedImages dedupes, so a
+// product edited several times is processed once.
+var (
+    imageQueue   chan string
+    imageQueueMu sync.Mutex
+    queuedImages = make(map[string]bool)
+)
+
+// Image pipeline metrics
+var (
+    imagesProcessed atomic.Int64
+    imagesFailed    atomic.Int64
+    imagesDropped   atomic.Int64
+)
+
+var imageClient = outbound.NewClient(10 * time.Second)
+
+func init() {
+    if _, set := os.LookupEnv("IMAGE_DIR"); !set {
+        imageDir = "data/images"
+    }
+    if value, err := strconv.Atoi(os.Getenv("IMAGE_WORKERS")); err == nil && value > 0 {
+        imageWorkers = value
+    }
+    if value, err := strconv.Atoi(os.Getenv("IMAGE_QUEUE_SIZE")); err == nil && value > 0 {
+        imageQueueSize = value
+    }
+    imageQueue = make(chan string, imageQueueSize)
+}
+
+// Helper function to build the public URL of a stored image file
+func imageURL(productID string, name string) string {
+    return imageBaseURL + "/api/products/" + productID + "/images/" + name
+}
+
+// Helper function to check image URLs supplied on a product
+func validateImageURLs(images []string) error {
+    for _, source := range images {
+        if strings.HasPrefix(source, imageBaseURL+"/api/products/") {
+            continue // uploaded through this service
+        }
+        parsed, err := url.Parse(source)
+        if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+            return i18n.NewError("product.invalid_image_url", source)
+        }
+    }
+    return nil
+}
+
+// Helper function to line renditions up with a product's images, keeping
+// the work already done for sources that didn't change. Returns whether
+// any image needs processing.
+func syncRenditions(product *Product) bool {
+    existing := make(map[string]ImageRendition, len(product.ImageRenditions))
+    for _, rendition := range product.ImageRenditions {
+        existing[rendition.Source] = rendition
+    }
+
+    pending := false
+    renditions := make([]ImageRendition, 0, len(product.Images))
+    for _, source := range product.Images {
+        rendition, exists := existing[source]
+        if !exists {
+            rendition = ImageRendition{Source: source, Status: RenditionPending}
+        }
+        if rendition.Status == RenditionPending {
+            pending = true
+        }
+        renditions = append(renditions, rendition)
+    }
+    product.ImageRenditions = renditions
+    return pending
+}
+
+// Helper function to hand a product to the image workers. Never blocks:
+// when the queue is full the product is dropped and counted, and stays
+// pending until POST /admin/images/reprocess.
+func enqueueImages(productID string) {
+    imageQueueMu.Lock()
+    defer imageQueueMu.Unlock()
+
+    if queuedImages[productID] {
+        return
+    }
+    select {
+    case imageQueue <- productID:
+        queuedImages[productID] = true
+    default:
+        imagesDropped.Add(1)
+        log.Printf("Image queue full, dropping product %s", productID)
+    }
+}
+
+// Helper function to read a source image, from disk when it was uploaded
+// here and over HTTP otherwise. Unreachable sources, non-image content and
+// oversized files are rejected.
+func readSourceImage(productID string, source string) ([]byte, string, error) {
+    if local := imageURL(productID, ""); strings.HasPrefix(source, local) {
+        data, err := os.ReadFile(filepath.Join(imageDir, productID, filepath.Base(strings.TrimPrefix(source, local))))
+        if err != nil {
+            return nil, "", err
+        }
+        return data, http.DetectContentType(data), nil
+    }
+
+    resp, err := imageClient.Get(source)
+    if err != nil {
+        return nil, "", fmt.Errorf("image is unreachable: %v", err)
+    }
+    defer resp.Body.Close()
+
+    if resp.StatusCode != http.StatusOK {
+        return nil, "", fmt.Errorf("image is unreachable: status %d", resp.StatusCode)
+    }
+    contentType := strings.TrimSpace(strings.Split(resp.Header.Get("Content-Type"), ";")[0])
+    if _, ok := imageContentTypes[contentType]; !ok {
+        return nil, "", fmt.Errorf("unsupported content type %q", contentType)
+    }
+
+    data, err := io.ReadAll(io.LimitReader(resp.Body, MaxImageBytes+1))
+    if err != nil {
+        return nil, "", err
+    }
+    if len(data) > MaxImageBytes {
+        return nil, "", fmt.Errorf("image is larger than %d bytes", MaxImageBytes)
+    }
+    return data, contentType, nil
+}
+
+// Helper function to shrink an image to fit a square box, averaging each
+// block of source pixels. Transparent areas are flattened onto white,
+// since renditions are JPEG. Smaller images are never upscaled.
+func resizeToFit(src image.Image, size int) image.Image {
+    bounds := src.Bounds()
+    width, height := bounds.Dx(), bounds.Dy()
+    if width <= size && height <= size {
+        size = width
+        if height > width {
+            size = height
+        }
+    }
+
+    newWidth, newHeight := size, size
+    if width > height {
+        newHeight = height * size / width
+    } else {
+        newWidth = width * size / height
+    }
+    if newWidth < 1 {
+        newWidth = 1
+    }
+    if newHeight < 1 {
+        newHeight = 1
+    }
+
+    dst := image.NewRGBA(image.Rect(0, 0, newWidth, newHeight))
+    for y := 0; y < newHeight; y++ {
+        y0 := bounds.Min.Y + y*height/newHeight
+        y1 := bounds.Min.Y + (y+1)*height/newHeight
+        for x := 0; x < newWidth; x++ {
+            x0 := bounds.Min.X + x*width/newWidth
+            x1 := bounds.Min.X + (x+1)*width/newWidth
+
+            var r, g, b, n uint64
+            for sy := y0; sy < y1; sy++ {
+                for sx := x0; sx < x1; sx++ {
+                    pr, pg, pb, pa := src.At(sx, sy).RGBA()
+                    r += uint64(pr + 0xffff - pa)
+                    g += uint64(pg + 0xffff - pa)
+                    b += uint64(pb + 0xffff - pa)
+                    n++
+                }
+            }
+            offset := dst.PixOffset(x, y)
+            dst.Pix[offset] = uint8(r / n >> 8)
+            dst.Pix[offset+1] = uint8(g / n >> 8)
+            dst.Pix[offset+2] = uint8(b / n >> 8)
+            dst.Pix[offset+3] = 0xff
+        }
+    }
+    return dst
+}
+
+// Helper function to write one JPEG rendition and return its URL
+func writeRendition(productID string, name string, img image.Image) (string, error) {
+    var buf bytes.Buffer
+    if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: 85}); err != nil {
+        return "", err
+    }
+    if err := os.WriteFile(filepath.Join(imageDir, productID, name), buf.Bytes(), 0644); err != nil {
+        return "", err
+    }
+    return imageURL(productID, name), nil
+}
+
+// Helper function to validate a source image and generate its renditions.
+// Rendition names derive from the source URL, so reprocessing overwrites
+// rather than accumulates files.
+func processImage(productID string, source string) ImageRendition {
+    rendition := ImageRendition{Source: source, Status: RenditionFailed}
+
+    data, contentType, err := readSourceImage(productID, source)
+    if err != nil {
+        rendition.Error = err.Error()
+        return rendition
+    }
+    rendition.ContentType = contentType
+
+    cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+    if err != nil {
+        rendition.Error = "not a decodable image: " + err.Error()
+        return rendition
+    }
+    if cfg.Width < 1 || cfg.Height < 1 {
+        rendition.Error = "image has no pixels"
+        return rendition
+    }
+    if cfg.Width*cfg.Height > MaxImagePixels {
+        rendition.Error = fmt.Sprintf("image is too large (%dx%d)", cfg.Width, cfg.Height)
+        return rendition
+    }
+    img, _, err := image.Decode(bytes.NewReader(data))
+    if err != nil {
+        rendition.Error = "not a decodable image: " + err.Error()
+        return rendition
+    }
+    rendition.Width, rendition.Height = cfg.Width, cfg.Height
+
+    if err := os.MkdirAll(filepath.Join(imageDir, productID), 0755); err != nil {
+        rendition.Error = err.Error()
+        return rendition
+    }
+    sum := sha1.Sum([]byte(source))
+    base := hex.EncodeToString(sum[:8])
+
+    if rendition.Thumbnail, err = writeRendition(productID, base+"-thumb.jpg", resizeToFit(img, ThumbnailSize)); err != nil {
+        rendition.Error = err.Error()
+        return rendition
+    }
+    if rendition.Medium, err = writeRendition(productID, base+"-medium.jpg", resizeToFit(img, MediumSize)); err != nil {
+        rendition.Error = err.Error()
+        return rendition
+    }
+    rendition.Status = RenditionReady
+    return rendition
+}
+
+// Worker loop: process a product's pending images, then store the results
+// on the product. Images are fetched without holding mu; results for
+// sources removed in the meantime are discarded.
+func imageWorker() {
+    for productID := range imageQueue {
+        imageQueueMu.Lock()
+        delete(queuedImages, productID)
+        imageQueueMu.Unlock()
+
+        mu.RLock()
+        product, exists := products[productID]
+        mu.RUnlock()
+        if !exists {
+            continue
+        }
+
+        results := make(map[string]ImageRendition)
+        for _, rendition := range product.ImageRenditions {
+            if rendition.Status != RenditionPending {
+                continue
+            }
+            result := processImage(productID, rendition.Source)
+            if result.Status == RenditionFailed {
+                imagesFailed.Add(1)
+                log.Printf("Image %s for product %s failed: %s", rendition.Source, productID, result.Error)
+            } else {
+                imagesProcessed.Add(1)
+            }
+            results[rendition.Source] = result
+        }
+        if len(results) == 0 {
+            continue
+        }
+
+        mu.Lock()
+        product, exists = products[productID]
+        if exists {
+            // Copy before writing; handlers may be encoding the old slice
+            product.ImageRenditions = append([]ImageRendition{}, product.ImageRenditions...)
+            for i, rendition := range product.ImageRenditions {
+                if result, done := results[rendition.Source]; done && rendition.Status == RenditionPending {
+                    product.ImageRenditions[i] = result
+                }
+            }
+            putProduct(product)
+        }
+        mu.Unlock()
+
+        if exists {
+            go indexProductInSearch(product)
+        }
+    }
+}
+
+// Start the image worker pool
+func startImageWorkers() {
+    for i := 0; i < imageWorkers; i++ {
+        go imageWorker()
+    }
+}
+
+// Helper function to delete a product's stored images
+func removeProductImages(productID string) {
+    if err := os.RemoveAll(filepath.Join(imageDir, productID)); err != nil {
+        log.Printf("Failed to remove images for product %s: %v", productID, err)
+    }
+}
+
+// Upload an image for a product. The body is the raw image (JPEG, PNG or
+// GIF); it is stored, appended to the product's images and queued for
+// renditions.
+func uploadProductImageHandler(w http.ResponseWriter, r *http.Request) {
+    productID := mux.Vars(r)["id"]
+
+    mu.RLock()
+    _, exists := products[productID]
+    mu.RUnlock()
+    if !exists {
+        i18n.WriteError(w, r, http.StatusNotFound, "product.not_found")
+        return
+    }
+
+    data, err := io.ReadAll(io.LimitReader(r.Body, MaxImageBytes+1))
+    if err != nil {
+        i18n.WriteError(w, r, http.StatusBadRequest, "product.image_unreadable")
+        return
+    }
+    if len(data) > MaxImageBytes {
+        i18n.WriteError(w, r, http.StatusRequestEntityTooLarge, "product.image_too_large", MaxImageBytes)
+        return
+    }
+    // Trust the bytes, not the declared Content-Type
+    extension, ok := imageContentTypes[http.DetectContentType(data)]
+    if !ok {
+        i18n.WriteError(w, r, http.StatusUnsupportedMediaType, "product.image_type")
+        return
+    }
+
+    name := uuid.New().String() + extension
+    if err := os.MkdirAll(filepath.Join(imageDir, productID), 0755); err == nil {
+        err = os.WriteFile(filepath.Join(imageDir, productID, name), data, 0644)
+    }
+    if err != nil {
+        log.Printf("Failed to store image for product %s: %v", productID, err)
+        http.Error(w, "Failed to store image", http.StatusInternalServerError)
+        return
+    }
+
+    mu.Lock()
+    product, exists := products[productID]
+    if !exists {
+        mu.Unlock()
+        removeProductImages(productID)
+        i18n.WriteError(w, r, http.StatusNotFound, "product.not_found")
+        return
+    }
+    product.Images = append(append([]string{}, product.Images...), imageURL(productID, name))
+    syncRenditions(&product)
+    product.UpdatedAt = time.Now().Unix()
+    putProduct(product)
+    mu.Unlock()
+
+    enqueueImages(productID)
+
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(http.StatusCreated)
+    json.NewEncoder(w).Encode(product)
+}
+
+// Serve a stored image (upload or rendition) of a product
+func getProductImageHandler(w http.ResponseWriter, r *http.Request) {
+    vars := mux.Vars(r)
+    productID := vars["id"]
+
+    mu.RLock()
+    _, exists := products[productID]
+    mu.RUnlock()
+    if !exists {
+        i18n.WriteError(w, r, http.StatusNotFound, "product.image_not_found")
+        return
+    }
+
+    file, err := os.Open(filepath.Join(imageDir, productID, filepath.Base(vars["name"])))
+    if err != nil {
+        i18n.WriteError(w, r, http.StatusNotFound, "product.image_not_found")
+        return
+    }
+    defer file.Close()
+
+    info, err := file.Stat()
+    if err != nil || info.IsDir() {
+        i18n.WriteError(w, r, http.StatusNotFound, "product.image_not_found")
+        return
+    }
+    w.Header().Set("Cache-Control", "public, max-age=86400")
+    http.ServeContent(w, r, info.Name(), info.ModTime(), file)
+}
+
+// Admin endpoint to queue products whose images are still pending, e.g.
+// after the queue overflowed. ?failed=true retries failed images too.
+func reprocessImagesHandler(w http.ResponseWriter, r *http.Request) {
+    retryFailed := r.URL.Query().Get("failed") == "true"
+
+    var queued []string
+    mu.Lock()
+    for productID, product := range products {
+        if retryFailed {
+            renditions := append([]ImageRendition{}, product.ImageRenditions...)
+            retried := false
+            for i, rendition := range renditions {
+                if rendition.Status == RenditionFailed {
+                    renditions[i] = ImageRendition{Source: rendition.Source, Status: RenditionPending}
+                    retried = true
+                }
+            }
+            if retried {
+                product.ImageRenditions = renditions
+                putProduct(product)
+            }
+        }
+        for _, rendition := range product.ImageRenditions {
+            if rendition.Status == RenditionPending {
+                queued = append(queued, productID)
+                break
+            }
+        }
+    }
+    mu.Unlock()
+
+    for _, productID := range queued {
+        enqueueImages(productID)
+    }
+    adminauth.Audit(r, "images_reprocess", map[string]interface{}{"queued": len(queued), "retry_failed": retryFailed})
+
+    result := map[string]interface{}{
+        "message": "Image processing queued",
+        "queued":  len(queued),
+    }
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(result)
+}
+
+// Helper function to report image pipeline metrics
+func imageMetrics() string {
+    return fmt.Sprintf(`
+# HELP product_service_image_queue_depth Products waiting for the image workers
+# TYPE product_service_image_queue_depth gauge
+product_service_image_queue_depth %d
+
+# HELP product_service_images_processed_total Source images turned into renditions
+# TYPE product_service_images_processed_total counter
+product_service_images_processed_total %d
+
+# HELP product_service_images_failed_total Source images rejected as unreachable, invalid or too large
+# TYPE product_service_images_failed_total counter
+product_service_images_failed_total %d
+
+# HELP product_service_images_dropped_total Products not queued because the image queue was full
+# TYPE product_service_images_dropped_total counter
+product_service_images_dropped_total %d
+`, len(imageQueue), imagesProcessed.Load(), imagesFailed.Load(), imagesDropped.Load())
+}
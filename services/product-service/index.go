@@ -0,0 +1,125 @@
+package main
+
+import (
+    "sort"
+    "strings"
+)
+
+// priceEntry orders products by price, with the ID as a tie-breaker so the
+// order is stable across requests
+type priceEntry struct {
+    PriceCents int
+    ProductID  string
+}
+
+func (e priceEntry) less(other priceEntry) bool {
+    if e.PriceCents != other.PriceCents {
+        return e.PriceCents < other.PriceCents
+    }
+    return e.ProductID < other.ProductID
+}
+
+// Secondary indexes for listing queries, guarded by mu. Each slice is kept
+// sorted by price so a page is a binary search plus a slice.
+var (
+    priceIndex    []priceEntry
+    categoryIndex = make(map[string][]priceEntry) // lower-cased category -> entries
+)
+
+// Helper function to insert an entry into a sorted slice
+func insertEntry(entries []priceEntry, entry priceEntry) []priceEntry {
+    i := sort.Search(len(entries), func(i int) bool { return !entries[i].less(entry) })
+    entries = append(entries, priceEntry{})
+    copy(entries[i+1:], entries[i:])
+    entries[i] = entry
+    return entries
+}
+
+// Helper function to remove an entry from a sorted slice
+func removeEntry(entries []priceEntry, entry priceEntry) []priceEntry {
+    i := sort.Search(len(entries), func(i int) bool { return !entries[i].less(entry) })
+    if i < len(entries) && entries[i] == entry {
+        entries = append(entries[:i], entries[i+1:]...)
+    }
+    return entries
+}
+
+// Helper function to list a product's distinct, normalized categories
+func indexCategories(product Product) []string {
+    seen := make(map[string]bool)
+    var categories []string
+    for _, category := range product.Categories {
+        key := strings.ToLower(category)
+        if key == "" || seen[key] {
+            continue
+        }
+        seen[key] = true
+        categories = append(categories, key)
+    }
+    return categories
+}
+
+// Helper function to drop a product from the indexes. Callers must hold mu.
+func unindexProduct(product Product) {
+    entry := priceEntry{PriceCents: product.PriceCents, ProductID: product.ProductID}
+    priceIndex = removeEntry(priceIndex, entry)
+
+    for _, category := range indexCategories(product) {
+        entries := removeEntry(categoryIndex[category], entry)
+        if len(entries) == 0 {
+            delete(categoryIndex, category)
+        } else {
+            categoryIndex[category] = entries
+        }
+    }
+}
+
+// Helper function to write a product and keep the indexes in sync.
+// Callers must hold mu.
+func putProduct(product Product) {
+    if previous, exists := products[product.ProductID]; exists {
+        unindexProduct(previous)
+    }
+    products[product.ProductID] = product
+
+    entry := priceEntry{PriceCents: product.PriceCents, ProductID: product.ProductID}
+    priceIndex = insertEntry(priceIndex, entry)
+    for _, category := range indexCategories(product) {
+        categoryIndex[category] = insertEntry(categoryIndex[category], entry)
+    }
+}
+
+// Helper function to delete a product and its index entries.
+// Callers must hold mu.
+func removeProduct(productID string) {
+    if previous, exists := products[productID]; exists {
+        unindexProduct(previous)
+        delete(products, productID)
+    }
+}
+
+// Helper function to reset the store and indexes. Callers must hold mu.
+func resetProducts() {
+    products = make(map[string]Product)
+    priceIndex = nil
+    categoryIndex = make(map[string][]priceEntry)
+}
+
+// Helper function to select the index entries matching a category and an
+// inclusive price range (maxPrice < 0 means unbounded). Callers must hold mu.
+func indexRange(category string, minPrice int, maxPrice int) []priceEntry {
+    entries := priceIndex
+    if category != "" {
+        entries = categoryIndex[strings.ToLower(category)]
+    }
+
+    start := sort.Search(len(entries), func(i int) bool { return entries[i].PriceCents >= minPrice })
+    end := len(entries)
+    if maxPrice >= 0 {
+        end = sort.Search(len(entries), func(i int) bool { return entries[i].PriceCents > maxPrice })
+    }
+    if end < start {
+        end = start
+    }
+    return entries[start:end]
+}
@@ -14,7 +14,19 @@ import (
 
     "github.com/google/uuid"
     "github.com/gorilla/mux"
-    "github.com/rs/cors"
+    "middleware/accesslog"
+    "middleware/adminauth"
+    "middleware/corspolicy"
+    "middleware/httpserver"
+    "middleware/i18n"
+    "middleware/loadshed"
+    "middleware/openmetrics"
+    "middleware/outbound"
+    "middleware/readiness"
+    "middleware/runtimemetrics"
+    "middleware/slo"
+    "middleware/versioning"
+    "money"
 )
 
 // Product represents a product in the catalog
@@ -26,18 +38,25 @@ type Product struct {
     PriceCents  int               `json:"price_cents"`
     Currency    string            `json:"currency"`
     Images      []string          `json:"images"`
+    ImageRenditions []ImageRendition `json:"image_renditions"`
     Stock       int               `json:"stock"`
     Metadata    map[string]interface{} `json:"metadata"`
     CreatedAt   int64             `json:"created_at"`
     UpdatedAt   int64             `json:"updated_at"`
 }
 
+// Price returns the product's unit price as Money
+func (p Product) Price() money.Money {
+    return money.New(p.PriceCents, p.Currency)
+}
+
 // ProductRequest for creating/updating products
 type ProductRequest struct {
     Title       string            `json:"title"`
     Description string            `json:"description"`
     Categories  []string          `json:"categories"`
     PriceCents  int               `json:"price_cents"`
+    Price       string            `json:"price"` // decimal alternative to price_cents, e.g. "19.99"
     Currency    string            `json:"currency"`
     Images      []string          `json:"images"`
     Stock       int               `json:"stock"`
@@ -50,20 +69,9 @@ var (
     mu       sync.RWMutex
 )
 
-// Environment variables
-var (
-    searchServiceURL = os.Getenv("SEARCH_SERVICE_URL")
-)
-
-func init() {
-    if searchServiceURL == "" {
-        searchServiceURL = "http://search-service:8005"
-    }
-}
-
 // Helper function to send product to search service
 func indexProductInSearch(product Product) error {
-    if searchServiceURL == "" {
+    if config().SearchServiceURL == "" {
         return nil // Skip if search service not configured
     }
 
@@ -72,8 +80,8 @@ func indexProductInSearch(product Product) error {
         return err
     }
 
-    resp, err := http.Post(
-        searchServiceURL+"/api/search/index/product",
+    resp, err := outbound.Client.Post(
+        config().SearchServiceURL+"/api/search/index/product",
         "application/json",
         bytes.NewBuffer(productJSON),
     )
@@ -111,21 +119,34 @@ func healthHandler(w http.ResponseWriter, r *http.Request) {
 func createProductHandler(w http.ResponseWriter, r *http.Request) {
     var req ProductRequest
     if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-        http.Error(w, "Invalid JSON", http.StatusBadRequest)
+        i18n.WriteError(w, r, http.StatusBadRequest, "request.invalid_json")
         return
     }
 
     // Validation
     if req.Title == "" {
-        http.Error(w, "Title is required", http.StatusBadRequest)
+        i18n.WriteError(w, r, http.StatusBadRequest, "product.title_required")
+        return
+    }
+    currency, err := money.NormalizeCurrency(req.Currency)
+    if err != nil {
+        i18n.WriteError(w, r, http.StatusBadRequest, "currency.unsupported", req.Currency)
         return
     }
+    req.Currency = currency
+    if req.Price != "" {
+        if req.PriceCents, err = money.ParseAmount(req.Price, req.Currency); err != nil {
+            i18n.WriteError(w, r, http.StatusBadRequest, "product.invalid_price", req.Currency)
+            return
+        }
+    }
     if req.PriceCents <= 0 {
-        http.Error(w, "Price must be positive", http.StatusBadRequest)
+        i18n.WriteError(w, r, http.StatusBadRequest, "product.price_positive")
         return
     }
-    if req.Currency == "" {
-        req.Currency = "USD"
+    if err := validateImageURLs(req.Images); err != nil {
+        i18n.WriteMessageError(w, r, http.StatusBadRequest, err, "product.invalid_image_url")
+        return
     }
 
     // Create product
@@ -142,12 +163,18 @@ func createProductHandler(w http.ResponseWriter, r *http.Request) {
         CreatedAt:   time.Now().Unix(),
         UpdatedAt:   time.Now().Unix(),
     }
+    pendingImages := syncRenditions(&product)
 
     // Store product
     mu.Lock()
-    products[product.ProductID] = product
+    putProduct(product)
     mu.Unlock()
 
+    // Validate images and generate renditions (async)
+    if pendingImages {
+        enqueueImages(product.ProductID)
+    }
+
     // Index in search service (async)
     go func() {
         if err := indexProductInSearch(product); err != nil {
@@ -166,6 +193,7 @@ func getProductsHandler(w http.ResponseWriter, r *http.Request) {
     limitStr := r.URL.Query().Get("limit")
     offsetStr := r.URL.Query().Get("offset")
     category := r.URL.Query().Get("category")
+    sortOrder := r.URL.Query().Get("sort")
 
     limit := 20 // default
     if limitStr != "" {
@@ -181,30 +209,35 @@ func getProductsHandler(w http.ResponseWriter, r *http.Request) {
         }
     }
 
-    mu.RLock()
-    defer mu.RUnlock()
+    if sortOrder == "" {
+        sortOrder = "price_asc"
+    }
+    if sortOrder != "price_asc" && sortOrder != "price_desc" {
+        i18n.WriteError(w, r, http.StatusBadRequest, "product.invalid_sort")
+        return
+    }
+
+    minPrice := 0
+    if minStr := r.URL.Query().Get("min_price"); minStr != "" {
+        if p, err := strconv.Atoi(minStr); err == nil && p >= 0 {
+            minPrice = p
+        }
+    }
 
-    // Filter and paginate
-    var filteredProducts []Product
-    for _, product := range products {
-        // Category filter
-        if category != "" {
-            found := false
-            for _, cat := range product.Categories {
-                if strings.EqualFold(cat, category) {
-                    found = true
-                    break
-                }
-            }
-            if !found {
-                continue
-            }
+    maxPrice := -1 // unbounded
+    if maxStr := r.URL.Query().Get("max_price"); maxStr != "" {
+        if p, err := strconv.Atoi(maxStr); err == nil && p >= 0 {
+            maxPrice = p
         }
-        filteredProducts = append(filteredProducts, product)
     }
 
-    // Pagination
-    total := len(filteredProducts)
+    mu.RLock()
+    defer mu.RUnlock()
+
+    // Filter via the category/price indexes, then paginate
+    entries := indexRange(category, minPrice, maxPrice)
+
+    total := len(entries)
     start := offset
     if start > total {
         start = total
@@ -214,11 +247,21 @@ func getProductsHandler(w http.ResponseWriter, r *http.Request) {
         end = total
     }
 
+    pageProducts := make([]Product, 0, end-start)
+    for i := start; i < end; i++ {
+        entry := entries[i]
+        if sortOrder == "price_desc" {
+            entry = entries[total-1-i]
+        }
+        pageProducts = append(pageProducts, products[entry.ProductID])
+    }
+
     result := map[string]interface{}{
-        "products": filteredProducts[start:end],
+        "products": pageProducts,
         "total":    total,
         "limit":    limit,
         "offset":   offset,
+        "sort":     sortOrder,
     }
 
     w.Header().Set("Content-Type", "application/json")
@@ -235,7 +278,7 @@ func getProductHandler(w http.ResponseWriter, r *http.Request) {
     mu.RUnlock()
 
     if !exists {
-        http.Error(w, "Product not found", http.StatusNotFound)
+        i18n.WriteError(w, r, http.StatusNotFound, "product.not_found")
         return
     }
 
@@ -252,14 +295,19 @@ func updateProductHandler(w http.ResponseWriter, r *http.Request) {
     product, exists := products[productID]
     if !exists {
         mu.Unlock()
-        http.Error(w, "Product not found", http.StatusNotFound)
+        i18n.WriteError(w, r, http.StatusNotFound, "product.not_found")
         return
     }
 
     var req ProductRequest
     if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
         mu.Unlock()
-        http.Error(w, "Invalid JSON", http.StatusBadRequest)
+        i18n.WriteError(w, r, http.StatusBadRequest, "request.invalid_json")
+        return
+    }
+    if err := validateImageURLs(req.Images); err != nil {
+        mu.Unlock()
+        i18n.WriteMessageError(w, r, http.StatusBadRequest, err, "product.invalid_image_url")
         return
     }
 
@@ -273,12 +321,27 @@ func updateProductHandler(w http.ResponseWriter, r *http.Request) {
     if req.Categories != nil {
         product.Categories = req.Categories
     }
+    if req.Currency != "" {
+        currency, err := money.NormalizeCurrency(req.Currency)
+        if err != nil {
+            mu.Unlock()
+            i18n.WriteError(w, r, http.StatusBadRequest, "currency.unsupported", req.Currency)
+            return
+        }
+        product.Currency = currency
+    }
+    if req.Price != "" {
+        price, err := money.ParseAmount(req.Price, product.Currency)
+        if err != nil || price <= 0 {
+            mu.Unlock()
+            i18n.WriteError(w, r, http.StatusBadRequest, "product.invalid_price", product.Currency)
+            return
+        }
+        req.PriceCents = price
+    }
     if req.PriceCents > 0 {
         product.PriceCents = req.PriceCents
     }
-    if req.Currency != "" {
-        product.Currency = req.Currency
-    }
     if req.Images != nil {
         product.Images = req.Images
     }
@@ -289,10 +352,15 @@ func updateProductHandler(w http.ResponseWriter, r *http.Request) {
         product.Metadata = req.Metadata
     }
     
+    pendingImages := syncRenditions(&product)
     product.UpdatedAt = time.Now().Unix()
-    products[productID] = product
+    putProduct(product)
     mu.Unlock()
 
+    if pendingImages {
+        enqueueImages(product.ProductID)
+    }
+
     // Update search index (async)
     go func() {
         if err := indexProductInSearch(product); err != nil {
@@ -313,32 +381,87 @@ func deleteProductHandler(w http.ResponseWriter, r *http.Request) {
     _, exists := products[productID]
     if !exists {
         mu.Unlock()
-        http.Error(w, "Product not found", http.StatusNotFound)
+        i18n.WriteError(w, r, http.StatusNotFound, "product.not_found")
         return
     }
 
-    delete(products, productID)
+    removeProduct(productID)
     mu.Unlock()
+    removeProductImages(productID)
 
     w.WriteHeader(http.StatusNoContent)
 }
 
 // Admin endpoint to clear all products
 func clearProductsHandler(w http.ResponseWriter, r *http.Request) {
+    scope, ok := adminauth.ConfirmClear(w, r)
+    if !ok {
+        return
+    }
+
     mu.Lock()
-    products = make(map[string]Product)
+    cleared := 0
+    if scope == "test" {
+        cleared = clearTestProducts()
+    } else {
+        cleared = len(products)
+        resetProducts()
+    }
     mu.Unlock()
 
-    result := map[string]string{
-        "message": "All products cleared",
+    // Test products' image files are left behind; they can't be served
+    // once the product is gone
+    if scope != "test" {
+        if err := os.RemoveAll(imageDir); err != nil {
+            log.Printf("Failed to remove product images: %v", err)
+        }
+    }
+
+    adminauth.Audit(r, "clear", map[string]interface{}{"scope": scope, "cleared": cleared})
+
+    result := map[string]interface{}{
+        "message": "Products cleared",
+        "scope":   scope,
+        "cleared": cleared,
     }
 
     w.Header().Set("Content-Type", "application/json")
     json.NewEncoder(w).Encode(result)
 }
 
-// Seed some sample products
-func seedSampleProducts() {
+// Sample product IDs line up with the sample stock in inventory-service
+var sampleProductIDs = []string{
+    "sku-12345678",
+    "sku-23456789",
+    "sku-34567890",
+    "sku-45678901",
+    "sku-56789012",
+}
+
+// Test products carry the test ID prefix or metadata {"test": true}
+func isTestProduct(product Product) bool {
+    if strings.HasPrefix(product.ProductID, adminauth.TestDataPrefix) {
+        return true
+    }
+    test, _ := product.Metadata["test"].(bool)
+    return test
+}
+
+// Helper function to remove every test product. Callers must hold mu.
+func clearTestProducts() int {
+    cleared := 0
+    for productID, product := range products {
+        if isTestProduct(product) {
+            removeProduct(productID)
+            cleared++
+        }
+    }
+    return cleared
+}
+
+// Seed some sample products; existing products are left untouched.
+// Returns the number of products seeded.
+func seedSampleProducts() int {
     sampleProducts := []ProductRequest{
         {
             Title:       "Wireless Bluetooth Headphones",
@@ -387,9 +510,10 @@ func seedSampleProducts() {
         },
     }
 
-    for _, req := range sampleProducts {
+    seeded := 0
+    for i, req := range sampleProducts {
         product := Product{
-            ProductID:   "sku-" + uuid.New().String()[:8],
+            ProductID:   sampleProductIDs[i],
             Title:       req.Title,
             Description: req.Description,
             Categories:  req.Categories,
@@ -401,14 +525,41 @@ func seedSampleProducts() {
             CreatedAt:   time.Now().Unix(),
             UpdatedAt:   time.Now().Unix(),
         }
+        syncRenditions(&product)
 
-        products[product.ProductID] = product
+        mu.Lock()
+        _, exists := products[product.ProductID]
+        if !exists {
+            putProduct(product)
+        }
+        mu.Unlock()
+
+        if exists {
+            continue
+        }
+        seeded++
 
         // Index in search service
         go indexProductInSearch(product)
+        enqueueImages(product.ProductID)
     }
 
-    log.Printf("Seeded %d sample products", len(sampleProducts))
+    log.Printf("Seeded %d sample products", seeded)
+    return seeded
+}
+
+// Admin endpoint to seed sample products (development only)
+func seedProductsHandler(w http.ResponseWriter, r *http.Request) {
+    seeded := seedSampleProducts()
+    adminauth.Audit(r, "seed", map[string]interface{}{"seeded": seeded})
+
+    result := map[string]interface{}{
+        "message": "Sample products seeded",
+        "seeded":  seeded,
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(result)
 }
 
 // Metrics endpoint
@@ -423,46 +574,76 @@ func metricsHandler(w http.ResponseWriter, r *http.Request) {
 product_service_products_total %d
 `, productCount)
 
-    w.Header().Set("Content-Type", "text/plain")
-    w.Write([]byte(metrics))
-}
+    metrics += imageMetrics()
+    metrics += readiness.Metrics()
+    metrics += versioning.Metrics()
+    metrics += loadshed.Metrics()
+    metrics += slo.Metrics()
+    metrics += runtimemetrics.Text()
 
-func main() {
-    // Seed sample products
-    seedSampleProducts()
-
-    router := mux.NewRouter()
+    openmetrics.Write(w, r, metrics)
+}
 
-    // API routes
-    api := router.PathPrefix("/api/products").Subrouter()
+// Product API v1 routes
+func productRoutesV1(api *mux.Router) {
     api.HandleFunc("", createProductHandler).Methods("POST")
     api.HandleFunc("", getProductsHandler).Methods("GET")
     api.HandleFunc("/{id}", getProductHandler).Methods("GET")
     api.HandleFunc("/{id}", updateProductHandler).Methods("PUT")
     api.HandleFunc("/{id}", deleteProductHandler).Methods("DELETE")
+    api.HandleFunc("/{id}/images", uploadProductImageHandler).Methods("POST")
+    api.HandleFunc("/{id}/images/{name}", getProductImageHandler).Methods("GET")
+}
+
+func main() {
+    // Seed sample products (opt-in so production catalogs start empty)
+    if os.Getenv("SEED_SAMPLE_DATA") == "true" {
+        seedSampleProducts()
+    }
+    go liveConfig.Watch()
+    go readiness.Run(outbound.NewClient)
+    startImageWorkers()
+
+    router := mux.NewRouter()
+    router.Use(openmetrics.Observe)
+
+    // API routes, served under /api/v1/products and the legacy /api/products
+    api := router.PathPrefix("/api").Subrouter()
+    versioning.Mount(api, "/products", map[string]func(*mux.Router){
+        "v1": productRoutesV1,
+    })
 
     // Admin routes
-    router.HandleFunc("/admin/clear", clearProductsHandler).Methods("DELETE")
+    admin := router.PathPrefix("/admin").Subrouter()
+    admin.Use(adminauth.Middleware)
+    admin.HandleFunc("/clear", clearProductsHandler).Methods("DELETE")
+    admin.HandleFunc("/backup", backupProductsHandler).Methods("GET")
+    admin.HandleFunc("/restore", restoreProductsHandler).Methods("POST")
+    admin.HandleFunc("/seed", seedProductsHandler).Methods("POST")
+    admin.HandleFunc("/search/reindex", reindexSearchHandler).Methods("POST")
+    admin.HandleFunc("/images/reprocess", reprocessImagesHandler).Methods("POST")
+    admin.HandleFunc("/test/fixtures", loadFixturesHandler).Methods("POST")
+    admin.HandleFunc("/test/fixtures", resetFixturesHandler).Methods("DELETE")
+    admin.HandleFunc("/config", liveConfig.Handler).Methods("GET")
+    admin.HandleFunc("/config/reload", liveConfig.ReloadHandler).Methods("POST")
 
     // Utility routes
     router.HandleFunc("/health", healthHandler).Methods("GET")
+    router.HandleFunc("/readyz", readiness.Handler).Methods("GET")
     router.HandleFunc("/metrics", metricsHandler).Methods("GET")
+    router.HandleFunc("/slo", slo.Handler).Methods("GET")
 
-    // CORS configuration
-    c := cors.New(cors.Options{
-        AllowedOrigins:   []string{"*"},
-        AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
-        AllowedHeaders:   []string{"*"},
-        AllowCredentials: true,
-    })
+    // CORS policy from CORS_* settings
+    c := corspolicy.New()
 
-    handler := c.Handler(router)
+    handler := accesslog.Handler(serviceName, c.Handler(loadshed.Handler(router, nil)))
 
     port := "8001"
     log.Printf("Product service starting on port %s", port)
-    log.Printf("Search service URL: %s", searchServiceURL)
+    log.Printf("Access log: %s", accesslog.Settings())
+    log.Printf("Search service URL: %s", config().SearchServiceURL)
     
-    if err := http.ListenAndServe(":"+port, handler); err != nil {
+    if err := httpserver.New(port, handler).ListenAndServe(); err != nil {
         log.Fatal("Server failed to start:", err)
     }
 }
\ No newline at end of file
@@ -0,0 +1,15 @@
+package main
+
+import "middleware/readiness"
+
+func init() {
+    readiness.Setup(serviceName, readinessDependencies, nil)
+}
+
+// Dependencies probed for readiness. The catalog is served from memory and
+// search indexing can be caught up with a reindex, so search is optional.
+func readinessDependencies() []readiness.Dependency {
+    return []readiness.Dependency{
+        {Name: "search", URL: func() string { return config().SearchServiceURL }, Required: false},
+    }
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+    "bytes"
+    "encoding/json"
+    "fmt"
+    "log"
+    "net/http"
+    "sort"
+    "strconv"
+    "sync/atomic"
+    "time"
+
+    "middleware/adminauth"
+    "middleware/httpserver"
+    "middleware/outbound"
+)
+
+// Reindex batch sizes
+const (
+    DefaultReindexBatchSize = 100
+    MaxReindexBatchSize     = 1000
+)
+
+// Only one full reindex runs at a time
+var reindexRunning atomic.Bool
+
+// searchBatchResponse from the search service's batch index endpoint
+type searchBatchResponse struct {
+    Indexed int      `json:"indexed"`
+    Failed  []string `json:"failed"`
+}
+
+// Helper function to send a batch of products to the search service
+func indexBatchInSearch(batch []Product) (searchBatchResponse, error) {
+    var result searchBatchResponse
+
+    payload, err := json.Marshal(map[string]interface{}{"products": batch})
+    if err != nil {
+        return result, err
+    }
+
+    client := outbound.NewClient(30 * time.Second)
+    resp, err := client.Post(
+        config().SearchServiceURL+"/api/search/index/products",
+        "application/json",
+        bytes.NewBuffer(payload),
+    )
+    if err != nil {
+        return result, err
+    }
+    defer resp.Body.Close()
+
+    if resp.StatusCode != http.StatusOK {
+        return result, fmt.Errorf("search service returned status %d", resp.StatusCode)
+    }
+    if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+        return result, err
+    }
+    return result, nil
+}
+
+// Admin endpoint to rebuild the search index from the catalog. Products are
+// sent in batches (?batch_size=, default 100) and progress is streamed back
+// as one JSON line per batch, followed by a summary line.
+func reindexSearchHandler(w http.ResponseWriter, r *http.Request) {
+    if config().SearchServiceURL == "" {
+        http.Error(w, "Search service not configured", http.StatusConflict)
+        return
+    }
+
+    batchSize := DefaultReindexBatchSize
+    if value := r.URL.Query().Get("batch_size"); value != "" {
+        parsed, err := strconv.Atoi(value)
+        if err != nil || parsed < 1 || parsed > MaxReindexBatchSize {
+            http.Error(w, fmt.Sprintf("batch_size must be between 1 and %d", MaxReindexBatchSize), http.StatusBadRequest)
+            return
+        }
+        batchSize = parsed
+    }
+
+    if !reindexRunning.CompareAndSwap(false, true) {
+        http.Error(w, "A reindex is already running", http.StatusConflict)
+        return
+    }
+    defer reindexRunning.Store(false)
+
+    // Copy the catalog so the lock isn't held across search calls; ID order
+    // keeps batches stable between runs
+    mu.RLock()
+    catalog := make([]Product, 0, len(products))
+    for _, product := range products {
+        catalog = append(catalog, product)
+    }
+    mu.RUnlock()
+    sort.Slice(catalog, func(i, j int) bool { return catalog[i].ProductID < catalog[j].ProductID })
+
+    adminauth.Audit(r, "search_reindex_started", map[string]interface{}{
+        "total":      len(catalog),
+        "batch_size": batchSize,
+    })
+
+    httpserver.LiftDeadlines(w)
+    w.Header().Set("Content-Type", "application/x-ndjson")
+    encoder := json.NewEncoder(w)
+    flusher, _ := w.(http.Flusher)
+
+    started := time.Now()
+    indexed := 0
+    failed := []string{}
+    batches := (len(catalog) + batchSize - 1) / batchSize
+    for i := 0; i < len(catalog); i += batchSize {
+        end := i + batchSize
+        if end > len(catalog) {
+            end = len(catalog)
+        }
+        batch := catalog[i:end]
+
+        progress := map[string]interface{}{
+            "batch":   i/batchSize + 1,
+            "batches": batches,
+        }
+
+        result, err := indexBatchInSearch(batch)
+        if err != nil {
+            // Keep going; the summary lists every product that didn't make it
+            log.Printf("Search reindex batch %d/%d failed: %v", i/batchSize+1, batches, err)
+            for _, product := range batch {
+                failed = append(failed, product.ProductID)
+            }
+            progress["error"] = err.Error()
+        } else {
+            indexed += result.Indexed
+            failed = append(failed, result.Failed...)
+        }
+
+        progress["indexed"] = indexed
+        progress["failed"] = len(failed)
+        progress["total"] = len(catalog)
+        encoder.Encode(progress)
+        if flusher != nil {
+            flusher.Flush()
+        }
+    }
+
+    summary := map[string]interface{}{
+        "done":        true,
+        "total":       len(catalog),
+        "indexed":     indexed,
+        "failed":      len(failed),
+        "failed_ids":  failed,
+        "duration_ms": time.Since(started).Milliseconds(),
+    }
+    encoder.Encode(summary)
+
+    adminauth.Audit(r, "search_reindex_finished", map[string]interface{}{
+        "total":   len(catalog),
+        "indexed": indexed,
+        "failed":  len(failed),
+    })
+    log.Printf("Search reindex finished: %d/%d products indexed in %s", indexed, len(catalog), time.Since(started))
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+    "time"
+
+    "middleware/slo"
+)
+
+func init() {
+    slo.Setup(serviceName, serviceObjectives(), nil)
+}
+
+// SLOs for the product service. Product pages read from memory, so the
+// latency target is tight.
+func serviceObjectives() []slo.Objective {
+    return []slo.Objective{
+        {
+            Name:        "product_read_latency",
+            Description: "99% of product reads complete within 200ms",
+            Method:      "GET",
+            Route:       "/api/products/{id}",
+            Target:      0.99,
+            Latency:     200 * time.Millisecond,
+        },
+        {
+            Name:        "availability",
+            Description: "99.9% of requests succeed",
+            Target:      0.999,
+        },
+    }
+}
@@ -1,8 +1,14 @@
-from fastapi import FastAPI, HTTPException, Query
+from fastapi import FastAPI, HTTPException, Query, Request, Header, Depends
 from fastapi.middleware.cors import CORSMiddleware
+from fastapi.responses import JSONResponse
+from starlette.routing import Match
 from pydantic import BaseModel
-from typing import List, Dict, Optional, Set
+from typing import Any, List, Dict, Optional, Set
 import re
+import os
+from datetime import datetime, timezone
+from email.utils import format_datetime
+import hmac
 import json
 import time
 from collections import defaultdict, Counter
@@ -17,14 +23,175 @@ logger = logging.getLogger(__name__)
 
 app = FastAPI(title="Search & Optimization Service", version="1.0.0")
 
+# CORS policy from CORS_* settings, matching the Go services: origins are
+# listed explicitly (the local frontend when APP_ENV=development, none
+# otherwise), and "*" turns credentialed requests off
+def cors_list(name: str, fallback: List[str]) -> List[str]:
+    value = os.getenv(name)
+    if value is None:
+        return fallback
+    return [item.strip() for item in value.split(",") if item.strip()]
+
+
+def cors_options() -> Dict[str, Any]:
+    fallback_origins = (
+        ["http://localhost:3000", "http://127.0.0.1:3000", "http://localhost"]
+        if os.getenv("APP_ENV") == "development"
+        else []
+    )
+    origins = cors_list("CORS_ALLOWED_ORIGINS", fallback_origins)
+    any_origin = "*" in origins
+    try:
+        max_age = max(int(os.getenv("CORS_MAX_AGE_SECONDS", "600")), 0)
+    except ValueError:
+        max_age = 600
+
+    return {
+        "allow_origins": ["*"] if any_origin else origins,
+        "allow_methods": cors_list("CORS_ALLOWED_METHODS", ["GET", "POST", "PUT", "DELETE", "OPTIONS"]),
+        "allow_headers": cors_list(
+            "CORS_ALLOWED_HEADERS",
+            ["Authorization", "Content-Type", "Accept", "Accept-Language", "X-API-Key",
+             "X-Request-ID", "X-Acting-As", "traceparent"],
+        ),
+        "expose_headers": ["X-Request-ID", "X-Error-Code", "Content-Language", "API-Version",
+                           "Deprecation", "Sunset", "Link", "Retry-After"],
+        "allow_credentials": not any_origin and os.getenv("CORS_ALLOW_CREDENTIALS") != "false",
+        "max_age": max_age,
+    }
+
+
 # CORS middleware
-app.add_middleware(
-    CORSMiddleware,
-    allow_origins=["*"],
-    allow_credentials=True,
-    allow_methods=["*"],
-    allow_headers=["*"],
-)
+app.add_middleware(CORSMiddleware, **cors_options())
+
+# API versions, oldest first. Routes are served under /api/<version>/... and
+# under the legacy unversioned /api/... paths, which alias the default
+# version. To change an endpoint in a new version, add the version here and
+# declare the route with its /api/<version>/ path; versioned requests with no
+# dedicated route fall through to the unversioned handlers.
+API_VERSIONS = ["v1"]
+DEFAULT_API_VERSION = "v1"
+API_VERSION_PATH = re.compile(r"^/api/(v\d+)(?=/|$)")
+
+def parse_api_deprecations(spec: str) -> Dict[str, Optional[datetime]]:
+    """Parse API_DEPRECATIONS ("v1=2027-06-30,v2") into version -> sunset date"""
+    deprecations = {}
+    for entry in spec.split(","):
+        name, _, date = entry.strip().partition("=")
+        if not name:
+            continue
+        if name not in API_VERSIONS:
+            logger.warning(f"Ignoring API_DEPRECATIONS entry for unknown version {name}")
+            continue
+        sunset = None
+        if date:
+            try:
+                sunset = datetime.strptime(date, "%Y-%m-%d").replace(tzinfo=timezone.utc)
+            except ValueError:
+                logger.warning(f"Ignoring invalid sunset date {date} for API {name}")
+                continue
+        deprecations[name] = sunset
+    return deprecations
+
+API_DEPRECATIONS = parse_api_deprecations(os.getenv("API_DEPRECATIONS", ""))
+# Requests served per (version, legacy unversioned path)
+api_version_requests = defaultdict(int)
+
+@app.middleware("http")
+async def api_version_middleware(request: Request, call_next):
+    """Tag responses with the API version served, add Deprecation/Sunset/Link
+    headers (RFC 8594) for deprecated versions, and route /api/<version>/...
+    to the unversioned handlers"""
+    path = request.scope["path"]
+    match = API_VERSION_PATH.match(path)
+    if not match and not path.startswith("/api/"):
+        return await call_next(request)
+
+    version = match.group(1) if match else DEFAULT_API_VERSION
+    if version not in API_VERSIONS:
+        return JSONResponse(status_code=404, content={"detail": f"Unknown API version {version}"})
+    api_version_requests[(version, not match)] += 1
+
+    unversioned = "/api" + path[match.end():] if match else path
+    headers = {"API-Version": version}
+    if version in API_DEPRECATIONS:
+        headers["Deprecation"] = "true"
+        index = API_VERSIONS.index(version)
+        if index + 1 < len(API_VERSIONS):
+            resource = unversioned.split("/")[2] if unversioned.count("/") >= 2 else ""
+            headers["Link"] = f'</api/{API_VERSIONS[index + 1]}/{resource}>; rel="successor-version"'
+        sunset = API_DEPRECATIONS[version]
+        if sunset:
+            headers["Sunset"] = format_datetime(sunset, usegmt=True)
+            if datetime.now(timezone.utc) > sunset:
+                return JSONResponse(status_code=410, headers=headers,
+                                    content={"detail": f"API {version} was retired on {sunset:%Y-%m-%d}"})
+
+    if match and not any(route.matches(request.scope)[0] == Match.FULL for route in app.router.routes):
+        request.scope["path"] = unversioned
+
+    response = await call_next(request)
+    response.headers.update(headers)
+    return response
+
+def api_version_metrics() -> str:
+    """Prometheus metrics for API version usage"""
+    metrics = """
+# HELP api_version_requests_total Requests served per API version (legacy = unversioned /api paths)
+# TYPE api_version_requests_total counter
+"""
+    for version in API_VERSIONS:
+        for legacy in (False, True):
+            if legacy and version != DEFAULT_API_VERSION:
+                continue
+            count = api_version_requests[(version, legacy)]
+            metrics += f'api_version_requests_total{{version="{version}",legacy="{str(legacy).lower()}"}} {count}\n'
+
+    metrics += """
+# HELP api_version_deprecated Whether an API version is deprecated
+# TYPE api_version_deprecated gauge
+"""
+    for version in API_VERSIONS:
+        metrics += f'api_version_deprecated{{version="{version}"}} {int(version in API_DEPRECATIONS)}\n'
+    return metrics
+
+# Admin endpoints are disabled entirely unless ADMIN_TOKEN is configured
+ADMIN_TOKEN = os.getenv("ADMIN_TOKEN", "")
+SERVICE_NAME = "search-service"
+# IDs created by tests and load generators; scoped clears (?scope=test) only remove these
+TEST_DATA_PREFIX = "test-"
+
+def audit_admin_action(request: Request, action: str, **details):
+    """Record an audit event for an admin action"""
+    event = {
+        "event": "admin_action",
+        "service": SERVICE_NAME,
+        "action": action,
+        "method": request.method,
+        "path": request.url.path,
+        "remote_addr": request.client.host if request.client else None,
+        "user_agent": request.headers.get("user-agent"),
+        "timestamp": time.time(),
+        **details,
+    }
+    logger.info("AUDIT %s", json.dumps(event))
+
+async def require_admin(request: Request, authorization: str = Header(default="")):
+    """Admin dependency: requires the ADMIN_TOKEN bearer token"""
+    if not ADMIN_TOKEN:
+        raise HTTPException(status_code=403, detail="Admin endpoints disabled: ADMIN_TOKEN not configured")
+    token = authorization[len("Bearer "):] if authorization.startswith("Bearer ") else authorization
+    if not hmac.compare_digest(token.encode(), ADMIN_TOKEN.encode()):
+        audit_admin_action(request, "auth_failed")
+        raise HTTPException(status_code=401, detail="Admin token required")
+
+def confirm_clear(scope: str, confirm: Optional[str]) -> str:
+    """Destructive calls must name the service in ?confirm= and may narrow to ?scope=test"""
+    if scope not in ("all", "test"):
+        raise HTTPException(status_code=400, detail="Scope must be 'all' or 'test'")
+    if confirm != SERVICE_NAME:
+        raise HTTPException(status_code=400, detail=f"Confirmation required: pass ?confirm={SERVICE_NAME}")
+    return scope
 
 # Pydantic models
 class Product(BaseModel):
@@ -34,9 +201,12 @@ class Product(BaseModel):
     categories: List[str]
     price_cents: int
     currency: str
-    images: List[str] = []
+    images: Optional[List[str]] = None  # product-service sends null for empty lists/maps
     stock: int = 0
-    metadata: Dict = {}
+    metadata: Optional[Dict] = None
+
+class ProductBatch(BaseModel):
+    products: List[Product]
 
 class SearchResult(BaseModel):
     product_id: str
@@ -224,7 +394,9 @@ class RecommendationEngine:
         else:
             price_range = "500+"
             
-        self.price_ranges[price_range].append(product_id)
+        # Re-indexing a product must not list it twice
+        if product_id not in self.price_ranges[price_range]:
+            self.price_ranges[price_range].append(product_id)
         
     def get_recommendations(self, product_id: str, limit: int = 5) -> tuple:
         """Get product recommendations"""
@@ -302,38 +474,42 @@ async def health_check():
         }
     }
 
+def add_to_indexes(product: Product):
+    """Add a product to every search structure"""
+    # Store product
+    products_store[product.product_id] = product.dict()
+    
+    # Add to bloom filter
+    bloom_filter.add(product.product_id)
+    
+    # Index for search
+    search_text = f"{product.title} {product.description}"
+    inverted_index.add_document(
+        product.product_id, 
+        search_text, 
+        product.categories
+    )
+    
+    # Add to autocomplete
+    for token in inverted_index.tokenize(product.title):
+        if len(token) > 2:  # Only index meaningful tokens
+            autocomplete_trie.insert(token)
+            
+    for category in product.categories:
+        autocomplete_trie.insert(category)
+        
+    # Add to recommendation engine
+    recommendation_engine.add_product_metadata(
+        product.product_id,
+        product.categories,
+        product.price_cents
+    )
+
 @app.post("/api/search/index/product")
 async def index_product(product: Product):
     """Index a product for search"""
     try:
-        # Store product
-        products_store[product.product_id] = product.dict()
-        
-        # Add to bloom filter
-        bloom_filter.add(product.product_id)
-        
-        # Index for search
-        search_text = f"{product.title} {product.description}"
-        inverted_index.add_document(
-            product.product_id, 
-            search_text, 
-            product.categories
-        )
-        
-        # Add to autocomplete
-        for token in inverted_index.tokenize(product.title):
-            if len(token) > 2:  # Only index meaningful tokens
-                autocomplete_trie.insert(token)
-                
-        for category in product.categories:
-            autocomplete_trie.insert(category)
-            
-        # Add to recommendation engine
-        recommendation_engine.add_product_metadata(
-            product.product_id,
-            product.categories,
-            product.price_cents
-        )
+        add_to_indexes(product)
         
         logger.info(f"Successfully indexed product: {product.product_id}")
         return {"status": "indexed", "product_id": product.product_id}
@@ -342,6 +518,22 @@ async def index_product(product: Product):
         logger.error(f"Error indexing product {product.product_id}: {str(e)}")
         raise HTTPException(status_code=500, detail=f"Indexing failed: {str(e)}")
 
+@app.post("/api/search/index/products")
+async def index_products(batch: ProductBatch):
+    """Index a batch of products (used by full reindexes)"""
+    indexed = 0
+    failed = []
+    for product in batch.products:
+        try:
+            add_to_indexes(product)
+            indexed += 1
+        except Exception as e:
+            logger.error(f"Error indexing product {product.product_id}: {str(e)}")
+            failed.append(product.product_id)
+            
+    logger.info(f"Batch indexed {indexed} products ({len(failed)} failed)")
+    return {"status": "indexed", "indexed": indexed, "failed": failed}
+
 @app.get("/api/search", response_model=Dict)
 async def search_products(
     q: str = Query(..., description="Search query"),
@@ -492,13 +684,24 @@ async def get_search_analytics():
         logger.error(f"Analytics error: {str(e)}")
         raise HTTPException(status_code=500, detail=f"Analytics failed: {str(e)}")
 
-@app.delete("/admin/clear")
-async def clear_all_data():
+@app.delete("/admin/clear", dependencies=[Depends(require_admin)])
+async def clear_all_data(request: Request, scope: str = "all", confirm: Optional[str] = None):
     """Clear all search data (admin endpoint)"""
+    scope = confirm_clear(scope, confirm)
     try:
         global inverted_index, autocomplete_trie, bloom_filter, recommendation_engine
         global products_store, search_analytics
         
+        # Keep non-test products when narrowing to test data; the bloom filter
+        # can't delete, so every structure is rebuilt from what remains
+        kept = []
+        if scope == "test":
+            kept = [
+                Product(**product) for product_id, product in products_store.items()
+                if not (product_id.startswith(TEST_DATA_PREFIX) or (product.get("metadata") or {}).get("test") is True)
+            ]
+        cleared = len(products_store) - len(kept)
+        
         # Reinitialize all data structures
         inverted_index = InvertedIndex()
         autocomplete_trie = AutocompleteTrie()
@@ -506,9 +709,13 @@ async def clear_all_data():
         recommendation_engine = RecommendationEngine()
         
         products_store.clear()
-        search_analytics.clear()
+        if scope == "all":
+            search_analytics.clear()
+        for product in kept:
+            add_to_indexes(product)
         
-        return {"status": "cleared", "message": "All search data has been cleared"}
+        audit_admin_action(request, "clear", scope=scope, cleared=cleared)
+        return {"status": "cleared", "message": "Search data has been cleared", "scope": scope, "cleared": cleared}
         
     except Exception as e:
         logger.error(f"Clear data error: {str(e)}")
@@ -534,6 +741,7 @@ search_service_unique_queries_total {len(search_analytics)}
 # TYPE search_service_index_documents_total counter
 search_service_index_documents_total {inverted_index.total_docs}
 """
+    metrics += api_version_metrics()
     
     from fastapi.responses import PlainTextResponse
     return PlainTextResponse(content=metrics, media_type="text/plain")
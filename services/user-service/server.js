@@ -6,6 +6,7 @@ const helmet = require('helmet');
 const rateLimit = require('express-rate-limit');
 const { v4: uuidv4 } = require('uuid');
 const morgan = require('morgan');
+const crypto = require('crypto');
 
 const app = express();
 const PORT = process.env.PORT || 3001;
@@ -15,12 +16,142 @@ const JWT_SECRET = process.env.JWT_SECRET || 'your-secret-key-here';
 const users = new Map();
 const sessions = new Map();
 
+// CORS policy from CORS_* settings, matching the Go services: origins are
+// listed explicitly (the local frontend when APP_ENV=development, none
+// otherwise), and "*" turns credentialed requests off
+const corsList = (name, fallback) => {
+  const value = process.env[name];
+  if (value === undefined) return fallback;
+  return value.split(',').map((item) => item.trim()).filter(Boolean);
+};
+
+const corsOptions = () => {
+  const fallbackOrigins = process.env.APP_ENV === 'development'
+    ? ['http://localhost:3000', 'http://127.0.0.1:3000', 'http://localhost']
+    : [];
+  const origins = corsList('CORS_ALLOWED_ORIGINS', fallbackOrigins);
+  const anyOrigin = origins.includes('*');
+  const maxAge = parseInt(process.env.CORS_MAX_AGE_SECONDS || '600', 10);
+
+  return {
+    origin: anyOrigin ? '*' : (origins.length > 0 ? origins : false),
+    methods: corsList('CORS_ALLOWED_METHODS', ['GET', 'POST', 'PUT', 'DELETE', 'OPTIONS']),
+    allowedHeaders: corsList('CORS_ALLOWED_HEADERS', ['Authorization', 'Content-Type', 'Accept', 'Accept-Language', 'X-API-Key', 'X-Request-ID', 'X-Acting-As', 'traceparent']),
+    exposedHeaders: ['X-Request-ID', 'X-Error-Code', 'Content-Language', 'API-Version', 'Deprecation', 'Sunset', 'Link', 'Retry-After'],
+    credentials: !anyOrigin && process.env.CORS_ALLOW_CREDENTIALS !== 'false',
+    maxAge: Number.isNaN(maxAge) || maxAge < 0 ? 600 : maxAge
+  };
+};
+
 // Middleware
 app.use(helmet());
-app.use(cors());
+app.use(cors(corsOptions()));
 app.use(morgan('combined'));
 app.use(express.json({ limit: '10mb' }));
 
+// API versions, oldest first. Routes are served under /api/<version>/...
+// and under the legacy unversioned /api/... paths, which alias the default
+// version. To change routes in a new version, add it here and mount an
+// express.Router at /api/<version> ahead of apiVersionMiddleware; requests
+// that router doesn't handle fall through to the existing routes.
+const API_VERSIONS = ['v1'];
+const DEFAULT_API_VERSION = 'v1';
+
+// API_DEPRECATIONS ("v1=2027-06-30,v2") marks versions deprecated, with an
+// optional sunset date after which they answer 410 Gone
+const parseApiDeprecations = (spec) => {
+  const deprecations = new Map();
+  for (const entry of (spec || '').split(',')) {
+    const [name, date] = entry.trim().split('=');
+    if (!name) {
+      continue;
+    }
+    if (!API_VERSIONS.includes(name)) {
+      console.warn(`Ignoring API_DEPRECATIONS entry for unknown version ${name}`);
+      continue;
+    }
+    const sunset = date ? new Date(`${date}T00:00:00Z`) : null;
+    if (sunset && isNaN(sunset.getTime())) {
+      console.warn(`Ignoring invalid sunset date ${date} for API ${name}`);
+      continue;
+    }
+    deprecations.set(name, { sunset });
+  }
+  return deprecations;
+};
+
+const apiDeprecations = parseApiDeprecations(process.env.API_DEPRECATIONS);
+// Requests served per version, split by legacy (unversioned) paths
+const apiVersionRequests = new Map();
+
+// Tag responses with the API version served, add Deprecation/Sunset/Link
+// headers (RFC 8594) for deprecated versions, and route /api/<version>/...
+// to the unversioned handlers
+const apiVersionMiddleware = (req, res, next) => {
+  const match = req.url.match(/^\/api\/(v\d+)(?=[/?]|$)/);
+  if (!match && !req.url.startsWith('/api/')) {
+    return next();
+  }
+
+  const version = match ? match[1] : DEFAULT_API_VERSION;
+  if (!API_VERSIONS.includes(version)) {
+    return res.status(404).json({ error: `Unknown API version ${version}` });
+  }
+
+  const key = `${version}|${!match}`;
+  apiVersionRequests.set(key, (apiVersionRequests.get(key) || 0) + 1);
+
+  const path = match ? '/api' + req.url.slice(match[0].length) : req.url;
+  res.set('API-Version', version);
+
+  const deprecation = apiDeprecations.get(version);
+  if (deprecation) {
+    res.set('Deprecation', 'true');
+    const successor = API_VERSIONS[API_VERSIONS.indexOf(version) + 1];
+    if (successor) {
+      const resource = path.split(/[/?]/)[2];
+      res.set('Link', `</api/${successor}/${resource}>; rel="successor-version"`);
+    }
+    if (deprecation.sunset) {
+      res.set('Sunset', deprecation.sunset.toUTCString());
+      if (Date.now() > deprecation.sunset.getTime()) {
+        const retired = deprecation.sunset.toISOString().slice(0, 10);
+        return res.status(410).json({ error: `API ${version} was retired on ${retired}` });
+      }
+    }
+  }
+
+  req.url = path;
+  next();
+};
+
+const apiVersionMetrics = () => {
+  let metrics = `
+# HELP api_version_requests_total Requests served per API version (legacy = unversioned /api paths)
+# TYPE api_version_requests_total counter
+`;
+  for (const version of API_VERSIONS) {
+    for (const legacy of [false, true]) {
+      if (legacy && version !== DEFAULT_API_VERSION) {
+        continue;
+      }
+      const count = apiVersionRequests.get(`${version}|${legacy}`) || 0;
+      metrics += `api_version_requests_total{version="${version}",legacy="${legacy}"} ${count}\n`;
+    }
+  }
+
+  metrics += `
+# HELP api_version_deprecated Whether an API version is deprecated
+# TYPE api_version_deprecated gauge
+`;
+  for (const version of API_VERSIONS) {
+    metrics += `api_version_deprecated{version="${version}"} ${apiDeprecations.has(version) ? 1 : 0}\n`;
+  }
+  return metrics;
+};
+
+app.use(apiVersionMiddleware);
+
 // Rate limiting
 const limiter = rateLimit({
   windowMs: 15 * 60 * 1000, // 15 minutes
@@ -46,6 +177,58 @@ const authenticateToken = (req, res, next) => {
   });
 };
 
+// Admin endpoints are disabled entirely unless ADMIN_TOKEN is configured
+const ADMIN_TOKEN = process.env.ADMIN_TOKEN || '';
+const SERVICE_NAME = 'user-service';
+// IDs created by tests and load generators; scoped clears (?scope=test) only remove these
+const TEST_DATA_PREFIX = 'test-';
+
+const auditAdminAction = (req, action, details = {}) => {
+  console.log('AUDIT ' + JSON.stringify({
+    event: 'admin_action',
+    service: SERVICE_NAME,
+    action,
+    method: req.method,
+    path: req.originalUrl,
+    remote_addr: req.ip,
+    user_agent: req.get('user-agent'),
+    timestamp: Date.now(),
+    ...details
+  }));
+};
+
+// Admin middleware: requires the ADMIN_TOKEN bearer token
+const requireAdmin = (req, res, next) => {
+  if (!ADMIN_TOKEN) {
+    return res.status(403).json({ error: 'Admin endpoints disabled: ADMIN_TOKEN not configured' });
+  }
+
+  const authHeader = req.headers['authorization'] || '';
+  const token = authHeader.replace(/^Bearer /, '');
+  const expected = Buffer.from(ADMIN_TOKEN);
+  const provided = Buffer.from(token);
+  if (provided.length !== expected.length || !crypto.timingSafeEqual(provided, expected)) {
+    auditAdminAction(req, 'auth_failed');
+    return res.status(401).json({ error: 'Admin token required' });
+  }
+
+  next();
+};
+
+// Destructive calls must name the service in ?confirm= and may narrow to ?scope=test
+const confirmClear = (req, res) => {
+  const scope = req.query.scope || 'all';
+  if (scope !== 'all' && scope !== 'test') {
+    res.status(400).json({ error: "Scope must be 'all' or 'test'" });
+    return null;
+  }
+  if (req.query.confirm !== SERVICE_NAME) {
+    res.status(400).json({ error: `Confirmation required: pass ?confirm=${SERVICE_NAME}` });
+    return null;
+  }
+  return scope;
+};
+
 // Helper functions
 const hashPassword = async (password) => {
   return await bcrypt.hash(password, 10);
@@ -60,7 +243,8 @@ const generateToken = (user) => {
     { 
       user_id: user.user_id, 
       email: user.email,
-      name: user.name 
+      name: user.name,
+      roles: user.roles || ['customer']
     },
     JWT_SECRET,
     { expiresIn: '24h' }
@@ -221,11 +405,120 @@ app.post('/api/users/logout', authenticateToken, (req, res) => {
   }
 });
 
+// Admin endpoint to look up a user's contact details, for services that
+// notify customers (order-service addresses its emails with it)
+app.get('/admin/users/:userId', requireAdmin, (req, res) => {
+  try {
+    const user = users.get(req.params.userId);
+    if (!user) {
+      return res.status(404).json({ error: 'User not found' });
+    }
+
+    res.json({ user_id: user.user_id, email: user.email, name: user.name });
+
+  } catch (error) {
+    console.error('User lookup error:', error);
+    res.status(500).json({ error: 'Internal server error' });
+  }
+});
+
+// Remove users registered with a test email, returning how many were removed
+const clearTestUsers = () => {
+  let cleared = 0;
+  for (const [userId, user] of users.entries()) {
+    if (user.email && user.email.startsWith(TEST_DATA_PREFIX)) {
+      users.delete(userId);
+      sessions.delete(userId);
+      cleared++;
+    }
+  }
+  return cleared;
+};
+
+// Fixture users for end-to-end suites. test-user-1 and test-user-2 have
+// fixture carts in cart-service; test-user-1 and test-user-3 have paid
+// fixture orders in order-service. All share FIXTURE_PASSWORD.
+const FIXTURE_PASSWORD = 'fixture-password';
+const FIXTURE_TIMESTAMP = Date.UTC(2024, 0, 1); // fixtures never carry wall-clock times
+const FIXTURE_USERS = [
+  { user_id: 'test-user-1', email: 'test-user-1@example.com', name: 'Fixture Shopper One' },
+  { user_id: 'test-user-2', email: 'test-user-2@example.com', name: 'Fixture Shopper Two' },
+  { user_id: 'test-user-3', email: 'test-user-3@example.com', name: 'Fixture Shopper Three' }
+];
+
+// Admin endpoint to (re)load the fixture users. Any other test users are
+// removed, so every run starts from the same accounts.
+app.post('/admin/test/fixtures', requireAdmin, async (req, res) => {
+  try {
+    const passwordHash = await hashPassword(FIXTURE_PASSWORD);
+    const removed = clearTestUsers();
+    for (const fixture of FIXTURE_USERS) {
+      users.set(fixture.user_id, {
+        ...fixture,
+        password_hash: passwordHash,
+        addresses: [],
+        created_at: FIXTURE_TIMESTAMP,
+        roles: ['customer']
+      });
+    }
+
+    auditAdminAction(req, 'fixtures_load', { removed, users: FIXTURE_USERS.length });
+    res.json({ message: 'Fixtures loaded', removed, loaded: { users: FIXTURE_USERS.length } });
+  } catch (error) {
+    console.error('Fixture load error:', error);
+    res.status(500).json({ error: 'Internal server error' });
+  }
+});
+
+// Admin endpoint to remove fixtures and any other test users
+app.delete('/admin/test/fixtures', requireAdmin, (req, res) => {
+  const removed = clearTestUsers();
+  auditAdminAction(req, 'fixtures_reset', { removed });
+  res.json({ message: 'Fixtures reset', removed });
+});
+
+// Roles a user can hold. Support and admin agents may act on a customer's
+// behalf in cart and order services (X-Acting-As); the roles are carried
+// in the JWT, so a change applies from the user's next login.
+const USER_ROLES = ['customer', 'support', 'admin'];
+
+// Admin endpoint to set a user's roles
+app.put('/admin/users/:userId/roles', requireAdmin, (req, res) => {
+  const user = users.get(req.params.userId);
+  if (!user) {
+    return res.status(404).json({ error: 'User not found' });
+  }
+
+  const { roles } = req.body;
+  if (!Array.isArray(roles) || roles.length === 0 || !roles.every((role) => USER_ROLES.includes(role))) {
+    return res.status(400).json({ error: `Roles must be a non-empty list of: ${USER_ROLES.join(', ')}` });
+  }
+
+  const previous = user.roles || [];
+  user.roles = [...new Set(roles)];
+  users.set(user.user_id, user);
+
+  auditAdminAction(req, 'set_roles', { user_id: user.user_id, previous_roles: previous, roles: user.roles });
+  const { password_hash, ...safeUser } = user;
+  res.json({ user: safeUser });
+});
+
 // Admin endpoint to clear data
-app.delete('/admin/clear', (req, res) => {
-  users.clear();
-  sessions.clear();
-  res.json({ message: 'All user data cleared' });
+app.delete('/admin/clear', requireAdmin, (req, res) => {
+  const scope = confirmClear(req, res);
+  if (!scope) return;
+
+  let cleared = 0;
+  if (scope === 'test') {
+    cleared = clearTestUsers();
+  } else {
+    cleared = users.size;
+    users.clear();
+    sessions.clear();
+  }
+
+  auditAdminAction(req, 'clear', { scope, cleared });
+  res.json({ message: 'User data cleared', scope, cleared });
 });
 
 // Metrics endpoint
@@ -239,7 +532,7 @@ user_service_users_total ${users.size}
 # HELP user_service_active_sessions_total Total number of active sessions
 # TYPE user_service_active_sessions_total counter
 user_service_active_sessions_total ${sessions.size}
-  `);
+${apiVersionMetrics()}  `);
 });
 
 // Cleanup expired sessions (runs every hour)